@@ -0,0 +1,152 @@
+package iavl
+
+import (
+	"fmt"
+	"math"
+)
+
+// AnomalyKind is the kind of an Anomaly.
+type AnomalyKind int
+
+const (
+	// AnomalyUnbalanced is an inner node whose subtrees differ in height by more than one.
+	AnomalyUnbalanced AnomalyKind = iota + 1
+	// AnomalyHeight is an inner node whose height isn't one more than the largest height of its
+	// subtrees, e.g. a corrupted height field.
+	AnomalyHeight
+	// AnomalySize is an inner node whose size isn't the sum of the sizes of its subtrees.
+	AnomalySize
+	// AnomalyHeightSizeRatio is a subtree with too few or too many leaves for its height, i.e.
+	// fewer than the sparsest balanced tree of the height or more than the complete one.
+	AnomalyHeightSizeRatio
+)
+
+// String implements fmt.Stringer.
+func (k AnomalyKind) String() string {
+	switch k {
+	case AnomalyUnbalanced:
+		return "unbalanced"
+	case AnomalyHeight:
+		return "height"
+	case AnomalySize:
+		return "size"
+	case AnomalyHeightSizeRatio:
+		return "height/size ratio"
+	default:
+		return fmt.Sprintf("AnomalyKind(%d)", int(k))
+	}
+}
+
+// Anomaly is a subtree of a tree deviating from the AVL invariants, found by DetectAnomalies.
+type Anomaly struct {
+	Kind AnomalyKind
+	// Key, Height, Size and Depth are those of the root of the subtree, see NodeInfo.
+	Key    []byte
+	Height int8
+	Size   int64
+	Depth  int
+	// MinKey and MaxKey are the smallest and largest keys of the subtree, the key range involved.
+	MinKey []byte
+	MaxKey []byte
+	// Detail describes the deviation, e.g. the heights of the subtrees.
+	Detail string
+}
+
+// String implements fmt.Stringer.
+func (a Anomaly) String() string {
+	return fmt.Sprintf("%v anomaly at node %X (depth %d, keys %X..%X): %s", a.Kind, a.Key, a.Depth, a.MinKey, a.MaxKey, a.Detail)
+}
+
+// DetectAnomalies walks the tree and reports all subtrees whose heights and sizes deviate from the
+// AVL invariants, in post-order, as a debugging aid for suspected balancing bugs or corrupted
+// height fields. The heights and sizes are those recorded in the nodes, so a corrupted node is
+// reported along with the ancestors it throws off. Unlike the checks of the iavltest package, it
+// doesn't stop at the first violation, and doesn't verify hashes.
+func (t *ImmutableTree) DetectAnomalies() ([]Anomaly, error) {
+	d := &anomalyDetector{}
+	if _, err := t.Accept(d, PostOrder); err != nil {
+		return nil, err
+	}
+	return d.anomalies, nil
+}
+
+// anomalySubtree summarizes a visited subtree for the checks of its parent.
+type anomalySubtree struct {
+	height int8
+	size   int64
+	minKey []byte
+	maxKey []byte
+}
+
+// anomalyDetector is the NodeVisitor of DetectAnomalies, keeping the visited subtrees on a stack.
+type anomalyDetector struct {
+	stack     []anomalySubtree
+	anomalies []Anomaly
+}
+
+var _ NodeVisitor = (*anomalyDetector)(nil)
+
+func (d *anomalyDetector) VisitLeaf(node NodeInfo) bool {
+	d.stack = append(d.stack, anomalySubtree{height: node.Height, size: node.Size, minKey: node.Key, maxKey: node.Key})
+	return false
+}
+
+func (d *anomalyDetector) VisitInner(node NodeInfo) bool {
+	n := len(d.stack)
+	left, right := d.stack[n-2], d.stack[n-1]
+	d.stack = d.stack[:n-2]
+	subtree := anomalySubtree{height: node.Height, size: node.Size, minKey: left.minKey, maxKey: right.maxKey}
+	report := func(kind AnomalyKind, format string, args ...any) {
+		d.anomalies = append(d.anomalies, Anomaly{
+			Kind:   kind,
+			Key:    node.Key,
+			Height: node.Height,
+			Size:   node.Size,
+			Depth:  node.Depth,
+			MinKey: subtree.minKey,
+			MaxKey: subtree.maxKey,
+			Detail: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if diff := int(left.height) - int(right.height); diff > 1 || diff < -1 {
+		report(AnomalyUnbalanced, "the subtrees have heights %d and %d", left.height, right.height)
+	}
+	if expected := max(left.height, right.height) + 1; node.Height != expected {
+		report(AnomalyHeight, "height %d, expected %d from the subtrees", node.Height, expected)
+	}
+	if expected := left.size + right.size; node.Size != expected {
+		report(AnomalySize, "size %d, expected %d from the subtrees", node.Size, expected)
+	}
+	if lo, hi := minAVLLeaves(node.Height), maxAVLLeaves(node.Height); node.Size < lo || node.Size > hi {
+		report(AnomalyHeightSizeRatio, "size %d, expected %d to %d leaves for height %d", node.Size, lo, hi, node.Height)
+	}
+
+	d.stack = append(d.stack, subtree)
+	return false
+}
+
+// minAVLLeaves returns the number of leaves of the sparsest balanced tree of the height, where
+// the subtrees of every inner node differ in height by one, saturated at math.MaxInt64.
+func minAVLLeaves(height int8) int64 {
+	prev, cur := int64(1), int64(1) // the leaves of the heights -1 and 0
+	for h := int8(1); h <= height; h++ {
+		if cur > math.MaxInt64-prev {
+			return math.MaxInt64
+		}
+		prev, cur = cur, prev+cur
+	}
+	return cur
+}
+
+// maxAVLLeaves returns the number of leaves of the complete tree of the height, saturated at
+// math.MaxInt64.
+func maxAVLLeaves(height int8) int64 {
+	if height < 0 {
+		return 0
+	}
+	if height >= 63 {
+		return math.MaxInt64
+	}
+	return int64(1) << height
+}
@@ -0,0 +1,98 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const appHeightKeyPrefix = "app_height/"
+
+// appHeightSegment maps a range of versions to application heights: the segment starts at
+// version, which corresponds to height, and ends where the next segment starts.
+type appHeightSegment struct {
+	version int64
+	height  int64
+}
+
+// ResetAppHeight records that the working version, and the versions saved after it, correspond to
+// application heights starting at appHeight. It is meant for chains performing hard-fork restarts
+// which reset the height while the tree keeps its versions. Until the first reset, app heights
+// are equal to versions. The mapping is written with the batch of the working version, so it is
+// persisted by the next SaveVersion, and removed by a rollback of the version.
+func (tree *MutableTree) ResetAppHeight(appHeight int64) error {
+	if appHeight <= 0 {
+		return fmt.Errorf("app height must be positive, got %d", appHeight)
+	}
+	version := tree.WorkingVersion()
+	segments, err := tree.ndb.getAppHeightSegments()
+	if err != nil {
+		return err
+	}
+	if last := segments[len(segments)-1]; last.version > version {
+		return fmt.Errorf("app height already reset at version %d, after the working version %d", last.version, version)
+	}
+
+	value := make([]byte, int64Size)
+	binary.BigEndian.PutUint64(value, uint64(appHeight))
+	return tree.ndb.batch.Set(appHeightKey(version), value)
+}
+
+// appHeightKey returns the key of the app height segment starting at the version.
+func appHeightKey(version int64) []byte {
+	key := make([]byte, len(appHeightKeyPrefix)+int64Size)
+	copy(key, appHeightKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(appHeightKeyPrefix):], uint64(version))
+	return metadataKeyFormat.Key(key)
+}
+
+// VersionAtAppHeight returns the version corresponding to the given application height. If the
+// height was reached more than once due to resets, the most recent occurrence is returned.
+func (tree *MutableTree) VersionAtAppHeight(appHeight int64) (int64, error) {
+	segments, err := tree.ndb.getAppHeightSegments()
+	if err != nil {
+		return 0, err
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	end := latestVersion
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		version := segment.version + appHeight - segment.height
+		if appHeight >= segment.height && version <= end && version > 0 {
+			return version, nil
+		}
+		end = segment.version - 1
+	}
+	return 0, ErrVersionDoesNotExist
+}
+
+// GetVersionedByAppHeight gets the value at the specified key and the version corresponding to the
+// given application height, see VersionAtAppHeight.
+func (tree *MutableTree) GetVersionedByAppHeight(key []byte, appHeight int64) ([]byte, error) {
+	version, err := tree.VersionAtAppHeight(appHeight)
+	if err != nil {
+		return nil, err
+	}
+	return tree.GetVersioned(key, version)
+}
+
+// getAppHeightSegments returns the recorded app height segments in ascending version order,
+// preceded by the identity mapping in effect before the first reset.
+func (ndb *nodeDB) getAppHeightSegments() ([]appHeightSegment, error) {
+	segments := []appHeightSegment{{version: 0, height: 0}}
+	prefix := metadataKeyFormat.Key([]byte(appHeightKeyPrefix))
+	err := ndb.traversePrefix(prefix, func(k, v []byte) error {
+		if len(k) != len(prefix)+int64Size || len(v) != int64Size {
+			return fmt.Errorf("invalid app height record %X", k)
+		}
+		segments = append(segments, appHeightSegment{
+			version: int64(binary.BigEndian.Uint64(k[len(prefix):])),
+			height:  int64(binary.BigEndian.Uint64(v)),
+		})
+		return nil
+	})
+	return segments, err
+}
@@ -0,0 +1,102 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetVersionedByAppHeight(t *testing.T) {
+	tree := setupMutableTree(false)
+	save := func(value string) {
+		_, err := tree.Set([]byte("k"), []byte(value))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// before any reset, app heights equal versions
+	for i := 1; i <= 5; i++ {
+		save(fmt.Sprintf("pre-%d", i))
+	}
+	version, err := tree.VersionAtAppHeight(3)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+
+	// hard fork restart at height 1, versions 6.. map to heights 1..
+	require.NoError(t, tree.ResetAppHeight(1))
+	for i := 1; i <= 3; i++ {
+		save(fmt.Sprintf("post-%d", i))
+	}
+
+	for height, expected := range map[int64]string{
+		1: "post-1",
+		3: "post-3",
+		4: "pre-4", // not reached after the restart yet
+		5: "pre-5",
+	} {
+		value, err := tree.GetVersionedByAppHeight([]byte("k"), height)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(value), "height %d", height)
+	}
+
+	_, err = tree.VersionAtAppHeight(6)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.VersionAtAppHeight(0)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// the mapping is persisted
+	reloaded := NewMutableTree(tree.ndb.db, 0, false, NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	version, err = reloaded.VersionAtAppHeight(2)
+	require.NoError(t, err)
+	require.Equal(t, int64(7), version)
+
+	require.Error(t, tree.ResetAppHeight(0))
+	require.NoError(t, tree.ResetAppHeight(100))
+	save("jump")
+	version, err = tree.VersionAtAppHeight(100)
+	require.NoError(t, err)
+	require.Equal(t, int64(9), version)
+}
+
+func TestResetAppHeightRollback(t *testing.T) {
+	tree := setupMutableTree(false)
+	save := func() {
+		_, err := tree.Set([]byte("k"), []byte("v"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	for i := 1; i <= 3; i++ {
+		save()
+	}
+
+	// the reset is written with the working version
+	require.NoError(t, tree.ResetAppHeight(100))
+	unsaved := NewMutableTree(tree.ndb.db, 0, false, NewNopLogger())
+	_, err := unsaved.Load()
+	require.NoError(t, err)
+	_, err = unsaved.VersionAtAppHeight(100)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	save()
+	save()
+	version, err := tree.VersionAtAppHeight(101)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), version)
+
+	// a rollback before the reset removes it
+	require.NoError(t, tree.LoadVersionForOverwriting(3))
+	version, err = tree.VersionAtAppHeight(3)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	save()
+	version, err = tree.VersionAtAppHeight(4)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), version)
+	_, err = tree.VersionAtAppHeight(100)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
@@ -0,0 +1,80 @@
+package iavl
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// maxBalanceSlack bounds Options.BalanceSlack, so the heights of the trees stay far below the
+// limit of int8 for any practical size.
+const maxBalanceSlack = 4
+
+// balanceSlack returns the largest height difference of the subtrees of a node left unrotated,
+// see BalanceSlack.
+func (opts Options) balanceSlack() int {
+	return min(max(opts.BalanceSlack, 1), maxBalanceSlack)
+}
+
+// BalanceSlack returns the largest height difference of the subtrees of a node of the tree, one
+// unless it was opened with Options.BalanceSlack.
+func (t *ImmutableTree) BalanceSlack() int {
+	if t.ndb == nil {
+		return 1
+	}
+	return t.ndb.opts.balanceSlack()
+}
+
+// getBalanceSlack returns the balance slack recorded in the database, see setBalanceSlackToBatch,
+// one if none is.
+func (ndb *nodeDB) getBalanceSlack() (int, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(balanceSlackKey)))
+	if err != nil {
+		return 0, err
+	}
+	if bz == nil {
+		return 1, nil
+	}
+	slack, err := strconv.Atoi(string(bz))
+	if err != nil {
+		return 0, fmt.Errorf("invalid balance slack %q: %w", bz, err)
+	}
+	return slack, nil
+}
+
+// checkBalanceSlack fails if the tree was saved with another balance slack than the options, so
+// the trees of the nodes of a network don't silently diverge.
+func (ndb *nodeDB) checkBalanceSlack() error {
+	if ndb.balanceSlackChecked {
+		return nil
+	}
+	slack, err := ndb.getBalanceSlack()
+	if err != nil {
+		return err
+	}
+	if expected := ndb.opts.balanceSlack(); slack != expected {
+		return fmt.Errorf("the tree was saved with the balance slack %d, not %d, see Options.BalanceSlack", slack, expected)
+	}
+	ndb.balanceSlackChecked = true
+	return nil
+}
+
+// setBalanceSlackToBatch records a relaxed balance slack with the first version saved with it,
+// the format flag checked by checkBalanceSlack. The strict balance isn't recorded, so the
+// databases of the trees which don't relax it are unchanged. The slack is only considered checked
+// once the batch is written, so it is recorded again with the next version if the commit fails.
+func (ndb *nodeDB) setBalanceSlackToBatch() error {
+	slack := ndb.opts.balanceSlack()
+	if slack == 1 {
+		return nil
+	}
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if ndb.balanceSlackChecked {
+		return nil
+	}
+	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(balanceSlackKey)), []byte(strconv.Itoa(slack))); err != nil {
+		return err
+	}
+	ndb.balanceSlackUnsaved = true
+	return nil
+}
@@ -0,0 +1,123 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestBalanceSlack(t *testing.T) {
+	// checkBalance returns the height of the subtree, checking the balance of its nodes
+	var checkBalance func(tree *ImmutableTree, node *Node, slack int) int8
+	checkBalance = func(tree *ImmutableTree, node *Node, slack int) int8 {
+		if node.isLeaf() {
+			return 0
+		}
+		left, err := node.getLeftNode(tree)
+		require.NoError(t, err)
+		right, err := node.getRightNode(tree)
+		require.NoError(t, err)
+		lh, rh := checkBalance(tree, left, slack), checkBalance(tree, right, slack)
+		require.LessOrEqual(t, int(lh)-int(rh), slack)
+		require.GreaterOrEqual(t, int(lh)-int(rh), -slack)
+		require.Equal(t, max(lh, rh)+1, node.subtreeHeight)
+		return node.subtreeHeight
+	}
+	// build appends keys in order with some random updates and removals, and returns the tree and
+	// the number of nodes it stored
+	build := func(db dbm.DB, options ...Option) (*MutableTree, int) {
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), options...)
+		_, err := tree.Load()
+		require.NoError(t, err)
+		r := rand.New(rand.NewSource(1))
+		for v := 0; v < 50; v++ {
+			for i := 0; i < 20; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key-%05d", v*20+i)), []byte("value"))
+				require.NoError(t, err)
+			}
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%05d", r.Intn(v*20+20))), []byte("updated"))
+			require.NoError(t, err)
+			_, _, err = tree.Remove([]byte(fmt.Sprintf("key-%05d", r.Intn(v*20+20))))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			checkBalance(tree.ImmutableTree, tree.root, tree.BalanceSlack())
+		}
+		nodes := 0
+		require.NoError(t, tree.ScanRecords(func(kind RecordKind, _, _ []byte) error {
+			if kind == RecordNode {
+				nodes++
+			}
+			return nil
+		}))
+		return tree, nodes
+	}
+
+	strict, _ := build(dbm.NewMemDB())
+	require.Equal(t, 1, strict.BalanceSlack())
+	db := dbm.NewMemDB()
+	relaxed, relaxedNodes := build(db, BalanceSlackOption(3))
+	require.Equal(t, 3, relaxed.BalanceSlack())
+	require.Greater(t, relaxed.Height(), strict.Height())
+	require.NotEqual(t, strict.Hash(), relaxed.Hash())
+
+	// the hashes are deterministic, and the proofs verify as usual
+	other, otherNodes := build(dbm.NewMemDB(), BalanceSlackOption(3))
+	require.Equal(t, relaxed.Hash(), other.Hash())
+	require.Equal(t, relaxedNodes, otherNodes)
+	for _, key := range []string{"key-00000", "key-00500", "key-00999"} {
+		if has, _ := relaxed.Has([]byte(key)); !has {
+			continue
+		}
+		proof, err := relaxed.GetMembershipProof([]byte(key))
+		require.NoError(t, err)
+		ok, err := relaxed.VerifyMembership(proof, []byte(key))
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	// the slack is recorded, and checked on load
+	hash := relaxed.Hash()
+	require.NoError(t, relaxed.Close())
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Load()
+	require.ErrorContains(t, err, "balance slack 3, not 1")
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), BalanceSlackOption(2))
+	_, err = tree.Load()
+	require.ErrorContains(t, err, "balance slack 3, not 2")
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), BalanceSlackOption(3))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, hash, tree.Hash())
+
+	has, err := strict.ndb.db.Has(metadataKeyFormat.Key([]byte(balanceSlackKey)))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestBalanceSlackFailedCommit(t *testing.T) {
+	db := &failingBatchDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), BalanceSlackOption(3))
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	db.failWrites = true
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	require.False(t, tree.ndb.balanceSlackChecked)
+
+	// the slack is recorded with the next version which is saved
+	db.failWrites = false
+	tree.Rollback()
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.True(t, tree.ndb.balanceSlackChecked)
+	slack, err := tree.ndb.getBalanceSlack()
+	require.NoError(t, err)
+	require.Equal(t, 3, slack)
+}
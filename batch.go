@@ -102,6 +102,13 @@ func (b *BatchWithFlusher) Write() error {
 	return nil
 }
 
+// setFlushThreshold changes the threshold to flush the batch to disk, from the next write.
+func (b *BatchWithFlusher) setFlushThreshold(flushThreshold int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.flushThreshold = flushThreshold
+}
+
 func (b *BatchWithFlusher) WriteSync() error {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
@@ -116,6 +123,18 @@ func (b *BatchWithFlusher) WriteSync() error {
 	return nil
 }
 
+// discard drops the writes which weren't flushed to disk yet, and starts a new batch.
+func (b *BatchWithFlusher) discard() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if err := b.batch.Close(); err != nil {
+		return err
+	}
+	b.batch = b.db.NewBatchWithSize(b.flushThreshold)
+	return nil
+}
+
 func (b *BatchWithFlusher) Close() error {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
@@ -0,0 +1,166 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestWorkload_Reproducible(t *testing.T) {
+	for _, dist := range []KeyDistribution{Uniform, Zipfian, Sequential} {
+		cfg := DefaultWorkloadConfig()
+		cfg.Distribution = dist
+		cfg.MinValueSize = 10
+		cfg.ChurnRatio = 0.2
+
+		w1, err := NewWorkload(cfg)
+		require.NoError(t, err)
+		w2, err := NewWorkload(cfg)
+		require.NoError(t, err)
+		ops := w1.Ops(100)
+		require.Equal(t, ops, w2.Ops(100))
+
+		removals := 0
+		for _, op := range ops {
+			require.Len(t, op.Key, cfg.KeySize)
+			if op.Delete {
+				removals++
+				continue
+			}
+			require.GreaterOrEqual(t, len(op.Value), cfg.MinValueSize)
+			require.LessOrEqual(t, len(op.Value), cfg.MaxValueSize)
+		}
+		require.Greater(t, removals, 0)
+	}
+}
+
+func TestWorkload_Distributions(t *testing.T) {
+	cfg := DefaultWorkloadConfig()
+	cfg.KeySpace = 1000
+
+	cfg.Distribution = Sequential
+	w, err := NewWorkload(cfg)
+	require.NoError(t, err)
+	prev := w.NextKey()
+	for i := 0; i < 10; i++ {
+		key := w.NextKey()
+		require.Equal(t, -1, bytes.Compare(prev, key))
+		prev = key
+	}
+
+	// the hottest key of a zipfian workload is drawn far more often than with a uniform one
+	hottest := func(dist KeyDistribution) int {
+		cfg.Distribution = dist
+		w, err := NewWorkload(cfg)
+		require.NoError(t, err)
+		counts := make(map[string]int)
+		top := 0
+		for i := 0; i < 10000; i++ {
+			key := string(w.NextKey())
+			counts[key]++
+			top = max(top, counts[key])
+		}
+		return top
+	}
+	require.Greater(t, hottest(Zipfian), 10*hottest(Uniform))
+
+	cfg.KeySize = 4
+	_, err = NewWorkload(cfg)
+	require.Error(t, err)
+}
+
+func TestScenarios(t *testing.T) {
+	cfg := DefaultWorkloadConfig()
+	cfg.KeySpace = 500
+	cfg.ChurnRatio = 0.1
+	w, err := NewWorkload(cfg)
+	require.NoError(t, err)
+
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 0, false, iavl.NewNopLogger())
+	require.NoError(t, Populate(tree, w, 1000))
+
+	result, err := CommitLatency(tree, w, 5, 50)
+	require.NoError(t, err)
+	require.Equal(t, 5, result.Ops)
+	require.Len(t, result.Latencies, 5)
+	require.Equal(t, int64(6), tree.Version())
+
+	result, err = QueryQPS(tree, w, 100)
+	require.NoError(t, err)
+	require.Equal(t, 100, result.Ops)
+
+	result, err = ImportThroughput(tree)
+	require.NoError(t, err)
+	require.Greater(t, result.Ops, 0)
+	require.Contains(t, result.String(), "import throughput")
+}
+
+func TestRun(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Workload.KeySpace = 500
+	cfg.InitialOps, cfg.Blocks, cfg.OpsPerBlock, cfg.Queries = 1000, 5, 50, 100
+	report, err := Run(cfg)
+	require.NoError(t, err)
+	require.Len(t, report.Scenarios, len(Scenarios))
+	commit, ok := report.Metrics(ScenarioCommit)
+	require.True(t, ok)
+	require.Equal(t, 5, commit.Ops)
+	require.Positive(t, commit.P99Nanos)
+	require.Positive(t, commit.AllocsPerOp)
+	iterate, ok := report.Metrics(ScenarioIterate)
+	require.True(t, ok)
+	require.Positive(t, iterate.Ops)
+
+	bz, err := json.Marshal(report)
+	require.NoError(t, err)
+	var decoded Report
+	require.NoError(t, json.Unmarshal(bz, &decoded))
+	require.Equal(t, report.Scenarios, decoded.Scenarios)
+
+	require.NoError(t, report.Check(Envelope{Name: ScenarioQuery, MinOpsPerSec: 1}))
+	err = report.Check(Envelope{Name: ScenarioCommit, MaxAllocsPerOp: 0.5}, Envelope{Name: "unknown"})
+	require.ErrorContains(t, err, "allocs/op")
+	require.ErrorContains(t, err, "unknown: not run")
+
+	cfg.Scenarios = []string{ScenarioQuery}
+	report, err = Run(cfg)
+	require.NoError(t, err)
+	require.Len(t, report.Scenarios, 1)
+	cfg.Scenarios = []string{"unknown"}
+	_, err = Run(cfg)
+	require.Error(t, err)
+}
+
+func BenchmarkCommitLatency(b *testing.B) {
+	for _, dist := range []KeyDistribution{Uniform, Zipfian, Sequential} {
+		cfg := DefaultWorkloadConfig()
+		cfg.Distribution = dist
+		cfg.ChurnRatio = 0.1
+		w, err := NewWorkload(cfg)
+		require.NoError(b, err)
+		tree := iavl.NewMutableTree(dbm.NewMemDB(), 10000, false, iavl.NewNopLogger())
+		require.NoError(b, Populate(tree, w, 10000))
+
+		b.Run([]string{"uniform", "zipfian", "sequential"}[dist], func(b *testing.B) {
+			result, err := CommitLatency(tree, w, b.N, 1000)
+			require.NoError(b, err)
+			b.ReportMetric(float64(result.Percentile(0.99).Microseconds()), "p99-us")
+		})
+	}
+}
+
+func BenchmarkQueryQPS(b *testing.B) {
+	w, err := NewWorkload(DefaultWorkloadConfig())
+	require.NoError(b, err)
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 10000, false, iavl.NewNopLogger())
+	require.NoError(b, Populate(tree, w, 10000))
+
+	b.ResetTimer()
+	_, err = QueryQPS(tree, w, b.N)
+	require.NoError(b, err)
+}
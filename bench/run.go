@@ -0,0 +1,191 @@
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// The names of the standard scenarios run by Run.
+const (
+	ScenarioCommit  = "commit"
+	ScenarioQuery   = "query"
+	ScenarioIterate = "iterate"
+	ScenarioImport  = "import"
+)
+
+// Scenarios are the standard scenarios, in the order Run runs them.
+var Scenarios = []string{ScenarioCommit, ScenarioQuery, ScenarioIterate, ScenarioImport}
+
+// Config configures Run. The same config runs the same operations, so the results of two runs
+// differ only by the performance of the trees.
+type Config struct {
+	Workload WorkloadConfig `json:"workload"`
+	// InitialOps is the number of operations populating the tree before the scenarios.
+	InitialOps int `json:"initial_ops"`
+	// Blocks and OpsPerBlock are the versions saved by the commit scenario, and their size.
+	Blocks      int `json:"blocks"`
+	OpsPerBlock int `json:"ops_per_block"`
+	// Queries is the number of queries of the query scenario.
+	Queries int `json:"queries"`
+	// CacheSize is the node cache size of the tree.
+	CacheSize int `json:"cache_size"`
+	// Scenarios selects the scenarios to run, by name. Empty runs all of Scenarios.
+	Scenarios []string `json:"scenarios,omitempty"`
+	// Options are the options of the tree, e.g. to compare features.
+	Options []iavl.Option `json:"-"`
+}
+
+// DefaultConfig returns a config of the default workload, populating the tree with 10000
+// operations, then saving 100 blocks of 1000 operations and running 10000 queries.
+func DefaultConfig() Config {
+	return Config{
+		Workload:    DefaultWorkloadConfig(),
+		InitialOps:  10000,
+		Blocks:      100,
+		OpsPerBlock: 1000,
+		Queries:     10000,
+		CacheSize:   10000,
+	}
+}
+
+// Metrics are the machine-readable measurements of a scenario.
+type Metrics struct {
+	Name        string  `json:"name"`
+	Ops         int     `json:"ops"`
+	OpsPerSec   float64 `json:"ops_per_sec"`
+	P50Nanos    int64   `json:"p50_ns,omitempty"`
+	P99Nanos    int64   `json:"p99_ns,omitempty"`
+	AllocsPerOp float64 `json:"allocs_per_op"`
+	BytesPerOp  float64 `json:"bytes_per_op"`
+}
+
+// newMetrics returns the metrics of a result.
+func newMetrics(name string, r Result) Metrics {
+	m := Metrics{
+		Name:        name,
+		Ops:         r.Ops,
+		OpsPerSec:   r.OpsPerSec(),
+		P50Nanos:    int64(r.Percentile(0.5)),
+		P99Nanos:    int64(r.Percentile(0.99)),
+		AllocsPerOp: r.AllocsPerOp(),
+	}
+	if r.Ops > 0 {
+		m.BytesPerOp = float64(r.AllocBytes) / float64(r.Ops)
+	}
+	return m
+}
+
+// Report is the result of Run, meant to be encoded as JSON, e.g. to be stored by CI.
+type Report struct {
+	GoVersion string    `json:"go_version"`
+	GOOS      string    `json:"goos"`
+	GOARCH    string    `json:"goarch"`
+	Config    Config    `json:"config"`
+	Scenarios []Metrics `json:"scenarios"`
+}
+
+// Metrics returns the metrics of the named scenario, if it was run.
+func (r *Report) Metrics(name string) (Metrics, bool) {
+	for _, m := range r.Scenarios {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Metrics{}, false
+}
+
+// Run populates a tree in memory with the workload of the config, and runs the selected standard
+// scenarios against it, in the order of Scenarios. Each scenario continues the workload where the
+// previous one left it.
+func Run(cfg Config) (*Report, error) {
+	selected := cfg.Scenarios
+	if len(selected) == 0 {
+		selected = Scenarios
+	}
+	for _, name := range selected {
+		if !slices.Contains(Scenarios, name) {
+			return nil, fmt.Errorf("unknown scenario %q", name)
+		}
+	}
+	w, err := NewWorkload(cfg.Workload)
+	if err != nil {
+		return nil, err
+	}
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), cfg.CacheSize, false, iavl.NewNopLogger(), cfg.Options...)
+	if err := Populate(tree, w, cfg.InitialOps); err != nil {
+		return nil, err
+	}
+
+	report := &Report{GoVersion: runtime.Version(), GOOS: runtime.GOOS, GOARCH: runtime.GOARCH, Config: cfg}
+	for _, name := range Scenarios {
+		if !slices.Contains(selected, name) {
+			continue
+		}
+		var result Result
+		switch name {
+		case ScenarioCommit:
+			result, err = CommitLatency(tree, w, cfg.Blocks, cfg.OpsPerBlock)
+		case ScenarioQuery:
+			result, err = QueryQPS(tree, w, cfg.Queries)
+		case ScenarioIterate:
+			result, err = IterateThroughput(tree)
+		case ScenarioImport:
+			result, err = ImportThroughput(tree)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("scenario %s: %w", name, err)
+		}
+		report.Scenarios = append(report.Scenarios, newMetrics(name, result))
+	}
+	return report, nil
+}
+
+// Envelope bounds the metrics of a scenario, e.g. for a CI job to fail on a performance
+// regression for the workload of its chain. Zero bounds are not checked.
+type Envelope struct {
+	Name           string        `json:"name"`
+	MinOpsPerSec   float64       `json:"min_ops_per_sec,omitempty"`
+	MaxP50         time.Duration `json:"max_p50_ns,omitempty"`
+	MaxP99         time.Duration `json:"max_p99_ns,omitempty"`
+	MaxAllocsPerOp float64       `json:"max_allocs_per_op,omitempty"`
+	MaxBytesPerOp  float64       `json:"max_bytes_per_op,omitempty"`
+}
+
+// Check returns an error listing the metrics of the report outside of their envelopes, including
+// the envelopes of scenarios the report lacks.
+func (r *Report) Check(envelopes ...Envelope) error {
+	var violations []string
+	for _, e := range envelopes {
+		m, ok := r.Metrics(e.Name)
+		if !ok {
+			violations = append(violations, fmt.Sprintf("%s: not run", e.Name))
+			continue
+		}
+		if e.MinOpsPerSec > 0 && m.OpsPerSec < e.MinOpsPerSec {
+			violations = append(violations, fmt.Sprintf("%s: %.0f ops/s, below %.0f", e.Name, m.OpsPerSec, e.MinOpsPerSec))
+		}
+		if e.MaxP50 > 0 && time.Duration(m.P50Nanos) > e.MaxP50 {
+			violations = append(violations, fmt.Sprintf("%s: p50 %v, above %v", e.Name, time.Duration(m.P50Nanos), e.MaxP50))
+		}
+		if e.MaxP99 > 0 && time.Duration(m.P99Nanos) > e.MaxP99 {
+			violations = append(violations, fmt.Sprintf("%s: p99 %v, above %v", e.Name, time.Duration(m.P99Nanos), e.MaxP99))
+		}
+		if e.MaxAllocsPerOp > 0 && m.AllocsPerOp > e.MaxAllocsPerOp {
+			violations = append(violations, fmt.Sprintf("%s: %.1f allocs/op, above %.1f", e.Name, m.AllocsPerOp, e.MaxAllocsPerOp))
+		}
+		if e.MaxBytesPerOp > 0 && m.BytesPerOp > e.MaxBytesPerOp {
+			violations = append(violations, fmt.Sprintf("%s: %.0f B/op, above %.0f", e.Name, m.BytesPerOp, e.MaxBytesPerOp))
+		}
+	}
+	if len(violations) > 0 {
+		return errors.New("performance envelope exceeded: " + strings.Join(violations, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// Result holds the measurements of a scenario.
+type Result struct {
+	Name string
+	// Ops is the number of operations measured, e.g. blocks, queries or imported nodes.
+	Ops      int
+	Duration time.Duration
+	// Latencies of the individual operations, if they were measured one by one.
+	Latencies []time.Duration
+	// Allocs and AllocBytes are the heap allocations during the measured operations.
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+// OpsPerSec returns the throughput of the scenario.
+func (r Result) OpsPerSec() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Duration.Seconds()
+}
+
+// Percentile returns the latency below which the fraction p of the operations completed.
+func (r Result) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(r.Latencies)
+	slices.Sort(sorted)
+	i := int(p * float64(len(sorted)))
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// AllocsPerOp returns the average number of heap allocations of an operation.
+func (r Result) AllocsPerOp() float64 {
+	if r.Ops == 0 {
+		return 0
+	}
+	return float64(r.Allocs) / float64(r.Ops)
+}
+
+// allocCounter measures the heap allocations of a span. Reading them stops the world briefly, so
+// they are read outside of the timed spans.
+type allocCounter struct {
+	mallocs, bytes uint64
+}
+
+func startAllocs() allocCounter {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return allocCounter{mallocs: ms.Mallocs, bytes: ms.TotalAlloc}
+}
+
+// stop adds the allocations since the start to the result.
+func (c allocCounter) stop(r *Result) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r.Allocs += ms.Mallocs - c.mallocs
+	r.AllocBytes += ms.TotalAlloc - c.bytes
+}
+
+// String returns a summary of the result.
+func (r Result) String() string {
+	s := fmt.Sprintf("%s: %d ops in %v (%.0f ops/s)", r.Name, r.Ops, r.Duration, r.OpsPerSec())
+	if len(r.Latencies) > 0 {
+		s += fmt.Sprintf(", p50 %v, p99 %v", r.Percentile(0.5), r.Percentile(0.99))
+	}
+	if r.Allocs > 0 {
+		s += fmt.Sprintf(", %.1f allocs/op", r.AllocsPerOp())
+	}
+	return s
+}
+
+// Populate applies n operations of the workload to the tree and saves a version.
+func Populate(tree *iavl.MutableTree, w *Workload, n int) error {
+	for i := 0; i < n; i++ {
+		if err := apply(tree, w.NextOp()); err != nil {
+			return err
+		}
+	}
+	_, _, err := tree.SaveVersion()
+	return err
+}
+
+func apply(tree *iavl.MutableTree, op Op) error {
+	if op.Delete {
+		_, _, err := tree.Remove(op.Key)
+		return err
+	}
+	_, err := tree.Set(op.Key, op.Value)
+	return err
+}
+
+// CommitLatency applies blocks of opsPerBlock operations of the workload and measures the
+// latency of saving each block as a version.
+func CommitLatency(tree *iavl.MutableTree, w *Workload, blocks, opsPerBlock int) (Result, error) {
+	result := Result{Name: "commit latency", Latencies: make([]time.Duration, 0, blocks)}
+	for b := 0; b < blocks; b++ {
+		for i := 0; i < opsPerBlock; i++ {
+			if err := apply(tree, w.NextOp()); err != nil {
+				return result, err
+			}
+		}
+		allocs := startAllocs()
+		start := time.Now()
+		if _, _, err := tree.SaveVersion(); err != nil {
+			return result, err
+		}
+		latency := time.Since(start)
+		allocs.stop(&result)
+		result.Latencies = append(result.Latencies, latency)
+		result.Duration += latency
+		result.Ops++
+	}
+	return result, nil
+}
+
+// QueryQPS measures the rate of queries of the workload keys against the latest version.
+func QueryQPS(tree *iavl.MutableTree, w *Workload, queries int) (Result, error) {
+	result := Result{Name: "query qps", Ops: queries}
+	keys := make([][]byte, queries)
+	for i := range keys {
+		keys[i] = w.NextKey()
+	}
+	allocs := startAllocs()
+	start := time.Now()
+	for _, key := range keys {
+		if _, err := tree.Get(key); err != nil {
+			return result, err
+		}
+	}
+	result.Duration = time.Since(start)
+	allocs.stop(&result)
+	return result, nil
+}
+
+// IterateThroughput measures the rate of iterating over all keys of the latest version, in
+// ascending order.
+func IterateThroughput(tree *iavl.MutableTree) (Result, error) {
+	result := Result{Name: "iterate throughput"}
+	itree, err := tree.GetImmutable(tree.Version())
+	if err != nil {
+		return result, err
+	}
+	allocs := startAllocs()
+	start := time.Now()
+	itr, err := itree.Iterator(nil, nil, true)
+	if err != nil {
+		return result, err
+	}
+	for ; itr.Valid(); itr.Next() {
+		result.Ops++
+	}
+	if err := itr.Error(); err != nil {
+		return result, err
+	}
+	if err := itr.Close(); err != nil {
+		return result, err
+	}
+	result.Duration = time.Since(start)
+	allocs.stop(&result)
+	return result, nil
+}
+
+// ImportThroughput exports the latest version of the tree and measures the rate of importing its
+// nodes into an empty tree.
+func ImportThroughput(tree *iavl.MutableTree) (Result, error) {
+	result := Result{Name: "import throughput"}
+	itree, err := tree.GetImmutable(tree.Version())
+	if err != nil {
+		return result, err
+	}
+	exporter, err := itree.Export()
+	if err != nil {
+		return result, err
+	}
+	defer exporter.Close()
+
+	var nodes []*iavl.ExportNode
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, iavl.ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	target := iavl.NewMutableTree(dbm.NewMemDB(), 0, false, iavl.NewNopLogger())
+	allocs := startAllocs()
+	start := time.Now()
+	importer, err := target.Import(tree.Version())
+	if err != nil {
+		return result, err
+	}
+	defer importer.Close()
+	for _, node := range nodes {
+		if err := importer.Add(node); err != nil {
+			return result, err
+		}
+	}
+	if err := importer.Commit(); err != nil {
+		return result, err
+	}
+	result.Duration = time.Since(start)
+	allocs.stop(&result)
+	result.Ops = len(nodes)
+	return result, nil
+}
@@ -0,0 +1,170 @@
+// Package bench provides reproducible workloads and standard scenarios for measuring the
+// performance of IAVL trees, so that changes can be compared consistently across releases. Run
+// runs the standard scenarios and reports machine-readable metrics, which Report.Check compares
+// with performance envelopes, e.g. to gate the CI of a chain on its workload shape.
+package bench
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+)
+
+// KeyDistribution selects how the keys of a workload are drawn from its key space.
+type KeyDistribution int
+
+const (
+	// Uniform draws every key of the key space with the same probability.
+	Uniform KeyDistribution = iota
+	// Zipfian draws a few hot keys most of the time, like account balances on a busy chain.
+	Zipfian
+	// Sequential walks the key space in order, wrapping around at its end.
+	Sequential
+)
+
+// minKeySize is the size of the key space index encoded in every key.
+const minKeySize = 8
+
+// WorkloadConfig configures a Workload. The same config always generates the same operations.
+type WorkloadConfig struct {
+	Seed         int64           `json:"seed"`
+	Distribution KeyDistribution `json:"distribution"`
+	// KeySpace is the number of distinct keys.
+	KeySpace uint64 `json:"key_space"`
+	// KeySize is the size of the keys, at least 8 bytes.
+	KeySize int `json:"key_size"`
+	// MinValueSize and MaxValueSize bound the sizes of the values, which are drawn uniformly.
+	MinValueSize int `json:"min_value_size"`
+	MaxValueSize int `json:"max_value_size"`
+	// ChurnRatio is the fraction of the operations which remove a key instead of setting it.
+	ChurnRatio float64 `json:"churn_ratio"`
+	// ZipfS is the skew of the Zipfian distribution, greater than 1. Zero uses 1.1.
+	ZipfS float64 `json:"zipf_s,omitempty"`
+}
+
+// DefaultWorkloadConfig returns a uniform workload of 32 byte keys and 100 byte values without
+// removals.
+func DefaultWorkloadConfig() WorkloadConfig {
+	return WorkloadConfig{
+		Seed:         1,
+		Distribution: Uniform,
+		KeySpace:     1 << 20,
+		KeySize:      32,
+		MinValueSize: 100,
+		MaxValueSize: 100,
+	}
+}
+
+// Op is an operation of a workload, removing the key if Delete is set.
+type Op struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// Workload generates a reproducible sequence of keys and operations. It is not safe for
+// concurrent use.
+type Workload struct {
+	cfg  WorkloadConfig
+	rand *rand.Rand
+	zipf *rand.Zipf
+	next uint64
+}
+
+// NewWorkload returns the workload of the given config.
+func NewWorkload(cfg WorkloadConfig) (*Workload, error) {
+	if cfg.KeySpace == 0 {
+		return nil, errors.New("key space must not be empty")
+	}
+	if cfg.KeySize < minKeySize {
+		return nil, errors.New("key size must be at least 8 bytes")
+	}
+	if cfg.MinValueSize < 0 || cfg.MaxValueSize < cfg.MinValueSize {
+		return nil, errors.New("invalid value size bounds")
+	}
+	if cfg.ChurnRatio < 0 || cfg.ChurnRatio > 1 {
+		return nil, errors.New("churn ratio must be between 0 and 1")
+	}
+
+	w := &Workload{
+		cfg:  cfg,
+		rand: rand.New(rand.NewSource(cfg.Seed)), //nolint:gosec // reproducibility matters, not security
+	}
+	switch cfg.Distribution {
+	case Uniform, Sequential:
+	case Zipfian:
+		s := cfg.ZipfS
+		if s == 0 {
+			s = 1.1
+		}
+		if s <= 1 {
+			return nil, errors.New("zipf skew must be greater than 1")
+		}
+		w.zipf = rand.NewZipf(w.rand, s, 1, cfg.KeySpace-1)
+	default:
+		return nil, errors.New("unknown key distribution")
+	}
+	return w, nil
+}
+
+// Key returns the key of the given index of the key space. Sequential workloads use keys in the
+// order of their index, the others spread them over the key space.
+func (w *Workload) Key(index uint64) []byte {
+	key := make([]byte, w.cfg.KeySize)
+	if w.cfg.Distribution == Sequential {
+		binary.BigEndian.PutUint64(key, index)
+		return key
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], index)
+	hash := sha256.Sum256(buf[:])
+	n := copy(key, hash[:])
+	// the index keeps longer keys distinct
+	binary.BigEndian.PutUint64(key[max(n, minKeySize)-minKeySize:], index)
+	return key
+}
+
+// NextKey returns the next key of the workload.
+func (w *Workload) NextKey() []byte {
+	var index uint64
+	switch w.cfg.Distribution {
+	case Sequential:
+		index = w.next % w.cfg.KeySpace
+		w.next++
+	case Zipfian:
+		index = w.zipf.Uint64()
+	default:
+		index = w.rand.Uint64() % w.cfg.KeySpace
+	}
+	return w.Key(index)
+}
+
+// NextValue returns a random value with a size within the configured bounds.
+func (w *Workload) NextValue() []byte {
+	size := w.cfg.MinValueSize
+	if w.cfg.MaxValueSize > size {
+		size += w.rand.Intn(w.cfg.MaxValueSize - size + 1)
+	}
+	value := make([]byte, size)
+	w.rand.Read(value)
+	return value
+}
+
+// NextOp returns the next operation of the workload.
+func (w *Workload) NextOp() Op {
+	key := w.NextKey()
+	if w.cfg.ChurnRatio > 0 && w.rand.Float64() < w.cfg.ChurnRatio {
+		return Op{Key: key, Delete: true}
+	}
+	return Op{Key: key, Value: w.NextValue()}
+}
+
+// Ops returns the next n operations of the workload.
+func (w *Workload) Ops(n int) []Op {
+	ops := make([]Op, n)
+	for i := range ops {
+		ops[i] = w.NextOp()
+	}
+	return ops
+}
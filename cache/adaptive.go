@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"container/list"
+	"runtime"
+)
+
+const (
+	defaultAdjustInterval = 10000
+	defaultTargetHitRate  = 0.9
+)
+
+// AdaptiveConfig configures an adaptive cache.
+type AdaptiveConfig struct {
+	// MinBytes and MaxBytes bound the byte limit of the cache, which starts at MinBytes.
+	MinBytes int64
+	MaxBytes int64
+
+	// SizeOf estimates the number of bytes of memory held by a node.
+	SizeOf func(Node) int
+
+	// AdjustInterval is the number of lookups between two adjustments of the limit.
+	// Defaults to 10000.
+	AdjustInterval int
+
+	// TargetHitRate is the hit rate below which a full cache grows its limit. Defaults to 0.9.
+	TargetHitRate float64
+
+	// HeapLimit is the heap size, as reported by runtime.MemStats.HeapAlloc, above which the cache
+	// shrinks its limit to release memory. Zero disables the memory pressure signal.
+	HeapLimit uint64
+}
+
+// AdaptiveStats reports the state of an adaptive cache.
+type AdaptiveStats struct {
+	LimitBytes int64
+	UsedBytes  int64
+	Hits       uint64
+	Misses     uint64
+}
+
+type adaptiveEntry struct {
+	node Node
+	size int64
+}
+
+// AdaptiveCache is an LRU cache bounded by an estimated byte size rather than a node count.
+// Every AdjustInterval lookups the byte limit is adjusted between MinBytes and MaxBytes: it grows
+// while the cache is full and the hit rate of the last interval is below TargetHitRate, and
+// shrinks while the heap exceeds HeapLimit.
+type AdaptiveCache struct {
+	cfg  AdaptiveConfig
+	dict map[string]*list.Element
+	ll   *list.List
+
+	limit int64
+	used  int64
+
+	hits, misses             uint64
+	windowHits, windowMisses int
+
+	readMemStats func(*runtime.MemStats)
+}
+
+var (
+	_ Cache    = (*AdaptiveCache)(nil)
+	_ Iterable = (*AdaptiveCache)(nil)
+)
+
+// NewAdaptive creates an adaptive cache with the given configuration.
+func NewAdaptive(cfg AdaptiveConfig) *AdaptiveCache {
+	if cfg.AdjustInterval <= 0 {
+		cfg.AdjustInterval = defaultAdjustInterval
+	}
+	if cfg.TargetHitRate <= 0 {
+		cfg.TargetHitRate = defaultTargetHitRate
+	}
+	if cfg.MaxBytes < cfg.MinBytes {
+		cfg.MaxBytes = cfg.MinBytes
+	}
+	return &AdaptiveCache{
+		cfg:          cfg,
+		dict:         make(map[string]*list.Element),
+		ll:           list.New(),
+		limit:        cfg.MinBytes,
+		readMemStats: runtime.ReadMemStats,
+	}
+}
+
+// Add adds the node to the cache. If nodes had to be evicted to stay within the byte limit, the
+// oldest evicted node is returned, otherwise nil.
+func (c *AdaptiveCache) Add(node Node) Node {
+	key := node.GetKey()
+	size := int64(c.cfg.SizeOf(node))
+	if e, exists := c.dict[string(key)]; exists {
+		c.ll.MoveToFront(e)
+		entry := e.Value.(*adaptiveEntry)
+		old := entry.node
+		c.used += size - entry.size
+		entry.node, entry.size = node, size
+		c.evict()
+		return old
+	}
+
+	c.dict[string(key)] = c.ll.PushFront(&adaptiveEntry{node: node, size: size})
+	c.used += size
+	return c.evict()
+}
+
+func (c *AdaptiveCache) Get(key []byte) Node {
+	c.adjust()
+	if e, hit := c.dict[string(key)]; hit {
+		c.hits++
+		c.windowHits++
+		c.ll.MoveToFront(e)
+		return e.Value.(*adaptiveEntry).node
+	}
+	c.misses++
+	c.windowMisses++
+	return nil
+}
+
+func (c *AdaptiveCache) Has(key []byte) bool {
+	_, exists := c.dict[string(key)]
+	return exists
+}
+
+func (c *AdaptiveCache) Len() int {
+	return c.ll.Len()
+}
+
+func (c *AdaptiveCache) Remove(key []byte) Node {
+	if e, exists := c.dict[string(key)]; exists {
+		return c.remove(e)
+	}
+	return nil
+}
+
+// Each implements Iterable.
+func (c *AdaptiveCache) Each(fn func(node Node) bool) {
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		if !fn(e.Value.(*adaptiveEntry).node) {
+			return
+		}
+	}
+}
+
+// Stats returns the current limit, usage and lookup counters of the cache.
+func (c *AdaptiveCache) Stats() AdaptiveStats {
+	return AdaptiveStats{
+		LimitBytes: c.limit,
+		UsedBytes:  c.used,
+		Hits:       c.hits,
+		Misses:     c.misses,
+	}
+}
+
+// adjust updates the byte limit once per interval of lookups.
+func (c *AdaptiveCache) adjust() {
+	lookups := c.windowHits + c.windowMisses
+	if lookups < c.cfg.AdjustInterval {
+		return
+	}
+	hitRate := float64(c.windowHits) / float64(lookups)
+	c.windowHits, c.windowMisses = 0, 0
+
+	if c.cfg.HeapLimit > 0 {
+		var ms runtime.MemStats
+		c.readMemStats(&ms)
+		if ms.HeapAlloc > c.cfg.HeapLimit {
+			c.limit = max(c.cfg.MinBytes, c.limit-c.limit/4)
+			c.evict()
+			return
+		}
+	}
+
+	// growing only helps if the cache is full, i.e. misses are caused by evictions
+	if hitRate < c.cfg.TargetHitRate && c.used >= c.limit-c.limit/10 {
+		c.limit = min(c.cfg.MaxBytes, c.limit+c.limit/4+1)
+	}
+}
+
+// evict removes the least recently used nodes until the cache fits its limit, returning the
+// oldest removed node.
+func (c *AdaptiveCache) evict() Node {
+	var oldest Node
+	for c.used > c.limit && c.ll.Len() > 0 {
+		removed := c.remove(c.ll.Back())
+		if oldest == nil {
+			oldest = removed
+		}
+	}
+	return oldest
+}
+
+func (c *AdaptiveCache) remove(e *list.Element) Node {
+	entry := c.ll.Remove(e).(*adaptiveEntry)
+	delete(c.dict, string(entry.node.GetKey()))
+	c.used -= entry.size
+	return entry.node
+}
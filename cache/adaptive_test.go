@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type sizedNode struct {
+	key  []byte
+	size int
+}
+
+func (n *sizedNode) GetKey() []byte {
+	return n.key
+}
+
+func newSizedNode(i, size int) *sizedNode {
+	return &sizedNode{key: []byte(fmt.Sprintf("key%d", i)), size: size}
+}
+
+func newTestAdaptive(heapLimit uint64) *AdaptiveCache {
+	return NewAdaptive(AdaptiveConfig{
+		MinBytes:       100,
+		MaxBytes:       1000,
+		SizeOf:         func(n Node) int { return n.(*sizedNode).size },
+		AdjustInterval: 10,
+		HeapLimit:      heapLimit,
+	})
+}
+
+func TestAdaptiveCache_ByteLimit(t *testing.T) {
+	c := newTestAdaptive(0)
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, c.Add(newSizedNode(i, 10)))
+	}
+	require.Equal(t, 10, c.Len())
+
+	// a larger node evicts the least recently used ones
+	require.NotNil(t, c.Get([]byte("key0")))
+	evicted := c.Add(newSizedNode(10, 25))
+	require.Equal(t, []byte("key1"), evicted.GetKey())
+	require.Equal(t, int64(95), c.Stats().UsedBytes)
+	require.True(t, c.Has([]byte("key0")))
+	require.False(t, c.Has([]byte("key2")))
+	require.False(t, c.Has([]byte("key3")))
+
+	// replacing a node accounts for its new size
+	old := c.Add(newSizedNode(10, 5))
+	require.Equal(t, 25, old.(*sizedNode).size)
+	require.Equal(t, int64(75), c.Stats().UsedBytes)
+
+	require.NotNil(t, c.Remove([]byte("key10")))
+	require.Nil(t, c.Remove([]byte("key10")))
+	require.Equal(t, int64(70), c.Stats().UsedBytes)
+}
+
+func TestAdaptiveCache_Adjust(t *testing.T) {
+	c := newTestAdaptive(1 << 20)
+	heap := uint64(0)
+	c.readMemStats = func(ms *runtime.MemStats) {
+		ms.HeapAlloc = heap
+	}
+
+	// a full cache missing most lookups grows up to MaxBytes
+	for i := 0; i < 1000; i++ {
+		c.Add(newSizedNode(i, 10))
+		c.Get([]byte("missing"))
+	}
+	stats := c.Stats()
+	require.Equal(t, int64(1000), stats.LimitBytes)
+	require.Equal(t, int64(1000), stats.UsedBytes)
+	require.Equal(t, uint64(1000), stats.Misses)
+
+	// a high hit rate keeps the limit
+	for i := 0; i < 100; i++ {
+		require.NotNil(t, c.Get([]byte("key999")))
+	}
+	require.Equal(t, int64(1000), c.Stats().LimitBytes)
+
+	// memory pressure shrinks the cache down to MinBytes
+	heap = 2 << 20
+	for i := 0; i < 1000; i++ {
+		c.Get([]byte("key999"))
+	}
+	stats = c.Stats()
+	require.Equal(t, int64(100), stats.LimitBytes)
+	require.LessOrEqual(t, stats.UsedBytes, int64(100))
+	require.Equal(t, 10, c.Len())
+}
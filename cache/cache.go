@@ -34,6 +34,14 @@ type Cache interface {
 	Len() int
 }
 
+// Iterable is implemented by the caches which can enumerate their nodes, e.g. to persist the
+// identities of the hot nodes across restarts.
+type Iterable interface {
+	// Each calls fn with the cached nodes, the most recently used first, until it returns false.
+	// fn must not call the cache.
+	Each(fn func(node Node) bool)
+}
+
 // lruCache is an LRU cache implementation.
 // The motivation for using a custom cache implementation is to
 // allow for a custom max policy.
@@ -50,7 +58,10 @@ type lruCache struct {
 	ll              *list.List               // LRU queue of cache elements. Used for deletion.
 }
 
-var _ Cache = (*lruCache)(nil)
+var (
+	_ Cache    = (*lruCache)(nil)
+	_ Iterable = (*lruCache)(nil)
+)
 
 func New(maxElementCount int) Cache {
 	return &lruCache{
@@ -96,6 +107,15 @@ func (c *lruCache) Len() int {
 	return c.ll.Len()
 }
 
+// Each implements Iterable.
+func (c *lruCache) Each(fn func(node Node) bool) {
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		if !fn(e.Value.(Node)) {
+			return
+		}
+	}
+}
+
 func (c *lruCache) Remove(key []byte) Node {
 	if elem, exists := c.dict[string(key)]; exists {
 		return c.removeWithKey(elem, string(key))
@@ -3,6 +3,7 @@ package cache_test
 import (
 	"crypto/rand"
 	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/cosmos/iavl/cache"
@@ -307,3 +308,74 @@ func randBytes(length int) []byte {
 	rand.Read(key) //nolint:errcheck
 	return key
 }
+
+func Test_ShardedCache(t *testing.T) {
+	c := cache.NewSharded(64, 4)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("%d-%d", g, i%32))
+				c.Add(&testNode{key: key})
+				c.Get(key)
+				if i%5 == 0 {
+					c.Remove(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, c.Len(), 64)
+
+	// a full cache keeps the node added last
+	c = cache.NewSharded(2, 4)
+	require.Nil(t, c.Add(&testNode{key: []byte("x")}))
+	require.Nil(t, c.Add(&testNode{key: []byte("y")}))
+	require.NotNil(t, c.Add(&testNode{key: []byte("z")}))
+	require.Equal(t, 2, c.Len())
+	require.True(t, c.Has([]byte("z")))
+
+	// a node is replaced by the node with the same key
+	c = cache.NewSharded(2, 4)
+	node := &testNode{key: []byte("a")}
+	require.Nil(t, c.Add(node))
+	require.Equal(t, node, c.Add(&testNode{key: []byte("a")}))
+	require.True(t, c.Has([]byte("a")))
+	require.NotNil(t, c.Remove([]byte("a")))
+	require.False(t, c.Has([]byte("a")))
+	require.Nil(t, c.Get([]byte("a")))
+}
+
+func Test_Cache_Each(t *testing.T) {
+	keys := func(c cache.Iterable) []string {
+		var keys []string
+		c.Each(func(node cache.Node) bool {
+			keys = append(keys, string(node.GetKey()))
+			return true
+		})
+		return keys
+	}
+	lru := cache.New(3)
+	adaptive := cache.NewAdaptive(cache.AdaptiveConfig{MinBytes: 3, SizeOf: func(cache.Node) int { return 1 }})
+	for _, c := range []cache.Cache{lru, adaptive} {
+		for _, node := range testNodes {
+			c.Add(node)
+		}
+		c.Get([]byte("key1"))
+		require.Equal(t, []string{"key1", "key3", "key2"}, keys(c.(cache.Iterable)))
+	}
+
+	sharded := cache.NewSharded(10, 4)
+	for _, node := range testNodes {
+		sharded.Add(node)
+	}
+	require.ElementsMatch(t, []string{"key1", "key2", "key3"}, keys(sharded))
+	n := 0
+	sharded.Each(func(cache.Node) bool {
+		n++
+		return false
+	})
+	require.Equal(t, 1, n)
+}
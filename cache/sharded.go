@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardedCache is an LRU cache which is safe for concurrent use. The nodes are split in shards by
+// the hash of their key, each one an LRU cache guarded by its own lock, so concurrent lookups of
+// different keys rarely contend. The shards share the bound on the number of nodes, and a full
+// cache evicts the least recently used node of the shard a node is added to, so the eviction order
+// is only approximately LRU.
+type ShardedCache struct {
+	seed            maphash.Seed
+	shards          []cacheShard
+	maxElementCount int64
+	count           atomic.Int64
+}
+
+type cacheShard struct {
+	mtx   sync.Mutex
+	cache *lruCache
+}
+
+var (
+	_ Cache    = (*ShardedCache)(nil)
+	_ Iterable = (*ShardedCache)(nil)
+)
+
+// NewSharded returns a ShardedCache of at most maxElementCount nodes, split in the given number of
+// shards.
+func NewSharded(maxElementCount, shards int) *ShardedCache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &ShardedCache{seed: maphash.MakeSeed(), shards: make([]cacheShard, shards), maxElementCount: int64(maxElementCount)}
+	for i := range c.shards {
+		// the shards are bounded by the count of the whole cache
+		c.shards[i].cache = New(maxElementCount).(*lruCache)
+	}
+	return c
+}
+
+func (c *ShardedCache) shardIndex(key []byte) int {
+	return int(maphash.Bytes(c.seed, key) % uint64(len(c.shards)))
+}
+
+func (c *ShardedCache) shard(key []byte) *cacheShard {
+	return &c.shards[c.shardIndex(key)]
+}
+
+// Add implements Cache.
+func (c *ShardedCache) Add(node Node) Node {
+	i := c.shardIndex(node.GetKey())
+	s := &c.shards[i]
+	s.mtx.Lock()
+	if s.cache.Has(node.GetKey()) {
+		defer s.mtx.Unlock()
+		return s.cache.Add(node)
+	}
+	s.cache.Add(node)
+	s.mtx.Unlock()
+
+	if c.count.Add(1) <= c.maxElementCount {
+		return nil
+	}
+	return c.evict(i)
+}
+
+// evict removes the least recently used node of the shard with the given index, or of the next
+// shard holding a node, keeping the node just added to the shard. A single shard is locked at a
+// time.
+func (c *ShardedCache) evict(i int) Node {
+	for j := 0; j < len(c.shards); j++ {
+		s := &c.shards[(i+j)%len(c.shards)]
+		s.mtx.Lock()
+		if n := s.cache.Len(); n > 1 || (j > 0 && n > 0) {
+			evicted := s.cache.remove(s.cache.ll.Back())
+			s.mtx.Unlock()
+			c.count.Add(-1)
+			return evicted
+		}
+		s.mtx.Unlock()
+	}
+	return nil
+}
+
+// Get implements Cache.
+func (c *ShardedCache) Get(key []byte) Node {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cache.Get(key)
+}
+
+// Has implements Cache.
+func (c *ShardedCache) Has(key []byte) bool {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.cache.Has(key)
+}
+
+// Remove implements Cache.
+func (c *ShardedCache) Remove(key []byte) Node {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	removed := s.cache.Remove(key)
+	if removed != nil {
+		c.count.Add(-1)
+	}
+	return removed
+}
+
+// Len implements Cache.
+func (c *ShardedCache) Len() int {
+	return int(c.count.Load())
+}
+
+// Each implements Iterable. The nodes are enumerated shard by shard, the most recently used first
+// within a shard, with the lock of the shard held.
+func (c *ShardedCache) Each(fn func(node Node) bool) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mtx.Lock()
+		more := true
+		s.cache.Each(func(node Node) bool {
+			more = fn(node)
+			return more
+		})
+		s.mtx.Unlock()
+		if !more {
+			return
+		}
+	}
+}
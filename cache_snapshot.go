@@ -0,0 +1,187 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/cosmos/iavl/cache"
+	"github.com/cosmos/iavl/fastnode"
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// cacheSnapshotMagic starts a cache snapshot, followed by the node keys and the fast node keys,
+// each a count followed by the length-prefixed keys, the most recently used first.
+const cacheSnapshotMagic = "IAVLCACHE1"
+
+// cacheSnapshotChunk is the number of nodes read from the database at a time by
+// LoadCacheSnapshot, so the reads of other users aren't blocked for long.
+const cacheSnapshotChunk = 1024
+
+// SaveCacheSnapshot writes the keys of the nodes and fast nodes in the caches of the tree to a file
+// at path, so LoadCacheSnapshot can warm the caches after a restart. Only the identities of the
+// nodes are saved, not their contents, so the snapshot is a small fraction of the cached memory.
+// The caches which don't implement cache.Iterable are not saved. The file is replaced atomically.
+func (tree *MutableTree) SaveCacheSnapshot(path string) error {
+	var buf bytes.Buffer
+	buf.WriteString(cacheSnapshotMagic)
+
+	tree.ndb.mtx.Lock()
+	nodeKeys := cacheKeys(tree.ndb.nodeCache)
+	tree.ndb.mtx.Unlock()
+	tree.ndb.fastNodeMtx.RLock()
+	fastNodeKeys := cacheKeys(tree.ndb.fastNodeCache)
+	tree.ndb.fastNodeMtx.RUnlock()
+
+	for _, keys := range [][][]byte{nodeKeys, fastNodeKeys} {
+		if err := encoding.EncodeUvarint(&buf, uint64(len(keys))); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := encoding.EncodeBytes(&buf, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	return nil
+}
+
+// cacheKeys returns the keys of the cached nodes, the most recently used first, or nil if the cache
+// can't enumerate them.
+func cacheKeys(c cache.Cache) [][]byte {
+	iterable, ok := c.(cache.Iterable)
+	if !ok {
+		return nil
+	}
+	keys := make([][]byte, 0, c.Len())
+	iterable.Each(func(node cache.Node) bool {
+		keys = append(keys, bytes.Clone(node.GetKey()))
+		return true
+	})
+	return keys
+}
+
+// LoadCacheSnapshot warms the caches of the tree with the nodes and fast nodes saved by
+// SaveCacheSnapshot, reading them from the database, e.g. right after a restart, so the query
+// latency doesn't suffer until the caches are warm again. The nodes deleted since the snapshot was
+// saved, e.g. by pruning, are skipped, and the fast nodes read are those of the latest version.
+func (tree *MutableTree) LoadCacheSnapshot(path string) error {
+	bz, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+	if !bytes.HasPrefix(bz, []byte(cacheSnapshotMagic)) {
+		return errors.New("not a cache snapshot")
+	}
+	bz = bz[len(cacheSnapshotMagic):]
+
+	var sections [2][][]byte
+	for i := range sections {
+		count, n, err := encoding.DecodeUvarint(bz)
+		if err != nil {
+			return fmt.Errorf("invalid cache snapshot: %w", err)
+		}
+		bz = bz[n:]
+		if count > uint64(len(bz)) {
+			return fmt.Errorf("invalid cache snapshot: %d keys in %d bytes", count, len(bz))
+		}
+		keys := make([][]byte, count)
+		for j := range keys {
+			key, n, err := encoding.DecodeBytes(bz)
+			if err != nil {
+				return fmt.Errorf("invalid cache snapshot: %w", err)
+			}
+			// the cached nodes may retain their keys, but not the snapshot
+			keys[j] = bytes.Clone(key)
+			bz = bz[n:]
+		}
+		// the least recently used are added first, so they are evicted first
+		slices.Reverse(keys)
+		sections[i] = keys
+	}
+
+	for keys := range slices.Chunk(sections[0], cacheSnapshotChunk) {
+		if err := tree.ndb.warmNodes(keys); err != nil {
+			return err
+		}
+	}
+	if tree.skipFastStorageUpgrade || !tree.ndb.hasUpgradedToFastStorage() {
+		return nil
+	}
+	for keys := range slices.Chunk(sections[1], cacheSnapshotChunk) {
+		if err := tree.ndb.warmFastNodes(keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmNodes adds the nodes with the given node keys to the node cache, skipping the ones which no
+// longer exist.
+func (ndb *nodeDB) warmNodes(nks [][]byte) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	nodeKeys := make([][]byte, len(nks))
+	for i, nk := range nks {
+		nodeKeys[i] = ndb.storedNodeKey(nk)
+	}
+	bufs, err := multiGet(ndb.db, nodeKeys)
+	if err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		if buf == nil || ndb.nodeCache.Has(nks[i]) {
+			continue
+		}
+		node, err := ndb.decodeNode(nks[i], nodeKeys[i], buf)
+		if err != nil {
+			return err
+		}
+		if node.valueRef {
+			if err := ndb.resolveValue(node); err != nil {
+				return err
+			}
+		}
+		ndb.nodeCache.Add(node)
+	}
+	return nil
+}
+
+// warmFastNodes adds the fast nodes with the given keys to the fast node cache, skipping the ones
+// which no longer exist.
+func (ndb *nodeDB) warmFastNodes(keys [][]byte) error {
+	fastNodeKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		fastNodeKeys[i] = ndb.fastNodeKey(key)
+	}
+
+	// the reads are done with the lock held, like GetFastNode, so a stale fast node isn't cached
+	ndb.fastNodeMtx.RLock()
+	defer ndb.fastNodeMtx.RUnlock()
+	bufs, err := multiGet(ndb.db, fastNodeKeys)
+	if err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		if buf == nil || ndb.fastNodeCache.Has(keys[i]) {
+			continue
+		}
+		fastNode, err := fastnode.DeserializeNode(keys[i], buf)
+		if err != nil {
+			return fmt.Errorf("error reading FastNode %X: %w", keys[i], err)
+		}
+		ndb.fastNodeCache.Add(fastNode)
+	}
+	return nil
+}
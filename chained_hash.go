@@ -0,0 +1,59 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// ChainedHash returns the chained hash of the saved version, which commits to the root hashes of
+// all versions saved before it, see Options.ChainedHashes. Unlike the roots, chained hashes are
+// kept when their versions are pruned. It returns ErrVersionDoesNotExist if the version has no
+// chained hash, e.g. when it was saved without the option.
+func (tree *MutableTree) ChainedHash(version int64) ([]byte, error) {
+	if !tree.ndb.opts.ChainedHashes {
+		return nil, errors.New("chained hashes are not enabled")
+	}
+	hash, err := tree.ndb.getChainedHash(version)
+	if err != nil {
+		return nil, err
+	}
+	if hash == nil {
+		return nil, fmt.Errorf("%w: no chained hash for version %d", ErrVersionDoesNotExist, version)
+	}
+	return hash, nil
+}
+
+// chainHash returns the chained hash of a version with the given root hash, following the version
+// with the previous chained hash, nil for the first version of the chain.
+func chainHash(prevChainedHash, rootHash []byte) []byte {
+	h := sha256.New()
+	h.Write(prevChainedHash)
+	h.Write(rootHash)
+	return h.Sum(nil)
+}
+
+// updateChainedHash writes the chained hash of the version being saved, with the batch of the
+// version. The chain starts with the first version saved with Options.ChainedHashes, and
+// continues from the latest saved version, so gaps from an initial version don't break it.
+func (tree *MutableTree) updateChainedHash(version int64, rootHash []byte) error {
+	if !tree.ndb.opts.ChainedHashes {
+		return nil
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	var prev []byte
+	if latestVersion > 0 {
+		if prev, err = tree.ndb.getChainedHash(latestVersion); err != nil {
+			return err
+		}
+	}
+	return tree.ndb.batch.Set(chainedHashKeyFormat.Key(version), chainHash(prev, rootHash))
+}
+
+// getChainedHash returns the chained hash of the version, or nil if it has none.
+func (ndb *nodeDB) getChainedHash(version int64) ([]byte, error) {
+	return ndb.db.Get(chainedHashKeyFormat.Key(version))
+}
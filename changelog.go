@@ -0,0 +1,383 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxChangelogRecordSize bounds the length prefix accepted by ChangelogReader and
+// IntentLogReader, so a corrupt log can't make them allocate unbounded memory.
+const maxChangelogRecordSize = 1 << 30
+
+// ChangelogRecord is a single entry of the changelog written to Options.ChangelogWriter by
+// SaveVersion. Each record is prefixed with its uvarint encoded length and is the protobuf
+// encoding of:
+//
+//	message ChangelogRecord {
+//	    int64 version = 1;
+//	    bytes root_hash = 2;
+//	    ChangeSet changeset = 3;
+//	    bool committed = 4;
+//	    bool rolled_back = 5;
+//	}
+//
+// The change set holds the Set and Remove operations of the version in the order they were applied,
+// since the shape of the tree, and so its hash, depends on it.
+//
+// The record of a version is written ahead of its commit, and followed by a commit marker, a
+// record with only the version and Committed set, once the commit succeeded. A record without its
+// marker, e.g. of a failed commit or a crash before the marker, is of a version which may not have
+// been saved, and is ignored by ReplayChangelog.
+//
+// A rollback by LoadVersionForOverwriting or DeleteVersionsFrom is recorded once committed by a
+// record with RolledBack set, and the version the tree was rolled back to, so the versions saved
+// again after it replace the deleted ones on replay.
+type ChangelogRecord struct {
+	Version    int64
+	RootHash   []byte
+	ChangeSet  *ChangeSet
+	Committed  bool
+	RolledBack bool
+}
+
+// Marshal returns the length-prefixed encoding of the record.
+func (r *ChangelogRecord) Marshal() ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.Version))
+	if len(r.RootHash) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.RootHash)
+	}
+	if r.ChangeSet != nil {
+		cs, err := r.ChangeSet.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, cs)
+	}
+	if r.Committed {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if r.RolledBack {
+		b = protowire.AppendTag(b, 5, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return append(binary.AppendUvarint(nil, uint64(len(b))), b...), nil
+}
+
+// unmarshal decodes the record from b, without the length prefix.
+func (r *ChangelogRecord) unmarshal(b []byte) error {
+	*r = ChangelogRecord{ChangeSet: &ChangeSet{}}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case (num == 1 || num == 4 || num == 5) && typ == protowire.VarintType:
+			v, m := protowire.ConsumeVarint(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			switch num {
+			case 1:
+				r.Version = int64(v)
+			case 4:
+				r.Committed = v != 0
+			default:
+				r.RolledBack = v != 0
+			}
+			n = m
+		case (num == 2 || num == 3) && typ == protowire.BytesType:
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			if num == 2 {
+				r.RootHash = append([]byte{}, v...)
+			} else if err := r.ChangeSet.Unmarshal(v); err != nil {
+				return fmt.Errorf("failed to decode changeset: %w", err)
+			}
+			n = m
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// ChangelogReader reads the records of a changelog written to Options.ChangelogWriter.
+type ChangelogReader struct {
+	r *bufio.Reader
+}
+
+// NewChangelogReader returns a reader for the changelog in r.
+func NewChangelogReader(r io.Reader) *ChangelogReader {
+	return &ChangelogReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record of the changelog, or io.EOF at its end. A truncated final record,
+// e.g. from a crash during the write, returns io.ErrUnexpectedEOF.
+func (cr *ChangelogReader) Next() (*ChangelogRecord, error) {
+	b, err := readLengthPrefixed(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	record := &ChangelogRecord{}
+	if err := record.unmarshal(b); err != nil {
+		return nil, fmt.Errorf("failed to decode changelog record: %w", err)
+	}
+	return record, nil
+}
+
+// readLengthPrefixed reads a record prefixed with its uvarint encoded length, as written to the
+// changelog and the intent log. It returns io.EOF at the end of r, and io.ErrUnexpectedEOF for a
+// truncated record.
+func readLengthPrefixed(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read record length: %w", err)
+	}
+	if size > maxChangelogRecordSize {
+		return nil, fmt.Errorf("record of %d bytes exceeds the maximum of %d", size, maxChangelogRecordSize)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// recordChange tracks a change of the working tree for the write amplification of the version, and
+// for the shadow tree, the changelog or the value hash index, if one is configured.
+func (tree *MutableTree) recordChange(key, value []byte, deleted bool) {
+	tree.unsavedUserBytes += int64(len(key) + len(value))
+	tree.shadowChange(key, value, deleted)
+	if tree.ndb.opts.ChangelogWriter == nil && !tree.ndb.opts.ValueHashIndex {
+		return
+	}
+	tree.unsavedChanges = append(tree.unsavedChanges, &KVPair{Key: key, Value: value, Delete: deleted})
+}
+
+// writeChangelog appends the record of the given version to the changelog, if one is configured.
+func (tree *MutableTree) writeChangelog(version int64, rootHash []byte) error {
+	if tree.ndb.opts.ChangelogWriter == nil {
+		return nil
+	}
+	cs := &ChangeSet{Pairs: tree.unsavedChanges}
+	return tree.writeChangelogRecord(&ChangelogRecord{Version: version, RootHash: rootHash, ChangeSet: cs})
+}
+
+// writeChangelogCommit appends the commit marker of the given version to the changelog, if one is
+// configured, once the version is committed.
+func (tree *MutableTree) writeChangelogCommit(version int64) error {
+	if tree.ndb.opts.ChangelogWriter == nil {
+		return nil
+	}
+	return tree.writeChangelogRecord(&ChangelogRecord{Version: version, Committed: true})
+}
+
+// writeChangelogRollback appends the record of a rollback to the given version to the changelog,
+// if one is configured, once the rollback is committed.
+func (tree *MutableTree) writeChangelogRollback(version int64) error {
+	if tree.ndb.opts.ChangelogWriter == nil {
+		return nil
+	}
+	return tree.writeChangelogRecord(&ChangelogRecord{Version: version, RolledBack: true})
+}
+
+// writeChangelogRecord appends a record to the changelog.
+func (tree *MutableTree) writeChangelogRecord(record *ChangelogRecord) error {
+	b, err := record.Marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := tree.ndb.opts.ChangelogWriter.Write(b); err != nil {
+		return fmt.Errorf("failed to write changelog record for version %d: %w", record.Version, err)
+	}
+	return nil
+}
+
+// ReplayChangelog applies the records of the changelog in r to the tree, saving one version per
+// record up to and including version upTo, or all of them if upTo is 0. Only the records followed
+// by their commit marker are applied, see ChangelogRecord, so a version whose commit failed is
+// skipped, and replaced by the record of the next attempt to save it. The rollbacks are replayed
+// too, so the versions saved again after one replace the deleted ones, as does a record of a
+// version saved again after a rollback which wasn't recorded. Records of versions the tree already
+// has are skipped, the rest must continue from the working version without gaps. The root hash of
+// every replayed version is checked against the recorded one before it is saved. Returns the last
+// saved version.
+func (tree *MutableTree) ReplayChangelog(r io.Reader, upTo int64) (int64, error) {
+	if tree.hasUnsavedChanges() {
+		return tree.version, ErrUnsavedChanges
+	}
+
+	cr := NewChangelogReader(r)
+	replay := newChangelogReplay(tree, upTo)
+	for {
+		record, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			return tree.version, nil
+		}
+		if err != nil {
+			return tree.version, err
+		}
+		if err := replay.apply(record); err != nil {
+			return tree.version, err
+		}
+	}
+}
+
+// changelogLineageWindow is the number of versions whose recorded root hashes a changelogReplay
+// keeps, to tell whether a rollback deletes versions it replayed.
+const changelogLineageWindow = 1 << 16
+
+// changelogReplay applies the records of a changelog to a tree, in the order they were written.
+type changelogReplay struct {
+	tree *MutableTree
+	upTo int64
+	// pending is the last record read, waiting for its commit marker
+	pending *ChangelogRecord
+	// latest is the latest version of the lineage read so far, the versions since the last
+	// rollback, and hashes the recorded root hashes of its last changelogLineageWindow versions
+	latest int64
+	hashes map[int64][]byte
+}
+
+// newChangelogReplay returns a replay of a changelog onto the tree, up to and including version
+// upTo, or all of them if upTo is 0.
+func newChangelogReplay(tree *MutableTree, upTo int64) *changelogReplay {
+	return &changelogReplay{tree: tree, upTo: upTo, hashes: make(map[int64][]byte)}
+}
+
+// apply applies a record read from the changelog. A record is applied with its commit marker,
+// and replaced by the next record if it has none.
+func (r *changelogReplay) apply(record *ChangelogRecord) error {
+	if record.RolledBack {
+		r.pending = nil
+		return r.rollback(record.Version)
+	}
+	if !record.Committed {
+		r.pending = record
+		return nil
+	}
+	committed := r.pending
+	r.pending = nil
+	if committed == nil || committed.Version != record.Version {
+		return nil
+	}
+
+	// a version saved again was rolled back to, even if the rollback wasn't recorded
+	if committed.Version <= r.latest {
+		if err := r.rollback(committed.Version - 1); err != nil {
+			return err
+		}
+	}
+	r.latest = committed.Version
+	r.hashes[committed.Version] = committed.RootHash
+	delete(r.hashes, committed.Version-changelogLineageWindow)
+
+	// the later records may still roll back to a version up to upTo, and save it again
+	if r.upTo > 0 && committed.Version > r.upTo {
+		return nil
+	}
+	// the tree may have the versions of another lineage, e.g. the one after a later rollback if
+	// the changelog is replayed again from its start, which are then kept unless a rollback
+	// deletes them
+	if committed.Version <= r.tree.version {
+		return nil
+	}
+	if prev, ok := r.hashes[r.tree.version]; ok && committed.Version == r.tree.version+1 && !bytes.Equal(prev, r.tree.lastSaved.Hash()) {
+		return nil
+	}
+	return r.tree.applyChangelogRecord(committed)
+}
+
+// rollback replays a rollback to the given version. The tree is rolled back if its next version
+// is the one of the deleted lineage, or unknown, and kept if it is from another lineage, e.g.
+// replayed from the later records in a previous replay.
+func (r *changelogReplay) rollback(version int64) error {
+	deleted, known := r.hashes[version+1]
+	for v := max(version+1, r.latest-changelogLineageWindow+1); v <= r.latest; v++ {
+		delete(r.hashes, v)
+	}
+	r.latest = min(r.latest, version)
+
+	tree := r.tree
+	if tree.version <= version {
+		return nil
+	}
+	if known {
+		hash, err := tree.savedHash(version + 1)
+		if err != nil || !bytes.Equal(hash, deleted) {
+			return err
+		}
+	}
+	return tree.rollbackTo(version)
+}
+
+// savedHash returns the root hash of a saved version, or nil if it doesn't exist, e.g. was pruned.
+func (tree *MutableTree) savedHash(version int64) ([]byte, error) {
+	if version == tree.version {
+		return tree.lastSaved.Hash(), nil
+	}
+	if !tree.VersionExists(version) {
+		return nil, nil
+	}
+	saved, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	return saved.Hash(), nil
+}
+
+// applyChangelogRecord applies the changes of a record of the working version, and saves the
+// version if its root hash matches the recorded one. The working tree is rolled back otherwise.
+func (tree *MutableTree) applyChangelogRecord(record *ChangelogRecord) error {
+	if version := tree.WorkingVersion(); record.Version != version {
+		return fmt.Errorf("changelog skips from version %d to %d", version, record.Version)
+	}
+
+	for _, pair := range record.ChangeSet.GetPairs() {
+		var err error
+		if pair.Delete {
+			_, _, err = tree.Remove(pair.Key)
+		} else {
+			_, err = tree.Set(pair.Key, pair.Value)
+		}
+		if err != nil {
+			tree.Rollback()
+			return err
+		}
+	}
+
+	if hash := tree.WorkingHash(); !bytes.Equal(hash, record.RootHash) {
+		tree.Rollback()
+		return fmt.Errorf("changelog root hash mismatch at version %d: expected %X, got %X",
+			record.Version, record.RootHash, hash)
+	}
+	_, _, err := tree.SaveVersion()
+	return err
+}
@@ -0,0 +1,252 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestChangelogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ChangelogWriterOption(&buf))
+
+	_, err := tree.Set([]byte("b"), []byte("1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	hash1, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// rolled back changes are not recorded
+	_, err = tree.Set([]byte("c"), []byte("1"))
+	require.NoError(t, err)
+	tree.Rollback()
+
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	hash2, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	hash3, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	r := NewChangelogReader(&buf)
+	expected := []ChangelogRecord{
+		{Version: 1, RootHash: hash1, ChangeSet: &ChangeSet{Pairs: []*KVPair{
+			{Key: []byte("b"), Value: []byte("1")},
+			{Key: []byte("a"), Value: []byte("1")},
+			{Key: []byte("b"), Value: []byte("2")},
+		}}},
+		{Version: 2, RootHash: hash2, ChangeSet: &ChangeSet{Pairs: []*KVPair{
+			{Key: []byte("a"), Delete: true},
+		}}},
+		{Version: 3, RootHash: hash3, ChangeSet: &ChangeSet{}},
+	}
+	for _, want := range expected {
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, want.Version, record.Version)
+		require.Equal(t, want.RootHash, record.RootHash)
+		require.Equal(t, len(want.ChangeSet.Pairs), len(record.ChangeSet.Pairs))
+		for i, pair := range want.ChangeSet.Pairs {
+			require.Equal(t, pair.Key, record.ChangeSet.Pairs[i].Key)
+			require.Equal(t, pair.Value, record.ChangeSet.Pairs[i].Value)
+			require.Equal(t, pair.Delete, record.ChangeSet.Pairs[i].Delete)
+		}
+		// followed by the commit marker
+		record, err = r.Next()
+		require.NoError(t, err)
+		require.Equal(t, want.Version, record.Version)
+		require.True(t, record.Committed)
+		require.Empty(t, record.ChangeSet.GetPairs())
+	}
+	_, err = r.Next()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestChangelogReader_Truncated(t *testing.T) {
+	b, err := (&ChangelogRecord{Version: 1, RootHash: []byte{1, 2, 3}, ChangeSet: &ChangeSet{}}).Marshal()
+	require.NoError(t, err)
+
+	_, err = NewChangelogReader(bytes.NewReader(b[:len(b)-1])).Next()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestChangelogWriter_Error(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ChangelogWriterOption(failingWriter{}))
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+
+	// the version was not committed
+	latest, err := tree.ndb.getLatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), latest)
+}
+
+// changelogRecords returns the encoding of the records.
+func changelogRecords(t *testing.T, records ...*ChangelogRecord) []byte {
+	var b []byte
+	for _, record := range records {
+		bz, err := record.Marshal()
+		require.NoError(t, err)
+		b = append(b, bz...)
+	}
+	return b
+}
+
+func TestReplayChangelog(t *testing.T) {
+	var buf bytes.Buffer
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ChangelogWriterOption(&buf))
+	hashes := make(map[int64][]byte)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte{byte(i), byte(v)}, []byte{byte(v)})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte{byte(v), 0})
+		require.NoError(t, err)
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	changelog := buf.Bytes()
+
+	replayed := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	version, err := replayed.ReplayChangelog(bytes.NewReader(changelog), 3)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	require.Equal(t, hashes[3], replayed.Hash())
+
+	// replaying again continues after the versions the tree already has
+	version, err = replayed.ReplayChangelog(bytes.NewReader(changelog), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), version)
+	require.Equal(t, hashes[5], replayed.Hash())
+	for v := int64(1); v <= 5; v++ {
+		require.True(t, replayed.VersionExists(v))
+	}
+}
+
+func TestReplayChangelog_Uncommitted(t *testing.T) {
+	var buf bytes.Buffer
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ChangelogWriterOption(&buf))
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	hash1, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("1"))
+	require.NoError(t, err)
+	hash2, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// a crash between the commit and the marker of version 2
+	committed := changelogRecords(t, &ChangelogRecord{Version: 2, Committed: true})
+	changelog := bytes.TrimSuffix(buf.Bytes(), committed)
+	replayed := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	version, err := replayed.ReplayChangelog(bytes.NewReader(changelog), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, hash1, replayed.Hash())
+
+	// a failed commit of version 2, followed by the successful one with other changes
+	failed := changelogRecords(t, &ChangelogRecord{Version: 2, RootHash: []byte("phantom"), ChangeSet: &ChangeSet{Pairs: []*KVPair{
+		{Key: []byte("c"), Value: []byte("1")},
+	}}})
+	first := len(changelogRecords(t, &ChangelogRecord{Version: 1, RootHash: hash1, ChangeSet: &ChangeSet{Pairs: []*KVPair{
+		{Key: []byte("a"), Value: []byte("1")},
+	}}}, &ChangelogRecord{Version: 1, Committed: true}))
+	changelog = append(append(append([]byte(nil), buf.Bytes()[:first]...), failed...), buf.Bytes()[first:]...)
+	replayed = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	version, err = replayed.ReplayChangelog(bytes.NewReader(changelog), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	require.Equal(t, hash2, replayed.Hash())
+	has, err := replayed.Has([]byte("c"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestReplayChangelog_Rollback(t *testing.T) {
+	var buf bytes.Buffer
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ChangelogWriterOption(&buf))
+	save := func(value string) {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", tree.WorkingVersion())), []byte(value))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	for i := 0; i < 4; i++ {
+		save("discarded")
+	}
+	require.NoError(t, tree.LoadVersionForOverwriting(2))
+	save("kept")
+	hash := tree.Hash()
+	rollback := changelogRecords(t, &ChangelogRecord{Version: 2, RolledBack: true})
+	require.True(t, bytes.Contains(buf.Bytes(), rollback))
+
+	replay := func(changelog []byte) *MutableTree {
+		replayed := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		version, err := replayed.ReplayChangelog(bytes.NewReader(changelog), 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(3), version)
+		require.Equal(t, hash, replayed.Hash())
+		require.False(t, replayed.VersionExists(4))
+		value, err := replayed.Get([]byte("key-3"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("kept"), value)
+		return replayed
+	}
+	// the versions saved again replace the rolled back ones, and the rollback to version 2 deletes
+	// version 4, which wasn't saved again
+	replayed := replay(buf.Bytes())
+	// the rollback is replayed even if it wasn't recorded, e.g. after a crash, since version 3 is
+	// saved again
+	replay(bytes.Replace(buf.Bytes(), rollback, nil, 1))
+
+	// a tree replayed from the changelog before isn't rolled back by replaying it again
+	reader, err := replayed.GetImmutable(3)
+	require.NoError(t, err)
+	version, err := replayed.ReplayChangelog(bytes.NewReader(buf.Bytes()), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	value, err := reader.Get([]byte("key-3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("kept"), value)
+
+	// a replay up to a version stops at the version saved again
+	replayed = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	version, err = replayed.ReplayChangelog(bytes.NewReader(buf.Bytes()), 3)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	require.Equal(t, hash, replayed.Hash())
+}
+
+func TestReplayChangelog_HashMismatch(t *testing.T) {
+	b := changelogRecords(t, &ChangelogRecord{Version: 1, RootHash: []byte("bogus"), ChangeSet: &ChangeSet{Pairs: []*KVPair{
+		{Key: []byte("a"), Value: []byte("1")},
+	}}}, &ChangelogRecord{Version: 1, Committed: true})
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	version, err := tree.ReplayChangelog(bytes.NewReader(b), 0)
+	require.Error(t, err)
+	require.Equal(t, int64(0), version)
+	require.False(t, tree.VersionExists(1))
+	require.True(t, tree.IsEmpty())
+}
@@ -0,0 +1,148 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// CloneTo copies the given saved versions of the tree into the empty database db, e.g. to migrate
+// a live node to another backend. The versions must be a contiguous range, like the versions of
+// any tree. The node keys are kept, so a node shared by several versions is copied only once, and
+// the copied versions have the same hashes. The nodes are written with the options of the tree,
+// e.g. its key prefixes. The fast node index is copied if the latest version is among the given
+// ones, otherwise it is rebuilt when the clone is loaded.
+func (tree *MutableTree) CloneTo(db corestore.KVStoreWithBatch, versions []int64) error {
+	if len(versions) == 0 {
+		return errors.New("no versions to clone")
+	}
+	versions = slices.Clone(versions)
+	slices.Sort(versions)
+	versions = slices.Compact(versions)
+	for i, version := range versions {
+		if !tree.VersionExists(version) {
+			return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+		}
+		if i > 0 && version != versions[i-1]+1 {
+			return fmt.Errorf("versions to clone must be contiguous, %d is followed by %d", versions[i-1], version)
+		}
+	}
+
+	target := newNodeDB(db, 0, tree.ndb.opts, tree.logger)
+	defer target.Close()
+	latest, err := target.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if latest != 0 {
+		return errors.New("the target database already has versions")
+	}
+
+	// A node which is reachable from a version and older than the previous cloned version was
+	// alive in the previous version too, since nodes are never shared again once orphaned, so its
+	// subtree was copied already.
+	if err := target.setKeyPrefixesToBatch(); err != nil {
+		return err
+	}
+	var prev int64
+	for _, version := range versions {
+		if err := tree.cloneVersionTo(target, version, prev); err != nil {
+			return fmt.Errorf("failed to clone version %d: %w", version, err)
+		}
+		prev = version
+	}
+	if err := target.setCommitMarkerToBatch(prev); err != nil {
+		return err
+	}
+
+	sourceLatest, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	synced, _, err := tree.ndb.isFastIndexSynced()
+	if err != nil {
+		return err
+	}
+	if prev == sourceLatest && synced && !tree.skipFastStorageUpgrade {
+		if err := tree.ndb.traverseFastNodes(func(k, v []byte) error {
+			return target.batch.Set(k, v)
+		}); err != nil {
+			return err
+		}
+		if err := target.SetFastStorageVersionToBatch(prev); err != nil {
+			return err
+		}
+	}
+	return target.Commit()
+}
+
+// cloneVersionTo copies the root record of the version and the nodes reachable from it which are
+// newer than prev.
+func (tree *MutableTree) cloneVersionTo(target *nodeDB, version, prev int64) error {
+	rootRecord, err := tree.ndb.db.Get(nodeKeyFormat.Key(GetRootKey(version)))
+	if err != nil {
+		return err
+	}
+	if rootRecord == nil {
+		// a legacy version, whose root record holds the root hash
+		legacyRoot, err := tree.ndb.db.Get(tree.ndb.legacyRootKey(version))
+		if err != nil {
+			return err
+		}
+		if err := target.batch.Set(tree.ndb.legacyRootKey(version), legacyRoot); err != nil {
+			return err
+		}
+		if len(legacyRoot) == 0 {
+			return nil
+		}
+		return tree.cloneNodeTo(target, legacyRoot, prev)
+	}
+
+	rootKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return err
+	}
+	if rootKey == nil {
+		return target.SaveEmptyRoot(version)
+	}
+	if nk := GetNodeKey(rootKey); len(rootKey) != hashSize && (nk.version != version || nk.nonce != 1) {
+		// the version reuses the root of an earlier one
+		if err := target.SaveRoot(version, nk); err != nil {
+			return err
+		}
+	}
+	return tree.cloneNodeTo(target, rootKey, prev)
+}
+
+// cloneNodeTo copies the node and its subtree, skipping the subtrees of nodes no newer than prev.
+func (tree *MutableTree) cloneNodeTo(target *nodeDB, nk []byte, prev int64) error {
+	node, err := tree.ndb.GetNode(nk)
+	if err != nil {
+		return err
+	}
+	if node.nodeKey.version <= prev {
+		return nil
+	}
+
+	if node.isLegacy {
+		bz, err := tree.ndb.db.Get(tree.ndb.legacyNodeKey(nk))
+		if err != nil {
+			return err
+		}
+		if err := target.batch.Set(tree.ndb.legacyNodeKey(nk), bz); err != nil {
+			return err
+		}
+	} else if err := target.SaveNode(node); err != nil {
+		return err
+	}
+
+	if node.isLeaf() {
+		return nil
+	}
+	if err := tree.cloneNodeTo(target, node.leftNodeKey, prev); err != nil {
+		return err
+	}
+	return tree.cloneNodeTo(target, node.rightNodeKey, prev)
+}
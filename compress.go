@@ -13,7 +13,15 @@ type NodeImporter interface {
 	Add(*ExportNode) error
 }
 
+// nodeImporterFunc adapts a function to NodeImporter.
+type nodeImporterFunc func(*ExportNode) error
+
+func (f nodeImporterFunc) Add(node *ExportNode) error {
+	return f(node)
+}
+
 // CompressExporter wraps the normal exporter to apply some compressions on `ExportNode`:
+// - node hashes are skipped, since they can be recomputed on import
 // - branch keys are skipped
 // - leaf keys are encoded with delta compared with the previous leaf
 // - branch node's version are encoded with delta compared with the max version in it's children
@@ -29,11 +37,22 @@ func NewCompressExporter(exporter NodeExporter) NodeExporter {
 	return &CompressExporter{inner: exporter}
 }
 
+// Header returns the header of the inner exporter with the compressed node encoding.
+func (e *CompressExporter) Header() ExportHeader {
+	header := ExportHeader{FormatVersion: ExportFormatVersion, HashFunction: ExportHashSHA256}
+	if inner, ok := e.inner.(interface{ Header() ExportHeader }); ok {
+		header = inner.Header()
+	}
+	header.NodeEncoding = ExportEncodingCompressed
+	return header
+}
+
 func (e *CompressExporter) Next() (*ExportNode, error) {
 	n, err := e.inner.Next()
 	if err != nil {
 		return nil, err
 	}
+	n.Hash = nil
 
 	if n.Height == 0 {
 		// apply delta encoding to leaf keys
@@ -80,6 +99,9 @@ func (i *CompressImporter) Add(node *ExportNode) error {
 		i.minKeyStack = append(i.minKeyStack, key)
 		i.versionStack = append(i.versionStack, node.Version)
 	} else {
+		if len(i.minKeyStack) < 2 {
+			return fmt.Errorf("%w: inner node precedes its subtrees", ErrExportOrder)
+		}
 		// use the min-key in right branch as the node key
 		node.Key = i.minKeyStack[len(i.minKeyStack)-1]
 		// leave the min-key in left branch in the stack
@@ -170,6 +170,22 @@ func (db *GoLevelDB) Iterator(start, end []byte) (corestore.Iterator, error) {
 	return newGoLevelDBIterator(itr, start, end, false), nil
 }
 
+var _ HintedDB = (*GoLevelDB)(nil)
+
+// NewBatchWithHint implements HintedDB. The hints of batches are not supported by goleveldb.
+func (db *GoLevelDB) NewBatchWithHint(Hint) corestore.Batch {
+	return newGoLevelDBBatch(db)
+}
+
+// IteratorWithHint implements HintedDB, supporting Hint.NoFillCache.
+func (db *GoLevelDB) IteratorWithHint(start, end []byte, ascending bool, hint Hint) (corestore.Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errors.New("key is empty")
+	}
+	itr := db.db.NewIterator(&util.Range{Start: start, Limit: end}, &opt.ReadOptions{DontFillCache: hint.NoFillCache})
+	return newGoLevelDBIterator(itr, start, end, !ascending), nil
+}
+
 // ReverseIterator implements corestore.KVStore.
 func (db *GoLevelDB) ReverseIterator(start, end []byte) (corestore.Iterator, error) {
 	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
@@ -74,6 +74,23 @@ func (db *MemDB) Get(key []byte) ([]byte, error) {
 	return nil, nil
 }
 
+// MultiGet implements MultiGetter.
+func (db *MemDB) MultiGet(keys [][]byte) ([][]byte, error) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	values := make([][]byte, len(keys))
+	for idx, key := range keys {
+		if len(key) == 0 {
+			return nil, errKeyEmpty
+		}
+		if i := db.btree.Get(newKey(key)); i != nil {
+			values[idx] = i.(item).value
+		}
+	}
+	return values, nil
+}
+
 // Has implements DB.
 func (db *MemDB) Has(key []byte) (bool, error) {
 	if len(key) == 0 {
@@ -39,6 +39,30 @@ func (pdb *PrefixDB) Get(key []byte) ([]byte, error) {
 	return value, nil
 }
 
+// MultiGet implements MultiGetter, using a single call if the underlying database implements it.
+func (pdb *PrefixDB) MultiGet(keys [][]byte) ([][]byte, error) {
+	pkeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		if len(key) == 0 {
+			return nil, errors.New("key is empty")
+		}
+		pkeys[i] = pdb.prefixed(key)
+	}
+	if mg, ok := pdb.db.(MultiGetter); ok {
+		return mg.MultiGet(pkeys)
+	}
+
+	values := make([][]byte, len(keys))
+	for i, pkey := range pkeys {
+		value, err := pdb.db.Get(pkey)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
 // Has implements corestore.KVStore.
 func (pdb *PrefixDB) Has(key []byte) (bool, error) {
 	if len(key) == 0 {
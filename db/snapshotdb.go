@@ -0,0 +1,395 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	corestore "cosmossdk.io/core/store"
+	"github.com/google/btree"
+)
+
+// snapshotIteratorChunk is the number of items an iterator of SnapshotDB reads from the B-tree at
+// once.
+const snapshotIteratorChunk = 64
+
+func lessItem(a, b item) bool {
+	return bytes.Compare(a.key, b.key) == -1
+}
+
+// SnapshotDB is an in-memory database backend whose snapshots are O(1): the B-tree is copied on
+// write, so a snapshot shares the nodes of its origin until either of them is modified. It is
+// meant for tests and simulations which fork many trees, e.g. to replay blocks from a common
+// state.
+//
+// Iterators read from a snapshot taken when they are created, so they don't hold a lock and the
+// database can be written while they are open.
+//
+// Like MemDB, all given and returned keys and values are pointers to the in-memory database, so
+// they must be considered read-only.
+type SnapshotDB struct {
+	mtx   sync.RWMutex
+	btree *btree.BTreeG[item]
+}
+
+var (
+	_ corestore.KVStoreWithBatch = (*SnapshotDB)(nil)
+	_ MultiGetter                = (*SnapshotDB)(nil)
+)
+
+// NewSnapshotDB creates a new empty SnapshotDB.
+func NewSnapshotDB() *SnapshotDB {
+	return &SnapshotDB{
+		btree: btree.NewG(bTreeDegree, lessItem),
+	}
+}
+
+// Snapshot returns a copy of the database in O(1). The copy and the database can be modified
+// independently of each other.
+func (db *SnapshotDB) Snapshot() *SnapshotDB {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	// Clone marks the shared nodes as copy-on-write for both trees, so it needs the write lock.
+	return &SnapshotDB{btree: db.btree.Clone()}
+}
+
+// Get implements DB.
+func (db *SnapshotDB) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errKeyEmpty
+	}
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	if i, ok := db.btree.Get(newKey(key)); ok {
+		return i.value, nil
+	}
+	return nil, nil
+}
+
+// MultiGet implements MultiGetter.
+func (db *SnapshotDB) MultiGet(keys [][]byte) ([][]byte, error) {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	values := make([][]byte, len(keys))
+	for idx, key := range keys {
+		if len(key) == 0 {
+			return nil, errKeyEmpty
+		}
+		if i, ok := db.btree.Get(newKey(key)); ok {
+			values[idx] = i.value
+		}
+	}
+	return values, nil
+}
+
+// Has implements DB.
+func (db *SnapshotDB) Has(key []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, errKeyEmpty
+	}
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	return db.btree.Has(newKey(key)), nil
+}
+
+// Set implements DB.
+func (db *SnapshotDB) Set(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if value == nil {
+		return errValueNil
+	}
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	db.btree.ReplaceOrInsert(newPair(key, value))
+	return nil
+}
+
+// SetSync implements DB.
+func (db *SnapshotDB) SetSync(key []byte, value []byte) error {
+	return db.Set(key, value)
+}
+
+// Delete implements DB.
+func (db *SnapshotDB) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	db.btree.Delete(newKey(key))
+	return nil
+}
+
+// DeleteSync implements DB.
+func (db *SnapshotDB) DeleteSync(key []byte) error {
+	return db.Delete(key)
+}
+
+// Close implements DB. It is a noop, like MemDB.Close.
+func (db *SnapshotDB) Close() error {
+	return nil
+}
+
+// Print implements DB.
+func (db *SnapshotDB) Print() error {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	db.btree.Ascend(func(i item) bool {
+		fmt.Printf("[%X]:\t[%X]\n", i.key, i.value)
+		return true
+	})
+	return nil
+}
+
+// Stats implements DB.
+func (db *SnapshotDB) Stats() map[string]string {
+	db.mtx.RLock()
+	defer db.mtx.RUnlock()
+
+	stats := make(map[string]string)
+	stats["database.type"] = "snapshotDB"
+	stats["database.size"] = fmt.Sprintf("%d", db.btree.Len())
+	return stats
+}
+
+// NewBatch implements DB.
+func (db *SnapshotDB) NewBatch() corestore.Batch {
+	return &snapshotDBBatch{db: db, ops: []operation{}}
+}
+
+// NewBatchWithSize implements DB.
+func (db *SnapshotDB) NewBatchWithSize(size int) corestore.Batch {
+	return &snapshotDBBatch{db: db, ops: make([]operation, 0, size)}
+}
+
+// Iterator implements DB.
+func (db *SnapshotDB) Iterator(start, end []byte) (corestore.Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	return newSnapshotDBIterator(db.Snapshot().btree, start, end, false), nil
+}
+
+// ReverseIterator implements DB.
+func (db *SnapshotDB) ReverseIterator(start, end []byte) (corestore.Iterator, error) {
+	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+		return nil, errKeyEmpty
+	}
+	return newSnapshotDBIterator(db.Snapshot().btree, start, end, true), nil
+}
+
+// snapshotDBIterator iterates over a snapshot of a SnapshotDB, reading it in chunks.
+type snapshotDBIterator struct {
+	btree   *btree.BTreeG[item]
+	start   []byte
+	end     []byte
+	reverse bool
+	items   []item
+	idx     int
+	// next is the key after which the next chunk is read, nil if there are no more chunks.
+	next []byte
+	done bool
+}
+
+var _ corestore.Iterator = (*snapshotDBIterator)(nil)
+
+func newSnapshotDBIterator(tree *btree.BTreeG[item], start, end []byte, reverse bool) *snapshotDBIterator {
+	iter := &snapshotDBIterator{
+		btree:   tree,
+		start:   start,
+		end:     end,
+		reverse: reverse,
+		items:   make([]item, 0, snapshotIteratorChunk),
+	}
+	iter.fill(false)
+	return iter
+}
+
+// fill reads the next chunk of items, from the domain start unless resume is set.
+func (iter *snapshotDBIterator) fill(resume bool) {
+	iter.items, iter.idx = iter.items[:0], 0
+	skip := resume
+	visitor := func(i item) bool {
+		if skip && bytes.Equal(i.key, iter.next) {
+			skip = false
+			return true
+		}
+		if iter.reverse && iter.start != nil && bytes.Compare(i.key, iter.start) < 0 {
+			return false
+		}
+		if !iter.reverse && iter.end != nil && bytes.Compare(i.key, iter.end) >= 0 {
+			return false
+		}
+		if iter.reverse && iter.end != nil && bytes.Compare(i.key, iter.end) >= 0 {
+			return true
+		}
+		iter.items = append(iter.items, i)
+		return len(iter.items) < snapshotIteratorChunk
+	}
+
+	switch {
+	case resume && iter.reverse:
+		iter.btree.DescendLessOrEqual(newKey(iter.next), visitor)
+	case resume:
+		iter.btree.AscendGreaterOrEqual(newKey(iter.next), visitor)
+	case iter.reverse && iter.end == nil:
+		iter.btree.Descend(visitor)
+	case iter.reverse:
+		iter.btree.DescendLessOrEqual(newKey(iter.end), visitor)
+	case iter.start == nil:
+		iter.btree.Ascend(visitor)
+	default:
+		iter.btree.AscendGreaterOrEqual(newKey(iter.start), visitor)
+	}
+
+	if len(iter.items) < snapshotIteratorChunk {
+		iter.next = nil
+	} else {
+		iter.next = iter.items[len(iter.items)-1].key
+	}
+	iter.done = len(iter.items) == 0
+}
+
+// Domain implements Iterator.
+func (iter *snapshotDBIterator) Domain() ([]byte, []byte) {
+	return iter.start, iter.end
+}
+
+// Valid implements Iterator.
+func (iter *snapshotDBIterator) Valid() bool {
+	return !iter.done
+}
+
+// Next implements Iterator.
+func (iter *snapshotDBIterator) Next() {
+	iter.assertIsValid()
+	iter.idx++
+	if iter.idx < len(iter.items) {
+		return
+	}
+	if iter.next == nil {
+		iter.done = true
+		return
+	}
+	iter.fill(true)
+}
+
+// Error implements Iterator.
+func (iter *snapshotDBIterator) Error() error {
+	return nil
+}
+
+// Key implements Iterator.
+func (iter *snapshotDBIterator) Key() []byte {
+	iter.assertIsValid()
+	return iter.items[iter.idx].key
+}
+
+// Value implements Iterator.
+func (iter *snapshotDBIterator) Value() []byte {
+	iter.assertIsValid()
+	return iter.items[iter.idx].value
+}
+
+// Close implements Iterator.
+func (iter *snapshotDBIterator) Close() error {
+	iter.items = nil
+	iter.done = true
+	return nil
+}
+
+func (iter *snapshotDBIterator) assertIsValid() {
+	if !iter.Valid() {
+		panic("iterator is invalid")
+	}
+}
+
+// snapshotDBBatch handles the batching of a SnapshotDB.
+type snapshotDBBatch struct {
+	db   *SnapshotDB
+	ops  []operation
+	size int
+}
+
+var _ corestore.Batch = (*snapshotDBBatch)(nil)
+
+// Set implements Batch.
+func (b *snapshotDBBatch) Set(key, value []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if value == nil {
+		return errValueNil
+	}
+	if b.ops == nil {
+		return errBatchClosed
+	}
+	b.size += len(key) + len(value)
+	b.ops = append(b.ops, operation{opTypeSet, key, value})
+	return nil
+}
+
+// Delete implements Batch.
+func (b *snapshotDBBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if b.ops == nil {
+		return errBatchClosed
+	}
+	b.size += len(key)
+	b.ops = append(b.ops, operation{opTypeDelete, key, nil})
+	return nil
+}
+
+// Write implements Batch.
+func (b *snapshotDBBatch) Write() error {
+	if b.ops == nil {
+		return errBatchClosed
+	}
+	b.db.mtx.Lock()
+	defer b.db.mtx.Unlock()
+
+	for _, op := range b.ops {
+		switch op.opType {
+		case opTypeSet:
+			b.db.btree.ReplaceOrInsert(newPair(op.key, op.value))
+		case opTypeDelete:
+			b.db.btree.Delete(newKey(op.key))
+		default:
+			return fmt.Errorf("unknown operation type %v (%v)", op.opType, op)
+		}
+	}
+
+	// Make sure batch cannot be used afterwards. Callers should still call Close(), for errors.
+	return b.Close()
+}
+
+// WriteSync implements Batch.
+func (b *snapshotDBBatch) WriteSync() error {
+	return b.Write()
+}
+
+// Close implements Batch.
+func (b *snapshotDBBatch) Close() error {
+	b.ops = nil
+	b.size = 0
+	return nil
+}
+
+// GetByteSize implements Batch.
+func (b *snapshotDBBatch) GetByteSize() (int, error) {
+	if b.ops == nil {
+		return 0, errBatchClosed
+	}
+	return b.size, nil
+}
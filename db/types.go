@@ -60,3 +60,43 @@ type DB interface {
 	// This will does the same thing as NewBatch if the batch implementation doesn't support pre-allocation.
 	NewBatchWithSize(int) corestore.Batch
 }
+
+// MultiGetter is implemented by backends which can read several keys with a single call, e.g.
+// the multi-get of RocksDB or Pebble. IAVL uses it to batch node reads when it is available.
+type MultiGetter interface {
+	// MultiGet fetches the values of the given keys, with nil for keys which do not exist.
+	// CONTRACT: key, value readonly []byte
+	MultiGet(keys [][]byte) ([][]byte, error)
+}
+
+// Hint tunes a batch or an iterator of a HintedDB for its workload. Backends ignore the hints they
+// don't support.
+type Hint struct {
+	// DisableWAL writes the batch without the write-ahead log, for data which is written again if
+	// it is lost in a crash, e.g. an interrupted import.
+	DisableWAL bool
+	// NoFillCache reads without filling the block cache, for scans which are not repeated.
+	NoFillCache bool
+	// LowPriority runs the writes, and the compactions they cause, at a low priority.
+	LowPriority bool
+}
+
+// HintedDB is implemented by backends which can tune batches and iterators with a Hint, e.g. with
+// the write and read options of RocksDB or Pebble. IAVL uses it for the Options.BackendHints.
+type HintedDB interface {
+	// NewBatchWithHint creates a batch for atomic updates tuned by the hint. The caller must call
+	// Batch.Close.
+	NewBatchWithHint(hint Hint) corestore.Batch
+
+	// IteratorWithHint is like Iterator, or ReverseIterator if ascending is false, tuned by the
+	// hint.
+	IteratorWithHint(start, end []byte, ascending bool, hint Hint) (corestore.Iterator, error)
+}
+
+// CompactionDebtReporter is implemented by backends which can estimate their compaction debt,
+// e.g. the pending compaction bytes of RocksDB or Pebble. IAVL uses it to pause imports while the
+// backend catches up, see ImportOptions.PauseOnCompactionDebt.
+type CompactionDebtReporter interface {
+	// CompactionDebt returns the estimated number of bytes which are pending compaction.
+	CompactionDebt() (int64, error)
+}
@@ -1,14 +1,21 @@
 package iavl
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
 )
 
 // exportBufferSize is the number of nodes to buffer in the exporter. It improves throughput by
 // processing multiple nodes per context switch, but take care to avoid excessive memory usage,
-// especially since callers may export several IAVL stores in parallel (e.g. the Cosmos SDK).
+// especially since callers may export several IAVL stores in parallel (e.g. the Cosmos SDK). It is
+// the default of Options.ExportBufferSize.
 const exportBufferSize = 32
 
 // ErrorExportDone is returned by Exporter.Next() when all items have been exported.
@@ -17,27 +24,83 @@ var ErrorExportDone = errors.New("export is complete")
 // ErrNotInitalizedTree when chains introduce a store without initializing data
 var ErrNotInitalizedTree = errors.New("iavl/export newExporter failed to create")
 
+// ErrUnsupportedExportFormat is returned by Importer.SetHeader for export streams it can't import.
+var ErrUnsupportedExportFormat = errors.New("unsupported export format")
+
+// ErrExportOrder is returned by Importer.Add and ValidateExportStream for nodes which are not in
+// the canonical export order, see Exporter.
+var ErrExportOrder = errors.New("export nodes out of canonical order")
+
+// Versions of the export stream format.
+const (
+	// ExportFormatV1 is the format of releases which don't send an ExportHeader.
+	ExportFormatV1 uint32 = 1
+	// ExportFormatV2 adds ExportNode.Hash.
+	ExportFormatV2 uint32 = 2
+
+	// ExportFormatVersion is the format version exported by this release.
+	ExportFormatVersion = ExportFormatV2
+)
+
+// Hash functions and node encodings of export streams.
+const (
+	ExportHashSHA256         = "sha256"
+	ExportEncodingPlain      = "plain"
+	ExportEncodingCompressed = "compressed"
+	// ExportEncodingLeaves streams the leaves only, in ascending key order, and requires
+	// ExportHeader.LeafCount. The importer builds a size balanced tree from them.
+	ExportEncodingLeaves = "leaves"
+)
+
+// ExportHeader describes the format of an export stream. It is sent ahead of the exported nodes,
+// so that importers on other releases can check that they are able to import them.
+type ExportHeader struct {
+	FormatVersion uint32
+	HashFunction  string
+	NodeEncoding  string
+
+	// LeafCount is the number of exported leaves. It is required for ExportEncodingLeaves, and
+	// lets importers of other encodings report their Progress.
+	LeafCount int64
+}
+
 // ExportNode contains exported node data.
 type ExportNode struct {
 	Key     []byte
 	Value   []byte
 	Version int64
 	Height  int8
+
+	// Hash is the hash of the node, checked by importers with ImportOptions.VerifyHashes.
+	Hash []byte
 }
 
 // Exporter exports nodes from an ImmutableTree. It is created by ImmutableTree.Export().
 //
 // Exported nodes can be imported into an empty tree with MutableTree.Import(). Nodes are exported
 // depth-first post-order (LRN), this order must be preserved when importing in order to recreate
-// the same tree structure.
+// the same tree structure. Since the tree is determined by its nodes, so is this canonical order:
+// the leaves are in strictly ascending key order, and every inner node follows its two subtrees,
+// is one level higher than the higher of them, which differ by at most one level, has the
+// smallest key of its right subtree, and a version no older than theirs. Importers reject other
+// orders with ErrExportOrder.
 type Exporter struct {
-	tree   *ImmutableTree
-	ch     chan *ExportNode
-	cancel context.CancelFunc
+	tree       *ImmutableTree
+	leavesOnly bool
+	ch         chan *ExportNode
+	cancel     context.CancelFunc
+	leafCount  int64
+	started    time.Time
+	nodes      atomic.Int64 // nodes returned by Next
+	readBytes  atomic.Int64 // bytes returned by Read
+
+	// the state of Read
+	readBuf    []byte
+	headerRead bool
 }
 
 // NewExporter creates a new Exporter. Callers must call Close() when done.
-func newExporter(tree *ImmutableTree) (*Exporter, error) {
+func newExporter(tree *ImmutableTree, leavesOnly bool) (*Exporter, error) {
 	if tree == nil {
 		return nil, fmt.Errorf("tree is nil: %w", ErrNotInitalizedTree)
 	}
@@ -45,12 +108,20 @@ func newExporter(tree *ImmutableTree) (*Exporter, error) {
 	if tree.ndb == nil {
 		return nil, fmt.Errorf("tree.ndb is nil: %w", ErrNotInitalizedTree)
 	}
+	if err := tree.checkGeneration(); err != nil {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	exporter := &Exporter{
-		tree:   tree,
-		ch:     make(chan *ExportNode, exportBufferSize),
-		cancel: cancel,
+		tree:       tree,
+		leavesOnly: leavesOnly,
+		ch:         make(chan *ExportNode, tree.ndb.opts.exportBufferSize()),
+		cancel:     cancel,
+		started:    time.Now(),
+	}
+	if tree.root != nil {
+		exporter.leafCount = tree.root.size
 	}
 
 	tree.ndb.incrVersionReaders(tree.version)
@@ -67,6 +138,13 @@ func (e *Exporter) export(ctx context.Context) {
 			Value:   node.value,
 			Version: node.nodeKey.version,
 			Height:  node.subtreeHeight,
+			Hash:    node.hash,
+		}
+		if e.leavesOnly {
+			if !node.isLeaf() {
+				return false
+			}
+			exportNode.Hash = nil
 		}
 
 		select {
@@ -79,14 +157,40 @@ func (e *Exporter) export(ctx context.Context) {
 	close(e.ch)
 }
 
+// Header returns the header describing the format of the exported nodes.
+func (e *Exporter) Header() ExportHeader {
+	header := ExportHeader{
+		FormatVersion: ExportFormatVersion,
+		HashFunction:  ExportHashSHA256,
+		NodeEncoding:  ExportEncodingPlain,
+		LeafCount:     e.leafCount,
+	}
+	if e.leavesOnly {
+		header.NodeEncoding = ExportEncodingLeaves
+	}
+	return header
+}
+
 // Next fetches the next exported node, or returns ExportDone when done.
 func (e *Exporter) Next() (*ExportNode, error) {
 	if exportNode, ok := <-e.ch; ok {
+		e.nodes.Add(1)
 		return exportNode, nil
 	}
 	return nil, ErrorExportDone
 }
 
+// Progress returns the progress of the export. It is safe to call concurrently with Next and
+// Read, e.g. to display it while the export is streamed elsewhere.
+func (e *Exporter) Progress() Progress {
+	return Progress{
+		Nodes:      e.nodes.Load(),
+		TotalNodes: exportNodeCount(e.leafCount, e.leavesOnly),
+		Bytes:      e.readBytes.Load(),
+		Elapsed:    time.Since(e.started),
+	}
+}
+
 // Close closes the exporter. It is safe to call multiple times.
 func (e *Exporter) Close() {
 	e.cancel()
@@ -97,3 +201,201 @@ func (e *Exporter) Close() {
 	}
 	e.tree = nil
 }
+
+// exportOrderChecker checks that exported nodes are in the canonical order, see Exporter.
+type exportOrderChecker struct {
+	stack   []exportOrderSubtree // the subtrees without a parent yet
+	lastKey []byte
+	leaves  int64
+}
+
+// exportOrderSubtree is a subtree of the nodes checked by an exportOrderChecker.
+type exportOrderSubtree struct {
+	height  int8
+	version int64
+	minKey  []byte
+}
+
+// check checks that the node follows the previously checked ones.
+func (c *exportOrderChecker) check(node *ExportNode) error {
+	if node.Height < 0 {
+		return fmt.Errorf("%w: node with negative height %d", ErrExportOrder, node.Height)
+	}
+	if node.Height == 0 {
+		if c.leaves > 0 && bytes.Compare(node.Key, c.lastKey) <= 0 {
+			return fmt.Errorf("%w: leaf key %X is not greater than the previous key %X", ErrExportOrder, node.Key, c.lastKey)
+		}
+		c.leaves++
+		c.lastKey = node.Key
+		c.stack = append(c.stack, exportOrderSubtree{version: node.Version, minKey: node.Key})
+		return nil
+	}
+
+	n := len(c.stack)
+	if n < 2 {
+		return fmt.Errorf("%w: inner node with key %X precedes its subtrees", ErrExportOrder, node.Key)
+	}
+	left, right := c.stack[n-2], c.stack[n-1]
+	if height := max(left.height, right.height) + 1; node.Height != height {
+		return fmt.Errorf("%w: inner node with key %X has height %d, expected %d", ErrExportOrder, node.Key, node.Height, height)
+	}
+	if left.height-right.height > 1 || right.height-left.height > 1 {
+		return fmt.Errorf("%w: inner node with key %X is unbalanced", ErrExportOrder, node.Key)
+	}
+	if !bytes.Equal(node.Key, right.minKey) {
+		return fmt.Errorf("%w: inner node has key %X, expected the smallest key %X of its right subtree", ErrExportOrder, node.Key, right.minKey)
+	}
+	if node.Version < max(left.version, right.version) {
+		return fmt.Errorf("%w: inner node with key %X at version %d is older than its subtrees", ErrExportOrder, node.Key, node.Version)
+	}
+	c.stack = append(c.stack[:n-2], exportOrderSubtree{height: node.Height, version: node.Version, minKey: left.minKey})
+	return nil
+}
+
+// done checks that the checked nodes form a single tree, or none.
+func (c *exportOrderChecker) done() error {
+	if len(c.stack) > 1 {
+		return fmt.Errorf("%w: export ends with %d subtrees without a root", ErrExportOrder, len(c.stack))
+	}
+	return nil
+}
+
+// ValidateExportStream checks that the export stream in r, as written by Exporter.Read, has a
+// supported header and its nodes are in the canonical order, without importing them, e.g. to
+// reject a malformed snapshot from a peer before restoring it. It doesn't verify the node hashes.
+func ValidateExportStream(r io.Reader) error {
+	sr, err := NewExportStreamReader(r)
+	if err != nil {
+		return err
+	}
+	header := sr.Header()
+	if err := validateExportHeader(header); err != nil {
+		return err
+	}
+
+	checker := &exportOrderChecker{}
+	var (
+		decoder NodeImporter = nodeImporterFunc(checker.check)
+		leaves  *leafImporter
+	)
+	switch header.NodeEncoding {
+	case ExportEncodingCompressed:
+		decoder = NewCompressImporter(decoder)
+	case ExportEncodingLeaves:
+		// the inner nodes are built at the import version, which is newer than the leaves
+		leaves = newLeafImporter(header.LeafCount, math.MaxInt64, decoder)
+		decoder = leaves
+	}
+
+	for {
+		node, err := sr.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := decoder.Add(node); err != nil {
+			return err
+		}
+	}
+	if leaves != nil && leaves.added != leaves.leafCount {
+		return fmt.Errorf("%w: leaf export ends after %d of %d leaves", ErrExportOrder, leaves.added, leaves.leafCount)
+	}
+	return checker.done()
+}
+
+// VerifyExport recomputes the root hash of the export stream in r, as written by Exporter.Read, and
+// compares it with expectedRoot, without writing anything to a database, e.g. for a snapshot
+// provider to validate an artifact before publishing it. Like ValidateExportStream, it checks the
+// header and the order of the nodes, and like ImportOptions.VerifyHashes, the hashes of the nodes
+// which have one. Only the subtrees without a parent yet are kept in memory. The root hash of a
+// leaf export depends on the version it is imported at, so those exports can't be verified.
+func VerifyExport(r io.Reader, expectedRoot []byte) error {
+	sr, err := NewExportStreamReader(r)
+	if err != nil {
+		return err
+	}
+	header := sr.Header()
+	if err := validateExportHeader(header); err != nil {
+		return err
+	}
+
+	hasher := &exportHasher{verifyHashes: header.FormatVersion >= ExportFormatV2}
+	var decoder NodeImporter = nodeImporterFunc(hasher.add)
+	switch header.NodeEncoding {
+	case ExportEncodingCompressed:
+		decoder = NewCompressImporter(decoder)
+	case ExportEncodingLeaves:
+		return fmt.Errorf("%w: the root hash of a leaf export depends on its import version", ErrUnsupportedExportFormat)
+	}
+
+	for {
+		node, err := sr.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := decoder.Add(node); err != nil {
+			return err
+		}
+	}
+	root, err := hasher.root()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(root, expectedRoot) {
+		return fmt.Errorf("%w: the export has root hash %X, expected %X", ErrImportHashMismatch, root, expectedRoot)
+	}
+	return nil
+}
+
+// exportHasher computes the hashes of exported nodes, keeping the subtrees without a parent yet,
+// with their hashes, like an Importer does without writing them.
+type exportHasher struct {
+	order        exportOrderChecker
+	stack        []*Node
+	verifyHashes bool
+}
+
+// add hashes the node, from the hashes of its subtrees for an inner node.
+func (h *exportHasher) add(exportNode *ExportNode) error {
+	if err := h.order.check(exportNode); err != nil {
+		return err
+	}
+	node := &Node{
+		key:           exportNode.Key,
+		value:         exportNode.Value,
+		subtreeHeight: exportNode.Height,
+		size:          1,
+	}
+	if node.subtreeHeight > 0 {
+		// the order checker verified that the node follows its subtrees
+		n := len(h.stack)
+		node.leftNode, node.rightNode = h.stack[n-2], h.stack[n-1]
+		node.size = node.leftNode.size + node.rightNode.size
+		h.stack = h.stack[:n-2]
+	}
+	hash := node._hash(exportNode.Version)
+	node.leftNode, node.rightNode = nil, nil
+	if h.verifyHashes && len(exportNode.Hash) > 0 && !bytes.Equal(hash, exportNode.Hash) {
+		return fmt.Errorf("%w: node with key %X at version %d has hash %X, expected %X",
+			ErrImportHashMismatch, exportNode.Key, exportNode.Version, hash, exportNode.Hash)
+	}
+	h.stack = append(h.stack, node)
+	return nil
+}
+
+// root returns the root hash of the added nodes, or the hash of an empty tree if there are none.
+func (h *exportHasher) root() ([]byte, error) {
+	if err := h.order.done(); err != nil {
+		return nil, err
+	}
+	if len(h.stack) == 0 {
+		hash := sha256.Sum256(nil)
+		return hash[:], nil
+	}
+	return h.stack[0].hash, nil
+}
@@ -0,0 +1,275 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxExportRecordSize bounds the length prefix accepted by ExportStreamReader, so a corrupt
+// stream can't make it allocate unbounded memory.
+const maxExportRecordSize = 1 << 30
+
+// exportRecordPrealloc is the size of the records ExportStreamReader allocates up front, the
+// larger ones growing as they are read.
+const exportRecordPrealloc = 1 << 20
+
+var _ io.Reader = (*Exporter)(nil)
+
+// Read implements io.Reader, serializing the export as a stream of records, so it can be piped
+// into compression, hashing or network transports, and read back by ExportStreamReader. Like the
+// changelog, each record is prefixed with its uvarint encoded length. The first record is the
+// ExportHeader and the others are the nodes, as the protobuf messages of proofpb:
+//
+//	message ExportHeader {
+//	    uint32 format_version = 1;
+//	    string hash_function = 2;
+//	    string node_encoding = 3;
+//	    int64 leaf_count = 4;
+//	}
+//
+//	message ExportNode {
+//	    bytes key = 1;
+//	    bytes value = 2;
+//	    int64 version = 3;
+//	    sint32 height = 4;
+//	    bytes hash = 5;
+//	}
+//
+// It returns io.EOF at the end of the export. Read and Next must not be mixed.
+func (e *Exporter) Read(p []byte) (int, error) {
+	for len(e.readBuf) == 0 {
+		if !e.headerRead {
+			e.headerRead = true
+			e.readBuf = appendExportRecord(e.readBuf, marshalExportHeader(e.Header()))
+			break
+		}
+		node, err := e.Next()
+		if errors.Is(err, ErrorExportDone) {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		e.readBuf = appendExportRecord(e.readBuf, marshalExportNode(node))
+	}
+	n := copy(p, e.readBuf)
+	e.readBuf = e.readBuf[n:]
+	e.readBytes.Add(int64(n))
+	return n, nil
+}
+
+// ExportStreamReader reads an export stream written by Exporter.Read. It implements NodeExporter,
+// so the nodes can be passed to an Importer, after Importer.SetHeader with the header.
+type ExportStreamReader struct {
+	r      *bufio.Reader
+	header ExportHeader
+}
+
+var _ NodeExporter = (*ExportStreamReader)(nil)
+
+// NewExportStreamReader returns a reader of the export stream in r, after reading its header.
+func NewExportStreamReader(r io.Reader) (*ExportStreamReader, error) {
+	sr := &ExportStreamReader{r: bufio.NewReader(r)}
+	b, err := sr.readRecord()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read export header: %w", err)
+	}
+	if sr.header, err = unmarshalExportHeader(b); err != nil {
+		return nil, fmt.Errorf("failed to decode export header: %w", err)
+	}
+	return sr, nil
+}
+
+// Header returns the header of the stream.
+func (sr *ExportStreamReader) Header() ExportHeader {
+	return sr.header
+}
+
+// Next returns the next node of the stream, or ErrorExportDone at its end. A truncated final
+// record returns io.ErrUnexpectedEOF.
+func (sr *ExportStreamReader) Next() (*ExportNode, error) {
+	b, err := sr.readRecord()
+	if errors.Is(err, io.EOF) {
+		return nil, ErrorExportDone
+	}
+	if err != nil {
+		return nil, err
+	}
+	node, err := unmarshalExportNode(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode export node: %w", err)
+	}
+	return node, nil
+}
+
+// readRecord reads the next length-prefixed record, returning io.EOF only at a record boundary.
+func (sr *ExportStreamReader) readRecord() ([]byte, error) {
+	size, err := binary.ReadUvarint(sr.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read export record length: %w", err)
+	}
+	if size > maxExportRecordSize {
+		return nil, fmt.Errorf("export record of %d bytes exceeds the maximum of %d", size, maxExportRecordSize)
+	}
+	// the buffer grows with the data read, so a corrupt length prefix of a short stream doesn't
+	// allocate its size up front
+	var buf bytes.Buffer
+	buf.Grow(int(min(size, exportRecordPrealloc)))
+	if _, err := io.CopyN(&buf, sr.r, int64(size)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func appendExportRecord(buf, record []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(record)))
+	return append(buf, record...)
+}
+
+func marshalExportHeader(header ExportHeader) []byte {
+	var b []byte
+	if header.FormatVersion != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(header.FormatVersion))
+	}
+	if header.HashFunction != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, header.HashFunction)
+	}
+	if header.NodeEncoding != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, header.NodeEncoding)
+	}
+	if header.LeafCount != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(header.LeafCount))
+	}
+	return b
+}
+
+func marshalExportNode(node *ExportNode) []byte {
+	var b []byte
+	if len(node.Key) > 0 {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, node.Key)
+	}
+	if len(node.Value) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, node.Value)
+	}
+	if node.Version != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(node.Version))
+	}
+	if node.Height != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(node.Height)))
+	}
+	if len(node.Hash) > 0 {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, node.Hash)
+	}
+	return b
+}
+
+// consumeExportFields calls fn with the number, type and value of every field of the message b.
+func consumeExportFields(b []byte, fn func(num protowire.Number, v uint64, bz []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, m := protowire.ConsumeVarint(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			if err := fn(num, v, nil); err != nil {
+				return err
+			}
+			n = m
+		case protowire.BytesType:
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			if err := fn(num, 0, v); err != nil {
+				return err
+			}
+			n = m
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func unmarshalExportHeader(b []byte) (ExportHeader, error) {
+	var header ExportHeader
+	err := consumeExportFields(b, func(num protowire.Number, v uint64, bz []byte) error {
+		switch num {
+		case 1:
+			if v > math.MaxUint32 {
+				return fmt.Errorf("invalid export format version %d", v)
+			}
+			header.FormatVersion = uint32(v)
+		case 2:
+			header.HashFunction = string(bz)
+		case 3:
+			header.NodeEncoding = string(bz)
+		case 4:
+			header.LeafCount = int64(v)
+		}
+		return nil
+	})
+	return header, err
+}
+
+func unmarshalExportNode(b []byte) (*ExportNode, error) {
+	node := &ExportNode{}
+	err := consumeExportFields(b, func(num protowire.Number, v uint64, bz []byte) error {
+		switch num {
+		case 1:
+			node.Key = bz
+		case 2:
+			node.Value = bz
+		case 3:
+			node.Version = int64(v)
+		case 4:
+			height := protowire.DecodeZigZag(v)
+			if height < 0 || height > math.MaxInt8 {
+				return fmt.Errorf("invalid export node height %d", height)
+			}
+			node.Height = int8(height)
+		case 5:
+			node.Hash = bz
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
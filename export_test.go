@@ -1,9 +1,16 @@
 package iavl
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
 	"math"
 	"math/rand"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -184,6 +191,8 @@ func TestExporter(t *testing.T) {
 			break
 		}
 		require.NoError(t, err)
+		require.Len(t, node.Hash, 32)
+		node.Hash = nil
 		actual = append(actual, node)
 	}
 
@@ -297,6 +306,361 @@ func TestExporter_Import(t *testing.T) {
 	}
 }
 
+func TestExporter_Read(t *testing.T) {
+	tree := setupExportTreeBasic(t)
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	// the stream goes through standard plumbing, e.g. compression
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = io.Copy(zw, exporter)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	zr, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	stream, err := NewExportStreamReader(zr)
+	require.NoError(t, err)
+	require.Equal(t, exporter.Header(), stream.Header())
+
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	importer, err := newTree.ImportWithOptions(tree.Version(), ImportOptions{VerifyHashes: true})
+	require.NoError(t, err)
+	defer importer.Close()
+	require.NoError(t, importer.SetHeader(stream.Header()))
+	for {
+		node, err := stream.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	require.Equal(t, tree.Hash(), newTree.Hash())
+
+	// a truncated stream is detected
+	exporter, err = tree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	bz, err := io.ReadAll(exporter)
+	require.NoError(t, err)
+	stream, err = NewExportStreamReader(bytes.NewReader(bz[:len(bz)-1]))
+	require.NoError(t, err)
+	for err == nil {
+		_, err = stream.Next()
+	}
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// so is a record longer than the stream, without allocating its length
+	header := appendExportRecord(nil, marshalExportHeader(ExportHeader{FormatVersion: ExportFormatV2}))
+	stream, err = NewExportStreamReader(bytes.NewReader(binary.AppendUvarint(header, maxExportRecordSize)))
+	require.NoError(t, err)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = stream.Next()
+	runtime.ReadMemStats(&after)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(maxExportRecordSize))
+}
+
+func TestVerifyExport(t *testing.T) {
+	tree := setupExportTreeSized(t, 100)
+	read := func(exporter *Exporter) []byte {
+		defer exporter.Close()
+		bz, err := io.ReadAll(exporter)
+		require.NoError(t, err)
+		return bz
+	}
+
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	plain := read(exporter)
+	require.NoError(t, VerifyExport(bytes.NewReader(plain), tree.Hash()))
+	require.ErrorIs(t, VerifyExport(bytes.NewReader(plain), make([]byte, 32)), ErrImportHashMismatch)
+
+	// a flipped byte in a value is caught by the hash of its leaf
+	corrupted := bytes.Clone(plain)
+	i := bytes.Index(corrupted, tree.root.key) // the smallest key of the right subtree, in a leaf first
+	require.Positive(t, i)
+	corrupted[i+len(tree.root.key)+3] ^= 0xff
+	require.ErrorIs(t, VerifyExport(bytes.NewReader(corrupted), tree.Hash()), ErrImportHashMismatch)
+
+	exporter, err = tree.ExportLeaves()
+	require.NoError(t, err)
+	require.ErrorIs(t, VerifyExport(bytes.NewReader(read(exporter)), tree.Hash()), ErrUnsupportedExportFormat)
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, _, err = empty.SaveVersion()
+	require.NoError(t, err)
+	immutable, err := empty.GetImmutable(1)
+	require.NoError(t, err)
+	exporter, err = immutable.Export()
+	require.NoError(t, err)
+	require.NoError(t, VerifyExport(bytes.NewReader(read(exporter)), immutable.Hash()))
+}
+
+func TestValidateExportStream(t *testing.T) {
+	tree := setupExportTreeSized(t, 100)
+
+	// collectNodes returns the header and nodes of an export
+	collectNodes := func(exporter interface {
+		NodeExporter
+		Header() ExportHeader
+	},
+	) (ExportHeader, []*ExportNode) {
+		var nodes []*ExportNode
+		for {
+			node, err := exporter.Next()
+			if errors.Is(err, ErrorExportDone) {
+				break
+			}
+			require.NoError(t, err)
+			nodes = append(nodes, node)
+		}
+		return exporter.Header(), nodes
+	}
+	encode := func(header ExportHeader, nodes []*ExportNode) []byte {
+		bz := appendExportRecord(nil, marshalExportHeader(header))
+		for _, node := range nodes {
+			bz = appendExportRecord(bz, marshalExportNode(node))
+		}
+		return bz
+	}
+
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	header, nodes := collectNodes(exporter)
+	exporter.Close()
+	require.NoError(t, ValidateExportStream(bytes.NewReader(encode(header, nodes))))
+
+	exporter, err = tree.Export()
+	require.NoError(t, err)
+	compressedHeader, compressed := collectNodes(NewCompressExporter(exporter).(*CompressExporter))
+	exporter.Close()
+	require.NoError(t, ValidateExportStream(bytes.NewReader(encode(compressedHeader, compressed))))
+
+	exporter, err = tree.ExportLeaves()
+	require.NoError(t, err)
+	leavesHeader, leaves := collectNodes(exporter)
+	exporter.Close()
+	require.NoError(t, ValidateExportStream(bytes.NewReader(encode(leavesHeader, leaves))))
+
+	// firstInner returns the index of the first inner node
+	firstInner := func(nodes []*ExportNode) int {
+		for i, node := range nodes {
+			if node.Height > 0 {
+				return i
+			}
+		}
+		return -1
+	}
+	clone := func(nodes []*ExportNode) []*ExportNode {
+		cloned := make([]*ExportNode, len(nodes))
+		for i, node := range nodes {
+			n := *node
+			cloned[i] = &n
+		}
+		return cloned
+	}
+
+	testcases := map[string]struct {
+		header ExportHeader
+		nodes  []*ExportNode
+		modify func(nodes []*ExportNode) []*ExportNode
+	}{
+		"swapped leaves": {header, nodes, func(nodes []*ExportNode) []*ExportNode {
+			nodes[0], nodes[1] = nodes[1], nodes[0]
+			return nodes
+		}},
+		"inner node first": {header, nodes, func(nodes []*ExportNode) []*ExportNode {
+			i := firstInner(nodes)
+			return append(append([]*ExportNode{nodes[i]}, nodes[:i]...), nodes[i+1:]...)
+		}},
+		"wrong inner key": {header, nodes, func(nodes []*ExportNode) []*ExportNode {
+			nodes[firstInner(nodes)].Key = []byte("x")
+			return nodes
+		}},
+		"wrong inner height": {header, nodes, func(nodes []*ExportNode) []*ExportNode {
+			nodes[firstInner(nodes)].Height++
+			return nodes
+		}},
+		"old inner version": {header, nodes, func(nodes []*ExportNode) []*ExportNode {
+			i := firstInner(nodes)
+			nodes[i].Version = nodes[i-1].Version - 1
+			return nodes
+		}},
+		"missing root": {header, nodes, func(nodes []*ExportNode) []*ExportNode {
+			return nodes[:len(nodes)-1]
+		}},
+		"compressed inner node first": {compressedHeader, compressed, func(nodes []*ExportNode) []*ExportNode {
+			i := firstInner(nodes)
+			return append(append([]*ExportNode{nodes[i]}, nodes[:i]...), nodes[i+1:]...)
+		}},
+		"swapped leaves only": {leavesHeader, leaves, func(nodes []*ExportNode) []*ExportNode {
+			nodes[0], nodes[1] = nodes[1], nodes[0]
+			return nodes
+		}},
+		"missing leaf": {leavesHeader, leaves, func(nodes []*ExportNode) []*ExportNode {
+			return nodes[1:]
+		}},
+	}
+	for desc, tc := range testcases {
+		tc := tc
+		t.Run(desc, func(t *testing.T) {
+			nodes := tc.modify(clone(tc.nodes))
+			require.ErrorIs(t, ValidateExportStream(bytes.NewReader(encode(tc.header, nodes))), ErrExportOrder)
+
+			// and is rejected on import
+			if tc.header.NodeEncoding == ExportEncodingLeaves {
+				return
+			}
+			newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+			importer, err := newTree.Import(tree.Version())
+			require.NoError(t, err)
+			defer importer.Close()
+			require.NoError(t, importer.SetHeader(tc.header))
+			for _, node := range nodes {
+				if err = importer.Add(node); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = importer.Commit()
+			}
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestExporter_Progress(t *testing.T) {
+	tree := setupExportTreeSized(t, 100)
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	require.EqualValues(t, 199, exporter.Progress().TotalNodes)
+	require.Zero(t, exporter.Progress().Percent())
+
+	bz, err := io.ReadAll(exporter)
+	require.NoError(t, err)
+	progress := exporter.Progress()
+	require.EqualValues(t, 199, progress.Nodes)
+	require.EqualValues(t, len(bz), progress.Bytes)
+	require.Equal(t, 100.0, progress.Percent())
+	require.Zero(t, progress.ETA())
+
+	stream, err := NewExportStreamReader(bytes.NewReader(bz))
+	require.NoError(t, err)
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	importer, err := newTree.Import(tree.Version())
+	require.NoError(t, err)
+	defer importer.Close()
+	require.NoError(t, importer.SetHeader(stream.Header()))
+	for n := 0; ; n++ {
+		node, err := stream.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+		if n == 99 {
+			progress := importer.Progress()
+			require.EqualValues(t, 100, progress.Nodes)
+			require.EqualValues(t, 199, progress.TotalNodes)
+			require.InDelta(t, 50.25, progress.Percent(), 0.01)
+		}
+	}
+	require.NoError(t, importer.Commit())
+	progress = importer.Progress()
+	require.EqualValues(t, 199, progress.Nodes)
+	require.Equal(t, 100.0, progress.Percent())
+	require.Positive(t, progress.Bytes)
+}
+
+func TestProgress_ETA(t *testing.T) {
+	require.Equal(t, 3*time.Second, Progress{Nodes: 25, TotalNodes: 100, Elapsed: time.Second}.ETA())
+	require.Zero(t, Progress{Nodes: 25, Elapsed: time.Second}.ETA())
+	require.Zero(t, Progress{TotalNodes: 100, Elapsed: time.Second}.ETA())
+	require.Equal(t, 25.0, Progress{Nodes: 25, TotalNodes: 100}.Percent())
+}
+
+func TestExporter_ImportLeaves(t *testing.T) {
+	testcases := map[string]*ImmutableTree{
+		"empty tree": NewImmutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()),
+		"basic tree": setupExportTreeBasic(t),
+		"one leaf":   setupExportTreeSized(t, 1),
+		"sized tree": setupExportTreeSized(t, 1000),
+	}
+
+	for desc, tree := range testcases {
+		tree := tree
+		t.Run(desc, func(t *testing.T) {
+			exporter, err := tree.ExportLeaves()
+			require.NoError(t, err)
+			defer exporter.Close()
+
+			newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+			importer, err := newTree.Import(tree.Version())
+			require.NoError(t, err)
+			defer importer.Close()
+
+			header := exporter.Header()
+			require.Equal(t, ExportEncodingLeaves, header.NodeEncoding)
+			require.EqualValues(t, tree.Size(), header.LeafCount)
+			require.NoError(t, importer.SetHeader(header))
+			for {
+				item, err := exporter.Next()
+				if err == ErrorExportDone {
+					break
+				}
+				require.NoError(t, err)
+				require.Zero(t, item.Height)
+				require.Nil(t, item.Hash)
+				require.NoError(t, importer.Add(item))
+			}
+			require.NoError(t, importer.Commit())
+
+			require.Equal(t, tree.Size(), newTree.Size())
+			require.Equal(t, tree.Version(), newTree.Version())
+			tree.Iterate(func(key, value []byte) bool { //nolint:errcheck
+				newValue, err := newTree.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, value, newValue, "Value mismatch for key %v", key)
+				return false
+			})
+
+			// the rebuilt tree is balanced
+			var checkBalance func(node *Node) int8
+			checkBalance = func(node *Node) int8 {
+				if node.isLeaf() {
+					return 0
+				}
+				left, err := node.getLeftNode(newTree.ImmutableTree)
+				require.NoError(t, err)
+				right, err := node.getRightNode(newTree.ImmutableTree)
+				require.NoError(t, err)
+				lh, rh := checkBalance(left), checkBalance(right)
+				require.LessOrEqual(t, lh-rh, int8(1))
+				require.LessOrEqual(t, rh-lh, int8(1))
+				require.Equal(t, maxInt8(lh, rh)+1, node.subtreeHeight)
+				require.Equal(t, left.size+right.size, node.size)
+				return node.subtreeHeight
+			}
+			if newTree.root != nil {
+				checkBalance(newTree.root)
+			}
+
+			// and can be modified
+			_, err = newTree.Set([]byte("new key"), []byte("new value"))
+			require.NoError(t, err)
+			_, _, err = newTree.SaveVersion()
+			require.NoError(t, err)
+		})
+	}
+}
+
 func TestExporter_Close(t *testing.T) {
 	tree := setupExportTreeSized(t, 4096)
 	exporter, err := tree.Export()
@@ -2,6 +2,7 @@ package iavl
 
 import (
 	"errors"
+	"fmt"
 
 	"cosmossdk.io/core/store"
 
@@ -27,6 +28,8 @@ type FastIterator struct {
 	nextFastNode *fastnode.Node
 
 	fastIterator store.Iterator
+
+	version int64 // version of the tree, for Checkpoint, 0 if unknown
 }
 
 var _ store.Iterator = (*FastIterator)(nil)
@@ -115,6 +118,9 @@ func (iter *FastIterator) Next() {
 	iter.valid = iter.valid && iter.fastIterator.Valid()
 	if iter.valid {
 		iter.nextFastNode, iter.err = fastnode.DeserializeNode(iter.fastIterator.Key()[1:], iter.fastIterator.Value())
+		if iter.err != nil {
+			iter.err = fmt.Errorf("%w: %v", ErrCorruptNode, iter.err)
+		}
 		iter.valid = iter.err == nil
 	}
 }
@@ -122,7 +128,9 @@ func (iter *FastIterator) Next() {
 // Close implements dbm.Iterator
 func (iter *FastIterator) Close() error {
 	if iter.fastIterator != nil {
-		iter.err = iter.fastIterator.Close()
+		if err := iter.fastIterator.Close(); iter.err == nil {
+			iter.err = err
+		}
 	}
 	iter.valid = false
 	iter.fastIterator = nil
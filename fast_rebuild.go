@@ -0,0 +1,355 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	corestore "cosmossdk.io/core/store"
+
+	"github.com/cosmos/iavl/fastnode"
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// errFastIndexRebuildStopped is returned by a background rebuild of the fast node index which was
+// stopped before it was done. Its progress is kept, so it is resumed later.
+var errFastIndexRebuildStopped = errors.New("fast node index rebuild stopped")
+
+// fastIndexRebuild is a background rebuild of the fast node index, see
+// MutableTree.SetFastStorageEnabled.
+type fastIndexRebuild struct {
+	stop chan struct{} // closed to stop the rebuild
+	done chan error    // receives the result of the rebuild
+}
+
+// fastIndexRebuildState is the progress of a rebuild of the fast node index, which is persisted
+// with every chunk of fast nodes it writes, so the rebuild is resumed after a restart. The keys are
+// indexed in ascending order from a version, and once the latest version moves past it, the fast
+// nodes indexed so far are rolled forward to the latest version with the changes in between.
+type fastIndexRebuildState struct {
+	version  int64  // the version of the fast nodes indexed so far
+	lastKey  []byte // the last indexed key, nil if none
+	complete bool   // all keys of the version are indexed
+}
+
+// marshal encodes the state as its version, big endian, a flag set if it is complete and the last
+// indexed key.
+func (s fastIndexRebuildState) marshal() []byte {
+	bz := make([]byte, int64Size+1, int64Size+1+len(s.lastKey))
+	binary.BigEndian.PutUint64(bz, uint64(s.version))
+	if s.complete {
+		bz[int64Size] = 1
+	}
+	return append(bz, s.lastKey...)
+}
+
+func unmarshalFastIndexRebuildState(bz []byte) (fastIndexRebuildState, error) {
+	if len(bz) < int64Size+1 {
+		return fastIndexRebuildState{}, fmt.Errorf("invalid fast node index rebuild state %X", bz)
+	}
+	s := fastIndexRebuildState{
+		version:  int64(binary.BigEndian.Uint64(bz)),
+		complete: bz[int64Size] == 1,
+	}
+	if len(bz) > int64Size+1 {
+		s.lastKey = bz[int64Size+1:]
+	}
+	return s, nil
+}
+
+// getFastIndexRebuild returns the progress of the rebuild of the fast node index, and false if no
+// rebuild is pending.
+func (ndb *nodeDB) getFastIndexRebuild() (fastIndexRebuildState, bool, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(fastIndexRebuildKey)))
+	if err != nil || bz == nil {
+		return fastIndexRebuildState{}, false, err
+	}
+	s, err := unmarshalFastIndexRebuildState(bz)
+	return s, err == nil, err
+}
+
+// rebuildFastIndex rebuilds the fast node index from the persisted progress, until all keys are
+// indexed and rolled forward to the latest version, or until stop is closed. A version which is
+// deleted during the rebuild, by pruning or by a rollback, restarts it from the latest version,
+// and the stale fast nodes are deleted as the keys are indexed again.
+func (ndb *nodeDB) rebuildFastIndex(stop <-chan struct{}) error {
+	state, found, err := ndb.getFastIndexRebuild()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("no fast node index rebuild is pending")
+	}
+	generation := ndb.generations.current()
+	for {
+		select {
+		case <-stop:
+			return errFastIndexRebuildStopped
+		case <-ndb.ctx.Done():
+			return ndb.ctx.Err()
+		default:
+		}
+
+		latest, err := ndb.getLatestVersion()
+		if err != nil {
+			return err
+		}
+		switch {
+		case state.version != latest:
+			err = ndb.rollFastIndexForward(&state, latest, generation)
+		case !state.complete:
+			err = ndb.indexFastNodes(&state, generation)
+		default:
+			return nil
+		}
+		if errors.Is(err, ErrTreeInvalidated) || errors.Is(err, ErrVersionDoesNotExist) {
+			ndb.logger.Info("restarting the fast node index rebuild", "version", latest, "reason", err)
+			state = fastIndexRebuildState{version: latest}
+			generation = ndb.generations.current()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// indexFastNodes writes the fast nodes of the next chunk of keys of the rebuilt version, deletes the
+// fast nodes of the keys in between which the version doesn't have, and persists the progress with
+// them.
+func (ndb *nodeDB) indexFastNodes(state *fastIndexRebuildState, generation uint64) error {
+	var start []byte
+	if state.lastKey != nil {
+		start = append(ibytes.Cp(state.lastKey), 0)
+	}
+	var keys, values [][]byte
+	complete := true
+	if state.version > 0 {
+		rootKey, err := ndb.GetRoot(state.version)
+		if err != nil {
+			return err
+		}
+		if rootKey != nil {
+			root, err := ndb.GetNode(rootKey)
+			if err != nil {
+				return ndb.rebuildError(state.version, generation, err)
+			}
+			tree := &ImmutableTree{root: root, ndb: ndb, version: state.version, skipFastStorageUpgrade: true}
+			itr := NewIterator(start, nil, true, tree.WithCacheBypass())
+			for ; itr.Valid() && len(keys) < maxBatchSize; itr.Next() {
+				keys = append(keys, ibytes.Cp(itr.Key()))
+				values = append(values, ibytes.Cp(itr.Value()))
+			}
+			complete = !itr.Valid()
+			err = errors.Join(itr.Error(), itr.Close())
+			if err := ndb.rebuildError(state.version, generation, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	next := fastIndexRebuildState{version: state.version, lastKey: state.lastKey, complete: complete}
+	end := ibytes.CpIncr(fastKeyFormat.Key())
+	if len(keys) > 0 {
+		next.lastKey = keys[len(keys)-1]
+		if !complete {
+			end = ndb.fastNodeKey(append(ibytes.Cp(next.lastKey), 0))
+		}
+	}
+
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	i := 0
+	if err := ndb.traverseRange(ndb.fastNodeKey(start), end, func(k, _ []byte) error {
+		key := k[len(fastKeyFormat.Key()):]
+		for i < len(keys) && bytes.Compare(keys[i], key) < 0 {
+			i++
+		}
+		if i < len(keys) && bytes.Equal(keys[i], key) {
+			return nil
+		}
+		return batch.Delete(ibytes.Cp(k))
+	}); err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if err := ndb.setFastNodeToBatch(batch, fastnode.NewNode(key, values[i], state.version)); err != nil {
+			return err
+		}
+	}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(fastIndexRebuildKey)), next.marshal()); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	*state = next
+	return nil
+}
+
+// rollFastIndexForward applies the changes of the versions after the rebuilt version up to
+// toVersion to the fast nodes indexed so far, i.e. those up to the last indexed key until all keys
+// are indexed, and persists the progress with them.
+func (ndb *nodeDB) rollFastIndexForward(state *fastIndexRebuildState, toVersion int64, generation uint64) error {
+	if err := ndb.generations.check(state.version, generation); err != nil {
+		return err
+	}
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	if state.complete || state.lastKey != nil {
+		if state.version > toVersion {
+			return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, state.version)
+		}
+		has, err := ndb.hasVersion(state.version)
+		if err != nil {
+			return err
+		}
+		if !has {
+			return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, state.version)
+		}
+		err = ndb.traverseStateChanges(ndb.nextVersion(state.version), toVersion, func(version int64, changeSet *ChangeSet) error {
+			for _, pair := range changeSet.Pairs {
+				if !state.complete && bytes.Compare(pair.Key, state.lastKey) > 0 {
+					continue
+				}
+				if pair.Delete {
+					if err := batch.Delete(ndb.fastNodeKey(pair.Key)); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := ndb.setFastNodeToBatch(batch, fastnode.NewNode(pair.Key, pair.Value, version)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err := ndb.rebuildError(state.version, generation, err); err != nil {
+			return err
+		}
+	}
+
+	next := fastIndexRebuildState{version: toVersion, lastKey: state.lastKey, complete: state.complete}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(fastIndexRebuildKey)), next.marshal()); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	*state = next
+	return nil
+}
+
+// rebuildError returns ErrTreeInvalidated if the rebuilt version was deleted since the rebuild
+// started from it, in which case the reads of its nodes may have failed, and err otherwise.
+func (ndb *nodeDB) rebuildError(version int64, generation uint64, err error) error {
+	if checkErr := ndb.generations.check(version, generation); checkErr != nil {
+		return checkErr
+	}
+	return err
+}
+
+// setFastNodeToBatch writes the fast node to the given batch instead of the nodeDB batch.
+func (ndb *nodeDB) setFastNodeToBatch(batch corestore.Batch, node *fastnode.Node) error {
+	var buf bytes.Buffer
+	buf.Grow(node.EncodedSize())
+	if err := ndb.encodeFastNode(&buf, node); err != nil {
+		return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
+	}
+	return batch.Set(ndb.fastNodeKey(node.GetKey()), buf.Bytes())
+}
+
+// startFastStorageRebuild starts the background rebuild of the fast node index from its persisted
+// progress. The reads stay on the tree until finishFastStorageRebuild switches them to the index.
+func (tree *MutableTree) startFastStorageRebuild() {
+	rebuild := &fastIndexRebuild{stop: make(chan struct{}), done: make(chan error, 1)}
+	go func() {
+		rebuild.done <- tree.ndb.rebuildFastIndex(rebuild.stop)
+	}()
+	tree.fastStorageRebuild = rebuild
+}
+
+// stopFastStorageRebuild stops the background rebuild of the fast node index, if any, keeping its
+// progress to be resumed.
+func (tree *MutableTree) stopFastStorageRebuild() {
+	if tree.fastStorageRebuild == nil {
+		return
+	}
+	close(tree.fastStorageRebuild.stop)
+	<-tree.fastStorageRebuild.done
+	tree.fastStorageRebuild = nil
+}
+
+// finishFastStorageRebuild switches the tree to the fast node index once the background rebuild is
+// done, after rolling the index forward to the versions saved since. It waits for the rebuild if
+// wait is set, and otherwise returns right away while it is running. It must be called without
+// unsaved changes, since their fast nodes aren't tracked during the rebuild.
+func (tree *MutableTree) finishFastStorageRebuild(wait bool) error {
+	rebuild := tree.fastStorageRebuild
+	if rebuild == nil {
+		return nil
+	}
+	var err error
+	if wait {
+		err = <-rebuild.done
+	} else {
+		select {
+		case err = <-rebuild.done:
+		default:
+			return nil
+		}
+	}
+	tree.fastStorageRebuild = nil
+	if err != nil {
+		// the progress is kept, so the rebuild is resumed on load or once enabled again
+		return fmt.Errorf("failed to rebuild the fast node index: %w", err)
+	}
+
+	state, _, err := tree.ndb.getFastIndexRebuild()
+	if err != nil {
+		return err
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if state.version != latestVersion {
+		err := tree.ndb.rollFastIndexForward(&state, latestVersion, tree.ndb.generations.current())
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			// the rebuilt version was deleted since the rebuild was done
+			if err := tree.ndb.resetFastIndexRebuild(latestVersion); err != nil {
+				return err
+			}
+			tree.startFastStorageRebuild()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tree.ndb.setFastIndexShardsToBatch(); err != nil {
+		return err
+	}
+	if err := tree.ndb.SetFastStorageVersionToBatch(latestVersion); err != nil {
+		return err
+	}
+	if err := tree.ndb.batch.Delete(metadataKeyFormat.Key([]byte(fastIndexRebuildKey))); err != nil {
+		return err
+	}
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
+	tree.setSkipFastStorageUpgrade(false)
+	tree.unsavedFastNodeAdditions = &sync.Map{}
+	tree.unsavedFastNodeRemovals = &sync.Map{}
+	return nil
+}
+
+// resetFastIndexRebuild starts a rebuild of the fast node index from the version, or restarts the
+// pending one.
+func (ndb *nodeDB) resetFastIndexRebuild(version int64) error {
+	return ndb.db.Set(metadataKeyFormat.Key([]byte(fastIndexRebuildKey)), fastIndexRebuildState{version: version}.marshal())
+}
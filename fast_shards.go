@@ -0,0 +1,427 @@
+package iavl
+
+import (
+	"bytes"
+	"strconv"
+
+	corestore "cosmossdk.io/core/store"
+
+	dbm "github.com/cosmos/iavl/db"
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// shardedDB serves the nodeDB of a tree with Options.FastIndexShards, storing the fast nodes in the
+// shards by the leading byte of their keys, and all other keys in the primary backend. Each shard
+// holds a contiguous range of leading bytes, so a range of fast nodes is the concatenation of the
+// ranges of the shards, and the keys with a common leading byte, e.g. those of a module, are in a
+// single shard.
+type shardedDB struct {
+	db     corestore.KVStoreWithBatch
+	shards []corestore.KVStoreWithBatch
+}
+
+var (
+	_ corestore.KVStoreWithBatch = (*shardedDB)(nil)
+	_ dbm.MultiGetter            = (*shardedDB)(nil)
+	_ dbm.HintedDB               = (*shardedDB)(nil)
+	_ dbm.CompactionDebtReporter = (*shardedDB)(nil)
+)
+
+func newShardedDB(db corestore.KVStoreWithBatch, shards []corestore.KVStoreWithBatch, namespace []byte) *shardedDB {
+	if len(namespace) > 0 {
+		namespaced := make([]corestore.KVStoreWithBatch, len(shards))
+		for i, shard := range shards {
+			namespaced[i] = newNamespaceDB(shard, namespace)
+		}
+		shards = namespaced
+	}
+	return &shardedDB{db: db, shards: shards}
+}
+
+// isFastNodeKey returns whether the key is the key of a fast node.
+func isFastNodeKey(key []byte) bool {
+	return len(key) > 0 && key[0] == fastKeyFormat.Prefix()[0]
+}
+
+// shardIndex returns the index of the shard of the fast node key.
+func (sdb *shardedDB) shardIndex(key []byte) int {
+	if len(key) < 2 {
+		return 0
+	}
+	return int(key[1]) * len(sdb.shards) / 256
+}
+
+// route returns the backend of the key.
+func (sdb *shardedDB) route(key []byte) corestore.KVStoreWithBatch {
+	if !isFastNodeKey(key) {
+		return sdb.db
+	}
+	return sdb.shards[sdb.shardIndex(key)]
+}
+
+// shardStart returns the first fast node key of the shard i, or the end of the fast node keys
+// after the last shard.
+func (sdb *shardedDB) shardStart(i int) []byte {
+	prefix := []byte(fastKeyFormat.Prefix())
+	switch {
+	case i == 0:
+		return prefix
+	case i >= len(sdb.shards):
+		return ibytes.CpIncr(prefix)
+	}
+	// the smallest leading byte b with b*len(shards)/256 >= i
+	return append(prefix, byte((i*256+len(sdb.shards)-1)/len(sdb.shards)))
+}
+
+// Get implements corestore.KVStore.
+func (sdb *shardedDB) Get(key []byte) ([]byte, error) {
+	return sdb.route(key).Get(key)
+}
+
+// Has implements corestore.KVStore.
+func (sdb *shardedDB) Has(key []byte) (bool, error) {
+	return sdb.route(key).Has(key)
+}
+
+// Set implements corestore.KVStore.
+func (sdb *shardedDB) Set(key, value []byte) error {
+	return sdb.route(key).Set(key, value)
+}
+
+// Delete implements corestore.KVStore.
+func (sdb *shardedDB) Delete(key []byte) error {
+	return sdb.route(key).Delete(key)
+}
+
+// MultiGet implements dbm.MultiGetter, with a single call to each backend implementing it.
+func (sdb *shardedDB) MultiGet(keys [][]byte) ([][]byte, error) {
+	indexes := make(map[corestore.KVStoreWithBatch][]int)
+	for i, key := range keys {
+		db := sdb.route(key)
+		indexes[db] = append(indexes[db], i)
+	}
+	values := make([][]byte, len(keys))
+	for db, idx := range indexes {
+		dbKeys := make([][]byte, len(idx))
+		for j, i := range idx {
+			dbKeys[j] = keys[i]
+		}
+		dbValues, err := multiGet(db, dbKeys)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range idx {
+			values[i] = dbValues[j]
+		}
+	}
+	return values, nil
+}
+
+// Iterator implements corestore.KVStore. A range of fast nodes is iterated over the shards, and any
+// other range over the primary backend only.
+func (sdb *shardedDB) Iterator(start, end []byte) (corestore.Iterator, error) {
+	return sdb.IteratorWithHint(start, end, true, dbm.Hint{})
+}
+
+// ReverseIterator implements corestore.KVStore, like Iterator.
+func (sdb *shardedDB) ReverseIterator(start, end []byte) (corestore.Iterator, error) {
+	return sdb.IteratorWithHint(start, end, false, dbm.Hint{})
+}
+
+// IteratorWithHint implements dbm.HintedDB, passing the hint through to the backends implementing
+// it.
+func (sdb *shardedDB) IteratorWithHint(start, end []byte, ascending bool, hint dbm.Hint) (corestore.Iterator, error) {
+	fastStart, fastEnd := sdb.shardStart(0), sdb.shardStart(len(sdb.shards))
+	if start == nil || end == nil || bytes.Compare(start, fastStart) < 0 || bytes.Compare(end, fastEnd) > 0 {
+		return iteratorWithHint(sdb.db, start, end, ascending, hint)
+	}
+
+	itr := &shardedIterator{start: start, end: end, ascending: ascending, hint: hint}
+	for i, shard := range sdb.shards {
+		shardStart, shardEnd := sdb.shardStart(i), sdb.shardStart(i+1)
+		if bytes.Compare(start, shardStart) > 0 {
+			shardStart = start
+		}
+		if bytes.Compare(end, shardEnd) < 0 {
+			shardEnd = end
+		}
+		if bytes.Compare(shardStart, shardEnd) < 0 {
+			itr.ranges = append(itr.ranges, shardRange{db: shard, start: shardStart, end: shardEnd})
+		}
+	}
+	if !ascending {
+		for i, j := 0, len(itr.ranges)-1; i < j; i, j = i+1, j-1 {
+			itr.ranges[i], itr.ranges[j] = itr.ranges[j], itr.ranges[i]
+		}
+	}
+	itr.advance()
+	return itr, itr.err
+}
+
+// iteratorWithHint returns an iterator over the database, tuned by the hint if it supports it.
+func iteratorWithHint(db corestore.KVStore, start, end []byte, ascending bool, hint dbm.Hint) (corestore.Iterator, error) {
+	switch hinted, ok := db.(dbm.HintedDB); {
+	case ok:
+		return hinted.IteratorWithHint(start, end, ascending, hint)
+	case ascending:
+		return db.Iterator(start, end)
+	default:
+		return db.ReverseIterator(start, end)
+	}
+}
+
+// NewBatch implements corestore.KVStoreWithBatch.
+func (sdb *shardedDB) NewBatch() corestore.Batch {
+	return &shardedBatch{source: sdb.db.NewBatch(), sdb: sdb}
+}
+
+// NewBatchWithSize implements corestore.KVStoreWithBatch.
+func (sdb *shardedDB) NewBatchWithSize(size int) corestore.Batch {
+	return &shardedBatch{source: sdb.db.NewBatchWithSize(size), sdb: sdb}
+}
+
+// NewBatchWithHint implements dbm.HintedDB, passing the hint through to the backends implementing
+// it.
+func (sdb *shardedDB) NewBatchWithHint(hint dbm.Hint) corestore.Batch {
+	b := &shardedBatch{sdb: sdb, hint: hint}
+	b.source = b.newBatch(sdb.db)
+	return b
+}
+
+// CompactionDebt implements dbm.CompactionDebtReporter, with the largest debt of the backends
+// reporting it.
+func (sdb *shardedDB) CompactionDebt() (int64, error) {
+	var debt int64
+	for _, db := range append([]corestore.KVStoreWithBatch{sdb.db}, sdb.shards...) {
+		reporter, ok := db.(dbm.CompactionDebtReporter)
+		if !ok {
+			continue
+		}
+		d, err := reporter.CompactionDebt()
+		if err != nil {
+			return 0, err
+		}
+		debt = max(debt, d)
+	}
+	return debt, nil
+}
+
+// Close implements corestore.KVStore, closing the primary backend. The shards are left open, since
+// they may be shared with other trees.
+func (sdb *shardedDB) Close() error {
+	return sdb.db.Close()
+}
+
+// shardRange is the part of the range of an iteration stored in a shard.
+type shardRange struct {
+	db         corestore.KVStoreWithBatch
+	start, end []byte
+}
+
+// shardedIterator iterates over the ranges of the shards one after the other, opening each when
+// the previous one is exhausted.
+type shardedIterator struct {
+	ranges     []shardRange
+	source     corestore.Iterator
+	start, end []byte
+	ascending  bool
+	hint       dbm.Hint
+	err        error
+}
+
+var _ corestore.Iterator = (*shardedIterator)(nil)
+
+// advance moves to the next non-empty range while the current one is exhausted.
+func (itr *shardedIterator) advance() {
+	for itr.err == nil && (itr.source == nil || !itr.source.Valid()) && len(itr.ranges) > 0 {
+		if itr.source != nil {
+			if itr.err = itr.source.Error(); itr.err != nil {
+				return
+			}
+			if itr.err = itr.source.Close(); itr.err != nil {
+				return
+			}
+			itr.source = nil
+		}
+		r := itr.ranges[0]
+		itr.ranges = itr.ranges[1:]
+		itr.source, itr.err = iteratorWithHint(r.db, r.start, r.end, itr.ascending, itr.hint)
+	}
+}
+
+// Domain implements corestore.Iterator.
+func (itr *shardedIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements corestore.Iterator.
+func (itr *shardedIterator) Valid() bool {
+	return itr.err == nil && itr.source != nil && itr.source.Valid()
+}
+
+// Next implements corestore.Iterator.
+func (itr *shardedIterator) Next() {
+	itr.source.Next()
+	itr.advance()
+}
+
+// Key implements corestore.Iterator.
+func (itr *shardedIterator) Key() []byte {
+	return itr.source.Key()
+}
+
+// Value implements corestore.Iterator.
+func (itr *shardedIterator) Value() []byte {
+	return itr.source.Value()
+}
+
+// Error implements corestore.Iterator.
+func (itr *shardedIterator) Error() error {
+	if itr.err != nil {
+		return itr.err
+	}
+	if itr.source != nil {
+		return itr.source.Error()
+	}
+	return nil
+}
+
+// Close implements corestore.Iterator.
+func (itr *shardedIterator) Close() error {
+	if itr.source == nil {
+		return nil
+	}
+	return itr.source.Close()
+}
+
+// shardedBatch writes the fast nodes to batches of the shards, created on the first write to each,
+// and the other keys to a batch of the primary backend.
+type shardedBatch struct {
+	source corestore.Batch
+	shards map[int]corestore.Batch
+	sdb    *shardedDB
+	hint   dbm.Hint
+}
+
+var _ corestore.Batch = (*shardedBatch)(nil)
+
+// newBatch returns a batch of the backend, tuned by the hint of the batch if it supports it.
+func (b *shardedBatch) newBatch(db corestore.KVStoreWithBatch) corestore.Batch {
+	if hinted, ok := db.(dbm.HintedDB); ok && b.hint != (dbm.Hint{}) {
+		return hinted.NewBatchWithHint(b.hint)
+	}
+	return db.NewBatch()
+}
+
+// route returns the batch of the key.
+func (b *shardedBatch) route(key []byte) corestore.Batch {
+	if !isFastNodeKey(key) {
+		return b.source
+	}
+	i := b.sdb.shardIndex(key)
+	if b.shards == nil {
+		b.shards = make(map[int]corestore.Batch)
+	}
+	if _, ok := b.shards[i]; !ok {
+		b.shards[i] = b.newBatch(b.sdb.shards[i])
+	}
+	return b.shards[i]
+}
+
+// Set implements corestore.Batch.
+func (b *shardedBatch) Set(key, value []byte) error {
+	return b.route(key).Set(key, value)
+}
+
+// Delete implements corestore.Batch.
+func (b *shardedBatch) Delete(key []byte) error {
+	return b.route(key).Delete(key)
+}
+
+// Write implements corestore.Batch. The shards are written first, and the primary backend last,
+// so an interrupted write leaves the fast storage version behind the fast nodes, and the fast node
+// index is rebuilt on load.
+func (b *shardedBatch) Write() error {
+	for _, batch := range b.shards {
+		if err := batch.Write(); err != nil {
+			return err
+		}
+	}
+	return b.source.Write()
+}
+
+// WriteSync implements corestore.Batch.
+func (b *shardedBatch) WriteSync() error {
+	for _, batch := range b.shards {
+		if err := batch.WriteSync(); err != nil {
+			return err
+		}
+	}
+	return b.source.WriteSync()
+}
+
+// Close implements corestore.Batch.
+func (b *shardedBatch) Close() error {
+	for _, batch := range b.shards {
+		if err := batch.Close(); err != nil {
+			return err
+		}
+	}
+	return b.source.Close()
+}
+
+// GetByteSize implements corestore.Batch, with the total size of the batches.
+func (b *shardedBatch) GetByteSize() (int, error) {
+	size, err := b.source.GetByteSize()
+	if err != nil {
+		return 0, err
+	}
+	for _, batch := range b.shards {
+		n, err := batch.GetByteSize()
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// getFastIndexShards returns the number of Options.FastIndexShards the fast node index in db was
+// built with, see setFastIndexShardsToBatch, or -1 if it can't be read, so the index is rebuilt.
+func getFastIndexShards(db corestore.KVStore) int {
+	bz, err := db.Get(metadataKeyFormat.Key([]byte(fastIndexShardsKey)))
+	if err != nil {
+		return -1
+	}
+	if bz == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(string(bz))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// setFastIndexShardsToBatch records the number of Options.FastIndexShards the fast node index is
+// built with, if it changed, so it is rebuilt when they change again.
+func (ndb *nodeDB) setFastIndexShardsToBatch() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	shards := len(ndb.opts.FastIndexShards)
+	if shards == ndb.fastIndexShards {
+		return nil
+	}
+	key := metadataKeyFormat.Key([]byte(fastIndexShardsKey))
+	var err error
+	if shards == 0 {
+		err = ndb.batch.Delete(key)
+	} else {
+		err = ndb.batch.Set(key, []byte(strconv.Itoa(shards)))
+	}
+	if err == nil {
+		ndb.fastIndexShards = shards
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	corestore "cosmossdk.io/core/store"
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestFastIndexShards(t *testing.T) {
+	db := dbm.NewMemDB()
+	shards := []dbm.DB{dbm.NewMemDB(), dbm.NewMemDB(), dbm.NewMemDB()}
+	open := func(shards ...dbm.DB) *MutableTree {
+		stores := make([]corestore.KVStoreWithBatch, len(shards))
+		for i, shard := range shards {
+			stores[i] = shard
+		}
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), FastIndexShardsOption(stores...))
+		_, err := tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+	fastKeys := func(db dbm.DB) [][]byte {
+		var keys [][]byte
+		itr, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			if isFastNodeKey(itr.Key()) {
+				keys = append(keys, itr.Key()[1:])
+			}
+		}
+		return keys
+	}
+
+	tree := open(shards...)
+	expected := make(map[string]string)
+	for v := 1; v <= 3; v++ {
+		for b := 0; b < 256; b += 5 {
+			key := fmt.Sprintf("%c-%d", byte(b), v%2)
+			expected[key] = fmt.Sprintf("v%d", v)
+			_, err := tree.Set([]byte(key), []byte(expected[key]))
+			require.NoError(t, err)
+		}
+		key := fmt.Sprintf("%c-%d", byte(v*50), 0)
+		_, _, err := tree.Remove([]byte(key))
+		require.NoError(t, err)
+		delete(expected, key)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	hash := tree.Hash()
+
+	// the fast nodes are only in the shards, by their leading byte
+	require.Empty(t, fastKeys(db))
+	total := 0
+	for i, shard := range shards {
+		keys := fastKeys(shard)
+		require.NotEmpty(t, keys)
+		for _, key := range keys {
+			require.Equal(t, i, int(key[0])*len(shards)/256)
+		}
+		total += len(keys)
+	}
+	require.Equal(t, len(expected), total)
+
+	check := func(tree *MutableTree) {
+		t.Helper()
+		enabled, err := tree.IsFastCacheEnabled()
+		require.NoError(t, err)
+		require.True(t, enabled)
+		require.Equal(t, hash, tree.Hash())
+		for key, value := range expected {
+			got, err := tree.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, []byte(value), got)
+		}
+		for _, ascending := range []bool{true, false} {
+			var keys [][]byte
+			itr, err := tree.Iterator(nil, nil, ascending)
+			require.NoError(t, err)
+			for ; itr.Valid(); itr.Next() {
+				require.Equal(t, []byte(expected[string(itr.Key())]), itr.Value())
+				keys = append(keys, itr.Key())
+			}
+			require.NoError(t, itr.Close())
+			require.Len(t, keys, len(expected))
+			for i := 1; i < len(keys); i++ {
+				require.Equal(t, ascending, bytes.Compare(keys[i-1], keys[i]) < 0)
+			}
+		}
+		// a range across shards
+		itr, err := tree.Iterator([]byte{80}, []byte{180}, true)
+		require.NoError(t, err)
+		n := 0
+		for ; itr.Valid(); itr.Next() {
+			n++
+		}
+		require.NoError(t, itr.Close())
+		inRange := 0
+		for key := range expected {
+			if key[0] >= 80 && key[0] < 180 {
+				inRange++
+			}
+		}
+		require.Equal(t, inRange, n)
+	}
+	check(tree)
+	require.NoError(t, tree.Close())
+
+	// the index is kept with the same shards, and rebuilt with others
+	check(open(shards...))
+	require.Empty(t, fastKeys(db))
+	check(open())
+	require.Len(t, fastKeys(db), len(expected))
+	check(open(shards[:2]...))
+}
@@ -29,17 +29,12 @@ func NewNode(key []byte, value []byte, version int64) *Node {
 	}
 }
 
-// DeserializeNode constructs an *FastNode from an encoded byte slice.
+// DeserializeNode constructs an *FastNode from an encoded byte slice, verifying the checksum of
+// the value if it was written by WriteChecksummedBytes.
 func DeserializeNode(key []byte, buf []byte) (*Node, error) {
-	ver, n, err := encoding.DecodeVarint(buf)
-	if err != nil {
-		return nil, fmt.Errorf("decoding fastnode.version, %w", err)
-	}
-	buf = buf[n:]
-
-	val, _, err := encoding.DecodeBytes(buf)
+	ver, val, err := DecodeValue(buf)
 	if err != nil {
-		return nil, fmt.Errorf("decoding fastnode.value, %w", err)
+		return nil, err
 	}
 
 	fastNode := &Node{
@@ -51,6 +46,28 @@ func DeserializeNode(key []byte, buf []byte) (*Node, error) {
 	return fastNode, nil
 }
 
+// DecodeValue decodes the version and the value of an encoded FastNode like DeserializeNode,
+// without allocating. The value is a slice of buf.
+func DecodeValue(buf []byte) (int64, []byte, error) {
+	ver, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return 0, nil, fmt.Errorf("decoding fastnode.version, %w", err)
+	}
+	buf = buf[n:]
+
+	val, n, err := encoding.DecodeBytes(buf)
+	if err != nil {
+		return 0, nil, fmt.Errorf("decoding fastnode.value, %w", err)
+	}
+	buf = buf[n:]
+	if len(buf) == encoding.ChecksumSize {
+		if err := encoding.VerifyChecksum(buf, val); err != nil {
+			return 0, nil, fmt.Errorf("verifying fastnode.value, %w", err)
+		}
+	}
+	return ver, val, nil
+}
+
 func (fn *Node) GetKey() []byte {
 	return fn.key
 }
@@ -83,3 +100,15 @@ func (fn *Node) WriteBytes(w io.Writer) error {
 	}
 	return nil
 }
+
+// WriteChecksummedBytes writes the FastNode like WriteBytes, followed by the checksum of its
+// value, which DeserializeNode verifies. Readers without checksum support ignore it.
+func (fn *Node) WriteChecksummedBytes(w io.Writer) error {
+	if err := fn.WriteBytes(w); err != nil {
+		return err
+	}
+	if err := encoding.EncodeChecksum(w, fn.value); err != nil {
+		return fmt.Errorf("writing value checksum, %w", err)
+	}
+	return nil
+}
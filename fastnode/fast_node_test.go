@@ -58,3 +58,18 @@ func TestFastNode_encode_decode(t *testing.T) {
 		})
 	}
 }
+
+func TestFastNode_checksum(t *testing.T) {
+	node := NewNode([]byte{0x4}, []byte("value"), 1)
+	var buf bytes.Buffer
+	require.NoError(t, node.WriteChecksummedBytes(&buf))
+
+	decoded, err := DeserializeNode(node.key, buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, node, decoded)
+
+	corrupted := bytes.Clone(buf.Bytes())
+	corrupted[3] ^= 0xff
+	_, err = DeserializeNode(node.key, corrupted)
+	require.ErrorContains(t, err, "checksum mismatch")
+}
@@ -0,0 +1,86 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrTreeInvalidated is returned by the reads of an ImmutableTree whose version was deleted after
+// it was loaded, by pruning or by deleting the later versions, e.g. LoadVersionForOverwriting.
+var ErrTreeInvalidated = errors.New("tree version has been deleted")
+
+// generationRegistry tracks the deletions of versions, so the ImmutableTree handles loaded before
+// them can tell that their nodes are gone, or were replaced by the nodes of a rewritten version.
+// Every deletion of the later versions starts a new generation, and handles remember the generation
+// they were loaded in. Pruning needs no generation, since a pruned version can't be loaded again.
+type generationRegistry struct {
+	mtx        sync.Mutex
+	generation uint64
+	prunedTo   int64
+	// rollbacks are the deletions of later versions, the latest last. A rollback from a lower
+	// version covers all earlier ones from higher versions, so fromVersion is increasing too.
+	rollbacks []rollbackRecord
+}
+
+type rollbackRecord struct {
+	generation  uint64 // the generation of the handles loaded after the rollback
+	fromVersion int64
+}
+
+// current returns the generation for a handle loaded now. Generations start at 1, handles with
+// generation 0 are not tracked, like the working tree of a MutableTree, which is reloaded itself.
+func (r *generationRegistry) current() uint64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.generation + 1
+}
+
+// pruned records the deletion of the versions up to toVersion.
+func (r *generationRegistry) pruned(toVersion int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if toVersion > r.prunedTo {
+		r.prunedTo = toVersion
+	}
+}
+
+// rolledBack records the deletion of the versions from fromVersion upwards.
+func (r *generationRegistry) rolledBack(fromVersion int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.generation++
+	for len(r.rollbacks) > 0 && r.rollbacks[len(r.rollbacks)-1].fromVersion >= fromVersion {
+		r.rollbacks = r.rollbacks[:len(r.rollbacks)-1]
+	}
+	r.rollbacks = append(r.rollbacks, rollbackRecord{generation: r.generation + 1, fromVersion: fromVersion})
+}
+
+// check returns ErrTreeInvalidated if the version was deleted since the given generation.
+func (r *generationRegistry) check(version int64, generation uint64) error {
+	if generation == 0 || version == 0 {
+		return nil
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if version <= r.prunedTo {
+		return fmt.Errorf("%w: version %d was pruned", ErrTreeInvalidated, version)
+	}
+	for i := len(r.rollbacks) - 1; i >= 0 && r.rollbacks[i].generation > generation; i-- {
+		if r.rollbacks[i].fromVersion <= version {
+			return fmt.Errorf("%w: version %d was deleted by a rollback to version %d", ErrTreeInvalidated,
+				version, r.rollbacks[i].fromVersion-1)
+		}
+	}
+	return nil
+}
+
+// checkGeneration returns ErrTreeInvalidated if the version of the tree was deleted since it was
+// loaded. The reads check it before they start, so a read which is already running when the
+// version is deleted fails on the missing nodes instead.
+func (t *ImmutableTree) checkGeneration() error {
+	if t.ndb == nil {
+		return nil
+	}
+	return t.ndb.generations.check(t.version, t.generation)
+}
@@ -0,0 +1,91 @@
+package iavldebug
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cosmos/iavl"
+)
+
+// Level is the minimum level of the messages passed on by a LevelLogger.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	// LevelNone drops all messages.
+	LevelNone
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "none"}
+
+// String implements fmt.Stringer.
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelNone {
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name, as returned by Level.String.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// LevelLogger is an iavl.Logger which drops the messages below a level that can be changed at
+// runtime, e.g. by the /loglevel endpoint of a Server. It is safe for concurrent use.
+type LevelLogger struct {
+	inner iavl.Logger
+	level atomic.Int32
+}
+
+var _ iavl.Logger = (*LevelLogger)(nil)
+
+// NewLevelLogger returns a logger passing the messages of at least the given level on to inner.
+func NewLevelLogger(inner iavl.Logger, level Level) *LevelLogger {
+	l := &LevelLogger{inner: inner}
+	l.SetLevel(level)
+	return l
+}
+
+// Level returns the current level.
+func (l *LevelLogger) Level() Level {
+	return Level(l.level.Load())
+}
+
+// SetLevel sets the level.
+func (l *LevelLogger) SetLevel(level Level) {
+	l.level.Store(int32(level))
+}
+
+func (l *LevelLogger) Debug(msg string, keyVals ...any) {
+	if l.Level() <= LevelDebug {
+		l.inner.Debug(msg, keyVals...)
+	}
+}
+
+func (l *LevelLogger) Info(msg string, keyVals ...any) {
+	if l.Level() <= LevelInfo {
+		l.inner.Info(msg, keyVals...)
+	}
+}
+
+func (l *LevelLogger) Warn(msg string, keyVals ...any) {
+	if l.Level() <= LevelWarn {
+		l.inner.Warn(msg, keyVals...)
+	}
+}
+
+func (l *LevelLogger) Error(msg string, keyVals ...any) {
+	if l.Level() <= LevelError {
+		l.inner.Error(msg, keyVals...)
+	}
+}
@@ -0,0 +1,228 @@
+// Package iavldebug provides an opt-in HTTP debug console for a live tree, to investigate
+// production incidents without restarting the node with special flags. It is not mounted
+// anywhere by default; an application serves it on a private address, e.g.
+//
+//	logger := iavldebug.NewLevelLogger(logger, iavldebug.LevelInfo)
+//	tree := iavl.NewMutableTree(db, cacheSize, false, logger)
+//	go http.ListenAndServe("localhost:6061", iavldebug.NewServer(tree, logger))
+//
+// The endpoints only read saved versions, so they are safe to use while the tree is written:
+//
+//	GET /stats                    version, size, height and hash, and the node cache occupancy
+//	GET /nodes?version=V          node counts and bytes by height of a version
+//	GET /render?version=V&format= the shape of a version as text, or format=dot for Graphviz
+//	POST /check?version=V         runs the invariant checks of iavltest on a version
+//	GET, PUT /loglevel?level=L    returns or sets the level of the LevelLogger
+//
+// The version defaults to the latest saved version.
+package iavldebug
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cosmos/iavl"
+	"github.com/cosmos/iavl/cache"
+	"github.com/cosmos/iavl/iavltest"
+)
+
+// maxRenderNodes bounds the size of the trees rendered by /render.
+const maxRenderNodes = 1 << 14
+
+// Server is the http.Handler of the debug console of a tree.
+type Server struct {
+	tree   *iavl.MutableTree
+	logger *LevelLogger
+	mux    *http.ServeMux
+}
+
+var _ http.Handler = (*Server)(nil)
+
+// NewServer returns the debug console of the tree. The logger, if not nil, is the one whose level
+// is adjusted by /loglevel.
+func NewServer(tree *iavl.MutableTree, logger *LevelLogger) *Server {
+	s := &Server{tree: tree, logger: logger, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/stats", s.handleStats)
+	s.mux.HandleFunc("/nodes", s.handleNodes)
+	s.mux.HandleFunc("/render", s.handleRender)
+	s.mux.HandleFunc("/check", s.handleCheck)
+	s.mux.HandleFunc("/loglevel", s.handleLogLevel)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Stats is the response of /stats.
+type Stats struct {
+	Version int64                `json:"version"`
+	Size    int64                `json:"size"`
+	Height  int8                 `json:"height"`
+	Hash    string               `json:"hash"`
+	Cache   *cache.AdaptiveStats `json:"cache,omitempty"`
+}
+
+// NodeStats is the response of /nodes.
+type NodeStats struct {
+	Version    int64          `json:"version"`
+	Leaves     int64          `json:"leaves"`
+	Inner      int64          `json:"inner"`
+	KeyBytes   int64          `json:"key_bytes"`
+	ValueBytes int64          `json:"value_bytes"`
+	ByHeight   map[int8]int64 `json:"by_height"`
+	// ByVersion counts the nodes by the version which wrote them, i.e. how much each version
+	// still contributes to the tree.
+	ByVersion map[int64]int64 `json:"by_version"`
+}
+
+func (s *NodeStats) VisitInner(node iavl.NodeInfo) bool {
+	s.Inner++
+	s.KeyBytes += int64(len(node.Key))
+	s.ByHeight[node.Height]++
+	s.ByVersion[node.Version]++
+	return false
+}
+
+func (s *NodeStats) VisitLeaf(node iavl.NodeInfo) bool {
+	s.Leaves++
+	s.KeyBytes += int64(len(node.Key))
+	s.ValueBytes += int64(len(node.Value))
+	s.ByHeight[0]++
+	s.ByVersion[node.Version]++
+	return false
+}
+
+// CheckResult is the response of /check.
+type CheckResult struct {
+	Version int64  `json:"version"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	tree, ok := s.immutableTree(w, r)
+	if !ok {
+		return
+	}
+	stats := Stats{Version: tree.Version(), Size: tree.Size(), Height: tree.Height(), Hash: hex.EncodeToString(tree.Hash())}
+	if cacheStats, ok := s.tree.NodeCacheStats(); ok {
+		stats.Cache = &cacheStats
+	}
+	writeJSON(w, stats)
+}
+
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	tree, ok := s.immutableTree(w, r)
+	if !ok {
+		return
+	}
+	stats := &NodeStats{Version: tree.Version(), ByHeight: map[int8]int64{}, ByVersion: map[int64]int64{}}
+	if _, err := tree.Accept(stats, iavl.PreOrder); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
+	tree, ok := s.immutableTree(w, r)
+	if !ok {
+		return
+	}
+	if nodes := 2*tree.Size() - 1; nodes > maxRenderNodes {
+		http.Error(w, fmt.Sprintf("the tree has %d nodes, more than the %d which are rendered", nodes, maxRenderNodes), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "text":
+		lines, err := tree.RenderShape("  ", nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, strings.Join(lines, "\n"))
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		iavl.WriteDOTGraph(w, tree, nil)
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "the checks must be triggered with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	tree, ok := s.immutableTree(w, r)
+	if !ok {
+		return
+	}
+	result := CheckResult{Version: tree.Version(), OK: true}
+	if err := iavltest.CheckTree(tree, iavltest.All); err != nil {
+		result.OK, result.Error = false, err.Error()
+	}
+	writeJSON(w, result)
+}
+
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if s.logger == nil {
+		http.Error(w, "the tree has no adjustable logger", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level, err := ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.SetLevel(level)
+	default:
+		http.Error(w, "the log level is read with GET and set with PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]string{"level": s.logger.Level().String()})
+}
+
+// immutableTree returns the saved version of the request, writing an error response if it fails.
+func (s *Server) immutableTree(w http.ResponseWriter, r *http.Request) (*iavl.ImmutableTree, bool) {
+	version, err := s.tree.LatestVersion()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if v := r.URL.Query().Get("version"); v != "" {
+		if version, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid version %q", v), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	tree, err := s.tree.GetImmutable(version)
+	if errors.Is(err, iavl.ErrVersionDoesNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return tree, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
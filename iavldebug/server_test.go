@@ -0,0 +1,86 @@
+package iavldebug
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+type recordingLogger struct {
+	iavl.Logger
+	messages []string
+}
+
+func (l *recordingLogger) Debug(msg string, _ ...any) { l.messages = append(l.messages, msg) }
+
+func TestServer(t *testing.T) {
+	inner := &recordingLogger{Logger: iavl.NewNopLogger()}
+	logger := NewLevelLogger(inner, LevelInfo)
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 0, false, logger)
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	server := NewServer(tree, logger)
+
+	request := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder, v any) {
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+
+	var stats Stats
+	decode(request(http.MethodGet, "/stats"), &stats)
+	require.EqualValues(t, 3, stats.Version)
+	require.EqualValues(t, 10, stats.Size)
+
+	var nodes NodeStats
+	decode(request(http.MethodGet, "/nodes?version=1"), &nodes)
+	require.EqualValues(t, 10, nodes.Leaves)
+	require.EqualValues(t, 9, nodes.Inner)
+	require.EqualValues(t, 19, nodes.ByVersion[1])
+	require.Equal(t, http.StatusNotFound, request(http.MethodGet, "/nodes?version=7").Code)
+	require.Equal(t, http.StatusBadRequest, request(http.MethodGet, "/nodes?version=x").Code)
+
+	w := request(http.MethodGet, "/render")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, strings.Split(strings.TrimSpace(w.Body.String()), "\n"), 19)
+	w = request(http.MethodGet, "/render?format=dot")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "graph {")
+
+	var check CheckResult
+	decode(request(http.MethodPost, "/check?version=2"), &check)
+	require.True(t, check.OK)
+	require.Equal(t, http.StatusMethodNotAllowed, request(http.MethodGet, "/check").Code)
+
+	var level map[string]string
+	decode(request(http.MethodGet, "/loglevel"), &level)
+	require.Equal(t, "info", level["level"])
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Empty(t, inner.messages)
+
+	decode(request(http.MethodPut, "/loglevel?level=debug"), &level)
+	require.Equal(t, "debug", level["level"])
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NotEmpty(t, inner.messages)
+	require.Equal(t, http.StatusBadRequest, request(http.MethodPut, "/loglevel?level=loud").Code)
+}
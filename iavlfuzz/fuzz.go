@@ -0,0 +1,256 @@
+// Package iavlfuzz provides fuzzing entry points for the paths fed by untrusted peers, the
+// verification of proofs and the import of export streams, so security teams can run structured
+// fuzzers against them without setting up trees of their own. The entry points follow the go-fuzz
+// convention: they return 1 for an input which decoded, so it is worth mutating further, 0
+// otherwise, and panic when an invariant is violated, e.g. a forged proof verifies, or an import
+// accepts an invalid tree. With the native fuzzing of go test:
+//
+//	func FuzzProofVerify(f *testing.F) {
+//		seeds, err := iavlfuzz.NewHarness().ProofSeeds()
+//		require.NoError(f, err)
+//		for _, seed := range seeds {
+//			f.Add(seed)
+//		}
+//		f.Fuzz(func(_ *testing.T, data []byte) {
+//			iavlfuzz.FuzzProofVerify(data)
+//		})
+//	}
+package iavlfuzz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	ics23 "github.com/cosmos/ics23/go"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/iavltest"
+	"github.com/cosmos/iavl/verify"
+)
+
+// ImportVersion is the version the export streams are imported at, so the nodes of later versions
+// are rejected.
+const ImportVersion = 1 << 20
+
+var (
+	defaultHarness     *Harness
+	defaultHarnessOnce sync.Once
+)
+
+// FuzzProofVerify decodes data as an ics23.CommitmentProof and verifies it against the tree of the
+// default Harness, see Harness.VerifyProof.
+func FuzzProofVerify(data []byte) int {
+	return getDefaultHarness().VerifyProof(data)
+}
+
+// FuzzImportStream imports data as an export stream, see Harness.ImportStream.
+func FuzzImportStream(data []byte) int {
+	return getDefaultHarness().ImportStream(data)
+}
+
+// getDefaultHarness returns the Harness of the package level entry points, shared by the calls.
+func getDefaultHarness() *Harness {
+	defaultHarnessOnce.Do(func() {
+		defaultHarness = NewHarness()
+	})
+	return defaultHarness
+}
+
+// Harness is the fixture of the entry points: a tree with a few saved versions, whose proofs and
+// exports are the seeds of the corpus. It is safe for concurrent use.
+type Harness struct {
+	tree *iavl.ImmutableTree
+}
+
+// NewHarness returns a harness over a deterministic tree in memory, with updates and removals
+// across its versions, so the seeds cover nodes of several versions.
+func NewHarness() *Harness {
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 0, true, iavl.NewNopLogger())
+	for v := 0; v < 3; v++ {
+		for i := v; i < 64; i += v + 1 {
+			if _, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d-%d", v, i))); err != nil {
+				panic(err)
+			}
+		}
+		if _, _, err := tree.Remove([]byte(fmt.Sprintf("key-%03d", 10*v+5))); err != nil {
+			panic(err)
+		}
+		if _, _, err := tree.SaveVersion(); err != nil {
+			panic(err)
+		}
+	}
+	return &Harness{tree: tree.ImmutableTree}
+}
+
+// Tree returns the tree the proofs are verified against.
+func (h *Harness) Tree() *iavl.ImmutableTree {
+	return h.tree
+}
+
+// VerifyProof decodes data as an ics23.CommitmentProof, and verifies it for the key it proves, or
+// the first one of a batch, with the verify package and the tree. It panics if a membership proof
+// verifies for a key which isn't in the tree or with another value, or a non-membership proof for
+// a key which is.
+func (h *Harness) VerifyProof(data []byte) int {
+	proof := &ics23.CommitmentProof{}
+	if err := proof.Unmarshal(data); err != nil {
+		return 0
+	}
+	claimed, key := proofEntry(proof)
+	if key == nil {
+		return 0
+	}
+	value, err := h.tree.Get(key)
+	if err != nil {
+		panic(err)
+	}
+	exists := value != nil
+
+	root := h.tree.Hash()
+	if verify.VerifyMembership(root, proof, key, claimed) && (!exists || !bytes.Equal(claimed, value)) {
+		panic(fmt.Sprintf("membership proof of %X with value %X verified, the tree has %X", key, claimed, value))
+	}
+	if verify.VerifyNonMembership(root, proof, key) && exists {
+		panic(fmt.Sprintf("non-membership proof of %X verified, the tree has it", key))
+	}
+	ok, err := h.tree.VerifyProof(proof, key)
+	if err != nil {
+		panic(err)
+	}
+	if ok && exists != (proof.GetExist() != nil) {
+		panic(fmt.Sprintf("proof of %X verified by the tree, which has %X", key, value))
+	}
+	return 1
+}
+
+// proofEntry returns the value and key of the existence proof, or the key of the non-existence
+// proof, of a proof or the first entry of a batch, compressed or not.
+func proofEntry(proof *ics23.CommitmentProof) (value, key []byte) {
+	proof = ics23.Decompress(proof)
+	if batch := proof.GetBatch(); batch != nil {
+		if len(batch.Entries) == 0 {
+			return nil, nil
+		}
+		entry := batch.Entries[0]
+		if exist := entry.GetExist(); exist != nil {
+			return exist.Value, exist.Key
+		}
+		return nil, entry.GetNonexist().GetKey()
+	}
+	if exist := proof.GetExist(); exist != nil {
+		return exist.Value, exist.Key
+	}
+	return nil, proof.GetNonexist().GetKey()
+}
+
+// ImportStream imports data as an export stream, see iavl.NewExportStreamReader, into an empty
+// tree at ImportVersion, verifying the hashes of the nodes which have one. It panics if the import commits a tree which fails
+// the size, order or hash checks of iavltest.
+func (h *Harness) ImportStream(data []byte) int {
+	sr, err := iavl.NewExportStreamReader(bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+	// only the nodes of the plain encoding carry their hash, which is checked instead of a root hash
+	header := sr.Header()
+	opts := iavl.ImportOptions{
+		VerifyHashes: header.NodeEncoding == iavl.ExportEncodingPlain && header.FormatVersion >= iavl.ExportFormatV2,
+	}
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 0, true, iavl.NewNopLogger())
+	importer, err := tree.ImportWithOptions(ImportVersion, opts)
+	if err != nil {
+		panic(err)
+	}
+	defer importer.Close()
+	if err := importer.SetHeader(header); err != nil {
+		return 0
+	}
+	for {
+		node, err := sr.Next()
+		if errors.Is(err, iavl.ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return 0
+		}
+		if err := importer.Add(node); err != nil {
+			return 0
+		}
+	}
+	if err := importer.Commit(); err != nil {
+		return 0
+	}
+
+	imported, err := tree.GetImmutable(ImportVersion)
+	if err != nil {
+		panic(fmt.Sprintf("imported version can't be read: %v", err))
+	}
+	if err := iavltest.CheckTree(imported, iavltest.Sizes|iavltest.Hashes); err != nil {
+		panic(fmt.Sprintf("imported tree is invalid: %v", err))
+	}
+	return 1
+}
+
+// ProofSeeds returns encoded proofs of the tree, of membership and non-membership, single and
+// batched, as the seeds of a corpus for VerifyProof.
+func (h *Harness) ProofSeeds() ([][]byte, error) {
+	var proofs []*ics23.CommitmentProof
+	for _, key := range []string{"key-000", "key-031", "key-063"} {
+		proof, err := h.tree.GetMembershipProof([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, proof)
+	}
+	for _, key := range []string{"a", "key-015", "key-025", "key-0310", "z"} {
+		proof, err := h.tree.GetNonMembershipProof([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, proof)
+	}
+	batch, err := h.tree.GetProofs([][]byte{[]byte("key-001"), []byte("key-025"), []byte("key-2")})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*ics23.BatchEntry, len(batch))
+	for i, proof := range batch {
+		if exist := proof.GetExist(); exist != nil {
+			entries[i] = &ics23.BatchEntry{Proof: &ics23.BatchEntry_Exist{Exist: exist}}
+		} else {
+			entries[i] = &ics23.BatchEntry{Proof: &ics23.BatchEntry_Nonexist{Nonexist: proof.GetNonexist()}}
+		}
+	}
+	proofs = append(proofs, &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Batch{Batch: &ics23.BatchProof{Entries: entries}}})
+
+	seeds := make([][]byte, len(proofs))
+	for i, proof := range proofs {
+		if seeds[i], err = proof.Marshal(); err != nil {
+			return nil, err
+		}
+	}
+	return seeds, nil
+}
+
+// ImportSeeds returns the export streams of the tree, of its nodes and of its leaves, as the
+// seeds of a corpus for ImportStream.
+func (h *Harness) ImportSeeds() ([][]byte, error) {
+	var seeds [][]byte
+	for _, export := range []func() (*iavl.Exporter, error){h.tree.Export, h.tree.ExportLeaves} {
+		exporter, err := export()
+		if err != nil {
+			return nil, err
+		}
+		seed, err := io.ReadAll(exporter)
+		exporter.Close()
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, nil
+}
@@ -0,0 +1,61 @@
+package iavlfuzz
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeeds(t *testing.T) {
+	h := NewHarness()
+	proofSeeds, err := h.ProofSeeds()
+	require.NoError(t, err)
+	require.Len(t, proofSeeds, 9)
+	importSeeds, err := h.ImportSeeds()
+	require.NoError(t, err)
+	require.Len(t, importSeeds, 2)
+
+	for _, seed := range proofSeeds {
+		require.Equal(t, 1, h.VerifyProof(seed))
+		// every flipped byte either fails to decode or fails to verify
+		for i := range seed {
+			mutated := append([]byte(nil), seed...)
+			mutated[i] ^= 0x5a
+			h.VerifyProof(mutated)
+		}
+	}
+	for _, seed := range importSeeds {
+		require.Equal(t, 1, h.ImportStream(seed))
+		require.Equal(t, 0, h.ImportStream(seed[:len(seed)-1]))
+		for i := 0; i < len(seed); i += 7 {
+			mutated := append([]byte(nil), seed...)
+			mutated[i] ^= 0x5a
+			h.ImportStream(mutated)
+		}
+	}
+
+	require.Equal(t, 0, FuzzProofVerify([]byte{0xff}))
+	require.Equal(t, 0, FuzzImportStream(nil))
+}
+
+func FuzzProofs(f *testing.F) {
+	seeds, err := NewHarness().ProofSeeds()
+	require.NoError(f, err)
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(_ *testing.T, data []byte) {
+		FuzzProofVerify(data)
+	})
+}
+
+func FuzzImports(f *testing.F) {
+	seeds, err := NewHarness().ImportSeeds()
+	require.NoError(f, err)
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(_ *testing.T, data []byte) {
+		FuzzImportStream(data)
+	})
+}
@@ -0,0 +1,203 @@
+// Package iavltest provides invariant checks of IAVL trees, for applications to run against their
+// own trees in integration tests, or after every SaveVersion in a debug mode.
+package iavltest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cosmos/iavl"
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// Check selects the invariants verified by a walk of the tree.
+type Check int
+
+const (
+	// Balance checks that the heights of the subtrees of every inner node differ by at most one,
+	// or the Options.BalanceSlack of the tree, and that its height is one more than the largest of
+	// them.
+	Balance Check = 1 << iota
+	// Sizes checks that the size of every inner node is the sum of the sizes of its subtrees, and
+	// that its key is the smallest key of its right subtree, with the leaves in ascending order.
+	Sizes
+	// Hashes recomputes the hash of every saved node from its content and its children.
+	Hashes
+
+	// All selects every check of the tree structure.
+	All = Balance | Sizes | Hashes
+)
+
+// subtree summarizes a visited subtree for the checks of its parent.
+type subtree struct {
+	height int8
+	size   int64
+	hash   []byte
+	minKey []byte
+	maxKey []byte
+}
+
+type checker struct {
+	checks Check
+	slack  int
+	stack  []subtree
+	err    error
+}
+
+var _ iavl.NodeVisitor = (*checker)(nil)
+
+func (c *checker) fail(format string, args ...any) bool {
+	c.err = fmt.Errorf(format, args...)
+	return true
+}
+
+func (c *checker) VisitLeaf(node iavl.NodeInfo) bool {
+	if c.checks&Sizes != 0 && node.Size != 1 {
+		return c.fail("leaf %X has size %d", node.Key, node.Size)
+	}
+	if n := len(c.stack); c.checks&Sizes != 0 && n > 0 && bytes.Compare(c.stack[n-1].maxKey, node.Key) >= 0 {
+		// the previous subtree on the stack is the left neighbor in post-order
+		return c.fail("leaf %X is not after %X", node.Key, c.stack[n-1].maxKey)
+	}
+	if c.checks&Hashes != 0 && node.Hash != nil {
+		valueHash := sha256.Sum256(node.Value)
+		if hash := hashNode(node, node.Key, valueHash[:]); !bytes.Equal(hash, node.Hash) {
+			return c.fail("leaf %X has hash %X, expected %X", node.Key, node.Hash, hash)
+		}
+	}
+	c.stack = append(c.stack, subtree{height: 0, size: 1, hash: node.Hash, minKey: node.Key, maxKey: node.Key})
+	return false
+}
+
+func (c *checker) VisitInner(node iavl.NodeInfo) bool {
+	n := len(c.stack)
+	if n < 2 {
+		return c.fail("inner node %X is missing children", node.Key)
+	}
+	left, right := c.stack[n-2], c.stack[n-1]
+	c.stack = c.stack[:n-2]
+
+	if c.checks&Balance != 0 {
+		if diff := int(left.height) - int(right.height); diff > c.slack || diff < -c.slack {
+			return c.fail("inner node %X is unbalanced, its subtrees have heights %d and %d", node.Key, left.height, right.height)
+		}
+		if expected := max(left.height, right.height) + 1; node.Height != expected {
+			return c.fail("inner node %X has height %d, expected %d", node.Key, node.Height, expected)
+		}
+	}
+	if c.checks&Sizes != 0 {
+		if expected := left.size + right.size; node.Size != expected {
+			return c.fail("inner node %X has size %d, expected %d", node.Key, node.Size, expected)
+		}
+		if !bytes.Equal(node.Key, right.minKey) {
+			return c.fail("inner node %X has key %X, expected the smallest key %X of its right subtree", node.Key, node.Key, right.minKey)
+		}
+	}
+	if c.checks&Hashes != 0 && node.Hash != nil {
+		if left.hash == nil || right.hash == nil {
+			return c.fail("saved inner node %X has unsaved children", node.Key)
+		}
+		if hash := hashNode(node, left.hash, right.hash); !bytes.Equal(hash, node.Hash) {
+			return c.fail("inner node %X has hash %X, expected %X", node.Key, node.Hash, hash)
+		}
+	}
+	c.stack = append(c.stack, subtree{height: node.Height, size: node.Size, hash: node.Hash, minKey: left.minKey, maxKey: right.maxKey})
+	return false
+}
+
+// hashNode returns the hash of a node with the given content, the key and value hash of a leaf or
+// the hashes of the children of an inner node, like the tree computes it.
+func hashNode(node iavl.NodeInfo, parts ...[]byte) []byte {
+	var buf bytes.Buffer
+	_ = encoding.EncodeVarint(&buf, int64(node.Height))
+	_ = encoding.EncodeVarint(&buf, node.Size)
+	_ = encoding.EncodeVarint(&buf, node.Version)
+	for _, part := range parts {
+		_ = encoding.EncodeBytes(&buf, part)
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:]
+}
+
+// CheckTree walks the tree and verifies the selected invariants, returning the first violation.
+func CheckTree(tree *iavl.ImmutableTree, checks Check) error {
+	c := &checker{checks: checks, slack: tree.BalanceSlack()}
+	if _, err := tree.Accept(c, iavl.PostOrder); err != nil {
+		return err
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if len(c.stack) > 1 {
+		return errors.New("the tree has more than one root")
+	}
+	if len(c.stack) == 1 && checks&Sizes != 0 && c.stack[0].size != tree.Size() {
+		return fmt.Errorf("the tree has %d leaves, but a size of %d", c.stack[0].size, tree.Size())
+	}
+	return nil
+}
+
+// CheckFastIndex verifies that iterating the tree, which uses the fast node index along with the
+// unsaved changes if it is enabled, yields the same entries as a traversal of its nodes.
+func CheckFastIndex(tree *iavl.MutableTree) error {
+	var expected []*iavl.KVPair
+	if _, err := tree.Accept(leafCollector(func(node iavl.NodeInfo) {
+		expected = append(expected, &iavl.KVPair{Key: node.Key, Value: node.Value})
+	}), iavl.InOrder); err != nil {
+		return err
+	}
+
+	itr, err := tree.Iterator(nil, nil, true)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	i := 0
+	for ; itr.Valid(); itr.Next() {
+		if i >= len(expected) {
+			return fmt.Errorf("the fast index has the extra key %X", itr.Key())
+		}
+		if !bytes.Equal(itr.Key(), expected[i].Key) {
+			return fmt.Errorf("the fast index has the key %X, the tree has %X", itr.Key(), expected[i].Key)
+		}
+		if !bytes.Equal(itr.Value(), expected[i].Value) {
+			return fmt.Errorf("the fast index has the value %X for key %X, the tree has %X", itr.Value(), itr.Key(), expected[i].Value)
+		}
+		i++
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	if i < len(expected) {
+		return fmt.Errorf("the fast index is missing the key %X", expected[i].Key)
+	}
+	return nil
+}
+
+type leafCollector func(node iavl.NodeInfo)
+
+func (f leafCollector) VisitInner(iavl.NodeInfo) bool { return false }
+
+func (f leafCollector) VisitLeaf(node iavl.NodeInfo) bool {
+	f(node)
+	return false
+}
+
+// CheckAll verifies every invariant of the working tree and its fast node index.
+func CheckAll(tree *iavl.MutableTree) error {
+	if err := CheckTree(tree.ImmutableTree, All); err != nil {
+		return err
+	}
+	return CheckFastIndex(tree)
+}
+
+// RequireInvariants fails the test if the tree violates any invariant.
+func RequireInvariants(t testing.TB, tree *iavl.MutableTree) {
+	t.Helper()
+	if err := CheckAll(tree); err != nil {
+		t.Fatalf("tree invariant violated: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package iavltest
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestCheckAll(t *testing.T) {
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 0, false, iavl.NewNopLogger())
+	RequireInvariants(t, tree)
+
+	r := rand.New(rand.NewSource(1))
+	for v := 0; v < 10; v++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("k%03d", r.Intn(300)))
+			if r.Intn(4) == 0 {
+				_, _, err := tree.Remove(key)
+				require.NoError(t, err)
+			} else {
+				_, err := tree.Set(key, []byte(fmt.Sprintf("v%d", r.Int())))
+				require.NoError(t, err)
+			}
+		}
+		// the working tree with unsaved nodes, then the saved version
+		RequireInvariants(t, tree)
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		RequireInvariants(t, tree)
+	}
+
+	itree, err := tree.GetImmutable(5)
+	require.NoError(t, err)
+	require.NoError(t, CheckTree(itree, All))
+}
+
+func TestChecker_Violations(t *testing.T) {
+	leaf := func(key string, version int64) iavl.NodeInfo {
+		return iavl.NodeInfo{Key: []byte(key), Value: []byte("v"), Size: 1, Version: version}
+	}
+	inner := func(key string, height int8, size int64) iavl.NodeInfo {
+		return iavl.NodeInfo{Key: []byte(key), Height: height, Size: size}
+	}
+
+	testCases := []struct {
+		name   string
+		checks Check
+		visit  func(c *checker)
+		err    string
+	}{
+		{"unordered leaves", Sizes, func(c *checker) {
+			c.VisitLeaf(leaf("b", 1))
+			c.VisitLeaf(leaf("a", 1))
+		}, "is not after"},
+		{"wrong size", Sizes, func(c *checker) {
+			c.VisitLeaf(leaf("a", 1))
+			c.VisitLeaf(leaf("b", 1))
+			c.VisitInner(inner("b", 1, 3))
+		}, "has size 3"},
+		{"wrong inner key", Sizes, func(c *checker) {
+			c.VisitLeaf(leaf("a", 1))
+			c.VisitLeaf(leaf("b", 1))
+			c.VisitInner(inner("a", 1, 2))
+		}, "smallest key"},
+		{"unbalanced", Balance, func(c *checker) {
+			c.stack = []subtree{{height: 0, size: 1}, {height: 2, size: 3}}
+			c.VisitInner(inner("b", 3, 4))
+		}, "unbalanced"},
+		{"wrong height", Balance, func(c *checker) {
+			c.VisitLeaf(leaf("a", 1))
+			c.VisitLeaf(leaf("b", 1))
+			c.VisitInner(inner("b", 2, 2))
+		}, "has height 2"},
+		{"wrong hash", Hashes, func(c *checker) {
+			node := leaf("a", 1)
+			node.Hash = make([]byte, 32)
+			c.VisitLeaf(node)
+		}, "has hash"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &checker{checks: tc.checks, slack: 1}
+			tc.visit(c)
+			require.ErrorContains(t, c.err, tc.err)
+		})
+	}
+}
@@ -1,15 +1,23 @@
 package iavl
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	corestore "cosmossdk.io/core/store"
 )
 
 // ImmutableTree contains the immutable tree at a given version. It is typically created by calling
 // MutableTree.GetImmutable(), in which case the returned tree is safe for concurrent access as
-// long as the version is not deleted via DeleteVersion() or the tree's pruning settings.
+// long as the version is not deleted via DeleteVersion() or the tree's pruning settings. Once it
+// is, the reads of the tree fail with ErrTreeInvalidated.
 //
 // Returned key/value byte slices must not be modified, since they may point to data located inside
 // IAVL which would also be modified.
@@ -20,6 +28,10 @@ type ImmutableTree struct {
 	ndb                    *nodeDB
 	version                int64
 	skipFastStorageUpgrade bool
+	// generation is the generation of the registry the tree was loaded in, 0 if it's not checked.
+	generation uint64
+	// cacheBypass skips adding the nodes read by the tree to the caches, see WithCacheBypass.
+	cacheBypass bool
 }
 
 // NewImmutableTree creates both in-memory and persistent instances
@@ -45,7 +57,7 @@ func NewImmutableTree(db corestore.KVStoreWithBatch, cacheSize int, skipFastStor
 // String returns a string representation of Tree.
 func (t *ImmutableTree) String() string {
 	leaves := []string{}
-	t.Iterate(func(key []byte, val []byte) (stop bool) { //nolint:errcheck
+	t.iterate(func(key []byte, val []byte) (stop bool) { //nolint:errcheck
 		leaves = append(leaves, fmt.Sprintf("%x: %x", key, val))
 		return false
 	})
@@ -141,6 +153,9 @@ func (t *ImmutableTree) Height() int8 {
 
 // Has returns whether or not a key exists.
 func (t *ImmutableTree) Has(key []byte) (bool, error) {
+	if err := t.checkGeneration(); err != nil {
+		return false, err
+	}
 	if t.root == nil {
 		return false, nil
 	}
@@ -155,7 +170,14 @@ func (t *ImmutableTree) Hash() []byte {
 // Export returns an iterator that exports tree nodes as ExportNodes. These nodes can be
 // imported with MutableTree.Import() to recreate an identical tree.
 func (t *ImmutableTree) Export() (*Exporter, error) {
-	return newExporter(t)
+	return newExporter(t, false)
+}
+
+// ExportLeaves returns an exporter of the leaves of the tree only, without their hashes, for a much
+// smaller export. The importer rebuilds a balanced tree with the same keys and values from them,
+// see ExportEncodingLeaves, but its structure and so its root hash differ from the exported tree.
+func (t *ImmutableTree) ExportLeaves() (*Exporter, error) {
+	return newExporter(t, true)
 }
 
 // GetWithIndex returns the index and value of the specified key if it exists, or nil and the next index
@@ -163,8 +185,13 @@ func (t *ImmutableTree) Export() (*Exporter, error) {
 // IAVL.
 //
 // The index is the index in the list of leaf nodes sorted lexicographically by key. The leftmost leaf has index 0.
-// It's neighbor has index 1 and so on.
+// It's neighbor has index 1 and so on. Both are found in a single descent from the root, so there
+// is no need to look the key up twice for its value and its index.
 func (t *ImmutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
+	t.onAccess(AccessGet, key)
+	if err := t.checkGeneration(); err != nil {
+		return 0, nil, err
+	}
 	if t.root == nil {
 		return 0, nil, nil
 	}
@@ -176,45 +203,161 @@ func (t *ImmutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
 // Get potentially employs a more performant strategy than GetWithIndex for retrieving the value.
 // If tree.skipFastStorageUpgrade is true, this will work almost the same as GetWithIndex.
 func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
+	t.onAccess(AccessGet, key)
+	defer t.latency().observe(LatencyGet, t.latency().startTimer())
+	return t.get(key)
+}
+
+// get is Get without the access hook.
+func (t *ImmutableTree) get(key []byte) ([]byte, error) {
+	if err := t.checkGeneration(); err != nil {
+		return nil, err
+	}
 	if t.root == nil {
 		return nil, nil
 	}
 
 	if !t.skipFastStorageUpgrade {
-		// attempt to get a FastNode directly from db/cache.
-		// if call fails, fall back to the original IAVL logic in place.
-		fastNode, err := t.ndb.GetFastNode(key)
-		if err != nil {
-			_, result, err := t.root.get(t, key)
-			return result, err
+		// the fast node index can only be trusted if it was built from the latest version's lineage,
+		// and isn't being updated by a commit
+		value, ok, err := t.ndb.getFastValue(key, t.version, !t.cacheBypass)
+		if err != nil || ok {
+			return value, err
 		}
+	}
 
-		if fastNode == nil {
-			// If the tree is of the latest version and fast node is not in the tree
-			// then the regular node is not in the tree either because fast node
-			// represents live state.
-			if t.version == t.ndb.latestVersion {
-				return nil, nil
-			}
+	// otherwise skipFastStorageUpgrade is true, the fast node index is stale or
+	// the cached node was updated later than the current tree. In this case,
+	// we need to use the regular stategy for reading from the current tree to avoid staleness.
+	_, result, err := t.root.get(t, key)
+	return result, err
+}
 
-			_, result, err := t.root.get(t, key)
-			return result, err
-		}
+// QueryOptions configures a single query.
+type QueryOptions struct {
+	// BypassFastCache reads the value from the tree nodes instead of the fast node index, for
+	// authoritative reads when the index is suspected to have drifted from the tree.
+	BypassFastCache bool
+}
 
-		if fastNode.GetVersionLastUpdatedAt() <= t.version {
-			return fastNode.GetValue(), nil
-		}
+// GetWithOptions is like Get, with the given query options.
+func (t *ImmutableTree) GetWithOptions(key []byte, opts QueryOptions) ([]byte, error) {
+	if !opts.BypassFastCache {
+		return t.Get(key)
 	}
+	t.onAccess(AccessGet, key)
+	return t.getFromNodes(key)
+}
 
-	// otherwise skipFastStorageUpgrade is true or
-	// the cached node was updated later than the current tree. In this case,
-	// we need to use the regular stategy for reading from the current tree to avoid staleness.
+// getFromNodes reads the value of the key from the tree nodes, bypassing the fast node index.
+func (t *ImmutableTree) getFromNodes(key []byte) ([]byte, error) {
+	if err := t.checkGeneration(); err != nil {
+		return nil, err
+	}
+	if t.root == nil {
+		return nil, nil
+	}
 	_, result, err := t.root.get(t, key)
 	return result, err
 }
 
+// onAccess calls the access hook of the tree, if any.
+func (t *ImmutableTree) onAccess(op AccessOp, key []byte) {
+	if t.ndb != nil && t.ndb.opts.AccessHook != nil {
+		t.ndb.opts.AccessHook(op, key, t.version)
+	}
+}
+
+// latency returns the latency histograms of the tree, nil if they aren't recorded.
+func (t *ImmutableTree) latency() *latencyMetrics {
+	if t.ndb == nil {
+		return nil
+	}
+	return t.ndb.latency
+}
+
+// GetMany returns the values of the given keys, with nil for keys which do not exist. The returned
+// values must not be modified, since they may point to data stored within IAVL. The paths to all
+// keys are walked together, so each level of the tree is read from the database in a single call
+// on backends implementing dbm.MultiGetter.
+func (t *ImmutableTree) GetMany(keys [][]byte) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	err := t.descend(keys, func(i int, leaf *Node) {
+		if bytes.Equal(leaf.key, keys[i]) {
+			values[i] = leaf.value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// descend walks down the paths to all the given keys level by level, loading the missing nodes of
+// each level with a single GetNodes call, and calls fn with the leaf reached for each key.
+func (t *ImmutableTree) descend(keys [][]byte, fn func(i int, leaf *Node)) error {
+	if err := t.checkGeneration(); err != nil {
+		return err
+	}
+	if t.root == nil {
+		return nil
+	}
+
+	nodes := make([]*Node, len(keys))
+	pending := make([]int, len(keys))
+	for i := range keys {
+		nodes[i] = t.root
+		pending[i] = i
+	}
+
+	for len(pending) > 0 {
+		var (
+			next     = pending[:0]
+			waiting  = make(map[string][]int)
+			nodeKeys [][]byte
+		)
+		for _, i := range pending {
+			node := nodes[i]
+			if node.isLeaf() {
+				fn(i, node)
+				continue
+			}
+			child, childKey := node.rightNode, node.rightNodeKey
+			if bytes.Compare(keys[i], node.key) < 0 {
+				child, childKey = node.leftNode, node.leftNodeKey
+			}
+			next = append(next, i)
+			if child != nil {
+				nodes[i] = child
+				continue
+			}
+			if _, ok := waiting[string(childKey)]; !ok {
+				nodeKeys = append(nodeKeys, childKey)
+			}
+			waiting[string(childKey)] = append(waiting[string(childKey)], i)
+		}
+
+		if len(nodeKeys) > 0 {
+			loaded, err := t.ndb.getNodes(nodeKeys, !t.cacheBypass)
+			if err != nil {
+				return err
+			}
+			for j, nodeKey := range nodeKeys {
+				for _, i := range waiting[string(nodeKey)] {
+					nodes[i] = loaded[j]
+				}
+			}
+		}
+		pending = next
+	}
+	return nil
+}
+
 // GetByIndex gets the key and value at the specified index.
 func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte, err error) {
+	if err := t.checkGeneration(); err != nil {
+		return nil, nil, err
+	}
 	if t.root == nil {
 		return nil, nil, nil
 	}
@@ -222,14 +365,56 @@ func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte, err e
 	return t.root.getByIndex(t, index)
 }
 
+// SampleKeys returns a uniform random sample of n distinct keys of the tree, in key order, e.g. to
+// audit a part of a huge tree. The sample is determined by the seed, so the same sample of the
+// same version can be checked again. Each key is found by its index with the subtree sizes. If n
+// is at least the size of the tree, all keys are returned. The keys must not be modified.
+func (t *ImmutableTree) SampleKeys(n int, seed int64) ([][]byte, error) {
+	size := t.Size()
+	if n <= 0 || size == 0 {
+		return nil, nil
+	}
+	if int64(n) > size {
+		n = int(size)
+	}
+
+	// Floyd's algorithm picks n distinct indexes uniformly with n draws.
+	rng := rand.New(rand.NewSource(seed))
+	picked := make(map[int64]struct{}, n)
+	for j := size - int64(n); j < size; j++ {
+		index := rng.Int63n(j + 1)
+		if _, ok := picked[index]; ok {
+			index = j
+		}
+		picked[index] = struct{}{}
+	}
+	indexes := slices.Sorted(maps.Keys(picked))
+
+	keys := make([][]byte, 0, n)
+	for _, index := range indexes {
+		key, _, err := t.GetByIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
 // since they may point to data stored within IAVL. Returns true if stopped by callback, false otherwise
 func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, error) {
+	t.onAccess(AccessIterate, nil)
+	return t.iterate(fn)
+}
+
+// iterate is Iterate without the access hook.
+func (t *ImmutableTree) iterate(fn func(key []byte, value []byte) bool) (bool, error) {
 	if t.root == nil {
 		return false, nil
 	}
 
-	itr, err := t.Iterator(nil, nil, true)
+	itr, err := t.iterator(nil, nil, true)
 	if err != nil {
 		return false, err
 	}
@@ -243,8 +428,158 @@ func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, e
 	return false, nil
 }
 
+// IterateHashes calls fn with the key and the hash of every leaf of the tree, in ascending key
+// order, e.g. to build another commitment over the tree or to find the leaves which changed between
+// versions by comparing their hashes. The leaf hashes are the ones the root hash is computed from,
+// so they change with the version a value was set at, not only with the value. The keys and hashes
+// must not be modified. Returns true if stopped by callback, false otherwise.
+func (t *ImmutableTree) IterateHashes(fn func(key []byte, leafHash []byte) bool) (bool, error) {
+	t.onAccess(AccessIterate, nil)
+	return t.iterateHashes(t.version, fn)
+}
+
+// iterateHashes is IterateHashes, hashing the leaves which have no hash yet at the given version.
+func (t *ImmutableTree) iterateHashes(version int64, fn func(key []byte, leafHash []byte) bool) (bool, error) {
+	if t.root == nil {
+		return false, nil
+	}
+
+	hasher := sha256.New()
+	var buf bytes.Buffer
+	trav := t.root.newTraversal(t, nil, nil, true, false, false)
+	for {
+		node, err := trav.next()
+		if err != nil {
+			return false, err
+		}
+		if node == nil {
+			return false, nil
+		}
+		if !node.isLeaf() {
+			continue
+		}
+		hash, err := node.computeHash(version, hasher, &buf)
+		if err != nil {
+			return false, err
+		}
+		if fn(node.key, hash) {
+			return true, nil
+		}
+	}
+}
+
+// IterateParallel iterates over all keys of the tree using the given number of workers. The key
+// space is partitioned into subtrees which are traversed concurrently, so fn is called from several
+// goroutines and in no particular order across subtrees; it must be safe for concurrent use. Keys
+// of the same subtree are visited in ascending order.
+//
+// Returning true from fn stops the iteration, although callbacks already in flight on other
+// workers may still complete. The keys and values must not be modified, since they may point to
+// data stored within IAVL. Returns true if stopped by callback, false otherwise.
+func (t *ImmutableTree) IterateParallel(workers int, fn func(key []byte, value []byte) bool) (bool, error) {
+	if workers <= 0 {
+		return false, fmt.Errorf("workers must be positive, got %d", workers)
+	}
+	if t.root == nil {
+		return false, nil
+	}
+
+	subtrees, err := t.partition(workers * parallelSubtreesPerWorker)
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		stop     atomic.Bool // set when any worker should stop
+		stopped  atomic.Bool // set when stopped by the callback
+		errOnce  sync.Once
+		firstErr error
+		jobs     = make(chan *Node, len(subtrees))
+	)
+	for _, subtree := range subtrees {
+		jobs <- subtree
+	}
+	close(jobs)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for subtree := range jobs {
+				trav := subtree.newTraversal(t, nil, nil, true, false, false)
+				for !stop.Load() {
+					node, err := trav.next()
+					if err != nil {
+						errOnce.Do(func() { firstErr = err })
+						stop.Store(true)
+						return
+					}
+					if node == nil {
+						break
+					}
+					if node.isLeaf() && fn(node.key, node.value) {
+						stopped.Store(true)
+						stop.Store(true)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return false, firstErr
+	}
+	return stopped.Load(), nil
+}
+
+// parallelSubtreesPerWorker is the number of subtrees IterateParallel aims to create per worker,
+// so that workers which finish early can pick up more work from unbalanced partitions.
+const parallelSubtreesPerWorker = 4
+
+// partition splits the tree into at least n disjoint subtrees covering all the leaves, unless the
+// tree has fewer leaves than that. The subtrees are returned in ascending key order.
+func (t *ImmutableTree) partition(n int) ([]*Node, error) {
+	subtrees := []*Node{t.root}
+	for len(subtrees) < n {
+		next := make([]*Node, 0, 2*len(subtrees))
+		expanded := false
+		for _, node := range subtrees {
+			if node.isLeaf() {
+				next = append(next, node)
+				continue
+			}
+			leftNode, err := node.getLeftNode(t)
+			if err != nil {
+				return nil, err
+			}
+			rightNode, err := node.getRightNode(t)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, leftNode, rightNode)
+			expanded = true
+		}
+		subtrees = next
+		if !expanded {
+			break
+		}
+	}
+	return subtrees, nil
+}
+
 // Iterator returns an iterator over the immutable tree.
 func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
+	t.onAccess(AccessIterate, start)
+	return t.iterator(start, end, ascending)
+}
+
+// iterator is Iterator without the access hook.
+func (t *ImmutableTree) iterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
+	if err := t.checkGeneration(); err != nil {
+		return nil, err
+	}
 	if !t.skipFastStorageUpgrade {
 		isFastCacheEnabled, err := t.IsFastCacheEnabled()
 		if err != nil {
@@ -252,12 +587,79 @@ func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) (corestore.I
 		}
 
 		if isFastCacheEnabled {
-			return NewFastIterator(start, end, ascending, t.ndb), nil
+			itr := NewFastIterator(start, end, ascending, t.ndb)
+			itr.version = t.version
+			return itr, nil
 		}
 	}
 	return NewIterator(start, end, ascending, t), nil
 }
 
+// IteratorOptions configures an iterator.
+type IteratorOptions struct {
+	// ClampToDomain clamps start and end to the first and last keys of the tree before iterating,
+	// so a range entirely outside of the stored keys returns an exhausted iterator without
+	// traversing the tree, e.g. for paginated queries with user supplied bounds.
+	ClampToDomain bool
+
+	// MaxOpsPerSec limits the average rate of the Next calls of the iterator, so a background job
+	// iterating the tree, e.g. an export or a reindex, doesn't compete with block processing for
+	// disk reads. Next sleeps while the iteration is ahead of the rate. Zero means no limit.
+	MaxOpsPerSec int64
+}
+
+// IteratorWithOptions is like Iterator, with the given iterator options. The Domain of the
+// returned iterator is the clamped range.
+func (t *ImmutableTree) IteratorWithOptions(start, end []byte, ascending bool, opts IteratorOptions) (corestore.Iterator, error) {
+	t.onAccess(AccessIterate, start)
+	if opts.ClampToDomain {
+		var (
+			empty bool
+			err   error
+		)
+		start, end, empty, err = t.clampToDomain(start, end)
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			return &Iterator{start: start, end: end}, nil
+		}
+	}
+	itr, err := t.iterator(start, end, ascending)
+	if err != nil {
+		return nil, err
+	}
+	return newThrottledIterator(itr, opts.MaxOpsPerSec), nil
+}
+
+// clampToDomain clamps the start to the first key of the tree, and opens the end if it is past the
+// last key. It returns true if the range doesn't contain any key of the tree.
+func (t *ImmutableTree) clampToDomain(start, end []byte) ([]byte, []byte, bool, error) {
+	if t.root == nil {
+		return start, end, true, nil
+	}
+	first, _, err := t.root.getByIndex(t, 0)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	last, _, err := t.root.getByIndex(t, t.root.size-1)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if (end != nil && bytes.Compare(end, first) <= 0) || (start != nil && bytes.Compare(start, last) > 0) {
+		return start, end, true, nil
+	}
+	if start == nil || bytes.Compare(start, first) < 0 {
+		start = first
+	}
+	if end != nil && bytes.Compare(end, last) > 0 {
+		// the end is exclusive, so it can't be clamped to the last key
+		end = nil
+	}
+	return start, end, false, nil
+}
+
 // IterateRange makes a callback for all nodes with key between start and end non-inclusive.
 // If either are nil, then it is open on that side (nil, nil is the same as Iterate). The keys and
 // values must not be modified, since they may point to data stored within IAVL.
@@ -297,7 +699,7 @@ func (t *ImmutableTree) IsFastCacheEnabled() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return isLatestTreeVersion && t.ndb.hasUpgradedToFastStorage(), nil
+	return isLatestTreeVersion && t.ndb.hasUpgradedToFastStorage() && !t.ndb.fastNodeWritesPending(), nil
 }
 
 func (t *ImmutableTree) isLatestTreeVersion() (bool, error) {
@@ -316,9 +718,26 @@ func (t *ImmutableTree) clone() *ImmutableTree {
 		ndb:                    t.ndb,
 		version:                t.version,
 		skipFastStorageUpgrade: t.skipFastStorageUpgrade,
+		generation:             t.generation,
+		cacheBypass:            t.cacheBypass,
 	}
 }
 
+// WithCacheBypass returns a copy of the tree whose reads don't add the nodes they load from disk
+// to the node caches, e.g. for bulk exports and migrations, so they don't evict the working set of
+// the other readers. Cached nodes are still read from the caches.
+func (t *ImmutableTree) WithCacheBypass() *ImmutableTree {
+	bypass := t.clone()
+	bypass.logger = t.logger
+	bypass.cacheBypass = true
+	return bypass
+}
+
+// getNode gets a node from the nodeDB, see WithCacheBypass.
+func (t *ImmutableTree) getNode(nk []byte) (*Node, error) {
+	return t.ndb.getNode(nk, !t.cacheBypass)
+}
+
 // nodeSize is like Size, but includes inner nodes too.
 // used only for testing.
 func (t *ImmutableTree) nodeSize() int {
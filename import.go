@@ -4,18 +4,53 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"cosmossdk.io/core/store"
+
+	dbm "github.com/cosmos/iavl/db"
 )
 
-// maxBatchSize is the maximum size of the import batch before flushing it to the database
+// maxBatchSize is the maximum size of the import batch before flushing it to the database, unless
+// set by Options.ImportBatchSize
 const maxBatchSize = 10000
 
+// compactionDebtPollInterval is how often a paused import polls the compaction debt of the backend.
+const compactionDebtPollInterval = 100 * time.Millisecond
+
 // ErrNoImport is returned when calling methods on a closed importer
 var ErrNoImport = errors.New("no import in progress")
 
-// Importer imports data into an empty MutableTree. It is created by MutableTree.Import(). Users
-// must call Close() when done.
+// ErrImportHashMismatch is returned by an importer verifying hashes when a node or the root doesn't
+// have the expected hash
+var ErrImportHashMismatch = errors.New("import hash mismatch")
+
+// ImportOptions configures an Importer.
+type ImportOptions struct {
+	// VerifyHashes recomputes the hash of every imported node and compares it with ExportNode.Hash.
+	// Nodes without a hash, e.g. from a CompressExporter, are only covered by the check of the root
+	// hash against RootHash, which Commit does before the imported version is made visible.
+	VerifyHashes bool
+
+	// RootHash is the expected root hash of the imported version, e.g. from a trusted app hash.
+	RootHash []byte
+
+	// MaxWriteBytesPerSec limits the average rate of the batch writes, so the compactions of a
+	// large import, e.g. a state-sync restore, don't stall the node once it completes. Zero means
+	// no limit.
+	MaxWriteBytesPerSec int64
+
+	// PauseOnCompactionDebt pauses the import before each batch write while the compaction debt of
+	// the backend is above this many bytes. It requires a backend implementing
+	// dbm.CompactionDebtReporter, and is ignored otherwise. Zero means no pauses.
+	PauseOnCompactionDebt int64
+}
+
+// Importer imports data into an empty MutableTree. It is created by MutableTree.Import(), or by
+// MutableTree.ImportRange() to import a key range into the working tree. Users must call Close()
+// when done.
 //
 // ExportNodes must be imported in the order returned by Exporter, i.e. depth-first post-order (LRN).
 //
@@ -24,10 +59,23 @@ var ErrNoImport = errors.New("no import in progress")
 type Importer struct {
 	tree      *MutableTree
 	version   int64
+	opts      ImportOptions
 	batch     store.Batch
 	batchSize uint32
 	stack     []*Node
 	nonces    []uint32
+	lastHash  []byte // ExportNode.Hash of the last added node, i.e. of the root on Commit
+	added     bool
+	header    ExportHeader
+	decoder   NodeImporter // decodes nodes of a compressed stream before adding them
+	order     exportOrderChecker
+	ranged    bool         // the nodes are kept in memory, and stitched into the working tree on Commit
+	written   atomic.Int64 // bytes of the written batches
+	nodes     atomic.Int64 // nodes passed to Add
+	total     atomic.Int64 // nodes of the stream, from its ExportHeader.LeafCount
+	started   time.Time
+	throttled time.Time // time of the first batch write throttled by MaxWriteBytesPerSec
+	sleep     func(time.Duration)
 
 	// inflightCommit tracks a batch commit, if any.
 	inflightCommit <-chan error
@@ -37,7 +85,7 @@ type Importer struct {
 //
 // version should correspond to the version that was initially exported. It must be greater than
 // or equal to the highest ExportNode version number given.
-func newImporter(tree *MutableTree, version int64) (*Importer, error) {
+func newImporter(tree *MutableTree, version int64, opts ImportOptions) (*Importer, error) {
 	if version < 0 {
 		return nil, errors.New("imported version cannot be negative")
 	}
@@ -51,7 +99,11 @@ func newImporter(tree *MutableTree, version int64) (*Importer, error) {
 	return &Importer{
 		tree:    tree,
 		version: version,
-		batch:   tree.ndb.db.NewBatch(),
+		opts:    opts,
+		started: time.Now(),
+		sleep:   time.Sleep,
+		header:  ExportHeader{FormatVersion: ExportFormatVersion, HashFunction: ExportHashSHA256, NodeEncoding: ExportEncodingPlain},
+		batch:   tree.ndb.newBatch(tree.ndb.opts.BackendHints.Import),
 		stack:   make([]*Node, 0, 8),
 		nonces:  make([]uint32, version+1),
 	}, nil
@@ -80,7 +132,15 @@ func (i *Importer) writeNode(node *Node) error {
 	}
 
 	i.batchSize++
-	if i.batchSize >= maxBatchSize {
+	flush := int(i.batchSize) >= i.tree.ndb.opts.importBatchSize()
+	if maxBatchBytes := i.tree.ndb.opts.MaxBatchBytes; !flush && maxBatchBytes > 0 {
+		size, err := i.batch.GetByteSize()
+		if err != nil {
+			return err
+		}
+		flush = size >= maxBatchBytes
+	}
+	if flush {
 		// Wait for previous batch.
 		var err error
 		if i.inflightCommit != nil {
@@ -90,19 +150,62 @@ func (i *Importer) writeNode(node *Node) error {
 		if err != nil {
 			return err
 		}
+		if err := i.throttle(); err != nil {
+			return err
+		}
 		result := make(chan error)
 		i.inflightCommit = result
+		latency := i.tree.ndb.latency
 		go func(batch store.Batch) {
 			defer batch.Close()
-			result <- batch.Write()
+			start := latency.startTimer()
+			err := batch.Write()
+			latency.observe(LatencyImportChunk, start)
+			result <- err
 		}(i.batch)
-		i.batch = i.tree.ndb.db.NewBatch()
+		i.batch = i.tree.ndb.newBatch(i.tree.ndb.opts.BackendHints.Import)
 		i.batchSize = 0
 	}
 
 	return nil
 }
 
+// throttle accounts the size of the batch before it is written, and waits until the backend has
+// paid down its compaction debt and the write stays within MaxWriteBytesPerSec, see ImportOptions.
+func (i *Importer) throttle() error {
+	size, err := i.batch.GetByteSize()
+	if err != nil {
+		return err
+	}
+	written := i.written.Add(int64(size))
+
+	if i.opts.PauseOnCompactionDebt > 0 {
+		if reporter, ok := i.tree.ndb.db.(dbm.CompactionDebtReporter); ok {
+			for {
+				debt, err := reporter.CompactionDebt()
+				if err != nil {
+					return fmt.Errorf("failed to get compaction debt: %w", err)
+				}
+				if debt <= i.opts.PauseOnCompactionDebt {
+					break
+				}
+				i.sleep(compactionDebtPollInterval)
+			}
+		}
+	}
+
+	if i.opts.MaxWriteBytesPerSec > 0 {
+		if i.throttled.IsZero() {
+			i.throttled = time.Now()
+		}
+		due := time.Duration(float64(written) / float64(i.opts.MaxWriteBytesPerSec) * float64(time.Second))
+		if wait := due - time.Since(i.throttled); wait > 0 {
+			i.sleep(wait)
+		}
+	}
+	return nil
+}
+
 // Close frees all resources. It is safe to call multiple times. Uncommitted nodes may already have
 // been flushed to the database, but will not be visible.
 func (i *Importer) Close() {
@@ -117,6 +220,56 @@ func (i *Importer) Close() {
 	i.tree = nil
 }
 
+// SetHeader sets the header of the export stream, which must precede the nodes. Streams without a
+// header, e.g. from releases before ExportFormatV2, are imported with the plain node encoding. It
+// returns ErrUnsupportedExportFormat if the stream can't be imported by this release.
+func (i *Importer) SetHeader(header ExportHeader) error {
+	if i.tree == nil {
+		return ErrNoImport
+	}
+	if i.added {
+		return errors.New("export header must be set before adding nodes")
+	}
+	if err := validateExportHeader(header); err != nil {
+		return err
+	}
+
+	switch header.NodeEncoding {
+	case ExportEncodingPlain:
+		i.decoder = nil
+	case ExportEncodingCompressed:
+		i.decoder = NewCompressImporter(nodeImporterFunc(i.add))
+	case ExportEncodingLeaves:
+		i.decoder = newLeafImporter(header.LeafCount, i.version, nodeImporterFunc(i.add))
+	}
+	i.header = header
+	i.total.Store(exportNodeCount(header.LeafCount, header.NodeEncoding == ExportEncodingLeaves))
+	return nil
+}
+
+// validateExportHeader returns ErrUnsupportedExportFormat if the stream of the header can't be
+// imported by this release.
+func validateExportHeader(header ExportHeader) error {
+	if header.FormatVersion < ExportFormatV1 || header.FormatVersion > ExportFormatVersion {
+		return fmt.Errorf("%w: format version %d, supported up to %d", ErrUnsupportedExportFormat,
+			header.FormatVersion, ExportFormatVersion)
+	}
+	if header.HashFunction != ExportHashSHA256 {
+		return fmt.Errorf("%w: hash function %q", ErrUnsupportedExportFormat, header.HashFunction)
+	}
+
+	switch header.NodeEncoding {
+	case ExportEncodingPlain, ExportEncodingCompressed:
+	case ExportEncodingLeaves:
+		if header.LeafCount < 0 {
+			return fmt.Errorf("invalid leaf count %d", header.LeafCount)
+		}
+	default:
+		return fmt.Errorf("%w: node encoding %q", ErrUnsupportedExportFormat, header.NodeEncoding)
+	}
+	return nil
+}
+
 // Add adds an ExportNode to the import. ExportNodes must be added in the order returned by
 // Exporter, i.e. depth-first post-order (LRN). Nodes are periodically flushed to the database,
 // but the imported version is not visible until Commit() is called.
@@ -127,10 +280,48 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	if exportNode == nil {
 		return errors.New("node cannot be nil")
 	}
-	if exportNode.Version > i.version {
+	i.added = true
+	var err error
+	if i.decoder != nil {
+		err = i.decoder.Add(exportNode)
+	} else {
+		err = i.add(exportNode)
+	}
+	if err == nil {
+		i.nodes.Add(1)
+	}
+	return err
+}
+
+// Progress returns the progress of the import, with the total from the ExportHeader.LeafCount of
+// the stream, if any. It is safe to call concurrently with Add and Commit.
+func (i *Importer) Progress() Progress {
+	return Progress{
+		Nodes:      i.nodes.Load(),
+		TotalNodes: i.total.Load(),
+		Bytes:      i.written.Load(),
+		Elapsed:    time.Since(i.started),
+	}
+}
+
+// add adds a decoded ExportNode to the import.
+func (i *Importer) add(exportNode *ExportNode) error {
+	if i.header.FormatVersion < ExportFormatV2 {
+		// nodes of older formats don't have hashes
+		exportNode.Hash = nil
+	}
+	if !i.ranged && exportNode.Version > i.version {
 		return fmt.Errorf("node version %v can't be greater than import version %v",
 			exportNode.Version, i.version)
 	}
+	if err := i.order.check(exportNode); err != nil {
+		return err
+	}
+
+	if exportNode.Height == 0 && exportNode.Value == nil && i.tree.ndb.opts.AllowEmptyValues {
+		// the encodings of the nodes don't tell an empty value from a missing one
+		exportNode.Value = []byte{}
+	}
 
 	node := &Node{
 		key:           exportNode.Key,
@@ -148,50 +339,84 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	stackSize := len(i.stack)
 	if node.subtreeHeight == 0 {
 		node.size = 1
+		if err := i.verifyHash(node, exportNode); err != nil {
+			return err
+		}
 	} else if stackSize >= 2 && i.stack[stackSize-1].subtreeHeight < node.subtreeHeight && i.stack[stackSize-2].subtreeHeight < node.subtreeHeight {
 		leftNode := i.stack[stackSize-2]
 		rightNode := i.stack[stackSize-1]
 
 		node.leftNode = leftNode
 		node.rightNode = rightNode
-		node.leftNodeKey = leftNode.GetKey()
-		node.rightNodeKey = rightNode.GetKey()
 		node.size = leftNode.size + rightNode.size
-
-		// Update the stack now.
-		if err := i.writeNode(leftNode); err != nil {
+		if err := i.verifyHash(node, exportNode); err != nil {
 			return err
 		}
-		if err := i.writeNode(rightNode); err != nil {
-			return err
+		if !i.ranged {
+			node.leftNodeKey = leftNode.GetKey()
+			node.rightNodeKey = rightNode.GetKey()
+
+			// Update the stack now.
+			if err := i.writeNode(leftNode); err != nil {
+				return err
+			}
+			if err := i.writeNode(rightNode); err != nil {
+				return err
+			}
+
+			// remove the recursive references to avoid memory leak
+			leftNode.leftNode = nil
+			leftNode.rightNode = nil
+			rightNode.leftNode = nil
+			rightNode.rightNode = nil
 		}
 		i.stack = i.stack[:stackSize-2]
-
-		// remove the recursive references to avoid memory leak
-		leftNode.leftNode = nil
-		leftNode.rightNode = nil
-		rightNode.leftNode = nil
-		rightNode.rightNode = nil
 	}
-	i.nonces[exportNode.Version]++
-	node.nodeKey = &NodeKey{
-		version: exportNode.Version,
-		// Nonce is 1-indexed, but start at 2 since the root node having a nonce of 1.
-		nonce: i.nonces[exportNode.Version] + 1,
+	if i.ranged {
+		// the nodes stay new nodes of the working tree, hashed at their version to verify them
+		node._hash(exportNode.Version)
+	} else {
+		i.nonces[exportNode.Version]++
+		node.nodeKey = &NodeKey{
+			version: exportNode.Version,
+			// Nonce is 1-indexed, but start at 2 since the root node having a nonce of 1.
+			nonce: i.nonces[exportNode.Version] + 1,
+		}
 	}
 
 	i.stack = append(i.stack, node)
+	i.lastHash = exportNode.Hash
+
+	return nil
+}
 
+// verifyHash checks the hash of the node built from exportNode, when verifying hashes.
+func (i *Importer) verifyHash(node *Node, exportNode *ExportNode) error {
+	if !i.opts.VerifyHashes {
+		return nil
+	}
+	if len(exportNode.Hash) == 0 {
+		return nil
+	}
+	// the children were hashed when they were added
+	if hash := node._hash(exportNode.Version); !bytes.Equal(hash, exportNode.Hash) {
+		return fmt.Errorf("%w: node with key %X at version %d has hash %X, expected %X",
+			ErrImportHashMismatch, exportNode.Key, exportNode.Version, hash, exportNode.Hash)
+	}
 	return nil
 }
 
 // Commit finalizes the import by flushing any outstanding nodes to the database, making the
-// version visible, and updating the tree metadata. It can only be called once, and calls Close()
-// internally.
+// version visible, and updating the tree metadata. The nodes of a range import are stitched into
+// the working tree instead, see MutableTree.ImportRange. It can only be called once, and calls
+// Close() internally.
 func (i *Importer) Commit() error {
 	if i.tree == nil {
 		return ErrNoImport
 	}
+	if i.ranged {
+		return i.commitRange()
+	}
 
 	switch len(i.stack) {
 	case 0:
@@ -212,6 +437,34 @@ func (i *Importer) Commit() error {
 		return fmt.Errorf("invalid node structure, found stack size %v when committing",
 			len(i.stack))
 	}
+	var size int64
+	if len(i.stack) == 1 {
+		size = i.stack[0].size
+	}
+	if err := i.batch.Set(versionSizeKeyFormat.Key(i.version), versionSizeValue(size, size)); err != nil {
+		return err
+	}
+	if err := i.batch.Set(versionTimeKeyFormat.Key(i.version), versionTimeValue(i.tree.ndb.opts.now())); err != nil {
+		return err
+	}
+	if err := i.batch.Set(metadataKeyFormat.Key([]byte(commitVersionKey)), []byte(strconv.FormatInt(i.version, 10))); err != nil {
+		return err
+	}
+
+	if i.opts.VerifyHashes {
+		var root *Node
+		if len(i.stack) == 1 {
+			root = i.stack[0]
+		}
+		if i.opts.RootHash == nil {
+			// the root was checked against its export hash by Add, if it had one
+			if root != nil && i.lastHash == nil {
+				return errors.New("no hash to verify the imported root against")
+			}
+		} else if hash := root.hashWithCount(i.version); !bytes.Equal(hash, i.opts.RootHash) {
+			return fmt.Errorf("%w: imported root hash %X, expected %X", ErrImportHashMismatch, hash, i.opts.RootHash)
+		}
+	}
 
 	// Wait for previous batch.
 	var err error
@@ -222,11 +475,16 @@ func (i *Importer) Commit() error {
 	if err != nil {
 		return err
 	}
+	if err := i.throttle(); err != nil {
+		return err
+	}
 
+	start := i.tree.ndb.latency.startTimer()
 	err = i.batch.WriteSync()
 	if err != nil {
 		return err
 	}
+	i.tree.ndb.latency.observe(LatencyImportChunk, start)
 	i.tree.ndb.resetLatestVersion(i.version)
 
 	_, err = i.tree.LoadVersion(i.version)
@@ -237,3 +495,84 @@ func (i *Importer) Commit() error {
 	i.Close()
 	return nil
 }
+
+// leafImporter builds the inner nodes of a size balanced tree over a stream of leafCount leaves in
+// ascending key order, see ExportEncodingLeaves. The left subtree of every inner node holds the
+// larger half of its leaves, and the inner nodes are added at the import version.
+type leafImporter struct {
+	inner     NodeImporter
+	leafCount int64
+	version   int64
+	added     int64
+	lastKey   []byte
+	splitKeys [][]byte // keys of the inner nodes on the path to the last leaf, by depth
+}
+
+func newLeafImporter(leafCount, version int64, inner NodeImporter) *leafImporter {
+	return &leafImporter{inner: inner, leafCount: leafCount, version: version}
+}
+
+func (l *leafImporter) Add(node *ExportNode) error {
+	if node.Height != 0 {
+		return fmt.Errorf("leaf export contains an inner node of height %d", node.Height)
+	}
+	if l.added >= l.leafCount {
+		return fmt.Errorf("leaf export contains more than %d leaves", l.leafCount)
+	}
+	if l.added > 0 && bytes.Compare(node.Key, l.lastKey) <= 0 {
+		return fmt.Errorf("%w: leaf key %X is not greater than the previous key %X", ErrExportOrder, node.Key, l.lastKey)
+	}
+	idx := l.added
+	l.added++
+	l.lastKey = node.Key
+
+	// walk down to the leaf, recording the keys of inner nodes whose right subtree starts at it and
+	// the inner nodes which are completed by it
+	type innerNode struct {
+		depth  int
+		leaves int64
+	}
+	var completed []innerNode
+	lo, hi := int64(0), l.leafCount
+	for depth := 0; hi-lo > 1; depth++ {
+		mid := lo + (hi-lo+1)/2
+		if len(l.splitKeys) <= depth {
+			l.splitKeys = append(l.splitKeys, nil)
+		}
+		if idx == mid {
+			l.splitKeys[depth] = node.Key
+		}
+		if hi == idx+1 {
+			completed = append(completed, innerNode{depth: depth, leaves: hi - lo})
+		}
+		if idx < mid {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	if err := l.inner.Add(node); err != nil {
+		return err
+	}
+	// add the completed inner nodes bottom-up, as in a post-order export
+	for j := len(completed) - 1; j >= 0; j-- {
+		if err := l.inner.Add(&ExportNode{
+			Key:     l.splitKeys[completed[j].depth],
+			Version: l.version,
+			Height:  balancedHeight(completed[j].leaves),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// balancedHeight returns the height of a size balanced tree with n leaves.
+func balancedHeight(n int64) int8 {
+	var height int8
+	for ; n > 1; n = (n + 1) / 2 {
+		height++
+	}
+	return height
+}
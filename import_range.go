@@ -0,0 +1,114 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// ErrImportRangeOverlap is returned by the Commit of a range import when the working tree has keys
+// within the imported key range.
+var ErrImportRangeOverlap = errors.New("imported range overlaps the keys of the tree")
+
+// ImportRange returns an Importer of an exported key range, e.g. a subspace of another tree, into
+// the working tree, which doesn't need to be empty. Commit checks that the working tree has no keys
+// between the smallest and largest imported key, and stitches the imported subtree in between the
+// rest of the tree, rebalancing the spine it is joined at. The imported nodes are saved as new
+// nodes by the next SaveVersion, so the tree, and its hash, can differ from setting the keys one by
+// one with Set. The options verify the imported subtree against its export hashes, and RootHash is
+// the hash of the exported subtree. The imported nodes are held in memory until the next
+// SaveVersion.
+//
+// It is the callers responsibility that no other modifications are made to the tree while
+// importing.
+func (tree *MutableTree) ImportRange(opts ImportOptions) (*Importer, error) {
+	return &Importer{
+		tree:    tree,
+		version: tree.WorkingVersion(),
+		opts:    opts,
+		ranged:  true,
+		started: time.Now(),
+		sleep:   time.Sleep,
+		header:  ExportHeader{FormatVersion: ExportFormatVersion, HashFunction: ExportHashSHA256, NodeEncoding: ExportEncodingPlain},
+		stack:   make([]*Node, 0, 8),
+	}, nil
+}
+
+// commitRange stitches the subtree of a range import into the working tree.
+func (i *Importer) commitRange() error {
+	defer i.Close()
+	tree := i.tree
+
+	var root *Node
+	switch len(i.stack) {
+	case 0:
+		return nil
+	case 1:
+		root = i.stack[0]
+	default:
+		return fmt.Errorf("invalid node structure, found stack size %v when committing",
+			len(i.stack))
+	}
+	if i.opts.VerifyHashes {
+		if i.opts.RootHash == nil {
+			// the root was checked against its export hash by Add, if it had one
+			if i.lastHash == nil {
+				return errors.New("no hash to verify the imported root against")
+			}
+		} else if !bytes.Equal(root.hash, i.opts.RootHash) {
+			return fmt.Errorf("%w: imported root hash %X, expected %X", ErrImportHashMismatch, root.hash, i.opts.RootHash)
+		}
+	}
+
+	// the hashes of the imported nodes are those of their export versions, and are recomputed by
+	// SaveVersion
+	var leaves []*Node
+	var collect func(node *Node)
+	collect = func(node *Node) {
+		node.hash = nil
+		if node.isLeaf() {
+			leaves = append(leaves, node)
+			return
+		}
+		collect(node.leftNode)
+		collect(node.rightNode)
+	}
+	collect(root)
+	first, last := leaves[0].key, leaves[len(leaves)-1].key
+
+	left, rest, err := tree.splitNode(tree.root, first)
+	if err != nil {
+		return err
+	}
+	existing, right, err := tree.splitNode(rest, append(append(make([]byte, 0, len(last)+1), last...), 0))
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("%w: %d keys are within the imported range %X to %X", ErrImportRangeOverlap, existing.size, first, last)
+	}
+
+	for _, leaf := range leaves {
+		tree.onAccess(AccessSet, leaf.key)
+		if err := tree.writeIntent(IntentSet, leaf.key, leaf.value); err != nil {
+			return err
+		}
+	}
+	if root, err = tree.joinNodes(left, root); err != nil {
+		return err
+	}
+	if root, err = tree.joinNodes(root, right); err != nil {
+		return err
+	}
+	tree.root = root
+	for _, leaf := range leaves {
+		if !tree.skipFastStorageUpgrade {
+			tree.addUnsavedAddition(leaf.key, fastnode.NewNode(leaf.key, leaf.value, tree.WorkingVersion()))
+		}
+		tree.recordChange(leaf.key, leaf.value, false)
+	}
+	return nil
+}
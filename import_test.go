@@ -1,7 +1,10 @@
 package iavl
 
 import (
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -231,6 +234,83 @@ func TestImporter_Commit_Empty(t *testing.T) {
 	assert.EqualValues(t, 3, tree.Version())
 }
 
+func TestImporter_VerifyHashes(t *testing.T) {
+	source := setupExportTreeBasic(t)
+
+	exportNodes := func(compress bool) []*ExportNode {
+		exporter, err := source.Export()
+		require.NoError(t, err)
+		defer exporter.Close()
+
+		var nodeExporter NodeExporter = exporter
+		if compress {
+			nodeExporter = NewCompressExporter(exporter)
+		}
+		var nodes []*ExportNode
+		for {
+			node, err := nodeExporter.Next()
+			if err == ErrorExportDone {
+				return nodes
+			}
+			require.NoError(t, err)
+			nodes = append(nodes, node)
+		}
+	}
+
+	importNodes := func(nodes []*ExportNode, compress bool, opts ImportOptions) (*MutableTree, error) {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		importer, err := tree.ImportWithOptions(source.Version(), opts)
+		require.NoError(t, err)
+		defer importer.Close()
+
+		var nodeImporter NodeImporter = importer
+		if compress {
+			nodeImporter = NewCompressImporter(importer)
+		}
+		for _, node := range nodes {
+			if err := nodeImporter.Add(node); err != nil {
+				return tree, err
+			}
+		}
+		return tree, importer.Commit()
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		tree, err := importNodes(exportNodes(false), false, ImportOptions{VerifyHashes: true, RootHash: source.Hash()})
+		require.NoError(t, err)
+		require.Equal(t, source.Hash(), tree.Hash())
+	})
+
+	t.Run("corrupt node", func(t *testing.T) {
+		nodes := exportNodes(false)
+		nodes[0].Value = []byte("corrupt")
+		tree, err := importNodes(nodes, false, ImportOptions{VerifyHashes: true})
+		require.ErrorIs(t, err, ErrImportHashMismatch)
+		require.EqualValues(t, 0, tree.Version())
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		tree, err := importNodes(exportNodes(true), true, ImportOptions{VerifyHashes: true, RootHash: source.Hash()})
+		require.NoError(t, err)
+		require.Equal(t, source.Hash(), tree.Hash())
+	})
+
+	t.Run("compressed corrupt node", func(t *testing.T) {
+		nodes := exportNodes(true)
+		nodes[0].Value = []byte("corrupt")
+		tree, err := importNodes(nodes, true, ImportOptions{VerifyHashes: true, RootHash: source.Hash()})
+		require.ErrorIs(t, err, ErrImportHashMismatch)
+		latest, err := tree.ndb.getLatestVersion()
+		require.NoError(t, err)
+		require.EqualValues(t, 0, latest)
+	})
+
+	t.Run("compressed without root hash", func(t *testing.T) {
+		_, err := importNodes(exportNodes(true), true, ImportOptions{VerifyHashes: true})
+		require.Error(t, err)
+	})
+}
+
 func BenchmarkImport(b *testing.B) {
 	benchmarkImport(b, 4096)
 }
@@ -271,3 +351,230 @@ func benchmarkImport(b *testing.B, nodes int) {
 		require.NoError(b, err)
 	}
 }
+
+func TestImporter_SetHeader(t *testing.T) {
+	source := setupExportTreeBasic(t)
+
+	newImporter := func(t *testing.T, opts ImportOptions) (*MutableTree, *Importer) {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		importer, err := tree.ImportWithOptions(source.Version(), opts)
+		require.NoError(t, err)
+		t.Cleanup(importer.Close)
+		return tree, importer
+	}
+
+	t.Run("compressed", func(t *testing.T) {
+		exporter, err := source.Export()
+		require.NoError(t, err)
+		defer exporter.Close()
+		compressExporter := NewCompressExporter(exporter).(*CompressExporter)
+
+		tree, importer := newImporter(t, ImportOptions{})
+		header := compressExporter.Header()
+		require.Equal(t, ExportEncodingCompressed, header.NodeEncoding)
+		require.NoError(t, importer.SetHeader(header))
+		for {
+			node, err := compressExporter.Next()
+			if err == ErrorExportDone {
+				break
+			}
+			require.NoError(t, err)
+			require.NoError(t, importer.Add(node))
+		}
+		require.NoError(t, importer.Commit())
+		require.Equal(t, source.Hash(), tree.Hash())
+	})
+
+	t.Run("older format", func(t *testing.T) {
+		_, importer := newImporter(t, ImportOptions{VerifyHashes: true, RootHash: source.Hash()})
+		require.NoError(t, importer.SetHeader(ExportHeader{
+			FormatVersion: ExportFormatV1, HashFunction: ExportHashSHA256, NodeEncoding: ExportEncodingPlain,
+		}))
+		// hashes are ignored for formats without them
+		require.NoError(t, importer.Add(&ExportNode{Key: []byte("a"), Value: []byte{1}, Version: 1, Hash: []byte("bogus")}))
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, importer := newImporter(t, ImportOptions{})
+		err := importer.SetHeader(ExportHeader{
+			FormatVersion: ExportFormatVersion + 1, HashFunction: ExportHashSHA256, NodeEncoding: ExportEncodingPlain,
+		})
+		require.ErrorIs(t, err, ErrUnsupportedExportFormat)
+		err = importer.SetHeader(ExportHeader{
+			FormatVersion: ExportFormatVersion, HashFunction: "sha3", NodeEncoding: ExportEncodingPlain,
+		})
+		require.ErrorIs(t, err, ErrUnsupportedExportFormat)
+		err = importer.SetHeader(ExportHeader{
+			FormatVersion: ExportFormatVersion, HashFunction: ExportHashSHA256, NodeEncoding: "zstd",
+		})
+		require.ErrorIs(t, err, ErrUnsupportedExportFormat)
+	})
+
+	t.Run("after nodes", func(t *testing.T) {
+		_, importer := newImporter(t, ImportOptions{})
+		require.NoError(t, importer.Add(&ExportNode{Key: []byte("a"), Value: []byte{1}, Version: 1}))
+		require.Error(t, importer.SetHeader(ExportHeader{
+			FormatVersion: ExportFormatVersion, HashFunction: ExportHashSHA256, NodeEncoding: ExportEncodingPlain,
+		}))
+	})
+}
+
+// compactionDebtDB reports the next of its debts on each call, and the last one once exhausted.
+type compactionDebtDB struct {
+	*dbm.MemDB
+	debts []int64
+	calls int
+}
+
+func (db *compactionDebtDB) CompactionDebt() (int64, error) {
+	debt := db.debts[min(db.calls, len(db.debts)-1)]
+	db.calls++
+	return debt, nil
+}
+
+func TestImporter_Throttle(t *testing.T) {
+	source := setupExportTreeSized(t, 100)
+	importTree := func(db *compactionDebtDB, opts ImportOptions) []time.Duration {
+		exporter, err := source.Export()
+		require.NoError(t, err)
+		defer exporter.Close()
+
+		tree := NewMutableTree(db, 0, false, NewNopLogger())
+		importer, err := tree.ImportWithOptions(source.Version(), opts)
+		require.NoError(t, err)
+		defer importer.Close()
+		var sleeps []time.Duration
+		importer.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+		for {
+			node, err := exporter.Next()
+			if errors.Is(err, ErrorExportDone) {
+				break
+			}
+			require.NoError(t, err)
+			require.NoError(t, importer.Add(node))
+		}
+		require.NoError(t, importer.Commit())
+		require.Equal(t, source.Hash(), tree.Hash())
+		return sleeps
+	}
+
+	t.Run("no limits", func(t *testing.T) {
+		db := &compactionDebtDB{MemDB: dbm.NewMemDB(), debts: []int64{1 << 30}}
+		require.Empty(t, importTree(db, ImportOptions{}))
+		require.Zero(t, db.calls)
+	})
+
+	t.Run("write rate", func(t *testing.T) {
+		// a single batch of a few KB at 100 bytes per second waits for most of its duration
+		sleeps := importTree(&compactionDebtDB{MemDB: dbm.NewMemDB(), debts: []int64{0}},
+			ImportOptions{MaxWriteBytesPerSec: 100})
+		require.Len(t, sleeps, 1)
+		require.Greater(t, sleeps[0], 10*time.Second)
+	})
+
+	t.Run("compaction debt", func(t *testing.T) {
+		db := &compactionDebtDB{MemDB: dbm.NewMemDB(), debts: []int64{300, 200, 100}}
+		sleeps := importTree(db, ImportOptions{PauseOnCompactionDebt: 100})
+		require.Equal(t, []time.Duration{compactionDebtPollInterval, compactionDebtPollInterval}, sleeps)
+		require.Equal(t, 3, db.calls)
+	})
+}
+
+func TestMutableTree_SyncFrom(t *testing.T) {
+	source := setupExportTreeSized(t, 200)
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, tree.SyncFrom(source))
+	require.Equal(t, source.Hash(), tree.Hash())
+	require.Equal(t, source.Version(), tree.Version())
+
+	// the trees share nothing
+	key, sourceValue, err := source.GetByIndex(0)
+	require.NoError(t, err)
+	value, err := tree.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, sourceValue, value)
+	_, err = tree.Set(key, []byte("changed"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	value, err = source.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, sourceValue, value)
+
+	// the target must be empty
+	require.Error(t, tree.SyncFrom(source))
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, _, err = empty.SaveVersion()
+	require.NoError(t, err)
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, tree.SyncFrom(empty.ImmutableTree))
+	require.EqualValues(t, 1, tree.Version())
+	require.Zero(t, tree.Size())
+}
+
+func TestMutableTree_ImportRange(t *testing.T) {
+	source := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	mirror := map[string]string{}
+	for i := 0; i < 100; i++ {
+		_, err := source.Set([]byte(fmt.Sprintf("b%03d", i)), []byte(fmt.Sprintf("source-%d", i)))
+		require.NoError(t, err)
+		mirror[fmt.Sprintf("b%03d", i)] = fmt.Sprintf("source-%d", i)
+		for _, prefix := range []string{"a", "c"} {
+			_, err := tree.Set([]byte(fmt.Sprintf("%s%03d", prefix, i)), []byte("tree"))
+			require.NoError(t, err)
+			mirror[fmt.Sprintf("%s%03d", prefix, i)] = "tree"
+		}
+	}
+	_, _, err := source.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	importRange := func(tree *MutableTree, opts ImportOptions) error {
+		exporter, err := source.Export()
+		require.NoError(t, err)
+		defer exporter.Close()
+		importer, err := tree.ImportRange(opts)
+		require.NoError(t, err)
+		defer importer.Close()
+		for {
+			node, err := exporter.Next()
+			if err == ErrorExportDone {
+				break
+			}
+			require.NoError(t, err)
+			require.NoError(t, importer.Add(node))
+		}
+		return importer.Commit()
+	}
+
+	require.NoError(t, importRange(tree, ImportOptions{VerifyHashes: true, RootHash: source.Hash()}))
+	assertWellFormed(t, tree.ImmutableTree, tree.root)
+	assertMutableMirrorIterate(t, tree, mirror)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the imported keys are saved as a part of the version
+	loaded := NewMutableTree(tree.ndb.db, 0, false, NewNopLogger())
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, tree.Hash(), loaded.Hash())
+	require.EqualValues(t, 300, loaded.Size())
+	value, err := loaded.GetVersioned([]byte("b042"), version)
+	require.NoError(t, err)
+	require.Equal(t, []byte("source-42"), value)
+
+	// the range must not overlap the keys of the tree
+	err = importRange(loaded, ImportOptions{})
+	require.ErrorIs(t, err, ErrImportRangeOverlap)
+	require.Equal(t, tree.Hash(), loaded.WorkingHash())
+
+	// a wrong root hash is detected before the tree is changed
+	other := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	err = importRange(other, ImportOptions{VerifyHashes: true, RootHash: []byte("wrong")})
+	require.ErrorIs(t, err, ErrImportHashMismatch)
+	require.True(t, other.IsEmpty())
+}
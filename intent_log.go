@@ -0,0 +1,206 @@
+package iavl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// IntentKind is the kind of an IntentRecord.
+type IntentKind int32
+
+const (
+	// IntentSet and IntentRemove are Set and Remove calls on the working tree.
+	IntentSet IntentKind = iota + 1
+	IntentRemove
+	// IntentCommit marks the intents of the version as saved by SaveVersion.
+	IntentCommit
+	// IntentRollback marks the intents of the version as discarded by Rollback.
+	IntentRollback
+)
+
+// String implements fmt.Stringer.
+func (k IntentKind) String() string {
+	switch k {
+	case IntentSet:
+		return "set"
+	case IntentRemove:
+		return "remove"
+	case IntentCommit:
+		return "commit"
+	case IntentRollback:
+		return "rollback"
+	default:
+		return fmt.Sprintf("IntentKind(%d)", int32(k))
+	}
+}
+
+// IntentRecord is a single entry of the intent log written to Options.IntentLogWriter. Set and
+// Remove calls are written before they are applied to the working tree, and SaveVersion and
+// Rollback close the intents of the working version with a commit or rollback marker. Each record
+// is prefixed with its uvarint encoded length, like a ChangelogRecord, and is the protobuf
+// encoding of:
+//
+//	message IntentRecord {
+//	    int64 version = 1;
+//	    int32 kind = 2;
+//	    bytes key = 3;
+//	    bytes value = 4;
+//	}
+type IntentRecord struct {
+	Version int64
+	Kind    IntentKind
+	Key     []byte
+	Value   []byte
+}
+
+// Marshal returns the length-prefixed encoding of the record.
+func (r *IntentRecord) Marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.Version))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.Kind))
+	if r.Key != nil {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.Key)
+	}
+	if r.Value != nil {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.Value)
+	}
+	return append(binary.AppendUvarint(nil, uint64(len(b))), b...)
+}
+
+// unmarshal decodes the record from b, without the length prefix.
+func (r *IntentRecord) unmarshal(b []byte) error {
+	*r = IntentRecord{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case (num == 1 || num == 2) && typ == protowire.VarintType:
+			v, m := protowire.ConsumeVarint(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			if num == 1 {
+				r.Version = int64(v)
+			} else {
+				r.Kind = IntentKind(v)
+			}
+			n = m
+		case (num == 3 || num == 4) && typ == protowire.BytesType:
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return protowire.ParseError(m)
+			}
+			if num == 3 {
+				r.Key = append([]byte{}, v...)
+			} else {
+				r.Value = append([]byte{}, v...)
+			}
+			n = m
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// IntentLogReader reads the records of an intent log written to Options.IntentLogWriter.
+type IntentLogReader struct {
+	r *bufio.Reader
+}
+
+// NewIntentLogReader returns a reader for the intent log in r.
+func NewIntentLogReader(r io.Reader) *IntentLogReader {
+	return &IntentLogReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record of the intent log, or io.EOF at its end. A truncated final record,
+// e.g. from a crash during the write, returns io.ErrUnexpectedEOF.
+func (ir *IntentLogReader) Next() (*IntentRecord, error) {
+	b, err := readLengthPrefixed(ir.r)
+	if err != nil {
+		return nil, err
+	}
+	record := &IntentRecord{}
+	if err := record.unmarshal(b); err != nil {
+		return nil, fmt.Errorf("failed to decode intent record: %w", err)
+	}
+	return record, nil
+}
+
+// writeIntent appends a record for the working version to the intent log, if one is configured.
+func (tree *MutableTree) writeIntent(kind IntentKind, key, value []byte) error {
+	w := tree.ndb.opts.IntentLogWriter
+	if w == nil {
+		return nil
+	}
+	record := &IntentRecord{Version: tree.WorkingVersion(), Kind: kind, Key: key, Value: value}
+	if _, err := w.Write(record.Marshal()); err != nil {
+		return fmt.Errorf("failed to write %s intent for version %d: %w", kind, record.Version, err)
+	}
+	return nil
+}
+
+// ReplayIntentLog applies the Set and Remove intents of the working version which are left open
+// at the end of the intent log in r, i.e. not followed by a commit or rollback marker, e.g. to
+// restore the working tree after a crash during block execution. Intents of other versions are
+// ignored. The intents are applied in their logged order, so an intent which failed originally
+// fails again, and are written again to the intent log of the tree, if any. Returns the number of
+// applied intents.
+func (tree *MutableTree) ReplayIntentLog(r io.Reader) (int, error) {
+	if tree.hasUnsavedChanges() {
+		return 0, ErrUnsavedChanges
+	}
+
+	version := tree.WorkingVersion()
+	var pending []*IntentRecord
+	ir := NewIntentLogReader(r)
+	for {
+		record, err := ir.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// a truncated record was never applied
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if record.Version != version {
+			continue
+		}
+		switch record.Kind {
+		case IntentSet, IntentRemove:
+			pending = append(pending, record)
+		case IntentCommit, IntentRollback:
+			pending = pending[:0]
+		}
+	}
+
+	for i, record := range pending {
+		var err error
+		if record.Kind == IntentRemove {
+			_, _, err = tree.Remove(record.Key)
+		} else {
+			_, err = tree.Set(record.Key, record.Value)
+		}
+		if err != nil {
+			return i, fmt.Errorf("failed to replay %s intent of key %X: %w", record.Kind, record.Key, err)
+		}
+	}
+	return len(pending), nil
+}
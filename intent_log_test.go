@@ -0,0 +1,73 @@
+package iavl
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestIntentLog(t *testing.T) {
+	var buf bytes.Buffer
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), IntentLogWriterOption(&buf))
+
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("b"), []byte("1"))
+	require.NoError(t, err)
+	tree.Rollback()
+
+	// the changes of version 2 are lost in a crash
+	_, err = tree.Set([]byte("c"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	hash, err := tree.ComputeWorkingHash()
+	require.NoError(t, err)
+
+	r := NewIntentLogReader(bytes.NewReader(buf.Bytes()))
+	expected := []IntentRecord{
+		{Version: 1, Kind: IntentSet, Key: []byte("a"), Value: []byte("1")},
+		{Version: 1, Kind: IntentCommit},
+		{Version: 2, Kind: IntentSet, Key: []byte("b"), Value: []byte("1")},
+		{Version: 2, Kind: IntentRollback},
+		{Version: 2, Kind: IntentSet, Key: []byte("c"), Value: []byte("1")},
+		{Version: 2, Kind: IntentRemove, Key: []byte("a")},
+	}
+	for _, want := range expected {
+		record, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, want, *record)
+	}
+	_, err = r.Next()
+	require.ErrorIs(t, err, io.EOF)
+
+	reopened := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = reopened.Load()
+	require.NoError(t, err)
+	// a truncated final record is ignored
+	truncated := append(bytes.Clone(buf.Bytes()), (&IntentRecord{Version: 2, Kind: IntentSet, Key: []byte("d")}).Marshal()[:3]...)
+	n, err := reopened.ReplayIntentLog(bytes.NewReader(truncated))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	replayed, err := reopened.ComputeWorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, hash, replayed)
+
+	_, err = reopened.ReplayIntentLog(bytes.NewReader(buf.Bytes()))
+	require.ErrorIs(t, err, ErrUnsavedChanges)
+}
+
+func TestIntentLog_WriteError(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), IntentLogWriterOption(failingWriter{}))
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.Error(t, err)
+	require.True(t, tree.IsEmpty())
+}
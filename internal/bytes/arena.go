@@ -0,0 +1,30 @@
+package common
+
+// stringArenaChunkSize is the size of the buffers of a StringArena. Longer strings are allocated
+// on their own.
+const stringArenaChunkSize = 32 << 10
+
+// StringArena copies byte slices into strings backed by large shared buffers, so many short-lived
+// strings, e.g. map keys, cost an allocation per buffer instead of one each. A buffer is freed by
+// the GC once none of its strings is referenced, so a long-lived string keeps its whole buffer
+// alive. The zero value is ready to use. It is not safe for concurrent use.
+type StringArena struct {
+	buf []byte
+}
+
+// Copy returns a string with the contents of b.
+func (a *StringArena) Copy(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	if len(b) > stringArenaChunkSize/8 {
+		return string(b)
+	}
+	if cap(a.buf)-len(a.buf) < len(b) {
+		// the strings of the previous buffer are never overwritten, since it is only appended to
+		a.buf = make([]byte, 0, stringArenaChunkSize)
+	}
+	start := len(a.buf)
+	a.buf = append(a.buf, b...)
+	return UnsafeBytesToStr(a.buf[start:])
+}
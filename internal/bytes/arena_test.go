@@ -0,0 +1,49 @@
+package common
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStringArena(t *testing.T) {
+	var arena StringArena
+	require.Equal(t, "", arena.Copy(nil))
+
+	buf := []byte("key-0000")
+	strs := make([]string, 0, 10000)
+	for i := 0; i < cap(strs); i++ {
+		buf[len(buf)-1] = byte('0' + i%10)
+		strs = append(strs, arena.Copy(buf))
+	}
+	// the strings don't share the buffer of the caller, and survive the GC and later buffers
+	buf[0] = 'x'
+	runtime.GC()
+	for i, s := range strs {
+		require.Equal(t, "key-000"+string(rune('0'+i%10)), s)
+	}
+
+	long := bytes.Repeat([]byte{1}, stringArenaChunkSize)
+	require.Equal(t, string(long), arena.Copy(long))
+}
+
+func BenchmarkStringArena(b *testing.B) {
+	key := []byte("some-module/balances/0123456789abcdef")
+	b.Run("string", func(b *testing.B) {
+		b.ReportAllocs()
+		strs := make([]string, b.N)
+		for i := 0; i < b.N; i++ {
+			strs[i] = string(key)
+		}
+	})
+	b.Run("arena", func(b *testing.B) {
+		b.ReportAllocs()
+		var arena StringArena
+		strs := make([]string, b.N)
+		for i := 0; i < b.N; i++ {
+			strs[i] = arena.Copy(key)
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math/bits"
 	"sync"
@@ -132,6 +133,32 @@ func EncodeBytesSize(bz []byte) int {
 	return EncodeUvarintSize(uint64(len(bz))) + len(bz)
 }
 
+// ChecksumSize is the size of a checksum written by EncodeChecksum.
+const ChecksumSize = 4
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// EncodeChecksum writes the CRC-32C checksum of the byte slice to the writer.
+func EncodeChecksum(w io.Writer, bz []byte) error {
+	var buf [ChecksumSize]byte
+	binary.BigEndian.PutUint32(buf[:], crc32.Checksum(bz, castagnoliTable))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// VerifyChecksum checks the checksum written by EncodeChecksum at the start of checksum against
+// the byte slice.
+func VerifyChecksum(checksum, bz []byte) error {
+	if len(checksum) < ChecksumSize {
+		return fmt.Errorf("insufficient bytes decoding checksum: %d", len(checksum))
+	}
+	stored, computed := binary.BigEndian.Uint32(checksum), crc32.Checksum(bz, castagnoliTable)
+	if stored != computed {
+		return fmt.Errorf("checksum mismatch: stored %08x, computed %08x", stored, computed)
+	}
+	return nil
+}
+
 // EncodeUvarint writes a varint-encoded unsigned integer to an io.Writer.
 func EncodeUvarint(w io.Writer, u uint64) error {
 	// See comment in encodeVarint
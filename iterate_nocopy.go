@@ -0,0 +1,136 @@
+package iavl
+
+import (
+	"fmt"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// IterateNoCopy is like Iterate, but it doesn't allocate per entry: the key and value slices
+// passed to fn are borrowed from the node cache or the database iterator, and are only valid
+// during the call to fn. They must not be modified, and must be copied to be retained, e.g. with a
+// CopyPool. It is meant for jobs iterating very many entries, e.g. analytics over the whole state.
+// Returns true if stopped by callback, false otherwise.
+func (t *ImmutableTree) IterateNoCopy(fn func(key, value []byte) bool) (bool, error) {
+	t.onAccess(AccessIterate, nil)
+	if err := t.checkGeneration(); err != nil {
+		return false, err
+	}
+	if t.root == nil {
+		return false, nil
+	}
+	if !t.skipFastStorageUpgrade {
+		isFastCacheEnabled, err := t.IsFastCacheEnabled()
+		if err != nil {
+			return false, err
+		}
+		if isFastCacheEnabled {
+			return t.iterateFastNoCopy(fn)
+		}
+	}
+	return t.iterateNodesNoCopy(fn)
+}
+
+// iterateNodesNoCopy iterates the leaves of the tree in order, with a stack of the inner nodes on
+// the path to the current leaf instead of a traversal.
+func (t *ImmutableTree) iterateNodesNoCopy(fn func(key, value []byte) bool) (bool, error) {
+	stack := make([]*Node, 0, t.root.subtreeHeight)
+	node := t.root
+	for {
+		var err error
+		for !node.isLeaf() {
+			stack = append(stack, node)
+			if node, err = node.getLeftNode(t); err != nil {
+				return false, err
+			}
+		}
+		if fn(node.key, node.value) {
+			return true, nil
+		}
+		if len(stack) == 0 {
+			return false, nil
+		}
+		parent := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if node, err = parent.getRightNode(t); err != nil {
+			return false, err
+		}
+	}
+}
+
+// IterateNoCopy is ImmutableTree.IterateNoCopy over the working tree. With unsaved changes, it
+// is like Iterate.
+func (tree *MutableTree) IterateNoCopy(fn func(key, value []byte) bool) (bool, error) {
+	if tree.hasUnsavedChanges() {
+		// the unsaved fast nodes are merged with the fast node index by Iterate
+		return tree.Iterate(fn)
+	}
+	return tree.ImmutableTree.IterateNoCopy(fn)
+}
+
+// iterateFastNoCopy iterates the fast node index like FastIterator, decoding the values in place.
+func (t *ImmutableTree) iterateFastNoCopy(fn func(key, value []byte) bool) (bool, error) {
+	itr, err := t.ndb.getFastIterator(nil, nil, true)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		_, value, err := fastnode.DecodeValue(itr.Value())
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ErrCorruptNode, err)
+		}
+		if fn(itr.Key()[1:], value) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
+
+// CopyPool copies borrowed slices, e.g. of IterateNoCopy, into chunks of memory which are reused
+// after Reset, so that a job retaining some of the entries, e.g. a batch of them, doesn't allocate
+// per entry. It is not safe for concurrent use.
+type CopyPool struct {
+	chunkSize int
+	chunks    [][]byte
+	current   int
+}
+
+// NewCopyPool returns a CopyPool allocating chunks of the given size, or of the size of a larger
+// slice.
+func NewCopyPool(chunkSize int) *CopyPool {
+	return &CopyPool{chunkSize: chunkSize}
+}
+
+// Copy returns a copy of bz, which is valid until the next Reset. Appending to the copy allocates.
+func (p *CopyPool) Copy(bz []byte) []byte {
+	if bz == nil {
+		return nil
+	}
+	for ; p.current < len(p.chunks); p.current++ {
+		chunk := p.chunks[p.current]
+		if cap(chunk)-len(chunk) >= len(bz) {
+			return p.copyInto(bz)
+		}
+	}
+	p.chunks = append(p.chunks, make([]byte, 0, max(p.chunkSize, len(bz))))
+	return p.copyInto(bz)
+}
+
+// copyInto copies bz to the end of the current chunk, which must have room for it.
+func (p *CopyPool) copyInto(bz []byte) []byte {
+	chunk := p.chunks[p.current]
+	start := len(chunk)
+	chunk = append(chunk, bz...)
+	p.chunks[p.current] = chunk
+	return chunk[start:len(chunk):len(chunk)]
+}
+
+// Reset invalidates all the copies made so far, and reuses their memory for the next ones.
+func (p *CopyPool) Reset() {
+	for i := range p.chunks {
+		p.chunks[i] = p.chunks[i][:0]
+	}
+	p.current = 0
+}
@@ -0,0 +1,91 @@
+package iavl
+
+import (
+	"fmt"
+
+	"github.com/cosmos/iavl/fastnode"
+)
+
+// IterateSelect iterates over the keys from start (inclusive) to end (exclusive) in ascending
+// order, nil being open on that side, and calls fn with the key and the projection of the value of
+// the entries selected by project. project runs on the key and value slices borrowed from the node
+// cache or the database iterator, like IterateNoCopy, so the values of the entries it filters out
+// are never copied, e.g. for analytical scans which only need a field of each value. It returns
+// the projection, and false to skip the entry. The keys and values passed to project and the keys
+// passed to fn are only valid during the call, and must not be modified, but the projection may
+// alias the value. Returns true if stopped by fn, false otherwise.
+func (t *ImmutableTree) IterateSelect(start, end []byte, project func(key, value []byte) ([]byte, bool), fn func(key, projected []byte) bool) (bool, error) {
+	t.onAccess(AccessIterate, start)
+	if err := t.checkGeneration(); err != nil {
+		return false, err
+	}
+	if t.root == nil {
+		return false, nil
+	}
+	visit := func(key, value []byte) bool {
+		projected, ok := project(key, value)
+		return ok && fn(key, projected)
+	}
+	if !t.skipFastStorageUpgrade {
+		isFastCacheEnabled, err := t.IsFastCacheEnabled()
+		if err != nil {
+			return false, err
+		}
+		if isFastCacheEnabled {
+			return t.iterateFastRange(start, end, visit)
+		}
+	}
+
+	traversal := t.root.newTraversal(t, start, end, true, false, false)
+	for {
+		node, err := traversal.next()
+		if err != nil || node == nil {
+			return false, err
+		}
+		if node.isLeaf() && visit(node.key, node.value) {
+			return true, nil
+		}
+	}
+}
+
+// IterateSelect is ImmutableTree.IterateSelect over the working tree, including its unsaved
+// changes.
+func (tree *MutableTree) IterateSelect(start, end []byte, project func(key, value []byte) ([]byte, bool), fn func(key, projected []byte) bool) (bool, error) {
+	if !tree.hasUnsavedChanges() {
+		return tree.ImmutableTree.IterateSelect(start, end, project, fn)
+	}
+	tree.onAccess(AccessIterate, start)
+	// the unsaved changes are merged by the iterator
+	itr, err := tree.iterator(start, end, true)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		projected, ok := project(itr.Key(), itr.Value())
+		if ok && fn(itr.Key(), projected) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
+
+// iterateFastRange iterates the fast node index from start to end like iterateFastNoCopy.
+func (t *ImmutableTree) iterateFastRange(start, end []byte, fn func(key, value []byte) bool) (bool, error) {
+	itr, err := t.ndb.getFastIterator(start, end, true)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		_, value, err := fastnode.DecodeValue(itr.Value())
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ErrCorruptNode, err)
+		}
+		if fn(itr.Key()[1:], value) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
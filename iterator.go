@@ -90,82 +90,97 @@ func (nodes *delayedNodes) length() int {
 //     set to false, and immediately returned at the subsequent call of `traversal.next()` at the last line.
 //  2. If the traversal is preorder, the current node will be returned.
 func (t *traversal) next() (*Node, error) {
-	// End of traversal.
-	if t.delayedNodes.length() == 0 {
-		return nil, nil
-	}
+	// The traversal is driven by a loop instead of recursion, so that skipping long runs of
+	// out-of-range leaves (or inner nodes in postorder) does not grow the call stack. Both
+	// directions stream natively: the order in which children are pushed decides the direction.
+	for t.delayedNodes.length() > 0 {
+		node, delayed := t.delayedNodes.pop()
+
+		// Already expanded, immediately return.
+		if !delayed || node == nil {
+			return node, nil
+		}
 
-	node, delayed := t.delayedNodes.pop()
+		afterStart := t.start == nil || bytes.Compare(t.start, node.key) < 0
+		startOrAfter := afterStart || bytes.Equal(t.start, node.key)
+		beforeEnd := t.end == nil || bytes.Compare(node.key, t.end) < 0
+		if t.inclusive {
+			beforeEnd = beforeEnd || bytes.Equal(node.key, t.end)
+		}
+		inRange := !node.isLeaf() || (startOrAfter && beforeEnd)
 
-	// Already expanded, immediately return.
-	if !delayed || node == nil {
-		return node, nil
-	}
+		// case of postorder. A-1 and B-1
+		// Recursively process left sub-tree, then right-subtree, then node itself.
+		if t.post && inRange {
+			t.delayedNodes.push(node, false)
+		}
 
-	afterStart := t.start == nil || bytes.Compare(t.start, node.key) < 0
-	startOrAfter := afterStart || bytes.Equal(t.start, node.key)
-	beforeEnd := t.end == nil || bytes.Compare(node.key, t.end) < 0
-	if t.inclusive {
-		beforeEnd = beforeEnd || bytes.Equal(node.key, t.end)
-	}
+		// case of branch node, traversing children. A-2.
+		if !node.isLeaf() {
+			if err := t.pushChildren(node, afterStart, beforeEnd); err != nil {
+				return nil, err
+			}
+		}
+
+		// case of preorder traversal. A-3 and B-2.
+		// Process root then (recursively) processing left child, then process right child
+		if !t.post && inRange {
+			return node, nil
+		}
 
-	// case of postorder. A-1 and B-1
-	// Recursively process left sub-tree, then right-subtree, then node itself.
-	if t.post && (!node.isLeaf() || (startOrAfter && beforeEnd)) {
-		t.delayedNodes.push(node, false)
+		// Keep traversing and expanding the remaning delayed nodes. A-4.
 	}
 
-	// case of branch node, traversing children. A-2.
-	if !node.isLeaf() {
-		// if node is a branch node and the order is ascending,
-		// We traverse through the left subtree, then the right subtree.
-		if t.ascending {
-			if beforeEnd {
-				// push the delayed traversal for the right nodes,
-				rightNode, err := node.getRightNode(t.tree)
-				if err != nil {
-					return nil, err
-				}
-				t.delayedNodes.push(rightNode, true)
-			}
-			if afterStart {
-				// push the delayed traversal for the left nodes,
-				leftNode, err := node.getLeftNode(t.tree)
-				if err != nil {
-					return nil, err
-				}
-				t.delayedNodes.push(leftNode, true)
-			}
-		} else {
-			// if node is a branch node and the order is not ascending
-			// We traverse through the right subtree, then the left subtree.
-			if afterStart {
-				// push the delayed traversal for the left nodes,
-				leftNode, err := node.getLeftNode(t.tree)
-				if err != nil {
-					return nil, err
-				}
-				t.delayedNodes.push(leftNode, true)
-			}
-			if beforeEnd {
-				// push the delayed traversal for the right nodes,
-				rightNode, err := node.getRightNode(t.tree)
-				if err != nil {
-					return nil, err
-				}
-				t.delayedNodes.push(rightNode, true)
+	// End of traversal.
+	return nil, nil
+}
+
+// pushChildren pushes the children of the branch node which may contain keys in the iteration
+// domain, so that they are popped in the traversal order.
+func (t *traversal) pushChildren(node *Node, afterStart, beforeEnd bool) error {
+	// if node is a branch node and the order is ascending,
+	// We traverse through the left subtree, then the right subtree.
+	// Otherwise, we traverse through the right subtree, then the left subtree.
+	if t.ascending {
+		if beforeEnd {
+			if err := t.pushRight(node); err != nil {
+				return err
 			}
 		}
+		if afterStart {
+			return t.pushLeft(node)
+		}
+		return nil
+	}
+	if afterStart {
+		if err := t.pushLeft(node); err != nil {
+			return err
+		}
 	}
+	if beforeEnd {
+		return t.pushRight(node)
+	}
+	return nil
+}
 
-	// case of preorder traversal. A-3 and B-2.
-	// Process root then (recursively) processing left child, then process right child
-	if !t.post && (!node.isLeaf() || (startOrAfter && beforeEnd)) {
-		return node, nil
+// pushLeft pushes the delayed traversal for the left node.
+func (t *traversal) pushLeft(node *Node) error {
+	leftNode, err := node.getLeftNode(t.tree)
+	if err != nil {
+		return err
 	}
+	t.delayedNodes.push(leftNode, true)
+	return nil
+}
 
-	// Keep traversing and expanding the remaning delayed nodes. A-4.
-	return t.next()
+// pushRight pushes the delayed traversal for the right node.
+func (t *traversal) pushRight(node *Node) error {
+	rightNode, err := node.getRightNode(t.tree)
+	if err != nil {
+		return err
+	}
+	t.delayedNodes.push(rightNode, true)
+	return nil
 }
 
 // Iterator is a dbm.Iterator for ImmutableTree
@@ -179,6 +194,9 @@ type Iterator struct {
 	err error
 
 	t *traversal
+
+	version   int64 // version of the tree, for Checkpoint
+	ascending bool
 }
 
 var _ store.Iterator = (*Iterator)(nil)
@@ -186,14 +204,16 @@ var _ store.Iterator = (*Iterator)(nil)
 // Returns a new iterator over the immutable tree. If the tree is nil, the iterator will be invalid.
 func NewIterator(start, end []byte, ascending bool, tree *ImmutableTree) store.Iterator {
 	iter := &Iterator{
-		start: start,
-		end:   end,
+		start:     start,
+		end:       end,
+		ascending: ascending,
 	}
 
 	if tree == nil {
 		iter.err = errIteratorNilTreeGiven
 	} else {
 		iter.valid = true
+		iter.version = tree.version
 		iter.t = tree.root.newTraversal(tree, start, end, ascending, false, false)
 		// Move iterator before the first element
 		iter.Next()
@@ -227,20 +247,22 @@ func (iter *Iterator) Next() {
 		return
 	}
 
-	node, err := iter.t.next()
-	// TODO: double-check if this error is correctly handled.
-	if node == nil || err != nil {
-		iter.t = nil
-		iter.valid = false
-		return
-	}
+	for {
+		node, err := iter.t.next()
+		if node == nil || err != nil {
+			// the iteration ends at the first error, which is kept for Error and Close
+			iter.t = nil
+			iter.valid = false
+			iter.key, iter.value = nil, nil
+			iter.err = err
+			return
+		}
 
-	if node.subtreeHeight == 0 {
-		iter.key, iter.value = node.key, node.value
-		return
+		if node.subtreeHeight == 0 {
+			iter.key, iter.value = node.key, node.value
+			return
+		}
 	}
-
-	iter.Next()
 }
 
 // Close implements dbm.Iterator
@@ -264,27 +286,47 @@ func (iter *Iterator) IsFast() bool {
 type NodeIterator struct {
 	nodesToVisit []*Node
 	ndb          *nodeDB
+	pool         *NodePool // recycles the visited nodes, if set
 	err          error
 }
 
 // NewNodeIterator returns a new NodeIterator to traverse the tree of the root node.
 func NewNodeIterator(rootKey []byte, ndb *nodeDB) (*NodeIterator, error) {
+	return newNodeIterator(rootKey, ndb, nil)
+}
+
+// newNodeIterator is NewNodeIterator, decoding the nodes into nodes of the pool, if any, which are
+// returned to it once visited. A node of a pooled iterator is then only valid until the next call
+// of Next.
+func newNodeIterator(rootKey []byte, ndb *nodeDB, pool *NodePool) (*NodeIterator, error) {
+	iter := &NodeIterator{
+		nodesToVisit: []*Node{},
+		ndb:          ndb,
+		pool:         pool,
+	}
 	if len(rootKey) == 0 {
-		return &NodeIterator{
-			nodesToVisit: []*Node{},
-			ndb:          ndb,
-		}, nil
+		return iter, nil
 	}
 
-	node, err := ndb.GetNode(rootKey)
+	node, err := iter.getNode(rootKey)
 	if err != nil {
 		return nil, err
 	}
+	iter.nodesToVisit = append(iter.nodesToVisit, node)
+	return iter, nil
+}
 
-	return &NodeIterator{
-		nodesToVisit: []*Node{node},
-		ndb:          ndb,
-	}, nil
+// getNode reads the node, into a node of the pool if there is one.
+func (iter *NodeIterator) getNode(nk []byte) (*Node, error) {
+	if iter.pool == nil {
+		return iter.ndb.GetNode(nk)
+	}
+	node := iter.pool.Get()
+	if err := iter.ndb.getNodeInto(nk, node); err != nil {
+		iter.pool.Put(node)
+		return nil, err
+	}
+	return node, nil
 }
 
 // GetNode returns the current visiting node.
@@ -310,6 +352,9 @@ func (iter *NodeIterator) Next(isSkipped bool) {
 	}
 	node := iter.GetNode()
 	iter.nodesToVisit = iter.nodesToVisit[:len(iter.nodesToVisit)-1]
+	if iter.pool != nil {
+		defer iter.pool.Put(node)
+	}
 
 	if isSkipped {
 		return
@@ -319,14 +364,14 @@ func (iter *NodeIterator) Next(isSkipped bool) {
 		return
 	}
 
-	rightNode, err := iter.ndb.GetNode(node.rightNodeKey)
+	rightNode, err := iter.getNode(node.rightNodeKey)
 	if err != nil {
 		iter.err = err
 		return
 	}
 	iter.nodesToVisit = append(iter.nodesToVisit, rightNode)
 
-	leftNode, err := iter.ndb.GetNode(node.leftNodeKey)
+	leftNode, err := iter.getNode(node.leftNodeKey)
 	if err != nil {
 		iter.err = err
 		return
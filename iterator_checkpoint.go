@@ -0,0 +1,187 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	corestore "cosmossdk.io/core/store"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// ErrInvalidCheckpoint is returned by ResumeIterator for a token which wasn't returned by
+// Checkpoint, or was returned for another version.
+var ErrInvalidCheckpoint = errors.New("invalid iterator checkpoint")
+
+// checkpointFormat is the format version of the checkpoint tokens.
+const checkpointFormat = 1
+
+// The flags of a checkpoint token.
+const (
+	checkpointAscending = 1 << iota
+	checkpointDone
+	checkpointStart
+	checkpointEnd
+)
+
+// CheckpointIterator is an iterator whose position can be saved with Checkpoint, and restored with
+// ResumeIterator, e.g. by a long scan surviving a restart. The iterators of saved versions
+// implement it.
+type CheckpointIterator interface {
+	corestore.Iterator
+	// Checkpoint returns an opaque token of the position of the iterator, which ResumeIterator
+	// resumes at the current entry, or at the end of the iteration if the iterator is invalid.
+	Checkpoint() ([]byte, error)
+}
+
+var (
+	_ CheckpointIterator = (*Iterator)(nil)
+	_ CheckpointIterator = (*FastIterator)(nil)
+)
+
+// iteratorCheckpoint is the position of an iterator encoded in a checkpoint token.
+type iteratorCheckpoint struct {
+	version    int64
+	ascending  bool
+	done       bool
+	start, end []byte
+	key        []byte // the current key, unless done
+}
+
+// marshal encodes the checkpoint as a token.
+func (c *iteratorCheckpoint) marshal() []byte {
+	flags := int64(0)
+	if c.ascending {
+		flags |= checkpointAscending
+	}
+	if c.done {
+		flags |= checkpointDone
+	}
+	if c.start != nil {
+		flags |= checkpointStart
+	}
+	if c.end != nil {
+		flags |= checkpointEnd
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(checkpointFormat)
+	// writes to a bytes.Buffer don't fail
+	_ = encoding.EncodeVarint(&buf, c.version)
+	_ = encoding.EncodeVarint(&buf, flags)
+	for _, bz := range [][]byte{c.start, c.end, c.key} {
+		_ = encoding.EncodeBytes(&buf, bz)
+	}
+	return buf.Bytes()
+}
+
+// unmarshalIteratorCheckpoint decodes a checkpoint token.
+func unmarshalIteratorCheckpoint(token []byte) (*iteratorCheckpoint, error) {
+	if len(token) == 0 || token[0] != checkpointFormat {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidCheckpoint)
+	}
+	buf := token[1:]
+	c := &iteratorCheckpoint{}
+	version, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding version, %v", ErrInvalidCheckpoint, err)
+	}
+	buf = buf[n:]
+	flags, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding flags, %v", ErrInvalidCheckpoint, err)
+	}
+	buf = buf[n:]
+	fields := make([][]byte, 3)
+	for i := range fields {
+		if fields[i], n, err = encoding.DecodeBytes(buf); err != nil {
+			return nil, fmt.Errorf("%w: decoding keys, %v", ErrInvalidCheckpoint, err)
+		}
+		buf = buf[n:]
+	}
+	if len(buf) > 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidCheckpoint, len(buf))
+	}
+
+	c.version = version
+	c.ascending = flags&checkpointAscending != 0
+	c.done = flags&checkpointDone != 0
+	if flags&checkpointStart != 0 {
+		c.start = bytes.Clone(fields[0])
+	}
+	if flags&checkpointEnd != 0 {
+		c.end = bytes.Clone(fields[1])
+	}
+	c.key = bytes.Clone(fields[2])
+	return c, nil
+}
+
+// Checkpoint implements CheckpointIterator.
+func (iter *Iterator) Checkpoint() ([]byte, error) {
+	if iter.err != nil {
+		return nil, iter.err
+	}
+	c := &iteratorCheckpoint{version: iter.version, ascending: iter.ascending, done: !iter.valid, start: iter.start, end: iter.end}
+	if iter.valid {
+		c.key = iter.key
+	}
+	return c.marshal(), nil
+}
+
+// Checkpoint implements CheckpointIterator. The version is unknown if the iterator wasn't created
+// by a tree, and the token is resumed at any version then.
+func (iter *FastIterator) Checkpoint() ([]byte, error) {
+	if iter.err != nil {
+		return nil, iter.err
+	}
+	valid := iter.Valid()
+	c := &iteratorCheckpoint{version: iter.version, ascending: iter.ascending, done: !valid, start: iter.start, end: iter.end}
+	if valid {
+		c.key = iter.Key()
+	}
+	return c.marshal(), nil
+}
+
+// ResumeIterator returns an iterator resuming the iteration whose position was saved by
+// Checkpoint, at the entry the iterator was at, over the rest of its domain. The token must have
+// been returned for the version of the tree.
+func (t *ImmutableTree) ResumeIterator(token []byte) (corestore.Iterator, error) {
+	c, err := unmarshalIteratorCheckpoint(token)
+	if err != nil {
+		return nil, err
+	}
+	if c.version != 0 && c.version != t.version {
+		return nil, fmt.Errorf("%w: checkpoint of version %d, tree at version %d", ErrInvalidCheckpoint, c.version, t.version)
+	}
+	if c.done {
+		return &Iterator{start: c.start, end: c.end, version: c.version, ascending: c.ascending}, nil
+	}
+
+	start, end := c.start, c.end
+	if c.ascending {
+		start = c.key
+	} else {
+		// the end is exclusive, and the key followed by a zero byte is the next possible key
+		end = append(c.key, 0)
+	}
+	t.onAccess(AccessIterate, start)
+	return t.iterator(start, end, c.ascending)
+}
+
+// ResumeIterator resumes the iteration of a saved version, see ImmutableTree.ResumeIterator.
+func (tree *MutableTree) ResumeIterator(token []byte) (corestore.Iterator, error) {
+	c, err := unmarshalIteratorCheckpoint(token)
+	if err != nil {
+		return nil, err
+	}
+	version := c.version
+	if version == 0 {
+		version = tree.Version()
+	}
+	itree, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	return itree.ResumeIterator(token)
+}
@@ -1,10 +1,15 @@
 package iavl
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"math/rand"
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	corestore "cosmossdk.io/core/store"
 	"github.com/stretchr/testify/require"
@@ -381,3 +386,539 @@ func syncMapCount(m *sync.Map) int {
 	})
 	return count
 }
+
+func BenchmarkIterator(b *testing.B) {
+	const numKeys = 10000
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < numKeys; i++ {
+		_, err := tree.Set(i2b(i), i2b(i))
+		require.NoError(b, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(b, err)
+	// leave a working set of unsaved additions and removals for the unsaved fast iterator
+	for i := 0; i < numKeys; i += 10 {
+		_, _, err := tree.Remove(i2b(i))
+		require.NoError(b, err)
+		_, err = tree.Set(i2b(numKeys+i), i2b(i))
+		require.NoError(b, err)
+	}
+
+	iterators := map[string]func(ascending bool) corestore.Iterator{
+		"tree": func(ascending bool) corestore.Iterator {
+			return NewIterator(nil, nil, ascending, tree.lastSaved)
+		},
+		"fast": func(ascending bool) corestore.Iterator {
+			return NewFastIterator(nil, nil, ascending, tree.ndb)
+		},
+		"unsaved-fast": func(ascending bool) corestore.Iterator {
+			return NewUnsavedFastIterator(nil, nil, ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals)
+		},
+	}
+	for _, name := range []string{"tree", "fast", "unsaved-fast"} {
+		for _, ascending := range []bool{true, false} {
+			direction := "ascending"
+			if !ascending {
+				direction = "descending"
+			}
+			b.Run(name+"-"+direction, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					itr := iterators[name](ascending)
+					for ; itr.Valid(); itr.Next() { //nolint:revive
+					}
+					require.NoError(b, itr.Close())
+				}
+			})
+		}
+	}
+}
+
+func TestIterator_PrunedMidIteration(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 100; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{byte(v)})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	itr, err := itree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	require.True(t, itr.Valid())
+
+	require.NoError(t, tree.DeleteVersionsTo(2))
+
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		count++
+	}
+	require.Less(t, count, 100)
+	require.ErrorIs(t, itr.Error(), ErrVersionPruned)
+
+	// the iterator stays invalid
+	itr.Next()
+	require.False(t, itr.Valid())
+	require.Nil(t, itr.Key())
+	require.ErrorIs(t, itr.Close(), ErrVersionPruned)
+}
+
+func TestIterator_CorruptNode(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// overwrite a leaf node with garbage
+	leafKey := tree.ndb.nodeKey((&NodeKey{version: 1, nonce: 3}).GetKey())
+	require.NoError(t, db.Set(leafKey, []byte{0xff}))
+
+	tree = NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+	}
+	require.ErrorIs(t, itr.Error(), ErrCorruptNode)
+}
+
+func TestOverlayIterator(t *testing.T) {
+	saved := map[string]string{"a": "1", "c": "1", "e": "1", "g": "1"}
+	testCases := []struct {
+		name      string
+		overlay   []overlayEntry
+		ascending bool
+		expected  []string
+	}{
+		{"no changes", nil, true, []string{"a=1", "c=1", "e=1", "g=1"}},
+		{"no changes descending", nil, false, []string{"g=1", "e=1", "c=1", "a=1"}},
+		{
+			"additions and updates",
+			[]overlayEntry{{key: []byte("b"), value: []byte("2")}, {key: []byte("c"), value: []byte("2")}, {key: []byte("h"), value: []byte("2")}},
+			true,
+			[]string{"a=1", "b=2", "c=2", "e=1", "g=1", "h=2"},
+		},
+		{
+			"removals",
+			[]overlayEntry{{key: []byte("a")}, {key: []byte("e")}, {key: []byte("g")}, {key: []byte("z")}},
+			true,
+			[]string{"c=1"},
+		},
+		{
+			"removals descending",
+			[]overlayEntry{{key: []byte("g")}, {key: []byte("a")}, {key: []byte("d"), value: []byte("2")}},
+			false,
+			[]string{"e=1", "d=2", "c=1"},
+		},
+		{
+			"all removed",
+			[]overlayEntry{{key: []byte("a")}, {key: []byte("c")}, {key: []byte("e")}, {key: []byte("g")}},
+			true,
+			nil,
+		},
+		{
+			"empty values are kept",
+			[]overlayEntry{{key: []byte("c"), value: []byte{}}},
+			true,
+			[]string{"a=1", "c=", "e=1", "g=1"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := dbm.NewMemDB()
+			for k, v := range saved {
+				require.NoError(t, db.Set([]byte(k), []byte(v)))
+			}
+			var parent corestore.Iterator
+			var err error
+			if tc.ascending {
+				parent, err = db.Iterator(nil, nil)
+			} else {
+				parent, err = db.ReverseIterator(nil, nil)
+			}
+			require.NoError(t, err)
+
+			itr := newOverlayIterator(parent, tc.overlay, tc.ascending)
+			var actual []string
+			for ; itr.Valid(); itr.Next() {
+				actual = append(actual, string(itr.Key())+"="+string(itr.Value()))
+			}
+			require.NoError(t, itr.Error())
+			require.NoError(t, itr.Close())
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestUnsavedFastIterator_UpdatedThenRemoved(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := tree.Set([]byte(key), []byte("1"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the key buffer is reused by the caller after every change
+	key := []byte("b")
+	_, err = tree.Set(key, []byte("2"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove(key)
+	require.NoError(t, err)
+	copy(key, "d")
+	_, err = tree.Set([]byte("d"), []byte("2"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("d"))
+	require.NoError(t, err)
+
+	var keys []string
+	_, err = tree.Iterate(func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "c"}, keys)
+}
+
+func TestStreamIterator(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i), 1})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	itr, err := tree.Iterator([]byte{10}, []byte{20}, true)
+	require.NoError(t, err)
+	stream := NewStreamIterator(itr, 4)
+	ctx := context.Background()
+	for i := 10; i < 20; i++ {
+		kv, err := stream.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, KV{Key: []byte{byte(i)}, Value: []byte{byte(i), 1}}, kv)
+	}
+	_, err = stream.Next(ctx)
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, stream.Close())
+
+	// a done context stops the wait, and Close stops a stream which is not drained
+	itr, err = tree.Iterator(nil, nil, false)
+	require.NoError(t, err)
+	stream = NewStreamIterator(itr, 0)
+	kv, err := stream.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte{49}, kv.Key)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	for err == nil {
+		_, err = stream.Next(cancelled)
+	}
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, stream.Close())
+}
+
+func TestIteratorWithOptions_ClampToDomain(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 10; i < 20; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte{20}, []byte{20})
+	require.NoError(t, err)
+
+	collect := func(itr corestore.Iterator) []byte {
+		defer itr.Close()
+		var keys []byte
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, itr.Key()[0])
+		}
+		require.NoError(t, itr.Error())
+		return keys
+	}
+	opts := IteratorOptions{ClampToDomain: true}
+	immutable, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	// ranges outside of the keys are empty, without changing the domain
+	for _, r := range [][2][]byte{{nil, {10}}, {{0}, {5}}, {{21}, nil}, {{30}, {40}}} {
+		itr, err := tree.IteratorWithOptions(r[0], r[1], true, opts)
+		require.NoError(t, err)
+		start, end := itr.Domain()
+		require.Equal(t, r[0], start)
+		require.Equal(t, r[1], end)
+		require.Empty(t, collect(itr))
+	}
+	itr, err := immutable.IteratorWithOptions([]byte{20}, nil, true, opts)
+	require.NoError(t, err)
+	require.Empty(t, collect(itr))
+
+	// overlapping ranges are clamped, and the working tree includes the unsaved key
+	itr, err = tree.IteratorWithOptions([]byte{5}, []byte{200}, false, opts)
+	require.NoError(t, err)
+	start, end := itr.Domain()
+	require.Equal(t, []byte{10}, start)
+	require.Nil(t, end)
+	require.Equal(t, []byte{20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10}, collect(itr))
+
+	itr, err = immutable.IteratorWithOptions(nil, []byte{13}, true, opts)
+	require.NoError(t, err)
+	require.Equal(t, []byte{10, 11, 12}, collect(itr))
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	itr, err = empty.IteratorWithOptions(nil, nil, true, opts)
+	require.NoError(t, err)
+	require.Empty(t, collect(itr))
+}
+
+func TestIteratorWithOptions_MaxOpsPerSec(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	itr, err := tree.IteratorWithOptions(nil, nil, true, IteratorOptions{MaxOpsPerSec: 1000})
+	require.NoError(t, err)
+	defer itr.Close()
+	// the sleeps don't advance the clock, so the last one is ahead by the whole iteration
+	var slept time.Duration
+	itr.(*throttledIterator).sleep = func(d time.Duration) { slept = d }
+	var keys []byte
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, itr.Key()[0])
+	}
+	require.NoError(t, itr.Error())
+	require.Len(t, keys, 100)
+	// 100 calls of Next at 1000 per second take 100ms, minus the time spent iterating
+	require.Greater(t, slept, 50*time.Millisecond)
+	require.LessOrEqual(t, slept, 100*time.Millisecond)
+
+	itr, err = tree.IteratorWithOptions(nil, nil, true, IteratorOptions{})
+	require.NoError(t, err)
+	_, throttled := itr.(*throttledIterator)
+	require.False(t, throttled)
+	require.NoError(t, itr.Close())
+}
+
+func TestIterateNoCopy(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 10000, skipFastStorageUpgrade, NewNopLogger())
+		for i := 0; i < 1000; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		type kv struct{ key, value []byte }
+		var expected []kv
+		_, err = tree.Iterate(func(key, value []byte) bool {
+			expected = append(expected, kv{key, value})
+			return false
+		})
+		require.NoError(t, err)
+
+		pool := NewCopyPool(64)
+		var entries []kv
+		stopped, err := tree.IterateNoCopy(func(key, value []byte) bool {
+			entries = append(entries, kv{pool.Copy(key), pool.Copy(value)})
+			return false
+		})
+		require.NoError(t, err)
+		require.False(t, stopped)
+		require.Equal(t, expected, entries)
+
+		// the working tree includes unsaved changes
+		_, err = tree.Set([]byte("k0000"), []byte("changed"))
+		require.NoError(t, err)
+		stopped, err = tree.IterateNoCopy(func(key, value []byte) bool {
+			require.Equal(t, []byte("changed"), value)
+			return true
+		})
+		require.NoError(t, err)
+		require.True(t, stopped)
+		tree.Rollback()
+
+		// the iteration doesn't allocate per entry, beyond the allocations of the MemDB iterator
+		backend := 0.0
+		if !skipFastStorageUpgrade {
+			backend = testing.AllocsPerRun(10, func() {
+				itr, err := tree.ndb.getFastIterator(nil, nil, true)
+				require.NoError(t, err)
+				for ; itr.Valid(); itr.Next() {
+				}
+				itr.Close()
+			})
+		}
+		allocs := testing.AllocsPerRun(10, func() {
+			_, err := tree.IterateNoCopy(func(_, _ []byte) bool { return false })
+			require.NoError(t, err)
+		})
+		require.Less(t, allocs, backend+100, "skipFastStorageUpgrade=%v", skipFastStorageUpgrade)
+	}
+}
+
+func TestIterateSelect(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger())
+		for i := 0; i < 100; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("%d:v%d", i%2, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		// the odd entries of the range, projected to the field after the colon
+		odd := func(_, value []byte) ([]byte, bool) {
+			field, ok := bytes.CutPrefix(value, []byte("1:"))
+			return field, ok
+		}
+		type iterateSelect func(start, end []byte, project func(k, v []byte) ([]byte, bool), fn func(k, v []byte) bool) (bool, error)
+		collect := func(iterate iterateSelect) []string {
+			var entries []string
+			stopped, err := iterate([]byte("k010"), []byte("k020"), odd, func(key, projected []byte) bool {
+				entries = append(entries, string(key)+"="+string(projected))
+				return false
+			})
+			require.NoError(t, err)
+			require.False(t, stopped)
+			return entries
+		}
+		expected := []string{"k011=v11", "k013=v13", "k015=v15", "k017=v17", "k019=v19"}
+		require.Equal(t, expected, collect(tree.IterateSelect))
+		itree, err := tree.GetImmutable(1)
+		require.NoError(t, err)
+		require.Equal(t, expected, collect(itree.IterateSelect))
+
+		// the working tree includes unsaved changes
+		_, err = tree.Set([]byte("k012"), []byte("1:changed"))
+		require.NoError(t, err)
+		_, _, err = tree.Remove([]byte("k013"))
+		require.NoError(t, err)
+		require.Equal(t, []string{"k011=v11", "k012=changed", "k015=v15", "k017=v17", "k019=v19"}, collect(tree.IterateSelect))
+
+		// fn stops the iteration, and only sees the selected entries
+		calls := 0
+		stopped, err := tree.IterateSelect(nil, nil, odd, func(key, _ []byte) bool {
+			calls++
+			return string(key) == "k005"
+		})
+		require.NoError(t, err)
+		require.True(t, stopped)
+		require.Equal(t, 3, calls)
+	}
+}
+
+func TestCopyPool(t *testing.T) {
+	pool := NewCopyPool(8)
+	a := pool.Copy([]byte("abc"))
+	b := pool.Copy([]byte("defgh"))
+	large := pool.Copy([]byte("0123456789"))
+	c := pool.Copy([]byte("i"))
+	require.Equal(t, []byte("abc"), a)
+	require.Equal(t, []byte("defgh"), b)
+	require.Equal(t, []byte("0123456789"), large)
+	require.Equal(t, []byte("i"), c)
+	require.Nil(t, pool.Copy(nil))
+
+	// appending to a copy doesn't overwrite the next one
+	_ = append(a, 'x')
+	require.Equal(t, []byte("defgh"), b)
+
+	// the chunks are reused after a reset
+	pool.Reset()
+	allocs := testing.AllocsPerRun(10, func() {
+		pool.Reset()
+		pool.Copy([]byte("abc"))
+		pool.Copy([]byte("0123456789"))
+	})
+	require.Zero(t, allocs)
+}
+
+func TestIteratorCheckpoint(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		for _, ascending := range []bool{true, false} {
+			db := dbm.NewMemDB()
+			tree := NewMutableTree(db, 0, skipFastStorageUpgrade, NewNopLogger())
+			for i := 0; i < 100; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte{byte(i)})
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			_, err = tree.Set([]byte("k050"), []byte("changed"))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+
+			itree, err := tree.GetImmutable(2)
+			require.NoError(t, err)
+			itr, err := itree.Iterator([]byte("k010"), []byte("k090"), ascending)
+			require.NoError(t, err)
+			var keys []string
+			for i := 0; i < 30; i++ {
+				keys = append(keys, string(itr.Key()))
+				itr.Next()
+			}
+			token, err := itr.(CheckpointIterator).Checkpoint()
+			require.NoError(t, err)
+			require.NoError(t, itr.Close())
+
+			_, isFast := itr.(*FastIterator)
+			require.Equal(t, !skipFastStorageUpgrade, isFast)
+
+			// a restarted process resumes at the entry after the processed ones
+			restarted := NewMutableTree(db, 0, skipFastStorageUpgrade, NewNopLogger())
+			_, err = restarted.Load()
+			require.NoError(t, err)
+			itr, err = restarted.ResumeIterator(token)
+			require.NoError(t, err)
+			for ; itr.Valid(); itr.Next() {
+				keys = append(keys, string(itr.Key()))
+				if string(itr.Key()) == "k050" {
+					require.Equal(t, []byte("changed"), itr.Value())
+				}
+			}
+			require.NoError(t, itr.Error())
+			require.Len(t, keys, 80)
+			for i, key := range keys {
+				expected := 10 + i
+				if !ascending {
+					expected = 89 - i
+				}
+				require.Equal(t, fmt.Sprintf("k%03d", expected), key)
+			}
+
+			// an exhausted iterator resumes exhausted
+			token, err = itr.(CheckpointIterator).Checkpoint()
+			require.NoError(t, err)
+			itr, err = restarted.ResumeIterator(token)
+			require.NoError(t, err)
+			require.False(t, itr.Valid())
+
+			previous, err := restarted.GetImmutable(1)
+			require.NoError(t, err)
+			_, err = previous.ResumeIterator(token)
+			require.ErrorIs(t, err, ErrInvalidCheckpoint)
+			_, err = previous.ResumeIterator([]byte("garbage"))
+			require.ErrorIs(t, err, ErrInvalidCheckpoint)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package iavl
+
+import (
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyOp is an operation timed by the latency histograms, see Options.LatencyExpvar.
+type LatencyOp int
+
+const (
+	LatencyGet LatencyOp = iota
+	LatencySet
+	LatencySaveVersion
+	LatencyGetProof
+	LatencyImportChunk
+	numLatencyOps
+)
+
+// String implements fmt.Stringer.
+func (op LatencyOp) String() string {
+	switch op {
+	case LatencyGet:
+		return "get"
+	case LatencySet:
+		return "set"
+	case LatencySaveVersion:
+		return "save_version"
+	case LatencyGetProof:
+		return "get_proof"
+	case LatencyImportChunk:
+		return "import_chunk"
+	default:
+		return "LatencyOp(" + strconv.Itoa(int(op)) + ")"
+	}
+}
+
+// latencyBuckets are the upper bounds of the histogram buckets, growing by a factor of 4 from 1µs
+// to about 17s. Slower operations are counted by a final unbounded bucket.
+var latencyBuckets = func() []time.Duration {
+	buckets := make([]time.Duration, 13)
+	bound := time.Microsecond
+	for i := range buckets {
+		buckets[i] = bound
+		bound *= 4
+	}
+	return buckets
+}()
+
+// LatencyHistogram is a histogram of operation latencies. It implements expvar.Var, rendered as a
+// JSON object with the count, the total and the cumulative bucket counts by upper bound.
+type LatencyHistogram struct {
+	count   atomic.Uint64
+	totalNs atomic.Uint64
+	buckets [14]atomic.Uint64 // latencyBuckets and the unbounded bucket
+}
+
+// Observe adds a latency to the histogram.
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	if d > 0 {
+		h.totalNs.Add(uint64(d))
+	}
+}
+
+// Count returns the number of observed latencies.
+func (h *LatencyHistogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// Total returns the sum of the observed latencies.
+func (h *LatencyHistogram) Total() time.Duration {
+	return time.Duration(h.totalNs.Load())
+}
+
+// String implements expvar.Var.
+func (h *LatencyHistogram) String() string {
+	var b strings.Builder
+	b.WriteString(`{"count":`)
+	b.WriteString(strconv.FormatUint(h.count.Load(), 10))
+	b.WriteString(`,"total_ns":`)
+	b.WriteString(strconv.FormatUint(h.totalNs.Load(), 10))
+	b.WriteString(`,"buckets":{`)
+	var cumulative uint64
+	for i := range h.buckets {
+		cumulative += h.buckets[i].Load()
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if i < len(latencyBuckets) {
+			b.WriteString(strconv.Quote(latencyBuckets[i].String()))
+		} else {
+			b.WriteString(`"+Inf"`)
+		}
+		b.WriteByte(':')
+		b.WriteString(strconv.FormatUint(cumulative, 10))
+	}
+	b.WriteString("}}")
+	return b.String()
+}
+
+// latencyMetrics are the latency histograms of all operations, indexed by LatencyOp.
+type latencyMetrics [numLatencyOps]*LatencyHistogram
+
+var (
+	latencyMetricsMtx    sync.Mutex
+	latencyMetricsByName = map[string]*latencyMetrics{}
+)
+
+// publishLatencyMetrics returns the latency histograms published under the expvar name, publishing
+// them on first use. Trees configured with the same name share the histograms. It returns nil for
+// an empty name.
+func publishLatencyMetrics(name string) *latencyMetrics {
+	if name == "" {
+		return nil
+	}
+	latencyMetricsMtx.Lock()
+	defer latencyMetricsMtx.Unlock()
+	if m, ok := latencyMetricsByName[name]; ok {
+		return m
+	}
+
+	m := &latencyMetrics{}
+	vars := &expvar.Map{}
+	for op := LatencyOp(0); op < numLatencyOps; op++ {
+		m[op] = &LatencyHistogram{}
+		vars.Set(op.String(), m[op])
+	}
+	// expvar.Publish panics on a name taken by another package, which is a configuration error
+	expvar.Publish(name, vars)
+	latencyMetricsByName[name] = m
+	return m
+}
+
+// observe adds the latency of an operation started at start. It is a no-op on nil metrics.
+func (m *latencyMetrics) observe(op LatencyOp, start time.Time) {
+	if m == nil {
+		return
+	}
+	m[op].Observe(time.Since(start))
+}
+
+// startTimer returns the current time, or the zero time if the latencies aren't recorded, so
+// untimed trees don't pay for reading the clock.
+func (m *latencyMetrics) startTimer() time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// LatencyHistogram returns the latency histogram of the operation, and false if the tree doesn't
+// record latencies, see Options.LatencyExpvar.
+func (tree *MutableTree) LatencyHistogram(op LatencyOp) (*LatencyHistogram, bool) {
+	m := tree.ndb.latency
+	if m == nil || op < 0 || op >= numLatencyOps {
+		return nil, false
+	}
+	return m[op], true
+}
@@ -0,0 +1,336 @@
+package iavl
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// errReadOnly is returned by the writes to the database of a LegacyReader.
+var errReadOnly = errors.New("the legacy database is opened read-only")
+
+// LegacyReader is a read-only view of a database in the legacy layout, see StorageVersionLegacy,
+// which serves the queries of its versions and converts them to the current layout, so a chain can
+// upgrade without exporting its state at genesis and importing it. Unlike MigrateStorage, the
+// conversion keeps the history, and writes to another database, so the legacy one keeps serving
+// queries until the conversion caught up with it.
+type LegacyReader struct {
+	tree *MutableTree
+}
+
+// OpenLegacy opens the legacy tree stored in db. The database is never written, its writes fail.
+// It fails if the database isn't in the legacy layout, or if newer versions were saved on top of
+// the legacy ones, which MigrateStorage migrates instead.
+func OpenLegacy(db corestore.KVStoreWithBatch, options ...Option) (*LegacyReader, error) {
+	tree := NewMutableTree(readOnlyDB{db}, 0, true, NewNopLogger(), options...)
+	current, err := tree.storageVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current != StorageVersionLegacy {
+		return nil, fmt.Errorf("the database is at storage version %v, not %v", current, StorageVersionLegacy)
+	}
+	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if latestVersion > legacyLatestVersion {
+		return nil, fmt.Errorf("version %d was saved after the legacy version %d, see MigrateStorage", latestVersion, legacyLatestVersion)
+	}
+	return &LegacyReader{tree: tree}, nil
+}
+
+// LatestVersion returns the latest legacy version.
+func (r *LegacyReader) LatestVersion() (int64, error) {
+	return r.tree.ndb.getLegacyLatestVersion()
+}
+
+// Versions returns the legacy versions in ascending order.
+func (r *LegacyReader) Versions() ([]int64, error) {
+	latestVersion, err := r.LatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	return r.tree.ndb.legacyVersions(1, latestVersion+1)
+}
+
+// GetImmutable returns the tree of a legacy version, to serve queries and proofs from.
+func (r *LegacyReader) GetImmutable(version int64) (*ImmutableTree, error) {
+	has, err := r.tree.ndb.hasLegacyVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, fmt.Errorf("%w: legacy version %d", ErrVersionDoesNotExist, version)
+	}
+	return r.tree.GetImmutable(version)
+}
+
+// Close closes the reader, and the database it was opened with.
+func (r *LegacyReader) Close() error {
+	return r.tree.Close()
+}
+
+// ConvertOptions configures LegacyReader.Convert.
+type ConvertOptions struct {
+	// TreeOptions are the options of the tree in the target database, e.g. its Namespace.
+	TreeOptions []Option
+	// FromVersion is the first legacy version converted, e.g. to skip the sparse history of a
+	// database pruned with a keep-every strategy, since the versions of the current layout are
+	// contiguous. Zero converts all the legacy versions.
+	FromVersion int64
+	// Progress is called after each converted version, with the number of nodes written for it.
+	Progress func(version int64, nodes int64)
+}
+
+// Convert writes the legacy versions to dst in the current layout, with the same hashes, one
+// version at a time in ascending order, and returns the latest converted version. Each version is
+// committed before the next one is converted, so an interrupted conversion, e.g. by canceling ctx,
+// is resumed by calling it again, from the version after the latest one of dst. The nodes shared
+// with the previous version are referenced by their node keys, so every node is written once, and
+// the hashes of the written nodes are recomputed and checked against the legacy ones. The legacy
+// versions from FromVersion must be contiguous. The fast node index of dst isn't built, see
+// MigrateStorage.
+func (r *LegacyReader) Convert(ctx context.Context, dst corestore.KVStoreWithBatch, opts ConvertOptions) (int64, error) {
+	versions, err := r.Versions()
+	if err != nil {
+		return 0, err
+	}
+	for len(versions) > 0 && versions[0] < opts.FromVersion {
+		versions = versions[1:]
+	}
+	if len(versions) == 0 {
+		return 0, errors.New("no legacy versions to convert")
+	}
+	for i := 1; i < len(versions); i++ {
+		if versions[i] != versions[i-1]+1 {
+			return 0, fmt.Errorf("the legacy versions %d and %d aren't contiguous, see ConvertOptions.FromVersion", versions[i-1], versions[i])
+		}
+	}
+
+	target := NewMutableTree(dst, 0, true, r.tree.logger, opts.TreeOptions...)
+	latestVersion, err := target.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	var prev *ImmutableTree
+	if latestVersion > 0 {
+		first, last := versions[0], versions[len(versions)-1]
+		if latestVersion < first || latestVersion > last {
+			return 0, fmt.Errorf("the target database is at version %d, outside of the legacy versions %d to %d", latestVersion, first, last)
+		}
+		if prev, err = target.GetImmutable(latestVersion); err != nil {
+			return 0, err
+		}
+		src, err := r.GetImmutable(latestVersion)
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(prev.Hash(), src.Hash()) {
+			return 0, fmt.Errorf("version %d of the target database has hash %X, not the legacy hash %X", latestVersion, prev.Hash(), src.Hash())
+		}
+		versions = versions[latestVersion-first+1:]
+	}
+
+	for _, version := range versions {
+		if err := ctx.Err(); err != nil {
+			return latestVersion, err
+		}
+		src, err := r.GetImmutable(version)
+		if err != nil {
+			return latestVersion, err
+		}
+		c := &legacyConverter{src: src.WithCacheBypass(), dst: target.ndb, prev: prev, nonces: make(map[int64]uint32)}
+		if err := c.convertVersion(); err != nil {
+			return latestVersion, fmt.Errorf("failed to convert version %d: %w", version, err)
+		}
+		latestVersion = version
+		if prev, err = target.GetImmutable(version); err != nil {
+			return latestVersion, err
+		}
+		if opts.Progress != nil {
+			opts.Progress(version, c.nodes)
+		}
+	}
+	return latestVersion, nil
+}
+
+// legacyConverter writes a legacy version to a nodeDB in the current layout. The nodes of the
+// version newer than the previous converted version are written, with node keys numbered in the
+// order of a post-order traversal, and the older ones are looked up in the previous version.
+type legacyConverter struct {
+	src    *ImmutableTree   // the legacy version
+	dst    *nodeDB          // the nodeDB written to
+	prev   *ImmutableTree   // the previous converted version, nil for the first one
+	nonces map[int64]uint32 // the last nonces of the node versions, see Importer
+	nodes  int64            // the number of nodes written
+}
+
+// convertVersion writes the nodes and the root of the version, and commits them.
+func (c *legacyConverter) convertVersion() error {
+	version := c.src.version
+	if err := c.dst.setKeyPrefixesToBatch(); err != nil {
+		return err
+	}
+	var size int64
+	if c.src.root == nil {
+		if err := c.dst.SaveEmptyRoot(version); err != nil {
+			return err
+		}
+	} else {
+		root, err := c.convert(c.src.root, true)
+		if err != nil {
+			return err
+		}
+		// a root of the version was written with the root nonce, an older one is referenced
+		if root.nodeKey.version < version {
+			if err := c.dst.SaveRoot(version, root.nodeKey); err != nil {
+				return err
+			}
+		}
+		size = root.size
+	}
+
+	var prevSize int64
+	if c.prev != nil {
+		prevSize = c.prev.Size()
+	}
+	if err := c.dst.setVersionSizeToBatch(version, size, prevSize); err != nil {
+		return err
+	}
+	if err := c.dst.setVersionTimeToBatch(version); err != nil {
+		return err
+	}
+	if err := c.dst.setCommitMarkerToBatch(version); err != nil {
+		return err
+	}
+	if err := c.dst.Commit(); err != nil {
+		return err
+	}
+	c.dst.resetLatestVersion(version)
+	return nil
+}
+
+// convert writes the legacy node and its descendants newer than the previous version, and returns
+// the written node, or the one of the previous version if the node is as old.
+func (c *legacyConverter) convert(node *Node, isRoot bool) (*Node, error) {
+	version := node.nodeKey.version
+	if c.prev != nil && version <= c.prev.version {
+		return c.findPrev(node)
+	}
+
+	converted := &Node{
+		key:           node.key,
+		value:         node.value,
+		hash:          node.hash,
+		size:          node.size,
+		subtreeHeight: node.subtreeHeight,
+	}
+	var leftHash, rightHash []byte
+	if !node.isLeaf() {
+		left, err := node.getLeftNode(c.src)
+		if err != nil {
+			return nil, err
+		}
+		if left, err = c.convert(left, false); err != nil {
+			return nil, err
+		}
+		right, err := node.getRightNode(c.src)
+		if err != nil {
+			return nil, err
+		}
+		if right, err = c.convert(right, false); err != nil {
+			return nil, err
+		}
+		converted.leftNodeKey, converted.rightNodeKey = left.GetKey(), right.GetKey()
+		leftHash, rightHash = left.hash, right.hash
+	}
+
+	h := sha256.New()
+	if err := converted.writeHashBytesWithChildren(h, version, leftHash, rightHash); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h.Sum(nil), node.hash) {
+		return nil, fmt.Errorf("%w: legacy node %X of version %d doesn't match its hash", ErrCorruptNode, node.hash, version)
+	}
+
+	// the nonce 1 is the one of the root of the version, the other nodes start at 2
+	if isRoot && version == c.src.version {
+		converted.nodeKey = &NodeKey{version: version, nonce: 1}
+	} else {
+		c.nonces[version]++
+		converted.nodeKey = &NodeKey{version: version, nonce: c.nonces[version] + 1}
+	}
+	if _, err := c.dst.saveNode(converted); err != nil {
+		return nil, err
+	}
+	c.nodes++
+	return converted, nil
+}
+
+// findPrev returns the node of the previous version with the hash of the legacy node. The node
+// is on the path to its key, which is in its subtree also for an inner node.
+func (c *legacyConverter) findPrev(node *Node) (*Node, error) {
+	n := c.prev.root
+	for n != nil {
+		if bytes.Equal(n.hash, node.hash) {
+			return n, nil
+		}
+		if n.isLeaf() {
+			break
+		}
+		var err error
+		if bytes.Compare(node.key, n.key) < 0 {
+			n, err = n.getLeftNode(c.prev)
+		} else {
+			n, err = n.getRightNode(c.prev)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("legacy node %X of version %d is missing from the converted version %d", node.hash, node.nodeKey.version, c.prev.version)
+}
+
+// readOnlyDB fails the writes to a database.
+type readOnlyDB struct {
+	corestore.KVStoreWithBatch
+}
+
+// Set implements corestore.KVStore.
+func (readOnlyDB) Set(_, _ []byte) error {
+	return errReadOnly
+}
+
+// Delete implements corestore.KVStore.
+func (readOnlyDB) Delete(_ []byte) error {
+	return errReadOnly
+}
+
+// NewBatch implements corestore.BatchCreator.
+func (readOnlyDB) NewBatch() corestore.Batch {
+	return readOnlyBatch{}
+}
+
+// NewBatchWithSize implements corestore.BatchCreator.
+func (readOnlyDB) NewBatchWithSize(int) corestore.Batch {
+	return readOnlyBatch{}
+}
+
+// readOnlyBatch is the batch of a readOnlyDB.
+type readOnlyBatch struct{}
+
+func (readOnlyBatch) Set(_, _ []byte) error     { return errReadOnly }
+func (readOnlyBatch) Delete(_ []byte) error     { return errReadOnly }
+func (readOnlyBatch) Write() error              { return nil }
+func (readOnlyBatch) WriteSync() error          { return nil }
+func (readOnlyBatch) Close() error              { return nil }
+func (readOnlyBatch) GetByteSize() (int, error) { return 0, nil }
@@ -2,6 +2,7 @@ package iavl
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math/rand"
 	"os"
@@ -20,6 +21,11 @@ const (
 )
 
 func createLegacyTree(t *testing.T, dbDir string, version int) (string, error) {
+	return runLegacyDump(t, dbDir, "random", version, version/2)
+}
+
+// runLegacyDump generates a legacy tree with the legacydump command, see its usage for the modes.
+func runLegacyDump(t *testing.T, dbDir, mode string, version, removalVersion int) (string, error) {
 	relateDir := path.Join(t.TempDir(), dbDir)
 	if _, err := os.Stat(relateDir); err == nil {
 		err := os.RemoveAll(relateDir)
@@ -28,7 +34,7 @@ func createLegacyTree(t *testing.T, dbDir string, version int) (string, error) {
 		}
 	}
 
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("./cmd/legacydump/legacydump %s %s random %d %d", dbType, relateDir, version, version/2)) //nolint:gosec
+	cmd := exec.Command("sh", "-c", fmt.Sprintf("./cmd/legacydump/legacydump %s %s %s %d %d", dbType, relateDir, mode, version, removalVersion)) //nolint:gosec
 	var out bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &out
@@ -166,6 +172,13 @@ func TestDeleteVersions(t *testing.T) {
 
 	// Check the available versions
 	versions := tree.AvailableVersions()
+	available := map[int]bool{}
+	for _, version := range versions {
+		available[version] = true
+	}
+	for version := 1; version <= versions[len(versions)-1]; version++ {
+		require.Equal(t, available[version], tree.VersionExists(int64(version)), version)
+	}
 	targetVersion := 0
 	for i := len(versions) - 1; i >= 0; i-- {
 		if versions[i] < legacyVersion {
@@ -329,3 +342,188 @@ func TestRandomSet(t *testing.T) {
 	err = tree.DeleteVersionsTo(int64(legacyVersion + postVersions - 1))
 	require.NoError(t, err)
 }
+
+func TestMigrateStorage(t *testing.T) {
+	legacyVersion := 10
+	dbDir := fmt.Sprintf("./legacy-%s-%d", dbType, legacyVersion)
+	relateDir, err := createLegacyTree(t, dbDir, legacyVersion)
+	require.NoError(t, err)
+
+	db, err := dbm.NewGoLevelDB("test", relateDir)
+	require.NoError(t, err)
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("DB close error: %v\n", err)
+		}
+	}()
+
+	legacy := NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = legacy.LoadVersion(int64(legacyVersion))
+	require.NoError(t, err)
+	hash := legacy.Hash()
+	size := legacy.Size()
+
+	current, err := DetectStorageVersion(db)
+	require.NoError(t, err)
+	require.Equal(t, StorageVersionLegacy, current)
+
+	// the older legacy versions are only dropped on request
+	err = MigrateStorage(db, StorageVersionLegacy, StorageVersionNodeKey, MigrateOptions{})
+	require.ErrorContains(t, err, "DropLegacyHistory")
+	err = MigrateStorage(db, StorageVersionNodeKey, StorageVersionFastIndex, MigrateOptions{})
+	require.Error(t, err)
+
+	var steps []StorageVersion
+	require.NoError(t, MigrateStorage(db, StorageVersionLegacy, StorageVersionFastIndex, MigrateOptions{
+		DropLegacyHistory: true,
+		Progress: func(step StorageVersion, p Progress) {
+			if len(steps) == 0 || steps[len(steps)-1] != step {
+				steps = append(steps, step)
+			}
+		},
+	}))
+	current, err = DetectStorageVersion(db)
+	require.NoError(t, err)
+	require.Equal(t, StorageVersionFastIndex, current)
+	require.Equal(t, []StorageVersion{StorageVersionNodeKey}, steps)
+
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+		require.NotContains(t, []byte("nor"), itr.Key()[0], "legacy key %X", itr.Key())
+	}
+	require.NoError(t, itr.Close())
+
+	// the latest version loads without an implicit migration, with its hash
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), StrictLoadOption(true))
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, legacyVersion, version)
+	require.Equal(t, hash, tree.Hash())
+	require.Equal(t, size, tree.Size())
+	require.Equal(t, []int{legacyVersion}, tree.AvailableVersions())
+	_, err = tree.Set([]byte("k"), []byte("v"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.NoError(t, MigrateStorage(db, StorageVersionFastIndex, StorageVersionNodeKey, MigrateOptions{}))
+	current, err = DetectStorageVersion(db)
+	require.NoError(t, err)
+	require.Equal(t, StorageVersionNodeKey, current)
+	err = MigrateStorage(db, StorageVersionNodeKey, StorageVersionLegacy, MigrateOptions{})
+	require.Error(t, err)
+
+	var progress Progress
+	require.NoError(t, MigrateStorage(db, StorageVersionNodeKey, StorageVersionFastIndex, MigrateOptions{
+		Progress: func(step StorageVersion, p Progress) {
+			require.Equal(t, StorageVersionFastIndex, step)
+			progress = p
+		},
+	}))
+	require.Equal(t, size+1, progress.Nodes)
+	require.Equal(t, progress.TotalNodes, progress.Nodes)
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), StrictLoadOption(true))
+	_, err = tree.Load()
+	require.NoError(t, err)
+}
+
+func TestLegacyReader(t *testing.T) {
+	relateDir, err := runLegacyDump(t, "./legacy-reader", "sequential", 10, 3)
+	require.NoError(t, err)
+	db, err := dbm.NewGoLevelDB("test", relateDir)
+	require.NoError(t, err)
+	r, err := OpenLegacy(db)
+	require.NoError(t, err)
+	defer r.Close()
+
+	versions, err := r.Versions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{4, 5, 6, 7, 8, 9, 10}, versions)
+	_, err = r.GetImmutable(3)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.ErrorIs(t, r.tree.ndb.db.Set([]byte("k"), []byte("v")), errReadOnly)
+
+	// an interrupted conversion is resumed
+	dst := dbm.NewMemDB()
+	ctx, cancel := context.WithCancel(context.Background())
+	var converted []int64
+	var nodes int64
+	opts := ConvertOptions{Progress: func(version, n int64) {
+		converted = append(converted, version)
+		nodes += n
+		if version == 5 {
+			cancel()
+		}
+	}}
+	latest, err := r.Convert(ctx, dst, opts)
+	require.ErrorIs(t, err, context.Canceled)
+	require.EqualValues(t, 5, latest)
+	latest, err = r.Convert(context.Background(), dst, opts)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, latest)
+	require.Equal(t, versions, converted)
+
+	// every version has the legacy hash and contents, and the shared nodes were written once
+	target := NewMutableTree(dst, 0, true, NewNopLogger())
+	_, err = target.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 5, 6, 7, 8, 9, 10}, target.AvailableVersions())
+	var fullNodes int64
+	for _, version := range versions {
+		src, err := r.GetImmutable(version)
+		require.NoError(t, err)
+		tree, err := target.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, src.Hash(), tree.Hash())
+		require.Equal(t, src.Size(), tree.Size())
+		itr, err := src.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		for ; itr.Valid(); itr.Next() {
+			value, err := tree.Get(itr.Key())
+			require.NoError(t, err)
+			require.Equal(t, itr.Value(), value)
+		}
+		require.NoError(t, itr.Close())
+		fullNodes += 2*src.Size() - 1
+	}
+	require.Less(t, nodes, fullNodes)
+
+	// the converted tree is a regular one
+	_, err = target.Set([]byte("k"), []byte("v"))
+	require.NoError(t, err)
+	_, version, err := target.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 11, version)
+	require.NoError(t, MigrateStorage(dst, StorageVersionNodeKey, StorageVersionFastIndex, MigrateOptions{}))
+}
+
+func TestLegacyReader_Sparse(t *testing.T) {
+	relateDir, err := createLegacyTree(t, "./legacy-reader-sparse", 10)
+	require.NoError(t, err)
+	db, err := dbm.NewGoLevelDB("test", relateDir)
+	require.NoError(t, err)
+	r, err := OpenLegacy(db)
+	require.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.Convert(context.Background(), dbm.NewMemDB(), ConvertOptions{})
+	require.ErrorContains(t, err, "aren't contiguous")
+
+	// the latest version is converted on its own
+	dst := dbm.NewMemDB()
+	latest, err := r.Convert(context.Background(), dst, ConvertOptions{FromVersion: 10})
+	require.NoError(t, err)
+	require.EqualValues(t, 10, latest)
+	src, err := r.GetImmutable(10)
+	require.NoError(t, err)
+	target := NewMutableTree(dst, 0, true, NewNopLogger())
+	_, err = target.Load()
+	require.NoError(t, err)
+	require.Equal(t, src.Hash(), target.Hash())
+
+	// and the database is still legacy
+	current, err := DetectStorageVersion(db)
+	require.NoError(t, err)
+	require.Equal(t, StorageVersionLegacy, current)
+}
@@ -0,0 +1,112 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// MirrorTree maintains a read-only replica of a tree from the records of its changelog, see
+// Options.ChangelogWriter, e.g. in a separate process and database serving the queries of a
+// validator. The root hash of every version is checked against the recorded one before it is
+// saved, so the replica never serves a version which differs from the source. Its reads are safe
+// for concurrent use with Apply.
+type MirrorTree struct {
+	mtx    sync.RWMutex
+	tree   *MutableTree
+	latest *ImmutableTree
+	replay *changelogReplay
+}
+
+// NewMirrorTree opens the replica stored in db at its latest version. The options are those of
+// NewMutableTree, and must not include a ChangelogWriter of the source tree.
+func NewMirrorTree(db corestore.KVStoreWithBatch, cacheSize int, lg Logger, options ...Option) (*MirrorTree, error) {
+	tree := NewMutableTree(db, cacheSize, false, lg, options...)
+	if _, err := tree.Load(); err != nil {
+		return nil, err
+	}
+	latest, err := tree.latestImmutable()
+	if err != nil {
+		return nil, err
+	}
+	return &MirrorTree{tree: tree, latest: latest, replay: newChangelogReplay(tree, 0)}, nil
+}
+
+// latestImmutable returns the last saved version of the tree, or an empty tree if none was saved.
+func (tree *MutableTree) latestImmutable() (*ImmutableTree, error) {
+	if tree.version == 0 {
+		return &ImmutableTree{ndb: tree.ndb, skipFastStorageUpgrade: tree.skipFastStorageUpgrade}, nil
+	}
+	return tree.GetImmutable(tree.version)
+}
+
+// Apply applies a changelog record to the replica, see ReplayChangelog. The record of a version
+// is applied with its commit marker, see ChangelogRecord, and the rollbacks delete the versions
+// the replica replayed after them. Records of versions the replica already has are skipped, the
+// others must follow its latest version without gaps.
+func (m *MirrorTree) Apply(record *ChangelogRecord) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if err := m.replay.apply(record); err != nil {
+		return err
+	}
+	latest, err := m.tree.latestImmutable()
+	if err != nil {
+		return err
+	}
+	m.latest = latest
+	return nil
+}
+
+// ApplyChangelog applies the records of the changelog in r up to its end, see Apply, and returns
+// the latest version of the replica. A truncated final record, e.g. of a changelog which is still
+// being written, is not applied, nor is a final record without its commit marker. Since applied
+// records are skipped, a growing changelog can be applied again from its start to catch up.
+func (m *MirrorTree) ApplyChangelog(r io.Reader) (int64, error) {
+	cr := NewChangelogReader(r)
+	for {
+		record, err := cr.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// the changelog is read from its start again
+			m.mtx.Lock()
+			m.replay = newChangelogReplay(m.tree, 0)
+			m.mtx.Unlock()
+			return m.Version(), nil
+		}
+		if err != nil {
+			return m.Version(), err
+		}
+		if err := m.Apply(record); err != nil {
+			return m.Version(), fmt.Errorf("failed to apply changelog record of version %d: %w", record.Version, err)
+		}
+	}
+}
+
+// Version returns the latest version of the replica, or 0 if it has none.
+func (m *MirrorTree) Version() int64 {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.latest.version
+}
+
+// Latest returns the latest version of the replica, which stays readable while later records are
+// applied.
+func (m *MirrorTree) Latest() *ImmutableTree {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.latest
+}
+
+// GetImmutable returns the given version of the replica, see MutableTree.GetImmutable.
+func (m *MirrorTree) GetImmutable(version int64) (*ImmutableTree, error) {
+	return m.tree.GetImmutable(version)
+}
+
+// Hash returns the root hash of the latest version of the replica.
+func (m *MirrorTree) Hash() []byte {
+	return m.Latest().Hash()
+}
@@ -0,0 +1,92 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestMirrorTree(t *testing.T) {
+	var buf bytes.Buffer
+	source := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ChangelogWriterOption(&buf))
+	saveVersions := func(n int) {
+		for i := 0; i < n; i++ {
+			for j := 0; j < 5; j++ {
+				_, err := source.Set([]byte(fmt.Sprintf("key-%d", (i*7+j)%13)), []byte(fmt.Sprintf("value-%d-%d", i, j)))
+				require.NoError(t, err)
+			}
+			_, _, err := source.Remove([]byte(fmt.Sprintf("key-%d", i%13)))
+			require.NoError(t, err)
+			_, _, err = source.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	saveVersions(3)
+
+	db := dbm.NewMemDB()
+	mirror, err := NewMirrorTree(db, 0, NewNopLogger())
+	require.NoError(t, err)
+	require.Zero(t, mirror.Version())
+
+	// a truncated record isn't applied, and the changelog can be applied again from its start
+	version, err := mirror.ApplyChangelog(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	previous := mirror.Latest()
+
+	saveVersions(2)
+	version, err = mirror.ApplyChangelog(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, int64(5), version)
+	require.Equal(t, source.Hash(), mirror.Hash())
+
+	value, err := mirror.Latest().Get([]byte("key-5"))
+	require.NoError(t, err)
+	expected, err := source.Get([]byte("key-5"))
+	require.NoError(t, err)
+	require.Equal(t, expected, value)
+	require.Equal(t, int64(2), previous.Version())
+	old, err := mirror.GetImmutable(2)
+	require.NoError(t, err)
+	require.Equal(t, old.Hash(), previous.Hash())
+
+	// the replica is reopened at its latest version
+	mirror, err = NewMirrorTree(db, 0, NewNopLogger())
+	require.NoError(t, err)
+	require.Equal(t, int64(5), mirror.Version())
+	require.Equal(t, source.Hash(), mirror.Hash())
+
+	// a record which doesn't match its root hash is rejected
+	saveVersions(1)
+	r := NewChangelogReader(bytes.NewReader(buf.Bytes()))
+	var record *ChangelogRecord
+	for record == nil || record.Version < 6 {
+		record, err = r.Next()
+		require.NoError(t, err)
+	}
+	record.RootHash = MutateByteSlice(record.RootHash)
+	require.NoError(t, mirror.Apply(record))
+	require.Error(t, mirror.Apply(&ChangelogRecord{Version: 6, Committed: true}))
+	require.Equal(t, int64(5), mirror.Version())
+
+	// gaps are rejected
+	require.NoError(t, mirror.Apply(&ChangelogRecord{Version: 7}))
+	require.Error(t, mirror.Apply(&ChangelogRecord{Version: 7, Committed: true}))
+
+	// a rollback of the source and the versions saved again replace the applied ones
+	require.NoError(t, source.LoadVersionForOverwriting(4))
+	_, err = source.Set([]byte("key-5"), []byte("saved again"))
+	require.NoError(t, err)
+	_, _, err = source.SaveVersion()
+	require.NoError(t, err)
+	mirror, err = NewMirrorTree(db, 0, NewNopLogger())
+	require.NoError(t, err)
+	version, err = mirror.ApplyChangelog(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, int64(5), version)
+	require.Equal(t, source.Hash(), mirror.Hash())
+}
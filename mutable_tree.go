@@ -2,13 +2,17 @@ package iavl
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	corestore "cosmossdk.io/core/store"
 
+	"github.com/cosmos/iavl/cache"
 	"github.com/cosmos/iavl/fastnode"
 	ibytes "github.com/cosmos/iavl/internal/bytes"
 )
@@ -19,8 +23,28 @@ var (
 
 	// ErrKeyDoesNotExist is returned if a key does not exist.
 	ErrKeyDoesNotExist = errors.New("key does not exist")
+
+	// ErrUnsavedChanges is returned if an operation requires a tree without unsaved changes.
+	ErrUnsavedChanges = errors.New("tree has unsaved changes")
+
+	// ErrTreeClosed is returned by the writes of a tree after it was closed.
+	ErrTreeClosed = errors.New("tree is closed")
+
+	// ErrInvalidKey is returned by the writes of keys rejected by Options.KeyValidator.
+	ErrInvalidKey = errors.New("invalid key")
 )
 
+// MigrationRequiredError is returned by loads with Options.StrictLoad which would have to write a
+// migration of the database, describing it.
+type MigrationRequiredError struct {
+	// Migration describes the migration, e.g. the fast storage upgrade.
+	Migration string
+}
+
+func (e *MigrationRequiredError) Error() string {
+	return "migration required: " + e.Migration
+}
+
 type Option func(*Options)
 
 // MutableTree is a persistent tree which keeps track of versions. It is not safe for concurrent
@@ -34,12 +58,22 @@ type Option func(*Options)
 type MutableTree struct {
 	logger Logger
 
-	*ImmutableTree                          // The current, working tree.
-	lastSaved                *ImmutableTree // The most recently saved tree.
-	unsavedFastNodeAdditions *sync.Map      // map[string]*FastNode FastNodes that have not yet been saved to disk
-	unsavedFastNodeRemovals  *sync.Map      // map[string]interface{} FastNodes that have not yet been removed from disk
+	*ImmutableTree                              // The current, working tree.
+	lastSaved                *ImmutableTree     // The most recently saved tree.
+	unsavedFastNodeAdditions *sync.Map          // map[string]*FastNode FastNodes that have not yet been saved to disk
+	unsavedFastNodeRemovals  *sync.Map          // map[string]interface{} FastNodes that have not yet been removed from disk
+	fastNodeKeys             ibytes.StringArena // Backs the keys of the unsaved fast node maps
 	ndb                      *nodeDB
-	skipFastStorageUpgrade   bool // If true, the tree will work like no fast storage and always not upgrade fast storage
+	skipFastStorageUpgrade   bool              // If true, the tree will work like no fast storage and always not upgrade fast storage
+	fastStorageCleanup       <-chan error      // Result of the background fast node deletion, if any.
+	fastStorageRebuild       *fastIndexRebuild // Background rebuild of the fast node index, if any.
+	unsavedChanges           []*KVPair         // Changes of the working tree for Options.ChangelogWriter
+	unsavedUserBytes         int64             // Size of the keys and values of the changes of the working tree
+	pendingOrphans           int64             // Nodes orphaned since the last prune triggered by Options.Pruning
+	pendingOrphanBytes       int64             // Estimated encoded size of pendingOrphans
+	closed                   bool              // Set by Close, failing the writes after
+	shadow                   *MutableTree      // Mirror of the tree on Options.ShadowDB, until it diverges
+	shadowDivergence         *ShadowDivergence
 
 	mtx sync.Mutex
 }
@@ -54,7 +88,7 @@ func NewMutableTree(db corestore.KVStoreWithBatch, cacheSize int, skipFastStorag
 	ndb := newNodeDB(db, cacheSize, opts, lg)
 	head := &ImmutableTree{ndb: ndb, skipFastStorageUpgrade: skipFastStorageUpgrade}
 
-	return &MutableTree{
+	tree := &MutableTree{
 		logger:                   lg,
 		ImmutableTree:            head,
 		lastSaved:                head.clone(),
@@ -63,6 +97,10 @@ func NewMutableTree(db corestore.KVStoreWithBatch, cacheSize int, skipFastStorag
 		ndb:                      ndb,
 		skipFastStorageUpgrade:   skipFastStorageUpgrade,
 	}
+	if opts.ShadowDB != nil {
+		tree.shadow = newShadowTree(opts, cacheSize, skipFastStorageUpgrade, lg)
+	}
+	return tree
 }
 
 // IsEmpty returns whether or not the tree has any keys. Only trees that are
@@ -71,12 +109,27 @@ func (tree *MutableTree) IsEmpty() bool {
 	return tree.ImmutableTree.Size() == 0
 }
 
-// GetLatestVersion returns the latest version of the tree.
+// GetLatestVersion returns the latest saved version of the tree, or 0 if no version was saved.
+// It is served from the nodeDB version markers, which are kept up to date by SaveVersion,
+// pruning and rollbacks, so it never scans the stored versions once loaded.
 func (tree *MutableTree) GetLatestVersion() (int64, error) {
 	return tree.ndb.getLatestVersion()
 }
 
-// VersionExists returns whether or not a version exists.
+// LatestVersion is an alias of GetLatestVersion, named to pair with FirstAvailableVersion.
+func (tree *MutableTree) LatestVersion() (int64, error) {
+	return tree.GetLatestVersion()
+}
+
+// FirstAvailableVersion returns the oldest version still stored in the tree, or 0 if no version
+// was saved. Like GetLatestVersion, it is served from the nodeDB version markers.
+func (tree *MutableTree) FirstAvailableVersion() (int64, error) {
+	return tree.ndb.getFirstVersion()
+}
+
+// VersionExists returns whether or not a version exists. It is served from the nodeDB version
+// markers, with a single root lookup for legacy versions, which can have gaps. The versions
+// skipped by MigrateInitialVersion don't exist.
 func (tree *MutableTree) VersionExists(version int64) bool {
 	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
 	if err != nil {
@@ -95,10 +148,12 @@ func (tree *MutableTree) VersionExists(version int64) bool {
 		return false
 	}
 
-	return firstVersion <= version && version <= latestVersion
+	return firstVersion <= version && version <= latestVersion && !tree.ndb.inVersionGap(version)
 }
 
-// AvailableVersions returns all available versions in ascending order
+// AvailableVersions returns all available versions in ascending order. The legacy versions are
+// read by a scan of their roots, the others are contiguous between the version markers, except
+// for the versions skipped by MigrateInitialVersion.
 func (tree *MutableTree) AvailableVersions() []int {
 	firstVersion, err := tree.ndb.getFirstVersion()
 	if err != nil {
@@ -115,24 +170,50 @@ func (tree *MutableTree) AvailableVersions() []int {
 
 	res := make([]int, 0)
 	if legacyLatestVersion > firstVersion {
-		for version := firstVersion; version < legacyLatestVersion; version++ {
-			has, err := tree.ndb.hasLegacyVersion(version)
-			if err != nil {
-				return nil
-			}
-			if has {
-				res = append(res, int(version))
-			}
+		legacyVersions, err := tree.ndb.legacyVersions(firstVersion, legacyLatestVersion)
+		if err != nil {
+			return nil
+		}
+		for _, version := range legacyVersions {
+			res = append(res, int(version))
 		}
 		firstVersion = legacyLatestVersion
 	}
 
-	for version := firstVersion; version <= latestVersion; version++ {
+	for version := firstVersion; version <= latestVersion; version = tree.ndb.nextVersion(version) {
 		res = append(res, int(version))
 	}
 	return res
 }
 
+// ProvableVersions returns the available versions, in ascending order, which can still produce
+// complete proofs, e.g. for an RPC server to advertise its earliest provable height. Versions up
+// to a pending or running asynchronous pruning are excluded, since their nodes may be deleted at
+// any time, and so is the first version if its deletion was interrupted and some of its nodes are
+// already gone.
+func (tree *MutableTree) ProvableVersions() ([]int, error) {
+	tree.ndb.mtx.Lock()
+	pruneVersion := tree.ndb.pruneVersion
+	tree.ndb.mtx.Unlock()
+
+	versions := tree.AvailableVersions()
+	for len(versions) > 0 && int64(versions[0]) <= pruneVersion {
+		versions = versions[1:]
+	}
+	// versions are deleted from the first one upwards, so only the first one can be incomplete
+	for len(versions) > 0 {
+		complete, err := tree.ndb.isVersionComplete(int64(versions[0]))
+		if err != nil {
+			return nil, err
+		}
+		if complete {
+			break
+		}
+		versions = versions[1:]
+	}
+	return versions, nil
+}
+
 // Hash returns the hash of the latest saved version of the tree, as returned
 // by SaveVersion. If no versions have been saved, Hash returns nil.
 func (tree *MutableTree) Hash() []byte {
@@ -144,8 +225,50 @@ func (tree *MutableTree) WorkingHash() []byte {
 	return tree.root.hashWithCount(tree.WorkingVersion())
 }
 
+// SimulateHash returns the working hash the tree would have once the changes are applied, without
+// applying them, e.g. to evaluate candidate sets of transactions when building a block. Like
+// SnapshotIterator, it relies on Set and Remove copying the nodes they change, so the changes are
+// applied to a scratch copy of the working tree which is discarded afterwards, and the nodes of the
+// working tree are hashed with ComputeWorkingHash. Nothing is written.
+func (tree *MutableTree) SimulateHash(changes *ChangeSet) ([]byte, error) {
+	sim := &MutableTree{
+		logger:                 tree.logger,
+		ImmutableTree:          tree.ImmutableTree.clone(),
+		ndb:                    tree.ndb,
+		skipFastStorageUpgrade: true,
+	}
+	sim.ImmutableTree.skipFastStorageUpgrade = true
+	for _, pair := range changes.Pairs {
+		if pair.Delete {
+			if sim.root == nil {
+				continue
+			}
+			newRoot, _, _, removed, err := sim.recursiveRemove(sim.root, pair.Key)
+			if err != nil {
+				return nil, err
+			}
+			if removed {
+				sim.root = newRoot
+			}
+			continue
+		}
+		if _, err := sim.set(pair.Key, pair.Value); err != nil {
+			return nil, err
+		}
+	}
+	return sim.ComputeWorkingHash()
+}
+
+// ComputeWorkingHash is like WorkingHash, but doesn't store the hashes it computes in the nodes of
+// the working tree, so it can be called repeatedly, e.g. after every transaction, without changing
+// the state SaveVersion starts from. The new nodes are hashed again on every call.
+func (tree *MutableTree) ComputeWorkingHash() ([]byte, error) {
+	var buf bytes.Buffer
+	return tree.root.computeHash(tree.WorkingVersion(), sha256.New(), &buf)
+}
+
 func (tree *MutableTree) WorkingVersion() int64 {
-	version := tree.version + 1
+	version := tree.ndb.nextVersion(tree.version)
 	if version == 1 && tree.ndb.opts.InitialVersion > 0 {
 		version = int64(tree.ndb.opts.InitialVersion)
 	}
@@ -157,21 +280,40 @@ func (tree *MutableTree) String() (string, error) {
 	return tree.ndb.String()
 }
 
-// Set sets a key in the working tree. Nil values are invalid. The given
+// Set sets a key in the working tree. Nil values are invalid, unless
+// Options.AllowEmptyValues stores them as empty values. The given
 // key/value byte slices must not be modified after this call, since they point
 // to slices stored within IAVL. It returns true when an existing value was
 // updated, while false means it was a new key.
 func (tree *MutableTree) Set(key, value []byte) (updated bool, err error) {
+	if tree.closed {
+		return false, ErrTreeClosed
+	}
+	if err := tree.validateKey(key); err != nil {
+		return false, err
+	}
+	if value == nil && tree.ndb.opts.AllowEmptyValues {
+		// an empty value, so it isn't taken for a removal by the logs
+		value = []byte{}
+	}
+	tree.onAccess(AccessSet, key)
+	defer tree.ndb.latency.observe(LatencySet, tree.ndb.latency.startTimer())
+	if err := tree.writeIntent(IntentSet, key, value); err != nil {
+		return false, err
+	}
 	updated, err = tree.set(key, value)
 	if err != nil {
 		return false, err
 	}
+	tree.recordChange(key, value, false)
 	return updated, nil
 }
 
 // Get returns the value of the specified key if it exists, or nil otherwise.
 // The returned value must not be modified, since it may point to data stored within IAVL.
 func (tree *MutableTree) Get(key []byte) ([]byte, error) {
+	tree.onAccess(AccessGet, key)
+	defer tree.ndb.latency.observe(LatencyGet, tree.ndb.latency.startTimer())
 	if tree.root == nil {
 		return nil, nil
 	}
@@ -181,12 +323,55 @@ func (tree *MutableTree) Get(key []byte) ([]byte, error) {
 			return fastNode.(*fastnode.Node).GetValue(), nil
 		}
 		// check if node was deleted
-		if _, ok := tree.unsavedFastNodeRemovals.Load(string(key)); ok {
+		if _, ok := tree.unsavedFastNodeRemovals.Load(ibytes.UnsafeBytesToStr(key)); ok {
 			return nil, nil
 		}
 	}
 
-	return tree.ImmutableTree.Get(key)
+	return tree.ImmutableTree.get(key)
+}
+
+// GetAtWorkingVersion returns the value of the key as of the working version, i.e. the latest
+// saved version with the unsaved changes of the working tree applied, or nil if it doesn't exist.
+// GetVersioned only reads saved versions, so it doesn't see the working version. Unlike Get, it
+// reads the nodes of the working tree, never the fast index, so the result doesn't depend on the
+// fast storage status, e.g. on fast nodes left stale by a crash. The returned value must not be
+// modified.
+func (tree *MutableTree) GetAtWorkingVersion(key []byte) ([]byte, error) {
+	tree.onAccess(AccessGet, key)
+	if tree.root == nil {
+		return nil, nil
+	}
+	_, value, err := tree.root.get(tree.ImmutableTree, key)
+	return value, err
+}
+
+// GetWithIndex returns the index and value of the specified key in the working tree, see
+// ImmutableTree.GetWithIndex. Unlike Get, it always reads the nodes of the working tree, since the
+// fast index has no indexes.
+func (tree *MutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
+	tree.onAccess(AccessGet, key)
+	if tree.root == nil {
+		return 0, nil, nil
+	}
+	return tree.root.get(tree.ImmutableTree, key)
+}
+
+// GetWithOptions is like Get, with the given query options. Bypassing the fast cache also skips the
+// unsaved fast nodes, the value is read from the nodes of the working tree.
+func (tree *MutableTree) GetWithOptions(key []byte, opts QueryOptions) ([]byte, error) {
+	if !opts.BypassFastCache {
+		return tree.Get(key)
+	}
+	tree.onAccess(AccessGet, key)
+	return tree.ImmutableTree.getFromNodes(key)
+}
+
+// onAccess calls the access hook of the tree, if any, with the working version.
+func (tree *MutableTree) onAccess(op AccessOp, key []byte) {
+	if tree.ndb.opts.AccessHook != nil {
+		tree.ndb.opts.AccessHook(op, key, tree.WorkingVersion())
+	}
 }
 
 // Import returns an importer for tree nodes previously exported by ImmutableTree.Export(),
@@ -198,18 +383,83 @@ func (tree *MutableTree) Get(key []byte) ([]byte, error) {
 // Import can only be called on an empty tree. It is the callers responsibility that no other
 // modifications are made to the tree while importing.
 func (tree *MutableTree) Import(version int64) (*Importer, error) {
-	return newImporter(tree, version)
+	return newImporter(tree, version, ImportOptions{})
+}
+
+// ImportWithOptions is like Import, but takes ImportOptions, e.g. to verify the node hashes of the
+// imported snapshot.
+func (tree *MutableTree) ImportWithOptions(version int64, opts ImportOptions) (*Importer, error) {
+	return newImporter(tree, version, opts)
+}
+
+// SyncFrom copies the saved version of src into the empty tree, node by node, e.g. to fork a tree
+// or build a derived store in tests. It works like an export of src imported with verified hashes,
+// but without the Exporter and the byte codec of export streams. The copied nodes share no memory
+// with src, which may be stored in another database, and src must not be pruned meanwhile.
+func (tree *MutableTree) SyncFrom(src *ImmutableTree) error {
+	return tree.syncFrom(src, nil)
+}
+
+// syncFrom is SyncFrom, calling progress, if not nil, with the progress of the import.
+func (tree *MutableTree) syncFrom(src *ImmutableTree, progress func(Progress)) error {
+	if src == nil || src.ndb == nil {
+		return ErrNotInitalizedTree
+	}
+	if src.root != nil && src.root.hash == nil {
+		return ErrUnsavedChanges
+	}
+	importer, err := newImporter(tree, src.version, ImportOptions{VerifyHashes: true, RootHash: src.Hash()})
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+	importer.total.Store(exportNodeCount(src.Size(), false))
+
+	src.ndb.incrVersionReaders(src.version)
+	defer src.ndb.decrVersionReaders(src.version)
+	if src.root != nil {
+		// the copied nodes would evict the working set of the source from the node cache
+		src.root.traversePost(src.WithCacheBypass(), true, func(node *Node) bool {
+			err = importer.Add(&ExportNode{
+				Key:     bytes.Clone(node.key),
+				Value:   bytes.Clone(node.value),
+				Version: node.nodeKey.version,
+				Height:  node.subtreeHeight,
+				Hash:    node.hash,
+			})
+			if progress != nil && importer.nodes.Load()%migrationProgressInterval == 0 {
+				progress(importer.Progress())
+			}
+			return err != nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if progress != nil {
+		progress(importer.Progress())
+	}
+	return importer.Commit()
+}
+
+// IterateHashes calls fn with the key and the hash of every leaf of the working tree, see
+// ImmutableTree.IterateHashes. The hashes of unsaved leaves are the ones they get when the working
+// version is saved.
+func (tree *MutableTree) IterateHashes(fn func(key []byte, leafHash []byte) bool) (bool, error) {
+	tree.onAccess(AccessIterate, nil)
+	return tree.ImmutableTree.iterateHashes(tree.WorkingVersion(), fn)
 }
 
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
 // since they may point to data stored within IAVL. Returns true if stopped by callnack, false otherwise
 func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	tree.onAccess(AccessIterate, nil)
 	if tree.root == nil {
 		return false, nil
 	}
 
 	if tree.skipFastStorageUpgrade {
-		return tree.ImmutableTree.Iterate(fn)
+		return tree.ImmutableTree.iterate(fn)
 	}
 
 	isFastCacheEnabled, err := tree.IsFastCacheEnabled()
@@ -217,7 +467,7 @@ func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stoppe
 		return false, err
 	}
 	if !isFastCacheEnabled {
-		return tree.ImmutableTree.Iterate(fn)
+		return tree.ImmutableTree.iterate(fn)
 	}
 
 	itr := NewUnsavedFastIterator(nil, nil, true, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals)
@@ -233,6 +483,36 @@ func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stoppe
 // Iterator returns an iterator over the mutable tree.
 // CONTRACT: no updates are made to the tree while an iterator is active.
 func (tree *MutableTree) Iterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
+	tree.onAccess(AccessIterate, start)
+	return tree.iterator(start, end, ascending)
+}
+
+// IteratorWithOptions is like Iterator, with the given iterator options, see
+// ImmutableTree.IteratorWithOptions. The domain of the working tree includes its unsaved changes.
+func (tree *MutableTree) IteratorWithOptions(start, end []byte, ascending bool, opts IteratorOptions) (corestore.Iterator, error) {
+	tree.onAccess(AccessIterate, start)
+	if opts.ClampToDomain {
+		var (
+			empty bool
+			err   error
+		)
+		start, end, empty, err = tree.ImmutableTree.clampToDomain(start, end)
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			return &Iterator{start: start, end: end}, nil
+		}
+	}
+	itr, err := tree.iterator(start, end, ascending)
+	if err != nil {
+		return nil, err
+	}
+	return newThrottledIterator(itr, opts.MaxOpsPerSec), nil
+}
+
+// iterator is Iterator without the access hook.
+func (tree *MutableTree) iterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
 	if !tree.skipFastStorageUpgrade {
 		isFastCacheEnabled, err := tree.IsFastCacheEnabled()
 		if err != nil {
@@ -244,7 +524,31 @@ func (tree *MutableTree) Iterator(start, end []byte, ascending bool) (corestore.
 		}
 	}
 
-	return tree.ImmutableTree.Iterator(start, end, ascending)
+	return tree.ImmutableTree.iterator(start, end, ascending)
+}
+
+// SnapshotIterator returns an iterator over a snapshot of the working tree, including its unsaved
+// changes. Unlike Iterator, it stays consistent while the tree is modified or saved, since Set and
+// Remove copy the nodes they change instead of updating them, and the unsaved nodes, which
+// SaveVersion assigns keys to and detaches from their children, are copied by the call. So it can
+// also be read concurrently with the writes and saves of the tree. It must not outlive the deletion
+// of the last saved version, whose nodes it may still load from disk.
+func (tree *MutableTree) SnapshotIterator(start, end []byte, ascending bool) corestore.Iterator {
+	snapshot := tree.ImmutableTree.clone()
+	snapshot.root = cloneUnsaved(snapshot.root)
+	return NewIterator(start, end, ascending, snapshot)
+}
+
+// cloneUnsaved copies the unsaved nodes of the subtree, i.e. those without a node key, and shares
+// the saved ones, which aren't modified.
+func cloneUnsaved(node *Node) *Node {
+	if node == nil || node.nodeKey != nil {
+		return node
+	}
+	clone := *node
+	clone.leftNode = cloneUnsaved(node.leftNode)
+	clone.rightNode = cloneUnsaved(node.rightNode)
+	return &clone
 }
 
 func (tree *MutableTree) set(key []byte, value []byte) (updated bool, err error) {
@@ -260,8 +564,12 @@ func (tree *MutableTree) set(key []byte, value []byte) (updated bool, err error)
 		return updated, nil
 	}
 
-	tree.ImmutableTree.root, updated, err = tree.recursiveSet(tree.ImmutableTree.root, key, value)
-	return updated, err
+	newRoot, updated, err := tree.recursiveSet(tree.ImmutableTree.root, key, value)
+	if err != nil {
+		return updated, err
+	}
+	tree.ImmutableTree.root = newRoot
+	return updated, nil
 }
 
 func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
@@ -276,11 +584,17 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte) (
 	}
 
 	if bytes.Compare(key, node.key) < 0 {
+		if err := tree.checkChild(node, node.leftNode); err != nil {
+			return nil, false, err
+		}
 		node.leftNode, updated, err = tree.recursiveSet(node.leftNode, key, value)
 		if err != nil {
 			return nil, updated, err
 		}
 	} else {
+		if err := tree.checkChild(node, node.rightNode); err != nil {
+			return nil, false, err
+		}
 		node.rightNode, updated, err = tree.recursiveSet(node.rightNode, key, value)
 		if err != nil {
 			return nil, updated, err
@@ -332,9 +646,30 @@ func (tree *MutableTree) recursiveSetLeaf(node *Node, key []byte, value []byte)
 	}
 }
 
+// validateKey checks the key of a write with Options.KeyValidator, if any.
+func (tree *MutableTree) validateKey(key []byte) error {
+	if tree.ndb.opts.KeyValidator == nil {
+		return nil
+	}
+	if err := tree.ndb.opts.KeyValidator(key); err != nil {
+		return fmt.Errorf("%w %X: %w", ErrInvalidKey, key, err)
+	}
+	return nil
+}
+
 // Remove removes a key from the working tree. The given key byte slice should not be modified
 // after this call, since it may point to data stored inside IAVL.
 func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
+	if tree.closed {
+		return nil, false, ErrTreeClosed
+	}
+	if err := tree.validateKey(key); err != nil {
+		return nil, false, err
+	}
+	tree.onAccess(AccessRemove, key)
+	if err := tree.writeIntent(IntentRemove, key, nil); err != nil {
+		return nil, false, err
+	}
 	if tree.root == nil {
 		return nil, false, nil
 	}
@@ -349,11 +684,110 @@ func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
 	if !tree.skipFastStorageUpgrade {
 		tree.addUnsavedRemoval(key)
 	}
+	tree.recordChange(key, nil, true)
 
 	tree.root = newRoot
 	return value, true, nil
 }
 
+// RemoveMany removes the given keys, which must be sorted in ascending order without duplicates,
+// from the working tree in a single pass, e.g. to drain a queue of contiguous keys. It returns the
+// removed values in the order of the keys, nil for keys which don't exist. Instead of rebalancing
+// after every key, the subtrees left by the removals are joined and rebalanced once on the way
+// up, so the resulting tree, and its hash, can differ from removing the keys one by one with
+// Remove. Like Remove, the keys should not be modified after this call.
+func (tree *MutableTree) RemoveMany(keys [][]byte) ([][]byte, error) {
+	if tree.closed {
+		return nil, ErrTreeClosed
+	}
+	for i, key := range keys {
+		if i > 0 && bytes.Compare(keys[i-1], key) >= 0 {
+			return nil, fmt.Errorf("keys must be sorted in ascending order without duplicates, %X is followed by %X", keys[i-1], key)
+		}
+		if err := tree.validateKey(key); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range keys {
+		tree.onAccess(AccessRemove, key)
+		if err := tree.writeIntent(IntentRemove, key, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make([][]byte, len(keys))
+	if tree.root == nil || len(keys) == 0 {
+		return values, nil
+	}
+	newRoot, err := tree.recursiveRemoveMany(tree.root, keys, values)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if values[i] == nil {
+			continue
+		}
+		if !tree.skipFastStorageUpgrade {
+			tree.addUnsavedRemoval(key)
+		}
+		tree.recordChange(key, nil, true)
+	}
+	tree.root = newRoot
+	return values, nil
+}
+
+// recursiveRemoveMany removes the sorted keys from the subtree of node, setting the removed values
+// at the indexes of their keys, and returns the new subtree, nil if it has no keys left.
+func (tree *MutableTree) recursiveRemoveMany(node *Node, keys, values [][]byte) (*Node, error) {
+	if node.isLeaf() {
+		for i, key := range keys {
+			if bytes.Equal(key, node.key) {
+				values[i] = node.value
+				return nil, nil
+			}
+		}
+		return node, nil
+	}
+
+	// the keys below node.key are in the left subtree
+	split := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], node.key) >= 0 })
+	leftNode, err := node.getLeftNode(tree.ImmutableTree)
+	if err != nil {
+		return nil, err
+	}
+	rightNode, err := node.getRightNode(tree.ImmutableTree)
+	if err != nil {
+		return nil, err
+	}
+	if err := tree.checkChild(node, leftNode); err != nil {
+		return nil, err
+	}
+	if err := tree.checkChild(node, rightNode); err != nil {
+		return nil, err
+	}
+	newLeft, newRight := leftNode, rightNode
+	if split > 0 {
+		if newLeft, err = tree.recursiveRemoveMany(leftNode, keys[:split], values[:split]); err != nil {
+			return nil, err
+		}
+	}
+	if split < len(keys) {
+		if newRight, err = tree.recursiveRemoveMany(rightNode, keys[split:], values[split:]); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case newLeft == leftNode && newRight == rightNode:
+		return node, nil
+	case newLeft == nil:
+		return newRight, nil
+	case newRight == nil:
+		return newLeft, nil
+	}
+	return tree.joinNodes(newLeft, newRight)
+}
+
 // removes the node corresponding to the passed key and balances the tree.
 // It returns:
 // - the hash of the new node (or nil if the node is the one removed)
@@ -376,6 +810,9 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node,
 
 	// node.key < key; we go to the left to find the key:
 	if bytes.Compare(key, node.key) < 0 {
+		if err := tree.checkChild(node, node.leftNode); err != nil {
+			return nil, nil, nil, false, err
+		}
 		newLeftNode, newKey, value, removed, err := tree.recursiveRemove(node.leftNode, key)
 		if err != nil {
 			return nil, nil, nil, false, err
@@ -402,6 +839,9 @@ func (tree *MutableTree) recursiveRemove(node *Node, key []byte) (newSelf *Node,
 		return node, newKey, value, removed, nil
 	}
 	// node.key >= key; either found or look to the right:
+	if err := tree.checkChild(node, node.rightNode); err != nil {
+		return nil, nil, nil, false, err
+	}
 	newRightNode, newKey, value, removed, err := tree.recursiveRemove(node.rightNode, key)
 	if err != nil {
 		return nil, nil, nil, false, err
@@ -439,14 +879,33 @@ func (tree *MutableTree) Load() (int64, error) {
 
 // Returns the version number of the specific version found
 func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
+	version, err := tree.loadVersion(targetVersion)
+	if err == nil {
+		tree.shadowLoad(version, false)
+	}
+	return version, err
+}
+
+func (tree *MutableTree) loadVersion(targetVersion int64) (int64, error) {
+	if tree.closed {
+		return 0, ErrTreeClosed
+	}
+	// a failed async fast node write is recovered by the fast storage upgrade below
+	tree.ndb.recoverFastNodeWrites()
+	if err := tree.ndb.loadVersionGap(); err != nil {
+		return 0, err
+	}
+	if err := tree.ndb.loadKeyPrefixes(); err != nil {
+		return 0, err
+	}
+
 	firstVersion, err := tree.ndb.getFirstVersion()
 	if err != nil {
 		return 0, err
 	}
 
-	if firstVersion > 0 && firstVersion < int64(tree.ndb.opts.InitialVersion) {
-		return firstVersion, fmt.Errorf("initial version set to %v, but found earlier version %v",
-			tree.ndb.opts.InitialVersion, firstVersion)
+	if err := tree.checkInitialVersion(firstVersion); err != nil {
+		return firstVersion, err
 	}
 
 	latestVersion, err := tree.ndb.getLatestVersion()
@@ -454,9 +913,8 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 		return 0, err
 	}
 
-	if firstVersion > 0 && firstVersion < int64(tree.ndb.opts.InitialVersion) {
-		return latestVersion, fmt.Errorf("initial version set to %v, but found earlier version %v",
-			tree.ndb.opts.InitialVersion, firstVersion)
+	if err := tree.checkInitialVersion(firstVersion); err != nil {
+		return latestVersion, err
 	}
 
 	if latestVersion < targetVersion {
@@ -468,13 +926,15 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 			if !tree.skipFastStorageUpgrade {
 				tree.mtx.Lock()
 				defer tree.mtx.Unlock()
-				_, err := tree.enableFastStorageAndCommitIfNotEnabled()
-				return 0, err
+				return 0, tree.upgradeFastStorageOnLoad()
 			}
 			return 0, nil
 		}
 		return 0, fmt.Errorf("no versions found while trying to load %v", targetVersion)
 	}
+	if err := tree.ndb.checkBalanceSlack(); err != nil {
+		return latestVersion, err
+	}
 
 	if targetVersion <= 0 {
 		targetVersion = latestVersion
@@ -502,25 +962,140 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 
 	tree.ImmutableTree = iTree
 	tree.lastSaved = iTree.clone()
+	tree.unsavedChanges = nil
+	tree.unsavedUserBytes = 0
 
-	if !tree.skipFastStorageUpgrade {
-		// Attempt to upgrade
-		if _, err := tree.enableFastStorageAndCommitIfNotEnabled(); err != nil {
-			return 0, err
-		}
+	if err := tree.loadFastStorage(); err != nil {
+		return 0, err
 	}
 
 	return latestVersion, nil
 }
 
+// loadFastStorage attempts to upgrade the fast storage on load, or resumes its background rebuild
+// or deletion if they were interrupted by a restart, see SetFastStorageEnabled.
+func (tree *MutableTree) loadFastStorage() error {
+	if tree.fastStorageRebuild != nil || tree.fastStorageCleanup != nil {
+		return nil
+	}
+	if tree.skipFastStorageUpgrade {
+		done, err := tree.ndb.resumeFastStorageCleanup()
+		if done != nil {
+			tree.fastStorageCleanup = done
+		}
+		return err
+	}
+	_, found, err := tree.ndb.getFastIndexRebuild()
+	if err != nil {
+		return err
+	}
+	if found {
+		tree.setSkipFastStorageUpgrade(true)
+		tree.startFastStorageRebuild()
+		return nil
+	}
+	return tree.upgradeFastStorageOnLoad()
+}
+
+// upgradeFastStorageOnLoad upgrades the fast storage if needed, or returns a
+// MigrationRequiredError for it with Options.StrictLoad.
+func (tree *MutableTree) upgradeFastStorageOnLoad() error {
+	if !tree.ndb.opts.StrictLoad {
+		_, err := tree.enableFastStorageAndCommitIfNotEnabled()
+		return err
+	}
+	upgradeable, err := tree.IsUpgradeable()
+	if err != nil || !upgradeable {
+		return err
+	}
+	if !tree.ndb.hasUpgradedToFastStorage() {
+		return &MigrationRequiredError{Migration: fmt.Sprintf("fast storage upgrade from storage version %s", tree.ndb.getStorageVersion())}
+	}
+	return &MigrationRequiredError{Migration: fmt.Sprintf("fast node index rebuild, the index is at storage version %s", tree.ndb.getStorageVersion())}
+}
+
+// checkInitialVersion returns an error if versions exist below the configured initial version,
+// unless the initial version was raised to it by MigrateInitialVersion.
+func (tree *MutableTree) checkInitialVersion(firstVersion int64) error {
+	initialVersion := tree.ndb.opts.InitialVersion
+	if firstVersion == 0 || firstVersion >= int64(initialVersion) {
+		return nil
+	}
+	migratedVersion, err := tree.ndb.getMigratedInitialVersion()
+	if err != nil {
+		return err
+	}
+	if migratedVersion >= initialVersion {
+		return nil
+	}
+	return fmt.Errorf("initial version set to %v, but found earlier version %v", initialVersion, firstVersion)
+}
+
 // loadVersionForOverwriting attempts to load a tree at a previously committed
 // version, or the latest version below it. Any versions greater than targetVersion will be deleted.
+//
+// If the fast node index was synced with the deleted latest version, only the fast nodes of the
+// keys changed by the deleted versions are reconciled with targetVersion, i.e. those whose
+// versionLastUpdatedAt exceeds it and those removed since, otherwise the index is rebuilt.
 func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) error {
-	if _, err := tree.LoadVersion(targetVersion); err != nil {
+	return tree.LoadVersionForOverwritingWithOptions(context.Background(), targetVersion, RollbackOptions{})
+}
+
+// RollbackOptions configures the deletion of versions by LoadVersionForOverwritingWithOptions and
+// DeleteVersionsFromWithOptions, e.g. for deep rollbacks, which can take hours.
+type RollbackOptions struct {
+	// ChunkSize commits the deletion every ChunkSize deleted nodes, so a stopped or interrupted
+	// deletion keeps its progress. Zero commits it once, at the end.
+	ChunkSize int
+
+	// MaxDeletesPerSec limits the average rate of the node deletions, so the deletion doesn't
+	// starve the other users of the database. Zero means no limit.
+	MaxDeletesPerSec int64
+}
+
+// LoadVersionForOverwritingWithOptions is like LoadVersionForOverwriting, but deletes the newer
+// versions in chunks and within the rate limit of the options, and stops when ctx is done. The
+// versions are deleted from the latest one down, so a stopped or interrupted deletion leaves a
+// valid latest version behind, and it is resumed by calling it again with the same targetVersion.
+func (tree *MutableTree) LoadVersionForOverwritingWithOptions(ctx context.Context, targetVersion int64, opts RollbackOptions) error {
+	if err := tree.loadVersionForOverwriting(ctx, targetVersion, opts); err != nil {
+		return err
+	}
+	tree.shadowLoad(targetVersion, true)
+	return tree.writeChangelogRollback(targetVersion)
+}
+
+// rollbackTo deletes the versions after the given one and loads it, like LoadVersionForOverwriting,
+// but the version may be zero, e.g. to drop the first version, and the tree is then empty.
+func (tree *MutableTree) rollbackTo(version int64) error {
+	if version > 0 {
+		return tree.LoadVersionForOverwriting(version)
+	}
+	if err := tree.DeleteVersionsFrom(1); err != nil {
 		return err
 	}
+	// loading an empty tree keeps the loaded one, so the tree is reset to an empty one first
+	tree.ndb.resetFirstVersion(0)
+	head := &ImmutableTree{ndb: tree.ndb, skipFastStorageUpgrade: tree.skipFastStorageUpgrade}
+	tree.ImmutableTree = head
+	tree.lastSaved = head.clone()
+	tree.unsavedChanges = nil
+	tree.unsavedUserBytes = 0
+	_, err := tree.Load()
+	return err
+}
 
-	if err := tree.ndb.DeleteVersionsFrom(targetVersion + 1); err != nil {
+func (tree *MutableTree) loadVersionForOverwriting(ctx context.Context, targetVersion int64, opts RollbackOptions) error {
+	if _, err := tree.loadVersion(targetVersion); err != nil {
+		return err
+	}
+
+	driftedKeys, err := tree.fastNodeDrift(targetVersion)
+	if err != nil {
+		return err
+	}
+
+	if err := tree.ndb.deleteVersionsFrom(ctx, targetVersion+1, opts); err != nil {
 		return err
 	}
 
@@ -531,16 +1106,81 @@ func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) error {
 		return err
 	}
 
-	if !tree.skipFastStorageUpgrade {
+	if driftedKeys != nil {
+		if err := tree.reconcileFastNodes(driftedKeys); err != nil {
+			return err
+		}
+	} else if !tree.skipFastStorageUpgrade {
 		// it'll repopulates the fast node index because of version mismatch.
 		if _, err := tree.enableFastStorageAndCommitIfNotEnabled(); err != nil {
 			return err
 		}
 	}
 
+	if tree.ndb.opts.ValueHashIndex {
+		return tree.RebuildValueHashIndex()
+	}
+
 	return nil
 }
 
+// fastNodeDrift returns the keys changed after targetVersion, whose fast nodes drift from it once
+// the later versions are deleted. It returns nil if the fast node index isn't synced with the
+// latest version, or the changes can't be extracted, e.g. from legacy nodes, so it must be
+// rebuilt instead.
+func (tree *MutableTree) fastNodeDrift(targetVersion int64) (map[string]struct{}, error) {
+	if tree.skipFastStorageUpgrade || !tree.ndb.hasUpgradedToFastStorage() {
+		return nil, nil
+	}
+	synced, latestVersion, err := tree.ndb.isFastIndexSynced()
+	if err != nil {
+		return nil, err
+	}
+	if !synced || latestVersion <= targetVersion {
+		return nil, nil
+	}
+
+	keys := make(map[string]struct{})
+	if err := tree.ndb.traverseStateChanges(targetVersion+1, latestVersion, func(_ int64, changeSet *ChangeSet) error {
+		for _, pair := range changeSet.Pairs {
+			keys[string(pair.Key)] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		tree.logger.Debug("rebuilding the fast node index", "err", err)
+		return nil, nil
+	}
+	return keys, nil
+}
+
+// reconcileFastNodes sets the fast nodes of the keys to the loaded version, deleting those of the
+// keys it doesn't have, and marks the fast node index as synced with it.
+func (tree *MutableTree) reconcileFastNodes(keys map[string]struct{}) error {
+	for key := range keys {
+		var value []byte
+		if tree.root != nil {
+			var err error
+			if _, value, err = tree.root.get(tree.ImmutableTree, []byte(key)); err != nil {
+				return err
+			}
+		}
+		if value == nil {
+			if err := tree.ndb.DeleteFastNode([]byte(key)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tree.ndb.SaveFastNode(fastnode.NewNode([]byte(key), value, tree.version)); err != nil {
+			return err
+		}
+	}
+
+	if err := tree.ndb.SetFastStorageVersionToBatch(tree.version); err != nil {
+		return err
+	}
+	return tree.ndb.Commit()
+}
+
 // Returns true if the tree may be auto-upgraded, false otherwise
 // An example of when an upgrade may be performed is when we are enaling fast storage for the first time or
 // need to overwrite fast nodes due to mismatch with live state.
@@ -557,6 +1197,12 @@ func (tree *MutableTree) IsUpgradeable() (bool, error) {
 // from latest tree.
 
 func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error) {
+	return tree.upgradeFastStorage(nil)
+}
+
+// upgradeFastStorage is enableFastStorageAndCommitIfNotEnabled, calling progress, if not nil,
+// with the number of fast nodes written so far.
+func (tree *MutableTree) upgradeFastStorage(progress func(nodes int64)) (bool, error) {
 	isUpgradeable, err := tree.IsUpgradeable()
 	if err != nil {
 		return false, err
@@ -580,24 +1226,32 @@ func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error)
 		}
 	}
 
-	if err := tree.enableFastStorageAndCommit(); err != nil {
+	if err := tree.enableFastStorageAndCommit(progress); err != nil {
+		tree.ndb.mtx.Lock()
 		tree.ndb.storageVersion = defaultStorageVersionValue
+		tree.ndb.mtx.Unlock()
 		return false, err
 	}
 	return true, nil
 }
 
-func (tree *MutableTree) enableFastStorageAndCommit() error {
+func (tree *MutableTree) enableFastStorageAndCommit(progress func(nodes int64)) error {
 	var err error
 
-	itr := NewIterator(nil, nil, true, tree.ImmutableTree)
+	itr := NewIterator(nil, nil, true, tree.ImmutableTree.WithCacheBypass())
 	defer itr.Close()
-	var upgradedFastNodes uint64
+	var upgradedFastNodes int64
 	for ; itr.Valid(); itr.Next() {
 		upgradedFastNodes++
 		if err = tree.ndb.SaveFastNodeNoCache(fastnode.NewNode(itr.Key(), itr.Value(), tree.version)); err != nil {
 			return err
 		}
+		if progress != nil && upgradedFastNodes%migrationProgressInterval == 0 {
+			progress(upgradedFastNodes)
+		}
+	}
+	if progress != nil {
+		progress(upgradedFastNodes)
 	}
 
 	if err = itr.Error(); err != nil {
@@ -609,16 +1263,105 @@ func (tree *MutableTree) enableFastStorageAndCommit() error {
 		return err
 	}
 
+	if err = tree.ndb.setFastIndexShardsToBatch(); err != nil {
+		return err
+	}
 	if err = tree.ndb.SetFastStorageVersionToBatch(latestVersion); err != nil {
 		return err
 	}
+	// the stale fast nodes of a disabled index were deleted by the upgrade
+	if err = tree.ndb.batch.Delete(metadataKeyFormat.Key([]byte(fastIndexCleanupKey))); err != nil {
+		return err
+	}
 
 	return tree.ndb.Commit()
 }
 
+// SetFastStorageEnabled enables or disables the fast storage at runtime, overriding the
+// skipFastStorageUpgrade flag given at construction. The tree must not have uncommitted changes.
+//
+// Disabling drops the unsaved fast node changes, marks the storage as not upgraded and deletes
+// the persisted fast nodes in the background, stopping a running rebuild first.
+//
+// Enabling waits for a pending deletion, then rebuilds the fast node index in the background from
+// the latest saved version, in chunks which persist the progress, so a rebuild interrupted by a
+// restart is resumed when the tree is loaded with the fast storage, or enabled again. The reads
+// stay on the tree until the index is rebuilt, and SaveVersion switches them to the index once it
+// is, after applying the changes of the versions saved during the rebuild.
+func (tree *MutableTree) SetFastStorageEnabled(enabled bool) error {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+
+	rebuilding := tree.fastStorageRebuild != nil
+	if enabled == (!tree.skipFastStorageUpgrade || rebuilding) {
+		return nil
+	}
+	if tree.root != nil && tree.root.nodeKey == nil {
+		return errors.New("cannot toggle fast storage with uncommitted changes")
+	}
+
+	if !enabled {
+		tree.stopFastStorageRebuild()
+		done, err := tree.ndb.disableFastStorage()
+		if err != nil {
+			return err
+		}
+		tree.fastStorageCleanup = done
+		tree.setSkipFastStorageUpgrade(true)
+		tree.unsavedFastNodeAdditions = &sync.Map{}
+		tree.unsavedFastNodeRemovals = &sync.Map{}
+		return nil
+	}
+
+	if err := tree.waitFastStorageCleanup(); err != nil {
+		return err
+	}
+	shouldForce, err := tree.ndb.shouldForceFastStorageUpgrade()
+	if err != nil {
+		return err
+	}
+	if tree.ndb.hasUpgradedToFastStorage() && !shouldForce {
+		tree.setSkipFastStorageUpgrade(false)
+		return nil
+	}
+	// a rebuild interrupted by a restart is resumed
+	if _, found, err := tree.ndb.getFastIndexRebuild(); err != nil {
+		return err
+	} else if !found {
+		if err := tree.ndb.resetFastIndexRebuild(tree.version); err != nil {
+			return err
+		}
+	}
+	tree.startFastStorageRebuild()
+	return nil
+}
+
+// setSkipFastStorageUpgrade propagates the skipFastStorageUpgrade flag to the working and the
+// last saved trees.
+func (tree *MutableTree) setSkipFastStorageUpgrade(skip bool) {
+	tree.skipFastStorageUpgrade = skip
+	tree.ImmutableTree.skipFastStorageUpgrade = skip
+	tree.lastSaved.skipFastStorageUpgrade = skip
+}
+
+// waitFastStorageCleanup blocks until the background fast node deletion, if any, is finished.
+func (tree *MutableTree) waitFastStorageCleanup() error {
+	if tree.fastStorageCleanup == nil {
+		return nil
+	}
+	err := <-tree.fastStorageCleanup
+	tree.fastStorageCleanup = nil
+	return err
+}
+
 // GetImmutable loads an ImmutableTree at a given version for querying. The returned tree is
-// safe for concurrent access, provided the version is not deleted, e.g. via `DeleteVersion()`.
+// safe for concurrent access, provided the version is not deleted, e.g. via `DeleteVersion()`,
+// otherwise its reads fail with ErrTreeInvalidated.
+// GetImmutable doesn't modify the MutableTree, so historical queries can call it concurrently with
+// the writer, e.g. with SaveVersion, without blocking it on their disk reads.
 func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
+	// taken before the root is read, so a deletion in between invalidates the tree
+	generation := tree.ndb.generations.current()
 	rootNodeKey, err := tree.ndb.GetRoot(version)
 	if err != nil {
 		return nil, err
@@ -637,12 +1380,18 @@ func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
 		ndb:                    tree.ndb,
 		version:                version,
 		skipFastStorageUpgrade: tree.skipFastStorageUpgrade,
+		generation:             generation,
 	}, nil
 }
 
 // Rollback resets the working tree to the latest saved version, discarding
 // any unsaved modifications.
 func (tree *MutableTree) Rollback() {
+	if err := tree.writeIntent(IntentRollback, nil, nil); err != nil {
+		// the intents of the working version are only replayed onto the saved version, so a
+		// missing marker doesn't change the outcome of a replay
+		tree.logger.Error("failed to write the intent log", "err", err)
+	}
 	if tree.version > 0 {
 		tree.ImmutableTree = tree.lastSaved.clone()
 	} else {
@@ -656,40 +1405,56 @@ func (tree *MutableTree) Rollback() {
 		tree.unsavedFastNodeAdditions = &sync.Map{}
 		tree.unsavedFastNodeRemovals = &sync.Map{}
 	}
+	tree.unsavedChanges = nil
+	tree.unsavedUserBytes = 0
+	tree.shadowRollback()
 }
 
-// GetVersioned gets the value at the specified key and version. The returned value must not be
-// modified, since it may point to data stored within IAVL.
+// GetVersioned gets the value at the specified key and saved version, see GetAtWorkingVersion for
+// the working version. The returned value must not be modified, since it may point to data stored
+// within IAVL.
+//
+// It is safe to call concurrently with SaveVersion, and never observes the version being saved
+// half-committed: the fast node index is only consulted outside of the commits, and the reads
+// overlapping with one fall back to the nodes of the version, which are immutable once saved.
 func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error) {
-	if tree.VersionExists(version) {
-		if !tree.skipFastStorageUpgrade {
-			isFastCacheEnabled, err := tree.IsFastCacheEnabled()
-			if err != nil {
-				return nil, err
-			}
+	if tree.ndb.opts.AccessHook != nil {
+		tree.ndb.opts.AccessHook(AccessGet, key, version)
+	}
+	if !tree.VersionExists(version) {
+		return nil, nil
+	}
+	if !tree.skipFastStorageUpgrade {
+		// only the nodeDB is read, not the working tree, which SaveVersion replaces concurrently
+		value, ok, err := tree.ndb.getFastValue(key, version, true)
+		if err != nil || ok {
+			return value, err
+		}
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, nil
+	}
+	value, err := t.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
 
-			if isFastCacheEnabled {
-				fastNode, _ := tree.ndb.GetFastNode(key)
-				if fastNode == nil && version == tree.ndb.latestVersion {
-					return nil, nil
-				}
+// NodeCacheStats returns the limit, usage and lookup counters of the node cache, and false if the
+// adaptive cache is not enabled, see AdaptiveCacheOption.
+func (tree *MutableTree) NodeCacheStats() (cache.AdaptiveStats, bool) {
+	return tree.ndb.nodeCacheStats()
+}
 
-				if fastNode != nil && fastNode.GetVersionLastUpdatedAt() <= version {
-					return fastNode.GetValue(), nil
-				}
-			}
-		}
-		t, err := tree.GetImmutable(version)
-		if err != nil {
-			return nil, nil
-		}
-		value, err := t.Get(key)
-		if err != nil {
-			return nil, err
-		}
-		return value, nil
+// RootCacheStats returns the counters of the root cache, and false if it is not enabled, see
+// Options.RootCacheSize.
+func (tree *MutableTree) RootCacheStats() (RootCacheStats, bool) {
+	if tree.ndb.roots == nil {
+		return RootCacheStats{}, false
 	}
-	return nil, nil
+	return tree.ndb.roots.stats(), true
 }
 
 // SetCommitting sets a flag to indicate that the tree is in the process of being saved.
@@ -705,9 +1470,73 @@ func (tree *MutableTree) UnsetCommitting() {
 
 // SaveVersion saves a new tree version to disk, based on the current state of
 // the tree. Returns the hash and new version number.
+// The final write is synchronous if Options.Sync is set.
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
+	return tree.saveVersion(tree.ndb.opts.Sync, &SaveVersionStats{})
+}
+
+// SaveVersionSync is like SaveVersion, but always flushes the final write to durable storage
+// (e.g. with fsync) regardless of Options.Sync. It lets operators trade durability for latency per
+// commit, e.g. syncing only every Nth version.
+func (tree *MutableTree) SaveVersionSync() ([]byte, int64, error) {
+	return tree.saveVersion(true, &SaveVersionStats{})
+}
+
+// SaveVersionStats is the breakdown of the time and writes of a saved version, see
+// SaveVersionDetailed.
+type SaveVersionStats struct {
+	// Hashing is the time spent hashing the new nodes, the ones not hashed already, e.g. by
+	// WorkingHash.
+	Hashing time.Duration
+	// Serialization is the time spent encoding the new nodes and adding them to the batch.
+	Serialization time.Duration
+	// FastNodes is the time spent adding the fast node changes to the batch, or handing them to
+	// the background writer with Options.AsyncFastNodeWrites.
+	FastNodes time.Duration
+	// BatchWrite is the time spent writing the batch to the database.
+	BatchWrite time.Duration
+	// Commit is the time of the whole SaveVersionDetailed call, including pruning.
+	Commit time.Duration
+	// NodesWritten and BytesWritten are the number and encoded size of the nodes written.
+	NodesWritten int
+	BytesWritten int64
+	// UserBytes is the size of the keys and values set, and of the keys removed, since the
+	// previous version, counting every change of a key.
+	UserBytes int64
+}
+
+// WriteAmplification returns the ratio of the bytes of the nodes written to the bytes of the keys
+// and values changed by the user, e.g. to guide the design of the keys or the externalization of
+// large values, or 0 if nothing was changed.
+func (s SaveVersionStats) WriteAmplification() float64 {
+	if s.UserBytes == 0 {
+		return 0
+	}
+	return float64(s.BytesWritten) / float64(s.UserBytes)
+}
+
+// SaveVersionDetailed is like SaveVersion, but also returns the breakdown of the time spent in the
+// phases of the commit, and of the nodes written, so operators can tell whether the commit latency
+// is CPU bound, i.e. mostly hashing and serialization, or IO bound, i.e. mostly batch writes,
+// without profiling in production.
+func (tree *MutableTree) SaveVersionDetailed() ([]byte, int64, SaveVersionStats, error) {
+	var stats SaveVersionStats
+	hash, version, err := tree.saveVersion(tree.ndb.opts.Sync, &stats)
+	return hash, version, stats, err
+}
+
+func (tree *MutableTree) saveVersion(syncWrite bool, stats *SaveVersionStats) ([]byte, int64, error) {
+	if tree.closed {
+		return nil, 0, ErrTreeClosed
+	}
+	defer tree.ndb.latency.observe(LatencySaveVersion, tree.ndb.latency.startTimer())
+	defer func(start time.Time) { stats.Commit = time.Since(start) }(time.Now())
 	version := tree.WorkingVersion()
 
+	if err := tree.ndb.waitFastNodeWrites(); err != nil {
+		return nil, version, fmt.Errorf("failed to write the fast nodes of the previous version: %w", err)
+	}
+
 	if tree.VersionExists(version) {
 		// If the version already exists, return an error as we're attempting to overwrite.
 		// However, the same hash means idempotent (i.e. no-op).
@@ -730,6 +1559,7 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 			tree.root = existingRoot
 			tree.ImmutableTree = tree.ImmutableTree.clone()
 			tree.lastSaved = tree.ImmutableTree.clone()
+			tree.shadowSave(version, newHash)
 			return newHash, version, nil
 		}
 
@@ -738,13 +1568,30 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 
 	tree.logger.Debug("SAVE TREE", "version", version)
 
+	// the readers of the fast node index fall back to the nodes until the new latest version is set
+	tree.ndb.beginCommit()
+	committing := true
+	defer func() {
+		if committing {
+			tree.ndb.endCommit()
+		}
+	}()
+
 	// save new fast nodes
-	if !tree.skipFastStorageUpgrade {
+	// the fast nodes in shards are written after the version, see Options.FastIndexShards
+	shardedFastNodeWrites := !tree.skipFastStorageUpgrade && len(tree.ndb.opts.FastIndexShards) > 0
+	asyncFastNodeWrites := !tree.skipFastStorageUpgrade && tree.ndb.opts.AsyncFastNodeWrites
+	if !tree.skipFastStorageUpgrade && !asyncFastNodeWrites && !shardedFastNodeWrites {
+		start := time.Now()
 		if err := tree.saveFastNodeVersion(version); err != nil {
 			return nil, version, err
 		}
+		stats.FastNodes = time.Since(start)
 	}
 	// save new nodes
+	if err := tree.ndb.setKeyPrefixesToBatch(); err != nil {
+		return nil, version, err
+	}
 	if tree.root == nil {
 		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
 			return nil, 0, err
@@ -760,24 +1607,79 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 				// it will update the legacy node to the new format
 				// which ensures the reference node is not a legacy node
 				tree.root.isLegacy = false
-				if err := tree.ndb.SaveNode(tree.root); err != nil {
+				size, err := tree.ndb.saveNode(tree.root)
+				if err != nil {
 					return nil, 0, fmt.Errorf("failed to save the reference legacy node: %w", err)
 				}
+				stats.NodesWritten++
+				stats.BytesWritten += int64(size)
 			}
 		} else {
-			if err := tree.saveNewNodes(version); err != nil {
+			if err := tree.saveNewNodes(version, stats); err != nil {
 				return nil, 0, err
 			}
 		}
 	}
 
-	if err := tree.ndb.Commit(); err != nil {
+	if err := tree.updateValueHashIndex(); err != nil {
+		return nil, version, err
+	}
+	if err := tree.updateChainedHash(version, tree.WorkingHash()); err != nil {
+		return nil, version, err
+	}
+	if err := tree.ndb.setVersionSizeToBatch(version, tree.Size(), tree.lastSaved.Size()); err != nil {
+		return nil, version, err
+	}
+	if err := tree.ndb.setVersionTimeToBatch(version); err != nil {
+		return nil, version, err
+	}
+	if err := tree.ndb.setBalanceSlackToBatch(); err != nil {
 		return nil, version, err
 	}
+	if err := tree.ndb.setCommitMarkerToBatch(version); err != nil {
+		return nil, version, err
+	}
+
+	// the changelog record is written ahead of the commit, so a committed version is never missing
+	// from it, and its commit marker after it
+	if err := tree.writeChangelog(version, tree.WorkingHash()); err != nil {
+		return nil, version, err
+	}
+
+	start := time.Now()
+	if err := tree.ndb.commit(syncWrite); err != nil {
+		return nil, version, err
+	}
+	stats.BatchWrite = time.Since(start)
+	stats.UserBytes = tree.unsavedUserBytes
+	tree.ndb.opts.Stat.AddBytesWritten(stats.UserBytes, stats.BytesWritten)
+	if err := tree.writeIntent(IntentCommit, nil, nil); err != nil {
+		// the version is saved, and its intents are ignored by a replay onto it
+		tree.logger.Error("failed to write the intent log", "err", err)
+	}
+	if err := tree.writeChangelogCommit(version); err != nil {
+		// the version is saved, and a replay fails at the gap it leaves in the changelog
+		tree.logger.Error("failed to write the changelog commit marker", "version", version, "err", err)
+	}
 
 	tree.ndb.resetLatestVersion(version)
+	tree.ndb.endCommit()
+	committing = false
 	tree.version = version
 
+	if asyncFastNodeWrites || shardedFastNodeWrites {
+		start := time.Now()
+		if err := tree.ndb.writeFastNodesAsync(version, tree.getUnsavedFastNodeAdditions(), tree.getUnsavedFastNodeRemovals()); err != nil {
+			return nil, version, err
+		}
+		if !asyncFastNodeWrites {
+			if err := tree.ndb.waitFastNodeWrites(); err != nil {
+				return nil, version, err
+			}
+		}
+		stats.FastNodes = time.Since(start)
+	}
+
 	// set new working tree
 	tree.ImmutableTree = tree.ImmutableTree.clone()
 	tree.lastSaved = tree.ImmutableTree.clone()
@@ -785,10 +1687,40 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 		tree.unsavedFastNodeAdditions = &sync.Map{}
 		tree.unsavedFastNodeRemovals = &sync.Map{}
 	}
+	tree.unsavedChanges = nil
+	tree.unsavedUserBytes = 0
+	if err := tree.finishFastStorageRebuild(false); err != nil {
+		// the reads stay on the tree, and the rebuild is resumed on load
+		tree.logger.Error("failed to finish the fast node index rebuild", "err", err)
+	}
 
+	if err := tree.maybePrune(version); err != nil {
+		return nil, version, fmt.Errorf("failed to prune after version %d: %w", version, err)
+	}
+
+	tree.shadowSave(version, tree.Hash())
 	return tree.Hash(), version, nil
 }
 
+// SaveEmptyVersion saves a new tree version which points at the root of the last saved version,
+// without writing any new nodes. It is meant for chains which must advance the version on every
+// block even when no writes occurred. Returns ErrUnsavedChanges if the working tree has been
+// modified since the last save.
+func (tree *MutableTree) SaveEmptyVersion() ([]byte, int64, error) {
+	if tree.hasUnsavedChanges() {
+		return nil, tree.WorkingVersion(), ErrUnsavedChanges
+	}
+	return tree.SaveVersion()
+}
+
+// hasUnsavedChanges returns true if the working tree differs from the last saved version.
+func (tree *MutableTree) hasUnsavedChanges() bool {
+	if tree.root == nil {
+		return tree.lastSaved.root != nil
+	}
+	return tree.root.nodeKey == nil
+}
+
 func (tree *MutableTree) saveFastNodeVersion(latestVersion int64) error {
 	if err := tree.saveFastNodeAdditions(); err != nil {
 		return err
@@ -821,9 +1753,9 @@ func (tree *MutableTree) getUnsavedFastNodeRemovals() map[string]interface{} {
 
 // addUnsavedAddition stores an addition into the unsaved additions map
 func (tree *MutableTree) addUnsavedAddition(key []byte, node *fastnode.Node) {
-	skey := ibytes.UnsafeBytesToStr(key)
-	tree.unsavedFastNodeRemovals.Delete(skey)
-	tree.unsavedFastNodeAdditions.Store(skey, node)
+	tree.unsavedFastNodeRemovals.Delete(ibytes.UnsafeBytesToStr(key))
+	// the key is copied, since the caller may reuse its buffer
+	tree.unsavedFastNodeAdditions.Store(tree.fastNodeKeys.Copy(key), node)
 }
 
 func (tree *MutableTree) saveFastNodeAdditions() error {
@@ -845,9 +1777,9 @@ func (tree *MutableTree) saveFastNodeAdditions() error {
 
 // addUnsavedRemoval adds a removal to the unsaved removals map
 func (tree *MutableTree) addUnsavedRemoval(key []byte) {
-	skey := ibytes.UnsafeBytesToStr(key)
-	tree.unsavedFastNodeAdditions.Delete(skey)
-	tree.unsavedFastNodeRemovals.Store(skey, true)
+	tree.unsavedFastNodeAdditions.Delete(ibytes.UnsafeBytesToStr(key))
+	// the key is copied, since the caller may reuse its buffer
+	tree.unsavedFastNodeRemovals.Store(tree.fastNodeKeys.Copy(key), true)
 }
 
 func (tree *MutableTree) saveFastNodeRemovals() error {
@@ -873,9 +1805,75 @@ func (tree *MutableTree) SetInitialVersion(version uint64) {
 	tree.ndb.opts.InitialVersion = version
 }
 
+// MigrateInitialVersion raises the initial version of an existing tree, for chain upgrades which
+// adopt a new height offset. The next SaveVersion() call saves newInitial, and the versions between
+// the latest version and newInitial are skipped, i.e. neither stored nor available, while existing
+// versions and their hashes are left untouched. Only the skipped range is recorded, with the new
+// initial version and in a single batch, so LoadVersion() accepts the earlier versions once the
+// tree is opened with InitialVersion set to newInitial. A rollback before the latest version
+// removes the skipped range, and a tree only records one, so the versions before an earlier
+// migration must be pruned before the initial version is raised again.
+func (tree *MutableTree) MigrateInitialVersion(newInitial uint64) error {
+	if newInitial <= tree.ndb.opts.InitialVersion {
+		return fmt.Errorf("initial version can only be raised, current %d, requested %d", tree.ndb.opts.InitialVersion, newInitial)
+	}
+	if tree.hasUnsavedChanges() {
+		return ErrUnsavedChanges
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if int64(newInitial) <= latestVersion {
+		return fmt.Errorf("cannot migrate initial version to %d, version %d already exists", newInitial, latestVersion)
+	}
+	if tree.version != latestVersion {
+		return fmt.Errorf("tree must be loaded at the latest version %d, got %d", latestVersion, tree.version)
+	}
+
+	skip := latestVersion > 0 && int64(newInitial) > latestVersion+1
+	if skip {
+		legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+		if err != nil {
+			return err
+		}
+		if latestVersion <= legacyLatestVersion {
+			return fmt.Errorf("the latest version %d is in the legacy format, a version must be saved before migrating", latestVersion)
+		}
+		firstVersion, err := tree.ndb.getFirstVersion()
+		if err != nil {
+			return err
+		}
+		tree.ndb.mtx.Lock()
+		gapFrom := tree.ndb.gapFrom
+		tree.ndb.mtx.Unlock()
+		if gapFrom > 0 && gapFrom != latestVersion && firstVersion <= gapFrom {
+			return fmt.Errorf("versions after %d are skipped by an earlier migration, versions up to %d must be pruned first", gapFrom, gapFrom)
+		}
+		if err := tree.ndb.setVersionGapToBatch(latestVersion); err != nil {
+			return err
+		}
+	}
+	if err := tree.ndb.setMigratedInitialVersionToBatch(newInitial); err != nil {
+		return err
+	}
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
+
+	if skip {
+		tree.ndb.resetVersionGap(latestVersion, int64(newInitial))
+	}
+	tree.ndb.opts.InitialVersion = newInitial
+	return nil
+}
+
 // DeleteVersionsTo removes versions upto the given version from the MutableTree.
 // It will not block the SaveVersion() call, instead it will be queued and executed deferred.
 func (tree *MutableTree) DeleteVersionsTo(toVersion int64) error {
+	if tree.closed {
+		return ErrTreeClosed
+	}
 	if err := tree.ndb.DeleteVersionsTo(toVersion); err != nil {
 		return err
 	}
@@ -883,14 +1881,39 @@ func (tree *MutableTree) DeleteVersionsTo(toVersion int64) error {
 	return tree.ndb.Commit()
 }
 
+// IterateOrphans calls fn with the nodes which are deleted along with the given version, the
+// nodes of the version which are not in the next one, e.g. to inspect what pruning the version
+// removes. The nodes must not be modified, and with Options.NodePool, they are only valid during
+// the call of fn. It fails for the latest version, which can't be deleted.
+func (tree *MutableTree) IterateOrphans(version int64, fn func(*Node) error) error {
+	return tree.ndb.IterateOrphans(version, fn)
+}
+
+// IterateNodesAtVersion calls fn with the nodes created by the version, the unit of pruning, along
+// with the bytes of their database records, e.g. to attribute the disk usage to the versions. See
+// nodeDB.IterateNodesAtVersion.
+func (tree *MutableTree) IterateNodesAtVersion(version int64, fn func(node *Node, storedBytes int) error) error {
+	return tree.ndb.IterateNodesAtVersion(version, fn)
+}
+
 // DeleteVersionsFrom removes from the given version upwards from the MutableTree.
 // It will not block the SaveVersion() call, instead it will be queued and executed deferred.
 func (tree *MutableTree) DeleteVersionsFrom(fromVersion int64) error {
-	if err := tree.ndb.DeleteVersionsFrom(fromVersion); err != nil {
+	return tree.DeleteVersionsFromWithOptions(context.Background(), fromVersion, RollbackOptions{})
+}
+
+// DeleteVersionsFromWithOptions is like DeleteVersionsFrom, but deletes the versions in chunks and
+// within the rate limit of the options, and stops when ctx is done, like
+// LoadVersionForOverwritingWithOptions.
+func (tree *MutableTree) DeleteVersionsFromWithOptions(ctx context.Context, fromVersion int64, opts RollbackOptions) error {
+	if err := tree.ndb.deleteVersionsFrom(ctx, fromVersion, opts); err != nil {
 		return err
 	}
 
-	return tree.ndb.Commit()
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
+	return tree.writeChangelogRollback(max(fromVersion-1, 0))
 }
 
 // Rotate right and return the new node and orphan.
@@ -964,7 +1987,8 @@ func (tree *MutableTree) balance(node *Node) (newSelf *Node, err error) {
 		return nil, err
 	}
 
-	if balance > 1 {
+	slack := tree.ndb.opts.balanceSlack()
+	if balance > slack {
 		lftBalance, err := node.leftNode.calcBalance(tree.ImmutableTree)
 		if err != nil {
 			return nil, err
@@ -992,7 +2016,7 @@ func (tree *MutableTree) balance(node *Node) (newSelf *Node, err error) {
 
 		return newNode, nil
 	}
-	if balance < -1 {
+	if balance < -slack {
 		rightNode, err := node.getRightNode(tree.ImmutableTree)
 		if err != nil {
 			return nil, err
@@ -1029,7 +2053,12 @@ func (tree *MutableTree) balance(node *Node) (newSelf *Node, err error) {
 // saveNewNodes save new created nodes by the changes of the working tree.
 // NOTE: This function clears leftNode/rigthNode recursively and
 // calls _hash() on the given node.
-func (tree *MutableTree) saveNewNodes(version int64) error {
+//
+// The nonces are assigned in pre-order, so the root gets nonce 1, see GetRootKey, and the new
+// nodes of every subtree get a contiguous range of node keys within the version. The keys can't
+// be collocated across versions: the version prefix is what the root lookup, the orphan checks of
+// pruning and the range deletes of DeleteVersionsFrom rely on.
+func (tree *MutableTree) saveNewNodes(version int64, stats *SaveVersionStats) error {
 	nonce := uint32(0)
 	newNodes := make([]*Node, 0)
 	var recursiveAssignKey func(*Node) ([]byte, error)
@@ -1062,16 +2091,23 @@ func (tree *MutableTree) saveNewNodes(version int64) error {
 		return node.nodeKey.GetKey(), nil
 	}
 
+	start := time.Now()
 	if _, err := recursiveAssignKey(tree.root); err != nil {
 		return err
 	}
+	stats.Hashing = time.Since(start)
 
+	start = time.Now()
 	for _, node := range newNodes {
-		if err := tree.ndb.SaveNode(node); err != nil {
+		size, err := tree.ndb.saveNode(node)
+		if err != nil {
 			return err
 		}
+		stats.BytesWritten += int64(size)
 		node.leftNode, node.rightNode = nil, nil
 	}
+	stats.NodesWritten += len(newNodes)
+	stats.Serialization = time.Since(start)
 
 	return nil
 }
@@ -1102,12 +2138,49 @@ func (tree *MutableTree) SaveChangeSet(cs *ChangeSet) (int64, error) {
 	return version, err
 }
 
-// Close closes the tree.
+// Flush writes the pending batch of the tree to disk, e.g. the deletions of a prune, and waits for
+// its async fast node writes, without saving a version.
+func (tree *MutableTree) Flush() error {
+	if tree.closed {
+		return ErrTreeClosed
+	}
+	if err := tree.ndb.waitFastNodeWrites(); err != nil {
+		return err
+	}
+	return tree.ndb.Commit()
+}
+
+// Close stops the background jobs of the tree, i.e. the async pruning, fast node writes and fast
+// node deletion, then flushes its pending batch and releases its caches. The unsaved changes of
+// the working tree are discarded. The tree must not be used after it was closed, its writes fail
+// with ErrTreeClosed. Closing a closed tree is a no-op.
 func (tree *MutableTree) Close() error {
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 
+	if tree.closed {
+		return nil
+	}
+	tree.closed = true
 	tree.ImmutableTree = nil
 	tree.lastSaved = nil
-	return tree.ndb.Close()
+	tree.unsavedFastNodeAdditions = &sync.Map{}
+	tree.unsavedFastNodeRemovals = &sync.Map{}
+	tree.fastNodeKeys = ibytes.StringArena{}
+	tree.unsavedChanges = nil
+	tree.unsavedUserBytes = 0
+	if tree.shadow != nil {
+		if err := tree.shadow.Close(); err != nil {
+			tree.logger.Error("failed to close the shadow tree", "err", err)
+		}
+		tree.shadow = nil
+	}
+	tree.stopFastStorageRebuild()
+	if err := tree.ndb.Close(); err != nil {
+		return err
+	}
+	if err := tree.waitFastStorageCleanup(); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
 }
@@ -2,14 +2,27 @@ package iavl
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	corestore "cosmossdk.io/core/store"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	gomock "go.uber.org/mock/gomock"
@@ -19,6 +32,7 @@ import (
 	"github.com/cosmos/iavl/internal/encoding"
 	iavlrand "github.com/cosmos/iavl/internal/rand"
 	"github.com/cosmos/iavl/mock"
+	"github.com/cosmos/iavl/verify"
 )
 
 var (
@@ -408,6 +422,65 @@ func TestMutableTree_GetVersioned(t *testing.T) {
 	checkGetVersioned(t, tree, 3, []byte{1}, nil)
 }
 
+func TestMutableTree_GetAtWorkingVersion(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipFastStorageUpgrade=%v", skipFastStorageUpgrade), func(t *testing.T) {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger())
+			for _, key := range []string{"a", "b", "c"} {
+				_, err := tree.Set([]byte(key), []byte(key+"1"))
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			_, err = tree.Set([]byte("a"), []byte("a2"))
+			require.NoError(t, err)
+			_, _, err = tree.Remove([]byte("b"))
+			require.NoError(t, err)
+			_, err = tree.Set([]byte("d"), []byte("d2"))
+			require.NoError(t, err)
+
+			expected := map[string][]byte{"a": []byte("a2"), "b": nil, "c": []byte("c1"), "d": []byte("d2"), "e": nil}
+			for key, value := range expected {
+				got, err := tree.GetAtWorkingVersion([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, value, got, key)
+				// the working version isn't saved
+				got, err = tree.GetVersioned([]byte(key), tree.WorkingVersion())
+				require.NoError(t, err)
+				require.Nil(t, got)
+			}
+
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			for key, value := range expected {
+				got, err := tree.GetAtWorkingVersion([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, value, got, key)
+			}
+
+			// stale fast nodes, unlike Get, don't affect it
+			_, err = tree.Set([]byte("a"), []byte("a3"))
+			require.NoError(t, err)
+			for _, key := range []string{"a", "c", "e"} {
+				require.NoError(t, tree.ndb.SaveFastNode(fastnode.NewNode([]byte(key), []byte("stale"), tree.Version())))
+			}
+			require.NoError(t, tree.ndb.Commit())
+			expected = map[string][]byte{"a": []byte("a3"), "b": nil, "c": []byte("c1"), "d": []byte("d2"), "e": nil}
+			for key, value := range expected {
+				got, err := tree.GetAtWorkingVersion([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, value, got, key)
+			}
+			if !skipFastStorageUpgrade {
+				got, err := tree.Get([]byte("c"))
+				require.NoError(t, err)
+				require.Equal(t, []byte("stale"), got)
+			}
+		})
+	}
+}
+
 func TestMutableTree_DeleteVersion(t *testing.T) {
 	tree := prepareTree(t)
 	ver, err := tree.LoadVersion(2)
@@ -825,6 +898,8 @@ func TestUpgradeStorageToFast_DbErrorConstructor_Failure(t *testing.T) {
 
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, expectedError).Times(1)
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(commitVersionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(keyPrefixesKey))).Return(nil, nil).AnyTimes()
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
 
 	tree := NewMutableTree(dbMock, 0, false, NewNopLogger())
@@ -851,6 +926,8 @@ func TestUpgradeStorageToFast_DbErrorEnableFastStorage_Failure(t *testing.T) {
 
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(batchMock).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(commitVersionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(keyPrefixesKey))).Return(nil, nil).AnyTimes()
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1)
 
 	iterMock := mock.NewMockIterator(ctrl)
@@ -899,7 +976,10 @@ func TestFastStorageReUpgradeProtection_NoForceUpgrade_Success(t *testing.T) {
 	batchMock := mock.NewMockBatch(ctrl)
 
 	dbMock.EXPECT().Get(gomock.Any()).Return(expectedStorageVersion, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(fastIndexShardsKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(batchMock).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(commitVersionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(keyPrefixesKey))).Return(nil, nil).AnyTimes()
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1) // called to get latest version
 
 	tree := NewMutableTree(dbMock, 0, false, NewNopLogger())
@@ -946,8 +1026,11 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 
 	// dbMock represents the underlying database under the hood of nodeDB
 	dbMock.EXPECT().Get(gomock.Any()).Return(expectedStorageVersion, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(fastIndexShardsKey))).Return(nil, nil).Times(1)
 
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(batchMock).Times(2)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(commitVersionKey))).Return(nil, nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(keyPrefixesKey))).Return(nil, nil).AnyTimes()
 	dbMock.EXPECT().ReverseIterator(gomock.Any(), gomock.Any()).Return(rIterMock, nil).Times(1) // called to get latest version
 	startFormat := fastKeyFormat.Key()
 	endFormat := fastKeyFormat.Key()
@@ -966,9 +1049,10 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 	updatedExpectedStorageVersion := make([]byte, len(expectedStorageVersion))
 	copy(updatedExpectedStorageVersion, expectedStorageVersion)
 	updatedExpectedStorageVersion[len(updatedExpectedStorageVersion)-1]++
-	batchMock.EXPECT().GetByteSize().Return(100, nil).Times(2)
+	batchMock.EXPECT().GetByteSize().Return(100, nil).Times(3)
 	batchMock.EXPECT().Delete(fastKeyFormat.Key(fastNodeKeyToDelete)).Return(nil).Times(1)
 	batchMock.EXPECT().Set(metadataKeyFormat.Key([]byte(storageVersionKey)), updatedExpectedStorageVersion).Return(nil).Times(1)
+	batchMock.EXPECT().Delete(metadataKeyFormat.Key([]byte(fastIndexCleanupKey))).Return(nil).Times(1)
 	batchMock.EXPECT().Write().Return(nil).Times(1)
 	batchMock.EXPECT().Close().Return(nil).Times(1)
 
@@ -1479,3 +1563,2344 @@ func TestMutableTreeClose(t *testing.T) {
 
 	require.NoError(t, tree.Close())
 }
+
+func TestMutableTreeClose_AsyncPruning(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), AsyncPruningOption(true))
+	for v := 0; v < 10; v++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", v)), []byte("value"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(5))
+
+	// a pending write of the batch is flushed by Flush, and Close, with the pruning running
+	key := metadataKeyFormat.Key([]byte("flushed"))
+	require.NoError(t, tree.ndb.batch.Set(key, []byte{1}))
+	require.NoError(t, tree.Flush())
+	bz, err := db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, bz)
+	require.NoError(t, tree.ndb.batch.Delete(key))
+	require.NoError(t, tree.Close())
+	bz, err = db.Get(key)
+	require.NoError(t, err)
+	require.Nil(t, bz)
+
+	require.NoError(t, tree.Close())
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.ErrorIs(t, err, ErrTreeClosed)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, ErrTreeClosed)
+	require.ErrorIs(t, tree.Flush(), ErrTreeClosed)
+
+	reopened := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reopened.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, version)
+	value, err := reopened.Get([]byte("key-9"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
+
+func TestMutableTree_SetFastStorageEnabled(t *testing.T) {
+	tree := setupMutableTree(false)
+	_, err := tree.Load()
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("val-%02d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	countFastNodes := func() int {
+		count := 0
+		require.NoError(t, tree.ndb.traverseFastNodes(func(_, _ []byte) error {
+			count++
+			return nil
+		}))
+		return count
+	}
+	require.Equal(t, 50, countFastNodes())
+
+	// uncommitted changes prevent the toggle
+	_, err = tree.Set([]byte("key-50"), []byte("val-50"))
+	require.NoError(t, err)
+	require.Error(t, tree.SetFastStorageEnabled(false))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.NoError(t, tree.SetFastStorageEnabled(false))
+	require.NoError(t, tree.waitFastStorageCleanup())
+	require.Equal(t, 0, countFastNodes())
+	require.False(t, tree.ndb.hasUpgradedToFastStorage())
+
+	_, _, err = tree.Remove([]byte("key-00"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key-01"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 0, countFastNodes())
+
+	require.NoError(t, tree.SetFastStorageEnabled(true))
+	// the reads stay on the tree until the index is rebuilt
+	isFastCacheEnabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.False(t, isFastCacheEnabled)
+	val, err := tree.Get([]byte("key-01"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), val)
+
+	require.NoError(t, tree.finishFastStorageRebuild(true))
+	require.True(t, tree.ndb.hasUpgradedToFastStorage())
+	require.Equal(t, 50, countFastNodes())
+	_, found, err := tree.ndb.getFastIndexRebuild()
+	require.NoError(t, err)
+	require.False(t, found)
+
+	isFastCacheEnabled, err = tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, isFastCacheEnabled)
+
+	val, err = tree.Get([]byte("key-00"))
+	require.NoError(t, err)
+	require.Nil(t, val)
+	val, err = tree.Get([]byte("key-01"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), val)
+	val, err = tree.Get([]byte("key-50"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val-50"), val)
+}
+
+func TestMutableTree_SetFastStorageEnabled_ResumeAfterRestart(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+
+	const numKeys = maxBatchSize + maxBatchSize/2
+	for i := 0; i < numKeys; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%05d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// index the first chunk of keys, as a rebuild interrupted by a restart would
+	require.NoError(t, tree.ndb.resetFastIndexRebuild(1))
+	state, found, err := tree.ndb.getFastIndexRebuild()
+	require.NoError(t, err)
+	require.True(t, found)
+	require.NoError(t, tree.ndb.indexFastNodes(&state, tree.ndb.generations.current()))
+	require.Equal(t, []byte(fmt.Sprintf("key-%05d", maxBatchSize-1)), state.lastKey)
+	require.False(t, state.complete)
+
+	// the changes saved meanwhile are rolled forward into the indexed keys
+	_, err = tree.Set([]byte("key-00001"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("key-00002"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte(fmt.Sprintf("key-%05d", numKeys-1)), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.Close())
+
+	reopened := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = reopened.Load()
+	require.NoError(t, err)
+	isFastCacheEnabled, err := reopened.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.False(t, isFastCacheEnabled)
+	require.NoError(t, reopened.finishFastStorageRebuild(true))
+	isFastCacheEnabled, err = reopened.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, isFastCacheEnabled)
+
+	// the keys indexed before the restart weren't indexed again
+	node, err := reopened.ndb.GetFastNode([]byte("key-00000"))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, node.GetVersionLastUpdatedAt())
+	node, err = reopened.ndb.GetFastNode([]byte(fmt.Sprintf("key-%05d", maxBatchSize)))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, node.GetVersionLastUpdatedAt())
+
+	count := 0
+	require.NoError(t, reopened.ndb.traverseFastNodes(func(_, _ []byte) error {
+		count++
+		return nil
+	}))
+	require.Equal(t, numKeys-1, count)
+	for key, expected := range map[string][]byte{
+		"key-00001":                           []byte("updated"),
+		"key-00002":                           nil,
+		fmt.Sprintf("key-%05d", numKeys-1):    []byte("updated"),
+		fmt.Sprintf("key-%05d", maxBatchSize): []byte("value"),
+	} {
+		val, err := reopened.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, expected, val, key)
+	}
+}
+
+func TestMutableTree_SetFastStorageEnabled_ResumeCleanupAfterRestart(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.Close())
+
+	// a deletion interrupted by a restart leaves its record behind
+	require.NoError(t, db.Set(metadataKeyFormat.Key([]byte(fastIndexCleanupKey)), []byte{}))
+
+	reopened := NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = reopened.Load()
+	require.NoError(t, err)
+	require.NoError(t, reopened.waitFastStorageCleanup())
+	count := 0
+	require.NoError(t, reopened.ndb.traverseFastNodes(func(_, _ []byte) error {
+		count++
+		return nil
+	}))
+	require.Zero(t, count)
+	bz, err := db.Get(metadataKeyFormat.Key([]byte(fastIndexCleanupKey)))
+	require.NoError(t, err)
+	require.Nil(t, bz)
+}
+
+func TestMutableTree_LatestAndFirstAvailableVersion(t *testing.T) {
+	tree := setupMutableTree(false)
+
+	latest, err := tree.LatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), latest)
+	first, err := tree.FirstAvailableVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), first)
+
+	for i := 0; i < 5; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	first, err = tree.FirstAvailableVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), first)
+
+	// a fresh tree over the same db reads the markers from disk
+	reloaded := NewMutableTree(tree.ndb.db, 0, false, NewNopLogger())
+	first, err = reloaded.FirstAvailableVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), first)
+	latest, err = reloaded.LatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), latest)
+
+	require.NoError(t, tree.LoadVersionForOverwriting(4))
+	latest, err = tree.LatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), latest)
+	latest, err = tree.GetLatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), latest)
+
+	first, err = tree.FirstAvailableVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), first)
+}
+
+func TestMutableTree_GetVersionedAfterRollback(t *testing.T) {
+	tree := setupMutableTree(false)
+
+	_, err := tree.Set([]byte("a"), []byte("a1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("b1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("c"), []byte("c2"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// version 3 removes "a" and updates "b", then gets rolled back
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("b3"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	isFastCacheEnabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, isFastCacheEnabled)
+
+	require.NoError(t, tree.DeleteVersionsFrom(3))
+	require.False(t, tree.VersionExists(3))
+
+	// the fast node index still reflects the deleted version 3, so it must not be trusted
+	value, err := tree.GetVersioned([]byte("a"), 2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a1"), value)
+	value, err = tree.GetVersioned([]byte("b"), 2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b1"), value)
+	value, err = tree.GetVersioned([]byte("c"), 1)
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	// once the index is rebuilt for the rolled back lineage it is consulted again
+	_, err = tree.LoadVersion(2)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("b3'"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for version, expected := range map[int64][]string{
+		1: {"a1", "b1", ""},
+		2: {"a1", "b1", "c2"},
+		3: {"a1", "b3'", "c2"},
+	} {
+		for i, key := range []string{"a", "b", "c"} {
+			value, err := tree.GetVersioned([]byte(key), version)
+			require.NoError(t, err)
+			if expected[i] == "" {
+				require.Nil(t, value, "key %s at version %d", key, version)
+			} else {
+				require.Equal(t, []byte(expected[i]), value, "key %s at version %d", key, version)
+			}
+		}
+	}
+}
+
+func TestMutableTree_LoadVersionForOverwritingReconcilesFastNodes(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	save := func(sets map[string]string, removes ...string) {
+		for k, v := range sets {
+			_, err := tree.Set([]byte(k), []byte(v))
+			require.NoError(t, err)
+		}
+		for _, k := range removes {
+			_, _, err := tree.Remove([]byte(k))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	save(map[string]string{"a": "a1", "b": "b1", "c": "c1", "g": "g1"})
+	save(map[string]string{"b": "b2", "d": "d2"})
+	save(map[string]string{"a": "a3", "e": "e3"}, "c", "d")
+	save(map[string]string{"f": "f4"}, "b")
+
+	require.NoError(t, tree.LoadVersionForOverwriting(2))
+
+	// the fast nodes match version 2, and untouched ones weren't rewritten
+	expected := map[string]string{"a": "a1", "b": "b2", "c": "c1", "d": "d2", "g": "g1"}
+	fastNodes := map[string]string{}
+	require.NoError(t, tree.ndb.traverseFastNodes(func(k, v []byte) error {
+		node, err := fastnode.DeserializeNode(k[1:], v)
+		require.NoError(t, err)
+		fastNodes[string(node.GetKey())] = string(node.GetValue())
+		return nil
+	}))
+	require.Equal(t, expected, fastNodes)
+	node, err := tree.ndb.GetFastNode([]byte("g"))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, node.GetVersionLastUpdatedAt())
+	node, err = tree.ndb.GetFastNode([]byte("a"))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, node.GetVersionLastUpdatedAt())
+
+	synced, _, err := tree.ndb.isFastIndexSynced()
+	require.NoError(t, err)
+	require.True(t, synced)
+	for k, v := range expected {
+		value, err := tree.Get([]byte(k))
+		require.NoError(t, err)
+		require.Equal(t, v, string(value))
+	}
+	value, err := tree.Get([]byte("e"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+func TestMutableTree_SaveEmptyVersion(t *testing.T) {
+	tree := setupMutableTree(false)
+
+	// an empty tree can advance its version as well
+	hash, version, err := tree.SaveEmptyVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, tree.WorkingHash(), hash)
+
+	_, err = tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveEmptyVersion()
+	require.ErrorIs(t, err, ErrUnsavedChanges)
+
+	hash, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	rootKey, err := tree.ndb.GetRoot(version)
+	require.NoError(t, err)
+
+	for i := 3; i <= 5; i++ {
+		emptyHash, emptyVersion, err := tree.SaveEmptyVersion()
+		require.NoError(t, err)
+		require.Equal(t, int64(i), emptyVersion)
+		require.Equal(t, hash, emptyHash)
+
+		// the new version references the existing root instead of rewriting it
+		emptyRootKey, err := tree.ndb.GetRoot(emptyVersion)
+		require.NoError(t, err)
+		require.Equal(t, rootKey, emptyRootKey)
+
+		value, err := tree.GetVersioned([]byte("a"), emptyVersion)
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), value)
+	}
+
+	// removing the last key is a change as well
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveEmptyVersion()
+	require.ErrorIs(t, err, ErrUnsavedChanges)
+
+	tree.Rollback()
+	_, version, err = tree.SaveEmptyVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(6), version)
+}
+
+func TestMutableTree_MigrateInitialVersion(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	require.ErrorIs(t, tree.MigrateInitialVersion(10), ErrUnsavedChanges)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the initial version cannot collide with existing versions
+	require.Error(t, tree.MigrateInitialVersion(2))
+
+	// without a migration, raising the initial version fails to load
+	unmigrated := NewMutableTree(db, 0, false, NewNopLogger(), InitialVersionOption(10))
+	_, err = unmigrated.Load()
+	require.Error(t, err)
+
+	require.NoError(t, tree.MigrateInitialVersion(10))
+	require.Error(t, tree.MigrateInitialVersion(5))
+	require.Equal(t, int64(2), tree.Version())
+	require.Equal(t, int64(10), tree.WorkingVersion())
+	require.Equal(t, hash, tree.Hash())
+	// the skipped versions aren't stored
+	require.Equal(t, []int{1, 2}, tree.AvailableVersions())
+	require.False(t, tree.VersionExists(5))
+	value, err := tree.GetVersioned([]byte("b"), 5)
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	_, err = tree.Set([]byte("c"), []byte("3"))
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), version)
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(11), version)
+
+	// the migrated tree loads with the new initial version and can be pruned across the skipped versions
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), InitialVersionOption(10))
+	version, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(11), version)
+	require.Equal(t, []int{1, 2, 10, 11}, reloaded.AvailableVersions())
+	require.NoError(t, reloaded.DeleteVersionsTo(2))
+	value, err = reloaded.GetVersioned([]byte("b"), 10)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	value, err = reloaded.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+
+	// the first version is searched across the skipped versions
+	reloaded = NewMutableTree(db, 0, false, NewNopLogger(), InitialVersionOption(10))
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	first, err := reloaded.FirstAvailableVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), first)
+	require.Equal(t, []int{10, 11}, reloaded.AvailableVersions())
+}
+
+func TestMutableTree_MigrateInitialVersionRollback(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for _, value := range []string{"1", "2"} {
+		_, err := tree.Set([]byte("a"), []byte(value))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.MigrateInitialVersion(10))
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), version)
+
+	// a rollback to the version before the skipped ones saves the new initial version again
+	require.NoError(t, tree.LoadVersionForOverwriting(2))
+	require.Equal(t, int64(2), tree.Version())
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), version)
+
+	// a rollback before them saves the skipped versions
+	require.NoError(t, tree.LoadVersionForOverwriting(1))
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), InitialVersionOption(10))
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, reloaded.AvailableVersions())
+}
+
+func TestMutableTree_AdaptiveNodeCache(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), AdaptiveCacheOption(1<<10, 1<<20, 0))
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	stats, ok := tree.NodeCacheStats()
+	require.True(t, ok)
+	require.Equal(t, int64(1<<10), stats.LimitBytes)
+	require.LessOrEqual(t, stats.UsedBytes, stats.LimitBytes)
+	require.Positive(t, stats.UsedBytes)
+
+	// the tree stays readable with a cache far smaller than its nodes
+	reloaded := NewMutableTree(tree.ndb.db, 0, false, NewNopLogger(), AdaptiveCacheOption(1<<10, 1<<20, 0))
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		_, value, err := reloaded.ImmutableTree.GetWithIndex([]byte(fmt.Sprintf("key-%d", i)))
+		require.NoError(t, err)
+		require.NotNil(t, value)
+	}
+	stats, ok = reloaded.NodeCacheStats()
+	require.True(t, ok)
+	require.Positive(t, stats.Misses)
+
+	_, ok = setupMutableTree(false).NodeCacheStats()
+	require.False(t, ok)
+}
+
+// syncCountingDB counts the synchronous batch writes of a MemDB.
+type syncCountingDB struct {
+	*dbm.MemDB
+	syncs int
+}
+
+type syncCountingBatch struct {
+	corestore.Batch
+	db *syncCountingDB
+}
+
+func (b *syncCountingBatch) WriteSync() error {
+	b.db.syncs++
+	return b.Batch.WriteSync()
+}
+
+func (db *syncCountingDB) NewBatchWithSize(size int) corestore.Batch {
+	return &syncCountingBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+func TestMutableTree_SaveVersionSync(t *testing.T) {
+	for _, sync := range []bool{false, true} {
+		db := &syncCountingDB{MemDB: dbm.NewMemDB()}
+		tree := NewMutableTree(db, 0, true, NewNopLogger(), SyncOption(sync))
+
+		_, err := tree.Set([]byte("a"), []byte("1"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		expected := 0
+		if sync {
+			expected = 1
+		}
+		require.Equal(t, expected, db.syncs, "sync option %v", sync)
+
+		_, err = tree.Set([]byte("b"), []byte("2"))
+		require.NoError(t, err)
+		_, version, err := tree.SaveVersionSync()
+		require.NoError(t, err)
+		require.Equal(t, int64(2), version)
+		require.Equal(t, expected+1, db.syncs, "sync option %v", sync)
+	}
+}
+
+func TestMutableTree_SnapshotIterator(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// unsaved changes are part of the snapshot
+	_, err = tree.Set([]byte("k20"), []byte{20})
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("k00"))
+	require.NoError(t, err)
+
+	itr := tree.SnapshotIterator(nil, nil, true)
+	defer itr.Close()
+
+	// keep writing and saving while iterating
+	for i := 0; i < 20; i += 2 {
+		_, err = tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("updated"))
+		require.NoError(t, err)
+		_, _, err = tree.Remove([]byte(fmt.Sprintf("k%02d", i+1)))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	expected := 1
+	for ; itr.Valid(); itr.Next() {
+		require.Equal(t, []byte(fmt.Sprintf("k%02d", expected)), itr.Key())
+		require.Equal(t, []byte{byte(expected)}, itr.Value())
+		expected++
+	}
+	require.NoError(t, itr.Error())
+	require.Equal(t, 21, expected)
+}
+
+// TestMutableTree_SnapshotIteratorConcurrentSave reads a snapshot with unsaved changes while the
+// tree saves them, which assigns keys to the unsaved nodes and detaches them from their children.
+// Run with -race.
+func TestMutableTree_SnapshotIteratorConcurrentSave(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 200; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 200; i += 2 {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("unsaved"))
+		require.NoError(t, err)
+	}
+
+	itr := tree.SnapshotIterator(nil, nil, true)
+	defer itr.Close()
+	done := make(chan int)
+	go func() {
+		count := 0
+		for ; itr.Valid(); itr.Next() {
+			i := count
+			if i%2 == 0 {
+				assert.Equal(t, []byte("unsaved"), itr.Value())
+			} else {
+				assert.Equal(t, []byte{byte(i)}, itr.Value())
+			}
+			count++
+		}
+		assert.NoError(t, itr.Error())
+		done <- count
+	}()
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("k%03d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 200, <-done)
+}
+
+func TestMutableTree_AsyncFastNodeWrites(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), AsyncFastNodeWritesOption(true))
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// reads are served whether or not the write is done
+	value, err := tree.Get([]byte{3})
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, value)
+
+	_, _, err = tree.Remove([]byte{3})
+	require.NoError(t, err)
+	_, err = tree.Set([]byte{4}, []byte("new"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.NoError(t, tree.ndb.waitFastNodeWrites())
+	require.False(t, tree.ndb.fastNodeWritesPending())
+	bz, err := db.Get(tree.ndb.fastNodeKey([]byte{3}))
+	require.NoError(t, err)
+	require.Nil(t, bz)
+	fastNode, err := tree.ndb.GetFastNode([]byte{4})
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), fastNode.GetValue())
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+
+	// a write lost in a crash is reconciled on load
+	require.NoError(t, db.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(fastStorageVersionValue+fastStorageVersionDelimiter+"1")))
+	require.NoError(t, db.Delete(tree.ndb.fastNodeKey([]byte{4})))
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), AsyncFastNodeWritesOption(true))
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	fastNode, err = reloaded.ndb.GetFastNode([]byte{4})
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), fastNode.GetValue())
+	itr, err := reloaded.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		count++
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, 9, count)
+}
+
+func TestMutableTree_GetWithOptions(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the fast node index drifts from the tree
+	drifted := fastnode.NewNode([]byte("a"), []byte("drifted"), 1)
+	require.NoError(t, tree.ndb.SaveFastNodeNoCache(drifted))
+	require.NoError(t, tree.ndb.Commit())
+	tree.ndb.fastNodeCache.Remove([]byte("a"))
+
+	value, err := tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("drifted"), value)
+
+	bypass := QueryOptions{BypassFastCache: true}
+	value, err = tree.GetWithOptions([]byte("a"), bypass)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	value, err = tree.ImmutableTree.GetWithOptions([]byte("missing"), bypass)
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	// unsaved changes are read from the working tree
+	_, err = tree.Set([]byte("a"), []byte("2"))
+	require.NoError(t, err)
+	value, err = tree.GetWithOptions([]byte("a"), bypass)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	value, err = tree.GetWithOptions([]byte("a"), QueryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+}
+
+func TestMutableTree_CloneTo(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	hashes := make(map[int64][]byte)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte{byte(i + v)}, []byte{byte(v)})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte{byte(v)})
+		require.NoError(t, err)
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	// a version reusing the root of the previous one
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	hashes[6] = hash
+
+	db := dbm.NewMemDB()
+	require.Error(t, tree.CloneTo(db, []int64{2, 3, 6}))
+	require.NoError(t, tree.CloneTo(db, []int64{6, 4, 5}))
+	require.Error(t, tree.CloneTo(db, []int64{2}))
+	require.ErrorIs(t, tree.CloneTo(dbm.NewMemDB(), []int64{9}), ErrVersionDoesNotExist)
+
+	clone := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = clone.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 5, 6}, clone.AvailableVersions())
+	for _, version := range []int64{4, 5, 6} {
+		itree, err := clone.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, hashes[version], itree.Hash())
+		source, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, source.Size(), itree.Size())
+	}
+
+	// the fast node index of the latest version was copied
+	synced, _, err := clone.ndb.isFastIndexSynced()
+	require.NoError(t, err)
+	require.True(t, synced)
+	value, err := clone.Get([]byte{10})
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, value)
+
+	// without the latest version, the fast node index is rebuilt on load
+	db = dbm.NewMemDB()
+	require.NoError(t, tree.CloneTo(db, []int64{3}))
+	clone = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = clone.Load()
+	require.NoError(t, err)
+	synced, _, err = clone.ndb.isFastIndexSynced()
+	require.NoError(t, err)
+	require.True(t, synced)
+	value, err = clone.Get([]byte{10})
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, value)
+	require.Equal(t, hashes[3], clone.Hash())
+}
+
+func TestMutableTree_AccessHook(t *testing.T) {
+	type access struct {
+		op      AccessOp
+		key     string
+		version int64
+	}
+	var accesses []access
+	hook := func(op AccessOp, key []byte, version int64) {
+		accesses = append(accesses, access{op, string(key), version})
+	}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), AccessHookOption(hook))
+
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	_, err = tree.Get([]byte("a"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	itr, err := tree.Iterator([]byte("a"), nil, true)
+	require.NoError(t, err)
+	require.NoError(t, itr.Close())
+	_, err = tree.Iterate(func(_, _ []byte) bool { return false })
+	require.NoError(t, err)
+
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	_, err = itree.Get([]byte("a"))
+	require.NoError(t, err)
+	_, err = tree.GetVersioned([]byte("a"), 1)
+	require.NoError(t, err)
+
+	require.Equal(t, []access{
+		{AccessSet, "a", 1},
+		{AccessSet, "b", 2},
+		{AccessGet, "a", 2},
+		{AccessRemove, "a", 2},
+		{AccessIterate, "a", 2},
+		{AccessIterate, "", 2},
+		{AccessGet, "a", 1},
+		{AccessGet, "a", 1},
+	}, accesses)
+	require.Equal(t, "remove", AccessRemove.String())
+}
+
+func TestMutableTree_SimulateHash(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte{100}, []byte{1})
+	require.NoError(t, err)
+	hash := tree.WorkingHash()
+
+	changes := &ChangeSet{Pairs: []*KVPair{
+		{Key: []byte{3}, Value: []byte("updated")},
+		{Key: []byte{200}, Value: []byte("new")},
+		{Key: []byte{7}, Delete: true},
+		{Key: []byte{201}, Delete: true},
+	}}
+	simulated, err := tree.SimulateHash(changes)
+	require.NoError(t, err)
+
+	// the working tree is untouched
+	require.Equal(t, hash, tree.WorkingHash())
+	value, err := tree.Get([]byte{7})
+	require.NoError(t, err)
+	require.Equal(t, []byte{7}, value)
+	has, err := tree.Has([]byte{200})
+	require.NoError(t, err)
+	require.False(t, has)
+
+	for _, pair := range changes.Pairs {
+		if pair.Delete {
+			_, _, err = tree.Remove(pair.Key)
+		} else {
+			_, err = tree.Set(pair.Key, pair.Value)
+		}
+		require.NoError(t, err)
+	}
+	require.Equal(t, tree.WorkingHash(), simulated)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, tree.Hash(), simulated)
+}
+
+func TestMutableTree_ComputeWorkingHash(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	hash, err := tree.ComputeWorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, tree.WorkingHash(), hash)
+
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte{3}, []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte{9})
+	require.NoError(t, err)
+
+	hash, err = tree.ComputeWorkingHash()
+	require.NoError(t, err)
+	require.Nil(t, tree.root.hash, "the working root must not be hashed")
+	again, err := tree.ComputeWorkingHash()
+	require.NoError(t, err)
+	require.Equal(t, hash, again)
+	require.Equal(t, tree.WorkingHash(), hash)
+
+	saved, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, saved, hash)
+}
+
+func TestMutableTree_FindByValueHash(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), ValueHashIndexOption(true))
+	find := func(value string) []string {
+		hash := sha256.Sum256([]byte(value))
+		keys, err := tree.FindByValueHash(hash[:])
+		require.NoError(t, err)
+		res := []string{}
+		for _, key := range keys {
+			res = append(res, string(key))
+		}
+		return res
+	}
+
+	for _, kv := range [][2]string{{"a", "x"}, {"b", "y"}, {"c", "x"}, {"d", "x"}} {
+		_, err := tree.Set([]byte(kv[0]), []byte(kv[1]))
+		require.NoError(t, err)
+	}
+	require.Empty(t, find("x"), "unsaved changes are not indexed")
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "c", "d"}, find("x"))
+	require.Equal(t, []string{"b"}, find("y"))
+
+	_, err = tree.Set([]byte("a"), []byte("y"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("c"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("e"), []byte("z"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("e"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []string{"d"}, find("x"))
+	require.Equal(t, []string{"a", "b"}, find("y"))
+	require.Empty(t, find("z"))
+
+	// rolling back rebuilds the index
+	require.NoError(t, tree.LoadVersionForOverwriting(1))
+	require.Equal(t, []string{"a", "c", "d"}, find("x"))
+	require.Equal(t, []string{"b"}, find("y"))
+
+	_, err = NewMutableTree(db, 0, false, NewNopLogger()).FindByValueHash(make([]byte, 32))
+	require.Error(t, err)
+}
+
+func TestMutableTree_SplitAt(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{byte(i), byte(v)})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	hash := tree.Hash()
+
+	left, right, err := tree.SplitAt([]byte{12}, dbm.NewMemDB(), dbm.NewMemDB())
+	require.NoError(t, err)
+	require.Equal(t, hash, tree.Hash())
+	require.Equal(t, int64(4), left.Version())
+	require.Equal(t, int64(4), right.Version())
+	require.Equal(t, int64(12), left.Size())
+	require.Equal(t, int64(8), right.Size())
+
+	// the left tree retains the history
+	itree, err := left.GetImmutable(3)
+	require.NoError(t, err)
+	require.Equal(t, hash, itree.Hash())
+	value, err := left.Get([]byte{11})
+	require.NoError(t, err)
+	require.Equal(t, []byte{11, 2}, value)
+	has, err := left.Has([]byte{12})
+	require.NoError(t, err)
+	require.False(t, has)
+
+	value, err = right.Get([]byte{19})
+	require.NoError(t, err)
+	require.Equal(t, []byte{19, 2}, value)
+	has, err = right.Has([]byte{11})
+	require.NoError(t, err)
+	require.False(t, has)
+	require.Equal(t, []int{4}, right.AvailableVersions())
+
+	_, err = tree.Set([]byte{1}, []byte{1})
+	require.NoError(t, err)
+	_, _, err = tree.SplitAt([]byte{12}, dbm.NewMemDB(), dbm.NewMemDB())
+	require.ErrorIs(t, err, ErrUnsavedChanges)
+}
+
+// assertWellFormed checks the heights, sizes, keys and balance of the nodes of the subtree, and
+// returns its lowest key.
+func assertWellFormed(t *testing.T, tree *ImmutableTree, node *Node) []byte {
+	if node.isLeaf() {
+		require.Equal(t, int8(0), node.subtreeHeight)
+		require.Equal(t, int64(1), node.size)
+		return node.key
+	}
+	left, err := node.getLeftNode(tree)
+	require.NoError(t, err)
+	right, err := node.getRightNode(tree)
+	require.NoError(t, err)
+	lowest := assertWellFormed(t, tree, left)
+	require.Equal(t, assertWellFormed(t, tree, right), node.key)
+	require.Equal(t, maxInt8(left.subtreeHeight, right.subtreeHeight)+1, node.subtreeHeight)
+	require.Equal(t, left.size+right.size, node.size)
+	require.LessOrEqual(t, left.subtreeHeight-right.subtreeHeight, int8(1))
+	require.GreaterOrEqual(t, left.subtreeHeight-right.subtreeHeight, int8(-1))
+	return lowest
+}
+
+func TestMutableTree_MigratePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		name, oldPrefix, newPrefix string
+	}{
+		{"forward", "bank/", "money/"},
+		{"backward", "stake/", "acc/x/"},
+		{"nested", "acc/", "acc/b/"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := dbm.NewMemDB()
+			tree := NewMutableTree(db, 0, false, NewNopLogger())
+			mirror := map[string]string{}
+			r := rand.New(rand.NewSource(int64(len(tc.name))))
+			for _, prefix := range []string{"acc/", "bank/", "stake/", "zzz/"} {
+				for i := 0; i < 10+r.Intn(100); i++ {
+					key := fmt.Sprintf("%s%d", prefix, r.Int())
+					mirror[key] = key
+					_, err := tree.Set([]byte(key), []byte(key))
+					require.NoError(t, err)
+				}
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+
+			migrated := map[string]string{}
+			for k, v := range mirror {
+				if strings.HasPrefix(k, tc.oldPrefix) {
+					k = tc.newPrefix + k[len(tc.oldPrefix):]
+				}
+				migrated[k] = v
+			}
+			hash, version, err := tree.MigratePrefix([]byte(tc.oldPrefix), []byte(tc.newPrefix))
+			require.NoError(t, err)
+			require.Equal(t, int64(2), version)
+			assertWellFormed(t, tree.ImmutableTree, tree.root)
+			assertMutableMirrorIterate(t, tree, migrated)
+
+			reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+			_, err = reloaded.Load()
+			require.NoError(t, err)
+			require.Equal(t, hash, reloaded.Hash())
+			require.Equal(t, int64(len(migrated)), reloaded.Size())
+			assertImmutableMirrorIterate(t, reloaded.ImmutableTree, migrated)
+			itree, err := reloaded.GetImmutable(1)
+			require.NoError(t, err)
+			assertImmutableMirrorIterate(t, itree, mirror)
+		})
+	}
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, key := range []string{"a/1", "b/1"} {
+		_, err := tree.Set([]byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.MigratePrefix([]byte("a/"), []byte("b/"))
+	require.Error(t, err)
+}
+
+func TestMutableTree_ProvableVersions(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for v := 1; v <= 5; v++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	versions, err := tree.ProvableVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4, 5}, versions)
+
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	versions, err = tree.ProvableVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int{3, 4, 5}, versions)
+
+	// a pending asynchronous pruning makes the versions up to it unprovable
+	tree.ndb.mtx.Lock()
+	tree.ndb.pruneVersion = 3
+	tree.ndb.mtx.Unlock()
+	versions, err = tree.ProvableVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 5}, versions)
+	tree.ndb.mtx.Lock()
+	tree.ndb.pruneVersion = 0
+	tree.ndb.mtx.Unlock()
+
+	// simulate an interrupted deletion of version 3 by deleting one of its orphans
+	var orphan *Node
+	require.NoError(t, tree.ndb.IterateOrphans(3, func(node *Node) error {
+		if orphan == nil && node.isLeaf() {
+			orphan = node
+		}
+		return nil
+	}))
+	require.NotNil(t, orphan)
+	require.NoError(t, db.Delete(tree.ndb.nodeKey(orphan.GetKey())))
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{3, 4, 5}, reloaded.AvailableVersions())
+	versions, err = reloaded.ProvableVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 5}, versions)
+}
+
+// failingGetDB fails the reads of a MemDB while failGets is set.
+type failingGetDB struct {
+	*dbm.MemDB
+	failGets bool
+}
+
+func (db *failingGetDB) Get(key []byte) ([]byte, error) {
+	if db.failGets {
+		return nil, errors.New("read failed")
+	}
+	return db.MemDB.Get(key)
+}
+
+func TestMutableTree_GetFastIndexError(t *testing.T) {
+	db := &failingGetDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	// the latest version can't be read to check the fast node index, and the error isn't hidden
+	// by reading the cached nodes instead
+	tree.ndb.resetLatestVersion(0)
+	db.failGets = true
+	_, err = itree.Get([]byte("a"))
+	require.ErrorContains(t, err, "read failed")
+	db.failGets = false
+	value, err := itree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+}
+
+func TestMutableTree_GetWithIndex(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, key := range []string{"b", "d", "f"} {
+		_, err := tree.Set([]byte(key), []byte("v"+key))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("a"), []byte("va"))
+	require.NoError(t, err)
+
+	// the working tree, with the unsaved key
+	for i, key := range []string{"a", "b", "d", "f"} {
+		index, value, err := tree.GetWithIndex([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, int64(i), index)
+		require.Equal(t, []byte("v"+key), value)
+	}
+	index, value, err := tree.GetWithIndex([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), index)
+	require.Nil(t, value)
+
+	// the saved version, without it
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	index, value, err = itree.GetWithIndex([]byte("d"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), index)
+	require.Equal(t, []byte("vd"), value)
+}
+
+func TestMutableTree_IterateHashes(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+	}
+	collect := func(iterate func(func(key, leafHash []byte) bool) (bool, error)) map[string][]byte {
+		hashes := map[string][]byte{}
+		stopped, err := iterate(func(key, leafHash []byte) bool {
+			hashes[string(key)] = leafHash
+			return false
+		})
+		require.NoError(t, err)
+		require.False(t, stopped)
+		return hashes
+	}
+
+	// the working hashes are the ones saved
+	working := collect(tree.IterateHashes)
+	require.Len(t, working, 20)
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	v1, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, working, collect(v1.IterateHashes))
+
+	_, err = tree.Set([]byte("key05"), []byte("changed"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	v2, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	var changed []string
+	for key, hash := range collect(v2.IterateHashes) {
+		if !bytes.Equal(hash, working[key]) {
+			changed = append(changed, key)
+		}
+	}
+	require.Equal(t, []string{"key05"}, changed)
+
+	var keys int
+	stopped, err := v2.IterateHashes(func(_, _ []byte) bool {
+		keys++
+		return keys == 3
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 3, keys)
+}
+
+func TestMutableTree_ReadTx(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := tree.Set([]byte(key), []byte("1"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("c"), []byte("2"))
+	require.NoError(t, err)
+
+	tx := tree.ReadTx()
+	require.Equal(t, int64(1), tx.Version())
+
+	// writes and saves after the start of the transaction are not visible
+	_, err = tree.Set([]byte("a"), []byte("3"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("d"), []byte("3"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	value, err := tx.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	has, err := tx.Has([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = tx.Has([]byte("d"))
+	require.NoError(t, err)
+	require.False(t, has)
+	var pairs []string
+	_, err = tx.Iterate(func(key, value []byte) bool {
+		pairs = append(pairs, string(key)+"="+string(value))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a=1", "b=1", "c=2"}, pairs)
+	itr, err := tx.Iterator([]byte("b"), nil, false)
+	require.NoError(t, err)
+	pairs = nil
+	for ; itr.Valid(); itr.Next() {
+		pairs = append(pairs, string(itr.Key()))
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, []string{"c", "b"}, pairs)
+
+	// the pinned versions can't be pruned until the transaction is closed
+	require.Error(t, tree.DeleteVersionsTo(1))
+	require.Error(t, tree.DeleteVersionsTo(2))
+	require.NoError(t, tx.Close())
+	require.NoError(t, tx.Close())
+	_, err = tx.Get([]byte("a"))
+	require.ErrorIs(t, err, ErrReadTxClosed)
+	require.NoError(t, tree.DeleteVersionsTo(2))
+}
+
+func TestMutableTree_LatencyExpvar(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), LatencyExpvarOption("iavl_test_latency"))
+	_, ok := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).LatencyHistogram(LatencyGet)
+	require.False(t, ok)
+
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, err = tree.Get([]byte("a"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.GetProof([]byte("a"))
+	require.NoError(t, err)
+
+	for _, op := range []LatencyOp{LatencyGet, LatencySet, LatencySaveVersion, LatencyGetProof} {
+		h, ok := tree.LatencyHistogram(op)
+		require.True(t, ok)
+		require.EqualValues(t, 1, h.Count(), op.String())
+	}
+
+	var published map[string]struct {
+		Count   uint64            `json:"count"`
+		Buckets map[string]uint64 `json:"buckets"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("iavl_test_latency").String()), &published))
+	require.EqualValues(t, 1, published["save_version"].Count)
+	require.EqualValues(t, 1, published["save_version"].Buckets["+Inf"])
+	require.Zero(t, published["import_chunk"].Count)
+
+	// a tree with the same name shares the histograms
+	other := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), LatencyExpvarOption("iavl_test_latency"))
+	_, err = other.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	h, _ := tree.LatencyHistogram(LatencySet)
+	require.EqualValues(t, 2, h.Count())
+}
+
+func TestMutableTree_GetImmutableConcurrentWithSaveVersion(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 100, false, NewNopLogger())
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	wg := new(sync.WaitGroup)
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				itree, err := tree.GetImmutable(1)
+				if err == nil {
+					var value []byte
+					value, err = itree.Get([]byte("k3"))
+					if err == nil && !bytes.Equal(value, []byte("v")) {
+						err = fmt.Errorf("unexpected value %q", value)
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i%10)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestMutableTree_GetImmutableInvalidated(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 5; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	v1, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	v3, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	v5, err := tree.GetImmutable(5)
+	require.NoError(t, err)
+
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	_, err = v1.Get([]byte("k0"))
+	require.ErrorIs(t, err, ErrTreeInvalidated)
+	_, err = v1.Iterator(nil, nil, true)
+	require.ErrorIs(t, err, ErrTreeInvalidated)
+	_, err = v1.Export()
+	require.ErrorIs(t, err, ErrTreeInvalidated)
+	value, err := v3.Get([]byte("k2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), value)
+
+	// version 5 is rewritten after the rollback, the old handle must not read the new nodes
+	require.NoError(t, tree.LoadVersionForOverwriting(3))
+	_, err = tree.Set([]byte("k3"), []byte("other"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = v5.GetWithIndex([]byte("k3"))
+	require.ErrorIs(t, err, ErrTreeInvalidated)
+	_, _, err = v5.GetByIndex(0)
+	require.ErrorIs(t, err, ErrTreeInvalidated)
+	value, err = v3.Get([]byte("k2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), value)
+
+	// handles loaded after the rollback are valid
+	v4, err := tree.GetImmutable(4)
+	require.NoError(t, err)
+	value, err = v4.Get([]byte("k3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("other"), value)
+}
+
+func TestMutableTree_ChainedHash(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), ChainedHashesOption(true))
+
+	var rootHashes [][]byte
+	for v := 0; v < 5; v++ {
+		_, err := tree.Set([]byte{byte(v)}, []byte{byte(v)})
+		require.NoError(t, err)
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		rootHashes = append(rootHashes, hash)
+	}
+
+	var chained []byte
+	for v, rootHash := range rootHashes {
+		chained = chainHash(chained, rootHash)
+		hash, err := tree.ChainedHash(int64(v + 1))
+		require.NoError(t, err)
+		require.Equal(t, chained, hash)
+	}
+	_, err := tree.ChainedHash(6)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// chained hashes survive pruning
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	hash, err := tree.ChainedHash(2)
+	require.NoError(t, err)
+	require.Equal(t, chainHash(chainHash(nil, rootHashes[0]), rootHashes[1]), hash)
+
+	// and are rewritten after a rollback
+	require.NoError(t, tree.LoadVersionForOverwriting(4))
+	_, err = tree.ChainedHash(5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.Set([]byte("other"), []byte("value"))
+	require.NoError(t, err)
+	rootHash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	prev, err := tree.ChainedHash(4)
+	require.NoError(t, err)
+	hash, err = tree.ChainedHash(5)
+	require.NoError(t, err)
+	require.Equal(t, chainHash(prev, rootHash), hash)
+
+	_, err = NewMutableTree(db, 0, false, NewNopLogger()).ChainedHash(5)
+	require.Error(t, err)
+}
+
+func TestMutableTree_SizeAtVersion(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	sizes := []int64{3, 5, 4, 4}
+	for v, size := range sizes {
+		for tree.Size() < size {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%d-%d", v, tree.Size())), []byte{1})
+			require.NoError(t, err)
+		}
+		if tree.Size() > size {
+			_, removed, err := tree.Remove([]byte("k0-0"))
+			require.NoError(t, err)
+			require.True(t, removed)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	check := func(tree *MutableTree, from int64) {
+		prev := int64(0)
+		for v, size := range sizes {
+			if int64(v+1) >= from {
+				got, err := tree.SizeAtVersion(int64(v + 1))
+				require.NoError(t, err)
+				require.Equal(t, size, got)
+				delta, err := tree.SizeDeltaAtVersion(int64(v + 1))
+				require.NoError(t, err)
+				require.Equal(t, size-prev, delta)
+			}
+			prev = size
+		}
+	}
+	check(tree, 1)
+
+	// the sizes are kept for pruned versions
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	require.False(t, tree.VersionExists(1))
+	check(tree, 1)
+
+	// and recorded for imported versions
+	exported, err := tree.GetImmutable(4)
+	require.NoError(t, err)
+	exporter, err := exported.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	imported := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	importer, err := imported.Import(4)
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	size, err := imported.SizeAtVersion(4)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, size)
+
+	_, err = tree.SizeDeltaAtVersion(5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_StrictLoad(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for v := 0; v < 3; v++ {
+		_, err := tree.Set([]byte{byte(v)}, []byte{byte(v)})
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	dump := func() map[string]string {
+		entries := map[string]string{}
+		itr, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			entries[string(itr.Key())] = string(itr.Value())
+		}
+		return entries
+	}
+	before := dump()
+
+	// the fast storage upgrade is reported instead of written
+	strict := NewMutableTree(db, 0, false, NewNopLogger(), StrictLoadOption(true))
+	_, err := strict.Load()
+	var migrationErr *MigrationRequiredError
+	require.ErrorAs(t, err, &migrationErr)
+	require.Contains(t, migrationErr.Migration, "fast storage upgrade")
+	require.Equal(t, before, dump())
+
+	// the tree can be read without the fast node index
+	strict = NewMutableTree(db, 0, true, NewNopLogger(), StrictLoadOption(true))
+	version, err := strict.LoadVersion(2)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	value, err := strict.Get([]byte{1})
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value)
+	require.Equal(t, before, dump())
+
+	// once migrated, strict loads succeed
+	_, err = NewMutableTree(db, 0, false, NewNopLogger()).Load()
+	require.NoError(t, err)
+	_, err = NewMutableTree(db, 0, false, NewNopLogger(), StrictLoadOption(true)).Load()
+	require.NoError(t, err)
+}
+
+func TestMutableTree_RemoveMany(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		expected := map[string][]byte{}
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("k%04d", r.Intn(1000)))
+			value := []byte(fmt.Sprintf("v%d", i))
+			_, err := tree.Set(key, value)
+			require.NoError(t, err)
+			expected[string(key)] = value
+		}
+		if round%2 == 0 {
+			// from persisted nodes as well as from the working tree
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+
+		// a contiguous range, like a drained queue, and scattered keys
+		var keys [][]byte
+		start := r.Intn(1000)
+		for i := 0; i < 1000; i++ {
+			if (i >= start && i < start+200) || r.Intn(10) == 0 {
+				keys = append(keys, []byte(fmt.Sprintf("k%04d", i)))
+			}
+		}
+		values, err := tree.RemoveMany(keys)
+		require.NoError(t, err)
+		require.Len(t, values, len(keys))
+		for i, key := range keys {
+			require.Equal(t, expected[string(key)], values[i], "key %s", key)
+			delete(expected, string(key))
+		}
+
+		require.EqualValues(t, len(expected), tree.Size())
+		var checkBalance func(node *Node) int8
+		checkBalance = func(node *Node) int8 {
+			if node.isLeaf() {
+				return 0
+			}
+			left, err := node.getLeftNode(tree.ImmutableTree)
+			require.NoError(t, err)
+			right, err := node.getRightNode(tree.ImmutableTree)
+			require.NoError(t, err)
+			lh, rh := checkBalance(left), checkBalance(right)
+			require.LessOrEqual(t, lh-rh, int8(1))
+			require.LessOrEqual(t, rh-lh, int8(1))
+			require.Equal(t, maxInt8(lh, rh)+1, node.subtreeHeight)
+			require.Equal(t, left.size+right.size, node.size)
+			minKey := right
+			for !minKey.isLeaf() {
+				minKey, err = minKey.getLeftNode(tree.ImmutableTree)
+				require.NoError(t, err)
+			}
+			require.Equal(t, minKey.key, node.key)
+			return node.subtreeHeight
+		}
+		if tree.root != nil {
+			checkBalance(tree.root)
+		}
+
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		reloaded := NewMutableTree(tree.ndb.db, 0, false, NewNopLogger())
+		_, err = reloaded.LoadVersion(version)
+		require.NoError(t, err)
+		require.Equal(t, hash, reloaded.Hash())
+		for key, value := range expected {
+			got, err := reloaded.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, value, got)
+		}
+		for _, key := range keys {
+			got, err := reloaded.Get(key)
+			require.NoError(t, err)
+			require.Nil(t, got)
+		}
+	}
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := tree.RemoveMany([][]byte{[]byte("b"), []byte("a")})
+	require.Error(t, err)
+	values, err := tree.RemoveMany([][]byte{[]byte("a")})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{nil}, values)
+
+	// a closed tree writes no intents
+	var intents bytes.Buffer
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), IntentLogWriterOption(&intents))
+	require.NoError(t, tree.Close())
+	_, err = tree.RemoveMany([][]byte{[]byte("a")})
+	require.ErrorIs(t, err, ErrTreeClosed)
+	require.Zero(t, intents.Len())
+}
+
+func TestImmutableTree_WithCacheBypass(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 1000, false, NewNopLogger())
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree = NewMutableTree(db, 1000, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	cached, fastCached := tree.ndb.nodeCache.Len(), tree.ndb.fastNodeCache.Len()
+
+	// reads and exports under the bypass don't fill the caches
+	bypass := itree.WithCacheBypass()
+	value, err := bypass.Get([]byte("k042"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v42"), value)
+	_, value, err = bypass.GetByIndex(7)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v7"), value)
+	exporter, err := bypass.Export()
+	require.NoError(t, err)
+	for {
+		if _, err := exporter.Next(); err != nil {
+			require.ErrorIs(t, err, ErrorExportDone)
+			break
+		}
+	}
+	exporter.Close()
+	require.Equal(t, cached, tree.ndb.nodeCache.Len())
+	require.Equal(t, fastCached, tree.ndb.fastNodeCache.Len())
+
+	// the tree itself still fills them
+	_, _, err = itree.GetByIndex(7)
+	require.NoError(t, err)
+	require.Greater(t, tree.ndb.nodeCache.Len(), cached)
+}
+
+func TestMutableTree_AllowEmptyValues(t *testing.T) {
+	_, err := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).Set([]byte("a"), nil)
+	require.Error(t, err)
+
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), AllowEmptyValuesOption(true))
+	_, err = tree.Set([]byte("a"), nil)
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte{})
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("d"), []byte("value"))
+	require.NoError(t, err)
+
+	// the empty values are present, unlike the absent key c
+	check := func(tree *MutableTree) {
+		t.Helper()
+		for _, key := range []string{"a", "b"} {
+			value, err := tree.Get([]byte(key))
+			require.NoError(t, err)
+			require.NotNil(t, value)
+			require.Empty(t, value)
+			has, err := tree.Has([]byte(key))
+			require.NoError(t, err)
+			require.True(t, has)
+		}
+		value, err := tree.Get([]byte("c"))
+		require.NoError(t, err)
+		require.Nil(t, value)
+		has, err := tree.Has([]byte("c"))
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+	check(tree)
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	check(tree)
+
+	// from the fast nodes and the nodes on disk
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), AllowEmptyValuesOption(true))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	check(tree)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	_, value, err := itree.GetWithIndex([]byte("a"))
+	require.NoError(t, err)
+	require.NotNil(t, value)
+
+	// removing an empty value removes the key
+	_, removed, err := tree.Remove([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	value, err = tree.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	tree.Rollback()
+
+	// the empty values have membership proofs, and neighbor the keys of non-membership proofs
+	proof, err := itree.GetMembershipProof([]byte("a"))
+	require.NoError(t, err)
+	require.True(t, verify.VerifyMembership(hash, proof, []byte("a"), nil))
+	require.False(t, verify.VerifyMembership(hash, proof, []byte("a"), []byte("value")))
+	require.False(t, verify.VerifyMembership(hash, proof, []byte("b"), nil))
+	ok, err := itree.VerifyMembership(proof, []byte("a"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	proof, err = itree.GetNonMembershipProof([]byte("c"))
+	require.NoError(t, err)
+	require.True(t, verify.VerifyNonMembership(hash, proof, []byte("c")))
+	require.False(t, verify.VerifyNonMembership(hash, proof, []byte("d")))
+	require.False(t, verify.VerifyNonMembership([]byte("wrong root"), proof, []byte("c")))
+	_, err = itree.GetNonMembershipProof([]byte("a"))
+	require.Error(t, err)
+
+	// the export stream doesn't encode the empty values, and the import with the option restores them
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	bz, err := io.ReadAll(exporter)
+	require.NoError(t, err)
+	exporter.Close()
+	stream, err := NewExportStreamReader(bytes.NewReader(bz))
+	require.NoError(t, err)
+	imported := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), AllowEmptyValuesOption(true))
+	importer, err := imported.Import(version)
+	require.NoError(t, err)
+	defer importer.Close()
+	require.NoError(t, importer.SetHeader(stream.Header()))
+	for {
+		node, err := stream.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	require.Equal(t, hash, imported.Hash())
+	check(imported)
+}
+
+func TestMutableTree_SaveVersionDetailed(t *testing.T) {
+	stat := &Statistics{}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), StatOption(stat))
+	var userBytes int64
+	for i := 0; i < 100; i++ {
+		key, value := []byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", i))
+		_, err := tree.Set(key, value)
+		require.NoError(t, err)
+		userBytes += int64(len(key) + len(value))
+	}
+	hash, version, stats, err := tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	require.Equal(t, tree.Hash(), hash)
+	require.Equal(t, 199, stats.NodesWritten)
+	require.Greater(t, stats.BytesWritten, int64(199))
+	require.Positive(t, stats.Commit)
+	require.GreaterOrEqual(t, stats.Commit, stats.Hashing+stats.Serialization+stats.FastNodes+stats.BatchWrite)
+	require.Equal(t, userBytes, stats.UserBytes)
+	require.InDelta(t, float64(stats.BytesWritten)/float64(userBytes), stats.WriteAmplification(), 1e-9)
+	require.Greater(t, stats.WriteAmplification(), 1.0)
+	firstBytes := stats.BytesWritten
+
+	// an update writes the path to the leaf, amplifying the small write much more
+	_, err = tree.Set([]byte("k042"), []byte("new"))
+	require.NoError(t, err)
+	_, _, stats, err = tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.Equal(t, int(tree.Height())+1, stats.NodesWritten)
+	require.EqualValues(t, 7, stats.UserBytes)
+	require.Greater(t, stats.WriteAmplification(), float64(tree.Height()))
+
+	// the statistics accumulate the versions
+	require.EqualValues(t, userBytes+7, stat.GetUserBytesWritten())
+	require.EqualValues(t, firstBytes+stats.BytesWritten, stat.GetNodeBytesWritten())
+	require.InDelta(t, float64(firstBytes+stats.BytesWritten)/float64(userBytes+7), stat.GetWriteAmplification(), 1e-9)
+
+	// and an empty version writes no nodes
+	_, _, stats, err = tree.SaveVersionDetailed()
+	require.NoError(t, err)
+	require.Zero(t, stats.NodesWritten)
+	require.Zero(t, stats.BytesWritten)
+	require.Zero(t, stats.Hashing)
+	require.Zero(t, stats.UserBytes)
+	require.Zero(t, stats.WriteAmplification())
+}
+
+// countdownContext is canceled once its Err was called n times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.n--; ctx.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestMutableTree_LoadVersionForOverwritingWithOptions(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	hashes := map[int64][]byte{}
+	for v := int64(1); v <= 20; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%03d", (int(v)*7+i*13)%100)), []byte(fmt.Sprintf("v%d", v)))
+			require.NoError(t, err)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[v] = hash
+	}
+
+	// a stopped deletion commits its progress, and leaves a valid latest version
+	ctx := &countdownContext{Context: context.Background(), n: 100}
+	err := tree.LoadVersionForOverwritingWithOptions(ctx, 5, RollbackOptions{ChunkSize: 30})
+	require.ErrorIs(t, err, context.Canceled)
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	latest, err := tree.Load()
+	require.NoError(t, err)
+	require.Greater(t, latest, int64(5))
+	require.Less(t, latest, int64(20))
+	require.Equal(t, hashes[latest], tree.Hash())
+
+	// and is resumed by calling it again, deleting the leftovers of the partially deleted version
+	require.NoError(t, tree.LoadVersionForOverwritingWithOptions(context.Background(), 5, RollbackOptions{ChunkSize: 30}))
+	latest, err = tree.LatestVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 5, latest)
+	_, found, err := tree.ndb.lastNodeVersion(6, math.MaxInt64)
+	require.NoError(t, err)
+	require.False(t, found)
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	latest, err = tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 5, latest)
+	require.Equal(t, hashes[5], tree.Hash())
+
+	// the deletions are throttled
+	var slept time.Duration
+	d := &versionDeleter{
+		ndb:     tree.ndb,
+		ctx:     context.Background(),
+		opts:    RollbackOptions{MaxDeletesPerSec: 1000},
+		started: time.Now(),
+		sleep:   func(d time.Duration) { slept = d },
+	}
+	require.NoError(t, d.deleteVersion(5))
+	require.InDelta(t, d.deleted, 1000*slept.Seconds(), 5)
+}
+
+func TestMutableTree_KeyValidator(t *testing.T) {
+	errPrefix := errors.New("missing the bank/ prefix")
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), KeyValidatorOption(func(key []byte) error {
+		if !bytes.HasPrefix(key, []byte("bank/")) {
+			return errPrefix
+		}
+		return nil
+	}))
+
+	_, err := tree.Set([]byte("bank/a"), []byte("1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("bank/b"), []byte("2"))
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("staking/a"), []byte("1"))
+	require.ErrorIs(t, err, ErrInvalidKey)
+	require.ErrorIs(t, err, errPrefix)
+	_, _, err = tree.Remove([]byte("staking/a"))
+	require.ErrorIs(t, err, errPrefix)
+	_, err = tree.RemoveMany([][]byte{[]byte("bank/a"), []byte("staking/a")})
+	require.ErrorIs(t, err, errPrefix)
+
+	// the rejected writes left the tree untouched
+	value, err := tree.Get([]byte("bank/a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	require.EqualValues(t, 2, tree.Size())
+
+	_, removed, err := tree.Remove([]byte("bank/b"))
+	require.NoError(t, err)
+	require.True(t, removed)
+}
+
+func TestMutableTree_CacheSnapshot(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 100, false, NewNopLogger())
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the hot keys of a restarted tree
+	tree = NewMutableTree(db, 100, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i += 50 {
+		_, _, err := itree.GetWithIndex([]byte(fmt.Sprintf("k%04d", i)))
+		require.NoError(t, err)
+		_, err = tree.Get([]byte(fmt.Sprintf("k%04d", i)))
+		require.NoError(t, err)
+	}
+	nodeKeys, fastNodeKeys := cacheKeys(tree.ndb.nodeCache), cacheKeys(tree.ndb.fastNodeCache)
+	require.Len(t, nodeKeys, 100)
+	require.Len(t, fastNodeKeys, 20)
+	path := filepath.Join(t.TempDir(), "cache")
+	require.NoError(t, tree.SaveCacheSnapshot(path))
+
+	// are cached again after a restart, in the same order
+	tree = NewMutableTree(db, 100, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.NoError(t, tree.LoadCacheSnapshot(path))
+	require.ElementsMatch(t, nodeKeys, cacheKeys(tree.ndb.nodeCache))
+	require.ElementsMatch(t, fastNodeKeys, cacheKeys(tree.ndb.fastNodeCache))
+	require.Equal(t, nodeKeys[len(nodeKeys)-50:], cacheKeys(tree.ndb.nodeCache)[50:])
+
+	// except for the deleted nodes
+	_, _, err = tree.Remove([]byte("k0000"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	tree = NewMutableTree(db, 100, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.NoError(t, tree.LoadCacheSnapshot(path))
+	deleted := 0
+	for _, nk := range nodeKeys {
+		exists, err := db.Has(tree.ndb.nodeKey(nk))
+		require.NoError(t, err)
+		if !exists {
+			deleted++
+			require.False(t, tree.ndb.nodeCache.Has(nk))
+		}
+	}
+	require.Positive(t, deleted)
+	require.Len(t, cacheKeys(tree.ndb.fastNodeCache), 19)
+
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o600))
+	require.ErrorContains(t, tree.LoadCacheSnapshot(path), "not a cache snapshot")
+}
+
+func TestMutableTree_GetVersionedDuringSaveVersion(t *testing.T) {
+	// a small flush threshold writes the fast node index of a version being saved in parts,
+	// ahead of its commit
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), FlushThresholdOption(256))
+	const keys, versions = 1000, 20
+
+	// the expected states, the value of key i at version v being states[v-1][i], nil if removed
+	states := make([][][]byte, versions)
+	state := make([][]byte, keys)
+	for v := 1; v <= versions; v++ {
+		for i := range state {
+			switch (i + v) % 3 {
+			case 0:
+				state[i] = []byte(fmt.Sprintf("v%d", v))
+			case 1:
+				if v > 1 {
+					state[i] = nil
+				}
+			}
+		}
+		states[v-1] = append([][]byte(nil), state...)
+	}
+	save := func(v int) {
+		for i, value := range states[v-1] {
+			key := []byte(fmt.Sprintf("k%03d", i))
+			var err error
+			if value == nil {
+				_, _, err = tree.Remove(key)
+			} else {
+				_, err = tree.Set(key, value)
+			}
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	save(1)
+
+	var latest atomic.Int64
+	latest.Store(1)
+	wg := new(sync.WaitGroup)
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(r)))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// mostly the latest version, which the fast node index answers for
+				v := latest.Load()
+				if rnd.Intn(4) == 0 {
+					v = 1 + rnd.Int63n(v)
+				}
+				i := rnd.Intn(keys)
+				value, err := tree.GetVersioned([]byte(fmt.Sprintf("k%03d", i)), v)
+				if err == nil && !bytes.Equal(value, states[v-1][i]) {
+					err = fmt.Errorf("key %d at version %d: expected %q, got %q", i, v, states[v-1][i], value)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+	for v := 2; v <= versions; v++ {
+		save(v)
+		latest.Store(int64(v))
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestMutableTree_ShadowDB(t *testing.T) {
+	shadowDB := dbm.NewMemDB()
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ShadowDBOption(shadowDB))
+	_, err := tree.Load()
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%d", (v*7+i)%30)), []byte(fmt.Sprintf("v%d", v)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("k%d", v)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// the rollbacks and loads are mirrored too
+	_, err = tree.Set([]byte("rolled back"), []byte("v"))
+	require.NoError(t, err)
+	tree.Rollback()
+	require.NoError(t, tree.LoadVersionForOverwriting(4))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Nil(t, tree.ShadowDivergence())
+
+	shadow := NewMutableTree(shadowDB, 0, false, NewNopLogger())
+	version, err := shadow.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 5, version)
+	require.Equal(t, tree.Hash(), shadow.Hash())
+
+	// a shadow tree out of sync is flagged at the next SaveVersion, and dropped
+	_, err = tree.shadow.Set([]byte("corrupted"), []byte("v"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("k1"), []byte("new"))
+	require.NoError(t, err)
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	divergence := tree.ShadowDivergence()
+	require.NotNil(t, divergence)
+	require.EqualValues(t, 6, divergence.Version)
+	require.EqualValues(t, 6, divergence.ShadowVersion)
+	require.Equal(t, hash, divergence.Hash)
+	require.NotEqual(t, hash, divergence.ShadowHash)
+	require.Contains(t, divergence.String(), "instead of")
+	require.Nil(t, tree.shadow)
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 7, version)
+	require.Equal(t, divergence, tree.ShadowDivergence())
+
+	// so is a failure of the shadow tree, e.g. with options under test
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), ShadowDBOption(dbm.NewMemDB(), KeyValidatorOption(func(key []byte) error {
+		if len(key) > 2 {
+			return errors.New("too long")
+		}
+		return nil
+	})))
+	_, err = tree.Set([]byte("k1"), []byte("v"))
+	require.NoError(t, err)
+	require.Nil(t, tree.ShadowDivergence())
+	_, err = tree.Set([]byte("k10"), []byte("v"))
+	require.NoError(t, err)
+	require.ErrorIs(t, tree.ShadowDivergence().Err, ErrInvalidKey)
+	require.NoError(t, tree.Close())
+}
+
+func TestMutableTree_MaxDepth(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger(), MaxDepthOption(3))
+	for i := 0; i < 8; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{1})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, tree.Height())
+
+	// the tree is as high as allowed, one more level fails
+	_, err = tree.Set([]byte{8}, []byte{1})
+	require.NoError(t, err)
+	_, err = tree.Set([]byte{9}, []byte{1})
+	require.ErrorIs(t, err, ErrMaxDepthExceeded)
+	tree.Rollback()
+
+	// a cyclic node reference fails instead of recursing forever, the writes clone the root and
+	// drop its reference, so it is made again before each of them
+	cycle := func() { tree.root.leftNode = tree.root }
+	cycle()
+	_, err = tree.Get([]byte{0})
+	require.ErrorIs(t, err, ErrCorruptNode)
+	_, err = tree.Has([]byte{0})
+	require.ErrorIs(t, err, ErrCorruptNode)
+	_, _, err = tree.GetByIndex(0)
+	require.ErrorIs(t, err, ErrCorruptNode)
+	_, err = tree.GetMembershipProof([]byte{0})
+	require.ErrorIs(t, err, ErrCorruptNode)
+	cycle()
+	_, err = tree.Set([]byte{0}, []byte{2})
+	require.ErrorIs(t, err, ErrCorruptNode)
+	cycle()
+	_, _, err = tree.Remove([]byte{0})
+	require.ErrorIs(t, err, ErrCorruptNode)
+	cycle()
+	_, err = tree.RemoveMany([][]byte{{0}, {7}})
+	require.ErrorIs(t, err, ErrCorruptNode)
+}
+
+func TestMutableTree_Reconfigure(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), FastNodeCacheSizeOption(10), ExportBufferSizeOption(1))
+	for v := 0; v < 5; v++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", v)), []byte("v"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, []int{1, 2, 3, 4, 5}, tree.AvailableVersions())
+
+	// the pruning and the batch sizes are changed in place
+	require.NoError(t, tree.Reconfigure(PruningOption(PruningOptions{MaxOrphans: 1, KeepRecent: 2}), FlushThresholdOption(1000), ImportBatchSizeOption(2), ExportBufferSizeOption(4)))
+	require.Equal(t, 1000, tree.ndb.batch.(*BatchWithFlusher).flushThreshold)
+	require.Equal(t, 2, tree.ndb.opts.importBatchSize())
+	require.Equal(t, 4, tree.ndb.opts.exportBufferSize())
+	_, err := tree.Set([]byte("k0"), []byte("new"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 6}, tree.AvailableVersions())
+
+	// the other options fail, without applying the safe ones
+	err = tree.Reconfigure(FlushThresholdOption(10), NamespaceOption([]byte("ns")))
+	require.ErrorContains(t, err, "Namespace")
+	err = tree.Reconfigure(KeyValidatorOption(func([]byte) error { return nil }))
+	require.ErrorContains(t, err, "KeyValidator")
+	require.Equal(t, 1000, tree.ndb.opts.FlushThreshold)
+	require.NoError(t, tree.Reconfigure(StatOption(tree.ndb.opts.Stat)))
+
+	// another closure of the same literal is a change too, and the unchanged hooks aren't
+	hook := func(calls *int) func(AccessOp, []byte, int64) {
+		return func(AccessOp, []byte, int64) { *calls++ }
+	}
+	var first, second int
+	hooked := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), AccessHookOption(hook(&first)))
+	err = hooked.Reconfigure(AccessHookOption(hook(&second)))
+	require.ErrorContains(t, err, "AccessHook")
+	require.NoError(t, hooked.Reconfigure(FlushThresholdOption(10)))
+	require.ErrorContains(t, hooked.Reconfigure(AccessHookOption(nil)), "AccessHook")
+
+	require.NoError(t, tree.Close())
+	require.ErrorIs(t, tree.Reconfigure(), ErrTreeClosed)
+}
@@ -0,0 +1,291 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	corestore "cosmossdk.io/core/store"
+
+	dbm "github.com/cosmos/iavl/db"
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// namespaceDB confines the nodeDB of a tree with Options.Namespace to its namespace of a shared
+// database. It passes the optional interfaces of the database through, and doesn't close it, since
+// it is shared with other trees.
+//
+// It is the layer of the nodeDB beneath its key formats, rather than a prefix of every key format:
+// the nodeDB slices the format byte off the keys it iterates in many places, and the same prefix
+// applies to the cold storage and the fast index shards, which the nodeDB reaches through their
+// own wrappers. Unlike a dbm prefix wrapper given by the caller, it is created by newNodeDB from
+// the options, so the pruning and the stats of NamespaceUsage see the same keys as the tree.
+type namespaceDB struct {
+	db     corestore.KVStoreWithBatch
+	prefix []byte
+}
+
+var (
+	_ corestore.KVStoreWithBatch = (*namespaceDB)(nil)
+	_ dbm.MultiGetter            = (*namespaceDB)(nil)
+	_ dbm.HintedDB               = (*namespaceDB)(nil)
+	_ dbm.CompactionDebtReporter = (*namespaceDB)(nil)
+)
+
+func newNamespaceDB(db corestore.KVStoreWithBatch, namespace []byte) *namespaceDB {
+	return &namespaceDB{db: db, prefix: namespacePrefix(namespace)}
+}
+
+// namespacePrefix returns the prefix of the keys of the namespace.
+func namespacePrefix(namespace []byte) []byte {
+	return namespaceKeyFormat.KeyBytes(append(binary.AppendUvarint(nil, uint64(len(namespace))), namespace...))
+}
+
+func (nsdb *namespaceDB) prefixed(key []byte) []byte {
+	pkey := make([]byte, 0, len(nsdb.prefix)+len(key))
+	return append(append(pkey, nsdb.prefix...), key...)
+}
+
+// Get implements corestore.KVStore.
+func (nsdb *namespaceDB) Get(key []byte) ([]byte, error) {
+	return nsdb.db.Get(nsdb.prefixed(key))
+}
+
+// Has implements corestore.KVStore.
+func (nsdb *namespaceDB) Has(key []byte) (bool, error) {
+	return nsdb.db.Has(nsdb.prefixed(key))
+}
+
+// Set implements corestore.KVStore.
+func (nsdb *namespaceDB) Set(key, value []byte) error {
+	return nsdb.db.Set(nsdb.prefixed(key), value)
+}
+
+// Delete implements corestore.KVStore.
+func (nsdb *namespaceDB) Delete(key []byte) error {
+	return nsdb.db.Delete(nsdb.prefixed(key))
+}
+
+// MultiGet implements dbm.MultiGetter, with a single call if the shared database implements it.
+func (nsdb *namespaceDB) MultiGet(keys [][]byte) ([][]byte, error) {
+	pkeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		pkeys[i] = nsdb.prefixed(key)
+	}
+	if mg, ok := nsdb.db.(dbm.MultiGetter); ok {
+		return mg.MultiGet(pkeys)
+	}
+	values := make([][]byte, len(keys))
+	for i, pkey := range pkeys {
+		value, err := nsdb.db.Get(pkey)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// domain returns the domain of the shared database for the domain of the namespace.
+func (nsdb *namespaceDB) domain(start, end []byte) ([]byte, []byte) {
+	pstart, pend := nsdb.prefix, ibytes.CpIncr(nsdb.prefix)
+	if start != nil {
+		pstart = nsdb.prefixed(start)
+	}
+	if end != nil {
+		pend = nsdb.prefixed(end)
+	}
+	return pstart, pend
+}
+
+// Iterator implements corestore.KVStore.
+func (nsdb *namespaceDB) Iterator(start, end []byte) (corestore.Iterator, error) {
+	return nsdb.IteratorWithHint(start, end, true, dbm.Hint{})
+}
+
+// ReverseIterator implements corestore.KVStore.
+func (nsdb *namespaceDB) ReverseIterator(start, end []byte) (corestore.Iterator, error) {
+	return nsdb.IteratorWithHint(start, end, false, dbm.Hint{})
+}
+
+// IteratorWithHint implements dbm.HintedDB, passing the hint through if the shared database
+// implements it.
+func (nsdb *namespaceDB) IteratorWithHint(start, end []byte, ascending bool, hint dbm.Hint) (corestore.Iterator, error) {
+	pstart, pend := nsdb.domain(start, end)
+	var (
+		source corestore.Iterator
+		err    error
+	)
+	switch hinted, ok := nsdb.db.(dbm.HintedDB); {
+	case ok && hint != (dbm.Hint{}):
+		source, err = hinted.IteratorWithHint(pstart, pend, ascending, hint)
+	case ascending:
+		source, err = nsdb.db.Iterator(pstart, pend)
+	default:
+		source, err = nsdb.db.ReverseIterator(pstart, pend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceIterator{source: source, prefix: nsdb.prefix, start: start, end: end}, nil
+}
+
+// NewBatch implements corestore.KVStoreWithBatch.
+func (nsdb *namespaceDB) NewBatch() corestore.Batch {
+	return &namespaceBatch{source: nsdb.db.NewBatch(), nsdb: nsdb}
+}
+
+// NewBatchWithSize implements corestore.KVStoreWithBatch.
+func (nsdb *namespaceDB) NewBatchWithSize(size int) corestore.Batch {
+	return &namespaceBatch{source: nsdb.db.NewBatchWithSize(size), nsdb: nsdb}
+}
+
+// NewBatchWithHint implements dbm.HintedDB, passing the hint through if the shared database
+// implements it.
+func (nsdb *namespaceDB) NewBatchWithHint(hint dbm.Hint) corestore.Batch {
+	if hinted, ok := nsdb.db.(dbm.HintedDB); ok {
+		return &namespaceBatch{source: hinted.NewBatchWithHint(hint), nsdb: nsdb}
+	}
+	return nsdb.NewBatch()
+}
+
+// CompactionDebt implements dbm.CompactionDebtReporter, with the debt of the shared database, or
+// none if it doesn't report it.
+func (nsdb *namespaceDB) CompactionDebt() (int64, error) {
+	if reporter, ok := nsdb.db.(dbm.CompactionDebtReporter); ok {
+		return reporter.CompactionDebt()
+	}
+	return 0, nil
+}
+
+// Close implements corestore.KVStore. The shared database is left open.
+func (nsdb *namespaceDB) Close() error {
+	return nil
+}
+
+// namespaceIterator strips the namespace prefix from the keys of an iterator over the shared
+// database.
+type namespaceIterator struct {
+	source     corestore.Iterator
+	prefix     []byte
+	start, end []byte
+	err        error
+}
+
+var _ corestore.Iterator = (*namespaceIterator)(nil)
+
+// Domain implements corestore.Iterator.
+func (itr *namespaceIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements corestore.Iterator.
+func (itr *namespaceIterator) Valid() bool {
+	if itr.err != nil || !itr.source.Valid() {
+		return false
+	}
+	if !bytes.HasPrefix(itr.source.Key(), itr.prefix) {
+		itr.err = fmt.Errorf("received key %X outside of the namespace %X", itr.source.Key(), itr.prefix)
+		return false
+	}
+	return true
+}
+
+// Next implements corestore.Iterator.
+func (itr *namespaceIterator) Next() {
+	itr.source.Next()
+}
+
+// Key implements corestore.Iterator.
+func (itr *namespaceIterator) Key() []byte {
+	return itr.source.Key()[len(itr.prefix):]
+}
+
+// Value implements corestore.Iterator.
+func (itr *namespaceIterator) Value() []byte {
+	return itr.source.Value()
+}
+
+// Error implements corestore.Iterator.
+func (itr *namespaceIterator) Error() error {
+	if err := itr.source.Error(); err != nil {
+		return err
+	}
+	return itr.err
+}
+
+// Close implements corestore.Iterator.
+func (itr *namespaceIterator) Close() error {
+	return itr.source.Close()
+}
+
+// namespaceBatch prefixes the keys of a batch of the shared database with the namespace.
+type namespaceBatch struct {
+	source corestore.Batch
+	nsdb   *namespaceDB
+}
+
+var _ corestore.Batch = (*namespaceBatch)(nil)
+
+// Set implements corestore.Batch.
+func (b *namespaceBatch) Set(key, value []byte) error {
+	if len(key) == 0 {
+		return errors.New("key is empty")
+	}
+	return b.source.Set(b.nsdb.prefixed(key), value)
+}
+
+// Delete implements corestore.Batch.
+func (b *namespaceBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errors.New("key is empty")
+	}
+	return b.source.Delete(b.nsdb.prefixed(key))
+}
+
+// Write implements corestore.Batch.
+func (b *namespaceBatch) Write() error {
+	return b.source.Write()
+}
+
+// WriteSync implements corestore.Batch.
+func (b *namespaceBatch) WriteSync() error {
+	return b.source.WriteSync()
+}
+
+// Close implements corestore.Batch.
+func (b *namespaceBatch) Close() error {
+	return b.source.Close()
+}
+
+// GetByteSize implements corestore.Batch.
+func (b *namespaceBatch) GetByteSize() (int, error) {
+	return b.source.GetByteSize()
+}
+
+// StorageUsage is the storage used by a tree, see NamespaceUsage.
+type StorageUsage struct {
+	// Keys is the number of keys.
+	Keys int64
+	// Bytes is the total size of the keys, without the namespace, and values.
+	Bytes int64
+}
+
+// NamespaceUsage scans the keys of the trees stored under the namespace of the shared database,
+// see Options.Namespace, and returns their storage usage, e.g. to find the trees pruning should
+// catch up on. It reads the whole namespace, so it is meant for diagnostics.
+func NamespaceUsage(db corestore.KVStoreWithBatch, namespace []byte) (StorageUsage, error) {
+	var usage StorageUsage
+	itr, err := newNamespaceDB(db, namespace).Iterator(nil, nil)
+	if err != nil {
+		return usage, err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		usage.Keys++
+		usage.Bytes += int64(len(itr.Key()) + len(itr.Value()))
+	}
+	return usage, itr.Error()
+}
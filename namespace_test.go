@@ -0,0 +1,64 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestNamespace(t *testing.T) {
+	db := dbm.NewMemDB()
+	// "a" is a prefix of "ab", but their keys must not overlap
+	treeA := NewMutableTree(db, 0, false, NewNopLogger(), NamespaceOption([]byte("a")))
+	treeAB := NewMutableTree(db, 0, false, NewNopLogger(), NamespaceOption([]byte("ab")))
+
+	for i := 0; i < 5; i++ {
+		for _, tree := range []*MutableTree{treeA, treeAB} {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	require.Equal(t, treeA.Hash(), treeAB.Hash())
+
+	usageA, err := NamespaceUsage(db, []byte("a"))
+	require.NoError(t, err)
+	usageAB, err := NamespaceUsage(db, []byte("ab"))
+	require.NoError(t, err)
+	require.Equal(t, usageA, usageAB)
+
+	// pruning one tree leaves the other one alone
+	require.NoError(t, treeA.DeleteVersionsTo(3))
+	pruned, err := NamespaceUsage(db, []byte("a"))
+	require.NoError(t, err)
+	require.Less(t, pruned.Keys, usageA.Keys)
+	unchanged, err := NamespaceUsage(db, []byte("ab"))
+	require.NoError(t, err)
+	require.Equal(t, usageAB, unchanged)
+
+	// both trees load from the shared database
+	for _, namespace := range []string{"a", "ab"} {
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), NamespaceOption([]byte(namespace)))
+		version, err := tree.Load()
+		require.NoError(t, err)
+		require.EqualValues(t, 5, version)
+		require.Equal(t, treeA.Hash(), tree.Hash())
+		value, err := tree.Get([]byte("k2"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("v2"), value)
+	}
+	require.True(t, treeAB.VersionExists(1))
+	require.False(t, treeA.VersionExists(1))
+
+	// there is nothing outside of the namespaces
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		require.Equal(t, byte('t'), itr.Key()[0], "%X", itr.Key())
+	}
+}
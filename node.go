@@ -9,8 +9,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"math"
+	"unsafe"
 
 	"github.com/cosmos/iavl/cache"
 
@@ -23,6 +25,19 @@ const (
 	ModeLegacyLeftNode = 0x01
 	// ModeLegacyRightNode is the mode for legacy right child in the node encoding/decoding.
 	ModeLegacyRightNode = 0x02
+	// ModeKeyPrefix is the mode for an inner node key stored without its shared prefix, see
+	// Options.KeyPrefixDictionary. The prefix id follows the mode.
+	ModeKeyPrefix = 0x04
+
+	// LeafModeValueRef is the leaf mode for a value stored by its hash in the nodeDB, see
+	// Options.DedupValueThreshold. The leaf mode follows the value and is omitted if zero.
+	LeafModeValueRef = 0x01
+	// LeafModeKeyPrefix is the leaf mode for a leaf key stored without its shared prefix, see
+	// Options.KeyPrefixDictionary. The prefix id follows the leaf mode.
+	LeafModeKeyPrefix = 0x02
+	// LeafModeValueChecksum is the leaf mode for a leaf stored with the checksum of its stored
+	// value, see Options.ValueChecksums. The checksum follows the prefix id.
+	LeafModeValueChecksum = 0x04
 )
 
 // NodeKey represents a key of node in the DB.
@@ -47,6 +62,11 @@ func GetNodeKey(key []byte) *NodeKey {
 	}
 }
 
+// NewNodeKey returns the NodeKey of the node with the given version and nonce.
+func NewNodeKey(version int64, nonce uint32) *NodeKey {
+	return &NodeKey{version: version, nonce: nonce}
+}
+
 // GetRootKey returns a byte slice of the root node key for the given version.
 func GetRootKey(version int64) []byte {
 	b := make([]byte, 12)
@@ -72,6 +92,9 @@ type Node struct {
 	rightNode     *Node
 	subtreeHeight int8
 	isLegacy      bool
+	valueRef      bool   // the value is stored by its hash, see LeafModeValueRef
+	valueChecksum bool   // the stored value was checksummed, see LeafModeValueChecksum
+	keyPrefixID   uint32 // the key lacks the shared prefix with this id until the nodeDB resolves it
 }
 
 var _ cache.Node = (*Node)(nil)
@@ -94,32 +117,44 @@ func (node *Node) GetKey() []byte {
 	return node.nodeKey.GetKey()
 }
 
-// MakeNode constructs an *Node from an encoded byte slice.
+// MakeNode constructs an *Node from an encoded byte slice. The value of a leaf stored with
+// LeafModeValueRef is its value hash, and the key of a node stored with a key prefix lacks the
+// prefix, until the nodeDB resolves them.
 func MakeNode(nk, buf []byte) (*Node, error) {
+	node := &Node{}
+	if err := MakeNodeInto(node, nk, buf); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// MakeNodeInto is like MakeNode, but decodes into the given node, e.g. from a NodePool, instead of
+// allocating one. All fields of the node are overwritten.
+func MakeNodeInto(node *Node, nk, buf []byte) error {
 	// Read node header (height, size, key).
 	height, n, err := encoding.DecodeVarint(buf)
 	if err != nil {
-		return nil, fmt.Errorf("decoding node.height, %w", err)
+		return fmt.Errorf("decoding node.height, %w", err)
 	}
 	buf = buf[n:]
 	height8 := int8(height)
 	if height != int64(height8) {
-		return nil, errors.New("invalid height, out of int8 range")
+		return errors.New("invalid height, out of int8 range")
 	}
 
 	size, n, err := encoding.DecodeVarint(buf)
 	if err != nil {
-		return nil, fmt.Errorf("decoding node.size, %w", err)
+		return fmt.Errorf("decoding node.size, %w", err)
 	}
 	buf = buf[n:]
 
 	key, n, err := encoding.DecodeBytes(buf)
 	if err != nil {
-		return nil, fmt.Errorf("decoding node.key, %w", err)
+		return fmt.Errorf("decoding node.key, %w", err)
 	}
 	buf = buf[n:]
 
-	node := &Node{
+	*node = Node{
 		subtreeHeight: height8,
 		size:          size,
 		nodeKey:       GetNodeKey(nk),
@@ -128,33 +163,73 @@ func MakeNode(nk, buf []byte) (*Node, error) {
 
 	// Read node body.
 	if node.isLeaf() {
-		val, _, err := encoding.DecodeBytes(buf)
+		val, n, err := encoding.DecodeBytes(buf)
 		if err != nil {
-			return nil, fmt.Errorf("decoding node.value, %w", err)
+			return fmt.Errorf("decoding node.value, %w", err)
 		}
+		buf = buf[n:]
 		node.value = val
+
+		var mode int64
+		if len(buf) > 0 {
+			mode, n, err = encoding.DecodeVarint(buf)
+			if err != nil {
+				return fmt.Errorf("decoding leaf mode, %w", err)
+			}
+			if mode&^(LeafModeValueRef|LeafModeKeyPrefix|LeafModeValueChecksum) != 0 {
+				return errors.New("invalid leaf mode")
+			}
+			buf = buf[n:]
+		}
+		if mode&LeafModeKeyPrefix != 0 {
+			if node.keyPrefixID, n, err = decodeKeyPrefixID(buf); err != nil {
+				return err
+			}
+			buf = buf[n:]
+		}
+		if mode&LeafModeValueChecksum != 0 {
+			// the value of a leaf stored with LeafModeValueRef is its hash, which the nodeDB
+			// verifies the referenced value against
+			if err := encoding.VerifyChecksum(buf, node.value); err != nil {
+				return fmt.Errorf("verifying node.value, %w", err)
+			}
+			node.valueChecksum = true
+		}
+		if mode&LeafModeValueRef != 0 {
+			node.valueRef = true
+		}
+		if node.valueRef || node.keyPrefixID != 0 {
+			// the node is hashed once the nodeDB resolved its key and value
+			return nil
+		}
 		// ensure take the hash for the leaf node
 		node._hash(node.nodeKey.version)
 	} else { // Read children.
 		node.hash, n, err = encoding.DecodeBytes(buf)
 		if err != nil {
-			return nil, fmt.Errorf("decoding node.hash, %w", err)
+			return fmt.Errorf("decoding node.hash, %w", err)
 		}
 		buf = buf[n:]
 
 		mode, n, err := encoding.DecodeVarint(buf)
 		if err != nil {
-			return nil, fmt.Errorf("decoding mode, %w", err)
+			return fmt.Errorf("decoding mode, %w", err)
 		}
 		buf = buf[n:]
-		if mode < 0 || mode > 3 {
-			return nil, errors.New("invalid mode")
+		if mode < 0 || mode > 7 {
+			return errors.New("invalid mode")
+		}
+		if mode&ModeKeyPrefix != 0 {
+			if node.keyPrefixID, n, err = decodeKeyPrefixID(buf); err != nil {
+				return err
+			}
+			buf = buf[n:]
 		}
 
 		if mode&ModeLegacyLeftNode != 0 { // legacy leftNodeKey
 			node.leftNodeKey, n, err = encoding.DecodeBytes(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding legacy node.leftNodeKey, %w", err)
+				return fmt.Errorf("decoding legacy node.leftNodeKey, %w", err)
 			}
 			buf = buf[n:]
 		} else {
@@ -164,24 +239,24 @@ func MakeNode(nk, buf []byte) (*Node, error) {
 			)
 			leftNodeKey.version, n, err = encoding.DecodeVarint(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding node.leftNodeKey.version, %w", err)
+				return fmt.Errorf("decoding node.leftNodeKey.version, %w", err)
 			}
 			buf = buf[n:]
 			nonce, n, err = encoding.DecodeVarint(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding node.leftNodeKey.nonce, %w", err)
+				return fmt.Errorf("decoding node.leftNodeKey.nonce, %w", err)
 			}
 			buf = buf[n:]
 			leftNodeKey.nonce = uint32(nonce)
 			if nonce != int64(leftNodeKey.nonce) {
-				return nil, errors.New("invalid leftNodeKey.nonce, out of int32 range")
+				return errors.New("invalid leftNodeKey.nonce, out of int32 range")
 			}
 			node.leftNodeKey = leftNodeKey.GetKey()
 		}
 		if mode&ModeLegacyRightNode != 0 { // legacy rightNodeKey
 			node.rightNodeKey, _, err = encoding.DecodeBytes(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding legacy node.rightNodeKey, %w", err)
+				return fmt.Errorf("decoding legacy node.rightNodeKey, %w", err)
 			}
 		} else {
 			var (
@@ -190,21 +265,21 @@ func MakeNode(nk, buf []byte) (*Node, error) {
 			)
 			rightNodeKey.version, n, err = encoding.DecodeVarint(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding node.rightNodeKey.version, %w", err)
+				return fmt.Errorf("decoding node.rightNodeKey.version, %w", err)
 			}
 			buf = buf[n:]
 			nonce, _, err = encoding.DecodeVarint(buf)
 			if err != nil {
-				return nil, fmt.Errorf("decoding node.rightNodeKey.nonce, %w", err)
+				return fmt.Errorf("decoding node.rightNodeKey.nonce, %w", err)
 			}
 			rightNodeKey.nonce = uint32(nonce)
 			if nonce != int64(rightNodeKey.nonce) {
-				return nil, errors.New("invalid rightNodeKey.nonce, out of int32 range")
+				return errors.New("invalid rightNodeKey.nonce, out of int32 range")
 			}
 			node.rightNodeKey = rightNodeKey.GetKey()
 		}
 	}
-	return node, nil
+	return nil
 }
 
 // MakeLegacyNode constructs a legacy *Node from an encoded byte slice.
@@ -345,6 +420,9 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 		if err != nil {
 			return false, err
 		}
+		if err := t.checkChild(node, leftNode); err != nil {
+			return false, err
+		}
 		return leftNode.has(t, key)
 	}
 
@@ -352,6 +430,9 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 	if err != nil {
 		return false, err
 	}
+	if err := t.checkChild(node, rightNode); err != nil {
+		return false, err
+	}
 
 	return rightNode.has(t, key)
 }
@@ -377,6 +458,9 @@ func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte,
 		if err != nil {
 			return 0, nil, err
 		}
+		if err := t.checkChild(node, leftNode); err != nil {
+			return 0, nil, err
+		}
 
 		return leftNode.get(t, key)
 	}
@@ -385,6 +469,9 @@ func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte,
 	if err != nil {
 		return 0, nil, err
 	}
+	if err := t.checkChild(node, rightNode); err != nil {
+		return 0, nil, err
+	}
 
 	index, value, err = rightNode.get(t, key)
 	if err != nil {
@@ -410,6 +497,9 @@ func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value [
 	}
 
 	if index < leftNode.size {
+		if err := t.checkChild(node, leftNode); err != nil {
+			return nil, nil, err
+		}
 		return leftNode.getByIndex(t, index)
 	}
 
@@ -417,6 +507,9 @@ func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value [
 	if err != nil {
 		return nil, nil, err
 	}
+	if err := t.checkChild(node, rightNode); err != nil {
+		return nil, nil, err
+	}
 
 	return rightNode.getByIndex(t, index-leftNode.size)
 }
@@ -460,6 +553,39 @@ func (node *Node) hashWithCount(version int64) []byte {
 	return node.hash
 }
 
+// computeHash is like hashWithCount, but doesn't store the hashes it computes in the nodes, so
+// the nodes are left as they are. The hasher and buf are scratch space reused across the subtree.
+func (node *Node) computeHash(version int64, hasher hash.Hash, buf *bytes.Buffer) ([]byte, error) {
+	if node == nil {
+		return sha256.New().Sum(nil), nil
+	}
+	if node.hash != nil {
+		return node.hash, nil
+	}
+
+	var leftHash, rightHash []byte
+	if !node.isLeaf() {
+		if node.leftNode == nil || node.rightNode == nil {
+			return nil, ErrEmptyChild
+		}
+		var err error
+		if leftHash, err = node.leftNode.computeHash(version, hasher, buf); err != nil {
+			return nil, err
+		}
+		if rightHash, err = node.rightNode.computeHash(version, hasher, buf); err != nil {
+			return nil, err
+		}
+	}
+
+	buf.Reset()
+	if err := node.writeHashBytesWithChildren(buf, version, leftHash, rightHash); err != nil {
+		return nil, err
+	}
+	hasher.Reset()
+	hasher.Write(buf.Bytes())
+	return hasher.Sum(nil), nil
+}
+
 // validate validates the node contents
 func (node *Node) validate() error {
 	if node == nil {
@@ -501,6 +627,17 @@ func (node *Node) validate() error {
 // Writes the node's hash to the given io.Writer. This function expects
 // child hashes to be already set.
 func (node *Node) writeHashBytes(w io.Writer, version int64) error {
+	if node.isLeaf() {
+		return node.writeHashBytesWithChildren(w, version, nil, nil)
+	}
+	if node.leftNode == nil || node.rightNode == nil {
+		return ErrEmptyChild
+	}
+	return node.writeHashBytesWithChildren(w, version, node.leftNode.hash, node.rightNode.hash)
+}
+
+// writeHashBytesWithChildren is like writeHashBytes, with the given child hashes of an inner node.
+func (node *Node) writeHashBytesWithChildren(w io.Writer, version int64, leftHash, rightHash []byte) error {
 	err := encoding.EncodeVarint(w, int64(node.subtreeHeight))
 	if err != nil {
 		return fmt.Errorf("writing height, %w", err)
@@ -524,6 +661,8 @@ func (node *Node) writeHashBytes(w io.Writer, version int64) error {
 
 		// Indirection needed to provide proofs without values.
 		// (e.g. ProofLeafNode.ValueHash)
+		// The value is hashed in place, only its hash is written to w, so large values are never
+		// copied into the hashing buffers.
 		valueHash := sha256.Sum256(node.value)
 
 		err = encoding.Encode32BytesHash(w, valueHash[:])
@@ -531,14 +670,11 @@ func (node *Node) writeHashBytes(w io.Writer, version int64) error {
 			return fmt.Errorf("writing value, %w", err)
 		}
 	} else {
-		if node.leftNode == nil || node.rightNode == nil {
-			return ErrEmptyChild
-		}
-		err = encoding.Encode32BytesHash(w, node.leftNode.hash)
+		err = encoding.Encode32BytesHash(w, leftHash)
 		if err != nil {
 			return fmt.Errorf("writing left hash, %w", err)
 		}
-		err = encoding.Encode32BytesHash(w, node.rightNode.hash)
+		err = encoding.Encode32BytesHash(w, rightHash)
 		if err != nil {
 			return fmt.Errorf("writing right hash, %w", err)
 		}
@@ -561,7 +697,11 @@ func (node *Node) encodedSize() int {
 		encoding.EncodeVarintSize(node.size) +
 		encoding.EncodeBytesSize(node.key)
 	if node.isLeaf() {
-		n += encoding.EncodeBytesSize(node.value)
+		if node.valueRef {
+			n += encoding.EncodeBytesSize(make([]byte, hashSize)) + 1
+		} else {
+			n += encoding.EncodeBytesSize(node.value)
+		}
 	} else {
 		n += encoding.EncodeBytesSize(node.hash)
 		if node.leftNodeKey != nil {
@@ -578,11 +718,43 @@ func (node *Node) encodedSize() int {
 	return n
 }
 
+// nodeStructSize is the in-memory size of the Node struct itself.
+const nodeStructSize = int(unsafe.Sizeof(Node{})) + int(unsafe.Sizeof(NodeKey{}))
+
+// memSize estimates the number of bytes of memory held by the node, used by the adaptive cache.
+func (node *Node) memSize() int {
+	return nodeStructSize + len(node.key) + len(node.value) + len(node.hash) +
+		len(node.leftNodeKey) + len(node.rightNodeKey)
+}
+
+// decodeKeyPrefixID decodes the key prefix id at the start of buf, returning it along with the
+// number of bytes read.
+func decodeKeyPrefixID(buf []byte) (uint32, int, error) {
+	id, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return 0, 0, fmt.Errorf("decoding key prefix id, %w", err)
+	}
+	if id <= 0 || id != int64(uint32(id)) {
+		return 0, 0, errors.New("invalid key prefix id")
+	}
+	return uint32(id), n, nil
+}
+
 // Writes the node as a serialized byte slice to the supplied io.Writer.
 func (node *Node) writeBytes(w io.Writer) error {
+	return node.writeBytesWithKeyPrefix(w, 0, 0, false)
+}
+
+// writeBytesWithKeyPrefix writes the node like writeBytes, replacing the first prefixLen bytes of
+// its key with the key prefix id. A zero id writes the full key. If checksum is set, a leaf is
+// written with the checksum of its stored value.
+func (node *Node) writeBytesWithKeyPrefix(w io.Writer, prefixID uint32, prefixLen int, checksum bool) error {
 	if node == nil {
 		return errors.New("cannot write nil node")
 	}
+	if prefixID == 0 {
+		prefixLen = 0
+	}
 	err := encoding.EncodeVarint(w, int64(node.subtreeHeight))
 	if err != nil {
 		return fmt.Errorf("writing height, %w", err)
@@ -593,15 +765,51 @@ func (node *Node) writeBytes(w io.Writer) error {
 	}
 
 	// Unlike writeHashBytes, key is written for inner nodes.
-	err = encoding.EncodeBytes(w, node.key)
+	err = encoding.EncodeBytes(w, node.key[prefixLen:])
 	if err != nil {
 		return fmt.Errorf("writing key, %w", err)
 	}
 
 	if node.isLeaf() {
-		err = encoding.EncodeBytes(w, node.value)
-		if err != nil {
-			return fmt.Errorf("writing value, %w", err)
+		mode := int64(0)
+		storedValue := node.value
+		if node.valueRef {
+			mode |= LeafModeValueRef
+			valueHash := sha256.Sum256(node.value)
+			storedValue = valueHash[:]
+			err = encoding.EncodeBytes(w, storedValue)
+			if err != nil {
+				return fmt.Errorf("writing value hash, %w", err)
+			}
+		} else {
+			err = encoding.EncodeBytes(w, node.value)
+			if err != nil {
+				return fmt.Errorf("writing value, %w", err)
+			}
+		}
+		if prefixID != 0 {
+			mode |= LeafModeKeyPrefix
+		}
+		if checksum {
+			mode |= LeafModeValueChecksum
+		}
+		if mode != 0 {
+			err = encoding.EncodeVarint(w, mode)
+			if err != nil {
+				return fmt.Errorf("writing leaf mode, %w", err)
+			}
+		}
+		if prefixID != 0 {
+			err = encoding.EncodeVarint(w, int64(prefixID))
+			if err != nil {
+				return fmt.Errorf("writing key prefix id, %w", err)
+			}
+		}
+		if checksum {
+			err = encoding.EncodeChecksum(w, storedValue)
+			if err != nil {
+				return fmt.Errorf("writing value checksum, %w", err)
+			}
 		}
 	} else {
 		err = encoding.Encode32BytesHash(w, node.hash)
@@ -619,10 +827,19 @@ func (node *Node) writeBytes(w io.Writer) error {
 		if len(node.rightNodeKey) == hashSize {
 			mode += ModeLegacyRightNode
 		}
+		if prefixID != 0 {
+			mode += ModeKeyPrefix
+		}
 		err = encoding.EncodeVarint(w, int64(mode))
 		if err != nil {
 			return fmt.Errorf("writing mode, %w", err)
 		}
+		if prefixID != 0 {
+			err = encoding.EncodeVarint(w, int64(prefixID))
+			if err != nil {
+				return fmt.Errorf("writing key prefix id, %w", err)
+			}
+		}
 		if mode&ModeLegacyLeftNode != 0 { // legacy leftNodeKey
 			err = encoding.Encode32BytesHash(w, node.leftNodeKey)
 			if err != nil {
@@ -666,7 +883,7 @@ func (node *Node) getLeftNode(t *ImmutableTree) (*Node, error) {
 	if node.leftNode != nil {
 		return node.leftNode, nil
 	}
-	leftNode, err := t.ndb.GetNode(node.leftNodeKey)
+	leftNode, err := t.getNode(node.leftNodeKey)
 	if err != nil {
 		return nil, err
 	}
@@ -677,13 +894,26 @@ func (node *Node) getRightNode(t *ImmutableTree) (*Node, error) {
 	if node.rightNode != nil {
 		return node.rightNode, nil
 	}
-	rightNode, err := t.ndb.GetNode(node.rightNodeKey)
+	rightNode, err := t.getNode(node.rightNodeKey)
 	if err != nil {
 		return nil, err
 	}
 	return rightNode, nil
 }
 
+// checkChild guards the recursive descents from node to its child: it fails if node is higher than
+// Options.MaxDepth, or if the child isn't lower than node, which also catches a cyclic node
+// reference, so the depth of the recursion is bounded by the height of the root.
+func (t *ImmutableTree) checkChild(node, child *Node) error {
+	if t.ndb != nil && t.ndb.opts.MaxDepth > 0 && int(node.subtreeHeight) > t.ndb.opts.MaxDepth {
+		return fmt.Errorf("%w: node %v has height %d, above %d", ErrMaxDepthExceeded, node.nodeKey, node.subtreeHeight, t.ndb.opts.MaxDepth)
+	}
+	if child.subtreeHeight >= node.subtreeHeight {
+		return fmt.Errorf("%w: node %v of height %d has child %v of height %d", ErrCorruptNode, node.nodeKey, node.subtreeHeight, child.nodeKey, child.subtreeHeight)
+	}
+	return nil
+}
+
 // NOTE: mutates height and size
 func (node *Node) calcHeightAndSize(t *ImmutableTree) error {
 	leftNode, err := node.getLeftNode(t)
@@ -749,4 +979,5 @@ var (
 	ErrRightNodeKeyEmpty = fmt.Errorf("node.rightNodeKey was empty in writeBytes")
 	ErrLeftHashIsNil     = fmt.Errorf("node.leftHash was nil in writeBytes")
 	ErrRightHashIsNil    = fmt.Errorf("node.rightHash was nil in writeBytes")
+	ErrMaxDepthExceeded  = errors.New("tree exceeds the maximum depth")
 )
@@ -0,0 +1,29 @@
+package iavl
+
+import "sync"
+
+// NodePool recycles the nodes decoded by the transient reads of the nodeDB, see Options.NodePool,
+// so steady-state pruning doesn't allocate a node for every node it visits. It is safe for
+// concurrent use.
+type NodePool struct {
+	pool sync.Pool
+}
+
+// NewNodePool returns an empty NodePool.
+func NewNodePool() *NodePool {
+	return &NodePool{pool: sync.Pool{New: func() interface{} { return &Node{} }}}
+}
+
+// Get returns a node of the pool, or a new one if it is empty. Its fields are meant to be
+// overwritten, e.g. by MakeNodeInto.
+func (np *NodePool) Get() *Node {
+	return np.pool.Get().(*Node)
+}
+
+// Put returns the node to the pool. The node must not be used afterwards, and must not be shared,
+// e.g. with the node cache or a tree.
+func (np *NodePool) Put(node *Node) {
+	// the slices may be shared with a cached copy of the node, so they are dropped, not reused
+	*node = Node{}
+	np.pool.Put(node)
+}
@@ -109,6 +109,11 @@ func TestNode_encode_decode(t *testing.T) {
 				tc.node.value = []byte{}
 			}
 			require.Equal(t, tc.node, node)
+
+			// decoding into a used node overwrites all of its fields
+			into := &Node{key: []byte("stale"), valueRef: true, leftNode: &Node{}}
+			require.NoError(t, MakeNodeInto(into, tc.node.GetKey(), buf.Bytes()))
+			require.Equal(t, tc.node, into)
 		})
 	}
 }
@@ -6,18 +6,24 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"math"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	corestore "cosmossdk.io/core/store"
 
 	"github.com/cosmos/iavl/cache"
+	dbm "github.com/cosmos/iavl/db"
 	"github.com/cosmos/iavl/fastnode"
 	ibytes "github.com/cosmos/iavl/internal/bytes"
+	"github.com/cosmos/iavl/internal/encoding"
 	"github.com/cosmos/iavl/keyformat"
 )
 
@@ -27,6 +33,21 @@ const (
 	hashSize          = sha256.Size
 	genesisVersion    = 1
 	storageVersionKey = "storage_version"
+	keyPrefixesKey    = "key_prefixes"
+	initialVersionKey = "initial_version"
+	coldVersionKey    = "cold_version"
+	// The number of Options.FastIndexShards the fast node index was built with, if any.
+	fastIndexShardsKey = "fast_index_shards"
+	// The Options.BalanceSlack the tree was saved with, if relaxed.
+	balanceSlackKey = "balance_slack"
+	// The version after which MigrateInitialVersion raised the initial version, if any.
+	versionGapKey = "version_gap"
+	// The latest version whose records were all written, see scanLatestVersion.
+	commitVersionKey = "commit_version"
+	// The progress of a background rebuild of the fast node index, see fastIndexRebuildState.
+	fastIndexRebuildKey = "fast_index_rebuild"
+	// Set while the fast nodes of a disabled fast node index are deleted in the background.
+	fastIndexCleanupKey = "fast_index_cleanup"
 	// We store latest saved version together with storage version delimited by the constant below.
 	// This delimiter is valid only if fast storage is enabled (i.e. storageVersion >= fastStorageVersionValue).
 	// The latest saved version is needed for protection against downgrade and re-upgrade. In such a case, it would
@@ -37,6 +58,7 @@ const (
 	defaultStorageVersionValue = "1.0.0"
 	fastStorageVersionValue    = "1.1.0"
 	fastNodeCacheSize          = 100000
+	fastNodeCacheShards        = 64
 )
 
 var (
@@ -67,10 +89,35 @@ var (
 
 	// All legacy root keys are prefixed with the byte 'r'.
 	legacyRootKeyFormat = keyformat.NewKeyFormat('r', int64Size) // r<version>
+
+	// Values deduplicated by Options.DedupValueThreshold are stored by their hash, along with the
+	// number of leaf nodes referring to them.
+	valueKeyFormat    = keyformat.NewFastPrefixFormatter('v', hashSize) // v<hash>
+	valueRefKeyFormat = keyformat.NewFastPrefixFormatter('c', hashSize) // c<hash>
+
+	// The keys of the latest version are indexed by the hash of their value if
+	// Options.ValueHashIndex is set.
+	valueHashIndexKeyFormat = keyformat.NewKeyFormat('x', hashSize, 0) // x<value hash><key>
+
+	// The chained hashes of the versions if Options.ChainedHashes is set. They are not pruned.
+	chainedHashKeyFormat = keyformat.NewKeyFormat('h', int64Size) // h<version>
+
+	// The number of keys of the versions, and their change. They are not pruned.
+	versionSizeKeyFormat = keyformat.NewKeyFormat('z', int64Size) // z<version>
+
+	// The times the versions were saved at. They are not pruned.
+	versionTimeKeyFormat = keyformat.NewKeyFormat('e', int64Size) // e<version>
+
+	// The keys of a tree with Options.Namespace are prefixed with the length-prefixed namespace, so
+	// no namespace is a prefix of another.
+	namespaceKeyFormat = keyformat.NewKeyFormat('t', 0) // t<len(namespace)><namespace><key>
 )
 
 var errInvalidFastStorageVersion = fmt.Errorf("fast storage version must be in the format <storage version>%s<latest fast cache version>", fastStorageVersionDelimiter)
 
+// errStopTraverse is returned by traversal callbacks to stop the traversal early.
+var errStopTraverse = errors.New("stop traverse")
+
 type nodeDB struct {
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -87,18 +134,53 @@ type nodeDB struct {
 	latestVersion       int64                      // Latest version of nodeDB.
 	pruneVersion        int64                      // Version to prune up to.
 	legacyLatestVersion int64                      // Latest version of nodeDB in legacy format.
+	gapFrom             int64                      // Version followed by gapTo, 0 unless MigrateInitialVersion skipped versions.
+	gapTo               int64                      // Initial version raised by MigrateInitialVersion after gapFrom.
 	nodeCache           cache.Cache                // Cache for nodes in the regular tree that consists of key-value pairs at any version.
-	fastNodeCache       cache.Cache                // Cache for nodes in the fast index that represents only key-value pairs at the latest version.
+	fastNodeCache       cache.Cache                // Cache for nodes in the fast index that represents only key-value pairs at the latest version, guarded by fastNodeMtx instead of mtx.
+	fastNodeMtx         sync.RWMutex               // Held for reading by the fast node loads, which fill the cache, and for writing by the cache updates, so a load can't cache a stale node.
 	isCommitting        bool                       // Flag to indicate that the nodeDB is committing.
 	chCommitting        chan struct{}              // Channel to signal that the committing is done.
+	valueRefs           map[string]int64           // Reference counts of deduplicated values changed since the last commit.
+	keyPrefixes         [][]byte                   // Key prefix dictionary, by id - 1, see Options.KeyPrefixDictionary.
+	keyPrefixesUnsaved  bool                       // Set while keyPrefixes has prefixes which aren't on disk yet.
+	fastNodeWriteDone   chan struct{}              // Closed when the pending async fast node write is done.
+	fastNodeWriteErr    error                      // Error of the last async fast node write.
+	latency             *latencyMetrics            // Latency histograms, nil unless Options.LatencyExpvar is set.
+	roots               *rootCache                 // Root node keys of recent versions, nil unless Options.RootCacheSize is set.
+	generations         generationRegistry         // Deletions of versions, to invalidate the ImmutableTrees loaded before.
+	closeOnce           sync.Once                  // Closes the nodeDB on the first call of Close.
+	closeErr            error                      // Error of closing the nodeDB.
+	closed              bool                       // Set once the nodeDB is closed, failing the commits after.
+	commitSeq           atomic.Uint64              // Odd while a version is being committed, see beginCommit.
+	fastIndexShards     int                        // The number of shards the fast node index was built with.
+	balanceSlackChecked bool                       // Whether the recorded balance slack matches the options.
+	balanceSlackUnsaved bool                       // Set while the balance slack is only recorded in the batch.
 }
 
 func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Logger) *nodeDB {
+	if len(opts.Namespace) > 0 {
+		db = newNamespaceDB(db, opts.Namespace)
+	}
+	if opts.ColdStorage != nil {
+		db = newTieredDB(db, opts.ColdStorage, opts.Namespace)
+	}
+	if len(opts.FastIndexShards) > 0 {
+		db = newShardedDB(db, opts.FastIndexShards, opts.Namespace)
+	}
 	storeVersion, err := db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
 
 	if err != nil || storeVersion == nil {
 		storeVersion = []byte(defaultStorageVersionValue)
 	}
+	var fastIndexShards int
+	if string(storeVersion) >= fastStorageVersionValue || len(opts.FastIndexShards) > 0 {
+		fastIndexShards = getFastIndexShards(db)
+	}
+	if string(storeVersion) >= fastStorageVersionValue && fastIndexShards != len(opts.FastIndexShards) {
+		// the fast node index is in the backends of other shards, and is rebuilt on load
+		storeVersion = []byte(defaultStorageVersionValue)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	ndb := &nodeDB{
@@ -106,17 +188,21 @@ func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Lo
 		cancel:              cancel,
 		logger:              lg,
 		db:                  db,
-		batch:               NewBatchWithFlusher(db, opts.FlushThreshold),
+		batch:               NewBatchWithFlusher(db, opts.flushThreshold()),
 		opts:                opts,
 		firstVersion:        0,
 		latestVersion:       0, // initially invalid
 		legacyLatestVersion: 0,
 		pruneVersion:        0,
-		nodeCache:           cache.New(cacheSize),
-		fastNodeCache:       cache.New(fastNodeCacheSize),
+		nodeCache:           newNodeCache(cacheSize, opts),
+		fastNodeCache:       newFastNodeCache(opts),
 		versionReaders:      make(map[int64]uint32, 8),
 		storageVersion:      string(storeVersion),
 		chCommitting:        make(chan struct{}, 1),
+		valueRefs:           make(map[string]int64),
+		latency:             publishLatencyMetrics(opts.LatencyExpvar),
+		roots:               newRootCache(opts.RootCacheSize),
+		fastIndexShards:     fastIndexShards,
 	}
 
 	if opts.AsyncPruning {
@@ -124,75 +210,442 @@ func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Lo
 		go ndb.startPruning()
 	}
 
+	// the dictionary is loaded again by the tree loads, which fail on an error
+	if err := ndb.loadKeyPrefixes(); err != nil {
+		lg.Error("failed to load the key prefix dictionary", "err", err)
+	}
+
 	return ndb
 }
 
+// getKeyPrefixes returns the key prefix dictionary. The prefixes are only appended, so the returned
+// slice stays valid.
+func (ndb *nodeDB) getKeyPrefixes() [][]byte {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.keyPrefixes
+}
+
+// loadKeyPrefixes loads the persisted key prefix dictionary.
+func (ndb *nodeDB) loadKeyPrefixes() error {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(keyPrefixesKey)))
+	if err != nil {
+		return fmt.Errorf("failed to load the key prefix dictionary: %w", err)
+	}
+	var prefixes [][]byte
+	for len(bz) > 0 {
+		prefix, n, err := encoding.DecodeBytes(bz)
+		if err != nil {
+			return fmt.Errorf("invalid key prefix dictionary: %w", err)
+		}
+		prefixes = append(prefixes, prefix)
+		bz = bz[n:]
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.keyPrefixes = prefixes
+	ndb.keyPrefixesUnsaved = false
+	return nil
+}
+
+// setKeyPrefixesToBatch appends the configured key prefixes missing from the dictionary, and writes
+// it to the batch if it changed since it was last written. It is called before the nodes of a
+// version are written, so they only use the prefixes written with them or before.
+func (ndb *nodeDB) setKeyPrefixesToBatch() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	for _, prefix := range ndb.opts.KeyPrefixDictionary {
+		if len(prefix) > 0 && !slices.ContainsFunc(ndb.keyPrefixes, func(p []byte) bool { return bytes.Equal(p, prefix) }) {
+			ndb.keyPrefixes = append(ndb.keyPrefixes, bytes.Clone(prefix))
+			ndb.keyPrefixesUnsaved = true
+		}
+	}
+	if !ndb.keyPrefixesUnsaved {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, prefix := range ndb.keyPrefixes {
+		if err := encoding.EncodeBytes(&buf, prefix); err != nil {
+			return err
+		}
+	}
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(keyPrefixesKey)), buf.Bytes())
+}
+
+// matchKeyPrefix returns the id and length of the longest configured key prefix the key starts
+// with, or a zero id if there is none. The caller must hold ndb.mtx.
+func (ndb *nodeDB) matchKeyPrefix(key []byte) (uint32, int) {
+	if len(ndb.opts.KeyPrefixDictionary) == 0 {
+		return 0, 0
+	}
+	var id uint32
+	length := 0
+	for i, prefix := range ndb.keyPrefixes {
+		if len(prefix) > length && bytes.HasPrefix(key, prefix) {
+			id, length = uint32(i+1), len(prefix)
+		}
+	}
+	return id, length
+}
+
+// newNodeCache returns the adaptive cache if it is enabled by the options, otherwise an LRU cache
+// of cacheSize nodes.
+func newNodeCache(cacheSize int, opts Options) cache.Cache {
+	if opts.AdaptiveCacheMaxBytes <= 0 {
+		return cache.New(cacheSize)
+	}
+	return cache.NewAdaptive(cache.AdaptiveConfig{
+		MinBytes:  opts.AdaptiveCacheMinBytes,
+		MaxBytes:  opts.AdaptiveCacheMaxBytes,
+		SizeOf:    func(n cache.Node) int { return n.(*Node).memSize() },
+		HeapLimit: opts.AdaptiveCacheHeapLimit,
+	})
+}
+
+// newFastNodeCache returns the fast node cache configured by Options.FastNodeCache.
+func newFastNodeCache(opts Options) cache.Cache {
+	if opts.FastNodeCache != nil {
+		return opts.FastNodeCache()
+	}
+	return cache.NewSharded(opts.fastNodeCacheSize(), fastNodeCacheShards)
+}
+
+// nodeCacheStats returns the stats of the node cache if it is adaptive.
+func (ndb *nodeDB) nodeCacheStats() (cache.AdaptiveStats, bool) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	adaptive, ok := ndb.nodeCache.(*cache.AdaptiveCache)
+	if !ok {
+		return cache.AdaptiveStats{}, false
+	}
+	return adaptive.Stats(), true
+}
+
 // GetNode gets a node from memory or disk. If it is an inner node, it does not
 // load its children.
 // It is used for both formats of nodes: legacy and new.
 // `legacy`: nk is the hash of the node. `new`: <version><nonce>.
 func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
-	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
+	return ndb.getNode(nk, true)
+}
 
+// getNode is GetNode, adding the node to the cache if it is read from disk and addToCache is set.
+func (ndb *nodeDB) getNode(nk []byte, addToCache bool) (*Node, error) {
 	if nk == nil {
 		return nil, ErrNodeMissingNodeKey
 	}
 
 	// Check the cache.
+	ndb.mtx.Lock()
 	if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
+		ndb.mtx.Unlock()
 		ndb.opts.Stat.IncCacheHitCnt()
 		return cachedNode.(*Node), nil
 	}
+	ndb.mtx.Unlock()
 
 	ndb.opts.Stat.IncCacheMissCnt()
 
-	// Doesn't exist, load.
-	isLegcyNode := len(nk) == hashSize
-	var nodeKey []byte
-	if isLegcyNode {
-		nodeKey = ndb.legacyNodeKey(nk)
-	} else {
-		nodeKey = ndb.nodeKey(nk)
-	}
+	// Doesn't exist, load. The lock isn't held while reading, so that concurrent readers, e.g. of
+	// historical versions, don't wait on each other's reads or block the writer.
+	nodeKey := ndb.storedNodeKey(nk)
 	buf, err := ndb.db.Get(nodeKey)
 	if err != nil {
 		return nil, fmt.Errorf("can't get node %v: %v", nk, err)
 	}
-	if buf == nil {
-		return nil, fmt.Errorf("Value missing for key %v corresponding to nodeKey %x", nk, nodeKey)
+
+	ndb.mtx.Lock()
+	// another reader may have loaded the node in the meantime
+	if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
+		ndb.mtx.Unlock()
+		return cachedNode.(*Node), nil
+	}
+	node, err := ndb.decodeNode(nk, nodeKey, buf)
+	ndb.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if node.valueRef {
+		// the deduplicated value is read without the lock too
+		if err := ndb.resolveValue(node); err != nil {
+			return nil, err
+		}
 	}
 
-	var node *Node
-	if isLegcyNode {
-		node, err = MakeLegacyNode(nk, buf)
-		if err != nil {
-			return nil, fmt.Errorf("error reading Legacy Node. bytes: %x, error: %v", buf, err)
+	if addToCache {
+		ndb.mtx.Lock()
+		defer ndb.mtx.Unlock()
+		if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
+			return cachedNode.(*Node), nil
+		}
+		ndb.nodeCache.Add(node)
+	}
+
+	return node, nil
+}
+
+// getNodeInto is like GetNode, but decodes the node into the given one, e.g. from a NodePool,
+// instead of allocating one. A cached node is copied into it without its children, and a node read
+// from disk isn't added to the cache, since it is owned by the caller.
+func (ndb *nodeDB) getNodeInto(nk []byte, node *Node) error {
+	if nk == nil {
+		return ErrNodeMissingNodeKey
+	}
+
+	ndb.mtx.Lock()
+	if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
+		*node = *cachedNode.(*Node)
+		ndb.mtx.Unlock()
+		node.leftNode, node.rightNode = nil, nil
+		ndb.opts.Stat.IncCacheHitCnt()
+		return nil
+	}
+	ndb.mtx.Unlock()
+
+	ndb.opts.Stat.IncCacheMissCnt()
+	nodeKey := ndb.storedNodeKey(nk)
+	buf, err := ndb.db.Get(nodeKey)
+	if err != nil {
+		return fmt.Errorf("can't get node %v: %v", nk, err)
+	}
+
+	ndb.mtx.Lock()
+	err = ndb.decodeNodeInto(node, nk, nodeKey, buf)
+	ndb.mtx.Unlock()
+	if err != nil || !node.valueRef {
+		return err
+	}
+	return ndb.resolveValue(node)
+}
+
+// GetNodes gets several nodes from memory or disk, see GetNode. The nodes which are not cached are
+// read with a single call if the backend implements dbm.MultiGetter.
+func (ndb *nodeDB) GetNodes(nks [][]byte) ([]*Node, error) {
+	return ndb.getNodes(nks, true)
+}
+
+// getNodes is GetNodes, adding the nodes read from disk to the cache if addToCache is set.
+func (ndb *nodeDB) getNodes(nks [][]byte, addToCache bool) ([]*Node, error) {
+	nodes := make([]*Node, len(nks))
+	var (
+		missing  []int
+		nodeKeys [][]byte
+	)
+	ndb.mtx.Lock()
+	for i, nk := range nks {
+		if nk == nil {
+			ndb.mtx.Unlock()
+			return nil, ErrNodeMissingNodeKey
+		}
+		if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
+			ndb.opts.Stat.IncCacheHitCnt()
+			nodes[i] = cachedNode.(*Node)
+			continue
+		}
+		ndb.opts.Stat.IncCacheMissCnt()
+		missing = append(missing, i)
+		nodeKeys = append(nodeKeys, ndb.storedNodeKey(nk))
+	}
+	ndb.mtx.Unlock()
+	if len(missing) == 0 {
+		return nodes, nil
+	}
+
+	// the lock isn't held while reading, like in getNode
+	var bufs [][]byte
+	if mg, ok := ndb.db.(dbm.MultiGetter); ok {
+		var err error
+		if bufs, err = mg.MultiGet(nodeKeys); err != nil {
+			return nil, fmt.Errorf("can't get nodes: %w", err)
+		}
+		if len(bufs) != len(nodeKeys) {
+			return nil, fmt.Errorf("multi-get returned %d values for %d keys", len(bufs), len(nodeKeys))
 		}
 	} else {
-		node, err = MakeNode(nk, buf)
+		bufs = make([][]byte, len(nodeKeys))
+		for j, nodeKey := range nodeKeys {
+			buf, err := ndb.db.Get(nodeKey)
+			if err != nil {
+				return nil, fmt.Errorf("can't get node %v: %v", nks[missing[j]], err)
+			}
+			bufs[j] = buf
+		}
+	}
+
+	// the nodes with a deduplicated value are cached once it is read, without the lock
+	var unresolved []int
+	ndb.mtx.Lock()
+	for j, i := range missing {
+		// another reader may have loaded the node in the meantime
+		if cachedNode := ndb.nodeCache.Get(nks[i]); cachedNode != nil {
+			nodes[i] = cachedNode.(*Node)
+			continue
+		}
+		node, err := ndb.decodeNode(nks[i], nodeKeys[j], bufs[j])
 		if err != nil {
-			return nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
+			ndb.mtx.Unlock()
+			return nil, err
+		}
+		nodes[i] = node
+		if node.valueRef {
+			unresolved = append(unresolved, i)
+		} else if addToCache {
+			ndb.nodeCache.Add(node)
 		}
 	}
+	ndb.mtx.Unlock()
+	if len(unresolved) == 0 {
+		return nodes, nil
+	}
 
-	ndb.nodeCache.Add(node)
+	for _, i := range unresolved {
+		if err := ndb.resolveValue(nodes[i]); err != nil {
+			return nil, err
+		}
+	}
+	if addToCache {
+		ndb.mtx.Lock()
+		defer ndb.mtx.Unlock()
+		for _, i := range unresolved {
+			if cachedNode := ndb.nodeCache.Get(nks[i]); cachedNode != nil {
+				nodes[i] = cachedNode.(*Node)
+				continue
+			}
+			ndb.nodeCache.Add(nodes[i])
+		}
+	}
+	return nodes, nil
+}
+
+// storedNodeKey returns the database key of the node with the given node key, which is the hash
+// for legacy nodes.
+func (ndb *nodeDB) storedNodeKey(nk []byte) []byte {
+	if len(nk) == hashSize {
+		return ndb.legacyNodeKey(nk)
+	}
+	return ndb.nodeKey(nk)
+}
 
+// decodeNode decodes the node stored at nodeKey. The caller must hold ndb.mtx.
+func (ndb *nodeDB) decodeNode(nk, nodeKey, buf []byte) (*Node, error) {
+	node := &Node{}
+	if err := ndb.decodeNodeInto(node, nk, nodeKey, buf); err != nil {
+		return nil, err
+	}
 	return node, nil
 }
 
+// decodeNodeInto is decodeNode, decoding into the given node. The caller must hold ndb.mtx.
+func (ndb *nodeDB) decodeNodeInto(node *Node, nk, nodeKey, buf []byte) error {
+	if buf == nil {
+		cause := ErrCorruptNode
+		if len(nk) != hashSize && GetNodeKey(nk).version < ndb.firstVersion {
+			cause = ErrVersionPruned
+		}
+		return fmt.Errorf("%w: value missing for key %v corresponding to nodeKey %x", cause, nk, nodeKey)
+	}
+
+	if len(nk) == hashSize {
+		legacyNode, err := MakeLegacyNode(nk, buf)
+		if err != nil {
+			return fmt.Errorf("%w: error reading Legacy Node. bytes: %x, error: %v", ErrCorruptNode, buf, err)
+		}
+		*node = *legacyNode
+		return nil
+	}
+	if err := MakeNodeInto(node, nk, buf); err != nil {
+		return fmt.Errorf("%w: error reading Node. bytes: %x, error: %v", ErrCorruptNode, buf, err)
+	}
+	if err := resolveKeyPrefix(node, ndb.keyPrefixes); err != nil {
+		return err
+	}
+	if node.isLeaf() && !node.valueRef {
+		node._hash(node.nodeKey.version)
+	}
+	return nil
+}
+
+// resolveNode restores the key prefix and the deduplicated value of a node made by MakeNode, and
+// hashes it if it is a leaf.
+func (ndb *nodeDB) resolveNode(node *Node) error {
+	if !node.valueRef && node.keyPrefixID == 0 {
+		return nil
+	}
+	if err := resolveKeyPrefix(node, ndb.getKeyPrefixes()); err != nil {
+		return err
+	}
+	if node.valueRef {
+		return ndb.resolveValue(node)
+	}
+	if node.isLeaf() {
+		node._hash(node.nodeKey.version)
+	}
+	return nil
+}
+
+// resolveKeyPrefix restores the key prefix of a node made by MakeNode from the key prefix
+// dictionary, if it was stored without it.
+func resolveKeyPrefix(node *Node, prefixes [][]byte) error {
+	if node.keyPrefixID != 0 {
+		if int(node.keyPrefixID) > len(prefixes) {
+			return fmt.Errorf("%w: unknown key prefix %d of node %v", ErrCorruptNode, node.keyPrefixID, node.nodeKey)
+		}
+		prefix := prefixes[node.keyPrefixID-1]
+		node.key = append(append(make([]byte, 0, len(prefix)+len(node.key)), prefix...), node.key...)
+		node.keyPrefixID = 0
+	}
+	return nil
+}
+
+// resolveValue reads the deduplicated value of a node made by MakeNode, and hashes it if it is a
+// leaf. It reads from the database, so the nodes read by getNode are resolved without ndb.mtx.
+func (ndb *nodeDB) resolveValue(node *Node) error {
+	if node.valueRef {
+		value, err := ndb.db.Get(valueKeyFormat.Key(node.value))
+		if err != nil {
+			return fmt.Errorf("can't get value %x of node %v: %w", node.value, node.nodeKey, err)
+		}
+		if value == nil {
+			return fmt.Errorf("%w: value %x of node %v is missing", ErrCorruptNode, node.value, node.nodeKey)
+		}
+		if node.valueChecksum {
+			// the checksum only covers the value hash in the node
+			if valueHash := sha256.Sum256(value); !bytes.Equal(valueHash[:], node.value) {
+				return fmt.Errorf("%w: value %x of node %v has hash %x", ErrCorruptNode, node.value, node.nodeKey, valueHash)
+			}
+		}
+		node.value = value
+	}
+	if node.isLeaf() {
+		node._hash(node.nodeKey.version)
+	}
+	return nil
+}
+
 func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
+	return ndb.getFastNode(key, true)
+}
+
+// getFastNode is GetFastNode, adding the fast node to the cache if it is read from disk and
+// addToCache is set.
+func (ndb *nodeDB) getFastNode(key []byte, addToCache bool) (*fastnode.Node, error) {
 	if !ndb.hasUpgradedToFastStorage() {
 		return nil, errors.New("storage version is not fast")
 	}
 
-	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
-
 	if len(key) == 0 {
 		return nil, fmt.Errorf("nodeDB.GetFastNode() requires key, len(key) equals 0")
 	}
 
+	// the loads don't take the lock of the nodeDB, so concurrent readers of the latest version
+	// only contend on the shards of the cache
+	ndb.fastNodeMtx.RLock()
+	defer ndb.fastNodeMtx.RUnlock()
+
 	if cachedFastNode := ndb.fastNodeCache.Get(key); cachedFastNode != nil {
 		ndb.opts.Stat.IncFastCacheHitCnt()
 		return cachedFastNode.(*fastnode.Node), nil
@@ -213,34 +666,132 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading FastNode. bytes: %x, error: %w", buf, err)
 	}
-	ndb.fastNodeCache.Add(fastNode)
+	// During a commit, the node read may be one the commit removed from the cache but hasn't
+	// written yet, and caching it would outlive the commit. The commits mark their start before
+	// taking fastNodeMtx to update the cache, so the check can't miss one.
+	if _, ok := ndb.commitSnapshot(); addToCache && ok {
+		ndb.fastNodeCache.Add(fastNode)
+	}
 	return fastNode, nil
 }
 
 // SaveNode saves a node to disk.
 func (ndb *nodeDB) SaveNode(node *Node) error {
+	_, err := ndb.saveNode(node)
+	return err
+}
+
+// saveNode saves a node to disk, and returns the size of its encoding.
+func (ndb *nodeDB) saveNode(node *Node) (int, error) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
 	if node.nodeKey == nil {
-		return ErrNodeMissingNodeKey
+		return 0, ErrNodeMissingNodeKey
+	}
+
+	threshold := ndb.opts.DedupValueThreshold
+	if node.isLeaf() && (node.valueRef || (threshold > 0 && len(node.value) >= threshold)) {
+		// the reference is taken before the node is written, so that a partial write can only
+		// leave an unused value behind
+		node.valueRef = true
+		if err := ndb.addValueRef(node.value); err != nil {
+			return 0, err
+		}
 	}
 
 	// Save node bytes to db.
 	var buf bytes.Buffer
 	buf.Grow(node.encodedSize())
 
-	if err := node.writeBytes(&buf); err != nil {
-		return err
+	prefixID, prefixLen := ndb.matchKeyPrefix(node.key)
+	if err := node.writeBytesWithKeyPrefix(&buf, prefixID, prefixLen, ndb.opts.ValueChecksums); err != nil {
+		return 0, err
 	}
 
 	if err := ndb.batch.Set(ndb.nodeKey(node.GetKey()), buf.Bytes()); err != nil {
-		return err
+		return 0, err
 	}
 
 	ndb.logger.Debug("BATCH SAVE", "node", node)
 	ndb.nodeCache.Add(node)
-	return nil
+	return buf.Len(), nil
+}
+
+// valueRefCount returns the number of leaf nodes referring to the deduplicated value with the given
+// hash. The caller must hold ndb.mtx.
+func (ndb *nodeDB) valueRefCount(valueHash []byte) (int64, error) {
+	if count, ok := ndb.valueRefs[string(valueHash)]; ok {
+		return count, nil
+	}
+	bz, err := ndb.db.Get(valueRefKeyFormat.Key(valueHash))
+	if err != nil {
+		return 0, err
+	}
+	if bz == nil {
+		return 0, nil
+	}
+	count, _, err := encoding.DecodeVarint(bz)
+	return count, err
+}
+
+// setValueRefCount updates the reference count of a deduplicated value, deleting it once it is no
+// longer referred to. The caller must hold ndb.mtx.
+func (ndb *nodeDB) setValueRefCount(valueHash []byte, count int64) error {
+	ndb.valueRefs[string(valueHash)] = count
+	if count <= 0 {
+		if err := ndb.batch.Delete(valueKeyFormat.Key(valueHash)); err != nil {
+			return err
+		}
+		return ndb.batch.Delete(valueRefKeyFormat.Key(valueHash))
+	}
+	var buf bytes.Buffer
+	if err := encoding.EncodeVarint(&buf, count); err != nil {
+		return err
+	}
+	return ndb.batch.Set(valueRefKeyFormat.Key(valueHash), buf.Bytes())
+}
+
+// addValueRef stores the value by its hash if it isn't stored yet, and takes a reference to it.
+// The caller must hold ndb.mtx.
+func (ndb *nodeDB) addValueRef(value []byte) error {
+	valueHash := sha256.Sum256(value)
+	count, err := ndb.valueRefCount(valueHash[:])
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		if err := ndb.batch.Set(valueKeyFormat.Key(valueHash[:]), value); err != nil {
+			return err
+		}
+	}
+	return ndb.setValueRefCount(valueHash[:], count+1)
+}
+
+// releaseValueRef drops a reference to the deduplicated value with the given hash, after the node
+// holding it was deleted. The caller must hold ndb.mtx.
+func (ndb *nodeDB) releaseValueRef(valueHash []byte) error {
+	count, err := ndb.valueRefCount(valueHash)
+	if err != nil {
+		return err
+	}
+	return ndb.setValueRefCount(valueHash, count-1)
+}
+
+// releaseValueFromPruning releases the deduplicated value of a node deleted by the pruning
+// process, if it has one.
+func (ndb *nodeDB) releaseValueFromPruning(node *Node) error {
+	if !node.valueRef {
+		return nil
+	}
+	if ndb.IsCommitting() {
+		<-ndb.chCommitting
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	valueHash := sha256.Sum256(node.value)
+	return ndb.releaseValueRef(valueHash[:])
 }
 
 // SaveFastNode saves a FastNode to disk and add to cache.
@@ -291,13 +842,27 @@ func (ndb *nodeDB) SetFastStorageVersionToBatch(latestVersion int64) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
+	newVersion, err := ndb.fastStorageVersion(latestVersion)
+	if err != nil {
+		return err
+	}
+	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
+		return err
+	}
+	ndb.storageVersion = newVersion
+	return nil
+}
+
+// fastStorageVersion returns the fast storage version for the given latest version. The caller
+// must hold ndb.mtx.
+func (ndb *nodeDB) fastStorageVersion(latestVersion int64) (string, error) {
 	var newVersion string
 	if ndb.storageVersion >= fastStorageVersionValue {
 		// Storage version should be at index 0 and latest fast cache version at index 1
 		versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
 
 		if len(versions) > 2 {
-			return errInvalidFastStorageVersion
+			return "", errInvalidFastStorageVersion
 		}
 
 		newVersion = versions[0]
@@ -305,16 +870,204 @@ func (ndb *nodeDB) SetFastStorageVersionToBatch(latestVersion int64) error {
 		newVersion = fastStorageVersionValue
 	}
 
-	newVersion += fastStorageVersionDelimiter + strconv.Itoa(int(latestVersion))
+	return newVersion + fastStorageVersionDelimiter + strconv.Itoa(int(latestVersion)), nil
+}
 
-	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
+// writeFastNodesAsync persists the fast node changes of the saved version in the background, see
+// Options.AsyncFastNodeWrites. The fast node cache is updated right away, but the fast node index
+// isn't read until the write is done. Only one write is pending at a time, the caller must wait
+// for the previous one with waitFastNodeWrites.
+func (ndb *nodeDB) writeFastNodesAsync(latestVersion int64, additions map[string]*fastnode.Node, removals map[string]interface{}) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	newVersion, err := ndb.fastStorageVersion(latestVersion)
+	if err != nil {
 		return err
 	}
+	ndb.fastNodeMtx.Lock()
+	for _, node := range additions {
+		ndb.fastNodeCache.Add(node)
+	}
+	for key := range removals {
+		ndb.fastNodeCache.Remove([]byte(key))
+	}
+	ndb.fastNodeMtx.Unlock()
+	prevVersion := ndb.storageVersion
 	ndb.storageVersion = newVersion
+
+	done := make(chan struct{})
+	ndb.fastNodeWriteDone = done
+	go func() {
+		defer close(done)
+		if err := ndb.writeFastNodes(newVersion, additions, removals); err != nil {
+			ndb.logger.Error("failed to write fast nodes", "version", latestVersion, "err", err)
+			ndb.mtx.Lock()
+			ndb.fastNodeWriteErr = err
+			// the fast node index on disk is of the previous version
+			ndb.storageVersion = prevVersion
+			ndb.mtx.Unlock()
+		}
+	}()
 	return nil
 }
 
+// writeFastNodes writes the fast node changes and the storage version in a batch of their own.
+func (ndb *nodeDB) writeFastNodes(storageVersion string, additions map[string]*fastnode.Node, removals map[string]interface{}) error {
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+
+	for _, key := range slices.Sorted(maps.Keys(additions)) {
+		var buf bytes.Buffer
+		buf.Grow(additions[key].EncodedSize())
+		if err := ndb.encodeFastNode(&buf, additions[key]); err != nil {
+			return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
+		}
+		if err := batch.Set(ndb.fastNodeKey([]byte(key)), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(removals)) {
+		if err := batch.Delete(ndb.fastNodeKey([]byte(key))); err != nil {
+			return err
+		}
+	}
+	// the storage version is written last, so a lost write makes the fast node index get rebuilt
+	if err := batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(storageVersion)); err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// waitFastNodeWrites waits for the pending async fast node write, and returns the error of the
+// last failed one. After a failure the fast node index is not read until it has been rebuilt by
+// loading the tree again.
+func (ndb *nodeDB) waitFastNodeWrites() error {
+	ndb.mtx.Lock()
+	done := ndb.fastNodeWriteDone
+	ndb.mtx.Unlock()
+	if done != nil {
+		<-done
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.fastNodeWriteErr
+}
+
+// recoverFastNodeWrites waits for the pending async fast node write and clears the error of a
+// failed one, for the fast node index to be rebuilt with the fast storage upgrade.
+func (ndb *nodeDB) recoverFastNodeWrites() {
+	if err := ndb.waitFastNodeWrites(); err != nil {
+		ndb.mtx.Lock()
+		ndb.fastNodeWriteErr = nil
+		ndb.mtx.Unlock()
+	}
+}
+
+// fastNodeWritesPending returns true if the fast node index on disk lags behind the saved version,
+// because an async fast node write is pending or failed.
+func (ndb *nodeDB) fastNodeWritesPending() bool {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	if ndb.fastNodeWriteErr != nil {
+		return true
+	}
+	if ndb.fastNodeWriteDone == nil {
+		return false
+	}
+	select {
+	case <-ndb.fastNodeWriteDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// getMigratedInitialVersion returns the initial version recorded by MigrateInitialVersion, or 0 if
+// the initial version was never migrated.
+func (ndb *nodeDB) getMigratedInitialVersion() (uint64, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(initialVersionKey)))
+	if err != nil || bz == nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(bz), 10, 64)
+}
+
+// setMigratedInitialVersionToBatch records the migrated initial version. Requires changes to be
+// committed after to be persisted.
+func (ndb *nodeDB) setMigratedInitialVersionToBatch(version uint64) error {
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(initialVersionKey)), []byte(strconv.FormatUint(version, 10)))
+}
+
+// loadVersionGap loads the versions skipped by MigrateInitialVersion, which are not stored.
+func (ndb *nodeDB) loadVersionGap() error {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(versionGapKey)))
+	if err != nil {
+		return err
+	}
+	var from, to int64
+	if bz != nil {
+		if from, err = strconv.ParseInt(string(bz), 10, 64); err != nil {
+			return err
+		}
+		initialVersion, err := ndb.getMigratedInitialVersion()
+		if err != nil {
+			return err
+		}
+		to = int64(initialVersion)
+	}
+	ndb.resetVersionGap(from, to)
+	return nil
+}
+
+// setVersionGapToBatch records that the version from is followed by the migrated initial version,
+// which must be set in the same batch. Requires changes to be committed after to be persisted.
+func (ndb *nodeDB) setVersionGapToBatch(from int64) error {
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(versionGapKey)), []byte(strconv.FormatInt(from, 10)))
+}
+
+func (ndb *nodeDB) resetVersionGap(from, to int64) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.gapFrom, ndb.gapTo = from, to
+}
+
+// nextVersion returns the version saved after the given one, skipping the versions left out by
+// MigrateInitialVersion.
+func (ndb *nodeDB) nextVersion(version int64) int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if ndb.gapFrom > 0 && version == ndb.gapFrom {
+		return ndb.gapTo
+	}
+	return version + 1
+}
+
+// prevVersion returns the highest version below the given one which can be stored, skipping the
+// versions left out by MigrateInitialVersion.
+func (ndb *nodeDB) prevVersion(version int64) int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if ndb.gapFrom < version-1 && version-1 < ndb.gapTo {
+		return ndb.gapFrom
+	}
+	return version - 1
+}
+
+// inVersionGap reports whether the version was left out by MigrateInitialVersion.
+func (ndb *nodeDB) inVersionGap(version int64) bool {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.gapFrom < version && version < ndb.gapTo
+}
+
+// getStorageVersion returns the storage version. The caller must not hold ndb.mtx, since the fast
+// node reads check it without the lock of the tree.
 func (ndb *nodeDB) getStorageVersion() string {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
 	return ndb.storageVersion
 }
 
@@ -343,6 +1096,80 @@ func (ndb *nodeDB) shouldForceFastStorageUpgrade() (bool, error) {
 	return false, nil
 }
 
+// isFastIndexSynced returns true if the fast node index was last synchronized with the latest
+// version, along with that version. The index only describes the lineage it was built from, so
+// after versions are deleted (e.g. a rollback) it must not be consulted for reads until it has
+// been rebuilt.
+func (ndb *nodeDB) isFastIndexSynced() (bool, int64, error) {
+	if ndb.fastNodeWritesPending() {
+		return false, 0, nil
+	}
+	_, fastVersion, found := strings.Cut(ndb.getStorageVersion(), fastStorageVersionDelimiter)
+	if !found {
+		return false, 0, nil
+	}
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return false, 0, err
+	}
+	return fastVersion == strconv.FormatInt(latestVersion, 10), latestVersion, nil
+}
+
+// beginCommit marks the start of the commit of a version, before the fast node index and caches
+// are updated. Until endCommit, the index on disk may be partially written by the flushes of the
+// batch and the caches ahead of it, so the readers of historical versions must not rely on it,
+// see commitSnapshot.
+func (ndb *nodeDB) beginCommit() {
+	ndb.commitSeq.Add(1)
+}
+
+// endCommit marks the end of the commit started by beginCommit, once the new latest version is
+// set.
+func (ndb *nodeDB) endCommit() {
+	ndb.commitSeq.Add(1)
+}
+
+// commitSnapshot returns the commit sequence, and false if a commit is in progress. A read of the
+// fast node index is consistent if no commit was in progress when it started, and the sequence is
+// unchanged when it ends.
+func (ndb *nodeDB) commitSnapshot() (uint64, bool) {
+	seq := ndb.commitSeq.Load()
+	return seq, seq%2 == 0
+}
+
+// getFastValue reads the value of the key at the version from the fast node index, adding the fast
+// node read to the cache if addToCache is set, and returns false if the index can't answer: it
+// isn't synced with the latest version, the key changed after the version, or the read overlapped
+// with a commit, see beginCommit.
+func (ndb *nodeDB) getFastValue(key []byte, version int64, addToCache bool) ([]byte, bool, error) {
+	seq, ok := ndb.commitSnapshot()
+	if !ok {
+		return nil, false, nil
+	}
+	isFastIndexSynced, latestVersion, err := ndb.isFastIndexSynced()
+	if err != nil || !isFastIndexSynced {
+		return nil, false, err
+	}
+
+	fastNode, err := ndb.getFastNode(key, addToCache)
+	if err != nil {
+		return nil, false, nil
+	}
+	var value []byte
+	switch {
+	case fastNode == nil && version == latestVersion:
+		// the fast nodes are the live state, so the key isn't in the latest version
+	case fastNode != nil && fastNode.GetVersionLastUpdatedAt() <= version:
+		value = fastNode.GetValue()
+	default:
+		return nil, false, nil
+	}
+	if ndb.commitSeq.Load() != seq {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
 // saveFastNodeUnlocked saves a FastNode to disk.
 func (ndb *nodeDB) saveFastNodeUnlocked(node *fastnode.Node, shouldAddToCache bool) error {
 	if node.GetKey() == nil {
@@ -353,7 +1180,7 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *fastnode.Node, shouldAddToCache bo
 	var buf bytes.Buffer
 	buf.Grow(node.EncodedSize())
 
-	if err := node.WriteBytes(&buf); err != nil {
+	if err := ndb.encodeFastNode(&buf, node); err != nil {
 		return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
 	}
 
@@ -361,11 +1188,22 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *fastnode.Node, shouldAddToCache bo
 		return fmt.Errorf("error while writing key/val to nodedb batch. Err: %w", err)
 	}
 	if shouldAddToCache {
+		ndb.fastNodeMtx.Lock()
 		ndb.fastNodeCache.Add(node)
+		ndb.fastNodeMtx.Unlock()
 	}
 	return nil
 }
 
+// encodeFastNode writes the fast node, with the checksum of its value if Options.ValueChecksums
+// is set.
+func (ndb *nodeDB) encodeFastNode(w io.Writer, node *fastnode.Node) error {
+	if ndb.opts.ValueChecksums {
+		return node.WriteChecksummedBytes(w)
+	}
+	return node.WriteBytes(w)
+}
+
 // Has checks if a node key exists in the database.
 func (ndb *nodeDB) Has(nk []byte) (bool, error) {
 	return ndb.db.Has(ndb.nodeKey(nk))
@@ -403,14 +1241,17 @@ func (ndb *nodeDB) saveNodeFromPruning(node *Node) error {
 }
 
 // deleteVersion deletes a tree version from disk.
-// deletes orphans
-func (ndb *nodeDB) deleteVersion(version int64) error {
+// deletes orphans, and counts them in event
+func (ndb *nodeDB) deleteVersion(version int64, event *PruneEvent) error {
+	// the pruning may continue past a commit, which resumes the root cache
+	ndb.roots.invalidate()
 	rootKey, err := ndb.GetRoot(version)
 	if err != nil {
 		return err
 	}
+	nextVersion := ndb.nextVersion(version)
 
-	if err := ndb.traverseOrphans(version, version+1, func(orphan *Node) error {
+	if err := ndb.traverseOrphans(version, nextVersion, func(orphan *Node) error {
 		if orphan.nodeKey.nonce == 0 && !orphan.isLegacy {
 			// if the orphan is a reformatted root, it can be a legacy root
 			// so it should be removed from the pruning process.
@@ -424,11 +1265,16 @@ func (ndb *nodeDB) deleteVersion(version int64) error {
 			// applied now due to the batch writing.
 			orphan.nodeKey.nonce = 0
 		}
+		event.Nodes++
+		event.Bytes += int64(orphan.encodedSize())
 		nk := orphan.GetKey()
 		if orphan.isLegacy {
 			return ndb.deleteFromPruning(ndb.legacyNodeKey(nk))
 		}
-		return ndb.deleteFromPruning(ndb.nodeKey(nk))
+		if err := ndb.deleteFromPruning(ndb.nodeKey(nk)); err != nil {
+			return err
+		}
+		return ndb.releaseValueFromPruning(orphan)
 	}); err != nil {
 		return err
 	}
@@ -443,7 +1289,7 @@ func (ndb *nodeDB) deleteVersion(version int64) error {
 	}
 
 	// check if the version is referred by the next version
-	nextRootKey, err := ndb.GetRoot(version + 1)
+	nextRootKey, err := ndb.GetRoot(nextVersion)
 	if err != nil {
 		return err
 	}
@@ -500,7 +1346,7 @@ func (ndb *nodeDB) deleteLegacyVersions(legacyLatestVersion int64) error {
 	}
 
 	// Delete orphans for all legacy versions
-	if err := ndb.traversePrefix(legacyOrphanKeyFormat.Key(), func(key, value []byte) error {
+	if err := ndb.traversePrefixWithHint(legacyOrphanKeyFormat.Key(), ndb.opts.BackendHints.Pruning, func(key, value []byte) error {
 		if err := ndb.deleteFromPruning(key); err != nil {
 			return err
 		}
@@ -514,7 +1360,7 @@ func (ndb *nodeDB) deleteLegacyVersions(legacyLatestVersion int64) error {
 		return err
 	}
 	// Delete all legacy roots
-	if err := ndb.traversePrefix(legacyRootKeyFormat.Key(), func(key, _ []byte) error {
+	if err := ndb.traversePrefixWithHint(legacyRootKeyFormat.Key(), ndb.opts.BackendHints.Pruning, func(key, _ []byte) error {
 		return ndb.deleteFromPruning(key)
 	}); err != nil {
 		return err
@@ -525,62 +1371,238 @@ func (ndb *nodeDB) deleteLegacyVersions(legacyLatestVersion int64) error {
 
 // DeleteVersionsFrom permanently deletes all tree versions from the given version upwards.
 func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
+	return ndb.deleteVersionsFrom(context.Background(), fromVersion, RollbackOptions{})
+}
+
+// deleteVersionsFrom deletes the versions from fromVersion upwards, in chunks and within the rate
+// limit of the options, see RollbackOptions. The versions are deleted from the latest one down, and
+// the root of a version first, so a deletion stopped by ctx or interrupted leaves the versions
+// below the one it was deleting intact, and the partially deleted version is ignored, see
+// scanLatestVersion. The nodes of the versions above the latest one are deleted too, so calling it
+// again resumes an interrupted deletion.
+func (ndb *nodeDB) deleteVersionsFrom(ctx context.Context, fromVersion int64, opts RollbackOptions) error {
 	latest, err := ndb.getLatestVersion()
 	if err != nil {
 		return err
 	}
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+	nodesFromVersion := max(fromVersion, legacyLatestVersion+1)
 	if latest < fromVersion {
-		return nil
+		// the leftovers of an interrupted deletion
+		_, found, err := ndb.lastNodeVersion(nodesFromVersion, math.MaxInt64)
+		if err != nil || !found {
+			return err
+		}
+	}
+
+	ndb.mtx.Lock()
+	for v, r := range ndb.versionReaders {
+		if v >= fromVersion && r != 0 {
+			ndb.mtx.Unlock() // Unlock before exiting
+			return fmt.Errorf("unable to delete version %v with %v active readers", v, r)
+		}
+	}
+	ndb.mtx.Unlock()
+	ndb.generations.rolledBack(fromVersion)
+	ndb.roots.invalidate()
+
+	// Delete the nodes for new format
+	d := &versionDeleter{ndb: ndb, ctx: ctx, opts: opts, started: time.Now(), sleep: time.Sleep}
+	for end := int64(math.MaxInt64); ; {
+		version, found, err := ndb.lastNodeVersion(nodesFromVersion, end)
+		if err == nil && found {
+			err = d.deleteVersion(version)
+		}
+		if err != nil {
+			// the latest version is scanned again, once the progress is committed
+			ndb.resetLatestVersion(0)
+			return errors.Join(err, d.commitProgress())
+		}
+		if !found {
+			break
+		}
+		end = version
+	}
+
+	// Delete the legacy versions
+	if legacyLatestVersion >= fromVersion {
+		if err := ndb.traverseRange(legacyRootKeyFormat.Key(fromVersion), legacyRootKeyFormat.Key(legacyLatestVersion+1), func(k, v []byte) error {
+			var version int64
+			legacyRootKeyFormat.Scan(k, &version)
+			// delete the legacy nodes
+			if err := ndb.deleteLegacyNodes(version, v); err != nil {
+				return err
+			}
+			// it will skip the orphans because orphans will be removed at once in `deleteLegacyVersions`
+			// delete the legacy root
+			return ndb.batch.Delete(k)
+		}); err != nil {
+			return err
+		}
+		// Update the legacy latest version forcibly
+		ndb.legacyLatestVersion = 0
+	}
+
+	// the per version metadata is kept by pruning, but not by a rollback
+	for _, kf := range []*keyformat.KeyFormat{chainedHashKeyFormat, versionSizeKeyFormat, versionTimeKeyFormat} {
+		if err := ndb.traverseRange(kf.Key(fromVersion), kf.Key(int64(math.MaxInt64)), func(k, _ []byte) error {
+			return ndb.batch.Delete(k)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := ndb.traverseRange(appHeightKey(fromVersion), appHeightKey(math.MaxInt64), func(k, _ []byte) error {
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+
+	// NOTICE: we don't touch fast node indexes here, because it'll be rebuilt later because of version mismatch.
+
+	if latest >= fromVersion {
+		if err := ndb.setCommitMarkerToBatch(ndb.prevVersion(fromVersion)); err != nil {
+			return err
+		}
+		ndb.resetLatestVersion(ndb.prevVersion(fromVersion))
+	}
+	// the versions skipped by MigrateInitialVersion are saved again after a rollback before them
+	ndb.mtx.Lock()
+	gapFrom := ndb.gapFrom
+	ndb.mtx.Unlock()
+	if gapFrom > 0 && fromVersion <= gapFrom {
+		if err := ndb.batch.Delete(metadataKeyFormat.Key([]byte(versionGapKey))); err != nil {
+			return err
+		}
+		ndb.resetVersionGap(0, 0)
+	}
+
+	return nil
+}
+
+// lastNodeVersion returns the highest version from fromVersion and below toVersion having nodes.
+func (ndb *nodeDB) lastNodeVersion(fromVersion, toVersion int64) (int64, bool, error) {
+	itr, err := ndb.db.ReverseIterator(nodeKeyPrefixFormat.KeyInt64(fromVersion), nodeKeyPrefixFormat.KeyInt64(toVersion))
+	if err != nil {
+		return 0, false, err
+	}
+	defer itr.Close()
+	if !itr.Valid() {
+		return 0, false, itr.Error()
+	}
+	var nk []byte
+	nodeKeyFormat.Scan(itr.Key(), &nk)
+	return GetNodeKey(nk).version, true, nil
+}
+
+// versionDeleter deletes the nodes of the versions of deleteVersionsFrom, committing the deletions
+// every RollbackOptions.ChunkSize nodes.
+type versionDeleter struct {
+	ndb     *nodeDB
+	ctx     context.Context
+	opts    RollbackOptions
+	deleted int64 // the deleted nodes
+	pending int   // the deleted nodes since the last commit
+	started time.Time
+	sleep   func(time.Duration)
+}
+
+// deleteVersion deletes the nodes of the version, in the order of their keys, i.e. the root first.
+func (d *versionDeleter) deleteVersion(version int64) error {
+	start, end := nodeKeyPrefixFormat.KeyInt64(version), nodeKeyPrefixFormat.KeyInt64(version+1)
+	for start != nil {
+		// the chunk is read before it is deleted, since some backends can't be written while they
+		// are iterated
+		var (
+			keys      [][]byte
+			valueRefs [][]byte
+			err       error
+		)
+		start, err = d.readChunk(start, end, func(k, v []byte) {
+			keys = append(keys, bytes.Clone(k))
+			// the reference of a deduplicated value is released after the node is deleted, so
+			// that a partial write can only leave an unused value behind
+			var valueRef []byte
+			if node, err := MakeNode(k[1:], v); err == nil && node.valueRef {
+				valueRef = node.value
+			}
+			valueRefs = append(valueRefs, valueRef)
+		})
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if err := d.delete(key, valueRefs[i]); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	ndb.mtx.Lock()
-	for v, r := range ndb.versionReaders {
-		if v >= fromVersion && r != 0 {
-			ndb.mtx.Unlock() // Unlock before exiting
-			return fmt.Errorf("unable to delete version %v with %v active readers", v, r)
+// readChunk calls fn with the keys from start and below end, up to the end of the current chunk,
+// and returns the key to continue from, or nil at the end.
+func (d *versionDeleter) readChunk(start, end []byte, fn func(k, v []byte)) ([]byte, error) {
+	itr, err := d.ndb.db.Iterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+	for n := d.pending; itr.Valid(); itr.Next() {
+		if d.opts.ChunkSize > 0 && n == d.opts.ChunkSize {
+			return bytes.Clone(itr.Key()), nil
 		}
+		fn(itr.Key(), itr.Value())
+		n++
 	}
-	ndb.mtx.Unlock()
+	return nil, itr.Error()
+}
 
-	// Delete the legacy versions
-	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
-	if err != nil {
+// delete deletes a node and releases its deduplicated value, if any, then commits the chunk once
+// it is full, and waits for the rate limit.
+func (d *versionDeleter) delete(key, valueRef []byte) error {
+	if err := d.ctx.Err(); err != nil {
 		return err
 	}
-	dumpFromVersion := fromVersion
-	if legacyLatestVersion >= fromVersion {
-		if err := ndb.traverseRange(legacyRootKeyFormat.Key(fromVersion), legacyRootKeyFormat.Key(legacyLatestVersion+1), func(k, v []byte) error {
-			var version int64
-			legacyRootKeyFormat.Scan(k, &version)
-			// delete the legacy nodes
-			if err := ndb.deleteLegacyNodes(version, v); err != nil {
-				return err
-			}
-			// it will skip the orphans because orphans will be removed at once in `deleteLegacyVersions`
-			// delete the legacy root
-			return ndb.batch.Delete(k)
-		}); err != nil {
+	if err := d.ndb.batch.Delete(key); err != nil {
+		return err
+	}
+	if valueRef != nil {
+		d.ndb.mtx.Lock()
+		err := d.ndb.releaseValueRef(valueRef)
+		d.ndb.mtx.Unlock()
+		if err != nil {
 			return err
 		}
-		// Update the legacy latest version forcibly
-		ndb.legacyLatestVersion = 0
-		fromVersion = legacyLatestVersion + 1
 	}
+	d.deleted++
+	d.pending++
 
-	// Delete the nodes for new format
-	if err = ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(fromVersion), nodeKeyPrefixFormat.KeyInt64(latest+1), func(k, _ []byte) error {
-		return ndb.batch.Delete(k)
-	}); err != nil {
-		return err
+	if d.opts.ChunkSize > 0 && d.pending >= d.opts.ChunkSize {
+		if err := d.commitProgress(); err != nil {
+			return err
+		}
+	}
+	if d.opts.MaxDeletesPerSec > 0 {
+		due := time.Duration(float64(d.deleted) / float64(d.opts.MaxDeletesPerSec) * float64(time.Second))
+		if wait := due - time.Since(d.started); wait > 0 {
+			d.sleep(wait)
+		}
 	}
-
-	// NOTICE: we don't touch fast node indexes here, because it'll be rebuilt later because of version mismatch.
-
-	ndb.resetLatestVersion(dumpFromVersion - 1)
-
 	return nil
 }
 
+// commitProgress commits the pending deletions, at the end of a chunk, or when the deletion stops.
+func (d *versionDeleter) commitProgress() error {
+	if d.pending == 0 {
+		return nil
+	}
+	d.pending = 0
+	return d.ndb.Commit()
+}
+
 // startPruning starts the pruning process.
 func (ndb *nodeDB) startPruning() {
 	for {
@@ -659,6 +1681,10 @@ func (ndb *nodeDB) deleteVersionsTo(toVersion int64) error {
 		}
 	}
 	ndb.mtx.Unlock()
+	ndb.generations.pruned(toVersion)
+	ndb.roots.invalidate()
+	start := time.Now()
+	event := PruneEvent{FromVersion: first, ToVersion: toVersion}
 
 	// Delete the legacy versions
 	if legacyLatestVersion >= first {
@@ -670,23 +1696,128 @@ func (ndb *nodeDB) deleteVersionsTo(toVersion int64) error {
 		ndb.resetLegacyLatestVersion(-1)
 	}
 
-	for version := first; version <= toVersion; version++ {
-		if err := ndb.deleteVersion(version); err != nil {
+	for version := first; version <= toVersion; version = ndb.nextVersion(version) {
+		if err := ndb.deleteVersion(version, &event); err != nil {
 			return err
 		}
-		ndb.resetFirstVersion(version + 1)
+		ndb.resetFirstVersion(ndb.nextVersion(version))
 	}
 
+	if ndb.opts.PruneHook != nil && event.FromVersion <= toVersion {
+		event.Duration = time.Since(start)
+		ndb.opts.PruneHook(event)
+	}
 	return nil
 }
 
+// disableFastStorage resets the storage version to the default (non-fast) value, drops the fast
+// node cache and deletes all persisted fast nodes in the background, along with the progress of a
+// pending rebuild. The deletion is recorded, so it is resumed after a restart by
+// resumeFastStorageCleanup. The returned channel receives the result of the background deletion
+// once it is finished.
+func (ndb *nodeDB) disableFastStorage() (<-chan error, error) {
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(defaultStorageVersionValue)); err != nil {
+		return nil, err
+	}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(fastIndexCleanupKey)), []byte{}); err != nil {
+		return nil, err
+	}
+	if err := batch.Delete(metadataKeyFormat.Key([]byte(fastIndexRebuildKey))); err != nil {
+		return nil, err
+	}
+	if err := batch.Write(); err != nil {
+		return nil, err
+	}
+
+	ndb.mtx.Lock()
+	ndb.storageVersion = defaultStorageVersionValue
+	ndb.fastNodeMtx.Lock()
+	ndb.fastNodeCache = newFastNodeCache(ndb.opts)
+	ndb.fastNodeMtx.Unlock()
+	ndb.mtx.Unlock()
+
+	return ndb.startFastStorageCleanup(), nil
+}
+
+// startFastStorageCleanup deletes all persisted fast nodes in the background, and then the record
+// of the deletion. The returned channel receives the result of the deletion once it is finished.
+func (ndb *nodeDB) startFastStorageCleanup() <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		err := ndb.deleteFastNodes()
+		if err == nil {
+			err = ndb.db.Delete(metadataKeyFormat.Key([]byte(fastIndexCleanupKey)))
+		}
+		done <- err
+	}()
+	return done
+}
+
+// resumeFastStorageCleanup restarts the background deletion of the fast nodes of a disabled fast
+// node index, if it was interrupted by a restart, and returns nil otherwise.
+func (ndb *nodeDB) resumeFastStorageCleanup() (<-chan error, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(fastIndexCleanupKey)))
+	if err != nil || bz == nil {
+		return nil, err
+	}
+	return ndb.startFastStorageCleanup(), nil
+}
+
+// deleteFastNodes deletes all persisted fast nodes, writing the deletions in chunks of
+// maxBatchSize using a dedicated batch so that the nodeDB batch is left untouched.
+func (ndb *nodeDB) deleteFastNodes() error {
+	start, end := fastKeyFormat.Key(), ibytes.CpIncr(fastKeyFormat.Key())
+	for {
+		select {
+		case <-ndb.ctx.Done():
+			return ndb.ctx.Err()
+		default:
+		}
+
+		keys := make([][]byte, 0, maxBatchSize)
+		if err := ndb.traverseRange(start, end, func(k, _ []byte) error {
+			if len(keys) == maxBatchSize {
+				return errStopTraverse
+			}
+			keys = append(keys, ibytes.Cp(k))
+			return nil
+		}); err != nil && !errors.Is(err, errStopTraverse) {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		batch := ndb.db.NewBatch()
+		for _, k := range keys {
+			if err := batch.Delete(k); err != nil {
+				batch.Close()
+				return err
+			}
+		}
+		if err := batch.Write(); err != nil {
+			batch.Close()
+			return err
+		}
+		if err := batch.Close(); err != nil {
+			return err
+		}
+
+		start = append(keys[len(keys)-1], 0)
+	}
+}
+
 func (ndb *nodeDB) DeleteFastNode(key []byte) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 	if err := ndb.batch.Delete(ndb.fastNodeKey(key)); err != nil {
 		return err
 	}
+	ndb.fastNodeMtx.Lock()
 	ndb.fastNodeCache.Remove(key)
+	ndb.fastNodeMtx.Unlock()
 	return nil
 }
 
@@ -716,7 +1847,7 @@ func (ndb *nodeDB) getFirstVersion() (int64, error) {
 	}
 
 	// Check if we have a legacy version
-	itr, err := ndb.getPrefixIterator(legacyRootKeyFormat.Key())
+	itr, err := ndb.getPrefixIterator(legacyRootKeyFormat.Key(), dbm.Hint{})
 	if err != nil {
 		return 0, err
 	}
@@ -731,8 +1862,15 @@ func (ndb *nodeDB) getFirstVersion() (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	ndb.mtx.Lock()
+	gapFrom, gapTo := ndb.gapFrom, ndb.gapTo
+	ndb.mtx.Unlock()
 	for firstVersion < latestVersion {
 		version := (latestVersion + firstVersion) >> 1
+		if gapFrom < version && version < gapTo {
+			// the versions skipped by MigrateInitialVersion are decided by the one before them
+			version = gapFrom
+		}
 		has, err := ndb.hasVersion(version)
 		if err != nil {
 			return 0, err
@@ -740,7 +1878,7 @@ func (ndb *nodeDB) getFirstVersion() (int64, error) {
 		if has {
 			latestVersion = version
 		} else {
-			firstVersion = version + 1
+			firstVersion = ndb.nextVersion(version)
 		}
 	}
 
@@ -806,28 +1944,15 @@ func (ndb *nodeDB) getLatestVersion() (int64, error) {
 		return latestVersion, nil
 	}
 
-	itr, err := ndb.db.ReverseIterator(
-		nodeKeyPrefixFormat.KeyInt64(int64(1)),
-		nodeKeyPrefixFormat.KeyInt64(int64(math.MaxInt64)),
-	)
+	latestVersion, err := ndb.scanLatestVersion()
 	if err != nil {
 		return 0, err
 	}
-	defer itr.Close()
-
-	if itr.Valid() {
-		k := itr.Key()
-		var nk []byte
-		nodeKeyFormat.Scan(k, &nk)
-		latestVersion = GetNodeKey(nk).version
+	if latestVersion > 0 {
 		ndb.resetLatestVersion(latestVersion)
 		return latestVersion, nil
 	}
 
-	if err := itr.Error(); err != nil {
-		return 0, err
-	}
-
 	// If there are no versions, try to get the latest version from the legacy format.
 	latestVersion, err = ndb.getLegacyLatestVersion()
 	if err != nil {
@@ -841,12 +1966,65 @@ func (ndb *nodeDB) getLatestVersion() (int64, error) {
 	return 0, nil
 }
 
+// scanLatestVersion returns the highest version whose root was written, or 0 if there is none.
+// A version may be flushed in several batches, see Options.MaxBatchBytes, so the versions above
+// the commit marker, which is written after all records of a version, are incomplete and ignored.
+// Databases written before the marker are scanned for the highest version with a root instead.
+func (ndb *nodeDB) scanLatestVersion() (int64, error) {
+	end := nodeKeyPrefixFormat.KeyInt64(int64(math.MaxInt64))
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(commitVersionKey)))
+	if err != nil {
+		return 0, err
+	}
+	if bz != nil {
+		committed, err := strconv.ParseInt(string(bz), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		end = nodeKeyPrefixFormat.KeyInt64(committed + 1)
+	}
+	for {
+		itr, err := ndb.db.ReverseIterator(nodeKeyPrefixFormat.KeyInt64(int64(1)), end)
+		if err != nil {
+			return 0, err
+		}
+		if !itr.Valid() {
+			err := itr.Error()
+			itr.Close()
+			return 0, err
+		}
+		var nk []byte
+		nodeKeyFormat.Scan(itr.Key(), &nk)
+		itr.Close()
+
+		nodeKey := GetNodeKey(nk)
+		if nodeKey.nonce == 1 {
+			return nodeKey.version, nil
+		}
+		hasRoot, err := ndb.hasVersion(nodeKey.version)
+		if err != nil {
+			return 0, err
+		}
+		if hasRoot {
+			return nodeKey.version, nil
+		}
+		ndb.logger.Error("ignoring partially written version", "version", nodeKey.version)
+		end = nodeKeyPrefixFormat.KeyInt64(nodeKey.version)
+	}
+}
+
 func (ndb *nodeDB) resetLatestVersion(version int64) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 	ndb.latestVersion = version
 }
 
+// setCommitMarkerToBatch records the version as completely written, see scanLatestVersion. It must
+// be the last write of the version, after its nodes, root and per version metadata.
+func (ndb *nodeDB) setCommitMarkerToBatch(version int64) error {
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(commitVersionKey)), []byte(strconv.FormatInt(version, 10)))
+}
+
 // hasVersion checks if the given version exists.
 func (ndb *nodeDB) hasVersion(version int64) (bool, error) {
 	return ndb.db.Has(nodeKeyFormat.Key(GetRootKey(version)))
@@ -857,8 +2035,36 @@ func (ndb *nodeDB) hasLegacyVersion(version int64) (bool, error) {
 	return ndb.db.Has(ndb.legacyRootKey(version))
 }
 
+// legacyVersions returns the legacy versions in [fromVersion, toVersion) in ascending order. It
+// scans their root keys, so it is proportional to the number of existing versions rather than to
+// the size of the range, which can have large gaps on pruned legacy nodes.
+func (ndb *nodeDB) legacyVersions(fromVersion, toVersion int64) ([]int64, error) {
+	var versions []int64
+	err := ndb.traverseRange(legacyRootKeyFormat.Key(fromVersion), legacyRootKeyFormat.Key(toVersion), func(k, _ []byte) error {
+		var version int64
+		legacyRootKeyFormat.Scan(k, &version)
+		versions = append(versions, version)
+		return nil
+	})
+	return versions, err
+}
+
 // GetRoot gets the nodeKey of the root for the specific version.
 func (ndb *nodeDB) GetRoot(version int64) ([]byte, error) {
+	rootKey, ok, epoch := ndb.roots.get(version)
+	if ok {
+		return rootKey, nil
+	}
+	rootKey, err := ndb.getRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	ndb.roots.add(version, rootKey, epoch)
+	return rootKey, nil
+}
+
+// getRoot is GetRoot without the root cache.
+func (ndb *nodeDB) getRoot(version int64) ([]byte, error) {
 	rootKey := GetRootKey(version)
 	val, err := ndb.db.Get(nodeKeyFormat.Key(rootKey))
 	if err != nil {
@@ -958,7 +2164,12 @@ func (ndb *nodeDB) traverseRange(start []byte, end []byte, fn func(k, v []byte)
 
 // Traverse all keys with a certain prefix. Return error if any, nil otherwise
 func (ndb *nodeDB) traversePrefix(prefix []byte, fn func(k, v []byte) error) error {
-	itr, err := ndb.getPrefixIterator(prefix)
+	return ndb.traversePrefixWithHint(prefix, dbm.Hint{}, fn)
+}
+
+// traversePrefixWithHint is like traversePrefix, with the iterator tuned by the backend hint.
+func (ndb *nodeDB) traversePrefixWithHint(prefix []byte, hint dbm.Hint, fn func(k, v []byte) error) error {
+	itr, err := ndb.getPrefixIterator(prefix, hint)
 	if err != nil {
 		return err
 	}
@@ -974,7 +2185,7 @@ func (ndb *nodeDB) traversePrefix(prefix []byte, fn func(k, v []byte) error) err
 }
 
 // Get the iterator for a given prefix.
-func (ndb *nodeDB) getPrefixIterator(prefix []byte) (corestore.Iterator, error) {
+func (ndb *nodeDB) getPrefixIterator(prefix []byte, hint dbm.Hint) (corestore.Iterator, error) {
 	var start, end []byte
 	if len(prefix) == 0 {
 		start = nil
@@ -984,7 +2195,27 @@ func (ndb *nodeDB) getPrefixIterator(prefix []byte) (corestore.Iterator, error)
 		end = ibytes.CpIncr(prefix)
 	}
 
-	return ndb.db.Iterator(start, end)
+	return ndb.iterator(start, end, true, hint)
+}
+
+// iterator returns an iterator over the domain tuned by the backend hint, if the database
+// supports it.
+func (ndb *nodeDB) iterator(start, end []byte, ascending bool, hint dbm.Hint) (corestore.Iterator, error) {
+	if hinted, ok := ndb.db.(dbm.HintedDB); ok && hint != (dbm.Hint{}) {
+		return hinted.IteratorWithHint(start, end, ascending, hint)
+	}
+	if ascending {
+		return ndb.db.Iterator(start, end)
+	}
+	return ndb.db.ReverseIterator(start, end)
+}
+
+// newBatch returns a batch tuned by the backend hint, if the database supports it.
+func (ndb *nodeDB) newBatch(hint dbm.Hint) corestore.Batch {
+	if hinted, ok := ndb.db.(dbm.HintedDB); ok && hint != (dbm.Hint{}) {
+		return hinted.NewBatchWithHint(hint)
+	}
+	return ndb.db.NewBatch()
 }
 
 // Get iterator for fast prefix and error, if any
@@ -1004,28 +2235,61 @@ func (ndb *nodeDB) getFastIterator(start, end []byte, ascending bool) (corestore
 		endFormatted[0]++
 	}
 
-	if ascending {
-		return ndb.db.Iterator(startFormatted, endFormatted)
-	}
-
-	return ndb.db.ReverseIterator(startFormatted, endFormatted)
+	return ndb.iterator(startFormatted, endFormatted, ascending, ndb.opts.BackendHints.Iteration)
 }
 
 // Write to disk.
 func (ndb *nodeDB) Commit() error {
+	return ndb.commit(ndb.opts.Sync)
+}
+
+// commit writes the batch to disk, synchronously if syncWrite is set.
+func (ndb *nodeDB) commit(syncWrite bool) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
+	if ndb.closed {
+		return ErrTreeClosed
+	}
+	return ndb.writeBatch(syncWrite)
+}
+
+// writeBatch writes the batch to disk, discarding it if the write fails. The caller must hold
+// ndb.mtx.
+func (ndb *nodeDB) writeBatch(syncWrite bool) error {
 	var err error
-	if ndb.opts.Sync {
+	if syncWrite {
 		err = ndb.batch.WriteSync()
 	} else {
 		err = ndb.batch.Write()
 	}
 	if err != nil {
+		// the reference counts of the batch are lost with it, and are read from disk again
+		if discardErr := ndb.discardBatch(); discardErr != nil {
+			err = errors.Join(err, discardErr)
+		}
 		return fmt.Errorf("failed to write batch, %w", err)
 	}
+	// the reference counts, the key prefix dictionary and the balance slack are on disk now
+	clear(ndb.valueRefs)
+	ndb.keyPrefixesUnsaved = false
+	if ndb.balanceSlackUnsaved {
+		ndb.balanceSlackChecked = true
+		ndb.balanceSlackUnsaved = false
+	}
+	ndb.roots.written()
+
+	return nil
+}
 
+// discardBatch drops the writes of the batch, along with the cached reference counts of the
+// deduplicated values, which may only be counted in it. The caller must hold ndb.mtx.
+func (ndb *nodeDB) discardBatch() error {
+	clear(ndb.valueRefs)
+	ndb.balanceSlackUnsaved = false
+	if batch, ok := ndb.batch.(*BatchWithFlusher); ok {
+		return batch.discard()
+	}
 	return nil
 }
 
@@ -1054,7 +2318,8 @@ func isReferenceRoot(bz []byte) (bool, int) {
 }
 
 // traverseOrphans traverses orphans which removed by the updates of the curVersion in the prevVersion.
-// NOTE: it is used for both legacy and new nodes.
+// NOTE: it is used for both legacy and new nodes. With Options.NodePool, the orphans are recycled
+// after fn returns, so fn must not retain them.
 func (ndb *nodeDB) traverseOrphans(prevVersion, curVersion int64, fn func(*Node) error) error {
 	curKey, err := ndb.GetRoot(curVersion)
 	if err != nil {
@@ -1070,7 +2335,7 @@ func (ndb *nodeDB) traverseOrphans(prevVersion, curVersion int64, fn func(*Node)
 	if err != nil {
 		return err
 	}
-	prevIter, err := NewNodeIterator(prevKey, ndb)
+	prevIter, err := newNodeIterator(prevKey, ndb, ndb.opts.NodePool)
 	if err != nil {
 		return err
 	}
@@ -1103,22 +2368,150 @@ func (ndb *nodeDB) traverseOrphans(prevVersion, curVersion int64, fn func(*Node)
 	return nil
 }
 
-// Close the nodeDB.
+// IterateOrphans calls fn with the nodes which become unreachable when the version is deleted,
+// i.e. the nodes of the version which are not in the next one. Versions are deleted from the first
+// one upwards, so these are exactly the nodes deleted along with the version. The nodes must not
+// be modified.
+func (ndb *nodeDB) IterateOrphans(version int64, fn func(*Node) error) error {
+	first, err := ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if version < first || version > latest || ndb.inVersionGap(version) {
+		return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+	}
+	if version == latest {
+		return fmt.Errorf("the latest version %d can't be deleted", latest)
+	}
+	return ndb.traverseOrphans(version, ndb.nextVersion(version), fn)
+}
+
+// IterateNodesAtVersion calls fn with the nodes created by the version, i.e. keyed by it, in the
+// order of their node keys, along with the bytes of their database records. The nodes of a pruned
+// version which later versions still reference are stored, so they are included, and the nodes of
+// legacy versions, keyed by their hash, and those moved to the cold storage are not. The nodes
+// must not be modified.
+func (ndb *nodeDB) IterateNodesAtVersion(version int64, fn func(node *Node, storedBytes int) error) error {
+	return ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(version), nodeKeyPrefixFormat.KeyInt64(version+1), func(key, value []byte) error {
+		if len(value) == 0 {
+			// the root of an empty version
+			return nil
+		}
+		if isRef, _ := isReferenceRoot(value); isRef {
+			return nil
+		}
+		node, err := MakeNode(key[1:], value)
+		if err != nil {
+			return err
+		}
+		if err := ndb.resolveNode(node); err != nil {
+			return err
+		}
+		return fn(node, len(key)+len(value))
+	})
+}
+
+// isVersionComplete reports whether all nodes of the version are still stored. Versions are
+// deleted from the first one upwards and deleting a version only deletes its nodes which the next
+// version doesn't share, so only these are checked, like in traverseOrphans. A node which can't be
+// read makes the version incomplete, e.g. when the deletion of the version was interrupted.
+func (ndb *nodeDB) isVersionComplete(version int64) (bool, error) {
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return false, err
+	}
+	prevKey, err := ndb.GetRoot(version)
+	if err != nil {
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	prevIter, err := NewNodeIterator(prevKey, ndb)
+	if err != nil {
+		return false, nil
+	}
+	if version >= latest {
+		// the latest version is never deleted, its root is enough
+		return true, nil
+	}
+
+	curKey, err := ndb.GetRoot(ndb.nextVersion(version))
+	if err != nil {
+		return false, err
+	}
+	curIter, err := NewNodeIterator(curKey, ndb)
+	if err != nil {
+		return false, err
+	}
+
+	var orgNode *Node
+	for prevIter.Valid() {
+		for orgNode == nil && curIter.Valid() {
+			node := curIter.GetNode()
+			if node.nodeKey.version <= version {
+				curIter.Next(true)
+				orgNode = node
+			} else {
+				curIter.Next(false)
+			}
+		}
+		if err := curIter.Error(); err != nil {
+			return false, err
+		}
+		pNode := prevIter.GetNode()
+		if orgNode != nil && bytes.Equal(pNode.hash, orgNode.hash) {
+			prevIter.Next(true)
+			orgNode = nil
+		} else {
+			prevIter.Next(false)
+		}
+	}
+	return prevIter.Error() == nil, nil
+}
+
+// Close the nodeDB, once. See close.
 func (ndb *nodeDB) Close() error {
-	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
+	ndb.closeOnce.Do(func() {
+		ndb.closeErr = ndb.close()
+	})
+	return ndb.closeErr
+}
+
+// close stops the background jobs first, so none of them writes to the batch once it is closed,
+// then writes the pending batch and releases the caches.
+func (ndb *nodeDB) close() error {
+	if err := ndb.waitFastNodeWrites(); err != nil {
+		ndb.logger.Error("fast nodes were not written, they will be rebuilt on load", "err", err)
+	}
 
 	ndb.cancel()
 	if ndb.opts.AsyncPruning {
-		<-ndb.done // wait for the pruning process to finish
+		// waited for without the lock, which the pruning process takes
+		<-ndb.done
 	}
 
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	ndb.closed = true
 	if ndb.batch != nil {
+		if err := ndb.writeBatch(ndb.opts.Sync); err != nil {
+			return err
+		}
 		if err := ndb.batch.Close(); err != nil {
 			return err
 		}
 		ndb.batch = nil
 	}
+	ndb.nodeCache = cache.New(0)
+	ndb.fastNodeMtx.Lock()
+	ndb.fastNodeCache = cache.New(0)
+	ndb.fastNodeMtx.Unlock()
 
 	// skip the db.Close() since it can be used by other trees
 	return nil
@@ -1177,8 +2570,8 @@ func (ndb *nodeDB) legacyNodes() ([]*Node, error) {
 func (ndb *nodeDB) orphans() ([][]byte, error) {
 	orphans := [][]byte{}
 
-	for version := ndb.firstVersion; version < ndb.latestVersion; version++ {
-		err := ndb.traverseOrphans(version, version+1, func(orphan *Node) error {
+	for version := ndb.firstVersion; version < ndb.latestVersion; version = ndb.nextVersion(version) {
+		err := ndb.traverseOrphans(version, ndb.nextVersion(version), func(orphan *Node) error {
 			orphans = append(orphans, orphan.hash)
 			return nil
 		})
@@ -1218,6 +2611,9 @@ func (ndb *nodeDB) traverseNodes(fn func(node *Node) error) error {
 		if err != nil {
 			return err
 		}
+		if err := ndb.resolveNode(node); err != nil {
+			return err
+		}
 		nodes = append(nodes, node)
 		return nil
 	}); err != nil {
@@ -1254,13 +2650,13 @@ func (ndb *nodeDB) traverseStateChanges(startVersion, endVersion int64, fn func(
 		endVersion = latestVersion
 	}
 
-	prevVersion := startVersion - 1
+	prevVersion := ndb.prevVersion(startVersion)
 	prevRoot, err := ndb.GetRoot(prevVersion)
 	if err != nil && err != ErrVersionDoesNotExist {
 		return err
 	}
 
-	for version := startVersion; version <= endVersion; version++ {
+	for version := ndb.nextVersion(prevVersion); version <= endVersion; version = ndb.nextVersion(version) {
 		root, err := ndb.GetRoot(version)
 		if err != nil {
 			return err
@@ -1323,4 +2719,13 @@ func (ndb *nodeDB) String() (string, error) {
 	return "-" + "\n" + buf.String() + "-", nil
 }
 
-var ErrNodeMissingNodeKey = fmt.Errorf("node does not have a nodeKey")
+var (
+	ErrNodeMissingNodeKey = fmt.Errorf("node does not have a nodeKey")
+
+	// ErrVersionPruned is returned when a node can't be read because its version has been deleted,
+	// e.g. by an iterator over a version pruned while it was open.
+	ErrVersionPruned = errors.New("version has been pruned")
+
+	// ErrCorruptNode is returned when a node of an existing version is missing or can't be decoded.
+	ErrCorruptNode = errors.New("corrupt node")
+)
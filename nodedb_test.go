@@ -1,16 +1,23 @@
 package iavl
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	corestore "cosmossdk.io/core/store"
 	"github.com/stretchr/testify/require"
 	gomock "go.uber.org/mock/gomock"
 
+	"github.com/cosmos/iavl/cache"
 	dbm "github.com/cosmos/iavl/db"
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+	"github.com/cosmos/iavl/internal/encoding"
 	"github.com/cosmos/iavl/mock"
 )
 
@@ -49,6 +56,7 @@ func TestNewNoDbStorage_StorageVersionInDb_Success(t *testing.T) {
 
 	dbMock.EXPECT().Get(gomock.Any()).Return([]byte(expectedVersion), nil).Times(1)
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(keyPrefixesKey))).Return(nil, nil).Times(1)
 
 	ndb := newNodeDB(dbMock, 0, DefaultOptions(), NewNopLogger())
 	require.Equal(t, expectedVersion, ndb.storageVersion)
@@ -62,6 +70,7 @@ func TestNewNoDbStorage_ErrorInConstructor_DefaultSet(t *testing.T) {
 
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, errors.New("some db error")).Times(1)
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(keyPrefixesKey))).Return(nil, nil).Times(1)
 	ndb := newNodeDB(dbMock, 0, DefaultOptions(), NewNopLogger())
 	require.Equal(t, expectedVersion, ndb.getStorageVersion())
 }
@@ -74,6 +83,7 @@ func TestNewNoDbStorage_DoesNotExist_DefaultSet(t *testing.T) {
 
 	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(keyPrefixesKey))).Return(nil, nil).Times(1)
 
 	ndb := newNodeDB(dbMock, 0, DefaultOptions(), NewNopLogger())
 	require.Equal(t, expectedVersion, ndb.getStorageVersion())
@@ -108,6 +118,7 @@ func TestSetStorageVersion_DBFailure_OldKept(t *testing.T) {
 
 	dbMock.EXPECT().Get(gomock.Any()).Return([]byte(defaultStorageVersionValue), nil).Times(1)
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(batchMock).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(keyPrefixesKey))).Return(nil, nil).Times(1)
 
 	batchMock.EXPECT().GetByteSize().Return(100, nil).Times(1)
 	batchMock.EXPECT().Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(fastStorageVersionValue+fastStorageVersionDelimiter+strconv.Itoa(expectedFastCacheVersion))).Return(errors.New(expectedErrorMsg)).Times(1)
@@ -131,7 +142,9 @@ func TestSetStorageVersion_InvalidVersionFailure_OldKept(t *testing.T) {
 	invalidStorageVersion := fastStorageVersionValue + fastStorageVersionDelimiter + "1" + fastStorageVersionDelimiter + "2"
 
 	dbMock.EXPECT().Get(gomock.Any()).Return([]byte(invalidStorageVersion), nil).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(fastIndexShardsKey))).Return(nil, nil).Times(1)
 	dbMock.EXPECT().NewBatchWithSize(gomock.Any()).Return(batchMock).Times(1)
+	dbMock.EXPECT().Get(metadataKeyFormat.Key([]byte(keyPrefixesKey))).Return(nil, nil).Times(1)
 
 	ndb := newNodeDB(dbMock, 0, DefaultOptions(), NewNopLogger())
 	require.Equal(t, invalidStorageVersion, ndb.getStorageVersion())
@@ -445,3 +458,825 @@ func TestCloseNodeDB(t *testing.T) {
 	ndb := newNodeDB(db, 0, opts, NewNopLogger())
 	require.NoError(t, ndb.Close())
 }
+
+// multiGetDB counts the reads of a MemDB.
+type multiGetDB struct {
+	*dbm.MemDB
+	gets, multiGets int
+}
+
+func (db *multiGetDB) Get(key []byte) ([]byte, error) {
+	db.gets++
+	return db.MemDB.Get(key)
+}
+
+func (db *multiGetDB) MultiGet(keys [][]byte) ([][]byte, error) {
+	db.multiGets++
+	return db.MemDB.MultiGet(keys)
+}
+
+func TestGetNodes(t *testing.T) {
+	db := &multiGetDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	keys := [][]byte{}
+	for i := 0; i < 64; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		keys = append(keys, key)
+		_, err := tree.Set(key, []byte(fmt.Sprintf("value-%02d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	reloaded := NewMutableTree(db, 1000, false, NewNopLogger())
+	_, err = reloaded.LoadVersion(version)
+	require.NoError(t, err)
+	itree, err := reloaded.GetImmutable(version)
+	require.NoError(t, err)
+
+	// every level of the tree is read with a single multi-get
+	db.gets, db.multiGets = 0, 0
+	values, err := itree.GetMany(append(keys, []byte("missing")))
+	require.NoError(t, err)
+	require.Zero(t, db.gets)
+	require.Equal(t, int(itree.Height()), db.multiGets)
+	for i, value := range values[:len(keys)] {
+		require.Equal(t, fmt.Sprintf("value-%02d", i), string(value))
+	}
+	require.Nil(t, values[len(keys)])
+
+	// cached nodes are not read again
+	db.multiGets = 0
+	_, err = itree.GetMany(keys[:1])
+	require.NoError(t, err)
+	require.Zero(t, db.multiGets)
+
+	// backends without multi-get fall back to single reads
+	plain := newNodeDB(dbm.NewMemDB(), 0, DefaultOptions(), NewNopLogger())
+	require.NoError(t, plain.SaveNode(&Node{key: []byte("k"), value: []byte("v"), nodeKey: &NodeKey{version: 1, nonce: 1}, size: 1}))
+	require.NoError(t, plain.Commit())
+	nodes, err := plain.GetNodes([][]byte{GetRootKey(1)})
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), nodes[0].value)
+	_, err = plain.GetNodes([][]byte{GetRootKey(2)})
+	require.Error(t, err)
+	_, err = plain.GetNodes([][]byte{nil})
+	require.ErrorIs(t, err, ErrNodeMissingNodeKey)
+}
+
+// batchCountingDB counts the batches created for a MemDB.
+type batchCountingDB struct {
+	*dbm.MemDB
+	batches int
+}
+
+func (db *batchCountingDB) NewBatch() corestore.Batch {
+	db.batches++
+	return db.MemDB.NewBatch()
+}
+
+func (db *batchCountingDB) NewBatchWithSize(size int) corestore.Batch {
+	db.batches++
+	return db.MemDB.NewBatchWithSize(size)
+}
+
+func TestMaxBatchBytes(t *testing.T) {
+	populate := func(tree *MutableTree) {
+		for i := 0; i < 200; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%03d", i)), make([]byte, 100))
+			require.NoError(t, err)
+		}
+	}
+
+	db := &batchCountingDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, true, NewNopLogger(), MaxBatchBytesOption(2000))
+	populate(tree)
+	db.batches = 0
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Greater(t, db.batches, 10)
+
+	// the chunked version is complete once loaded
+	reloaded := NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, tree.Hash(), reloaded.Hash())
+
+	// imports are chunked as well
+	exported, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	exporter, err := exported.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	importDB := &batchCountingDB{MemDB: dbm.NewMemDB()}
+	imported := NewMutableTree(importDB, 0, true, NewNopLogger(), MaxBatchBytesOption(2000))
+	importer, err := imported.Import(version)
+	require.NoError(t, err)
+	defer importer.Close()
+	importDB.batches = 0
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	require.Greater(t, importDB.batches, 10)
+	require.Equal(t, tree.Hash(), imported.Hash())
+}
+
+func TestPartiallyFlushedVersionIgnored(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// simulate a crash after flushing some nodes of version 2, but not its root
+	ndb := newNodeDB(db, 0, DefaultOptions(), NewNopLogger())
+	require.NoError(t, ndb.SaveNode(&Node{key: []byte("b"), value: []byte("2"), size: 1, nodeKey: &NodeKey{version: 2, nonce: 3}}))
+	require.NoError(t, ndb.Commit())
+
+	reloaded := NewMutableTree(db, 0, true, NewNopLogger())
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, hash, reloaded.Hash())
+
+	// the version can be saved again
+	_, err = reloaded.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	_, version, err = reloaded.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	hash = reloaded.Hash()
+
+	// a version whose root was flushed, but not its metadata and commit marker, is ignored too
+	require.NoError(t, ndb.SaveNode(&Node{key: []byte("c"), value: []byte("3"), size: 1, nodeKey: &NodeKey{version: 3, nonce: 1}}))
+	require.NoError(t, ndb.Commit())
+
+	reloaded = NewMutableTree(db, 0, true, NewNopLogger())
+	version, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	require.Equal(t, hash, reloaded.Hash())
+}
+
+func TestDedupValues(t *testing.T) {
+	countValues := func(db dbm.DB) int {
+		itr, err := db.Iterator(valueKeyFormat.Prefix(), []byte("w"))
+		require.NoError(t, err)
+		defer itr.Close()
+		count := 0
+		for ; itr.Valid(); itr.Next() {
+			count++
+		}
+		return count
+	}
+
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), DedupValueThresholdOption(16))
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+
+	large := bytes.Repeat([]byte{'x'}, 32)
+	for _, tr := range []*MutableTree{tree, plain} {
+		for i := 0; i < 10; i++ {
+			_, err := tr.Set([]byte{byte(i)}, large)
+			require.NoError(t, err)
+		}
+		_, err := tr.Set([]byte("small"), []byte("1"))
+		require.NoError(t, err)
+		_, _, err = tr.SaveVersion()
+		require.NoError(t, err)
+
+		_, err = tr.Set([]byte{0}, []byte("replaced"))
+		require.NoError(t, err)
+		_, _, err = tr.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, plain.Hash(), tree.Hash())
+	require.Equal(t, 1, countValues(db))
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), DedupValueThresholdOption(16))
+	_, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, plain.Hash(), reloaded.Hash())
+	value, err := reloaded.Get([]byte{1})
+	require.NoError(t, err)
+	require.Equal(t, large, value)
+	itree, err := reloaded.GetImmutable(1)
+	require.NoError(t, err)
+	value, err = itree.Get([]byte{0})
+	require.NoError(t, err)
+	require.Equal(t, large, value)
+
+	// the value is deleted once the last node referring to it is pruned
+	for i := 1; i < 10; i++ {
+		_, _, err := reloaded.Remove([]byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err = reloaded.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 1, countValues(db))
+	require.NoError(t, reloaded.DeleteVersionsTo(2))
+	require.Equal(t, 0, countValues(db))
+}
+
+// valueReadDB calls onValueGet on the reads of the deduplicated values of a MemDB.
+type valueReadDB struct {
+	*dbm.MemDB
+	onValueGet func()
+}
+
+func (db *valueReadDB) Get(key []byte) ([]byte, error) {
+	if db.onValueGet != nil && bytes.HasPrefix(key, valueKeyFormat.Prefix()) {
+		db.onValueGet()
+	}
+	return db.MemDB.Get(key)
+}
+
+func TestDedupValues_ReadWithoutLock(t *testing.T) {
+	db := &valueReadDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), DedupValueThresholdOption(16))
+	large := bytes.Repeat([]byte{'x'}, 32)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte{byte(i)}, large)
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), DedupValueThresholdOption(16))
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	reads := 0
+	db.onValueGet = func() {
+		reads++
+		require.True(t, reloaded.ndb.mtx.TryLock(), "the value is read with the lock held")
+		reloaded.ndb.mtx.Unlock()
+	}
+	itree, err := reloaded.GetImmutable(version)
+	require.NoError(t, err)
+	value, err := itree.Get([]byte{0})
+	require.NoError(t, err)
+	require.Equal(t, large, value)
+	values, err := itree.GetMany([][]byte{{1}, {2}})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{large, large}, values)
+	require.Positive(t, reads)
+}
+
+// failingBatchDB fails the writes of the batches of a MemDB while failWrites is set.
+type failingBatchDB struct {
+	*dbm.MemDB
+	failWrites bool
+}
+
+func (db *failingBatchDB) NewBatchWithSize(size int) corestore.Batch {
+	return &failingBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+type failingBatch struct {
+	corestore.Batch
+	db *failingBatchDB
+}
+
+func (b *failingBatch) Write() error {
+	if b.db.failWrites {
+		return errors.New("write failed")
+	}
+	return b.Batch.Write()
+}
+
+func TestDedupValues_FailedCommit(t *testing.T) {
+	db := &failingBatchDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), DedupValueThresholdOption(16))
+	large := bytes.Repeat([]byte{'x'}, 32)
+	_, err := tree.Set([]byte{0}, large)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the counts taken by the failed commit are dropped along with its batch
+	_, err = tree.Set([]byte{1}, large)
+	require.NoError(t, err)
+	db.failWrites = true
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	require.Empty(t, tree.ndb.valueRefs)
+	db.failWrites = false
+	tree.Rollback()
+
+	_, err = tree.Set([]byte{1}, large)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	valueHash := sha256.Sum256(large)
+	bz, err := db.Get(valueRefKeyFormat.Key(valueHash[:]))
+	require.NoError(t, err)
+	count, _, err := encoding.DecodeVarint(bz)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+}
+
+func TestKeyPrefixDictionary(t *testing.T) {
+	dbSize := func(db dbm.DB) int {
+		itr, err := db.Iterator(nodeKeyPrefixFormat.Prefix(), []byte("t"))
+		require.NoError(t, err)
+		defer itr.Close()
+		size := 0
+		for ; itr.Valid(); itr.Next() {
+			size += len(itr.Value())
+		}
+		return size
+	}
+
+	module := []byte("bank/balances/")
+	address := append([]byte("bank/balances/"), bytes.Repeat([]byte{0xab}, 20)...)
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), KeyPrefixDictionaryOption(module, address))
+	plainDB := dbm.NewMemDB()
+	plain := NewMutableTree(plainDB, 0, false, NewNopLogger())
+	for _, tr := range []*MutableTree{tree, plain} {
+		for i := 0; i < 50; i++ {
+			_, err := tr.Set(append(append([]byte{}, address...), byte(i)), []byte{byte(i)})
+			require.NoError(t, err)
+			_, err = tr.Set(append(append([]byte{}, module...), byte(i)), []byte{byte(i)})
+			require.NoError(t, err)
+		}
+		_, err := tr.Set([]byte("other"), []byte("1"))
+		require.NoError(t, err)
+		_, _, err = tr.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, plain.Hash(), tree.Hash())
+	require.Less(t, dbSize(db), dbSize(plainDB))
+
+	// the nodes stay readable without the option, and new prefixes are appended once a version is
+	// saved, not by the reads
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), KeyPrefixDictionaryOption([]byte("other")))
+	_, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{module, address}, reloaded.ndb.getKeyPrefixes())
+	_, err = reloaded.Get(append(append([]byte{}, address...), 7))
+	require.NoError(t, err)
+	size, err := reloaded.ndb.batch.GetByteSize()
+	require.NoError(t, err)
+	require.Zero(t, size)
+	_, err = reloaded.Set([]byte("other"), []byte("2"))
+	require.NoError(t, err)
+	_, _, err = reloaded.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{module, address, []byte("other")}, reloaded.ndb.getKeyPrefixes())
+
+	reloaded = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	itree, err := reloaded.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, plain.Hash(), itree.Hash())
+	value, err := itree.Get(append(append([]byte{}, address...), 7))
+	require.NoError(t, err)
+	require.Equal(t, []byte{7}, value)
+	value, err = reloaded.Get([]byte("other"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	_, err = reloaded.GetVersionedProof(append(append([]byte{}, module...), 9), 1)
+	require.NoError(t, err)
+}
+
+func TestValueChecksums(t *testing.T) {
+	large := bytes.Repeat([]byte{'x'}, 32)
+	options := []Option{ValueChecksumsOption(true), DedupValueThresholdOption(16), KeyPrefixDictionaryOption([]byte("k"))}
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), options...)
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, tr := range []*MutableTree{tree, plain} {
+		for i := 0; i < 10; i++ {
+			_, err := tr.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("value-%02d", i)))
+			require.NoError(t, err)
+		}
+		_, err := tr.Set([]byte("large"), large)
+		require.NoError(t, err)
+		_, _, err = tr.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, plain.Hash(), tree.Hash())
+
+	// corrupt reports whether it flipped a byte of the value in a key with the given prefix
+	corrupt := func(prefix, value []byte) bool {
+		itr, err := db.Iterator(prefix, ibytes.CpIncr(prefix))
+		require.NoError(t, err)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			if i := bytes.Index(itr.Value(), value); i >= 0 {
+				corrupted := bytes.Clone(itr.Value())
+				corrupted[i+len(value)-1] ^= 0xff
+				require.NoError(t, db.Set(bytes.Clone(itr.Key()), corrupted))
+				return true
+			}
+		}
+		return false
+	}
+	get := func(key string) ([]byte, error) {
+		reloaded := NewMutableTree(db, 0, true, NewNopLogger(), options...)
+		_, err := reloaded.Load()
+		require.NoError(t, err)
+		return reloaded.Get([]byte(key))
+	}
+
+	value, err := get("k05")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-05"), value)
+	require.True(t, corrupt(nodeKeyPrefixFormat.Prefix(), []byte("value-05")))
+	_, err = get("k05")
+	require.ErrorIs(t, err, ErrCorruptNode)
+
+	// the deduplicated value is verified against the checksummed hash in the node
+	value, err = get("large")
+	require.NoError(t, err)
+	require.Equal(t, large, value)
+	require.True(t, corrupt(valueKeyFormat.Prefix(), large))
+	_, err = get("large")
+	require.ErrorIs(t, err, ErrCorruptNode)
+
+	// a corrupt fast node fails its checksum, and Get falls back to the tree
+	require.True(t, corrupt([]byte(fastKeyFormat.Prefix()), []byte("value-07")))
+	_, err = NewMutableTree(db, 0, false, NewNopLogger(), options...).ndb.GetFastNode([]byte("k07"))
+	require.Error(t, err)
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), options...)
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	value, err = reloaded.Get([]byte("k07"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-07"), value)
+}
+
+func TestFastNodeCacheConcurrentGet(t *testing.T) {
+	var caches []*cache.ShardedCache
+	newCache := func() cache.Cache {
+		c := cache.NewSharded(1000, 8)
+		caches = append(caches, c)
+		return c
+	}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), FastNodeCacheOption(newCache))
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Len(t, caches, 1)
+
+	// readers of the latest version fill the cache concurrently with the writer updating it
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, err := tree.ndb.GetFastNode([]byte(fmt.Sprintf("k%03d", i)))
+				require.NoError(t, err)
+			}
+		}()
+	}
+	for i := 0; i < 100; i += 10 {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("updated"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	wg.Wait()
+
+	for i := 0; i < 100; i += 10 {
+		value, err := tree.Get([]byte(fmt.Sprintf("k%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte("updated"), value)
+	}
+	require.Equal(t, 100, caches[0].Len())
+}
+
+// hintRecordingDB records the hints passed to it as a dbm.HintedDB.
+type hintRecordingDB struct {
+	*dbm.MemDB
+	batchHints    []dbm.Hint
+	iteratorHints []dbm.Hint
+}
+
+func (db *hintRecordingDB) NewBatchWithHint(hint dbm.Hint) corestore.Batch {
+	db.batchHints = append(db.batchHints, hint)
+	return db.NewBatch()
+}
+
+func (db *hintRecordingDB) IteratorWithHint(start, end []byte, ascending bool, hint dbm.Hint) (corestore.Iterator, error) {
+	db.iteratorHints = append(db.iteratorHints, hint)
+	if ascending {
+		return db.Iterator(start, end)
+	}
+	return db.ReverseIterator(start, end)
+}
+
+func TestBackendHints(t *testing.T) {
+	source := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 10; i++ {
+		_, err := source.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, version, err := source.SaveVersion()
+	require.NoError(t, err)
+	itree, err := source.GetImmutable(version)
+	require.NoError(t, err)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	hints := BackendHints{
+		Import:    dbm.Hint{DisableWAL: true},
+		Iteration: dbm.Hint{NoFillCache: true},
+	}
+	db := &hintRecordingDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), BackendHintsOption(hints))
+	importer, err := tree.Import(version)
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		item, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(item))
+	}
+	require.NoError(t, importer.Commit())
+	require.NotEmpty(t, db.batchHints)
+	for _, hint := range db.batchHints {
+		require.Equal(t, hints.Import, hint)
+	}
+
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		count++
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, 10, count)
+	require.NotEmpty(t, db.iteratorHints)
+	for _, hint := range db.iteratorHints {
+		require.Equal(t, hints.Iteration, hint)
+	}
+}
+
+func TestSnapshotDB(t *testing.T) {
+	db := dbm.NewSnapshotDB()
+	memDB := dbm.NewMemDB()
+	for i := 0; i < 300; i += 2 {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		require.NoError(t, db.Set(key, key))
+		require.NoError(t, memDB.Set(key, key))
+	}
+
+	// iterators match those of MemDB across chunks and domains
+	domains := [][2][]byte{
+		{nil, nil},
+		{[]byte("key010"), nil},
+		{nil, []byte("key201")},
+		{[]byte("key011"), []byte("key200")},
+		{[]byte("zzz"), nil},
+	}
+	collect := func(itr corestore.Iterator, err error) []string {
+		require.NoError(t, err)
+		defer itr.Close()
+		keys := []string{}
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Key()))
+		}
+		return keys
+	}
+	for _, d := range domains {
+		require.Equal(t, collect(memDB.Iterator(d[0], d[1])), collect(db.Iterator(d[0], d[1])))
+		require.Equal(t, collect(memDB.ReverseIterator(d[0], d[1])), collect(db.ReverseIterator(d[0], d[1])))
+	}
+
+	// trees in a snapshot and its origin diverge independently
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	fork := NewMutableTree(db.Snapshot(), 0, false, NewNopLogger())
+	_, err = fork.Load()
+	require.NoError(t, err)
+	_, err = fork.Set([]byte("a"), []byte("2"))
+	require.NoError(t, err)
+	_, _, err = fork.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	value, err := tree.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	value, err = fork.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	has, err := fork.Has([]byte("b"))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.NotEqual(t, tree.Hash(), fork.Hash())
+}
+
+func TestIterateOrphans(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte{byte(i * (v + 1))}, []byte{byte(v)})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	orphans := map[string]bool{}
+	require.NoError(t, tree.IterateOrphans(1, func(node *Node) error {
+		orphans[string(tree.ndb.nodeKey(node.GetKey()))] = true
+		return nil
+	}))
+	require.NotEmpty(t, orphans)
+
+	before, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	after, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	remaining := map[string]bool{}
+	for _, node := range after {
+		remaining[string(tree.ndb.nodeKey(node.GetKey()))] = true
+	}
+	deleted := map[string]bool{}
+	for _, node := range before {
+		if key := string(tree.ndb.nodeKey(node.GetKey())); !remaining[key] {
+			deleted[key] = true
+		}
+	}
+	require.Equal(t, orphans, deleted)
+
+	err = tree.IterateOrphans(1, func(*Node) error { return nil })
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.Error(t, tree.IterateOrphans(3, func(*Node) error { return nil }))
+}
+
+func TestIterateNodesAtVersion(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for v := 0; v < 4; v++ {
+		// version 4 is saved without changes
+		for i := 0; i < 20 && v < 3; i++ {
+			_, err := tree.Set([]byte{byte(i * (v + 1))}, []byte{byte(v)})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(1))
+
+	expected := map[int64][]string{}
+	nodes, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	for _, node := range nodes {
+		expected[node.nodeKey.version] = append(expected[node.nodeKey.version], string(node.GetKey()))
+	}
+	totalBytes := 0
+	require.NoError(t, tree.ndb.traversePrefix(nodeKeyFormat.Prefix(), func(key, value []byte) error {
+		if isRef, _ := isReferenceRoot(value); !isRef {
+			totalBytes += len(key) + len(value)
+		}
+		return nil
+	}))
+
+	storedBytes := 0
+	for v := int64(1); v <= 4; v++ {
+		var keys []string
+		require.NoError(t, tree.IterateNodesAtVersion(v, func(node *Node, size int) error {
+			require.Equal(t, v, node.nodeKey.version)
+			keys = append(keys, string(node.GetKey()))
+			storedBytes += size
+			return nil
+		}))
+		require.ElementsMatch(t, expected[v], keys, "version %d", v)
+	}
+	// the nodes of version 1 still referenced by the later versions are kept
+	require.NotEmpty(t, expected[1])
+	require.Empty(t, expected[4])
+	require.Equal(t, totalBytes, storedBytes)
+}
+
+func TestNodePool(t *testing.T) {
+	pool := NewNodePool()
+	trees := []*MutableTree{
+		NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()),
+		NewMutableTree(dbm.NewMemDB(), 100, false, NewNopLogger(), NodePoolOption(pool)),
+	}
+	for _, tree := range trees {
+		for v := 0; v < 5; v++ {
+			for i := 0; i < 50; i++ {
+				_, err := tree.Set([]byte{byte(i * (v + 1))}, []byte{byte(v)})
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		require.NoError(t, tree.DeleteVersionsTo(3))
+	}
+	nodes := make([][]string, len(trees))
+	for i, tree := range trees {
+		stored, err := tree.ndb.nodes()
+		require.NoError(t, err)
+		for _, node := range stored {
+			nodes[i] = append(nodes[i], string(node.GetKey()))
+		}
+	}
+	require.Equal(t, nodes[0], nodes[1])
+	require.Equal(t, trees[0].Hash(), trees[1].Hash())
+
+	// a node read into a pooled node isn't cached, and a cached one is copied
+	tree := trees[1]
+	rootKey, err := tree.ndb.GetRoot(5)
+	require.NoError(t, err)
+	root, err := tree.ndb.GetNode(rootKey)
+	require.NoError(t, err)
+	node := pool.Get()
+	require.NoError(t, tree.ndb.getNodeInto(root.leftNodeKey, node))
+	require.Nil(t, tree.ndb.nodeCache.Get(root.leftNodeKey))
+	pool.Put(node)
+	node = pool.Get()
+	require.NoError(t, tree.ndb.getNodeInto(rootKey, node))
+	require.Equal(t, root.hash, node.hash)
+	require.NotSame(t, root, node)
+	require.ErrorIs(t, tree.ndb.getNodeInto(nil, node), ErrNodeMissingNodeKey)
+}
+
+func TestRootCache(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), RootCacheSizeOption(2))
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	hashes := map[int64][]byte{}
+	for v := int64(1); v <= 4; v++ {
+		// versions 2 and 3 are saved without changes, they reference the root of version 1
+		if v == 4 {
+			_, err = tree.Set([]byte("b"), []byte("2"))
+			require.NoError(t, err)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[v] = hash
+	}
+	getHash := func(version int64) []byte {
+		immutable, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		return immutable.Hash()
+	}
+
+	require.Equal(t, hashes[3], getHash(3))
+	before, ok := tree.RootCacheStats()
+	require.True(t, ok)
+	require.Equal(t, hashes[3], getHash(3))
+	stats, _ := tree.RootCacheStats()
+	require.Equal(t, before.Hits+1, stats.Hits)
+	require.Equal(t, before.Misses, stats.Misses)
+	for v := int64(1); v <= 4; v++ {
+		require.Equal(t, hashes[v], getHash(v))
+	}
+	stats, _ = tree.RootCacheStats()
+	require.Equal(t, 2, stats.Size)
+
+	// pruning version 1 reformats the root referenced by versions 2 and 3
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	stats, _ = tree.RootCacheStats()
+	require.Greater(t, stats.Invalidations, before.Invalidations)
+	require.Zero(t, stats.Size)
+	require.Equal(t, hashes[2], getHash(2))
+	require.Equal(t, hashes[3], getHash(3))
+
+	// a rollback rewrites version 4
+	require.Equal(t, hashes[4], getHash(4))
+	require.NoError(t, tree.LoadVersionForOverwriting(3))
+	_, err = tree.Set([]byte("c"), []byte("3"))
+	require.NoError(t, err)
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.NotEqual(t, hashes[4], hash)
+	require.Equal(t, hash, getHash(4))
+
+	_, ok = NewMutableTree(db, 0, false, NewNopLogger()).RootCacheStats()
+	require.False(t, ok)
+}
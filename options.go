@@ -1,6 +1,17 @@
 package iavl
 
-import "sync/atomic"
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	corestore "cosmossdk.io/core/store"
+
+	"github.com/cosmos/iavl/cache"
+	dbm "github.com/cosmos/iavl/db"
+)
 
 // Statisc about db runtime state
 type Statistics struct {
@@ -15,6 +26,11 @@ type Statistics struct {
 
 	// Each time GetFastNode operation miss cache
 	fastCacheMissCnt uint64
+
+	// The size of the keys and values changed by the user, and of the nodes written, by the saved
+	// versions
+	userBytesWritten uint64
+	nodeBytesWritten uint64
 }
 
 func (stat *Statistics) IncCacheHitCnt() {
@@ -45,6 +61,16 @@ func (stat *Statistics) IncFastCacheMissCnt() {
 	atomic.AddUint64(&stat.fastCacheMissCnt, 1)
 }
 
+// AddBytesWritten adds the size of the keys and values changed by the user in a saved version, and
+// of the nodes it wrote.
+func (stat *Statistics) AddBytesWritten(userBytes, nodeBytes int64) {
+	if stat == nil {
+		return
+	}
+	atomic.AddUint64(&stat.userBytesWritten, uint64(userBytes))
+	atomic.AddUint64(&stat.nodeBytesWritten, uint64(nodeBytes))
+}
+
 func (stat *Statistics) GetCacheHitCnt() uint64 {
 	return atomic.LoadUint64(&stat.cacheHitCnt)
 }
@@ -61,11 +87,32 @@ func (stat *Statistics) GetFastCacheMissCnt() uint64 {
 	return atomic.LoadUint64(&stat.fastCacheMissCnt)
 }
 
+func (stat *Statistics) GetUserBytesWritten() uint64 {
+	return atomic.LoadUint64(&stat.userBytesWritten)
+}
+
+func (stat *Statistics) GetNodeBytesWritten() uint64 {
+	return atomic.LoadUint64(&stat.nodeBytesWritten)
+}
+
+// GetWriteAmplification returns the ratio of the bytes of the nodes written to the bytes of the
+// keys and values changed by the user, over the versions saved since the last Reset, or 0 if
+// nothing was changed, see SaveVersionStats.WriteAmplification for a single version.
+func (stat *Statistics) GetWriteAmplification() float64 {
+	userBytes := stat.GetUserBytesWritten()
+	if userBytes == 0 {
+		return 0
+	}
+	return float64(stat.GetNodeBytesWritten()) / float64(userBytes)
+}
+
 func (stat *Statistics) Reset() {
 	atomic.StoreUint64(&stat.cacheHitCnt, 0)
 	atomic.StoreUint64(&stat.cacheMissCnt, 0)
 	atomic.StoreUint64(&stat.fastCacheHitCnt, 0)
 	atomic.StoreUint64(&stat.fastCacheMissCnt, 0)
+	atomic.StoreUint64(&stat.userBytesWritten, 0)
+	atomic.StoreUint64(&stat.nodeBytesWritten, 0)
 }
 
 // Options define tree options.
@@ -87,6 +134,237 @@ type Options struct {
 
 	// AsyncPruning is a flag to enable async pruning
 	AsyncPruning bool
+
+	// StrictLoad makes LoadVersion fail with a MigrationRequiredError instead of writing a
+	// migration, i.e. the fast storage upgrade, so read-only tooling never mutates the database it
+	// is pointed at. Open such trees with skipFastStorageUpgrade to read them without the fast
+	// node index.
+	StrictLoad bool
+
+	// Namespace stores the tree under the namespace in a database shared with other trees, instead
+	// of in a database of its own, to save the file handles and compactions of many databases. All
+	// keys of the tree, and so its pruning and storage usage, are confined to the namespace, see
+	// NamespaceUsage. A tree without a namespace must not share the database.
+	Namespace []byte
+
+	// MaxBatchBytes caps the estimated size of every write batch, including the batches of
+	// SaveVersion and imports, which are flushed in chunks once they would exceed it. A commit
+	// marker is written after all records of a version, so a partially flushed version is ignored
+	// on load.
+	// Zero leaves the nodeDB batch to FlushThreshold and import batches to a node count limit.
+	MaxBatchBytes int
+
+	// AdaptiveCacheMinBytes and AdaptiveCacheMaxBytes enable an adaptive node cache bounded by the
+	// estimated byte size of its nodes. Its limit moves between the two bounds based on the hit
+	// rate, and it replaces the node count based cacheSize when AdaptiveCacheMaxBytes is set.
+	AdaptiveCacheMinBytes int64
+	AdaptiveCacheMaxBytes int64
+
+	// AdaptiveCacheHeapLimit makes the adaptive node cache shrink while the heap exceeds it.
+	AdaptiveCacheHeapLimit uint64
+
+	// FastNodeCache returns a new cache of the fast nodes of the latest version, which is read
+	// without the lock of the tree, so it must be safe for concurrent use. It is called again when
+	// the cache is reset. Defaults to a cache.ShardedCache of 100000 fast nodes.
+	FastNodeCache func() cache.Cache
+
+	// RootCacheSize is the number of recent versions whose root node keys are cached, since they
+	// are resolved by every GetImmutable and SaveVersion, e.g. following the reference roots of
+	// versions saved without changes. Pruning and rollbacks invalidate the cache. Zero disables it.
+	// See MutableTree.RootCacheStats.
+	RootCacheSize int
+
+	// ChangelogWriter receives a ChangelogRecord with the changes and root hash of every version
+	// saved by SaveVersion, before the version is committed, and its commit marker after it, and a
+	// record of every rollback by LoadVersionForOverwriting or DeleteVersionsFrom. A write error of
+	// the record of a version fails SaveVersion, one of its marker is logged.
+	ChangelogWriter io.Writer
+
+	// IntentLogWriter receives an IntentRecord for every Set and Remove call before it is applied
+	// to the working tree, and for every SaveVersion and Rollback, so that the changes of a version
+	// lost in a crash can be diagnosed and replayed with ReplayIntentLog. A write error fails the
+	// call before the tree is changed.
+	IntentLogWriter io.Writer
+
+	// DedupValueThreshold stores leaf values of at least this many bytes once by their hash, with a
+	// reference count, instead of in every node version holding them. Zero disables it. Hashes and
+	// proofs are not affected.
+	DedupValueThreshold int
+
+	// ValueChecksums stores a CRC-32C checksum of the value with every new leaf and fast node, so
+	// on-disk corruption of values is detected when they are read, e.g. by Get, without verifying
+	// the node hashes. The nodes written with it are not readable by older releases.
+	ValueChecksums bool
+
+	// KeyPrefixDictionary are shared key prefixes, e.g. module or address prefixes, which the new
+	// nodes starting with them store as an id into the dictionary instead. The nodes are read one
+	// at a time by their node key, so they can't be encoded relative to the key of a neighbour.
+	// The dictionary is persisted in the order the prefixes were first configured, so nodes
+	// written with them stay readable when they are no longer configured.
+	KeyPrefixDictionary [][]byte
+
+	// KeyValidator is called with the key of every Set, Remove and RemoveMany, which fail with
+	// ErrInvalidKey wrapping its error, so store wrappers can enforce the prefixes or shapes of
+	// their keys in the tree, and catch the writes of other modules to their key domain at write
+	// time. It must not modify or retain the key.
+	KeyValidator func(key []byte) error
+
+	// AllowEmptyValues makes Set(key, nil) store an empty value instead of failing, so callers can
+	// store empty values without allocating them. An empty value is a value like any other: Get
+	// returns a non-nil empty slice for it, unlike for an absent key, and it has membership proofs,
+	// verified by the verify package. An Importer of a tree with it reads a leaf missing its value
+	// as an empty value, since the export stream omits them.
+	AllowEmptyValues bool
+
+	// AsyncFastNodeWrites persists the fast node changes of a version in the background after
+	// SaveVersion returns, instead of with the version. The fast node index isn't read until the
+	// write is done, and it is rebuilt from the tree on load if the write was lost in a crash.
+	AsyncFastNodeWrites bool
+
+	// BackendHints tune the batches and iterators of some workloads, if the database implements
+	// dbm.HintedDB.
+	BackendHints BackendHints
+
+	// AccessHook is called on every Get, Set, Remove and iteration of the tree, e.g. to build an
+	// audit log of the state access. The key is the start of the domain of iterations, nil for a
+	// full iteration, and the version is the version of the tree, the working version for a
+	// MutableTree. It must not modify or retain the key, and it must be safe for concurrent use
+	// if the tree is read concurrently.
+	AccessHook func(op AccessOp, key []byte, version int64)
+
+	// ValueHashIndex maintains an index of the keys of the latest version by the SHA-256 hash of
+	// their value, updated with every SaveVersion, for reverse lookups with FindByValueHash. It
+	// covers the versions saved while it is set, see RebuildValueHashIndex.
+	ValueHashIndex bool
+
+	// ChainedHashes stores chainedHash(v) = SHA-256(chainedHash(v-1) || rootHash(v)) with every
+	// SaveVersion, retrievable with ChainedHash, as a tamper-evident sequence over the historical
+	// roots which is kept when their versions are pruned.
+	ChainedHashes bool
+
+	// Pruning triggers pruning from SaveVersion by the accumulated orphaned nodes, so bursty write
+	// workloads don't grow the disk usage between interval based prunes.
+	Pruning PruningOptions
+
+	// PruneHook is called after every pruning of versions, by DeleteVersionsTo or Pruning, e.g. for
+	// snapshot managers and monitoring agents to react to the retention instead of polling
+	// AvailableVersions. The deletions are written to the database with the next commit of the
+	// tree, and with AsyncPruning, it is called from the pruning goroutine.
+	PruneHook func(PruneEvent)
+
+	// ColdStorage is a secondary, cheaper backend, e.g. on slower disks or object storage, which
+	// MutableTree.MoveToColdStorage migrates the nodes only reachable from old versions to. The nodes
+	// missing from the primary backend are read from it transparently. It is shared by the trees
+	// opened on the same primary backend, with the same Namespace.
+	ColdStorage corestore.KVStoreWithBatch
+
+	// NodePool recycles the nodes read by the traversals of the orphans of versions, e.g. by
+	// pruning, instead of allocating them, to cut the GC churn of steady-state pruning. The nodes
+	// of these traversals are decoded into nodes of the pool and bypass the node cache, since a
+	// cached node is shared with the trees and iterators reading it, and can't be recycled when it
+	// is evicted. The orphans passed to IterateOrphans are then only valid during the call.
+	NodePool *NodePool
+
+	// Clock returns the time SaveVersion records for a version, see MutableTree.VersionTime and
+	// PruningOptions.KeepDuration. Defaults to time.Now.
+	Clock func() time.Time
+
+	// LatencyExpvar publishes latency histograms of Get, Set, SaveVersion, GetProof and the import
+	// chunk writes under this expvar name, served at /debug/vars by the expvar handler, for quick
+	// diagnosis without a metrics stack. Trees with the same name share the histograms. Empty
+	// disables them.
+	LatencyExpvar string
+
+	// ShadowDB mirrors the tree into a shadow tree stored in this database, e.g. on another
+	// backend, as a debugging mode to validate a backend migration or an encoding change: the
+	// changes, saves, rollbacks and loads of the tree are repeated on the shadow tree, and their
+	// versions and root hashes compared at every SaveVersion and load. The first divergence is
+	// logged and kept, see MutableTree.ShadowDivergence, and the shadow tree is dropped, so a
+	// canary running it keeps committing. The shadow tree has the options of the tree, without its
+	// side effects, e.g. the changelog, and with ShadowOptions on top.
+	ShadowDB corestore.KVStoreWithBatch
+
+	// ShadowOptions are applied to the shadow tree of ShadowDB, e.g. the encoding options under
+	// test.
+	ShadowOptions []Option
+
+	// MaxDepth is the maximum height of the trees the recursive operations, e.g. Set, Remove, Get
+	// and the proofs, descend into, above which they fail with ErrMaxDepthExceeded instead of
+	// exhausting the stack or running for long on a corrupted tree. The heights must decrease on
+	// the way down regardless, so a cyclic node reference fails with ErrCorruptNode. Zero doesn't
+	// limit the height, which is at most 127.
+	MaxDepth int
+
+	// BalanceSlack relaxes the balance of the tree for append-mostly workloads: the heights of the
+	// subtrees of a node may differ by up to BalanceSlack, instead of one, before it is rotated.
+	// This cuts the rotations, and the nodes off the updated paths they rewrite, e.g. on removals,
+	// at the cost of deeper trees, and so longer updated paths, so its effect on the orphaned nodes
+	// depends on the workload, see IterateOrphans. Values below 2 keep the strict balance, and
+	// values above 4 are treated as 4.
+	// The hashes and proofs are computed as usual, but the trees have other shapes, and so other
+	// hashes, so all the nodes of a network must use the same value. It is recorded with the first
+	// version saved with it, and LoadVersion fails if the tree was saved with another.
+	BalanceSlack int
+
+	// FastNodeCacheSize is the number of fast nodes in the default fast node cache, when
+	// FastNodeCache is unset. Defaults to 100000.
+	FastNodeCacheSize int
+
+	// ImportBatchSize is the number of nodes an Importer writes per batch, which MaxBatchBytes
+	// further limits. Defaults to 10000.
+	ImportBatchSize int
+
+	// ExportBufferSize is the number of nodes an Exporter buffers ahead of its caller. Defaults to
+	// 32.
+	ExportBufferSize int
+
+	// FastIndexShards stores the fast node index in these databases instead, e.g. separate
+	// backends or column families, sharded by the leading byte of the keys, so very large states
+	// are compacted in parallel and the keys of a module, which share their leading byte, are
+	// scanned from a single shard. Each shard holds a contiguous range of leading bytes, so at most
+	// 256 are used. The shards may be shared by trees with different Namespaces, and are left open
+	// by Close. The fast node changes of a version are written to the shards after the version,
+	// like with AsyncFastNodeWrites but before SaveVersion returns, so a lost write makes the index
+	// get rebuilt on load. Changing the shards rebuilds the index too, without deleting the fast
+	// nodes left in the previous shards.
+	FastIndexShards []corestore.KVStoreWithBatch
+}
+
+// AccessOp is an operation reported to Options.AccessHook.
+type AccessOp int
+
+const (
+	AccessGet AccessOp = iota + 1
+	AccessSet
+	AccessRemove
+	AccessIterate
+)
+
+// String implements fmt.Stringer.
+func (op AccessOp) String() string {
+	switch op {
+	case AccessGet:
+		return "get"
+	case AccessSet:
+		return "set"
+	case AccessRemove:
+		return "remove"
+	case AccessIterate:
+		return "iterate"
+	default:
+		return fmt.Sprintf("AccessOp(%d)", int(op))
+	}
+}
+
+// BackendHints are the hints passed to a dbm.HintedDB for the workloads of the nodeDB.
+type BackendHints struct {
+	// Import tunes the batches of Importer, e.g. to disable the write-ahead log.
+	Import dbm.Hint
+	// Iteration tunes the iterators over the fast node index, e.g. to not fill the block cache.
+	Iteration dbm.Hint
+	// Pruning tunes the scans and deletes of legacy versions during pruning, e.g. to run them at a
+	// low priority. The deletes of other versions are written with the commit of a version.
+	Pruning dbm.Hint
 }
 
 // DefaultOptions returns the default options for IAVL.
@@ -101,6 +379,20 @@ func SyncOption(sync bool) Option {
 	}
 }
 
+// StrictLoadOption sets the StrictLoad for the tree.
+func StrictLoadOption(strict bool) Option {
+	return func(opts *Options) {
+		opts.StrictLoad = strict
+	}
+}
+
+// NamespaceOption sets the Namespace for the tree.
+func NamespaceOption(namespace []byte) Option {
+	return func(opts *Options) {
+		opts.Namespace = namespace
+	}
+}
+
 // InitialVersionOption sets the initial version for the tree.
 func InitialVersionOption(iv uint64) Option {
 	return func(opts *Options) {
@@ -108,6 +400,56 @@ func InitialVersionOption(iv uint64) Option {
 	}
 }
 
+// ShadowDBOption sets the ShadowDB and ShadowOptions for the tree.
+func ShadowDBOption(db corestore.KVStoreWithBatch, options ...Option) Option {
+	return func(opts *Options) {
+		opts.ShadowDB = db
+		opts.ShadowOptions = options
+	}
+}
+
+// MaxDepthOption sets the MaxDepth for the tree.
+func MaxDepthOption(depth int) Option {
+	return func(opts *Options) {
+		opts.MaxDepth = depth
+	}
+}
+
+// BalanceSlackOption sets the BalanceSlack for the tree.
+func BalanceSlackOption(slack int) Option {
+	return func(opts *Options) {
+		opts.BalanceSlack = slack
+	}
+}
+
+// FastNodeCacheSizeOption sets the FastNodeCacheSize for the tree.
+func FastNodeCacheSizeOption(size int) Option {
+	return func(opts *Options) {
+		opts.FastNodeCacheSize = size
+	}
+}
+
+// ImportBatchSizeOption sets the ImportBatchSize for the tree.
+func ImportBatchSizeOption(size int) Option {
+	return func(opts *Options) {
+		opts.ImportBatchSize = size
+	}
+}
+
+// ExportBufferSizeOption sets the ExportBufferSize for the tree.
+func ExportBufferSizeOption(size int) Option {
+	return func(opts *Options) {
+		opts.ExportBufferSize = size
+	}
+}
+
+// FastIndexShardsOption sets the FastIndexShards for the tree.
+func FastIndexShardsOption(shards ...corestore.KVStoreWithBatch) Option {
+	return func(opts *Options) {
+		opts.FastIndexShards = shards
+	}
+}
+
 // StatOption sets the Statistics for the tree.
 func StatOption(stats *Statistics) Option {
 	return func(opts *Options) {
@@ -128,3 +470,246 @@ func AsyncPruningOption(asyncPruning bool) Option {
 		opts.AsyncPruning = asyncPruning
 	}
 }
+
+// MaxBatchBytesOption sets the MaxBatchBytes for the tree.
+func MaxBatchBytesOption(maxBatchBytes int) Option {
+	return func(opts *Options) {
+		opts.MaxBatchBytes = maxBatchBytes
+	}
+}
+
+// flushThreshold returns the size at which the nodeDB batch is flushed.
+func (opts Options) flushThreshold() int {
+	if opts.MaxBatchBytes > 0 && opts.MaxBatchBytes < opts.FlushThreshold {
+		return opts.MaxBatchBytes
+	}
+	return opts.FlushThreshold
+}
+
+// fastNodeCacheSize returns the FastNodeCacheSize, or its default.
+func (opts Options) fastNodeCacheSize() int {
+	if opts.FastNodeCacheSize > 0 {
+		return opts.FastNodeCacheSize
+	}
+	return fastNodeCacheSize
+}
+
+// importBatchSize returns the ImportBatchSize, or its default.
+func (opts Options) importBatchSize() int {
+	if opts.ImportBatchSize > 0 {
+		return opts.ImportBatchSize
+	}
+	return maxBatchSize
+}
+
+// exportBufferSize returns the ExportBufferSize, or its default.
+func (opts Options) exportBufferSize() int {
+	if opts.ExportBufferSize > 0 {
+		return opts.ExportBufferSize
+	}
+	return exportBufferSize
+}
+
+// reconfigurableOptions are the fields of Options which Reconfigure can change, since they are
+// read when used rather than when the tree is opened, and don't change what is stored.
+var reconfigurableOptions = map[string]bool{
+	"FlushThreshold":   true,
+	"MaxBatchBytes":    true,
+	"Pruning":          true,
+	"ImportBatchSize":  true,
+	"ExportBufferSize": true,
+}
+
+// Reconfigure applies options to the open tree, e.g. to tune the batch sizes or the pruning of a
+// running node without restarting it. Only FlushThreshold, MaxBatchBytes, Pruning,
+// ImportBatchSize and ExportBufferSize can be changed, the other options fail without changing
+// anything. Like the writes, it must not be called concurrently with the other methods of the
+// tree, and applies to the imports and exports started after it.
+func (tree *MutableTree) Reconfigure(options ...Option) error {
+	if tree.closed {
+		return ErrTreeClosed
+	}
+	updated := tree.ndb.opts
+	for _, opt := range options {
+		opt(&updated)
+	}
+	// the functions can't be compared, so those the options set are found on empty options
+	var set Options
+	for _, opt := range options {
+		opt(&set)
+	}
+	current, next, probe := reflect.ValueOf(tree.ndb.opts), reflect.ValueOf(updated), reflect.ValueOf(set)
+	for i := 0; i < current.NumField(); i++ {
+		name := current.Type().Field(i).Name
+		if reconfigurableOptions[name] {
+			continue
+		}
+		if !sameOption(current.Field(i), next.Field(i), probe.Field(i)) {
+			return fmt.Errorf("option %s can't be changed on an open tree", name)
+		}
+	}
+
+	tree.ndb.opts.FlushThreshold = updated.FlushThreshold
+	tree.ndb.opts.MaxBatchBytes = updated.MaxBatchBytes
+	tree.ndb.opts.Pruning = updated.Pruning
+	tree.ndb.opts.ImportBatchSize = updated.ImportBatchSize
+	tree.ndb.opts.ExportBufferSize = updated.ExportBufferSize
+	if batch, ok := tree.ndb.batch.(*BatchWithFlusher); ok {
+		batch.setFlushThreshold(updated.flushThreshold())
+	}
+	return nil
+}
+
+// sameOption returns true if the values of an option are the same. A function is changed if the
+// options set it, to probe, or cleared it: the closures of a function literal share their code
+// pointer, so two hooks can't be told apart.
+func sameOption(a, b, probe reflect.Value) bool {
+	if a.Kind() == reflect.Func {
+		return probe.IsNil() && a.IsNil() == b.IsNil()
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// AdaptiveCacheOption enables the adaptive node cache with the given byte bounds and heap limit,
+// see Options.AdaptiveCacheMaxBytes. A zero heapLimit disables the memory pressure signal.
+func AdaptiveCacheOption(minBytes, maxBytes int64, heapLimit uint64) Option {
+	return func(opts *Options) {
+		opts.AdaptiveCacheMinBytes = minBytes
+		opts.AdaptiveCacheMaxBytes = maxBytes
+		opts.AdaptiveCacheHeapLimit = heapLimit
+	}
+}
+
+// FastNodeCacheOption sets the FastNodeCache for the tree.
+func FastNodeCacheOption(newCache func() cache.Cache) Option {
+	return func(opts *Options) {
+		opts.FastNodeCache = newCache
+	}
+}
+
+// RootCacheSizeOption sets the RootCacheSize for the tree.
+func RootCacheSizeOption(size int) Option {
+	return func(opts *Options) {
+		opts.RootCacheSize = size
+	}
+}
+
+// ChangelogWriterOption sets the ChangelogWriter for the tree.
+func ChangelogWriterOption(w io.Writer) Option {
+	return func(opts *Options) {
+		opts.ChangelogWriter = w
+	}
+}
+
+// IntentLogWriterOption sets the IntentLogWriter for the tree.
+func IntentLogWriterOption(w io.Writer) Option {
+	return func(opts *Options) {
+		opts.IntentLogWriter = w
+	}
+}
+
+// DedupValueThresholdOption sets the DedupValueThreshold for the tree.
+func DedupValueThresholdOption(threshold int) Option {
+	return func(opts *Options) {
+		opts.DedupValueThreshold = threshold
+	}
+}
+
+// ValueChecksumsOption sets the ValueChecksums for the tree.
+func ValueChecksumsOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.ValueChecksums = enabled
+	}
+}
+
+// KeyPrefixDictionaryOption sets the KeyPrefixDictionary for the tree.
+func KeyPrefixDictionaryOption(prefixes ...[]byte) Option {
+	return func(opts *Options) {
+		opts.KeyPrefixDictionary = prefixes
+	}
+}
+
+// KeyValidatorOption sets the KeyValidator for the tree.
+func KeyValidatorOption(validator func(key []byte) error) Option {
+	return func(opts *Options) {
+		opts.KeyValidator = validator
+	}
+}
+
+// AllowEmptyValuesOption sets the AllowEmptyValues for the tree.
+func AllowEmptyValuesOption(allow bool) Option {
+	return func(opts *Options) {
+		opts.AllowEmptyValues = allow
+	}
+}
+
+// AsyncFastNodeWritesOption sets the AsyncFastNodeWrites for the tree.
+func AsyncFastNodeWritesOption(async bool) Option {
+	return func(opts *Options) {
+		opts.AsyncFastNodeWrites = async
+	}
+}
+
+// BackendHintsOption sets the BackendHints for the tree.
+func BackendHintsOption(hints BackendHints) Option {
+	return func(opts *Options) {
+		opts.BackendHints = hints
+	}
+}
+
+// AccessHookOption sets the AccessHook for the tree.
+func AccessHookOption(hook func(op AccessOp, key []byte, version int64)) Option {
+	return func(opts *Options) {
+		opts.AccessHook = hook
+	}
+}
+
+// LatencyExpvarOption sets the LatencyExpvar for the tree.
+func LatencyExpvarOption(name string) Option {
+	return func(opts *Options) {
+		opts.LatencyExpvar = name
+	}
+}
+
+// ChainedHashesOption sets the ChainedHashes for the tree.
+func ChainedHashesOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.ChainedHashes = enabled
+	}
+}
+
+// ColdStorageOption sets the ColdStorage for the tree.
+func ColdStorageOption(db corestore.KVStoreWithBatch) Option {
+	return func(opts *Options) {
+		opts.ColdStorage = db
+	}
+}
+
+// NodePoolOption sets the NodePool for the tree.
+func NodePoolOption(pool *NodePool) Option {
+	return func(opts *Options) {
+		opts.NodePool = pool
+	}
+}
+
+// ClockOption sets the Clock for the tree.
+func ClockOption(clock func() time.Time) Option {
+	return func(opts *Options) {
+		opts.Clock = clock
+	}
+}
+
+// now returns the time of the Clock, or the current time.
+func (opts Options) now() time.Time {
+	if opts.Clock != nil {
+		return opts.Clock()
+	}
+	return time.Now()
+}
+
+// ValueHashIndexOption sets the ValueHashIndex for the tree.
+func ValueHashIndexOption(enabled bool) Option {
+	return func(opts *Options) {
+		opts.ValueHashIndex = enabled
+	}
+}
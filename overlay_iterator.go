@@ -0,0 +1,126 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+
+	"cosmossdk.io/core/store"
+)
+
+// overlayEntry is an unsaved change merged by overlayIterator. A nil value marks a removed key.
+type overlayEntry struct {
+	key   []byte
+	value []byte
+}
+
+// overlayIterator merges an iterator over saved state with a set of unsaved changes. A change
+// prevails over the saved entry of its key, and a removal hides it, so removed keys are skipped
+// whether or not they were updated before.
+type overlayIterator struct {
+	parent    store.Iterator
+	overlay   []overlayEntry
+	ascending bool
+	idx       int
+	key       []byte
+	value     []byte
+	valid     bool
+}
+
+var _ store.Iterator = (*overlayIterator)(nil)
+
+// newOverlayIterator returns an iterator merging parent with the overlay changes, which must have
+// distinct keys within the domain of parent. The overlay is sorted in the iteration order.
+func newOverlayIterator(parent store.Iterator, overlay []overlayEntry, ascending bool) *overlayIterator {
+	sort.Slice(overlay, func(i, j int) bool {
+		if ascending {
+			return bytes.Compare(overlay[i].key, overlay[j].key) < 0
+		}
+		return bytes.Compare(overlay[i].key, overlay[j].key) > 0
+	})
+	iter := &overlayIterator{
+		parent:    parent,
+		overlay:   overlay,
+		ascending: ascending,
+	}
+	iter.Next()
+	return iter
+}
+
+// Domain implements store.Iterator.
+func (iter *overlayIterator) Domain() ([]byte, []byte) {
+	return iter.parent.Domain()
+}
+
+// Valid implements store.Iterator.
+func (iter *overlayIterator) Valid() bool {
+	return iter.valid
+}
+
+// Key implements store.Iterator.
+func (iter *overlayIterator) Key() []byte {
+	return iter.key
+}
+
+// Value implements store.Iterator.
+func (iter *overlayIterator) Value() []byte {
+	return iter.value
+}
+
+// Next implements store.Iterator.
+func (iter *overlayIterator) Next() {
+	for {
+		if iter.parent.Error() != nil {
+			iter.setInvalid()
+			return
+		}
+
+		parentValid := iter.parent.Valid()
+		overlayValid := iter.idx < len(iter.overlay)
+		if !parentValid && !overlayValid {
+			iter.setInvalid()
+			return
+		}
+
+		if parentValid && overlayValid {
+			cmp := bytes.Compare(iter.parent.Key(), iter.overlay[iter.idx].key)
+			if !iter.ascending {
+				cmp = -cmp
+			}
+			if cmp < 0 {
+				overlayValid = false
+			} else if cmp == 0 {
+				// the change prevails over the saved entry
+				iter.parent.Next()
+			}
+		}
+
+		if !overlayValid {
+			iter.key, iter.value, iter.valid = iter.parent.Key(), iter.parent.Value(), true
+			iter.parent.Next()
+			return
+		}
+
+		entry := iter.overlay[iter.idx]
+		iter.idx++
+		if entry.value == nil {
+			continue
+		}
+		iter.key, iter.value, iter.valid = entry.key, entry.value, true
+		return
+	}
+}
+
+func (iter *overlayIterator) setInvalid() {
+	iter.key, iter.value, iter.valid = nil, nil, false
+}
+
+// Close implements store.Iterator.
+func (iter *overlayIterator) Close() error {
+	iter.setInvalid()
+	return iter.parent.Close()
+}
+
+// Error implements store.Iterator.
+func (iter *overlayIterator) Error() error {
+	return iter.parent.Error()
+}
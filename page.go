@@ -0,0 +1,92 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// pageCursorFormat is the leading byte of the cursors returned by Page, reserved to evolve the
+// cursor encoding without breaking the cursors handed out to clients.
+const pageCursorFormat = 0x01
+
+// ErrInvalidCursor is returned by Page when the given cursor was not produced by Page.
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// Page returns up to limit key/value pairs in ascending key order, starting at start (inclusive,
+// nil for the first key) and continuing after cursor when it is not nil. The returned cursor is
+// opaque and nil once the last page was returned.
+//
+// A cursor only captures the position "after the last returned key". It stays valid across
+// versions, i.e. it resolves to the next key after the last returned one that exists in the tree
+// it is used against, even if that key was removed in the meantime. The returned keys and values
+// must not be modified, since they may point to data stored within IAVL.
+func (t *ImmutableTree) Page(start []byte, limit int, cursor []byte) ([]*KVPair, []byte, error) {
+	start, err := pageStart(start, limit, cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	itr, err := t.Iterator(start, nil, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return page(itr, limit)
+}
+
+// Page returns a page of the working tree, including unsaved changes. See ImmutableTree.Page.
+func (tree *MutableTree) Page(start []byte, limit int, cursor []byte) ([]*KVPair, []byte, error) {
+	start, err := pageStart(start, limit, cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	itr, err := tree.Iterator(start, nil, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return page(itr, limit)
+}
+
+// pageStart resolves the key to start the page from.
+func pageStart(start []byte, limit int, cursor []byte) ([]byte, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("page limit must be positive, got %d", limit)
+	}
+	if cursor == nil {
+		return start, nil
+	}
+	if len(cursor) < 2 || cursor[0] != pageCursorFormat {
+		return nil, ErrInvalidCursor
+	}
+	// the smallest key strictly greater than the last returned key is the key
+	// followed by a zero byte.
+	next := make([]byte, len(cursor))
+	copy(next, cursor[1:])
+	if bytes.Compare(start, next) > 0 {
+		return start, nil
+	}
+	return next, nil
+}
+
+// page collects up to limit pairs from the iterator and closes it.
+func page(itr corestore.Iterator, limit int) ([]*KVPair, []byte, error) {
+	defer itr.Close()
+
+	pairs := make([]*KVPair, 0, limit)
+	for ; itr.Valid() && len(pairs) < limit; itr.Next() {
+		pairs = append(pairs, &KVPair{Key: itr.Key(), Value: itr.Value()})
+	}
+	if err := itr.Error(); err != nil {
+		return nil, nil, err
+	}
+
+	var cursor []byte
+	if itr.Valid() {
+		lastKey := pairs[len(pairs)-1].Key
+		cursor = make([]byte, 1, len(lastKey)+1)
+		cursor[0] = pageCursorFormat
+		cursor = append(cursor, lastKey...)
+	}
+	return pairs, cursor, nil
+}
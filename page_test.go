@@ -0,0 +1,67 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPage(t *testing.T) {
+	tree := setupMutableTree(false)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("val-%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	collect := func(pager func(start []byte, limit int, cursor []byte) ([]*KVPair, []byte, error), start []byte, limit int) []string {
+		keys := []string{}
+		var cursor []byte
+		for {
+			pairs, next, err := pager(start, limit, cursor)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(pairs), limit)
+			for _, pair := range pairs {
+				keys = append(keys, string(pair.Key))
+			}
+			if next == nil {
+				return keys
+			}
+			cursor = next
+		}
+	}
+
+	expected := []string{"key-0", "key-1", "key-2", "key-3", "key-4", "key-5", "key-6", "key-7", "key-8", "key-9"}
+	require.Equal(t, expected, collect(itree.Page, nil, 3))
+	require.Equal(t, expected, collect(itree.Page, nil, 10))
+	require.Equal(t, expected[4:], collect(tree.Page, []byte("key-4"), 4))
+
+	// the cursor stays valid across versions, even if the last returned key is removed.
+	pairs, cursor, err := itree.Page(nil, 3, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("key-2"), pairs[2].Key)
+	_, _, err = tree.Remove([]byte("key-2"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("key-3"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key-2a"), []byte("new"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	pairs, _, err = tree.Page(nil, 2, cursor)
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	require.Equal(t, []byte("key-2a"), pairs[0].Key)
+	require.Equal(t, []byte("key-4"), pairs[1].Key)
+
+	_, _, err = tree.Page(nil, 0, nil)
+	require.Error(t, err)
+	_, _, err = tree.Page(nil, 1, []byte("bogus"))
+	require.ErrorIs(t, err, ErrInvalidCursor)
+}
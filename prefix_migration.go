@@ -0,0 +1,203 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/cosmos/iavl/fastnode"
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// MigratePrefix replaces the prefix oldPrefix of all keys under it by newPrefix, e.g. for a
+// module rename, and saves the result as a new version. Instead of removing and setting every key,
+// the keys under oldPrefix are split off the tree as a whole, rebuilt as a balanced subtree with the
+// new keys, and joined back at their new position, so the rest of the tree is only rewritten along
+// the paths of the splits and joins. No key may exist under newPrefix yet, other than the migrated
+// ones. It returns the hash and the version, and ErrUnsavedChanges if the working tree has been
+// modified since the last save.
+func (tree *MutableTree) MigratePrefix(oldPrefix, newPrefix []byte) ([]byte, int64, error) {
+	if len(oldPrefix) == 0 || len(newPrefix) == 0 {
+		return nil, 0, errors.New("prefixes must not be empty")
+	}
+	if bytes.Equal(oldPrefix, newPrefix) {
+		return nil, 0, errors.New("prefixes must differ")
+	}
+	if tree.hasUnsavedChanges() {
+		return nil, tree.WorkingVersion(), ErrUnsavedChanges
+	}
+
+	left, rest, err := tree.splitNode(tree.root, oldPrefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	migrated, right, err := tree.splitNode(rest, ibytes.CpIncr(oldPrefix))
+	if err != nil {
+		return nil, 0, err
+	}
+	base, err := tree.joinNodes(left, right)
+	if err != nil {
+		return nil, 0, err
+	}
+	left, rest, err = tree.splitNode(base, newPrefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	existing, right, err := tree.splitNode(rest, ibytes.CpIncr(newPrefix))
+	if err != nil {
+		return nil, 0, err
+	}
+	if existing != nil {
+		return nil, 0, fmt.Errorf("keys already exist under the new prefix %X", newPrefix)
+	}
+
+	var leaves []*Node
+	if migrated != nil {
+		migrated.traverse(tree.ImmutableTree, true, func(node *Node) bool {
+			if node.isLeaf() {
+				leaves = append(leaves, node)
+			}
+			return false
+		})
+	}
+	version := tree.WorkingVersion()
+	renamed := make([]*Node, len(leaves))
+	for i, leaf := range leaves {
+		key := append(append(make([]byte, 0, len(newPrefix)+len(leaf.key)-len(oldPrefix)), newPrefix...), leaf.key[len(oldPrefix):]...)
+		renamed[i] = NewNode(key, leaf.value)
+		if !tree.skipFastStorageUpgrade {
+			tree.addUnsavedRemoval(leaf.key)
+		}
+		tree.recordChange(leaf.key, nil, true)
+	}
+	for _, leaf := range renamed {
+		if !tree.skipFastStorageUpgrade {
+			tree.addUnsavedAddition(leaf.key, fastnode.NewNode(leaf.key, leaf.value, version))
+		}
+		tree.recordChange(leaf.key, leaf.value, false)
+	}
+
+	root, err := tree.joinNodes(left, buildBalancedNode(renamed))
+	if err != nil {
+		return nil, 0, err
+	}
+	if tree.root, err = tree.joinNodes(root, right); err != nil {
+		return nil, 0, err
+	}
+	return tree.SaveVersion()
+}
+
+// splitNode splits the subtree of node into the subtrees of the keys below key and of the others.
+// Like Set and Remove, it copies the nodes it changes. A nil key splits off the whole subtree as
+// the lower part, like the end of a domain.
+func (tree *MutableTree) splitNode(node *Node, key []byte) (*Node, *Node, error) {
+	if node == nil {
+		return nil, nil, nil
+	}
+	if key == nil {
+		return node, nil, nil
+	}
+	if node.isLeaf() {
+		if bytes.Compare(node.key, key) < 0 {
+			return node, nil, nil
+		}
+		return nil, node, nil
+	}
+
+	leftNode, err := node.getLeftNode(tree.ImmutableTree)
+	if err != nil {
+		return nil, nil, err
+	}
+	rightNode, err := node.getRightNode(tree.ImmutableTree)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the key of an inner node is the lowest key of its right subtree
+	if bytes.Compare(key, node.key) <= 0 {
+		lower, upper, err := tree.splitNode(leftNode, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		upper, err = tree.joinNodes(upper, rightNode)
+		return lower, upper, err
+	}
+	lower, upper, err := tree.splitNode(rightNode, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	lower, err = tree.joinNodes(leftNode, lower)
+	return lower, upper, err
+}
+
+// joinNodes joins two subtrees, the keys of left being below those of right, into a balanced one.
+func (tree *MutableTree) joinNodes(left, right *Node) (*Node, error) {
+	if left == nil {
+		return right, nil
+	}
+	if right == nil {
+		return left, nil
+	}
+
+	switch {
+	case left.subtreeHeight > right.subtreeHeight+1:
+		node, err := left.clone(tree)
+		if err != nil {
+			return nil, err
+		}
+		if node.rightNode, err = tree.joinNodes(node.rightNode, right); err != nil {
+			return nil, err
+		}
+		if err := node.calcHeightAndSize(tree.ImmutableTree); err != nil {
+			return nil, err
+		}
+		return tree.balance(node)
+
+	case right.subtreeHeight > left.subtreeHeight+1:
+		node, err := right.clone(tree)
+		if err != nil {
+			return nil, err
+		}
+		if node.leftNode, err = tree.joinNodes(left, node.leftNode); err != nil {
+			return nil, err
+		}
+		if err := node.calcHeightAndSize(tree.ImmutableTree); err != nil {
+			return nil, err
+		}
+		return tree.balance(node)
+
+	default:
+		lowest := right
+		for !lowest.isLeaf() {
+			var err error
+			if lowest, err = lowest.getLeftNode(tree.ImmutableTree); err != nil {
+				return nil, err
+			}
+		}
+		return &Node{
+			key:           lowest.key,
+			subtreeHeight: maxInt8(left.subtreeHeight, right.subtreeHeight) + 1,
+			size:          left.size + right.size,
+			leftNode:      left,
+			rightNode:     right,
+		}, nil
+	}
+}
+
+// buildBalancedNode builds a balanced subtree of the sorted leaves.
+func buildBalancedNode(leaves []*Node) *Node {
+	switch len(leaves) {
+	case 0:
+		return nil
+	case 1:
+		return leaves[0]
+	}
+	mid := (len(leaves) + 1) / 2
+	left, right := buildBalancedNode(leaves[:mid]), buildBalancedNode(leaves[mid:])
+	return &Node{
+		key:           leaves[mid].key,
+		subtreeHeight: maxInt8(left.subtreeHeight, right.subtreeHeight) + 1,
+		size:          left.size + right.size,
+		leftNode:      left,
+		rightNode:     right,
+	}
+}
@@ -0,0 +1,42 @@
+package iavl
+
+import "time"
+
+// Progress is the progress of an export or import, see Exporter.Progress and Importer.Progress.
+type Progress struct {
+	// Nodes is the number of exported or imported nodes.
+	Nodes int64
+	// TotalNodes is the number of nodes of the whole export, or 0 if it is unknown, e.g. for an
+	// import of a stream without an ExportHeader.LeafCount.
+	TotalNodes int64
+	// Bytes is the number of bytes read from an Exporter with Read, or written to the database by
+	// an Importer.
+	Bytes int64
+	// Elapsed is the time since the export or import was started.
+	Elapsed time.Duration
+}
+
+// Percent returns the percentage of the processed nodes, or 0 if the total is unknown.
+func (p Progress) Percent() float64 {
+	if p.TotalNodes <= 0 {
+		return 0
+	}
+	return min(100, 100*float64(p.Nodes)/float64(p.TotalNodes))
+}
+
+// ETA estimates the remaining time from the rate of the processed nodes, or returns 0 if the total
+// is unknown or no node was processed yet.
+func (p Progress) ETA() time.Duration {
+	if p.TotalNodes <= 0 || p.Nodes <= 0 || p.Nodes >= p.TotalNodes {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * float64(p.TotalNodes-p.Nodes) / float64(p.Nodes))
+}
+
+// exportNodeCount returns the number of exported nodes of a tree with the given number of leaves.
+func exportNodeCount(leafCount int64, leavesOnly bool) int64 {
+	if leavesOnly || leafCount == 0 {
+		return leafCount
+	}
+	return 2*leafCount - 1
+}
@@ -211,6 +211,9 @@ func (node *Node) pathToLeaf(t *ImmutableTree, key []byte, version int64, path *
 		if err != nil {
 			return nil, err
 		}
+		if err := t.checkChild(node, leftNode); err != nil {
+			return nil, err
+		}
 		n, err := leftNode.pathToLeaf(t, key, version, path)
 		return n, err
 	}
@@ -233,6 +236,9 @@ func (node *Node) pathToLeaf(t *ImmutableTree, key []byte, version int64, path *
 	if err != nil {
 		return nil, err
 	}
+	if err := t.checkChild(node, rightNode); err != nil {
+		return nil, err
+	}
 
 	n, err := rightNode.pathToLeaf(t, key, version, path)
 	return n, err
@@ -1,10 +1,13 @@
 package iavl
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 
 	ics23 "github.com/cosmos/ics23/go"
+
+	"github.com/cosmos/iavl/verify"
 )
 
 /*
@@ -32,7 +35,7 @@ func (t *ImmutableTree) VerifyMembership(proof *ics23.CommitmentProof, key []byt
 	}
 	root := t.Hash()
 
-	return ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, val), nil
+	return verify.VerifyMembership(root, proof, key, val), nil
 }
 
 /*
@@ -92,7 +95,7 @@ func (t *ImmutableTree) GetNonMembershipProof(key []byte) (*ics23.CommitmentProo
 func (t *ImmutableTree) VerifyNonMembership(proof *ics23.CommitmentProof, key []byte) (bool, error) {
 	root := t.Hash()
 
-	return ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key), nil
+	return verify.VerifyNonMembership(root, proof, key), nil
 }
 
 // createExistenceProof will get the proof from the tree and convert the proof into a valid
@@ -100,6 +103,9 @@ func (t *ImmutableTree) VerifyNonMembership(proof *ics23.CommitmentProof, key []
 func (t *ImmutableTree) createExistenceProof(key []byte) (*ics23.ExistenceProof, error) {
 	t.Hash()
 	path, node, err := t.root.PathToLeaf(t, key, t.version+1)
+	if node == nil {
+		return nil, err
+	}
 	nodeVersion := t.version + 1
 	if node.nodeKey != nil {
 		nodeVersion = node.nodeKey.version
@@ -127,6 +133,34 @@ func convertLeafOp(version int64) *ics23.LeafOp {
 	}
 }
 
+// ProofSpec returns the ICS23 proof spec the proofs of the tree are verified with, e.g. to generate
+// the setup of the IBC clients instead of hard-coding it. The nodes are hashed with SHA-256 and the
+// keys aren't hashed whatever the options of the tree, so it matches ics23.IavlSpec, but it is
+// derived from the ops of the proofs, so it follows them. The proofs of empty values, see
+// AllowEmptyValues, also need the verify package. The returned spec may be modified.
+func (t *ImmutableTree) ProofSpec() *ics23.ProofSpec {
+	leaf := convertLeafOp(0)
+	return &ics23.ProofSpec{
+		LeafSpec: &ics23.LeafOp{
+			Hash:         leaf.Hash,
+			PrehashKey:   leaf.PrehashKey,
+			PrehashValue: leaf.PrehashValue,
+			Length:       leaf.Length,
+			// the height of the leaves, the size and version varints following it vary
+			Prefix: leaf.Prefix[:1],
+		},
+		InnerSpec: &ics23.InnerSpec{
+			ChildOrder: []int32{0, 1},
+			// the height, size and version varints, and the length byte of the left child
+			MinPrefixLength: 4,
+			MaxPrefixLength: 12,
+			// the length byte and hash of a child, see convertInnerOps
+			ChildSize: 1 + sha256.Size,
+			Hash:      ics23.HashOp_SHA256,
+		},
+	}
+}
+
 // we cannot get the proofInnerNode type, so we need to do the whole path in one function
 func convertInnerOps(path PathToLeaf) []*ics23.InnerOp {
 	steps := make([]*ics23.InnerOp, 0, len(path))
@@ -176,6 +210,7 @@ func convertVarIntToBytes(orig int64, buf [binary.MaxVarintLen64]byte) []byte {
 
 // GetProof gets the proof for the given key.
 func (t *ImmutableTree) GetProof(key []byte) (*ics23.CommitmentProof, error) {
+	defer t.latency().observe(LatencyGetProof, t.latency().startTimer())
 	if t.root == nil {
 		return nil, fmt.Errorf("cannot generate the proof with nil root")
 	}
@@ -191,6 +226,27 @@ func (t *ImmutableTree) GetProof(key []byte) (*ics23.CommitmentProof, error) {
 	return t.GetNonMembershipProof(key)
 }
 
+// GetProofs gets the membership or non-membership proofs of the given keys. The nodes on the paths
+// to the keys are loaded together beforehand, see GetMany.
+func (t *ImmutableTree) GetProofs(keys [][]byte) ([]*ics23.CommitmentProof, error) {
+	if t.root == nil {
+		return nil, fmt.Errorf("cannot generate the proof with nil root")
+	}
+	if err := t.descend(keys, func(int, *Node) {}); err != nil {
+		return nil, err
+	}
+
+	proofs := make([]*ics23.CommitmentProof, len(keys))
+	for i, key := range keys {
+		proof, err := t.GetProof(key)
+		if err != nil {
+			return nil, err
+		}
+		proofs[i] = proof
+	}
+	return proofs, nil
+}
+
 // VerifyProof checks if the proof is correct for the given key.
 func (t *ImmutableTree) VerifyProof(proof *ics23.CommitmentProof, key []byte) (bool, error) {
 	if proof.GetExist() != nil {
@@ -210,3 +266,55 @@ func (tree *MutableTree) GetVersionedProof(key []byte, version int64) (*ics23.Co
 	}
 	return nil, ErrVersionDoesNotExist
 }
+
+// GetProofAcrossVersions gets the proofs of the key at each of the versions, in their order, e.g.
+// to show how its value evolved over time. All versions are checked to exist before any proof is
+// generated, and the versions sharing their root, i.e. saved without changes, share their proof.
+func (tree *MutableTree) GetProofAcrossVersions(key []byte, versions []int64) ([]*ics23.CommitmentProof, error) {
+	for _, version := range versions {
+		if !tree.VersionExists(version) {
+			return nil, fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+		}
+	}
+
+	proofs := make([]*ics23.CommitmentProof, len(versions))
+	byRoot := make(map[string]*ics23.CommitmentProof, len(versions))
+	for i, version := range versions {
+		rootKey, err := tree.ndb.GetRoot(version)
+		if err != nil {
+			return nil, err
+		}
+		if proof, ok := byRoot[string(rootKey)]; ok && rootKey != nil {
+			proofs[i] = proof
+			continue
+		}
+		t, err := tree.GetImmutable(version)
+		if err != nil {
+			return nil, err
+		}
+		proof, err := t.GetProof(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the proof at version %d: %w", version, err)
+		}
+		proofs[i] = proof
+		byRoot[string(rootKey)] = proof
+	}
+	return proofs, nil
+}
+
+// WorkingProof gets the membership or non-membership proof of the key in the working tree,
+// including its unsaved changes, against WorkingHash, e.g. to distribute proofs before the version
+// is saved. The unsaved nodes on the paths are hashed on the fly, like WorkingHash does, and the
+// saved ones are read as usual. The proof is invalidated by later changes to the working tree.
+func (tree *MutableTree) WorkingProof(key []byte) (*ics23.CommitmentProof, error) {
+	// the proofs hash the unsaved nodes at the version after the tree's, so the view is based on
+	// the version before the working one, which differs from the saved one for an InitialVersion
+	view := &ImmutableTree{
+		logger:                 tree.logger,
+		root:                   tree.root,
+		ndb:                    tree.ndb,
+		version:                tree.WorkingVersion() - 1,
+		skipFastStorageUpgrade: true,
+	}
+	return view.GetProof(key)
+}
@@ -258,3 +258,120 @@ func BenchmarkConvertLeafOp(b *testing.B) {
 	}
 	sink = nil
 }
+
+func TestGetProofs(t *testing.T) {
+	tree := getTestTree(0)
+	for _, key := range []string{"a", "c", "e", "g"} {
+		_, err := tree.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("g"), []byte("z")}
+	proofs, err := tree.GetProofs(keys)
+	require.NoError(t, err)
+	require.Len(t, proofs, len(keys))
+	for i, proof := range proofs {
+		ok, err := tree.VerifyProof(proof, keys[i])
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	require.NotNil(t, proofs[0].GetExist())
+	require.NotNil(t, proofs[1].GetNonexist())
+}
+
+func TestGetProofAcrossVersions(t *testing.T) {
+	tree := getTestTree(0)
+	var hashes [][]byte
+	_, err := tree.Set([]byte("other"), []byte("value"))
+	require.NoError(t, err)
+	// version 4 is saved without changes
+	for _, value := range []string{"a", "", "b", "-", "c"} {
+		switch value {
+		case "":
+			_, _, err = tree.Remove([]byte("key"))
+		case "-":
+		default:
+			_, err = tree.Set([]byte("key"), []byte(value))
+		}
+		require.NoError(t, err)
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+
+	versions := []int64{5, 1, 2, 3, 4}
+	proofs, err := tree.GetProofAcrossVersions([]byte("key"), versions)
+	require.NoError(t, err)
+	require.Len(t, proofs, len(versions))
+	for i, value := range []string{"c", "a", "", "b", "b"} {
+		root := hashes[versions[i]-1]
+		if value == "" {
+			require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, proofs[i], []byte("key")))
+		} else {
+			require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proofs[i], []byte("key"), []byte(value)))
+		}
+	}
+	// version 4 shares the root and the proof of version 3
+	require.Same(t, proofs[3], proofs[4])
+
+	_, err = tree.GetProofAcrossVersions([]byte("key"), []int64{1, 6})
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestWorkingProof(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), InitialVersionOption(10))
+	for _, key := range []string{"a", "c", "e", "g"} {
+		_, err := tree.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	// the first version is the initial one, not the one after the saved version
+	proof, err := tree.WorkingProof([]byte("c"))
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, tree.WorkingHash(), proof, []byte("c"), []byte("value-c")))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("d"), []byte("value-d"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+
+	root := tree.WorkingHash()
+	exist, err := tree.WorkingProof([]byte("d"))
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, exist, []byte("d"), []byte("value-d")))
+	nonexist, err := tree.WorkingProof([]byte("a"))
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, nonexist, []byte("a")))
+
+	// the proofs hold for the saved version
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, root, hash)
+}
+
+func TestProofSpec(t *testing.T) {
+	tree, allkeys, err := BuildTree(100, 0)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	spec := tree.ProofSpec()
+	require.True(t, spec.SpecEquals(ics23.IavlSpec))
+	require.Equal(t, ics23.IavlSpec.InnerSpec, spec.InnerSpec)
+
+	root := tree.WorkingHash()
+	key := GetKey(allkeys, Middle)
+	val, err := tree.Get(key)
+	require.NoError(t, err)
+	proof, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(spec, root, proof, key, val))
+
+	nonKey := GetNonKey(allkeys, Middle)
+	proof, err = tree.GetNonMembershipProof(nonKey)
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyNonMembership(spec, root, proof, nonKey))
+}
@@ -3,6 +3,7 @@ package iavl
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"sort"
 	"testing"
 
@@ -126,3 +127,103 @@ func (bz byteslices) Less(i, j int) bool {
 func (bz byteslices) Swap(i, j int) {
 	bz[j], bz[i] = bz[i], bz[j]
 }
+
+func TestSimpleMerkleProof(t *testing.T) {
+	require := require.New(t)
+	tree := getTestTree(0)
+
+	root, err := tree.SimpleMerkleRoot()
+	require.NoError(err)
+	empty := sha256.Sum256(nil)
+	require.Equal(empty[:], root)
+
+	for _, ikey := range []byte{0x11, 0x32, 0x50} {
+		tree.Set([]byte{ikey}, []byte{ikey + 1})
+	}
+	// RFC 6962 splits 3 leaves into 2 and 1
+	leaves := [][]byte{
+		SimpleMerkleLeafHash([]byte{0x11}, []byte{0x12}),
+		SimpleMerkleLeafHash([]byte{0x32}, []byte{0x33}),
+		SimpleMerkleLeafHash([]byte{0x50}, []byte{0x51}),
+	}
+	root, err = tree.SimpleMerkleRoot()
+	require.NoError(err)
+	require.Equal(simpleMerkleInnerHash(simpleMerkleInnerHash(leaves[0], leaves[1]), leaves[2]), root)
+
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(iavlrand.RandStr(8)), []byte(iavlrand.RandStr(8)))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+	root, err = tree.SimpleMerkleRoot()
+	require.NoError(err)
+
+	_, err = tree.Iterate(func(key, _ []byte) bool {
+		proof, err := tree.SimpleMerkleProof(key)
+		require.NoError(err)
+		require.NoError(proof.Verify(root))
+
+		proof.Value = append(bytes.Clone(proof.Value), 0)
+		require.Error(proof.Verify(root))
+		return false
+	})
+	require.NoError(err)
+
+	_, err = tree.SimpleMerkleProof([]byte("missing"))
+	require.Error(err)
+}
+
+func TestSubtreeHash(t *testing.T) {
+	require := require.New(t)
+	tree := getTestTree(0)
+	hash, proof, err := tree.SubtreeHash(nil, nil)
+	require.NoError(err)
+	require.Empty(proof.Subtrees)
+	require.NoError(proof.Verify(nil, hash))
+
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte{byte(2 * i)}, []byte(iavlrand.RandStr(8)))
+	}
+	_, _, err = tree.Remove([]byte{10})
+	require.NoError(err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(err)
+	rootHash := tree.Hash()
+
+	ranges := [][2][]byte{{nil, nil}, {{7}, {101}}, {nil, {50}}, {{150}, nil}, {{11}, {12}}, {{199}, nil}, {{250}, nil}}
+	for _, r := range ranges {
+		hash, proof, err := tree.SubtreeHash(r[0], r[1])
+		require.NoError(err)
+		require.NoError(proof.Verify(rootHash, hash))
+
+		var count int64
+		tree.IterateRange(r[0], r[1], true, func(_, _ []byte) bool {
+			count++
+			return false
+		})
+		var size int64
+		for _, sr := range proof.Subtrees {
+			size += sr.Size
+		}
+		require.Equal(count, size, "%X-%X", r[0], r[1])
+	}
+
+	_, proof, err = tree.SubtreeHash(nil, nil)
+	require.NoError(err)
+	require.Len(proof.Subtrees, 1)
+	require.Empty(proof.Subtrees[0].Path)
+
+	hash, proof, err = tree.SubtreeHash([]byte{7}, []byte{101})
+	require.NoError(err)
+	require.Greater(len(proof.Subtrees), 1)
+	require.Error(proof.Verify(rootHash, MutateByteSlice(hash)))
+	require.Error(proof.Verify(MutateByteSlice(rootHash), hash))
+
+	// dropping a subtree breaks the contiguity of the others
+	proof.Subtrees = append(proof.Subtrees[:1], proof.Subtrees[2:]...)
+	require.Error(proof.Verify(rootHash, hash))
+
+	tree.Set([]byte{1}, []byte{1})
+	_, _, err = tree.SubtreeHash(nil, nil)
+	require.ErrorIs(err, ErrUnsavedChanges)
+}
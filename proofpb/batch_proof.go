@@ -0,0 +1,46 @@
+package proofpb
+
+import (
+	"errors"
+
+	ics23 "github.com/cosmos/ics23/go"
+
+	"github.com/cosmos/iavl"
+)
+
+// NewBatchProof returns a compressed batch proof of membership or non-membership of the given
+// keys. Keys are proven in the given order.
+func NewBatchProof(tree *iavl.ImmutableTree, keys [][]byte) (*ics23.CommitmentProof, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("cannot create a batch proof without keys")
+	}
+	proofs, err := tree.GetProofs(keys)
+	if err != nil {
+		return nil, err
+	}
+	return ics23.CombineProofs(proofs)
+}
+
+// MarshalBatchProof encodes a batch proof as a cosmos.ics23.v1.CommitmentProof message.
+func MarshalBatchProof(proof *ics23.CommitmentProof) ([]byte, error) {
+	if !isBatch(proof) {
+		return nil, errors.New("commitment proof is not a batch proof")
+	}
+	return proof.Marshal()
+}
+
+// UnmarshalBatchProof decodes a cosmos.ics23.v1.CommitmentProof message holding a batch proof.
+func UnmarshalBatchProof(bz []byte) (*ics23.CommitmentProof, error) {
+	proof := &ics23.CommitmentProof{}
+	if err := proof.Unmarshal(bz); err != nil {
+		return nil, err
+	}
+	if !isBatch(proof) {
+		return nil, errors.New("commitment proof is not a batch proof")
+	}
+	return proof, nil
+}
+
+func isBatch(proof *ics23.CommitmentProof) bool {
+	return proof.GetBatch() != nil || proof.GetCompressed() != nil
+}
@@ -0,0 +1,38 @@
+package proofpb
+
+import (
+	"testing"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchProof(t *testing.T) {
+	tree := newTestTree(t, "a", "b", "c", "d", "e")
+
+	proof, err := NewBatchProof(tree, [][]byte{[]byte("a"), []byte("c"), []byte("cc"), []byte("z")})
+	require.NoError(t, err)
+
+	bz, err := MarshalBatchProof(proof)
+	require.NoError(t, err)
+	decoded, err := UnmarshalBatchProof(bz)
+	require.NoError(t, err)
+
+	require.True(t, ics23.BatchVerifyMembership(ics23.IavlSpec, tree.Hash(), decoded, map[string][]byte{
+		"a": []byte("value-a"),
+		"c": []byte("value-c"),
+	}))
+	require.True(t, ics23.BatchVerifyNonMembership(ics23.IavlSpec, tree.Hash(), decoded, [][]byte{[]byte("cc"), []byte("z")}))
+
+	single, err := tree.GetProof([]byte("a"))
+	require.NoError(t, err)
+	_, err = MarshalBatchProof(single)
+	require.Error(t, err)
+	bz, err = single.Marshal()
+	require.NoError(t, err)
+	_, err = UnmarshalBatchProof(bz)
+	require.Error(t, err)
+
+	_, err = NewBatchProof(tree, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package proofpb
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/cosmos/iavl"
+)
+
+// MarshalExportHeader encodes an export header as an ExportHeader message.
+func MarshalExportHeader(header iavl.ExportHeader) []byte {
+	var b []byte
+	if header.FormatVersion != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(header.FormatVersion))
+	}
+	if header.HashFunction != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, header.HashFunction)
+	}
+	if header.NodeEncoding != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, header.NodeEncoding)
+	}
+	if header.LeafCount != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(header.LeafCount))
+	}
+	return b
+}
+
+// UnmarshalExportHeader decodes an ExportHeader message.
+func UnmarshalExportHeader(bz []byte) (iavl.ExportHeader, error) {
+	var header iavl.ExportHeader
+	err := unmarshalFields(bz, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var (
+			v   uint64
+			s   []byte
+			n   int
+			err error
+		)
+		switch num {
+		case 1:
+			v, n, err = consumeVarint(num, typ, b)
+			if v > math.MaxUint32 {
+				return 0, fmt.Errorf("invalid export format version %d", v)
+			}
+			header.FormatVersion = uint32(v)
+		case 2:
+			s, n, err = consumeBytes(num, typ, b)
+			header.HashFunction = string(s)
+		case 3:
+			s, n, err = consumeBytes(num, typ, b)
+			header.NodeEncoding = string(s)
+		case 4:
+			v, n, err = consumeVarint(num, typ, b)
+			header.LeafCount = int64(v)
+		}
+		return n, err
+	})
+	if err != nil {
+		return iavl.ExportHeader{}, err
+	}
+	return header, nil
+}
+
+// MarshalExportNode encodes an export node as an ExportNode message.
+func MarshalExportNode(node *iavl.ExportNode) []byte {
+	var b []byte
+	if len(node.Key) > 0 {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, node.Key)
+	}
+	if len(node.Value) > 0 {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, node.Value)
+	}
+	if node.Version != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(node.Version))
+	}
+	if node.Height != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(node.Height)))
+	}
+	if len(node.Hash) > 0 {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, node.Hash)
+	}
+	return b
+}
+
+// UnmarshalExportNode decodes an ExportNode message.
+func UnmarshalExportNode(bz []byte) (*iavl.ExportNode, error) {
+	node := &iavl.ExportNode{}
+	err := unmarshalFields(bz, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var (
+			v   uint64
+			n   int
+			err error
+		)
+		switch num {
+		case 1:
+			node.Key, n, err = consumeBytes(num, typ, b)
+		case 2:
+			node.Value, n, err = consumeBytes(num, typ, b)
+		case 3:
+			v, n, err = consumeVarint(num, typ, b)
+			node.Version = int64(v)
+		case 4:
+			v, n, err = consumeVarint(num, typ, b)
+			height := protowire.DecodeZigZag(v)
+			if height < 0 || height > math.MaxInt8 {
+				return 0, fmt.Errorf("invalid export node height %d", height)
+			}
+			node.Height = int8(height)
+		case 5:
+			node.Hash, n, err = consumeBytes(num, typ, b)
+		}
+		return n, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
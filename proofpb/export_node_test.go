@@ -0,0 +1,71 @@
+package proofpb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/cosmos/iavl"
+)
+
+func TestExportNode(t *testing.T) {
+	tree := newTestTree(t, "a", "b", "c")
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	count := 0
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, iavl.ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		decoded, err := UnmarshalExportNode(MarshalExportNode(node))
+		require.NoError(t, err)
+		require.Equal(t, node.Height, decoded.Height)
+		require.Equal(t, node.Version, decoded.Version)
+		require.Equal(t, string(node.Key), string(decoded.Key))
+		require.Equal(t, string(node.Value), string(decoded.Value))
+		require.NotEmpty(t, decoded.Hash)
+		require.Equal(t, node.Hash, decoded.Hash)
+		count++
+	}
+	require.Equal(t, 5, count)
+
+	// unknown fields are skipped
+	bz := MarshalExportNode(&iavl.ExportNode{Key: []byte("k"), Version: 3, Height: 1})
+	bz = protowire.AppendTag(bz, 15, protowire.BytesType)
+	bz = protowire.AppendBytes(bz, []byte("unknown"))
+	node, err := UnmarshalExportNode(bz)
+	require.NoError(t, err)
+	require.Equal(t, &iavl.ExportNode{Key: []byte("k"), Version: 3, Height: 1}, node)
+
+	_, err = UnmarshalExportNode([]byte{0x0a, 0x05})
+	require.Error(t, err)
+}
+
+func TestExportHeader(t *testing.T) {
+	tree := newTestTree(t, "a")
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	header, err := UnmarshalExportHeader(MarshalExportHeader(exporter.Header()))
+	require.NoError(t, err)
+	require.Equal(t, exporter.Header(), header)
+	require.Equal(t, iavl.ExportFormatVersion, header.FormatVersion)
+
+	leafExporter, err := tree.ExportLeaves()
+	require.NoError(t, err)
+	defer leafExporter.Close()
+	header, err = UnmarshalExportHeader(MarshalExportHeader(leafExporter.Header()))
+	require.NoError(t, err)
+	require.Equal(t, iavl.ExportEncodingLeaves, header.NodeEncoding)
+	require.EqualValues(t, 1, header.LeafCount)
+
+	_, err = UnmarshalExportHeader([]byte{0x12, 0x05})
+	require.Error(t, err)
+}
@@ -0,0 +1,63 @@
+// Package proofpb implements the stable protobuf encoding of IAVL range proofs, batch proofs and
+// export nodes described by proof.proto, so that clients in other languages can consume them by
+// generating code from the schema. Existence and batch proofs use the ics23 schema.
+package proofpb
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ErrInvalidProof is returned when a proof fails verification.
+var ErrInvalidProof = errors.New("invalid proof")
+
+// unmarshalFields calls fn for every field of the encoded message b. fn returns the number of
+// bytes it consumed, or 0 to skip an unknown field.
+func unmarshalFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := fn(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// consumeBytes decodes a length-delimited field, copying its value.
+func consumeBytes(num protowire.Number, typ protowire.Type, b []byte) ([]byte, int, error) {
+	if typ != protowire.BytesType {
+		return nil, 0, fmt.Errorf("field %d has wire type %d, expected bytes", num, typ)
+	}
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return nil, 0, protowire.ParseError(n)
+	}
+	return append([]byte{}, v...), n, nil
+}
+
+// consumeVarint decodes a varint field.
+func consumeVarint(num protowire.Number, typ protowire.Type, b []byte) (uint64, int, error) {
+	if typ != protowire.VarintType {
+		return 0, 0, fmt.Errorf("field %d has wire type %d, expected varint", num, typ)
+	}
+	v, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, 0, protowire.ParseError(n)
+	}
+	return v, n, nil
+}
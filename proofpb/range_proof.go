@@ -0,0 +1,314 @@
+package proofpb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/cosmos/iavl"
+)
+
+// RangeProof proves the complete set of key/value pairs of a tree within [Start, End). An empty
+// Start or End leaves the range unbounded on that side. See proof.proto for the encoding.
+type RangeProof struct {
+	Start []byte
+	End   []byte
+	// Left proves the last key before Start, nil if there is none.
+	Left *ics23.ExistenceProof
+	// Entries prove all keys within [Start, End) in ascending key order.
+	Entries []*ics23.ExistenceProof
+	// Right proves the first key at or after End, nil if there is none.
+	Right *ics23.ExistenceProof
+}
+
+// The field numbers of the RangeProof message.
+const (
+	rangeProofStart protowire.Number = iota + 1
+	rangeProofEnd
+	rangeProofLeft
+	rangeProofEntry
+	rangeProofRight
+)
+
+// NewRangeProof returns a proof of all key/value pairs of the tree within [start, end).
+func NewRangeProof(tree *iavl.ImmutableTree, start, end []byte) (*RangeProof, error) {
+	start, end, err := rangeBounds(tree, start, end)
+	if err != nil {
+		return nil, err
+	}
+	proof := &RangeProof{Start: start, End: end}
+	err = proveRange(tree, start, end, func(num protowire.Number, exist *ics23.ExistenceProof) error {
+		switch num {
+		case rangeProofLeft:
+			proof.Left = exist
+		case rangeProofEntry:
+			proof.Entries = append(proof.Entries, exist)
+		case rangeProofRight:
+			proof.Right = exist
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// rangeBounds validates the range of a proof, with an empty end unbounded.
+func rangeBounds(tree *iavl.ImmutableTree, start, end []byte) ([]byte, []byte, error) {
+	if tree.Size() == 0 {
+		return nil, nil, errors.New("cannot generate a range proof for an empty tree")
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+	if len(start) > 0 && end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, nil, fmt.Errorf("invalid range [%X, %X)", start, end)
+	}
+	return start, end, nil
+}
+
+// proveRange calls emit with the proofs of the range in the order of their fields: the left
+// proof, the entries and the right proof.
+func proveRange(tree *iavl.ImmutableTree, start, end []byte, emit func(num protowire.Number, exist *ics23.ExistenceProof) error) error {
+	if len(start) > 0 {
+		left, err := firstExistenceProof(tree, nil, start, false)
+		if err != nil {
+			return err
+		}
+		if left != nil {
+			if err := emit(rangeProofLeft, left); err != nil {
+				return err
+			}
+		}
+	}
+
+	itr, err := tree.Iterator(start, end, true)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		entry, err := existenceProof(tree, itr.Key())
+		if err != nil {
+			return err
+		}
+		if err := emit(rangeProofEntry, entry); err != nil {
+			return err
+		}
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+
+	if end != nil {
+		right, err := firstExistenceProof(tree, end, nil, true)
+		if err != nil {
+			return err
+		}
+		if right != nil {
+			return emit(rangeProofRight, right)
+		}
+	}
+	return nil
+}
+
+// firstExistenceProof proves the first key in the given iteration range, if any.
+func firstExistenceProof(tree *iavl.ImmutableTree, start, end []byte, ascending bool) (*ics23.ExistenceProof, error) {
+	itr, err := tree.Iterator(start, end, ascending)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+	if !itr.Valid() {
+		return nil, itr.Error()
+	}
+	return existenceProof(tree, itr.Key())
+}
+
+func existenceProof(tree *iavl.ImmutableTree, key []byte) (*ics23.ExistenceProof, error) {
+	proof, err := tree.GetMembershipProof(key)
+	if err != nil {
+		return nil, err
+	}
+	return proof.GetExist(), nil
+}
+
+// Verify checks that the proof proves exactly the entries within its range against the given
+// root hash. It returns an error wrapping ErrInvalidProof otherwise.
+func (p *RangeProof) Verify(root []byte) error {
+	v := &rangeVerifier{root: root, start: p.Start, end: p.End}
+	if p.Left != nil {
+		if err := v.left(p.Left); err != nil {
+			return err
+		}
+	}
+	for _, entry := range p.Entries {
+		if err := v.entry(entry); err != nil {
+			return err
+		}
+	}
+	if p.Right != nil {
+		return v.right(p.Right)
+	}
+	return v.done()
+}
+
+// rangeVerifier verifies the proofs of a range proof in their order, so the proof can be verified
+// without holding all of its entries, see VerifyRangeProofStream.
+type rangeVerifier struct {
+	root       []byte
+	start, end []byte
+	prev       *ics23.ExistenceProof
+}
+
+func (v *rangeVerifier) verify(proof *ics23.ExistenceProof) error {
+	if err := proof.Verify(ics23.IavlSpec, v.root, proof.Key, proof.Value); err != nil {
+		return fmt.Errorf("%w: key %X: %v", ErrInvalidProof, proof.Key, err)
+	}
+	return nil
+}
+
+// check verifies the proof and that it is adjacent to the previous one.
+func (v *rangeVerifier) check(proof *ics23.ExistenceProof) error {
+	if err := v.verify(proof); err != nil {
+		return err
+	}
+	if v.prev == nil {
+		if !ics23.IsLeftMost(ics23.IavlSpec.InnerSpec, proof.Path) {
+			return fmt.Errorf("%w: key %X is not the first key", ErrInvalidProof, proof.Key)
+		}
+	} else if bytes.Compare(v.prev.Key, proof.Key) >= 0 || len(v.prev.Path) == 0 || len(proof.Path) == 0 ||
+		!ics23.IsLeftNeighbor(ics23.IavlSpec.InnerSpec, v.prev.Path, proof.Path) {
+		return fmt.Errorf("%w: key %X does not follow key %X", ErrInvalidProof, proof.Key, v.prev.Key)
+	}
+	v.prev = proof
+	return nil
+}
+
+// left verifies the proof of the last key before the start.
+func (v *rangeVerifier) left(proof *ics23.ExistenceProof) error {
+	if len(v.start) == 0 {
+		return fmt.Errorf("%w: unbounded start with a left proof", ErrInvalidProof)
+	}
+	if bytes.Compare(proof.Key, v.start) >= 0 {
+		return fmt.Errorf("%w: left key %X is not before the start", ErrInvalidProof, proof.Key)
+	}
+	if err := v.verify(proof); err != nil {
+		return err
+	}
+	v.prev = proof
+	return nil
+}
+
+// entry verifies the proof of an entry of the range.
+func (v *rangeVerifier) entry(proof *ics23.ExistenceProof) error {
+	if bytes.Compare(proof.Key, v.start) < 0 || (len(v.end) > 0 && bytes.Compare(proof.Key, v.end) >= 0) {
+		return fmt.Errorf("%w: key %X is out of range", ErrInvalidProof, proof.Key)
+	}
+	return v.check(proof)
+}
+
+// right verifies the proof of the first key at or after the end, which completes the proof.
+func (v *rangeVerifier) right(proof *ics23.ExistenceProof) error {
+	if len(v.end) == 0 {
+		return fmt.Errorf("%w: unbounded end with a right proof", ErrInvalidProof)
+	}
+	if bytes.Compare(proof.Key, v.end) < 0 {
+		return fmt.Errorf("%w: right key %X is before the end", ErrInvalidProof, proof.Key)
+	}
+	return v.check(proof)
+}
+
+// done completes a proof without a right proof, whose last key must be the last key of the tree.
+func (v *rangeVerifier) done() error {
+	if v.prev == nil {
+		return fmt.Errorf("%w: empty range proof", ErrInvalidProof)
+	}
+	if !ics23.IsRightMost(ics23.IavlSpec.InnerSpec, v.prev.Path) {
+		return fmt.Errorf("%w: key %X is not the last key", ErrInvalidProof, v.prev.Key)
+	}
+	return nil
+}
+
+// Marshal encodes the proof as a RangeProof message.
+func (p *RangeProof) Marshal() ([]byte, error) {
+	var b []byte
+	appendProof := func(num protowire.Number, proof *ics23.ExistenceProof) error {
+		bz, err := proof.Marshal()
+		if err != nil {
+			return err
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, bz)
+		return nil
+	}
+
+	if len(p.Start) > 0 {
+		b = protowire.AppendTag(b, rangeProofStart, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.Start)
+	}
+	if len(p.End) > 0 {
+		b = protowire.AppendTag(b, rangeProofEnd, protowire.BytesType)
+		b = protowire.AppendBytes(b, p.End)
+	}
+	if p.Left != nil {
+		if err := appendProof(rangeProofLeft, p.Left); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range p.Entries {
+		if err := appendProof(rangeProofEntry, entry); err != nil {
+			return nil, err
+		}
+	}
+	if p.Right != nil {
+		if err := appendProof(rangeProofRight, p.Right); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Unmarshal decodes a RangeProof message into the proof.
+func (p *RangeProof) Unmarshal(bz []byte) error {
+	*p = RangeProof{}
+	return unmarshalFields(bz, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var (
+			v   []byte
+			n   int
+			err error
+		)
+		switch num {
+		case 1:
+			p.Start, n, err = consumeBytes(num, typ, b)
+			return n, err
+		case 2:
+			p.End, n, err = consumeBytes(num, typ, b)
+			return n, err
+		case 3, 4, 5:
+			if v, n, err = consumeBytes(num, typ, b); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, nil
+		}
+
+		proof := &ics23.ExistenceProof{}
+		if err := proof.Unmarshal(v); err != nil {
+			return 0, err
+		}
+		switch num {
+		case 3:
+			p.Left = proof
+		case 4:
+			p.Entries = append(p.Entries, proof)
+		case 5:
+			p.Right = proof
+		}
+		return n, nil
+	})
+}
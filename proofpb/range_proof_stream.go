@@ -0,0 +1,158 @@
+package proofpb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/cosmos/iavl"
+)
+
+// maxStreamFieldSize bounds the size of a field read by VerifyRangeProofStream, so a corrupt length
+// can't make it allocate an arbitrary buffer.
+const maxStreamFieldSize = 1 << 30
+
+// WriteRangeProof writes a proof of all key/value pairs of the tree within [start, end) to w, like
+// NewRangeProof followed by Marshal, but writes the proof of every entry as it is built instead of
+// holding all of them, so huge ranges are proven with bounded memory. The output is a RangeProof
+// message, and is decoded by RangeProof.Unmarshal or verified by VerifyRangeProofStream. On error,
+// w may hold a partial proof.
+func WriteRangeProof(w io.Writer, tree *iavl.ImmutableTree, start, end []byte) error {
+	start, end, err := rangeBounds(tree, start, end)
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	if len(start) > 0 {
+		b = protowire.AppendTag(b, rangeProofStart, protowire.BytesType)
+		b = protowire.AppendBytes(b, start)
+	}
+	if len(end) > 0 {
+		b = protowire.AppendTag(b, rangeProofEnd, protowire.BytesType)
+		b = protowire.AppendBytes(b, end)
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+
+	return proveRange(tree, start, end, func(num protowire.Number, exist *ics23.ExistenceProof) error {
+		bz, err := exist.Marshal()
+		if err != nil {
+			return err
+		}
+		b = protowire.AppendTag(b[:0], num, protowire.BytesType)
+		b = protowire.AppendBytes(b, bz)
+		_, err = w.Write(b)
+		return err
+	})
+}
+
+// VerifyRangeProofStream verifies an encoded RangeProof read from r against the given root hash,
+// holding a single entry proof at a time, and calls fn with the key and value of every entry in
+// order as it is verified. The entries are only known to be complete once it returns nil, so fn
+// must not act on them before that, e.g. by committing them. It returns an error wrapping
+// ErrInvalidProof if the proof fails verification, or the error of fn.
+//
+// The fields must be in the order written by WriteRangeProof and Marshal.
+func VerifyRangeProofStream(r io.Reader, root []byte, fn func(key, value []byte) error) error {
+	br := bufio.NewReader(r)
+	v := &rangeVerifier{root: root}
+	var last protowire.Number
+	for {
+		num, value, err := readStreamField(br)
+		if errors.Is(err, io.EOF) {
+			return v.done()
+		}
+		if err != nil {
+			return err
+		}
+		if num < last || (num == last && num != rangeProofEntry) {
+			return fmt.Errorf("%w: field %d after field %d", ErrInvalidProof, num, last)
+		}
+		last = num
+
+		switch num {
+		case rangeProofStart:
+			v.start = value
+			continue
+		case rangeProofEnd:
+			v.end = value
+			continue
+		case rangeProofLeft, rangeProofEntry, rangeProofRight:
+		default:
+			continue
+		}
+
+		proof := &ics23.ExistenceProof{}
+		if err := proof.Unmarshal(value); err != nil {
+			return err
+		}
+		switch num {
+		case rangeProofLeft:
+			err = v.left(proof)
+		case rangeProofEntry:
+			if err = v.entry(proof); err == nil {
+				err = fn(proof.Key, proof.Value)
+			}
+		case rangeProofRight:
+			if err = v.right(proof); err == nil {
+				return expectStreamEnd(br)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readStreamField reads a length-delimited field, returning io.EOF at the end of the message.
+func readStreamField(br *bufio.Reader) (protowire.Number, []byte, error) {
+	tag, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	num, typ := protowire.DecodeTag(tag)
+	if num < protowire.MinValidNumber {
+		return 0, nil, fmt.Errorf("invalid field number %d", num)
+	}
+	if typ != protowire.BytesType {
+		return 0, nil, fmt.Errorf("field %d has wire type %d, expected bytes", num, typ)
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if size > maxStreamFieldSize {
+		return 0, nil, fmt.Errorf("field %d of %d bytes exceeds the limit of %d bytes", num, size, maxStreamFieldSize)
+	}
+	value := make([]byte, size)
+	if _, err := io.ReadFull(br, value); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return num, value, nil
+}
+
+// expectStreamEnd checks that nothing follows the right proof, which completes the proof.
+func expectStreamEnd(br *bufio.Reader) error {
+	num, _, err := readStreamField(br)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: field %d after field %d", ErrInvalidProof, num, rangeProofRight)
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package proofpb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteRangeProof(t *testing.T) {
+	keys := []string{}
+	for i := 0; i < 20; i += 2 {
+		keys = append(keys, fmt.Sprintf("k%02d", i))
+	}
+	tree := newTestTree(t, keys...)
+	root := tree.Hash()
+
+	for _, bounds := range [][2]string{{"", ""}, {"k04", "k10"}, {"k03", "k11"}, {"", "k05"}, {"k15", ""}, {"k05", "k06"}, {"z", ""}} {
+		t.Run(fmt.Sprintf("[%s,%s)", bounds[0], bounds[1]), func(t *testing.T) {
+			proof, err := NewRangeProof(tree, []byte(bounds[0]), []byte(bounds[1]))
+			require.NoError(t, err)
+			expected, err := proof.Marshal()
+			require.NoError(t, err)
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, WriteRangeProof(buf, tree, []byte(bounds[0]), []byte(bounds[1])))
+			require.Equal(t, expected, buf.Bytes())
+
+			entries := []string{}
+			err = VerifyRangeProofStream(bytes.NewReader(buf.Bytes()), root, func(key, value []byte) error {
+				entries = append(entries, string(key))
+				require.Equal(t, "value-"+string(key), string(value))
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, len(proof.Entries), len(entries))
+		})
+	}
+
+	proof, err := NewRangeProof(tree, []byte("k04"), []byte("k10"))
+	require.NoError(t, err)
+	verify := func(p *RangeProof) error {
+		bz, err := p.Marshal()
+		require.NoError(t, err)
+		return VerifyRangeProofStream(bytes.NewReader(bz), root, func(_, _ []byte) error { return nil })
+	}
+
+	// the stream fails like Verify on omitted entries, boundaries and tampered values
+	omitted := *proof
+	omitted.Entries = append(omitted.Entries[:1:1], proof.Entries[2:]...)
+	require.ErrorIs(t, verify(&omitted), ErrInvalidProof)
+	unbounded := *proof
+	unbounded.Right = nil
+	require.ErrorIs(t, verify(&unbounded), ErrInvalidProof)
+	tampered := *proof
+	tampered.Entries = append(tampered.Entries[:0:0], proof.Entries...)
+	entry := *proof.Entries[1]
+	entry.Value = []byte("tampered")
+	tampered.Entries[1] = &entry
+	require.ErrorIs(t, verify(&tampered), ErrInvalidProof)
+
+	// a truncated stream is incomplete
+	bz, err := proof.Marshal()
+	require.NoError(t, err)
+	err = VerifyRangeProofStream(bytes.NewReader(bz[:len(bz)-1]), root, func(_, _ []byte) error { return nil })
+	require.Error(t, err)
+
+	// the error of the callback is returned
+	errStop := fmt.Errorf("stop")
+	err = VerifyRangeProofStream(bytes.NewReader(bz), root, func(_, _ []byte) error { return errStop })
+	require.ErrorIs(t, err, errStop)
+
+	require.Error(t, WriteRangeProof(&bytes.Buffer{}, tree, []byte("k10"), []byte("k04")))
+}
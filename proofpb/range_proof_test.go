@@ -0,0 +1,111 @@
+package proofpb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func newTestTree(t *testing.T, keys ...string) *iavl.ImmutableTree {
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 0, false, iavl.NewNopLogger())
+	for _, key := range keys {
+		_, err := tree.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	return itree
+}
+
+func TestRangeProof(t *testing.T) {
+	keys := []string{}
+	for i := 0; i < 20; i += 2 {
+		keys = append(keys, fmt.Sprintf("k%02d", i))
+	}
+	tree := newTestTree(t, keys...)
+	root := tree.Hash()
+
+	testCases := []struct {
+		start, end string
+		expected   []string
+	}{
+		{"", "", keys},
+		{"k04", "k10", []string{"k04", "k06", "k08"}},
+		{"k03", "k11", []string{"k04", "k06", "k08", "k10"}},
+		{"", "k05", []string{"k00", "k02", "k04"}},
+		{"k15", "", []string{"k16", "k18"}},
+		{"k05", "k06", nil},
+		{"a", "b", nil},
+		{"z", "", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("[%s,%s)", tc.start, tc.end), func(t *testing.T) {
+			proof, err := NewRangeProof(tree, []byte(tc.start), []byte(tc.end))
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(root))
+
+			entries := []string{}
+			for _, entry := range proof.Entries {
+				entries = append(entries, string(entry.Key))
+				require.Equal(t, "value-"+string(entry.Key), string(entry.Value))
+			}
+			require.Equal(t, len(tc.expected), len(entries))
+			if len(tc.expected) > 0 {
+				require.Equal(t, tc.expected, entries)
+			}
+
+			bz, err := proof.Marshal()
+			require.NoError(t, err)
+			decoded := &RangeProof{}
+			require.NoError(t, decoded.Unmarshal(bz))
+			require.NoError(t, decoded.Verify(root))
+			require.Equal(t, len(proof.Entries), len(decoded.Entries))
+		})
+	}
+
+	proof, err := NewRangeProof(tree, []byte("k04"), []byte("k10"))
+	require.NoError(t, err)
+
+	// omitting an entry breaks the neighbor chain
+	omitted := *proof
+	omitted.Entries = append(omitted.Entries[:1:1], proof.Entries[2:]...)
+	require.ErrorIs(t, omitted.Verify(root), ErrInvalidProof)
+
+	// omitting a boundary proof hides keys outside of the proven entries
+	unbounded := *proof
+	unbounded.Right = nil
+	require.ErrorIs(t, unbounded.Verify(root), ErrInvalidProof)
+	unbounded = *proof
+	unbounded.Left = nil
+	require.ErrorIs(t, unbounded.Verify(root), ErrInvalidProof)
+
+	// a tampered value does not verify against the root
+	tampered := *proof
+	tampered.Entries = append(tampered.Entries[:0:0], proof.Entries...)
+	entry := *proof.Entries[1]
+	entry.Value = []byte("tampered")
+	tampered.Entries[1] = &entry
+	require.ErrorIs(t, tampered.Verify(root), ErrInvalidProof)
+
+	require.ErrorIs(t, proof.Verify(newTestTree(t, "other").Hash()), ErrInvalidProof)
+
+	_, err = NewRangeProof(tree, []byte("k10"), []byte("k04"))
+	require.Error(t, err)
+	_, err = NewRangeProof(newTestTree(t), nil, nil)
+	require.Error(t, err)
+}
+
+func TestRangeProof_SingleKey(t *testing.T) {
+	tree := newTestTree(t, "a")
+	for _, bounds := range [][2]string{{"", ""}, {"a", "b"}, {"b", ""}, {"", "a"}} {
+		proof, err := NewRangeProof(tree, []byte(bounds[0]), []byte(bounds[1]))
+		require.NoError(t, err)
+		require.NoError(t, proof.Verify(tree.Hash()))
+	}
+}
@@ -0,0 +1,124 @@
+package iavl
+
+import "time"
+
+// PruningOptions configure the pruning triggered by SaveVersion once the versions saved since the
+// last prune have orphaned enough nodes, or have aged past a retention period, in addition to any
+// interval based DeleteVersionsTo calls of the caller. It is disabled while MaxOrphans,
+// MaxOrphanBytes and KeepDuration are all zero.
+type PruningOptions struct {
+	// MaxOrphans triggers a prune once the accumulated number of orphaned nodes reaches it.
+	MaxOrphans int64
+	// MaxOrphanBytes triggers a prune once the estimated encoded size of the accumulated orphaned
+	// nodes, i.e. the bytes a prune can reclaim, reaches it.
+	MaxOrphanBytes int64
+	// KeepRecent is the number of most recent versions, including the latest one, left by a
+	// triggered prune. Values below 1 keep only the latest version.
+	KeepRecent int64
+	// KeepDuration is a wall-clock retention, e.g. 21 days, pruning the versions saved more than
+	// KeepDuration ago by the times recorded by SaveVersion, see Options.Clock. Alone, it triggers a
+	// prune from every SaveVersion with such versions; with an orphan limit, a triggered prune keeps
+	// the versions saved within KeepDuration. Either way, KeepRecent versions are kept too.
+	KeepDuration time.Duration
+}
+
+// enabled returns whether a pruning trigger is configured.
+func (opts PruningOptions) enabled() bool {
+	return opts.orphanLimited() || opts.KeepDuration > 0
+}
+
+// orphanLimited returns whether an orphan limit is configured.
+func (opts PruningOptions) orphanLimited() bool {
+	return opts.MaxOrphans > 0 || opts.MaxOrphanBytes > 0
+}
+
+// exceeded returns whether the accumulated orphans reach one of the limits.
+func (opts PruningOptions) exceeded(orphans, orphanBytes int64) bool {
+	return (opts.MaxOrphans > 0 && orphans >= opts.MaxOrphans) ||
+		(opts.MaxOrphanBytes > 0 && orphanBytes >= opts.MaxOrphanBytes)
+}
+
+// PruningOption sets the PruningOptions for the tree.
+func PruningOption(pruning PruningOptions) Option {
+	return func(opts *Options) {
+		opts.Pruning = pruning
+	}
+}
+
+// PruneEvent describes a pruning of versions, see Options.PruneHook.
+type PruneEvent struct {
+	// FromVersion and ToVersion are the first and the last pruned versions.
+	FromVersion int64
+	ToVersion   int64
+	// Nodes and Bytes are the number and the estimated encoded size of the deleted nodes, the nodes
+	// of the legacy versions excepted.
+	Nodes int64
+	Bytes int64
+	// Duration is the time the pruning took.
+	Duration time.Duration
+}
+
+// PruneHookOption sets the PruneHook for the tree.
+func PruneHookOption(hook func(PruneEvent)) Option {
+	return func(opts *Options) {
+		opts.PruneHook = hook
+	}
+}
+
+// PendingOrphans returns the number and estimated encoded size of the nodes orphaned by the
+// versions saved since the last triggered prune, see PruningOptions. They are only counted while
+// an orphan limit is configured, and start from zero when the tree is opened.
+func (tree *MutableTree) PendingOrphans() (orphans int64, orphanBytes int64) {
+	return tree.pendingOrphans, tree.pendingOrphanBytes
+}
+
+// maybePrune adds the nodes orphaned by the saved version to the pending orphans, and deletes the
+// versions older than PruningOptions.KeepRecent and KeepDuration once they reach a limit, or at
+// every save without an orphan limit.
+func (tree *MutableTree) maybePrune(version int64) error {
+	opts := tree.ndb.opts.Pruning
+	prevVersion := tree.ndb.prevVersion(version)
+	if !opts.enabled() || !tree.VersionExists(prevVersion) {
+		return nil
+	}
+
+	if opts.orphanLimited() {
+		if err := tree.ndb.traverseOrphans(prevVersion, version, func(orphan *Node) error {
+			tree.pendingOrphans++
+			tree.pendingOrphanBytes += int64(orphan.encodedSize())
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !opts.exceeded(tree.pendingOrphans, tree.pendingOrphanBytes) {
+			return nil
+		}
+	}
+
+	keepRecent := opts.KeepRecent
+	if keepRecent < 1 {
+		keepRecent = 1
+	}
+	toVersion := version - keepRecent
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	if toVersion >= firstVersion && opts.KeepDuration > 0 {
+		cutoff := tree.ndb.opts.now().Add(-opts.KeepDuration)
+		if toVersion, err = tree.ndb.lastVersionSavedBefore(firstVersion, toVersion, cutoff); err != nil {
+			return err
+		}
+	}
+	if toVersion < firstVersion {
+		return nil
+	}
+
+	tree.logger.Debug("pruning triggered", "orphans", tree.pendingOrphans,
+		"orphanBytes", tree.pendingOrphanBytes, "keepDuration", opts.KeepDuration, "toVersion", toVersion)
+	if err := tree.DeleteVersionsTo(toVersion); err != nil {
+		return err
+	}
+	tree.pendingOrphans, tree.pendingOrphanBytes = 0, 0
+	return nil
+}
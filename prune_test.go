@@ -66,3 +66,124 @@ func TestAsyncPruning(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestOrphanTriggeredPruning(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(),
+		PruningOption(PruningOptions{MaxOrphans: 20, KeepRecent: 2}))
+
+	for i := 0; i < 8; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	pruned := false
+	for i := 0; i < 20 && !pruned; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i%8)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		firstVersion, err := tree.FirstAvailableVersion()
+		require.NoError(t, err)
+		if firstVersion > 1 {
+			pruned = true
+			require.Equal(t, version-1, firstVersion)
+			orphans, orphanBytes := tree.PendingOrphans()
+			require.Zero(t, orphans)
+			require.Zero(t, orphanBytes)
+		} else {
+			orphans, orphanBytes := tree.PendingOrphans()
+			require.Positive(t, orphans)
+			require.Positive(t, orphanBytes)
+			require.Less(t, orphans, int64(20))
+		}
+	}
+	require.True(t, pruned)
+
+	// the bytes limit triggers on its own
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(),
+		PruningOption(PruningOptions{MaxOrphanBytes: 1}))
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("value2"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{2}, tree.AvailableVersions())
+}
+
+func TestTimeRetainedPruning(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(),
+		ClockOption(func() time.Time { return now }),
+		PruningOption(PruningOptions{KeepDuration: 72 * time.Hour}))
+
+	// a version a day keeps the versions of the last three days
+	for i := 0; i < 6; i++ {
+		_, err := tree.Set([]byte("key"), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		now = now.Add(24 * time.Hour)
+	}
+	require.Equal(t, []int{3, 4, 5, 6}, tree.AvailableVersions())
+
+	saved, err := tree.VersionTime(1)
+	require.NoError(t, err)
+	require.True(t, saved.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+	_, err = tree.VersionTime(7)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// KeepRecent still applies after a pause of the saves
+	tree.ndb.opts.Pruning.KeepRecent = 2
+	now = now.Add(30 * 24 * time.Hour)
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{6, 7}, tree.AvailableVersions())
+
+	// rolled back versions lose their time
+	require.NoError(t, tree.DeleteVersionsFrom(7))
+	_, err = tree.VersionTime(7)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestPruneHook(t *testing.T) {
+	var events []PruneEvent
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), PruneHookOption(func(e PruneEvent) {
+		events = append(events, e)
+	}))
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	var nodes, bytes int64
+	for v := int64(1); v <= 3; v++ {
+		require.NoError(t, tree.IterateOrphans(v, func(orphan *Node) error {
+			nodes++
+			bytes += int64(orphan.encodedSize())
+			return nil
+		}))
+	}
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	require.Len(t, events, 1)
+	require.Equal(t, int64(1), events[0].FromVersion)
+	require.Equal(t, int64(3), events[0].ToVersion)
+	require.Equal(t, nodes, events[0].Nodes)
+	require.Equal(t, bytes, events[0].Bytes)
+	require.Equal(t, []int{4, 5}, tree.AvailableVersions())
+
+	// nothing is pruned, nothing is reported
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	require.Len(t, events, 1)
+}
@@ -0,0 +1,86 @@
+package iavl
+
+import (
+	"errors"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// ErrReadTxClosed is returned by the reads of a ReadTx after Close.
+var ErrReadTxClosed = errors.New("read transaction is closed")
+
+// ReadTx is a consistent view of the working tree, including its unsaved changes, for a sequence
+// of reads, see MutableTree.ReadTx. It keeps its view across the writes and saves of the tree, but
+// like the tree itself, it must not be read concurrently with them.
+type ReadTx struct {
+	tree *ImmutableTree
+}
+
+// ReadTx returns a read transaction pinning the working tree at the time of the call, so the reads
+// through it neither see the later writes nor a mix of them with the earlier state. Like
+// SnapshotIterator, it relies on Set and Remove copying the nodes they change. The nodes of the
+// view may be loaded from disk from the last saved version, or from the working version once its
+// unsaved nodes are saved, so neither can be pruned until Close is called. Deleting them by other
+// means, e.g. LoadVersionForOverwriting, invalidates the view, and its reads fail with
+// ErrTreeInvalidated.
+func (tree *MutableTree) ReadTx() *ReadTx {
+	snapshot := tree.ImmutableTree.clone()
+	// the fast index follows the tree, so the view reads the nodes
+	snapshot.skipFastStorageUpgrade = true
+	snapshot.generation = tree.ndb.generations.current()
+	tree.ndb.incrVersionReaders(snapshot.version)
+	tree.ndb.incrVersionReaders(snapshot.version + 1)
+	return &ReadTx{tree: snapshot}
+}
+
+// Version returns the last saved version the view is based on.
+func (tx *ReadTx) Version() int64 {
+	if tx.tree == nil {
+		return 0
+	}
+	return tx.tree.version
+}
+
+// Get returns the value of the key in the view, or nil.
+func (tx *ReadTx) Get(key []byte) ([]byte, error) {
+	if tx.tree == nil {
+		return nil, ErrReadTxClosed
+	}
+	return tx.tree.Get(key)
+}
+
+// Has returns whether the key exists in the view.
+func (tx *ReadTx) Has(key []byte) (bool, error) {
+	if tx.tree == nil {
+		return false, ErrReadTxClosed
+	}
+	return tx.tree.Has(key)
+}
+
+// Iterate calls fn with the keys of the view in ascending order. Returns true if stopped by
+// callback, false otherwise.
+func (tx *ReadTx) Iterate(fn func(key []byte, value []byte) bool) (bool, error) {
+	if tx.tree == nil {
+		return false, ErrReadTxClosed
+	}
+	return tx.tree.Iterate(fn)
+}
+
+// Iterator returns an iterator over the domain of the view. It must be closed before the read
+// transaction.
+func (tx *ReadTx) Iterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
+	if tx.tree == nil {
+		return nil, ErrReadTxClosed
+	}
+	return tx.tree.Iterator(start, end, ascending)
+}
+
+// Close releases the view and the pinned version. It is safe to call multiple times.
+func (tx *ReadTx) Close() error {
+	if tx.tree != nil {
+		tx.tree.ndb.decrVersionReaders(tx.tree.version)
+		tx.tree.ndb.decrVersionReaders(tx.tree.version + 1)
+		tx.tree = nil
+	}
+	return nil
+}
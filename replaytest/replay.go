@@ -0,0 +1,189 @@
+// Package replaytest records the Set, Remove and SaveVersion calls on a tree, and replays them
+// against other trees, e.g. the same tree with other options or another implementation, comparing
+// their root hashes version by version. It is meant to validate redesigns of the tree internals,
+// e.g. a new node encoding, against a recorded workload:
+//
+//	rec := replaytest.NewRecorder(tree, logFile)
+//	// ... run the workload against rec instead of tree ...
+//	last, err := replaytest.Replay(logFile, baseline, candidate)
+//
+// The log uses the encoding of the iavl intent log, with the root hash of every saved version in
+// its commit record, so the replayed trees are checked against the recorded tree too.
+package replaytest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl"
+)
+
+// Tree is the API of a tree the operations are recorded on and replayed against.
+type Tree interface {
+	Set(key, value []byte) (bool, error)
+	Remove(key []byte) ([]byte, bool, error)
+	SaveVersion() ([]byte, int64, error)
+	Rollback()
+	WorkingVersion() int64
+}
+
+var _ Tree = (*iavl.MutableTree)(nil)
+
+// Recorder is a Tree writing the operations on the wrapped tree to a log.
+type Recorder struct {
+	tree Tree
+	w    io.Writer
+}
+
+var _ Tree = (*Recorder)(nil)
+
+// NewRecorder returns a recorder of the operations on tree, writing them to w.
+func NewRecorder(tree Tree, w io.Writer) *Recorder {
+	return &Recorder{tree: tree, w: w}
+}
+
+func (r *Recorder) write(kind iavl.IntentKind, version int64, key, value []byte) error {
+	record := &iavl.IntentRecord{Version: version, Kind: kind, Key: key, Value: value}
+	if _, err := r.w.Write(record.Marshal()); err != nil {
+		return fmt.Errorf("failed to record %s of version %d: %w", kind, version, err)
+	}
+	return nil
+}
+
+// Set records and applies a Set call.
+func (r *Recorder) Set(key, value []byte) (bool, error) {
+	if err := r.write(iavl.IntentSet, r.tree.WorkingVersion(), key, value); err != nil {
+		return false, err
+	}
+	return r.tree.Set(key, value)
+}
+
+// Remove records and applies a Remove call.
+func (r *Recorder) Remove(key []byte) ([]byte, bool, error) {
+	if err := r.write(iavl.IntentRemove, r.tree.WorkingVersion(), key, nil); err != nil {
+		return nil, false, err
+	}
+	return r.tree.Remove(key)
+}
+
+// SaveVersion saves the version and records it with its root hash.
+func (r *Recorder) SaveVersion() ([]byte, int64, error) {
+	hash, version, err := r.tree.SaveVersion()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := r.write(iavl.IntentCommit, version, nil, hash); err != nil {
+		return nil, 0, err
+	}
+	return hash, version, nil
+}
+
+// Rollback records and applies a Rollback call.
+func (r *Recorder) Rollback() {
+	// a lost rollback marker fails the replay at the next save, with the hash of the version
+	_ = r.write(iavl.IntentRollback, r.tree.WorkingVersion(), nil, nil)
+	r.tree.Rollback()
+}
+
+// WorkingVersion returns the working version of the wrapped tree.
+func (r *Recorder) WorkingVersion() int64 {
+	return r.tree.WorkingVersion()
+}
+
+// DivergenceError is returned by Replay when the replayed trees disagree on a saved version.
+type DivergenceError struct {
+	// Version is the first version the trees disagree on.
+	Version int64
+	// Recorded is the root hash of the version recorded in the log.
+	Recorded []byte
+	// Hashes are the root hashes of the version saved by the replayed trees, in their order.
+	Hashes [][]byte
+}
+
+func (e *DivergenceError) Error() string {
+	return fmt.Sprintf("replayed trees diverge at version %d: recorded hash %X, replayed hashes %X", e.Version, e.Recorded, e.Hashes)
+}
+
+// Replay applies the operations of the log in r to the trees, and compares the root hashes of
+// every saved version with each other and with the recorded one, returning a DivergenceError for
+// the first version they disagree on. The trees must be at the same working version, and the
+// operations of the versions before it are skipped, so a replay can resume from a checkpoint, i.e.
+// trees loaded at a version of the log. Returns the last replayed version.
+func Replay(r io.Reader, trees ...Tree) (int64, error) {
+	if len(trees) == 0 {
+		return 0, errors.New("no trees to replay against")
+	}
+	working := trees[0].WorkingVersion()
+	for i, tree := range trees {
+		if tree.WorkingVersion() != working {
+			return 0, fmt.Errorf("tree %d is at working version %d, tree 0 at %d", i, tree.WorkingVersion(), working)
+		}
+	}
+
+	var last int64
+	ir := iavl.NewIntentLogReader(r)
+	for {
+		record, err := ir.Next()
+		if errors.Is(err, io.EOF) {
+			return last, nil
+		}
+		if err != nil {
+			return last, err
+		}
+		if record.Version < working {
+			continue
+		}
+
+		if record.Kind == iavl.IntentCommit {
+			if err := saveVersion(record, trees); err != nil {
+				return last, err
+			}
+			last = record.Version
+			continue
+		}
+		for i, tree := range trees {
+			if err := apply(tree, record); err != nil {
+				return last, fmt.Errorf("tree %d: failed to replay %s of version %d: %w", i, record.Kind, record.Version, err)
+			}
+		}
+	}
+}
+
+// apply applies a Set, Remove or Rollback record to the tree.
+func apply(tree Tree, record *iavl.IntentRecord) error {
+	var err error
+	switch record.Kind {
+	case iavl.IntentSet:
+		_, err = tree.Set(record.Key, record.Value)
+	case iavl.IntentRemove:
+		_, _, err = tree.Remove(record.Key)
+	case iavl.IntentRollback:
+		tree.Rollback()
+	default:
+		err = fmt.Errorf("unknown record kind %s", record.Kind)
+	}
+	return err
+}
+
+// saveVersion saves the version of a commit record in the trees and compares their hashes.
+func saveVersion(record *iavl.IntentRecord, trees []Tree) error {
+	hashes := make([][]byte, len(trees))
+	diverged := false
+	for i, tree := range trees {
+		hash, version, err := tree.SaveVersion()
+		if err != nil {
+			return fmt.Errorf("tree %d: failed to save version %d: %w", i, record.Version, err)
+		}
+		if version != record.Version {
+			return fmt.Errorf("tree %d saved version %d, recorded version %d", i, version, record.Version)
+		}
+		hashes[i] = hash
+		diverged = diverged || !bytes.Equal(hash, record.Value)
+	}
+	if diverged {
+		return &DivergenceError{Version: record.Version, Recorded: record.Value, Hashes: hashes}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package replaytest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func newTree(options ...iavl.Option) *iavl.MutableTree {
+	return iavl.NewMutableTree(dbm.NewMemDB(), 0, false, iavl.NewNopLogger(), options...)
+}
+
+// record runs a random workload of the given number of versions against a recorder.
+func record(t *testing.T, log *bytes.Buffer, versions int) *iavl.MutableTree {
+	tree := newTree()
+	rec := NewRecorder(tree, log)
+	r := rand.New(rand.NewSource(1))
+	for v := 0; v < versions; v++ {
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("k%03d", r.Intn(200)))
+			if r.Intn(4) == 0 {
+				_, _, err := rec.Remove(key)
+				require.NoError(t, err)
+			} else {
+				_, err := rec.Set(key, []byte(fmt.Sprintf("v%d", r.Int())))
+				require.NoError(t, err)
+			}
+		}
+		if v%3 == 2 {
+			rec.Rollback()
+		}
+		_, _, err := rec.SaveVersion()
+		require.NoError(t, err)
+	}
+	return tree
+}
+
+func TestReplay(t *testing.T) {
+	log := &bytes.Buffer{}
+	recorded := record(t, log, 10)
+
+	baseline := newTree()
+	candidate := newTree(iavl.DedupValueThresholdOption(4), iavl.KeyPrefixDictionaryOption([]byte("k0")))
+	last, err := Replay(bytes.NewReader(log.Bytes()), baseline, candidate)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, last)
+	require.Equal(t, recorded.Hash(), baseline.Hash())
+	require.Equal(t, recorded.Hash(), candidate.Hash())
+}
+
+func TestReplay_Checkpoint(t *testing.T) {
+	log := &bytes.Buffer{}
+	recorded := record(t, log, 10)
+
+	// a tree at version 6 resumes from there
+	db := dbm.NewMemDB()
+	tree := iavl.NewMutableTree(db, 0, false, iavl.NewNopLogger())
+	_, err := Replay(bytes.NewReader(log.Bytes()), &stopAt{Tree: tree, version: 6})
+	require.ErrorIs(t, err, errStop)
+	resumed := iavl.NewMutableTree(db, 0, false, iavl.NewNopLogger())
+	_, err = resumed.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 7, resumed.WorkingVersion())
+
+	last, err := Replay(bytes.NewReader(log.Bytes()), resumed)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, last)
+	require.Equal(t, recorded.Hash(), resumed.Hash())
+
+	_, err = Replay(bytes.NewReader(log.Bytes()), resumed, newTree())
+	require.ErrorContains(t, err, "working version")
+}
+
+func TestReplay_Divergence(t *testing.T) {
+	log := &bytes.Buffer{}
+	record(t, log, 5)
+
+	_, err := Replay(bytes.NewReader(log.Bytes()), newTree(), &dropKey{Tree: newTree(), key: []byte("k100")})
+	var divergence *DivergenceError
+	require.ErrorAs(t, err, &divergence)
+	require.Len(t, divergence.Hashes, 2)
+	require.Equal(t, divergence.Recorded, divergence.Hashes[0])
+	require.NotEqual(t, divergence.Recorded, divergence.Hashes[1])
+}
+
+var errStop = fmt.Errorf("stopped")
+
+// stopAt fails the save after the given version, like a crash.
+type stopAt struct {
+	Tree
+	version int64
+}
+
+func (s *stopAt) SaveVersion() ([]byte, int64, error) {
+	if s.WorkingVersion() > s.version {
+		return nil, 0, errStop
+	}
+	return s.Tree.SaveVersion()
+}
+
+// dropKey ignores the sets of a key, like a broken implementation.
+type dropKey struct {
+	Tree
+	key []byte
+}
+
+func (d *dropKey) Set(key, value []byte) (bool, error) {
+	if bytes.Equal(key, d.key) {
+		return false, nil
+	}
+	return d.Tree.Set(key, value)
+}
@@ -0,0 +1,125 @@
+package iavl
+
+import (
+	"fmt"
+	"math"
+)
+
+// ResolvePolicy is the policy of ResolveVersion for a requested version which is not stored.
+type ResolvePolicy int
+
+const (
+	// ResolveExact resolves only a stored version to itself.
+	ResolveExact ResolvePolicy = iota
+	// ResolveLatestAtOrBefore resolves to the latest stored version at or before the requested
+	// one, e.g. for a query at a height without a version of its own.
+	ResolveLatestAtOrBefore
+	// ResolveEarliestAtOrAfter resolves to the earliest stored version at or after the requested
+	// one, e.g. for a query at a height which was pruned.
+	ResolveEarliestAtOrAfter
+)
+
+// String implements fmt.Stringer.
+func (p ResolvePolicy) String() string {
+	switch p {
+	case ResolveExact:
+		return "exact"
+	case ResolveLatestAtOrBefore:
+		return "latest-at-or-before"
+	case ResolveEarliestAtOrAfter:
+		return "earliest-at-or-after"
+	default:
+		return fmt.Sprintf("ResolvePolicy(%d)", int(p))
+	}
+}
+
+// ResolveVersion maps the requested version, e.g. a queried height, to a stored version according
+// to the policy, or returns ErrVersionDoesNotExist if there is none. Like VersionExists, it is
+// served from the nodeDB version markers, with a scan of the roots for legacy versions, which can
+// have gaps.
+func (tree *MutableTree) ResolveVersion(version int64, policy ResolvePolicy) (int64, error) {
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return 0, err
+	}
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	switch policy {
+	case ResolveExact:
+		if tree.VersionExists(version) {
+			return version, nil
+		}
+	case ResolveLatestAtOrBefore:
+		if latestVersion > 0 && version >= firstVersion {
+			if version >= latestVersion {
+				return latestVersion, nil
+			}
+			if version > legacyLatestVersion {
+				return version, nil
+			}
+			return tree.ndb.legacyVersionAtOrBefore(version)
+		}
+	case ResolveEarliestAtOrAfter:
+		if latestVersion > 0 && version <= latestVersion {
+			if version <= firstVersion {
+				return firstVersion, nil
+			}
+			if version > legacyLatestVersion {
+				return version, nil
+			}
+			resolved, err := tree.ndb.legacyVersionAtOrAfter(version)
+			if err != nil || resolved > 0 {
+				return resolved, err
+			}
+			// the versions following the legacy ones are contiguous
+			return legacyLatestVersion + 1, nil
+		}
+	default:
+		return 0, fmt.Errorf("unknown resolve policy %v", policy)
+	}
+	return 0, fmt.Errorf("%w: no %v version for %d", ErrVersionDoesNotExist, policy, version)
+}
+
+// legacyVersionAtOrBefore returns the latest legacy version at or before the given one, or
+// ErrVersionDoesNotExist if there is none.
+func (ndb *nodeDB) legacyVersionAtOrBefore(version int64) (int64, error) {
+	itr, err := ndb.db.ReverseIterator(legacyRootKeyFormat.Key(int64(1)), legacyRootKeyFormat.Key(version+1))
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+
+	if itr.Valid() {
+		var resolved int64
+		legacyRootKeyFormat.Scan(itr.Key(), &resolved)
+		return resolved, nil
+	}
+	if err := itr.Error(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%w: no legacy version at or before %d", ErrVersionDoesNotExist, version)
+}
+
+// legacyVersionAtOrAfter returns the earliest legacy version at or after the given one, or 0 if
+// there is none.
+func (ndb *nodeDB) legacyVersionAtOrAfter(version int64) (int64, error) {
+	itr, err := ndb.db.Iterator(legacyRootKeyFormat.Key(version), legacyRootKeyFormat.Key(int64(math.MaxInt64)))
+	if err != nil {
+		return 0, err
+	}
+	defer itr.Close()
+
+	if itr.Valid() {
+		var resolved int64
+		legacyRootKeyFormat.Scan(itr.Key(), &resolved)
+		return resolved, nil
+	}
+	return 0, itr.Error()
+}
@@ -0,0 +1,49 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveVersion(t *testing.T) {
+	tree := setupMutableTree(false)
+
+	_, err := tree.ResolveVersion(1, ResolveLatestAtOrBefore)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	for i := 0; i < 6; i++ {
+		_, err := tree.Set([]byte("k"), []byte{byte(i)})
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(2))
+
+	for _, tc := range []struct {
+		version  int64
+		policy   ResolvePolicy
+		expected int64 // 0 if it doesn't resolve
+	}{
+		{4, ResolveExact, 4},
+		{2, ResolveExact, 0},
+		{7, ResolveExact, 0},
+		{4, ResolveLatestAtOrBefore, 4},
+		{9, ResolveLatestAtOrBefore, 6},
+		{2, ResolveLatestAtOrBefore, 0},
+		{4, ResolveEarliestAtOrAfter, 4},
+		{1, ResolveEarliestAtOrAfter, 3},
+		{7, ResolveEarliestAtOrAfter, 0},
+	} {
+		resolved, err := tree.ResolveVersion(tc.version, tc.policy)
+		if tc.expected == 0 {
+			require.ErrorIs(t, err, ErrVersionDoesNotExist, "%d %v", tc.version, tc.policy)
+			continue
+		}
+		require.NoError(t, err, "%d %v", tc.version, tc.policy)
+		require.Equal(t, tc.expected, resolved, "%d %v", tc.version, tc.policy)
+	}
+
+	_, err = tree.ResolveVersion(4, ResolvePolicy(9))
+	require.Error(t, err)
+}
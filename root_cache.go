@@ -0,0 +1,128 @@
+package iavl
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RootCacheStats are the counters of the root cache, see Options.RootCacheSize.
+type RootCacheStats struct {
+	// Size is the number of cached roots, at most Options.RootCacheSize.
+	Size int
+	// Hits and Misses count the root lookups served from the cache and from the database.
+	Hits   uint64
+	Misses uint64
+	// Invalidations counts the clears of the cache by the deletions of versions.
+	Invalidations uint64
+}
+
+// rootCache caches the root node keys of recent versions, as resolved by GetRoot, in the order they
+// were added, evicting the oldest. The deletions of versions change the roots of the later
+// versions, e.g. pruning reformats a root referenced by the next version, so they invalidate the
+// whole cache, and nothing is cached until their batch is written. Every invalidation starts a new
+// epoch, and a root read from the database before it isn't cached after it. All methods are no-ops
+// on a nil cache.
+type rootCache struct {
+	mtx     sync.Mutex
+	size    int
+	roots   map[int64][]byte
+	order   []int64 // the cached versions, oldest first
+	epoch   uint64
+	pending bool // a deletion of versions isn't written yet
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	invalidations atomic.Uint64
+}
+
+// newRootCache returns a cache of size roots, or nil if size isn't positive.
+func newRootCache(size int) *rootCache {
+	if size <= 0 {
+		return nil
+	}
+	return &rootCache{size: size, roots: make(map[int64][]byte, size)}
+}
+
+// get returns the cached root of the version, and the current epoch for adding it otherwise.
+func (c *rootCache) get(version int64) (rootKey []byte, ok bool, epoch uint64) {
+	if c == nil {
+		return nil, false, 0
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	rootKey, ok = c.roots[version]
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return rootKey, ok, c.epoch
+}
+
+// add caches the root of the version read from the database in the given epoch, unless the cache
+// was invalidated since.
+func (c *rootCache) add(version int64, rootKey []byte, epoch uint64) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if epoch != c.epoch || c.pending {
+		return
+	}
+	if _, ok := c.roots[version]; ok {
+		return
+	}
+	if len(c.order) >= c.size {
+		delete(c.roots, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.roots[version] = rootKey
+	c.order = append(c.order, version)
+}
+
+// invalidate clears the cache ahead of a deletion of versions, and stops caching until it is
+// written, see written.
+func (c *rootCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.clear()
+	c.pending = true
+}
+
+// written resumes caching after a write of the batch, clearing the roots read while a deletion of
+// versions was pending.
+func (c *rootCache) written() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.pending {
+		c.clear()
+		c.pending = false
+	}
+}
+
+// clear drops the cached roots and starts a new epoch. The caller must hold c.mtx.
+func (c *rootCache) clear() {
+	clear(c.roots)
+	c.order = c.order[:0]
+	c.epoch++
+	c.invalidations.Add(1)
+}
+
+// stats returns the counters of the cache.
+func (c *rootCache) stats() RootCacheStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return RootCacheStats{
+		Size:          len(c.roots),
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+}
@@ -0,0 +1,131 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ShadowDivergence is the first divergence of the shadow tree of Options.ShadowDB from the tree.
+type ShadowDivergence struct {
+	// Version and Hash are the version saved or loaded by the tree when the divergence was found,
+	// and its root hash, and ShadowVersion and ShadowHash those of the shadow tree.
+	Version       int64
+	Hash          []byte
+	ShadowVersion int64
+	ShadowHash    []byte
+	// Err is the error of the shadow tree, if it failed an operation the tree performed, in which
+	// case the hashes are unset.
+	Err error
+}
+
+// String implements fmt.Stringer.
+func (d *ShadowDivergence) String() string {
+	switch {
+	case d.Err != nil:
+		return fmt.Sprintf("shadow tree failed at version %d: %v", d.Version, d.Err)
+	case d.ShadowVersion != d.Version:
+		return fmt.Sprintf("shadow tree is at version %d instead of %d", d.ShadowVersion, d.Version)
+	default:
+		return fmt.Sprintf("shadow tree has hash %X instead of %X at version %d", d.ShadowHash, d.Hash, d.Version)
+	}
+}
+
+// ShadowDivergence returns the first divergence of the shadow tree of Options.ShadowDB from the
+// tree, or nil if it didn't diverge or isn't enabled.
+func (tree *MutableTree) ShadowDivergence() *ShadowDivergence {
+	return tree.shadowDivergence
+}
+
+// newShadowTree returns the shadow tree of a tree with the given options, which has the options of
+// the tree without its side effects, e.g. its changelog, and with Options.ShadowOptions.
+func newShadowTree(opts Options, cacheSize int, skipFastStorageUpgrade bool, lg Logger) *MutableTree {
+	shadowOpts := opts
+	shadowOpts.ShadowDB = nil
+	shadowOpts.ShadowOptions = nil
+	shadowOpts.Stat = nil
+	shadowOpts.ChangelogWriter = nil
+	shadowOpts.IntentLogWriter = nil
+	shadowOpts.AccessHook = nil
+	shadowOpts.PruneHook = nil
+	shadowOpts.ColdStorage = nil
+	shadowOpts.FastIndexShards = nil
+	shadowOpts.LatencyExpvar = ""
+	for _, opt := range opts.ShadowOptions {
+		opt(&shadowOpts)
+	}
+	return NewMutableTree(opts.ShadowDB, cacheSize, skipFastStorageUpgrade, lg, func(o *Options) { *o = shadowOpts })
+}
+
+// shadowChange repeats a change of the working tree on the shadow tree, if any.
+func (tree *MutableTree) shadowChange(key, value []byte, deleted bool) {
+	if tree.shadow == nil {
+		return
+	}
+	var err error
+	if deleted {
+		_, _, err = tree.shadow.Remove(key)
+	} else {
+		_, err = tree.shadow.Set(key, value)
+	}
+	if err != nil {
+		tree.diverge(&ShadowDivergence{Version: tree.WorkingVersion(), Err: err})
+	}
+}
+
+// shadowSave saves the working version of the shadow tree, if any, and compares it with the
+// version saved by the tree.
+func (tree *MutableTree) shadowSave(version int64, hash []byte) {
+	if tree.shadow == nil {
+		return
+	}
+	shadowHash, shadowVersion, err := tree.shadow.SaveVersion()
+	tree.shadowCompare(version, hash, shadowVersion, shadowHash, err)
+}
+
+// shadowLoad loads the version loaded by the tree in the shadow tree, if any, overwriting the
+// newer versions if overwrite is set, and compares them.
+func (tree *MutableTree) shadowLoad(version int64, overwrite bool) {
+	if tree.shadow == nil {
+		return
+	}
+	shadowVersion := version
+	var err error
+	if overwrite {
+		err = tree.shadow.LoadVersionForOverwriting(version)
+	} else {
+		shadowVersion, err = tree.shadow.LoadVersion(version)
+	}
+	var shadowHash []byte
+	if err == nil {
+		shadowHash = tree.shadow.Hash()
+	}
+	tree.shadowCompare(version, tree.Hash(), shadowVersion, shadowHash, err)
+}
+
+// shadowRollback discards the unsaved changes of the shadow tree, if any.
+func (tree *MutableTree) shadowRollback() {
+	if tree.shadow != nil {
+		tree.shadow.Rollback()
+	}
+}
+
+// shadowCompare records a divergence if the shadow tree failed, or its version or hash differs.
+func (tree *MutableTree) shadowCompare(version int64, hash []byte, shadowVersion int64, shadowHash []byte, err error) {
+	if err != nil {
+		tree.diverge(&ShadowDivergence{Version: version, Err: err})
+	} else if shadowVersion != version || !bytes.Equal(shadowHash, hash) {
+		tree.diverge(&ShadowDivergence{Version: version, Hash: hash, ShadowVersion: shadowVersion, ShadowHash: shadowHash})
+	}
+}
+
+// diverge records the first divergence of the shadow tree, and drops it, so the tree keeps working
+// without the cost of the shadow. The database of the shadow is left as it was at the divergence,
+// for inspection.
+func (tree *MutableTree) diverge(d *ShadowDivergence) {
+	tree.shadowDivergence = d
+	tree.logger.Error("shadow tree diverged", "version", d.Version, "divergence", d.String())
+	if err := tree.shadow.Close(); err != nil {
+		tree.logger.Error("failed to close the shadow tree", "err", err)
+	}
+	tree.shadow = nil
+}
@@ -0,0 +1,209 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	corestore "cosmossdk.io/core/store"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// ShardedTree is an experimental tree whose key space is partitioned into ranges, each stored in
+// its own MutableTree, so the updates of a block can be applied and saved concurrently. Its hash
+// is the RFC 6962 simple Merkle root of the shard hashes, see SimpleMerkleRoot, so it differs
+// from the hash of a single tree with the same keys.
+//
+// The shards are saved one by one, so a crash can leave some shards a version ahead of the others.
+// Load rolls them back to the version every shard reached, and SaveVersion fails until they are.
+//
+// Only ApplyChangeSet and SaveVersion work on the shards concurrently. Like a MutableTree, the
+// tree must not be read while it is written.
+type ShardedTree struct {
+	boundaries [][]byte
+	shards     []*MutableTree
+}
+
+// NewShardedTree returns a tree with a shard per range between the given boundaries, which must be
+// sorted and distinct, so there are len(boundaries)+1 shards. Shard i holds the keys in
+// [boundaries[i-1], boundaries[i]). The shards are stored under prefixes of db, which must not be
+// used for anything else, and they share the options. The hooks of the options, e.g.
+// Options.KeyValidator or Options.PruneHook, are called by the shards concurrently. The
+// Options.ChangelogWriter and Options.IntentLogWriter streams can't be shared, so they are
+// rejected.
+func NewShardedTree(db corestore.KVStoreWithBatch, boundaries [][]byte, cacheSize int, lg Logger, options ...Option) (*ShardedTree, error) {
+	opts := DefaultOptions()
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if opts.ChangelogWriter != nil || opts.IntentLogWriter != nil {
+		return nil, errors.New("the shards of a sharded tree can't share a ChangelogWriter or IntentLogWriter")
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if bytes.Compare(boundaries[i-1], boundaries[i]) >= 0 {
+			return nil, fmt.Errorf("shard boundaries must be sorted and distinct, %X is followed by %X", boundaries[i-1], boundaries[i])
+		}
+	}
+	shards := make([]*MutableTree, len(boundaries)+1)
+	for i := range shards {
+		prefix := []byte(fmt.Sprintf("shard/%d/", i))
+		shards[i] = NewMutableTree(dbm.NewPrefixDB(db, prefix), cacheSize, false, lg, options...)
+	}
+	return &ShardedTree{boundaries: boundaries, shards: shards}, nil
+}
+
+// shardIndex returns the index of the shard holding the key.
+func (st *ShardedTree) shardIndex(key []byte) int {
+	return sort.Search(len(st.boundaries), func(i int) bool {
+		return bytes.Compare(key, st.boundaries[i]) < 0
+	})
+}
+
+// Shards returns the number of shards.
+func (st *ShardedTree) Shards() int {
+	return len(st.shards)
+}
+
+// Shard returns the shard with the given index, e.g. to prove a key against its shard hash.
+func (st *ShardedTree) Shard(i int) *MutableTree {
+	return st.shards[i]
+}
+
+// Load loads the latest version every shard has, rolling back shards which are ahead of it.
+func (st *ShardedTree) Load() (int64, error) {
+	version := int64(-1)
+	for _, shard := range st.shards {
+		latest, err := shard.Load()
+		if err != nil {
+			return 0, err
+		}
+		if version < 0 || latest < version {
+			version = latest
+		}
+	}
+	for i, shard := range st.shards {
+		if shard.Version() <= version {
+			continue
+		}
+		if err := shard.rollbackTo(version); err != nil {
+			return 0, fmt.Errorf("failed to roll back shard %d to version %d: %w", i, version, err)
+		}
+	}
+	return version, nil
+}
+
+// Get returns the value of the key in the working tree, or nil.
+func (st *ShardedTree) Get(key []byte) ([]byte, error) {
+	return st.shards[st.shardIndex(key)].Get(key)
+}
+
+// Set sets the key in the working tree.
+func (st *ShardedTree) Set(key, value []byte) (bool, error) {
+	return st.shards[st.shardIndex(key)].Set(key, value)
+}
+
+// Remove removes the key from the working tree.
+func (st *ShardedTree) Remove(key []byte) ([]byte, bool, error) {
+	return st.shards[st.shardIndex(key)].Remove(key)
+}
+
+// ApplyChangeSet applies the changes to the working tree, the changes of each shard concurrently
+// with the others and in their order within the shard.
+func (st *ShardedTree) ApplyChangeSet(changes *ChangeSet) error {
+	pairs := make([][]*KVPair, len(st.shards))
+	for _, pair := range changes.Pairs {
+		i := st.shardIndex(pair.Key)
+		pairs[i] = append(pairs[i], pair)
+	}
+	return st.forEachShard(func(i int, shard *MutableTree) error {
+		for _, pair := range pairs[i] {
+			var err error
+			if pair.Delete {
+				_, _, err = shard.Remove(pair.Key)
+			} else {
+				_, err = shard.Set(pair.Key, pair.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SaveVersion saves the shards concurrently, and returns the combined hash and the new version.
+func (st *ShardedTree) SaveVersion() ([]byte, int64, error) {
+	// the shards of a version can't be rolled back once saved, see Load
+	for i, shard := range st.shards {
+		if shard.Version() != st.shards[0].Version() {
+			return nil, 0, fmt.Errorf("shard %d is at version %d, shard 0 at version %d, the tree must be reloaded", i, shard.Version(), st.shards[0].Version())
+		}
+	}
+	hashes := make([][]byte, len(st.shards))
+	versions := make([]int64, len(st.shards))
+	if err := st.forEachShard(func(i int, shard *MutableTree) error {
+		var err error
+		hashes[i], versions[i], err = shard.SaveVersion()
+		return err
+	}); err != nil {
+		return nil, 0, err
+	}
+	for i, version := range versions {
+		if version != versions[0] {
+			return nil, 0, fmt.Errorf("shard %d saved version %d, shard 0 saved version %d", i, version, versions[0])
+		}
+	}
+	return simpleMerkleRoot(hashes), versions[0], nil
+}
+
+// Hash returns the combined hash of the last saved version.
+func (st *ShardedTree) Hash() []byte {
+	hashes := make([][]byte, len(st.shards))
+	for i, shard := range st.shards {
+		hashes[i] = shard.Hash()
+	}
+	return simpleMerkleRoot(hashes)
+}
+
+// WorkingHash returns the combined hash of the working tree.
+func (st *ShardedTree) WorkingHash() []byte {
+	hashes := make([][]byte, len(st.shards))
+	for i, shard := range st.shards {
+		hashes[i] = shard.WorkingHash()
+	}
+	return simpleMerkleRoot(hashes)
+}
+
+// Version returns the last saved version.
+func (st *ShardedTree) Version() int64 {
+	return st.shards[0].Version()
+}
+
+// Close closes the shards.
+func (st *ShardedTree) Close() error {
+	var errs []error
+	for _, shard := range st.shards {
+		errs = append(errs, shard.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// forEachShard calls fn with every shard concurrently, and returns the errors.
+func (st *ShardedTree) forEachShard(fn func(i int, shard *MutableTree) error) error {
+	errs := make([]error, len(st.shards))
+	var wg sync.WaitGroup
+	for i, shard := range st.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(i, shard); err != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
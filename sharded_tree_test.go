@@ -0,0 +1,112 @@
+package iavl
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestShardedTree(t *testing.T) {
+	db := dbm.NewMemDB()
+	boundaries := [][]byte{[]byte("k3"), []byte("k6")}
+	tree, err := NewShardedTree(db, boundaries, 0, NewNopLogger())
+	require.NoError(t, err)
+	require.Equal(t, 3, tree.Shards())
+
+	changes := &ChangeSet{}
+	for i := 0; i < 90; i++ {
+		key := []byte(fmt.Sprintf("k%02d", i))
+		changes.Pairs = append(changes.Pairs, &KVPair{Key: key, Value: key})
+	}
+	changes.Pairs = append(changes.Pairs, &KVPair{Key: []byte("k42"), Delete: true})
+	require.NoError(t, tree.ApplyChangeSet(changes))
+	working := tree.WorkingHash()
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, working, hash)
+	require.Equal(t, hash, tree.Hash())
+
+	// the keys are split by range, and the hash combines the shard hashes
+	require.Equal(t, int64(30), tree.Shard(0).Size())
+	require.Equal(t, int64(29), tree.Shard(1).Size())
+	require.Equal(t, int64(30), tree.Shard(2).Size())
+	require.Equal(t, simpleMerkleRoot([][]byte{tree.Shard(0).Hash(), tree.Shard(1).Hash(), tree.Shard(2).Hash()}), hash)
+	value, err := tree.Get([]byte("k55"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("k55"), value)
+	value, err = tree.Get([]byte("k42"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	// a shard saved ahead of the others is rolled back on load
+	_, err = tree.Set([]byte("k70"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.Shard(2).SaveVersion()
+	require.NoError(t, err)
+
+	reloaded, err := NewShardedTree(db, boundaries, 0, NewNopLogger())
+	require.NoError(t, err)
+	version, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, hash, reloaded.Hash())
+	value, err = reloaded.Get([]byte("k70"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("k70"), value)
+
+	_, err = NewShardedTree(db, [][]byte{[]byte("b"), []byte("a")}, 0, NewNopLogger())
+	require.Error(t, err)
+	_, err = NewShardedTree(db, boundaries, 0, NewNopLogger(), ChangelogWriterOption(io.Discard))
+	require.Error(t, err)
+	_, err = NewShardedTree(db, boundaries, 0, NewNopLogger(), IntentLogWriterOption(io.Discard))
+	require.Error(t, err)
+}
+
+func TestShardedTreeCrashRecovery(t *testing.T) {
+	db := dbm.NewMemDB()
+	boundaries := [][]byte{[]byte("k5")}
+	tree, err := NewShardedTree(db, boundaries, 0, NewNopLogger())
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	// a crash after the first shard saved the first version
+	_, _, err = tree.Shard(0).SaveVersion()
+	require.NoError(t, err)
+
+	// the shards diverge until they are reloaded
+	_, _, err = tree.SaveVersion()
+	require.ErrorContains(t, err, "shard 1 is at version 0, shard 0 at version 1")
+	require.Equal(t, int64(1), tree.Shard(0).Version())
+
+	tree, err = NewShardedTree(db, boundaries, 0, NewNopLogger())
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), version)
+	for i := range tree.Shards() {
+		require.Equal(t, int64(0), tree.Shard(i).Version())
+		require.Equal(t, int64(0), tree.Shard(i).Size())
+	}
+	value, err := tree.Get([]byte("k1"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	_, err = tree.Set([]byte("k2"), []byte("value"))
+	require.NoError(t, err)
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	has, err := tree.Shard(0).Has([]byte("k1"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
@@ -0,0 +1,173 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// The domain separation prefixes of RFC 6962 for the hashes of leaves and inner nodes.
+const (
+	simpleMerkleLeafPrefix  = 0x00
+	simpleMerkleInnerPrefix = 0x01
+)
+
+// SimpleMerkleProof proves that a key-value pair is a leaf of the simple Merkle tree over the
+// sorted leaves of a version, see ImmutableTree.SimpleMerkleRoot.
+type SimpleMerkleProof struct {
+	Key   []byte
+	Value []byte
+	// Index is the index of the leaf, and Total the number of leaves.
+	Index int64
+	Total int64
+	// Aunts are the hashes of the siblings on the path from the leaf to the root, bottom first.
+	Aunts [][]byte
+}
+
+// SimpleMerkleLeafHash returns the leaf hash of a key-value pair in the simple Merkle tree, the
+// SHA-256 hash of the 0x00 prefix followed by the length-prefixed key and value.
+func SimpleMerkleLeafHash(key, value []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(1 + encoding.EncodeBytesSize(key) + encoding.EncodeBytesSize(value))
+	buf.WriteByte(simpleMerkleLeafPrefix)
+	// writing to a bytes.Buffer doesn't fail
+	_ = encoding.EncodeBytes(&buf, key)
+	_ = encoding.EncodeBytes(&buf, value)
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:]
+}
+
+func simpleMerkleInnerHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{simpleMerkleInnerPrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// simpleMerkleSplit returns the largest power of two less than n, n > 1.
+func simpleMerkleSplit(n int64) int64 {
+	return 1 << (bits.Len64(uint64(n-1)) - 1)
+}
+
+func simpleMerkleRoot(hashes [][]byte) []byte {
+	switch len(hashes) {
+	case 0:
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	case 1:
+		return hashes[0]
+	}
+	k := simpleMerkleSplit(int64(len(hashes)))
+	return simpleMerkleInnerHash(simpleMerkleRoot(hashes[:k]), simpleMerkleRoot(hashes[k:]))
+}
+
+// simpleMerkleAunts returns the aunts of the leaf at the index, bottom first.
+func simpleMerkleAunts(hashes [][]byte, index int64) [][]byte {
+	if len(hashes) <= 1 {
+		return nil
+	}
+	k := simpleMerkleSplit(int64(len(hashes)))
+	if index < k {
+		return append(simpleMerkleAunts(hashes[:k], index), simpleMerkleRoot(hashes[k:]))
+	}
+	return append(simpleMerkleAunts(hashes[k:], index-k), simpleMerkleRoot(hashes[:k]))
+}
+
+func simpleMerkleRootFromAunts(leaf []byte, index, total int64, aunts [][]byte) ([]byte, error) {
+	if total == 1 {
+		if len(aunts) != 0 {
+			return nil, errors.New("too many aunts")
+		}
+		return leaf, nil
+	}
+	if len(aunts) == 0 {
+		return nil, errors.New("too few aunts")
+	}
+	last := len(aunts) - 1
+	k := simpleMerkleSplit(total)
+	if index < k {
+		left, err := simpleMerkleRootFromAunts(leaf, index, k, aunts[:last])
+		if err != nil {
+			return nil, err
+		}
+		return simpleMerkleInnerHash(left, aunts[last]), nil
+	}
+	right, err := simpleMerkleRootFromAunts(leaf, index-k, total-k, aunts[:last])
+	if err != nil {
+		return nil, err
+	}
+	return simpleMerkleInnerHash(aunts[last], right), nil
+}
+
+// Verify verifies the proof against the root of a simple Merkle tree.
+func (p *SimpleMerkleProof) Verify(root []byte) error {
+	if p.Total <= 0 || p.Index < 0 || p.Index >= p.Total {
+		return fmt.Errorf("invalid leaf index %d of %d leaves", p.Index, p.Total)
+	}
+	computed, err := simpleMerkleRootFromAunts(SimpleMerkleLeafHash(p.Key, p.Value), p.Index, p.Total, p.Aunts)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(computed, root) {
+		return fmt.Errorf("invalid proof: computed root %X, expected %X", computed, root)
+	}
+	return nil
+}
+
+// SimpleMerkleRoot returns the root of a simple Merkle tree over the sorted leaves of the tree,
+// following RFC 6962, so the state can be anchored into systems which don't understand IAVL
+// proofs. The leaf hashes are those of SimpleMerkleLeafHash, and the root of an empty tree is the
+// hash of the empty string. It reads all leaves of the tree.
+func (t *ImmutableTree) SimpleMerkleRoot() ([]byte, error) {
+	hashes, err := t.simpleMerkleLeafHashes()
+	if err != nil {
+		return nil, err
+	}
+	return simpleMerkleRoot(hashes), nil
+}
+
+// SimpleMerkleProof returns the proof of the key against SimpleMerkleRoot. It fails if the key
+// doesn't exist.
+func (t *ImmutableTree) SimpleMerkleProof(key []byte) (*SimpleMerkleProof, error) {
+	index, value, err := t.GetWithIndex(key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("key %X does not exist", key)
+	}
+	hashes, err := t.simpleMerkleLeafHashes()
+	if err != nil {
+		return nil, err
+	}
+	return &SimpleMerkleProof{
+		Key:   key,
+		Value: value,
+		Index: index,
+		Total: int64(len(hashes)),
+		Aunts: simpleMerkleAunts(hashes, index),
+	}, nil
+}
+
+// simpleMerkleLeafHashes returns the simple Merkle leaf hashes of the leaves of the tree, read
+// from the nodes rather than the fast index so the working tree of a MutableTree is covered too.
+func (t *ImmutableTree) simpleMerkleLeafHashes() ([][]byte, error) {
+	if t.root == nil {
+		return nil, nil
+	}
+	hashes := make([][]byte, 0, t.root.size)
+	itr := NewIterator(nil, nil, true, t)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		hashes = append(hashes, SimpleMerkleLeafHash(itr.Key(), itr.Value()))
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
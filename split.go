@@ -0,0 +1,70 @@
+package iavl
+
+import (
+	"slices"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// SplitAt splits the latest saved version of the tree into two independent trees, stored in the
+// empty databases left and right, with the keys below the pivot and the keys from the pivot on,
+// e.g. to shard a monolithic store during an upgrade. The left tree is the retained side: it gets
+// all versions of the tree, see CloneTo, followed by a version removing the keys from the pivot on.
+// The right tree starts at that same version with its keys. Both trees are opened with the given
+// options, and the tree itself is left unchanged.
+func (tree *MutableTree) SplitAt(pivot []byte, left, right corestore.KVStoreWithBatch, options ...Option) (*MutableTree, *MutableTree, error) {
+	if tree.hasUnsavedChanges() {
+		return nil, nil, ErrUnsavedChanges
+	}
+	versions := tree.AvailableVersions()
+	if len(versions) == 0 {
+		return nil, nil, ErrVersionDoesNotExist
+	}
+	latest := int64(versions[len(versions)-1])
+
+	clone := make([]int64, len(versions))
+	for i, version := range versions {
+		clone[i] = int64(version)
+	}
+	if err := tree.CloneTo(left, clone); err != nil {
+		return nil, nil, err
+	}
+	leftTree := NewMutableTree(left, 0, false, tree.logger, options...)
+	if _, err := leftTree.Load(); err != nil {
+		return nil, nil, err
+	}
+	itr := leftTree.SnapshotIterator(pivot, nil, true)
+	for ; itr.Valid(); itr.Next() {
+		if _, _, err := leftTree.Remove(itr.Key()); err != nil {
+			itr.Close()
+			return nil, nil, err
+		}
+	}
+	if err := itr.Error(); err != nil {
+		itr.Close()
+		return nil, nil, err
+	}
+	if err := itr.Close(); err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := leftTree.SaveVersion(); err != nil {
+		return nil, nil, err
+	}
+
+	rightTree := NewMutableTree(right, 0, false, tree.logger,
+		append(slices.Clone(options), InitialVersionOption(uint64(latest+1)))...)
+	itr = NewIterator(pivot, nil, true, tree.lastSaved)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if _, err := rightTree.Set(itr.Key(), itr.Value()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := itr.Error(); err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := rightTree.SaveVersion(); err != nil {
+		return nil, nil, err
+	}
+	return leftTree, rightTree, nil
+}
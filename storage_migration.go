@@ -0,0 +1,222 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// migrationProgressInterval is the number of nodes between the progress reports of a migration.
+const migrationProgressInterval = 10000
+
+// StorageVersion is a layout of the stored tree, see MigrateStorage.
+type StorageVersion int
+
+const (
+	// StorageVersionLegacy is the layout written before node keys, with the nodes keyed by their
+	// hash and orphan records for pruning.
+	StorageVersionLegacy StorageVersion = iota + 1
+	// StorageVersionNodeKey keys the nodes by their version and nonce.
+	StorageVersionNodeKey
+	// StorageVersionFastIndex is StorageVersionNodeKey with the fast node index of the latest
+	// version.
+	StorageVersionFastIndex
+)
+
+// String implements fmt.Stringer.
+func (v StorageVersion) String() string {
+	switch v {
+	case StorageVersionLegacy:
+		return "legacy"
+	case StorageVersionNodeKey:
+		return "nodekey"
+	case StorageVersionFastIndex:
+		return "fastindex"
+	default:
+		return fmt.Sprintf("StorageVersion(%d)", int(v))
+	}
+}
+
+// MigrateOptions configures MigrateStorage.
+type MigrateOptions struct {
+	// TreeOptions are the options the tree is opened with, e.g. its Namespace.
+	TreeOptions []Option
+	// DropLegacyHistory allows the migration from StorageVersionLegacy to drop the legacy versions
+	// before the latest one, which can't be converted. Without it, only a database with a single
+	// legacy version is migrated.
+	DropLegacyHistory bool
+	// Progress is called periodically during each step of the migration, with the storage version
+	// the step migrates to.
+	Progress func(step StorageVersion, p Progress)
+	// Logger logs the steps of the migration. Defaults to a no-op logger.
+	Logger Logger
+}
+
+// DetectStorageVersion returns the storage version of the tree stored in db. A database with
+// legacy versions is at StorageVersionLegacy, even if newer versions were saved on top of them.
+func DetectStorageVersion(db corestore.KVStoreWithBatch, options ...Option) (StorageVersion, error) {
+	tree := NewMutableTree(db, 0, true, NewNopLogger(), options...)
+	return tree.storageVersion()
+}
+
+// storageVersion returns the storage version of the tree.
+func (tree *MutableTree) storageVersion() (StorageVersion, error) {
+	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	if legacyLatestVersion > 0 {
+		return StorageVersionLegacy, nil
+	}
+	if tree.ndb.hasUpgradedToFastStorage() {
+		return StorageVersionFastIndex, nil
+	}
+	return StorageVersionNodeKey, nil
+}
+
+// MigrateStorage migrates the tree stored in db from one storage version to another, instead of
+// relying on the migrations LoadVersion performs implicitly, e.g. the fast storage upgrade, so
+// operators can run them ahead of time with their progress reported. The tree must not be opened
+// elsewhere meanwhile. An interrupted migration is resumed by running it again.
+//
+// The legacy layout is migrated by converting its latest version to node keys, with the same
+// hashes, and deleting all legacy records, see MigrateOptions.DropLegacyHistory. A database with
+// newer versions saved on top of legacy ones is migrated lazily by pruning the legacy versions
+// instead. The fast node index is built or deleted to migrate to or from StorageVersionFastIndex,
+// and rebuilt by a migration from it to itself if it isn't synced with the latest version. There
+// is no migration back to the legacy layout.
+func MigrateStorage(db corestore.KVStoreWithBatch, from, to StorageVersion, opts MigrateOptions) error {
+	if opts.Logger == nil {
+		opts.Logger = NewNopLogger()
+	}
+	if from < StorageVersionLegacy || from > StorageVersionFastIndex || to < StorageVersionLegacy || to > StorageVersionFastIndex {
+		return fmt.Errorf("unknown storage version migration from %v to %v", from, to)
+	}
+	if to == StorageVersionLegacy && from != StorageVersionLegacy {
+		return fmt.Errorf("can't migrate from %v back to %v", from, to)
+	}
+
+	current, err := DetectStorageVersion(db, opts.TreeOptions...)
+	if err != nil {
+		return err
+	}
+	if current != from {
+		return fmt.Errorf("the database is at storage version %v, not %v", current, from)
+	}
+	if from == to && to != StorageVersionFastIndex {
+		return nil
+	}
+
+	if current == StorageVersionLegacy {
+		opts.Logger.Info("migrating legacy nodes to node keys")
+		if err := migrateLegacyNodes(db, opts); err != nil {
+			return fmt.Errorf("failed to migrate legacy nodes: %w", err)
+		}
+		// the legacy fast node index is kept, it still describes the latest version
+		if current, err = DetectStorageVersion(db, opts.TreeOptions...); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case to == StorageVersionFastIndex:
+		// rebuilds the index if it isn't synced with the latest version
+		opts.Logger.Info("building the fast node index")
+		return migrateFastIndex(db, true, opts)
+	case current == StorageVersionFastIndex:
+		opts.Logger.Info("deleting the fast node index")
+		return migrateFastIndex(db, false, opts)
+	}
+	return nil
+}
+
+// migrateLegacyNodes converts the latest legacy version to node keys, and deletes the legacy
+// records. The legacy roots are deleted last, so an interrupted migration is detected as legacy,
+// and resumed with the deletion if the version was converted already.
+func migrateLegacyNodes(db corestore.KVStoreWithBatch, opts MigrateOptions) error {
+	tree := NewMutableTree(db, 0, true, opts.Logger, opts.TreeOptions...)
+	ndb := tree.ndb
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if latestVersion > legacyLatestVersion {
+		return fmt.Errorf("version %d was saved after the legacy version %d, the legacy versions are migrated by pruning them", latestVersion, legacyLatestVersion)
+	}
+	olderVersions, err := ndb.legacyVersions(1, legacyLatestVersion)
+	if err != nil {
+		return err
+	}
+	if len(olderVersions) > 0 && !opts.DropLegacyHistory {
+		return fmt.Errorf("%d legacy versions before version %d can't be converted, see MigrateOptions.DropLegacyHistory", len(olderVersions), legacyLatestVersion)
+	}
+
+	converted, err := ndb.hasVersion(legacyLatestVersion)
+	if err != nil {
+		return err
+	}
+	if !converted {
+		src, err := tree.GetImmutable(legacyLatestVersion)
+		if err != nil {
+			return err
+		}
+		target := NewMutableTree(db, 0, true, opts.Logger, opts.TreeOptions...)
+		var progress func(Progress)
+		if opts.Progress != nil {
+			progress = func(p Progress) { opts.Progress(StorageVersionNodeKey, p) }
+		}
+		if err := target.syncFrom(src, progress); err != nil {
+			return err
+		}
+	}
+
+	for _, prefix := range [][]byte{legacyNodeKeyFormat.Prefix(), legacyOrphanKeyFormat.Key(), legacyRootKeyFormat.Key()} {
+		if err := ndb.traversePrefix(prefix, func(key, _ []byte) error {
+			return ndb.batch.Delete(key)
+		}); err != nil {
+			return err
+		}
+		if err := ndb.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateFastIndex builds or deletes the fast node index of the latest version.
+func migrateFastIndex(db corestore.KVStoreWithBatch, enable bool, opts MigrateOptions) error {
+	tree := NewMutableTree(db, 0, true, opts.Logger, opts.TreeOptions...)
+	if !enable {
+		done, err := tree.ndb.disableFastStorage()
+		if err != nil {
+			return err
+		}
+		return <-done
+	}
+
+	if _, err := tree.Load(); err != nil {
+		return err
+	}
+	tree.setSkipFastStorageUpgrade(false)
+	var progress func(int64)
+	if opts.Progress != nil {
+		started := time.Now()
+		total := tree.Size()
+		progress = func(nodes int64) {
+			opts.Progress(StorageVersionFastIndex, Progress{Nodes: nodes, TotalNodes: total, Elapsed: time.Since(started)})
+		}
+	}
+	if _, err := tree.upgradeFastStorage(progress); err != nil {
+		return err
+	}
+	if !tree.ndb.hasUpgradedToFastStorage() {
+		return errors.New("the fast node index was not built")
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package iavl
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// KV is a key-value pair returned by StreamIterator.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// StreamIterator is a pull-based iterator for server code with flow control, e.g. feeding a gRPC
+// stream: the pairs are read ahead of the consumer in a background goroutine, but only up to the
+// buffer size, so a slow consumer holds back the reads instead of piling pairs up in memory.
+type StreamIterator struct {
+	ch     chan KV
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// NewStreamIterator returns a StreamIterator reading the given iterator, e.g. of Iterator, with
+// up to bufferSize pairs read ahead. It takes ownership of the iterator, which is read from a
+// background goroutine and closed by Close, so the contract of the iterator, e.g. no updates of
+// the tree while it is active, holds until Close returns. The pairs are copied, so they stay
+// valid after the iterator moves on.
+func NewStreamIterator(itr corestore.Iterator, bufferSize int) *StreamIterator {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	si := &StreamIterator{
+		ch:     make(chan KV, bufferSize),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go si.produce(ctx, itr)
+	return si
+}
+
+func (si *StreamIterator) produce(ctx context.Context, itr corestore.Iterator) {
+	defer close(si.done)
+	defer close(si.ch)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		kv := KV{Key: bytes.Clone(itr.Key()), Value: bytes.Clone(itr.Value())}
+		select {
+		case si.ch <- kv:
+		case <-ctx.Done():
+			return
+		}
+	}
+	// the error is read by the consumer after ch is closed
+	si.err = itr.Error()
+}
+
+// Next returns the next pair, waiting for it until the context is done. It returns io.EOF after
+// the last pair, and the error of the underlying iterator if it failed.
+func (si *StreamIterator) Next(ctx context.Context) (KV, error) {
+	select {
+	case kv, ok := <-si.ch:
+		if !ok {
+			<-si.done
+			if si.err != nil {
+				return KV{}, si.err
+			}
+			return KV{}, io.EOF
+		}
+		return kv, nil
+	case <-ctx.Done():
+		return KV{}, ctx.Err()
+	}
+}
+
+// Close stops the reads and closes the underlying iterator. It must be called when done.
+func (si *StreamIterator) Close() error {
+	si.cancel()
+	<-si.done
+	return nil
+}
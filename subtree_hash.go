@@ -0,0 +1,230 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// SubtreeRoot is the root of one of the subtrees covering a key range, see
+// ImmutableTree.SubtreeHash. Its hash is computed from its fields, so its size is authenticated
+// along with it.
+type SubtreeRoot struct {
+	Height  int8
+	Size    int64
+	Version int64
+	// Key and ValueHash are set for a leaf.
+	Key       []byte
+	ValueHash []byte
+	// Left and Right are the child hashes of an inner node.
+	Left  []byte
+	Right []byte
+	// Path links the subtree to the root. Like PathToLeaf, the node closest to the root is last.
+	Path PathToLeaf
+}
+
+// Hash returns the hash of the root node of the subtree.
+func (sr SubtreeRoot) Hash() ([]byte, error) {
+	if sr.Height == 0 {
+		if sr.Size != 1 {
+			return nil, fmt.Errorf("%w: leaf with size %d", ErrInvalidProof, sr.Size)
+		}
+		return ProofLeafNode{Key: sr.Key, ValueHash: sr.ValueHash, Version: sr.Version}.Hash()
+	}
+	if len(sr.Left) == 0 || len(sr.Right) == 0 {
+		return nil, fmt.Errorf("%w: inner node without child hashes", ErrInvalidProof)
+	}
+	return ProofInnerNode{Height: sr.Height, Size: sr.Size, Version: sr.Version, Left: sr.Left}.Hash(sr.Right)
+}
+
+// index returns the index of the first leaf of the subtree, computed from its path.
+func (sr SubtreeRoot) index() int64 {
+	var idx int64
+	childSize := sr.Size
+	for _, pin := range sr.Path {
+		if len(pin.Right) == 0 {
+			// the subtree is in the right child
+			idx += pin.Size - childSize
+		}
+		childSize = pin.Size
+	}
+	return idx
+}
+
+// SubtreeHashProof links the subtrees covering a key range to the root hash of the tree.
+type SubtreeHashProof struct {
+	// Subtrees are the covering subtrees in ascending key order.
+	Subtrees []SubtreeRoot
+}
+
+// Verify checks that the subtrees of the proof are contiguous subtrees of the tree with the given
+// root hash, and that hash is their commitment as returned by SubtreeHash. That the subtrees cover
+// the whole key range, and nothing beyond it, can be shown with proofs of the keys next to them.
+func (p *SubtreeHashProof) Verify(rootHash, hash []byte) error {
+	hashes := make([][]byte, len(p.Subtrees))
+	var nextIndex int64
+	for i, sr := range p.Subtrees {
+		subtreeHash, err := sr.Hash()
+		if err != nil {
+			return err
+		}
+		hashes[i] = subtreeHash
+
+		idx := sr.index()
+		if i > 0 && idx != nextIndex {
+			return fmt.Errorf("%w: subtree %d starts at leaf %d, expected %d", ErrInvalidProof, i, idx, nextIndex)
+		}
+		nextIndex = idx + sr.Size
+
+		for _, pin := range sr.Path {
+			if subtreeHash, err = pin.Hash(subtreeHash); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(subtreeHash, rootHash) {
+			return fmt.Errorf("%w: subtree %d has root hash %X, expected %X", ErrInvalidRoot, i, subtreeHash, rootHash)
+		}
+	}
+	if !bytes.Equal(subtreeCommitment(hashes), hash) {
+		return fmt.Errorf("%w: subtree commitment mismatch", ErrInvalidProof)
+	}
+	return nil
+}
+
+// subtreeCommitment returns the SHA-256 hash of the length-prefixed subtree hashes.
+func subtreeCommitment(hashes [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, hash := range hashes {
+		// writing to a bytes.Buffer doesn't fail
+		_ = encoding.EncodeBytes(&buf, hash)
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:]
+}
+
+// SubtreeHash returns a commitment to the key range [start, end), the hash of the roots of the
+// largest subtrees whose keys are all in the range, with a proof linking them to the root hash.
+// Either bound may be nil for an open range. The commitment of a range without keys is the hash
+// of no subtrees. It requires a saved tree, since the nodes of unsaved changes have no hashes.
+func (t *ImmutableTree) SubtreeHash(start, end []byte) ([]byte, *SubtreeHashProof, error) {
+	proof := &SubtreeHashProof{}
+	if t.root == nil {
+		return subtreeCommitment(nil), proof, nil
+	}
+	if t.root.hash == nil {
+		return nil, nil, ErrUnsavedChanges
+	}
+
+	first, _, err := t.root.getByIndex(t, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	last, _, err := t.root.getByIndex(t, t.root.size-1)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &subtreeCollector{tree: t, start: start, end: end, last: last, proof: proof}
+	if err := c.collect(t.root, first, nil); err != nil {
+		return nil, nil, err
+	}
+	return subtreeCommitment(c.hashes), proof, nil
+}
+
+// subtreeCollector collects the subtrees covering a key range.
+type subtreeCollector struct {
+	tree       *ImmutableTree
+	start, end []byte
+	last       []byte           // the last key of the tree
+	path       []ProofInnerNode // the ancestors of the current node, the root first
+	proof      *SubtreeHashProof
+	hashes     [][]byte
+}
+
+// collect adds the subtrees of node covering the range. The keys of the subtree are in [lo, hi),
+// where a nil hi means the subtree ends with the last key of the tree.
+func (c *subtreeCollector) collect(node *Node, lo, hi []byte) error {
+	if node.isLeaf() {
+		if (c.start != nil && bytes.Compare(node.key, c.start) < 0) || (c.end != nil && bytes.Compare(node.key, c.end) >= 0) {
+			return nil
+		}
+		return c.add(node)
+	}
+
+	beforeStart := c.start != nil && (hi != nil && bytes.Compare(hi, c.start) <= 0 ||
+		hi == nil && bytes.Compare(c.last, c.start) < 0)
+	afterEnd := c.end != nil && bytes.Compare(lo, c.end) >= 0
+	if beforeStart || afterEnd {
+		return nil
+	}
+	inside := (c.start == nil || bytes.Compare(lo, c.start) >= 0) &&
+		(c.end == nil || (hi != nil && bytes.Compare(hi, c.end) <= 0) || (hi == nil && bytes.Compare(c.last, c.end) < 0))
+	if inside {
+		return c.add(node)
+	}
+
+	leftNode, err := node.getLeftNode(c.tree)
+	if err != nil {
+		return err
+	}
+	rightNode, err := node.getRightNode(c.tree)
+	if err != nil {
+		return err
+	}
+	pin := ProofInnerNode{Height: node.subtreeHeight, Size: node.size, Version: c.nodeVersion(node)}
+
+	pin.Right = rightNode.hash
+	c.path = append(c.path, pin)
+	if err := c.collect(leftNode, lo, node.key); err != nil {
+		return err
+	}
+	c.path = c.path[:len(c.path)-1]
+
+	pin.Right, pin.Left = nil, leftNode.hash
+	c.path = append(c.path, pin)
+	if err := c.collect(rightNode, node.key, hi); err != nil {
+		return err
+	}
+	c.path = c.path[:len(c.path)-1]
+	return nil
+}
+
+// add adds the subtree of node to the proof.
+func (c *subtreeCollector) add(node *Node) error {
+	sr := SubtreeRoot{
+		Height:  node.subtreeHeight,
+		Size:    node.size,
+		Version: c.nodeVersion(node),
+		Path:    make(PathToLeaf, len(c.path)),
+	}
+	for i, pin := range c.path {
+		sr.Path[len(c.path)-1-i] = pin
+	}
+	if node.isLeaf() {
+		sr.Key = node.key
+		valueHash := sha256.Sum256(node.value)
+		sr.ValueHash = valueHash[:]
+	} else {
+		leftNode, err := node.getLeftNode(c.tree)
+		if err != nil {
+			return err
+		}
+		rightNode, err := node.getRightNode(c.tree)
+		if err != nil {
+			return err
+		}
+		sr.Left, sr.Right = leftNode.hash, rightNode.hash
+	}
+	c.proof.Subtrees = append(c.proof.Subtrees, sr)
+	c.hashes = append(c.hashes, node.hash)
+	return nil
+}
+
+// nodeVersion returns the version hashed into the node.
+func (c *subtreeCollector) nodeVersion(node *Node) int64 {
+	if node.nodeKey != nil {
+		return node.nodeKey.version
+	}
+	return c.tree.version
+}
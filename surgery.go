@@ -0,0 +1,310 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrRootReferenced is returned by the surgery on the root record of a version whose root node is
+// referenced by the root records of later versions.
+var ErrRootReferenced = errors.New("root is referenced by a later version")
+
+// RecordKind is the kind of a record of the database of a tree, see MutableTree.ScanRecords.
+type RecordKind int
+
+const (
+	// RecordOther is a record of none of the other kinds, e.g. of another store sharing the
+	// database.
+	RecordOther RecordKind = iota
+	// RecordNode is a node, keyed by its node key.
+	RecordNode
+	// RecordRoot is the root record of a version which isn't a node: the empty root of an empty
+	// tree, or a reference to the root of an older version saved without changes.
+	RecordRoot
+	// RecordLegacyNode, RecordLegacyOrphan and RecordLegacyRoot are the records of the legacy
+	// layout, see StorageVersionLegacy.
+	RecordLegacyNode
+	RecordLegacyOrphan
+	RecordLegacyRoot
+	// RecordFastNode is an entry of the fast node index.
+	RecordFastNode
+	// RecordValue is a value deduplicated by Options.DedupValueThreshold, or its reference count.
+	RecordValue
+	// RecordValueHashIndex is an entry of Options.ValueHashIndex.
+	RecordValueHashIndex
+	// RecordMetadata is a metadata record, e.g. the storage version.
+	RecordMetadata
+	// RecordVersionInfo is the chained hash, size or time of a version.
+	RecordVersionInfo
+)
+
+var recordKindNames = map[RecordKind]string{
+	RecordOther:          "other",
+	RecordNode:           "node",
+	RecordRoot:           "root",
+	RecordLegacyNode:     "legacy node",
+	RecordLegacyOrphan:   "legacy orphan",
+	RecordLegacyRoot:     "legacy root",
+	RecordFastNode:       "fast node",
+	RecordValue:          "value",
+	RecordValueHashIndex: "value hash index",
+	RecordMetadata:       "metadata",
+	RecordVersionInfo:    "version info",
+}
+
+// String implements fmt.Stringer.
+func (k RecordKind) String() string {
+	if name, ok := recordKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("RecordKind(%d)", int(k))
+}
+
+// recordKinds are the kinds of the records by their prefix, the nodes and roots sharing theirs.
+var recordKinds = map[byte]RecordKind{
+	nodeKeyFormat.Prefix()[0]:           RecordNode,
+	legacyNodeKeyFormat.Prefix()[0]:     RecordLegacyNode,
+	legacyOrphanKeyFormat.Prefix()[0]:   RecordLegacyOrphan,
+	legacyRootKeyFormat.Prefix()[0]:     RecordLegacyRoot,
+	fastKeyFormat.Prefix()[0]:           RecordFastNode,
+	valueKeyFormat.Prefix()[0]:          RecordValue,
+	valueRefKeyFormat.Prefix()[0]:       RecordValue,
+	valueHashIndexKeyFormat.Prefix()[0]: RecordValueHashIndex,
+	metadataKeyFormat.Prefix()[0]:       RecordMetadata,
+	chainedHashKeyFormat.Prefix()[0]:    RecordVersionInfo,
+	versionSizeKeyFormat.Prefix()[0]:    RecordVersionInfo,
+	versionTimeKeyFormat.Prefix()[0]:    RecordVersionInfo,
+}
+
+// recordKind returns the kind of a record.
+func recordKind(key, value []byte) RecordKind {
+	if len(key) == 0 {
+		return RecordOther
+	}
+	kind, ok := recordKinds[key[0]]
+	if !ok {
+		return RecordOther
+	}
+	if kind == RecordNode {
+		if len(value) == 0 {
+			return RecordRoot
+		}
+		if isRef, _ := isReferenceRoot(value); isRef {
+			return RecordRoot
+		}
+	}
+	return kind
+}
+
+// ScanRecords calls fn with every record of the tree in the database, in key order, with the keys
+// as seen by the tree, e.g. without the Options.Namespace prefix. The fast nodes stored in
+// Options.FastIndexShards aren't scanned. The key and value must not be modified or retained.
+func (tree *MutableTree) ScanRecords(fn func(kind RecordKind, key, value []byte) error) error {
+	return tree.ndb.traverse(func(key, value []byte) error {
+		return fn(recordKind(key, value), key, value)
+	})
+}
+
+// RawNode is a node as stored in the database, see MutableTree.FindNode.
+type RawNode struct {
+	// NodeKey is the node key of the node, see GetNodeKey, or its hash if it is a legacy node.
+	NodeKey []byte
+	Legacy  bool
+	Key     []byte
+	Value   []byte // nil for inner nodes
+	Hash    []byte
+	Version int64
+	Height  int8
+	Size    int64
+	// LeftNodeKey and RightNodeKey are the keys of the children of an inner node, their hashes
+	// for a legacy node.
+	LeftNodeKey  []byte
+	RightNodeKey []byte
+}
+
+// FindNode returns the stored node with the given hash, or nil if there is none. The legacy nodes
+// are looked up by their hash, but the other nodes are keyed by their node key, so they are all
+// decoded and resolved until it is found.
+func (tree *MutableTree) FindNode(hash []byte) (*RawNode, error) {
+	ndb := tree.ndb
+	if len(hash) == hashSize {
+		buf, err := ndb.db.Get(ndb.legacyNodeKey(hash))
+		if err != nil {
+			return nil, err
+		}
+		if buf != nil {
+			node, err := MakeLegacyNode(hash, buf)
+			if err != nil {
+				return nil, fmt.Errorf("%w: legacy node %X: %v", ErrCorruptNode, hash, err)
+			}
+			return newRawNode(hash, node), nil
+		}
+	}
+
+	var found *RawNode
+	err := ndb.traversePrefix(nodeKeyFormat.Prefix(), func(key, value []byte) error {
+		if recordKind(key, value) != RecordNode {
+			return nil
+		}
+		node, err := MakeNode(key[1:], value)
+		if err != nil {
+			return fmt.Errorf("%w: node %v: %v", ErrCorruptNode, GetNodeKey(key[1:]), err)
+		}
+		// the hashes of the leaves with a key prefix or a deduplicated value are computed once
+		// they are resolved
+		if err := ndb.resolveNode(node); err != nil {
+			return err
+		}
+		if !bytes.Equal(node.hash, hash) {
+			return nil
+		}
+		found = newRawNode(node.GetKey(), node)
+		return errStopTraverse
+	})
+	if err != nil && !errors.Is(err, errStopTraverse) {
+		return nil, err
+	}
+	return found, nil
+}
+
+// newRawNode returns the RawNode of a decoded node.
+func newRawNode(nk []byte, node *Node) *RawNode {
+	return &RawNode{
+		NodeKey:      nk,
+		Legacy:       node.isLegacy,
+		Key:          node.key,
+		Value:        node.value,
+		Hash:         node.hash,
+		Version:      node.nodeKey.version,
+		Height:       node.subtreeHeight,
+		Size:         node.size,
+		LeftNodeKey:  node.leftNodeKey,
+		RightNodeKey: node.rightNodeKey,
+	}
+}
+
+// DeleteVersionRecords deletes the root record of a version, and its chained hash, size and time,
+// but none of its other nodes, e.g. to drop a version whose nodes are corrupt, which DeleteVersion
+// can't prune. The nodes only reachable from the version are left in the database, since the
+// pruning of the older versions doesn't find them anymore. It fails with ErrRootReferenced if a
+// later version refers to the root of the version. Legacy versions aren't supported.
+//
+// It is a repair of the database, for trees which aren't loaded or written concurrently, see the
+// tool package.
+func (tree *MutableTree) DeleteVersionRecords(version int64) error {
+	ndb := tree.ndb
+	rootKey := GetRootKey(version)
+	has, err := ndb.hasVersion(version)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+	}
+	if err := ndb.checkRootUnreferenced(version); err != nil {
+		return err
+	}
+
+	ndb.roots.invalidate()
+	ndb.mtx.Lock()
+	ndb.nodeCache.Remove(rootKey)
+	for _, key := range [][]byte{
+		ndb.nodeKey(rootKey),
+		chainedHashKeyFormat.Key(version),
+		versionSizeKeyFormat.Key(version),
+		versionTimeKeyFormat.Key(version),
+	} {
+		if err := ndb.batch.Delete(key); err != nil {
+			ndb.mtx.Unlock()
+			return err
+		}
+	}
+	ndb.mtx.Unlock()
+	return ndb.commitRepair()
+}
+
+// RewriteRoot rewrites the root record of a version to refer to the node with the given node key,
+// see GetNodeKey, e.g. to point a version whose root is corrupt to the root of the previous
+// version. The node must be of the version or an older one, and not be legacy. It fails with
+// ErrRootReferenced if the root record is a node referred to by a later version, since it would be
+// lost. The hash of the version becomes the hash of the node, and its size isn't updated.
+//
+// It is a repair of the database, for trees which aren't loaded or written concurrently, see the
+// tool package.
+func (tree *MutableTree) RewriteRoot(version int64, nk []byte) error {
+	ndb := tree.ndb
+	if len(nk) != nodeKeyFormat.Length()-1 {
+		return fmt.Errorf("invalid node key %X, the roots can't refer to legacy nodes", nk)
+	}
+	target := GetNodeKey(nk)
+	rootKey := GetRootKey(version)
+	switch {
+	case target.version > version:
+		return fmt.Errorf("the root of version %d can't refer to node %v of a later version", version, target)
+	case bytes.Equal(nk, rootKey):
+		return fmt.Errorf("the root of version %d can't refer to itself", version)
+	}
+	has, err := ndb.hasVersion(version)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+	}
+	buf, err := ndb.db.Get(ndb.nodeKey(nk))
+	if err != nil {
+		return err
+	}
+	if recordKind(ndb.nodeKey(nk), buf) != RecordNode {
+		return fmt.Errorf("node %v doesn't exist", target)
+	}
+	if err := ndb.checkRootUnreferenced(version); err != nil {
+		return err
+	}
+
+	ndb.roots.invalidate()
+	ndb.mtx.Lock()
+	ndb.nodeCache.Remove(rootKey)
+	ndb.mtx.Unlock()
+	if err := ndb.SaveRoot(version, target); err != nil {
+		return err
+	}
+	return ndb.commitRepair()
+}
+
+// checkRootUnreferenced fails with ErrRootReferenced if the root node of the version is referred
+// to by the root record of a later version. The references are the versions after it saved
+// without changes, so the scan stops at the first later version with a root of its own.
+func (ndb *nodeDB) checkRootUnreferenced(version int64) error {
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	ref := ndb.nodeKey(GetRootKey(version))
+	for v := ndb.nextVersion(version); v <= latestVersion; v = ndb.nextVersion(v) {
+		val, err := ndb.db.Get(ndb.nodeKey(GetRootKey(v)))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(val, ref) {
+			return fmt.Errorf("%w: version %d refers to the root of version %d", ErrRootReferenced, v, version)
+		}
+		// a version deleted by DeleteVersionRecords is skipped
+		if val != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// commitRepair commits the changes of a repair, and resets the cached first and latest versions,
+// which it may have changed.
+func (ndb *nodeDB) commitRepair() error {
+	if err := ndb.Commit(); err != nil {
+		return err
+	}
+	ndb.resetFirstVersion(0)
+	ndb.resetLatestVersion(0)
+	return nil
+}
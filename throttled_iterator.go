@@ -0,0 +1,42 @@
+package iavl
+
+import (
+	"time"
+
+	"cosmossdk.io/core/store"
+)
+
+// throttledIterator limits the average rate of the Next calls of an iterator to
+// IteratorOptions.MaxOpsPerSec, sleeping in Next while the iteration is ahead of it.
+type throttledIterator struct {
+	store.Iterator
+	maxOpsPerSec int64
+	ops          int64
+	started      time.Time
+	sleep        func(time.Duration)
+}
+
+var _ store.Iterator = (*throttledIterator)(nil)
+
+// newThrottledIterator returns the iterator throttled to maxOpsPerSec, or as is if it is zero.
+func newThrottledIterator(parent store.Iterator, maxOpsPerSec int64) store.Iterator {
+	if maxOpsPerSec <= 0 {
+		return parent
+	}
+	return &throttledIterator{
+		Iterator:     parent,
+		maxOpsPerSec: maxOpsPerSec,
+		started:      time.Now(),
+		sleep:        time.Sleep,
+	}
+}
+
+// Next implements store.Iterator.
+func (iter *throttledIterator) Next() {
+	iter.ops++
+	due := time.Duration(float64(iter.ops) / float64(iter.maxOpsPerSec) * float64(time.Second))
+	if wait := due - time.Since(iter.started); wait > 0 {
+		iter.sleep(wait)
+	}
+	iter.Iterator.Next()
+}
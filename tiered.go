@@ -0,0 +1,346 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	corestore "cosmossdk.io/core/store"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// tieredDB serves the nodeDB of a tree with Options.ColdStorage from the primary backend, and reads
+// the nodes it misses from the cold storage, where MoveToColdStorage moved them. All other keys,
+// and the roots of the versions, stay in the primary backend, so the cold storage is only read for
+// the nodes of old versions. The deletions of nodes, e.g. by pruning, are applied to both.
+type tieredDB struct {
+	db   corestore.KVStoreWithBatch
+	cold corestore.KVStoreWithBatch
+}
+
+var (
+	_ corestore.KVStoreWithBatch = (*tieredDB)(nil)
+	_ dbm.MultiGetter            = (*tieredDB)(nil)
+	_ dbm.HintedDB               = (*tieredDB)(nil)
+	_ dbm.CompactionDebtReporter = (*tieredDB)(nil)
+)
+
+func newTieredDB(db, cold corestore.KVStoreWithBatch, namespace []byte) *tieredDB {
+	if len(namespace) > 0 {
+		cold = newNamespaceDB(cold, namespace)
+	}
+	return &tieredDB{db: db, cold: cold}
+}
+
+// isNodeKey returns whether the key is the key of a node, which may be in the cold storage.
+func isNodeKey(key []byte) bool {
+	return len(key) == nodeKeyFormat.Length() && bytes.HasPrefix(key, nodeKeyFormat.Prefix())
+}
+
+// Get implements corestore.KVStore.
+func (tdb *tieredDB) Get(key []byte) ([]byte, error) {
+	value, err := tdb.db.Get(key)
+	if err != nil || value != nil || !isNodeKey(key) {
+		return value, err
+	}
+	return tdb.cold.Get(key)
+}
+
+// Has implements corestore.KVStore.
+func (tdb *tieredDB) Has(key []byte) (bool, error) {
+	has, err := tdb.db.Has(key)
+	if err != nil || has || !isNodeKey(key) {
+		return has, err
+	}
+	return tdb.cold.Has(key)
+}
+
+// Set implements corestore.KVStore.
+func (tdb *tieredDB) Set(key, value []byte) error {
+	return tdb.db.Set(key, value)
+}
+
+// Delete implements corestore.KVStore.
+func (tdb *tieredDB) Delete(key []byte) error {
+	if err := tdb.db.Delete(key); err != nil {
+		return err
+	}
+	if isNodeKey(key) {
+		return tdb.cold.Delete(key)
+	}
+	return nil
+}
+
+// MultiGet implements dbm.MultiGetter, with a single call to each backend implementing it.
+func (tdb *tieredDB) MultiGet(keys [][]byte) ([][]byte, error) {
+	values, err := multiGet(tdb.db, keys)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		missing  []int
+		coldKeys [][]byte
+	)
+	for i, key := range keys {
+		if values[i] == nil && isNodeKey(key) {
+			missing = append(missing, i)
+			coldKeys = append(coldKeys, key)
+		}
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+	coldValues, err := multiGet(tdb.cold, coldKeys)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range missing {
+		values[i] = coldValues[j]
+	}
+	return values, nil
+}
+
+// multiGet reads the keys with a single call if the database implements dbm.MultiGetter.
+func multiGet(db corestore.KVStore, keys [][]byte) ([][]byte, error) {
+	if mg, ok := db.(dbm.MultiGetter); ok {
+		values, err := mg.MultiGet(keys)
+		if err == nil && len(values) != len(keys) {
+			err = fmt.Errorf("multi-get returned %d values for %d keys", len(values), len(keys))
+		}
+		return values, err
+	}
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		value, err := db.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// Iterator implements corestore.KVStore. It iterates over the primary backend only.
+func (tdb *tieredDB) Iterator(start, end []byte) (corestore.Iterator, error) {
+	return tdb.db.Iterator(start, end)
+}
+
+// ReverseIterator implements corestore.KVStore. It iterates over the primary backend only.
+func (tdb *tieredDB) ReverseIterator(start, end []byte) (corestore.Iterator, error) {
+	return tdb.db.ReverseIterator(start, end)
+}
+
+// IteratorWithHint implements dbm.HintedDB, passing the hint through if the primary backend
+// implements it.
+func (tdb *tieredDB) IteratorWithHint(start, end []byte, ascending bool, hint dbm.Hint) (corestore.Iterator, error) {
+	switch hinted, ok := tdb.db.(dbm.HintedDB); {
+	case ok:
+		return hinted.IteratorWithHint(start, end, ascending, hint)
+	case ascending:
+		return tdb.db.Iterator(start, end)
+	default:
+		return tdb.db.ReverseIterator(start, end)
+	}
+}
+
+// NewBatch implements corestore.KVStoreWithBatch.
+func (tdb *tieredDB) NewBatch() corestore.Batch {
+	return &tieredBatch{source: tdb.db.NewBatch(), tdb: tdb}
+}
+
+// NewBatchWithSize implements corestore.KVStoreWithBatch.
+func (tdb *tieredDB) NewBatchWithSize(size int) corestore.Batch {
+	return &tieredBatch{source: tdb.db.NewBatchWithSize(size), tdb: tdb}
+}
+
+// NewBatchWithHint implements dbm.HintedDB, passing the hint through if the primary backend
+// implements it.
+func (tdb *tieredDB) NewBatchWithHint(hint dbm.Hint) corestore.Batch {
+	if hinted, ok := tdb.db.(dbm.HintedDB); ok {
+		return &tieredBatch{source: hinted.NewBatchWithHint(hint), tdb: tdb}
+	}
+	return tdb.NewBatch()
+}
+
+// CompactionDebt implements dbm.CompactionDebtReporter, with the debt of the primary backend, or
+// none if it doesn't report it.
+func (tdb *tieredDB) CompactionDebt() (int64, error) {
+	if reporter, ok := tdb.db.(dbm.CompactionDebtReporter); ok {
+		return reporter.CompactionDebt()
+	}
+	return 0, nil
+}
+
+// Close implements corestore.KVStore, closing the primary backend. The cold storage is left open,
+// since it is shared with other trees.
+func (tdb *tieredDB) Close() error {
+	return tdb.db.Close()
+}
+
+// tieredBatch writes to the primary backend, and applies the deletions of nodes to the cold
+// storage too, with a batch of its own created on the first one.
+type tieredBatch struct {
+	source corestore.Batch
+	cold   corestore.Batch
+	tdb    *tieredDB
+}
+
+var _ corestore.Batch = (*tieredBatch)(nil)
+
+// Set implements corestore.Batch.
+func (b *tieredBatch) Set(key, value []byte) error {
+	return b.source.Set(key, value)
+}
+
+// Delete implements corestore.Batch.
+func (b *tieredBatch) Delete(key []byte) error {
+	if err := b.source.Delete(key); err != nil {
+		return err
+	}
+	if !isNodeKey(key) {
+		return nil
+	}
+	if b.cold == nil {
+		b.cold = b.tdb.cold.NewBatch()
+	}
+	return b.cold.Delete(key)
+}
+
+// Write implements corestore.Batch. The primary backend is written first, so an interrupted write
+// leaves the deleted nodes in the cold storage at most, where they are unreachable.
+func (b *tieredBatch) Write() error {
+	if err := b.source.Write(); err != nil {
+		return err
+	}
+	if b.cold != nil {
+		return b.cold.Write()
+	}
+	return nil
+}
+
+// WriteSync implements corestore.Batch.
+func (b *tieredBatch) WriteSync() error {
+	if err := b.source.WriteSync(); err != nil {
+		return err
+	}
+	if b.cold != nil {
+		return b.cold.WriteSync()
+	}
+	return nil
+}
+
+// Close implements corestore.Batch.
+func (b *tieredBatch) Close() error {
+	if b.cold != nil {
+		if err := b.cold.Close(); err != nil {
+			return err
+		}
+	}
+	return b.source.Close()
+}
+
+// GetByteSize implements corestore.Batch, with the size of the batch of the primary backend.
+func (b *tieredBatch) GetByteSize() (int, error) {
+	return b.source.GetByteSize()
+}
+
+// MoveToColdStorage moves the nodes which are only reachable from the versions up to toVersion,
+// i.e. not from the later ones, from the primary backend to Options.ColdStorage, e.g. so an archive
+// node keeps most of its history on cheaper storage. The nodes are written to the cold storage
+// before they are deleted from the primary backend, and the moved versions are recorded, so an
+// interrupted move is resumed by the next call, which only moves the versions after them. The
+// roots of the versions stay in the primary backend. It must not run concurrently with the
+// deletion of versions, e.g. by async pruning.
+func (tree *MutableTree) MoveToColdStorage(toVersion int64) error {
+	return tree.ndb.moveToColdStorage(toVersion)
+}
+
+// moveToColdStorage moves the orphans of the versions up to toVersion to the cold storage.
+func (ndb *nodeDB) moveToColdStorage(toVersion int64) error {
+	tdb, ok := ndb.db.(*tieredDB)
+	if !ok {
+		return errors.New("no cold storage configured")
+	}
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if toVersion >= latestVersion {
+		return fmt.Errorf("version %d must be below the latest version %d", toVersion, latestVersion)
+	}
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+	if legacyLatestVersion > 0 {
+		return fmt.Errorf("the legacy versions up to %d can't be moved to the cold storage", legacyLatestVersion)
+	}
+	fromVersion, err := ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	coldVersion, err := ndb.getColdVersion()
+	if err != nil {
+		return err
+	}
+	if coldVersion >= fromVersion {
+		fromVersion = ndb.nextVersion(coldVersion)
+	}
+
+	for version := fromVersion; version <= toVersion; version = ndb.nextVersion(version) {
+		if err := ndb.moveVersionToColdStorage(tdb, version); err != nil {
+			return fmt.Errorf("failed to move version %d to the cold storage: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// moveVersionToColdStorage moves the nodes of the version which aren't in the next version to the
+// cold storage, and records the version as moved.
+func (ndb *nodeDB) moveVersionToColdStorage(tdb *tieredDB, version int64) error {
+	coldBatch := tdb.cold.NewBatch()
+	defer coldBatch.Close()
+	var keys [][]byte
+	if err := ndb.traverseOrphans(version, ndb.nextVersion(version), func(orphan *Node) error {
+		if orphan.nodeKey.nonce == 1 {
+			// the versions are found by their roots
+			return nil
+		}
+		key := ndb.nodeKey(orphan.GetKey())
+		bz, err := tdb.db.Get(key)
+		if err != nil || bz == nil {
+			// moved already by an interrupted move
+			return err
+		}
+		keys = append(keys, key)
+		return coldBatch.Set(key, bz)
+	}); err != nil {
+		return err
+	}
+	if err := coldBatch.WriteSync(); err != nil {
+		return err
+	}
+
+	batch := tdb.db.NewBatch()
+	defer batch.Close()
+	for _, key := range keys {
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	if err := batch.Set(metadataKeyFormat.Key([]byte(coldVersionKey)), []byte(strconv.FormatInt(version, 10))); err != nil {
+		return err
+	}
+	return batch.WriteSync()
+}
+
+// getColdVersion returns the last version moved by MoveToColdStorage, or 0 if there is none.
+func (ndb *nodeDB) getColdVersion() (int64, error) {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(coldVersionKey)))
+	if err != nil || bz == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(bz), 10, 64)
+}
@@ -0,0 +1,65 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestMoveToColdStorage(t *testing.T) {
+	db, cold := dbm.NewMemDB(), dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), ColdStorageOption(cold))
+	for v := 1; v <= 10; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	countKeys := func(db dbm.DB) int {
+		n := 0
+		itr, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			if isNodeKey(itr.Key()) {
+				n++
+			}
+		}
+		return n
+	}
+	total := countKeys(db)
+
+	require.Error(t, tree.MoveToColdStorage(10))
+	require.NoError(t, tree.MoveToColdStorage(7))
+	moved := countKeys(cold)
+	require.Positive(t, moved)
+	require.Equal(t, total, countKeys(db)+moved)
+	// the moved versions are skipped
+	require.NoError(t, tree.MoveToColdStorage(7))
+	require.Equal(t, moved, countKeys(cold))
+
+	// the old versions are read from the cold storage, also after a reload
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), ColdStorageOption(cold))
+	_, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, tree.AvailableVersions())
+	for v := 1; v <= 10; v++ {
+		value, err := tree.GetVersioned([]byte("k05"), int64(v))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("v%d-5", v)), value)
+	}
+
+	// pruning deletes the nodes from the cold storage too
+	require.NoError(t, tree.DeleteVersionsTo(7))
+	require.Zero(t, countKeys(cold))
+	require.Equal(t, []int{8, 9, 10}, tree.AvailableVersions())
+
+	// without a cold storage there is nothing to move to
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.Error(t, plain.MoveToColdStorage(1))
+}
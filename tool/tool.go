@@ -0,0 +1,115 @@
+// Package tool provides the offline inspection and repairs of the IAVL tooling as a library, for
+// operators to script the recovery of a database against supported APIs instead of its raw
+// keyspace, e.g.
+//
+//	report, err := tool.InspectDB(db)
+//	for _, v := range report.Versions {
+//		if v.Err != nil {
+//			// point the broken version to the root of the previous one
+//			err = tool.RewriteRootPointer(db, v.Version, v.Version-1, 1)
+//		}
+//	}
+//
+// The database must not be in use by a running node. The functions take the options the tree is
+// opened with by the node, e.g. its iavl.NamespaceOption, and don't close the database.
+package tool
+
+import (
+	"encoding/binary"
+
+	corestore "cosmossdk.io/core/store"
+
+	"github.com/cosmos/iavl"
+)
+
+// Report is the result of InspectDB.
+type Report struct {
+	// Records are the number and sizes of the records of the tree by their kind.
+	Records map[iavl.RecordKind]RecordStats
+	// Versions are the versions with a root record, in ascending order.
+	Versions []VersionInfo
+}
+
+// RecordStats are the number and sizes of the records of a kind.
+type RecordStats struct {
+	Count      int64
+	KeyBytes   int64
+	ValueBytes int64
+}
+
+// VersionInfo describes a version of a Report.
+type VersionInfo struct {
+	Version int64
+	Legacy  bool
+	// Hash and Size are the root hash and the number of keys of the version, unset if its root
+	// can't be read.
+	Hash []byte
+	Size int64
+	// Err is the error reading the root of the version, if any.
+	Err error
+}
+
+// InspectDB scans all the records of the tree in db, and reads the root of every version.
+func InspectDB(db corestore.KVStoreWithBatch, options ...iavl.Option) (*Report, error) {
+	tree := open(db, options)
+	report := &Report{Records: make(map[iavl.RecordKind]RecordStats)}
+	var versions []VersionInfo
+	err := tree.ScanRecords(func(kind iavl.RecordKind, key, value []byte) error {
+		stats := report.Records[kind]
+		stats.Count++
+		stats.KeyBytes += int64(len(key))
+		stats.ValueBytes += int64(len(value))
+		report.Records[kind] = stats
+
+		switch kind {
+		case iavl.RecordNode, iavl.RecordRoot:
+			// the roots have the nonce 1
+			if nk := key[1:]; binary.BigEndian.Uint32(nk[8:]) == 1 {
+				versions = append(versions, VersionInfo{Version: int64(binary.BigEndian.Uint64(nk))})
+			}
+		case iavl.RecordLegacyRoot:
+			versions = append(versions, VersionInfo{Version: int64(binary.BigEndian.Uint64(key[1:])), Legacy: true})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range versions {
+		root, err := tree.GetImmutable(v.Version)
+		if err != nil {
+			v.Err = err
+		} else {
+			v.Hash, v.Size = root.Hash(), root.Size()
+		}
+		report.Versions = append(report.Versions, v)
+	}
+	return report, nil
+}
+
+// DeleteVersionRecordsOnly deletes the root record of a version and its metadata, but not its
+// nodes, see iavl.MutableTree.DeleteVersionRecords.
+func DeleteVersionRecordsOnly(db corestore.KVStoreWithBatch, version int64, options ...iavl.Option) error {
+	return open(db, options).DeleteVersionRecords(version)
+}
+
+// RewriteRootPointer rewrites the root record of a version to refer to the node with the given
+// version and nonce, the nonce 1 being the root of its version, see
+// iavl.MutableTree.RewriteRoot.
+func RewriteRootPointer(db corestore.KVStoreWithBatch, version, targetVersion int64, targetNonce uint32, options ...iavl.Option) error {
+	return open(db, options).RewriteRoot(version, iavl.NewNodeKey(targetVersion, targetNonce).GetKey())
+}
+
+// ExtractNode returns the stored node with the given hash, or nil if there is none, see
+// iavl.MutableTree.FindNode.
+func ExtractNode(db corestore.KVStoreWithBatch, hash []byte, options ...iavl.Option) (*iavl.RawNode, error) {
+	return open(db, options).FindNode(hash)
+}
+
+// open returns the tree in db without loading it. The pruning is synchronous, so no goroutine
+// outlives the call, and the tree isn't closed, which would close db.
+func open(db corestore.KVStoreWithBatch, options []iavl.Option) *iavl.MutableTree {
+	options = append(options[:len(options):len(options)], iavl.AsyncPruningOption(false))
+	return iavl.NewMutableTree(db, 0, true, iavl.NewNopLogger(), options...)
+}
@@ -0,0 +1,120 @@
+package tool
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestTool(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := iavl.NewMutableTree(db, 0, false, iavl.NewNopLogger())
+	hashes := make(map[int64][]byte)
+	for v := int64(1); v <= 5; v++ {
+		// version 3 is saved without changes, so its root refers to the one of version 2
+		if v != 3 {
+			for i := 0; i < 10; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("k%d-%d", v, i)), []byte("value"))
+				require.NoError(t, err)
+			}
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[v] = hash
+	}
+
+	report, err := InspectDB(db)
+	require.NoError(t, err)
+	require.Len(t, report.Versions, 5)
+	for i, info := range report.Versions {
+		require.Equal(t, int64(i+1), info.Version)
+		require.NoError(t, info.Err)
+		require.Equal(t, hashes[info.Version], info.Hash)
+	}
+	require.Equal(t, int64(40), report.Versions[4].Size)
+	require.Equal(t, int64(1), report.Records[iavl.RecordRoot].Count)
+	require.Equal(t, int64(40), report.Records[iavl.RecordFastNode].Count)
+	require.Equal(t, int64(2*5), report.Records[iavl.RecordVersionInfo].Count) // sizes and times
+	require.NotZero(t, report.Records[iavl.RecordNode].Count)
+	require.NotZero(t, report.Records[iavl.RecordMetadata].Count)
+
+	// the root of version 1 is found by its hash
+	node, err := ExtractNode(db, hashes[1])
+	require.NoError(t, err)
+	require.NotNil(t, node)
+	require.Equal(t, iavl.NewNodeKey(1, 1).GetKey(), node.NodeKey)
+	require.Equal(t, int64(1), node.Version)
+	require.Equal(t, int64(10), node.Size)
+	require.NotNil(t, node.LeftNodeKey)
+	node, err = ExtractNode(db, []byte("missing"))
+	require.NoError(t, err)
+	require.Nil(t, node)
+
+	// the root of version 2 is referenced by version 3
+	require.ErrorIs(t, DeleteVersionRecordsOnly(db, 2), iavl.ErrRootReferenced)
+	require.ErrorIs(t, RewriteRootPointer(db, 2, 1, 1), iavl.ErrRootReferenced)
+	require.ErrorIs(t, DeleteVersionRecordsOnly(db, 6), iavl.ErrVersionDoesNotExist)
+	require.Error(t, RewriteRootPointer(db, 4, 5, 1))
+	require.Error(t, RewriteRootPointer(db, 4, 4, 1))
+	require.Error(t, RewriteRootPointer(db, 4, 1, 100))
+
+	require.NoError(t, DeleteVersionRecordsOnly(db, 5))
+	require.NoError(t, RewriteRootPointer(db, 4, 2, 1))
+	report, err = InspectDB(db)
+	require.NoError(t, err)
+	require.Len(t, report.Versions, 4)
+	require.Equal(t, hashes[2], report.Versions[3].Hash)
+	require.Equal(t, int64(2), report.Records[iavl.RecordRoot].Count)
+
+	tree = iavl.NewMutableTree(db, 0, true, iavl.NewNopLogger())
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), version)
+	require.Equal(t, hashes[2], tree.Hash())
+	value, err := tree.Get([]byte("k2-0"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
+
+func TestExtractNode(t *testing.T) {
+	for name, options := range map[string][]iavl.Option{
+		"plain":          nil,
+		"key prefixes":   {iavl.KeyPrefixDictionaryOption([]byte("k"))},
+		"deduplicated":   {iavl.DedupValueThresholdOption(8)},
+		"prefixes+dedup": {iavl.KeyPrefixDictionaryOption([]byte("k")), iavl.DedupValueThresholdOption(8)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := dbm.NewMemDB()
+			tree := iavl.NewMutableTree(db, 0, false, iavl.NewNopLogger(), options...)
+			value := []byte("a value of 20 bytes.")
+			_, err := tree.Set([]byte("k1"), value)
+			require.NoError(t, err)
+			_, err = tree.Set([]byte("k2"), []byte("short"))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+
+			// the leaves are found by their hash, with their full key and value
+			leafHashes := make(map[string][]byte)
+			_, err = tree.IterateHashes(func(key, leafHash []byte) bool {
+				leafHashes[string(key)] = leafHash
+				return false
+			})
+			require.NoError(t, err)
+			require.Len(t, leafHashes, 2)
+			for key, leafHash := range leafHashes {
+				node, err := ExtractNode(db, leafHash, options...)
+				require.NoError(t, err)
+				require.NotNil(t, node, key)
+				require.Equal(t, []byte(key), node.Key)
+				expected, err := tree.Get([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, expected, node.Value)
+			}
+		})
+	}
+}
@@ -270,6 +270,13 @@ func assertEmptyDatabase(t *testing.T, tree *MutableTree) {
 
 	var foundKeys []string
 	for ; iter.Valid(); iter.Next() {
+		// the version sizes and times are kept when their versions are deleted, and the commit
+		// marker of the latest version with them
+		if strings.HasPrefix(string(iter.Key()), versionSizeKeyFormat.Prefix()) ||
+			strings.HasPrefix(string(iter.Key()), versionTimeKeyFormat.Prefix()) ||
+			string(iter.Key()) == string(metadataKeyFormat.Key([]byte(commitVersionKey))) {
+			continue
+		}
 		foundKeys = append(foundKeys, string(iter.Key()))
 	}
 	require.NoError(t, iter.Error())
@@ -6,10 +6,13 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	corestore "cosmossdk.io/core/store"
@@ -1640,6 +1643,39 @@ func TestGetByIndex_ImmutableTree(t *testing.T) {
 	}
 }
 
+func TestSampleKeys(t *testing.T) {
+	tree, mirror := getRandomizedTreeAndMirror(t)
+	mirrorKeys := getSortedMirrorKeys(mirror)
+
+	sample, err := tree.SampleKeys(10, 42)
+	require.NoError(t, err)
+	require.Len(t, sample, 10)
+	for i, key := range sample {
+		require.Contains(t, mirror, string(key))
+		if i > 0 {
+			require.Equal(t, -1, bytes.Compare(sample[i-1], key))
+		}
+	}
+
+	again, err := tree.SampleKeys(10, 42)
+	require.NoError(t, err)
+	require.Equal(t, sample, again)
+	other, err := tree.SampleKeys(10, 43)
+	require.NoError(t, err)
+	require.NotEqual(t, sample, other)
+
+	all, err := tree.SampleKeys(len(mirrorKeys)+10, 1)
+	require.NoError(t, err)
+	require.Len(t, all, len(mirrorKeys))
+	for i, key := range all {
+		require.Equal(t, mirrorKeys[i], string(key))
+	}
+
+	none, err := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).SampleKeys(5, 1)
+	require.NoError(t, err)
+	require.Empty(t, none)
+}
+
 func TestGetWithIndex_ImmutableTree(t *testing.T) {
 	tree, mirror := getRandomizedTreeAndMirror(t)
 	mirrorKeys := getSortedMirrorKeys(mirror)
@@ -1947,3 +1983,92 @@ func TestWorkingHashWithInitialVersion(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, commitHash1, commitHash)
 }
+
+func TestIterateParallel(t *testing.T) {
+	tree := getTestTree(100)
+	expected := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key, value := fmt.Sprintf("key-%04d", i), fmt.Sprintf("value-%d", i)
+		_, err := tree.Set([]byte(key), []byte(value))
+		require.NoError(t, err)
+		expected[key] = value
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	for _, workers := range []int{1, 3, 8} {
+		var mtx sync.Mutex
+		visited := map[string]string{}
+		stopped, err := itree.IterateParallel(workers, func(key, value []byte) bool {
+			mtx.Lock()
+			defer mtx.Unlock()
+			_, dup := visited[string(key)]
+			require.False(t, dup)
+			visited[string(key)] = string(value)
+			return false
+		})
+		require.NoError(t, err)
+		require.False(t, stopped)
+		require.Equal(t, expected, visited)
+	}
+
+	var count atomic.Int64
+	stopped, err := itree.IterateParallel(4, func(_, _ []byte) bool {
+		return count.Add(1) >= 10
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Less(t, count.Load(), int64(1000))
+
+	_, err = itree.IterateParallel(0, func(_, _ []byte) bool { return false })
+	require.Error(t, err)
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	anomalies, err := tree.DetectAnomalies()
+	require.NoError(t, err)
+	require.Empty(t, anomalies)
+
+	// a corrupted height of the left child of the root throws off the root too
+	left := tree.root.leftNode
+	left.subtreeHeight += 3
+	anomalies, err = tree.DetectAnomalies()
+	require.NoError(t, err)
+	kinds := map[AnomalyKind][]int{}
+	for _, a := range anomalies {
+		kinds[a.Kind] = append(kinds[a.Kind], a.Depth)
+	}
+	require.Equal(t, map[AnomalyKind][]int{
+		AnomalyHeight:          {1, 0},
+		AnomalyHeightSizeRatio: {1},
+		AnomalyUnbalanced:      {0},
+	}, kinds)
+	require.Equal(t, []byte{0}, anomalies[0].MinKey)
+	require.Less(t, anomalies[0].MaxKey[0], tree.root.key[0])
+
+	left.subtreeHeight -= 3
+	left.size--
+	anomalies, err = tree.DetectAnomalies()
+	require.NoError(t, err)
+	require.Len(t, anomalies, 2)
+	require.Equal(t, AnomalySize, anomalies[0].Kind)
+	require.Equal(t, left.key, anomalies[0].Key)
+	require.Equal(t, AnomalySize, anomalies[1].Kind)
+	require.Equal(t, tree.root.key, anomalies[1].Key)
+}
+
+func TestAVLLeaves(t *testing.T) {
+	for h, expected := range []int64{1, 2, 3, 5, 8, 13} {
+		require.Equal(t, expected, minAVLLeaves(int8(h)))
+		require.Equal(t, int64(1)<<h, maxAVLLeaves(int8(h)))
+	}
+	require.Equal(t, int64(math.MaxInt64), minAVLLeaves(127))
+	require.Equal(t, int64(math.MaxInt64), maxAVLLeaves(127))
+}
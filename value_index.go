@@ -0,0 +1,89 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// FindByValueHash returns the keys of the latest saved version whose value has the given SHA-256
+// hash, in key order. It requires Options.ValueHashIndex.
+func (tree *MutableTree) FindByValueHash(hash []byte) ([][]byte, error) {
+	if !tree.ndb.opts.ValueHashIndex {
+		return nil, errors.New("the value hash index is not enabled")
+	}
+	if len(hash) != hashSize {
+		return nil, fmt.Errorf("value hash must be %d bytes, got %d", hashSize, len(hash))
+	}
+	var keys [][]byte
+	prefix := valueHashIndexKeyFormat.KeyBytes(hash)
+	if err := tree.ndb.traversePrefix(prefix, func(k, _ []byte) error {
+		keys = append(keys, k[len(prefix):])
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RebuildValueHashIndex rebuilds the value hash index from the latest saved version, e.g. after
+// enabling Options.ValueHashIndex on an existing tree. The working tree must not have unsaved
+// changes.
+func (tree *MutableTree) RebuildValueHashIndex() error {
+	if err := tree.ndb.traversePrefix(valueHashIndexKeyFormat.Key(), func(k, _ []byte) error {
+		return tree.ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+	if tree.lastSaved != nil && tree.lastSaved.root != nil {
+		itr := NewIterator(nil, nil, true, tree.lastSaved)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			if err := tree.ndb.batch.Set(valueHashIndexKey(itr.Key(), itr.Value()), []byte{}); err != nil {
+				return err
+			}
+		}
+		if err := itr.Error(); err != nil {
+			return err
+		}
+	}
+	return tree.ndb.Commit()
+}
+
+// updateValueHashIndex writes the changes of the working tree to the value hash index, with the
+// batch of the version being saved.
+func (tree *MutableTree) updateValueHashIndex() error {
+	if !tree.ndb.opts.ValueHashIndex {
+		return nil
+	}
+	// only the last change of a key matters
+	latest := make(map[string]*KVPair, len(tree.unsavedChanges))
+	for _, pair := range tree.unsavedChanges {
+		latest[string(pair.Key)] = pair
+	}
+	for key, pair := range latest {
+		var old []byte
+		if tree.lastSaved != nil {
+			var err error
+			if old, err = tree.lastSaved.getFromNodes(pair.Key); err != nil {
+				return err
+			}
+		}
+		if old != nil {
+			if err := tree.ndb.batch.Delete(valueHashIndexKey([]byte(key), old)); err != nil {
+				return err
+			}
+		}
+		if !pair.Delete {
+			if err := tree.ndb.batch.Set(valueHashIndexKey(pair.Key, pair.Value), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func valueHashIndexKey(key, value []byte) []byte {
+	hash := sha256.Sum256(value)
+	return valueHashIndexKeyFormat.KeyBytes(hash[:], key)
+}
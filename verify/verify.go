@@ -0,0 +1,178 @@
+// Package verify checks IAVL proofs against a root hash. It only depends on ics23 and has no tree
+// or database dependencies, so light clients (e.g. compiled to WASM or for mobile) can verify
+// proofs without pulling in the rest of IAVL.
+//
+// Unlike the verification functions of ics23, it supports the proofs of empty values, which trees
+// with the AllowEmptyValues option store, and which ics23 refuses to compute the leaf hash of.
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	ics23 "github.com/cosmos/ics23/go"
+)
+
+// VerifyMembership returns true iff proof is an existence proof of the key with the given value
+// in the tree with the given root hash.
+func VerifyMembership(root []byte, proof *ics23.CommitmentProof, key, value []byte) bool {
+	if len(value) > 0 {
+		return ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, value)
+	}
+	exist := existenceProof(ics23.Decompress(proof), key)
+	return exist != nil && verifyExistence(root, exist, key, value) == nil
+}
+
+// VerifyNonMembership returns true iff proof is a non-existence proof of the key in the tree with
+// the given root hash.
+func VerifyNonMembership(root []byte, proof *ics23.CommitmentProof, key []byte) bool {
+	if ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key) {
+		return true
+	}
+	// ics23 fails the proofs with a neighbor of an empty value
+	nonExist := nonExistenceProof(ics23.Decompress(proof), key)
+	if nonExist == nil || !(hasEmptyValue(nonExist.Left) || hasEmptyValue(nonExist.Right)) {
+		return false
+	}
+	return verifyNonExistence(root, nonExist, key) == nil
+}
+
+// VerifyBatchMembership returns true iff the batch proof proves the existence of all the given
+// key/value pairs in the tree with the given root hash.
+func VerifyBatchMembership(root []byte, proof *ics23.CommitmentProof, items map[string][]byte) bool {
+	proof = ics23.Decompress(proof)
+	for key, value := range items {
+		if !VerifyMembership(root, proof, []byte(key), value) {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyBatchNonMembership returns true iff the batch proof proves the absence of all the given
+// keys in the tree with the given root hash.
+func VerifyBatchNonMembership(root []byte, proof *ics23.CommitmentProof, keys [][]byte) bool {
+	proof = ics23.Decompress(proof)
+	for _, key := range keys {
+		if !VerifyNonMembership(root, proof, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// existenceProof returns the existence proof of the key in a decompressed proof, if any.
+func existenceProof(proof *ics23.CommitmentProof, key []byte) *ics23.ExistenceProof {
+	if exist := proof.GetExist(); exist != nil && bytes.Equal(exist.Key, key) {
+		return exist
+	}
+	for _, entry := range proof.GetBatch().GetEntries() {
+		if exist := entry.GetExist(); exist != nil && bytes.Equal(exist.Key, key) {
+			return exist
+		}
+	}
+	return nil
+}
+
+// nonExistenceProof returns the non-existence proof of the key in a decompressed proof, i.e. the
+// one with neighbors around the key, if any.
+func nonExistenceProof(proof *ics23.CommitmentProof, key []byte) *ics23.NonExistenceProof {
+	around := func(nonExist *ics23.NonExistenceProof) bool {
+		return (nonExist.Left == nil || bytes.Compare(nonExist.Left.Key, key) < 0) &&
+			(nonExist.Right == nil || bytes.Compare(nonExist.Right.Key, key) > 0)
+	}
+	if nonExist := proof.GetNonexist(); nonExist != nil && around(nonExist) {
+		return nonExist
+	}
+	for _, entry := range proof.GetBatch().GetEntries() {
+		if nonExist := entry.GetNonexist(); nonExist != nil && around(nonExist) {
+			return nonExist
+		}
+	}
+	return nil
+}
+
+func hasEmptyValue(exist *ics23.ExistenceProof) bool {
+	return exist != nil && len(exist.Value) == 0
+}
+
+// verifyExistence is ics23.ExistenceProof.Verify with the IAVL spec, which also verifies the
+// proofs of empty values.
+func verifyExistence(root []byte, exist *ics23.ExistenceProof, key, value []byte) error {
+	if len(value) > 0 || len(exist.Value) > 0 {
+		return exist.Verify(ics23.IavlSpec, root, key, value)
+	}
+	if err := exist.CheckAgainstSpec(ics23.IavlSpec); err != nil {
+		return err
+	}
+	if !bytes.Equal(key, exist.Key) {
+		return errors.New("provided key doesn't match proof")
+	}
+
+	// The spec checked that the value is prehashed with SHA-256, so the leaf hash is the one of
+	// the leaf op taking the hash of the value as is, which ics23 applies to non-empty values.
+	leaf := &ics23.LeafOp{
+		Hash:         exist.Leaf.Hash,
+		PrehashKey:   exist.Leaf.PrehashKey,
+		PrehashValue: ics23.HashOp_NO_HASH,
+		Length:       exist.Leaf.Length,
+		Prefix:       exist.Leaf.Prefix,
+	}
+	valueHash := sha256.Sum256(nil)
+	hash, err := leaf.Apply(exist.Key, valueHash[:])
+	if err != nil {
+		return err
+	}
+	for _, step := range exist.Path {
+		if hash, err = step.Apply(hash); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(root, hash) {
+		return errors.New("calculated root doesn't match provided root")
+	}
+	return nil
+}
+
+// verifyNonExistence is ics23.NonExistenceProof.Verify with the IAVL spec, which also verifies the
+// proofs with neighbors of empty values.
+func verifyNonExistence(root []byte, nonExist *ics23.NonExistenceProof, key []byte) error {
+	left, right := nonExist.Left, nonExist.Right
+	if left == nil && right == nil {
+		return errors.New("both left and right proofs missing")
+	}
+	if left != nil {
+		if err := verifyExistence(root, left, left.Key, left.Value); err != nil {
+			return err
+		}
+		if bytes.Compare(key, left.Key) <= 0 {
+			return errors.New("key is not right of left proof")
+		}
+	}
+	if right != nil {
+		if err := verifyExistence(root, right, right.Key, right.Value); err != nil {
+			return err
+		}
+		if bytes.Compare(key, right.Key) >= 0 {
+			return errors.New("key is not left of right proof")
+		}
+	}
+
+	spec := ics23.IavlSpec.InnerSpec
+	switch {
+	case left == nil:
+		if !ics23.IsLeftMost(spec, right.Path) {
+			return errors.New("left proof missing, right proof must be left-most")
+		}
+	case right == nil:
+		if !ics23.IsRightMost(spec, left.Path) {
+			return errors.New("right proof missing, left proof must be right-most")
+		}
+	default:
+		if !ics23.IsLeftNeighbor(spec, left.Path, right.Path) {
+			return errors.New("left and right proofs must be neighbors")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package verify_test
+
+import (
+	"testing"
+
+	ics23 "github.com/cosmos/ics23/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/verify"
+)
+
+func TestVerify(t *testing.T) {
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 0, false, iavl.NewNopLogger())
+	for _, key := range []string{"a", "c", "e"} {
+		_, err := tree.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	root, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	exist, err := tree.GetMembershipProof([]byte("c"))
+	require.NoError(t, err)
+	require.True(t, verify.VerifyMembership(root, exist, []byte("c"), []byte("value-c")))
+	require.False(t, verify.VerifyMembership(root, exist, []byte("c"), []byte("other")))
+	require.False(t, verify.VerifyMembership([]byte("wrong root"), exist, []byte("c"), []byte("value-c")))
+	require.False(t, verify.VerifyNonMembership(root, exist, []byte("c")))
+
+	nonexist, err := tree.GetNonMembershipProof([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, verify.VerifyNonMembership(root, nonexist, []byte("b")))
+	require.False(t, verify.VerifyNonMembership(root, nonexist, []byte("d")))
+
+	batch, err := ics23.CombineProofs([]*ics23.CommitmentProof{exist, nonexist})
+	require.NoError(t, err)
+	require.True(t, verify.VerifyBatchMembership(root, batch, map[string][]byte{"c": []byte("value-c")}))
+	require.True(t, verify.VerifyBatchNonMembership(root, batch, [][]byte{[]byte("b")}))
+	require.False(t, verify.VerifyBatchNonMembership(root, batch, [][]byte{[]byte("a")}))
+}
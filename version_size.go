@@ -0,0 +1,63 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// SizeAtVersion returns the number of keys of the saved version. It reads the size recorded by
+// SaveVersion, so it doesn't need the root of the version, e.g. after it was pruned. Versions
+// saved by releases without the records fall back to their root.
+func (tree *MutableTree) SizeAtVersion(version int64) (int64, error) {
+	size, _, found, err := tree.ndb.getVersionSize(version)
+	if err != nil || found {
+		return size, err
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return 0, err
+	}
+	return t.Size(), nil
+}
+
+// SizeDeltaAtVersion returns the change of the number of keys by the saved version, relative to
+// the version saved before it, e.g. to chart the state growth. It returns ErrVersionDoesNotExist
+// for versions without a size record.
+func (tree *MutableTree) SizeDeltaAtVersion(version int64) (int64, error) {
+	_, delta, found, err := tree.ndb.getVersionSize(version)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("%w: no size record for version %d", ErrVersionDoesNotExist, version)
+	}
+	return delta, nil
+}
+
+// versionSizeValue encodes the size of a version and its delta as varints.
+func versionSizeValue(size, delta int64) []byte {
+	return binary.AppendVarint(binary.AppendVarint(nil, size), delta)
+}
+
+// setVersionSizeToBatch records the size of the version being saved, and its delta to the
+// previous size. Requires changes to be committed after to be persisted.
+func (ndb *nodeDB) setVersionSizeToBatch(version, size, prevSize int64) error {
+	return ndb.batch.Set(versionSizeKeyFormat.Key(version), versionSizeValue(size, size-prevSize))
+}
+
+// getVersionSize returns the recorded size of the version and its delta, if found.
+func (ndb *nodeDB) getVersionSize(version int64) (size, delta int64, found bool, err error) {
+	bz, err := ndb.db.Get(versionSizeKeyFormat.Key(version))
+	if err != nil || bz == nil {
+		return 0, 0, false, err
+	}
+	size, n := binary.Varint(bz)
+	if n <= 0 {
+		return 0, 0, false, fmt.Errorf("invalid size record of version %d", version)
+	}
+	delta, m := binary.Varint(bz[n:])
+	if m <= 0 {
+		return 0, 0, false, fmt.Errorf("invalid size record of version %d", version)
+	}
+	return size, delta, true, nil
+}
@@ -0,0 +1,73 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// VersionTime returns the time the version was saved at, as recorded by SaveVersion with
+// Options.Clock, e.g. to map a time to a version. The records are not pruned with their versions.
+// It returns ErrVersionDoesNotExist for versions without a record, e.g. saved by releases without
+// them.
+func (tree *MutableTree) VersionTime(version int64) (time.Time, error) {
+	saved, found, err := tree.ndb.getVersionTime(version)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !found {
+		return time.Time{}, fmt.Errorf("%w: no time record for version %d", ErrVersionDoesNotExist, version)
+	}
+	return saved, nil
+}
+
+// versionTimeValue encodes the time of a version as its Unix time in nanoseconds.
+func versionTimeValue(saved time.Time) []byte {
+	return binary.AppendVarint(nil, saved.UnixNano())
+}
+
+// setVersionTimeToBatch records the time the version is saved at. Requires changes to be
+// committed after to be persisted.
+func (ndb *nodeDB) setVersionTimeToBatch(version int64) error {
+	return ndb.batch.Set(versionTimeKeyFormat.Key(version), versionTimeValue(ndb.opts.now()))
+}
+
+// getVersionTime returns the recorded time of the version, if found.
+func (ndb *nodeDB) getVersionTime(version int64) (time.Time, bool, error) {
+	bz, err := ndb.db.Get(versionTimeKeyFormat.Key(version))
+	if err != nil || bz == nil {
+		return time.Time{}, false, err
+	}
+	nanos, n := binary.Varint(bz)
+	if n <= 0 {
+		return time.Time{}, false, fmt.Errorf("invalid time record of version %d", version)
+	}
+	return time.Unix(0, nanos), true, nil
+}
+
+// lastVersionSavedBefore returns the last version of [fromVersion, toVersion] which was saved before
+// the cutoff along with all the versions before it, or fromVersion-1 if there is none. A version
+// without a time record is older than the next recorded one. The records are read from
+// fromVersion up to the first one at or after the cutoff, so a prune keeping up with the saves
+// reads few of them.
+func (ndb *nodeDB) lastVersionSavedBefore(fromVersion, toVersion int64, cutoff time.Time) (int64, error) {
+	last := fromVersion - 1
+	err := ndb.traverseRange(versionTimeKeyFormat.Key(fromVersion), versionTimeKeyFormat.Key(toVersion+1), func(k, v []byte) error {
+		var version int64
+		versionTimeKeyFormat.Scan(k, &version)
+		nanos, n := binary.Varint(v)
+		if n <= 0 {
+			return fmt.Errorf("invalid time record of version %d", version)
+		}
+		if !time.Unix(0, nanos).Before(cutoff) {
+			return errStopTraverse
+		}
+		last = version
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopTraverse) {
+		return 0, err
+	}
+	return last, nil
+}
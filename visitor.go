@@ -0,0 +1,95 @@
+package iavl
+
+import "fmt"
+
+// TraversalOrder is the order in which Accept visits the nodes of a tree.
+type TraversalOrder int
+
+const (
+	// PreOrder visits a node before its children (NLR).
+	PreOrder TraversalOrder = iota
+	// InOrder visits the left subtree, then the node, then the right subtree (LNR).
+	InOrder
+	// PostOrder visits a node after its children (LRN), the order used by Export.
+	PostOrder
+)
+
+// NodeInfo is a read-only view of a node given to a NodeVisitor.
+type NodeInfo struct {
+	Key     []byte
+	Value   []byte // nil for inner nodes
+	Hash    []byte // nil for nodes of the working tree which are not saved yet
+	Version int64  // 0 for nodes of the working tree which are not saved yet
+	Height  int8
+	Size    int64
+	Depth   int // distance from the root, which has depth 0
+}
+
+// IsLeaf returns true if the node is a leaf node.
+func (n NodeInfo) IsLeaf() bool {
+	return n.Height == 0
+}
+
+// NodeVisitor receives the nodes of a tree traversed by Accept. Returning true from either method
+// stops the traversal. The byte slices must not be modified, since they point to data stored
+// within IAVL.
+type NodeVisitor interface {
+	VisitInner(node NodeInfo) (stop bool)
+	VisitLeaf(node NodeInfo) (stop bool)
+}
+
+// Accept traverses the tree in the given order, calling the visitor for each inner and leaf node.
+// Returns true if stopped by the visitor, false otherwise.
+func (t *ImmutableTree) Accept(v NodeVisitor, order TraversalOrder) (stopped bool, err error) {
+	if order < PreOrder || order > PostOrder {
+		return false, fmt.Errorf("invalid traversal order %d", order)
+	}
+	if t.root == nil {
+		return false, nil
+	}
+	return t.accept(t.root, 0, v, order)
+}
+
+func (t *ImmutableTree) accept(node *Node, depth int, v NodeVisitor, order TraversalOrder) (bool, error) {
+	info := NodeInfo{
+		Key:    node.key,
+		Value:  node.value,
+		Height: node.subtreeHeight,
+		Size:   node.size,
+		Depth:  depth,
+	}
+	if node.nodeKey != nil {
+		info.Hash = node.hash
+		info.Version = node.nodeKey.version
+	}
+
+	if node.isLeaf() {
+		return v.VisitLeaf(info), nil
+	}
+
+	leftNode, err := node.getLeftNode(t)
+	if err != nil {
+		return false, err
+	}
+	rightNode, err := node.getRightNode(t)
+	if err != nil {
+		return false, err
+	}
+
+	if order == PreOrder && v.VisitInner(info) {
+		return true, nil
+	}
+	if stopped, err := t.accept(leftNode, depth+1, v, order); stopped || err != nil {
+		return stopped, err
+	}
+	if order == InOrder && v.VisitInner(info) {
+		return true, nil
+	}
+	if stopped, err := t.accept(rightNode, depth+1, v, order); stopped || err != nil {
+		return stopped, err
+	}
+	if order == PostOrder && v.VisitInner(info) {
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,82 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingVisitor struct {
+	nodes []NodeInfo
+	limit int
+}
+
+func (v *recordingVisitor) VisitInner(node NodeInfo) bool {
+	v.nodes = append(v.nodes, node)
+	return v.limit > 0 && len(v.nodes) >= v.limit
+}
+
+func (v *recordingVisitor) VisitLeaf(node NodeInfo) bool {
+	return v.VisitInner(node)
+}
+
+func TestAccept(t *testing.T) {
+	tree := getTestTree(0)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		_, err := tree.Set([]byte(key), []byte("value-"+key))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	// post-order visits must match the export order
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	post := &recordingVisitor{}
+	stopped, err := itree.Accept(post, PostOrder)
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.Len(t, post.nodes, 9)
+	for _, node := range post.nodes {
+		exported, err := exporter.Next()
+		require.NoError(t, err)
+		require.Equal(t, exported.Key, node.Key)
+		require.Equal(t, exported.Height, node.Height)
+		require.Equal(t, exported.Version, node.Version)
+		require.NotEmpty(t, node.Hash)
+	}
+	require.Equal(t, itree.Hash(), post.nodes[len(post.nodes)-1].Hash)
+	require.Equal(t, 0, post.nodes[len(post.nodes)-1].Depth)
+
+	pre := &recordingVisitor{}
+	_, err = itree.Accept(pre, PreOrder)
+	require.NoError(t, err)
+	require.Equal(t, itree.Hash(), pre.nodes[0].Hash)
+	require.Equal(t, int64(5), pre.nodes[0].Size)
+
+	// in-order visits leaves in ascending key order, with inner nodes between them
+	in := &recordingVisitor{}
+	_, err = itree.Accept(in, InOrder)
+	require.NoError(t, err)
+	leaves := []string{}
+	for i, node := range in.nodes {
+		require.Equal(t, i%2 == 0, node.IsLeaf())
+		if node.IsLeaf() {
+			leaves = append(leaves, string(node.Key))
+			require.Equal(t, "value-"+string(node.Key), string(node.Value))
+		}
+	}
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, leaves)
+
+	limited := &recordingVisitor{limit: 3}
+	stopped, err = itree.Accept(limited, PreOrder)
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Len(t, limited.nodes, 3)
+
+	_, err = itree.Accept(pre, TraversalOrder(42))
+	require.Error(t, err)
+}